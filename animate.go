@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/png"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// maxAnimationPixels is the maximum pixels of the canvas coalescing the animation frames
+const maxAnimationPixels = 50 * 1000 * 1000
+
+// isAnimationControlled reports whether any animated output frame control is defined
+func isAnimationControlled(o ImageOptions) bool {
+	return o.Frames != 0 || o.FrameStep != 0 || o.Loop != 0 || o.Duration != 0
+}
+
+// Animate returns the operation processing every frame of animated GIF images with the given
+// operation, instead of flattening them to their first frame, limited to the first frames,
+// subsampled every frame steps and capped to the total duration, reducing the output cost and size.
+func Animate(operation Operation) Operation {
+	return func(buf []byte, o ImageOptions) (Image, error) {
+		if bimg.DetermineImageType(buf) != bimg.GIF || (o.Type != "" && ImageType(o.Type) != bimg.GIF) {
+			return operation(buf, o)
+		}
+		if o.Frames < 0 || o.FrameStep < 0 || o.Duration < 0 || o.Loop < -1 {
+			return Image{}, NewError("Animation frame controls must be positive numbers", BadRequest)
+		}
+
+		anim, err := gif.DecodeAll(bytes.NewReader(buf))
+		if err != nil || len(anim.Image) < 2 {
+			return operation(buf, o)
+		}
+
+		canvas, err := newFrameCanvas(anim)
+		if err != nil {
+			return Image{}, err
+		}
+		frames, delays, palettes := selectFrames(anim, o)
+
+		frameOpts := o
+		frameOpts.Type = "png"
+
+		out := &gif.GIF{LoopCount: loopCount(anim.LoopCount, o.Loop)}
+		for i, index := range frames {
+			var body bytes.Buffer
+			if err := png.Encode(&body, canvas.render(index)); err != nil {
+				return Image{}, err
+			}
+
+			image, err := operation(body.Bytes(), frameOpts)
+			if err != nil || image.Mime != "image/png" {
+				return image, err
+			}
+
+			paletted, err := palettedFrame(image.Body, palettes[i])
+			if err != nil {
+				return Image{}, err
+			}
+
+			out.Image = append(out.Image, paletted)
+			out.Delay = append(out.Delay, delays[i])
+			out.Disposal = append(out.Disposal, gif.DisposalBackground)
+		}
+
+		var body bytes.Buffer
+		if err := gif.EncodeAll(&body, out); err != nil {
+			return Image{}, err
+		}
+		return Image{Body: body.Bytes(), Mime: "image/gif"}, nil
+	}
+}
+
+// frameCanvas renders the animation frames, usually partial images, into full frames, in order,
+// honouring the frames disposal methods. The canvas is reused by every frame, so the memory does
+// not grow with the frames count.
+type frameCanvas struct {
+	anim     *gif.GIF
+	canvas   *image.RGBA
+	previous *image.RGBA
+	next     int
+}
+
+// newFrameCanvas returns the canvas of the given animation, limited to the maximum pixels
+func newFrameCanvas(anim *gif.GIF) (*frameCanvas, error) {
+	bounds := image.Rect(0, 0, anim.Config.Width, anim.Config.Height)
+	if bounds.Empty() {
+		bounds = image.Rectangle{}
+		for _, frame := range anim.Image {
+			bounds = bounds.Union(frame.Bounds())
+		}
+	}
+	if pixels := bounds.Dx() * bounds.Dy(); pixels > maxAnimationPixels {
+		return nil, NewError(fmt.Sprintf("Animation exceeds the maximum allowed pixels: %d > %d", pixels, maxAnimationPixels), TooLarge)
+	}
+	return &frameCanvas{anim: anim, canvas: image.NewRGBA(bounds)}, nil
+}
+
+// render returns the full frame of the given index, which must not precede the last rendered
+// one. The returned frame is only valid until the next render.
+func (c *frameCanvas) render(index int) *image.RGBA {
+	for ; c.next <= index; c.next++ {
+		if c.next > 0 {
+			c.dispose(c.next - 1)
+		}
+		frame := c.anim.Image[c.next]
+		if c.disposal(c.next) == gif.DisposalPrevious {
+			if c.previous == nil {
+				c.previous = copyCanvas(c.canvas)
+			} else {
+				copy(c.previous.Pix, c.canvas.Pix)
+			}
+		}
+		draw.Draw(c.canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+	}
+	return c.canvas
+}
+
+// dispose applies the disposal method of the given rendered frame
+func (c *frameCanvas) dispose(index int) {
+	switch c.disposal(index) {
+	case gif.DisposalBackground:
+		draw.Draw(c.canvas, c.anim.Image[index].Bounds(), image.Transparent, image.ZP, draw.Src)
+	case gif.DisposalPrevious:
+		c.canvas, c.previous = c.previous, c.canvas
+	}
+}
+
+// disposal returns the disposal method of the given frame
+func (c *frameCanvas) disposal(index int) byte {
+	if index < len(c.anim.Disposal) {
+		return c.anim.Disposal[index]
+	}
+	return 0
+}
+
+// selectFrames returns the indexes of the animation frames, their delays and palettes, subsampled
+// every frame steps, merging the delays of the skipped frames to preserve the playback speed,
+// limited to the first frames and capped to the total duration in seconds.
+func selectFrames(anim *gif.GIF, o ImageOptions) ([]int, []int, []color.Palette) {
+	step := o.FrameStep
+	if step < 1 {
+		step = 1
+	}
+
+	var frames []int
+	var delays []int
+	var palettes []color.Palette
+	total := 0
+	for i := range anim.Image {
+		delay := 0
+		if i < len(anim.Delay) {
+			delay = anim.Delay[i]
+		}
+		if i%step != 0 {
+			delays[len(delays)-1] += delay
+			total += delay
+			continue
+		}
+		if o.Frames > 0 && len(frames) == o.Frames {
+			break
+		}
+		if o.Duration > 0 && len(frames) > 0 && float64(total) >= o.Duration*100 {
+			break
+		}
+		frames = append(frames, i)
+		delays = append(delays, delay)
+		palettes = append(palettes, anim.Image[i].Palette)
+		total += delay
+	}
+	return frames, delays, palettes
+}
+
+// loopCount returns the GIF loop count by the given number of times the animation plays,
+// where -1 loops forever, or the source loop count if undefined.
+func loopCount(source, loop int) int {
+	switch {
+	case loop == 0:
+		return source
+	case loop < 0:
+		return 0
+	case loop == 1:
+		return -1
+	}
+	return loop - 1
+}
+
+// palettedFrame decodes the processed PNG frame into a paletted frame of the source frame palette
+func palettedFrame(buf []byte, p color.Palette) (*image.Paletted, error) {
+	img, err := png.Decode(bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	frame := image.NewPaletted(img.Bounds().Sub(img.Bounds().Min), p)
+	draw.Draw(frame, frame.Bounds(), img, img.Bounds().Min, draw.Src)
+	return frame, nil
+}
+
+// copyCanvas returns a copy of the given canvas
+func copyCanvas(canvas *image.RGBA) *image.RGBA {
+	copied := image.NewRGBA(canvas.Bounds())
+	copy(copied.Pix, canvas.Pix)
+	return copied
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"testing"
+)
+
+func TestSelectFrames(t *testing.T) {
+	anim, _ := gif.DecodeAll(bytes.NewReader(testGIF(t)))
+
+	cases := []struct {
+		options ImageOptions
+		delays  []int
+	}{
+		{ImageOptions{}, []int{10, 10, 10, 10}},
+		{ImageOptions{Frames: 2}, []int{10, 10}},
+		{ImageOptions{FrameStep: 2}, []int{20, 20}},
+		{ImageOptions{FrameStep: 3}, []int{30, 10}},
+		{ImageOptions{Duration: 0.2}, []int{10, 10}},
+		{ImageOptions{Duration: 0.01}, []int{10}},
+		{ImageOptions{FrameStep: 2, Frames: 1}, []int{20}},
+	}
+
+	for _, c := range cases {
+		frames, delays, palettes := selectFrames(anim, c.options)
+		if len(frames) != len(c.delays) || len(palettes) != len(c.delays) {
+			t.Errorf("Invalid frames count of %+v: %d", c.options, len(frames))
+			continue
+		}
+		for i, delay := range delays {
+			if delay != c.delays[i] {
+				t.Errorf("Invalid delays of %+v: %v", c.options, delays)
+				break
+			}
+		}
+	}
+}
+
+func TestFrameCanvas(t *testing.T) {
+	red, blue := color.NRGBA{0xff, 0, 0, 0xff}, color.NRGBA{0, 0, 0xff, 0xff}
+	p := color.Palette{color.Transparent, red, blue}
+	frame := func(r image.Rectangle, index uint8) *image.Paletted {
+		img := image.NewPaletted(r, p)
+		for i := range img.Pix {
+			img.Pix[i] = index
+		}
+		return img
+	}
+	anim := &gif.GIF{
+		Image:    []*image.Paletted{frame(image.Rect(0, 0, 2, 1), 1), frame(image.Rect(1, 0, 2, 1), 2), frame(image.Rect(0, 0, 1, 1), 0)},
+		Disposal: []byte{gif.DisposalNone, gif.DisposalPrevious, gif.DisposalBackground},
+	}
+
+	canvas, err := newFrameCanvas(anim)
+	if err != nil {
+		t.Fatalf("Cannot create the frame canvas: %s", err)
+	}
+	assertPixel(t, "frame 1", canvas.render(1), 1, 0, blue)
+	img := canvas.render(2)
+	assertPixel(t, "frame 2", img, 0, 0, red)
+	assertPixel(t, "frame 2", img, 1, 0, red)
+
+	anim.Config.Width, anim.Config.Height = 10000, 10000
+	if _, err := newFrameCanvas(anim); err == nil {
+		t.Error("Expected an error with an animation canvas exceeding the maximum pixels")
+	}
+}
+
+func TestLoopCount(t *testing.T) {
+	cases := []struct{ source, loop, expected int }{
+		{3, 0, 3},
+		{3, -1, 0},
+		{0, 1, -1},
+		{0, 3, 2},
+	}
+
+	for _, c := range cases {
+		if n := loopCount(c.source, c.loop); n != c.expected {
+			t.Errorf("Invalid loop count of %d plays: %d", c.loop, n)
+		}
+	}
+}
+
+func TestAnimate(t *testing.T) {
+	image, err := Animate(Resize)(testGIF(t), ImageOptions{Width: 15, Height: 10, Force: true, Frames: 3, Loop: 2})
+	if err != nil {
+		t.Fatalf("Cannot process the animation: %s", err)
+	}
+	if image.Mime != "image/gif" {
+		t.Fatalf("Invalid image MIME type: %s", image.Mime)
+	}
+
+	anim, err := gif.DecodeAll(bytes.NewReader(image.Body))
+	if err != nil {
+		t.Fatalf("Cannot decode the animation: %s", err)
+	}
+	if len(anim.Image) != 3 {
+		t.Errorf("Invalid frames count: %d", len(anim.Image))
+	}
+	if anim.LoopCount != 1 {
+		t.Errorf("Invalid loop count: %d", anim.LoopCount)
+	}
+	if size := anim.Image[0].Bounds().Size(); size.X != 15 || size.Y != 10 {
+		t.Errorf("Invalid frame size: %v", size)
+	}
+}
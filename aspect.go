@@ -0,0 +1,67 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// parseAspectRatio parses the given width to height aspect ratio, such as 16:9 or 1.5
+func parseAspectRatio(val string) (float64, error) {
+	err := NewError("Invalid aspect ratio: "+val, BadRequest)
+
+	parts := strings.Split(val, ":")
+	if len(parts) > 2 {
+		return 0, err
+	}
+	ratio, e := strconv.ParseFloat(parts[0], 64)
+	if e != nil {
+		return 0, err
+	}
+	if len(parts) == 2 {
+		height, e := strconv.ParseFloat(parts[1], 64)
+		if e != nil || height <= 0 {
+			return 0, err
+		}
+		ratio /= height
+	}
+	if ratio <= 0 || math.IsInf(ratio, 0) || math.IsNaN(ratio) {
+		return 0, err
+	}
+	return ratio, nil
+}
+
+// aspectRatioOptions defines the output dimensions by the aspect ratio param: the missing
+// dimension of the defined one, or the largest area of the source image of that ratio,
+// so clients do not need to know the source image dimensions in advance.
+func aspectRatioOptions(buf []byte, o ImageOptions) (ImageOptions, error) {
+	ratio, err := parseAspectRatio(o.AspectRatio)
+	if err != nil {
+		return o, err
+	}
+
+	switch {
+	case o.Width > 0 && o.Height > 0:
+		return o, NewError("Aspect ratio cannot be combined with both width and height", BadRequest)
+	case o.Width > 0:
+		o.Height = int(math.Max(1, float64(o.Width)/ratio+0.5))
+	case o.Height > 0:
+		o.Width = int(math.Max(1, float64(o.Height)*ratio+0.5))
+	default:
+		meta, err := bimg.Metadata(buf)
+		if err != nil {
+			return o, NewError("Cannot retrieve image metadata: "+err.Error(), BadRequest)
+		}
+		width, height := meta.Size.Width, meta.Size.Height
+		if meta.Orientation >= 5 && !o.NoRotation {
+			width, height = height, width
+		}
+		o.Width, o.Height = width, int(math.Max(1, float64(width)/ratio+0.5))
+		if o.Height > height {
+			o.Width, o.Height = int(math.Max(1, float64(height)*ratio+0.5)), height
+		}
+	}
+	return o, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestParseAspectRatio(t *testing.T) {
+	cases := []struct {
+		value    string
+		expected float64
+	}{
+		{"16:9", 16.0 / 9},
+		{"1:1", 1},
+		{"1.5", 1.5},
+		{"3:4", 0.75},
+	}
+	for _, c := range cases {
+		if ratio, err := parseAspectRatio(c.value); err != nil || ratio != c.expected {
+			t.Errorf("Invalid aspect ratio of %s: %g", c.value, ratio)
+		}
+	}
+
+	for _, value := range []string{"", "16:0", "a:b", "1:2:3", "-1:2", "0"} {
+		if ratio, err := parseAspectRatio(value); err == nil {
+			t.Errorf("Expected an error with %q aspect ratio: %g", value, ratio)
+		}
+	}
+}
+
+func TestAspectRatioOptions(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+
+	cases := []struct {
+		opts          ImageOptions
+		width, height int
+	}{
+		{ImageOptions{AspectRatio: "16:9"}, 550, 309},
+		{ImageOptions{AspectRatio: "1:2"}, 370, 740},
+		{ImageOptions{AspectRatio: "16:9", Width: 320}, 320, 180},
+		{ImageOptions{AspectRatio: "4:3", Height: 300}, 400, 300},
+	}
+	for _, c := range cases {
+		o, err := aspectRatioOptions(buf, c.opts)
+		if err != nil {
+			t.Fatalf("Cannot apply the aspect ratio: %s", err)
+		}
+		if o.Width != c.width || o.Height != c.height {
+			t.Errorf("Invalid %s dimensions: %dx%d != %dx%d", c.opts.AspectRatio, o.Width, o.Height, c.width, c.height)
+		}
+	}
+
+	if _, err := aspectRatioOptions(buf, ImageOptions{AspectRatio: "1:1", Width: 100, Height: 100}); err == nil {
+		t.Error("Expected an error with both width and height")
+	}
+}
+
+func TestAspectRatioCrop(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+	ts := testServer(func(w http.ResponseWriter, r *http.Request) {
+		imageHandler(w, r, buf, Crop, ServerOptions{}, nil)
+	})
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "?ar=16:9&gravity=north")
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	image, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err := assertSize(image, 550, 309); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Security relevant audit event types
+const (
+	AuditOriginDenied      = "origin_denied"
+	AuditClientIPDenied    = "client_ip_denied"
+	AuditInvalidAPIKey     = "invalid_api_key"
+	AuditInvalidSignature  = "invalid_signature"
+	AuditRateLimited       = "rate_limited"
+	AuditOversizedInput    = "oversized_input"
+	AuditModerationBlocked = "moderation_blocked"
+)
+
+// AuditEvent represents a security relevant event, such as a denied request.
+type AuditEvent struct {
+	Type       string    `json:"type"`
+	Message    string    `json:"message"`
+	ClientIP   string    `json:"clientIp"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	SourceHost string    `json:"sourceHost,omitempty"`
+	UserAgent  string    `json:"userAgent,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+// AuditError represents an image source error which must be audited.
+type AuditError struct {
+	Event   string
+	Message string
+}
+
+func (e AuditError) Error() string {
+	return e.Message
+}
+
+// NewAuditError creates a new audited error of the given event type.
+func NewAuditError(event, message string) AuditError {
+	return AuditError{event, message}
+}
+
+// Auditor writes the audit events as JSON lines into a stream separated
+// from the access log, optionally sending them to a webhook as well.
+type Auditor struct {
+	out     io.Writer
+	webhook string
+	mutex   sync.Mutex
+}
+
+// NewAuditor creates a new auditor. Both the stream and the webhook are optional.
+func NewAuditor(out io.Writer, webhook string) *Auditor {
+	return &Auditor{out: out, webhook: webhook}
+}
+
+// Audit records the given event.
+func (a *Auditor) Audit(event AuditEvent) {
+	body, _ := json.Marshal(event)
+
+	if a.out != nil {
+		a.mutex.Lock()
+		a.out.Write(append(body, '\n'))
+		a.mutex.Unlock()
+	}
+
+	if a.webhook != "" {
+		go func() {
+			if err := postJSON(a.webhook, body, nil); err != nil {
+				debug("cannot send audit event: %s", err)
+			}
+		}()
+	}
+}
+
+// NewAuditEvent creates a new audit event for the given request. As in error
+// reports, only the host is exposed from the image source URL.
+func NewAuditEvent(r *http.Request, event, message string) AuditEvent {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	e := AuditEvent{
+		Type:      event,
+		Message:   message,
+		ClientIP:  host,
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		UserAgent: r.UserAgent(),
+		Time:      time.Now().UTC(),
+	}
+	if u, err := url.Parse(r.URL.Query().Get("url")); err == nil {
+		e.SourceHost = u.Hostname()
+	}
+	return e
+}
+
+// audit records a security event for the given request, if audit mode is enabled.
+func audit(o ServerOptions, r *http.Request, event, message string) {
+	if o.Auditor == nil {
+		return
+	}
+	o.Auditor.Audit(NewAuditEvent(r, event, message))
+}
+
+// auditSourceError records the image source error, if it is security relevant.
+func auditSourceError(o ServerOptions, r *http.Request, err error) {
+	if e, ok := err.(AuditError); ok {
+		audit(o, r, e.Event, e.Message)
+	}
+}
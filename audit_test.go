@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAuditEvents(t *testing.T) {
+	out := &bytes.Buffer{}
+	opts := ServerOptions{
+		APIKey:      "secret",
+		Concurrency: 1,
+		Burst:       1,
+		Auditor:     NewAuditor(out, ""),
+	}
+
+	ts := httptest.NewServer(Middleware(healthController, opts))
+	defer ts.Close()
+
+	for i := 0; i < 3; i++ {
+		res, err := http.Get(ts.URL + "/health?key=secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+
+	res, err := http.Get(ts.URL + "/health?key=invalid&url=http://example.com/image.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 401 {
+		t.Fatalf("Invalid response status: %d", res.StatusCode)
+	}
+
+	events := map[string]AuditEvent{}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var event AuditEvent
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("Invalid audit event: %s", line)
+		}
+		events[event.Type] = event
+	}
+
+	if _, ok := events[AuditRateLimited]; !ok {
+		t.Errorf("Missing rate limit audit event: %s", out.String())
+	}
+
+	event, ok := events[AuditInvalidAPIKey]
+	if !ok {
+		t.Fatalf("Missing invalid API key audit event: %s", out.String())
+	}
+	if event.ClientIP != "127.0.0.1" || event.Path != "/health" || event.SourceHost != "example.com" {
+		t.Errorf("Invalid audit event: %#v", event)
+	}
+}
+
+func TestAuditSourceError(t *testing.T) {
+	out := &bytes.Buffer{}
+	opts := ServerOptions{Auditor: NewAuditor(out, "")}
+	req := httptest.NewRequest("GET", "/resize?url=http://foo.com/image.jpg", nil)
+
+	auditSourceError(opts, req, NewAuditError(AuditOriginDenied, "Not allowed remote URL origin: foo.com"))
+	auditSourceError(opts, req, ErrEmptyBody)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 1 || !strings.Contains(lines[0], `"type":"origin_denied"`) {
+		t.Fatalf("Invalid audit log: %s", out.String())
+	}
+}
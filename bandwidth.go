@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// bandwidthWriter limits the outbound bandwidth of the response bytes beyond the threshold
+// to the given rate in bytes per second, so a few huge transfers cannot saturate the network.
+// The write deadline of the connection is extended before writing every chunk, if supported by
+// the response writer, so the limited transfers are not interrupted by the server write timeout.
+type bandwidthWriter struct {
+	http.ResponseWriter
+	ctx          context.Context
+	rate         int
+	threshold    int
+	writeTimeout time.Duration
+	written      int
+	start        time.Time
+}
+
+// writeDeadliner is implemented by the response writers able to extend their write deadline
+type writeDeadliner interface {
+	SetWriteDeadline(time.Time) error
+}
+
+func (w *bandwidthWriter) Write(buf []byte) (int, error) {
+	written := 0
+	for len(buf) > 0 {
+		// Write the bytes up to the threshold at once, then chunks of a tenth of a second
+		size := w.threshold - w.written
+		if size <= 0 {
+			size = w.rate / 10
+			if size == 0 {
+				size = 1
+			}
+		}
+		if size > len(buf) {
+			size = len(buf)
+		}
+
+		if d, ok := w.ResponseWriter.(writeDeadliner); ok && w.writeTimeout > 0 && w.written >= w.threshold {
+			d.SetWriteDeadline(time.Now().Add(w.writeTimeout))
+		}
+		n, err := w.ResponseWriter.Write(buf[:size])
+		written += n
+		buf = buf[n:]
+		if err != nil {
+			return written, err
+		}
+		if w.start.IsZero() && w.written+n >= w.threshold {
+			w.start = time.Now()
+		}
+		w.written += n
+
+		if err := w.wait(); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Flush sends the buffered response bytes to the client, if supported by the response writer
+func (w *bandwidthWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// wait waits until the bytes written beyond the threshold are within the rate, or the request is done
+func (w *bandwidthWriter) wait() error {
+	if w.written <= w.threshold {
+		return nil
+	}
+	delay := w.start.Add(time.Duration(w.written-w.threshold) * time.Second / time.Duration(w.rate)).Sub(time.Now())
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-w.ctx.Done():
+		if w.ctx.Err() != context.DeadlineExceeded {
+			return w.ctx.Err()
+		}
+		// The processing deadline does not apply to the transfer
+		w.ctx = context.Background()
+		<-timer.C
+		return nil
+	}
+}
+
+// limitBandwidth limits the outbound bandwidth of every response beyond the bandwidth threshold
+func limitBandwidth(next http.Handler, o ServerOptions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&bandwidthWriter{
+			ResponseWriter: w,
+			ctx:            r.Context(),
+			rate:           o.MaxBandwidth,
+			threshold:      o.BandwidthThreshold,
+			writeTimeout:   time.Duration(o.HTTPWriteTimeout) * time.Second,
+		}, r)
+	})
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLimitBandwidth(t *testing.T) {
+	body := bytes.Repeat([]byte("x"), 300)
+	handler := limitBandwidth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}), ServerOptions{MaxBandwidth: 1000, BandwidthThreshold: 100})
+
+	w := httptest.NewRecorder()
+	start := time.Now()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if elapsed := time.Since(start); elapsed < 180*time.Millisecond || elapsed > time.Second {
+		t.Errorf("Invalid limited transfer duration of 200 bytes at 1000 bytes/s: %s", elapsed)
+	}
+	if !bytes.Equal(w.Body.Bytes(), body) {
+		t.Errorf("Invalid response body of %d bytes", w.Body.Len())
+	}
+
+	start = time.Now()
+	limitBandwidth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body[:100])
+	}), ServerOptions{MaxBandwidth: 1, BandwidthThreshold: 100}).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Unexpected limited transfer below the threshold: %s", elapsed)
+	}
+}
+
+func TestLimitBandwidthCanceled(t *testing.T) {
+	handler := limitBandwidth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := w.Write(make([]byte, 1000)); err != context.Canceled {
+			t.Errorf("Expected canceled transfer error: %v", err)
+		}
+	}), ServerOptions{MaxBandwidth: 10, BandwidthThreshold: 0})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Invalid canceled transfer duration: %s", elapsed)
+	}
+}
+
+// deadlineRecorder records the write deadlines of the response
+type deadlineRecorder struct {
+	*httptest.ResponseRecorder
+	deadlines []time.Time
+}
+
+func (r *deadlineRecorder) SetWriteDeadline(deadline time.Time) error {
+	r.deadlines = append(r.deadlines, deadline)
+	return nil
+}
+
+func TestLimitBandwidthWriteDeadline(t *testing.T) {
+	handler := limitBandwidth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 300))
+		w.(http.Flusher).Flush()
+	}), ServerOptions{MaxBandwidth: 1000, BandwidthThreshold: 100, HTTPWriteTimeout: 1})
+
+	w := &deadlineRecorder{ResponseRecorder: httptest.NewRecorder()}
+	start := time.Now()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if len(w.deadlines) != 2 {
+		t.Fatalf("Invalid number of extended write deadlines: %d", len(w.deadlines))
+	}
+	if last := w.deadlines[len(w.deadlines)-1]; last.Sub(start) < time.Second+90*time.Millisecond {
+		t.Errorf("The write deadline should be extended per chunk: %s", last.Sub(start))
+	}
+	if !w.Flushed {
+		t.Error("Expected the flushed response")
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const benchUsage = `imaginary bench %s
+
+Replays a list of request URLs, or synthesizes typical image operations,
+against a running imaginary server or an in-process one.
+
+Usage:
+  imaginary bench -image ./testdata/large.jpg
+  imaginary bench -image ./testdata/large.jpg -n 1000 -c 10
+  imaginary bench -target http://localhost:8088 -urls ./requests.txt
+
+Options:
+  -target <url>   Base URL of a running imaginary server [default: in-process server]
+  -urls <path>    File with the request URLs or paths to replay, one per line
+  -image <path>   Image to send as POST payload. Required to synthesize operations
+  -n <num>        Total number of requests [default: 100]
+  -c <num>        Number of concurrent requests [default: 4]
+`
+
+// benchOperations defines the synthesized operations used when no URLs file is provided.
+var benchOperations = []string{
+	"/resize?width=300",
+	"/resize?width=800&height=600",
+	"/crop?width=300&height=260",
+	"/thumbnail?width=100",
+	"/fit?width=400&height=400",
+	"/convert?type=webp",
+	"/convert?type=png",
+	"/blur?sigma=5",
+}
+
+// BenchRequest represents a single request to perform during the benchmark.
+type BenchRequest struct {
+	Method string
+	URL    string
+	Body   []byte
+}
+
+// BenchResult stores the outcome of a single benchmark request.
+type BenchResult struct {
+	Latency time.Duration
+	Status  int
+	Bytes   int64
+	Err     error
+}
+
+// BenchReport summarizes the benchmark results.
+type BenchReport struct {
+	Requests   int
+	Errors     int
+	Bytes      int64
+	Duration   time.Duration
+	Throughput float64
+	Min        time.Duration
+	Mean       time.Duration
+	P50        time.Duration
+	P90        time.Duration
+	P99        time.Duration
+	Max        time.Duration
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+func runBench(args []string) {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	target := flags.String("target", "", "Base URL of a running imaginary server")
+	urlsFile := flags.String("urls", "", "File with the request URLs or paths to replay, one per line")
+	imageFile := flags.String("image", "", "Image to send as POST payload")
+	total := flags.Int("n", 100, "Total number of requests")
+	concurrency := flags.Int("c", 4, "Number of concurrent requests")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, benchUsage, Version)
+	}
+	flags.Parse(args)
+
+	var image []byte
+	if *imageFile != "" {
+		buf, err := ioutil.ReadFile(*imageFile)
+		if err != nil {
+			exitWithError("cannot read benchmark image: %s", err)
+		}
+		image = buf
+	}
+
+	paths := benchOperations
+	if *urlsFile != "" {
+		lines, err := readBenchURLs(*urlsFile)
+		if err != nil {
+			exitWithError("cannot read benchmark URLs: %s", err)
+		}
+		paths = lines
+	} else if image == nil {
+		exitWithError("-image flag is required to synthesize operations")
+	}
+	if len(paths) == 0 {
+		exitWithError("no benchmark URLs to replay")
+	}
+
+	if *target == "" {
+		addr, err := startBenchServer()
+		if err != nil {
+			exitWithError("cannot start the in-process server: %s", err)
+		}
+		*target = addr
+	}
+
+	requests := buildBenchRequests(*target, paths, image, *total)
+	fmt.Printf("Running %d requests against %s with concurrency %d\n", len(requests), *target, *concurrency)
+
+	start := time.Now()
+	results := performBench(requests, *concurrency)
+	report := NewBenchReport(results, time.Since(start))
+	report.Print(os.Stdout)
+
+	if report.Errors > 0 {
+		os.Exit(1)
+	}
+}
+
+func readBenchURLs(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	lines := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// startBenchServer starts an in-process imaginary server in a random local port, using the default options.
+func startBenchServer() (string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+
+	opts := ServerOptions{PathPrefix: "/"}
+	LoadSources(opts)
+	go http.Serve(listener, NewServerMux(opts))
+
+	return "http://" + listener.Addr().String(), nil
+}
+
+func buildBenchRequests(target string, paths []string, image []byte, total int) []BenchRequest {
+	target = strings.TrimSuffix(target, "/")
+	requests := make([]BenchRequest, 0, total)
+	for i := 0; i < total; i++ {
+		path := paths[i%len(paths)]
+		url := path
+		if !strings.HasPrefix(path, "http://") && !strings.HasPrefix(path, "https://") {
+			url = target + "/" + strings.TrimPrefix(path, "/")
+		}
+
+		req := BenchRequest{Method: "GET", URL: url}
+		if image != nil {
+			req.Method = "POST"
+			req.Body = image
+		}
+		requests = append(requests, req)
+	}
+	return requests
+}
+
+func performBench(requests []BenchRequest, concurrency int) []BenchResult {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	results := make([]BenchResult, len(requests))
+	queue := make(chan int)
+	var wg sync.WaitGroup
+
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				results[i] = performBenchRequest(requests[i])
+			}
+		}()
+	}
+
+	for i := range requests {
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+
+	return results
+}
+
+func performBenchRequest(r BenchRequest) BenchResult {
+	var body io.Reader
+	if r.Body != nil {
+		body = bytes.NewReader(r.Body)
+	}
+
+	req, err := http.NewRequest(r.Method, r.URL, body)
+	if err != nil {
+		return BenchResult{Err: err}
+	}
+	if r.Body != nil {
+		req.Header.Set("Content-Type", http.DetectContentType(r.Body))
+	}
+
+	start := time.Now()
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return BenchResult{Latency: time.Since(start), Err: err}
+	}
+	defer res.Body.Close()
+
+	n, err := io.Copy(ioutil.Discard, res.Body)
+	result := BenchResult{Latency: time.Since(start), Status: res.StatusCode, Bytes: n, Err: err}
+	if err == nil && res.StatusCode >= 400 {
+		result.Err = fmt.Errorf("invalid response status: %d", res.StatusCode)
+	}
+	return result
+}
+
+// NewBenchReport computes the benchmark report for the given results.
+func NewBenchReport(results []BenchResult, elapsed time.Duration) BenchReport {
+	report := BenchReport{Requests: len(results), Duration: elapsed}
+	if len(results) == 0 {
+		return report
+	}
+
+	latencies := make(durations, 0, len(results))
+	var sum time.Duration
+	for _, result := range results {
+		if result.Err != nil {
+			report.Errors++
+		}
+		report.Bytes += result.Bytes
+		latencies = append(latencies, result.Latency)
+		sum += result.Latency
+	}
+	sort.Sort(latencies)
+
+	report.Min = latencies[0]
+	report.Max = latencies[len(latencies)-1]
+	report.Mean = sum / time.Duration(len(latencies))
+	report.P50 = percentile(latencies, 50)
+	report.P90 = percentile(latencies, 90)
+	report.P99 = percentile(latencies, 99)
+	if elapsed > 0 {
+		report.Throughput = float64(len(results)) / elapsed.Seconds()
+	}
+	return report
+}
+
+// percentile returns the nearest-rank percentile of the given sorted latencies.
+func percentile(sorted durations, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// Print writes the human readable benchmark report in the given stream.
+func (r BenchReport) Print(out io.Writer) {
+	fmt.Fprintf(out, "Requests:    %d (%d errors)\n", r.Requests, r.Errors)
+	fmt.Fprintf(out, "Duration:    %s\n", r.Duration)
+	fmt.Fprintf(out, "Throughput:  %.2f req/s\n", r.Throughput)
+	fmt.Fprintf(out, "Transferred: %.2f MB\n", toMegaBytes(uint64(r.Bytes)))
+	fmt.Fprintf(out, "Latency:     min=%s mean=%s p50=%s p90=%s p99=%s max=%s\n",
+		r.Min, r.Mean, r.P50, r.P90, r.P99, r.Max)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNewBenchReport(t *testing.T) {
+	results := []BenchResult{}
+	for i := 1; i <= 100; i++ {
+		results = append(results, BenchResult{Latency: time.Duration(i) * time.Millisecond, Bytes: 10})
+	}
+	results[0].Err = errors.New("oops")
+
+	report := NewBenchReport(results, time.Second)
+	if report.Requests != 100 || report.Errors != 1 || report.Bytes != 1000 {
+		t.Fatalf("Invalid report counters: %#v", report)
+	}
+	if report.Min != time.Millisecond || report.Max != 100*time.Millisecond {
+		t.Fatalf("Invalid min/max latencies: %s/%s", report.Min, report.Max)
+	}
+	if report.P50 != 50*time.Millisecond || report.P90 != 90*time.Millisecond || report.P99 != 99*time.Millisecond {
+		t.Fatalf("Invalid latency percentiles: %s/%s/%s", report.P50, report.P90, report.P99)
+	}
+	if report.Throughput != 100 {
+		t.Fatalf("Invalid throughput: %f", report.Throughput)
+	}
+}
+
+func TestBuildBenchRequests(t *testing.T) {
+	requests := buildBenchRequests("http://localhost:8088/", []string{"/resize?width=100", "http://foo/crop"}, []byte("foo"), 3)
+	if len(requests) != 3 {
+		t.Fatalf("Invalid number of requests: %d", len(requests))
+	}
+	if requests[0].URL != "http://localhost:8088/resize?width=100" || requests[1].URL != "http://foo/crop" {
+		t.Fatalf("Invalid request URLs: %s, %s", requests[0].URL, requests[1].URL)
+	}
+	if requests[2].Method != "POST" {
+		t.Fatalf("Invalid request method: %s", requests[2].Method)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"strconv"
+	"strings"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// maxBorderWidth is the maximum border width in pixels
+const maxBorderWidth = 500
+
+// Default drop shadow params
+const (
+	shadowDefaultOffset  = 10
+	shadowDefaultSigma   = 8
+	shadowDefaultOpacity = 0.5
+)
+
+// parseBorder parses the border param as width and color, such as 10,eee or 10,255,200,150.
+// The border color defaults to black.
+func parseBorder(val string) (int, color.RGBA, error) {
+	parts := strings.SplitN(val, ",", 2)
+	width, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil || width < 0 || width > maxBorderWidth {
+		return 0, color.RGBA{}, NewError("Invalid border param: "+val, BadRequest)
+	}
+
+	fg := color.RGBA{0, 0, 0, 0xff}
+	if len(parts) > 1 {
+		fg = parseCanvasColor(parts[1], fg)
+	}
+	return width, fg, nil
+}
+
+// Border returns the operation framing the resultant image of the given
+// operation with a solid border, as defined via the border param.
+func Border(operation Operation) Operation {
+	return func(buf []byte, o ImageOptions) (Image, error) {
+		out, err := operation.Run(buf, o)
+		if err != nil || o.Border == "" || out.Mime == "application/json" {
+			return out, err
+		}
+
+		width, fg, err := parseBorder(o.Border)
+		if err != nil || width == 0 {
+			return out, err
+		}
+
+		src, err := decodeImage(out.Body, bimg.Options{})
+		if err != nil {
+			return Image{}, err
+		}
+		size := src.Bounds().Size()
+		if err := checkCanvasSize(size.X+width*2, size.Y+width*2); err != nil {
+			return Image{}, err
+		}
+
+		canvas := newCanvas(size.X+width*2, size.Y+width*2, fg, fg)
+		draw.Draw(canvas, src.Bounds().Sub(src.Bounds().Min).Add(image.Pt(width, width)), src, src.Bounds().Min, draw.Src)
+		return encodeCanvas(canvas, outputOptions(out.Body, o))
+	}
+}
+
+// DropShadow casts a blurred shadow of the image, based on its alpha channel, at the given
+// offset, extending the image canvas to fit the shadow.
+func DropShadow(buf []byte, o ImageOptions) (Image, error) {
+	offset := image.Pt(o.ShadowX, o.ShadowY)
+	if offset == image.ZP {
+		offset = image.Pt(shadowDefaultOffset, shadowDefaultOffset)
+	}
+	sigma := o.Sigma
+	if sigma == 0 {
+		sigma = shadowDefaultSigma
+	}
+	opacity, err := shadeOpacity(o.Opacity, shadowDefaultOpacity)
+	if err != nil {
+		return Image{}, err
+	}
+
+	src, err := decodeImage(buf, bimg.Options{})
+	if err != nil {
+		return Image{}, err
+	}
+	bounds := src.Bounds().Sub(src.Bounds().Min)
+
+	// The canvas is extended by the shadow offset plus its blur extent
+	spread := int(math.Ceil(sigma * 3))
+	pad := image.Rect(
+		maxInt(spread-offset.X, 0), maxInt(spread-offset.Y, 0),
+		maxInt(spread+offset.X, 0), maxInt(spread+offset.Y, 0),
+	)
+	width, height := bounds.Dx()+pad.Min.X+pad.Max.X, bounds.Dy()+pad.Min.Y+pad.Max.Y
+	if err := checkCanvasSize(width, height); err != nil {
+		return Image{}, err
+	}
+
+	// Render the image silhouette, blurred via libvips
+	silhouette := image.NewGray(image.Rect(0, 0, width, height))
+	at := bounds.Add(pad.Min)
+	draw.DrawMask(silhouette, at.Add(offset), &image.Uniform{color.White}, image.ZP, src, src.Bounds().Min, draw.Over)
+	mask, err := encodeCanvas(silhouette, bimg.Options{Type: bimg.PNG})
+	if err != nil {
+		return Image{}, err
+	}
+	blurred, err := decodeImage(mask.Body, bimg.Options{GaussianBlur: bimg.GaussianBlur{Sigma: sigma}})
+	if err != nil {
+		return Image{}, err
+	}
+
+	shadow := image.NewAlpha(blurred.Bounds())
+	for y := shadow.Rect.Min.Y; y < shadow.Rect.Max.Y; y++ {
+		for x := shadow.Rect.Min.X; x < shadow.Rect.Max.X; x++ {
+			gray := color.GrayModel.Convert(blurred.At(x, y)).(color.Gray)
+			shadow.SetAlpha(x, y, color.Alpha{uint8(float64(gray.Y)*opacity + 0.5)})
+		}
+	}
+
+	output := outputOptions(buf, o)
+	background := canvasBackground(o, output.Type)
+
+	canvas := newCanvas(width, height, background, background)
+	drawMask(canvas, shadow, shadeColor(o.Color), shadow.Rect.Min.X, shadow.Rect.Min.Y)
+	draw.Draw(canvas, at, src, src.Bounds().Min, draw.Over)
+	return encodeCanvas(canvas, output)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"image/color"
+	"io/ioutil"
+	"testing"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+func TestParseBorder(t *testing.T) {
+	cases := []struct {
+		value string
+		width int
+		color color.RGBA
+		fail  bool
+	}{
+		{"10", 10, color.RGBA{0, 0, 0, 0xff}, false},
+		{"5,eee", 5, color.RGBA{0xee, 0xee, 0xee, 0xff}, false},
+		{"5,255,200,150", 5, color.RGBA{255, 200, 150, 0xff}, false},
+		{"foo", 0, color.RGBA{}, true},
+		{"-1", 0, color.RGBA{}, true},
+		{"1000", 0, color.RGBA{}, true},
+	}
+
+	for _, test := range cases {
+		width, c, err := parseBorder(test.value)
+		if test.fail {
+			if err == nil {
+				t.Errorf("Expected error for border %q", test.value)
+			}
+			continue
+		}
+		if err != nil || width != test.width || c != test.color {
+			t.Errorf("Invalid border %q: %d %v (%v)", test.value, width, c, err)
+		}
+	}
+}
+
+func TestBorder(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+	resized, _ := Resize(buf, ImageOptions{Width: 300})
+	size, _ := bimg.Size(resized.Body)
+
+	image, err := Border(Resize)(buf, ImageOptions{Width: 300, Border: "10,255,0,0"})
+	if err != nil {
+		t.Fatalf("Cannot frame the image: %s", err)
+	}
+	if image.Mime != "image/jpeg" {
+		t.Errorf("Invalid image MIME type: %s", image.Mime)
+	}
+	if err := assertSize(image.Body, size.Width+20, size.Height+20); err != nil {
+		t.Error(err)
+	}
+
+	canvas, _ := decodeCanvas(image.Body)
+	if c := canvas.RGBAAt(2, 2); c.R < 0xf0 || c.G > 0x10 || c.B > 0x10 {
+		t.Errorf("Invalid border color: %v", c)
+	}
+}
+
+func TestDropShadow(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("test.png"))
+	size, _ := bimg.Size(buf)
+
+	image, err := DropShadow(buf, ImageOptions{ShadowX: 5, ShadowY: 5, Sigma: 2})
+	if err != nil {
+		t.Fatalf("Cannot cast the shadow: %s", err)
+	}
+	if image.Mime != "image/png" {
+		t.Errorf("Invalid image MIME type: %s", image.Mime)
+	}
+	// Blur extent of 6px, 1px before and 11px after the image
+	if err := assertSize(image.Body, size.Width+12, size.Height+12); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := DropShadow(buf, ImageOptions{Opacity: 2}); err == nil {
+		t.Error("Expected invalid opacity error")
+	}
+}
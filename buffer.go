@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// maxPooledBufferSize defines the maximum buffer capacity kept in the pool,
+// so exceptionally large images don't retain memory forever.
+const maxPooledBufferSize = 1024 * 1024 * 32
+
+// BufferPoolStats represents the buffer pool usage counters.
+type BufferPoolStats struct {
+	Gets      uint64 `json:"gets"`
+	Allocated uint64 `json:"allocated"`
+	Discarded uint64 `json:"discarded"`
+	InUse     int64  `json:"inUse"`
+}
+
+var bufferPoolStats BufferPoolStats
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		atomic.AddUint64(&bufferPoolStats.Allocated, 1)
+		return new(bytes.Buffer)
+	},
+}
+
+func getBuffer() *bytes.Buffer {
+	atomic.AddUint64(&bufferPoolStats.Gets, 1)
+	atomic.AddInt64(&bufferPoolStats.InUse, 1)
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	atomic.AddInt64(&bufferPoolStats.InUse, -1)
+	if buf.Cap() > maxPooledBufferSize {
+		atomic.AddUint64(&bufferPoolStats.Discarded, 1)
+		return
+	}
+	buf.Reset()
+	bufferPool.Put(buf)
+}
+
+// GetBufferPoolStats returns a snapshot of the buffer pool usage counters.
+func GetBufferPoolStats() BufferPoolStats {
+	return BufferPoolStats{
+		Gets:      atomic.LoadUint64(&bufferPoolStats.Gets),
+		Allocated: atomic.LoadUint64(&bufferPoolStats.Allocated),
+		Discarded: atomic.LoadUint64(&bufferPoolStats.Discarded),
+		InUse:     atomic.LoadInt64(&bufferPoolStats.InUse),
+	}
+}
+
+// imageBuffers holds the pooled buffers of the images read by a request. They are returned to
+// the pool once released by the request, after its response is written, and by every operation
+// still processing them, since the expired operations keep running in background.
+type imageBuffers struct {
+	mutex sync.Mutex
+	refs  int
+	bufs  []*bytes.Buffer
+}
+
+// imageBuffersKey is the request context key of the pooled image buffers of the request
+type imageBuffersKey struct{}
+
+// withImageBuffers returns the given request reading its images into pooled buffers, held
+// until released by releaseImageBuffers.
+func withImageBuffers(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), imageBuffersKey{}, &imageBuffers{refs: 1}))
+}
+
+// holdImageBuffers holds the pooled image buffers of the given request context, if any,
+// returning the function releasing them.
+func holdImageBuffers(ctx context.Context) func() {
+	b, ok := ctx.Value(imageBuffersKey{}).(*imageBuffers)
+	if !ok {
+		return func() {}
+	}
+	b.mutex.Lock()
+	b.refs++
+	b.mutex.Unlock()
+	return b.release
+}
+
+// releaseImageBuffers releases the pooled image buffers of the given request, if any
+func releaseImageBuffers(r *http.Request) {
+	if b, ok := r.Context().Value(imageBuffersKey{}).(*imageBuffers); ok {
+		b.release()
+	}
+}
+
+func (b *imageBuffers) release() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.refs--; b.refs > 0 {
+		return
+	}
+	for _, buf := range b.bufs {
+		putBuffer(buf)
+	}
+	b.bufs = nil
+}
+
+// readImage reads the whole image of the given request, as readAll does, into a pooled buffer
+// if the request holds pooled buffers, in which case the returned image is only valid until
+// the request buffers are released.
+func readImage(req *http.Request, r io.Reader, sizeHint int) ([]byte, error) {
+	b, ok := req.Context().Value(imageBuffersKey{}).(*imageBuffers)
+	if !ok {
+		return readAll(r, sizeHint)
+	}
+
+	buf := getBuffer()
+	b.mutex.Lock()
+	b.bufs = append(b.bufs, buf)
+	b.mutex.Unlock()
+
+	if sizeHint > 0 && sizeHint <= maxPooledBufferSize {
+		buf.Grow(sizeHint + bytes.MinRead)
+	}
+	if _, err := buf.ReadFrom(r); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// readAll reads the whole reader, avoiding the repeated allocations caused by the slice growth
+// in ioutil.ReadAll. sizeHint is the expected size in bytes, if known, in which case the buffer
+// is allocated upfront, unless it exceeds the pooled buffer size, since it comes from the
+// untrusted Content-Length headers.
+func readAll(r io.Reader, sizeHint int) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if sizeHint > 0 && sizeHint <= maxPooledBufferSize {
+		buf = bytes.NewBuffer(make([]byte, 0, sizeHint+bytes.MinRead))
+	}
+	if _, err := buf.ReadFrom(r); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadAll(t *testing.T) {
+	expected, _ := ioutil.ReadFile(fixtureImage)
+
+	for _, hint := range []int{0, 10, len(expected), maxPooledBufferSize + 1} {
+		buf, err := readAll(bytes.NewReader(expected), hint)
+		if err != nil {
+			t.Fatalf("Cannot read buffer: %s", err)
+		}
+		if !bytes.Equal(buf, expected) {
+			t.Fatalf("Invalid buffer content with size hint %d", hint)
+		}
+		if hint == len(expected) && cap(buf) > len(expected)+bytes.MinRead {
+			t.Errorf("The known size buffer should not be reallocated: %d", cap(buf))
+		}
+	}
+}
+
+func TestReadImage(t *testing.T) {
+	expected, _ := ioutil.ReadFile(fixtureImage)
+	r := withImageBuffers(httptest.NewRequest("GET", "/", nil))
+	inUse := GetBufferPoolStats().InUse
+
+	buf, err := readImage(r, bytes.NewReader(expected), len(expected))
+	if err != nil {
+		t.Fatalf("Cannot read image: %s", err)
+	}
+	if !bytes.Equal(buf, expected) {
+		t.Fatal("Invalid image content")
+	}
+	if n := GetBufferPoolStats().InUse - inUse; n != 1 {
+		t.Fatalf("Invalid pooled buffers in use: %d", n)
+	}
+
+	// The buffers are held until both the request and the operations release them
+	release := holdImageBuffers(r.Context())
+	releaseImageBuffers(r)
+	if n := GetBufferPoolStats().InUse - inUse; n != 1 {
+		t.Errorf("The held buffers should not be released: %d", n)
+	}
+	release()
+	if n := GetBufferPoolStats().InUse - inUse; n != 0 {
+		t.Errorf("The released buffers should be returned to the pool: %d", n)
+	}
+
+	// The requests without pooled buffers read the images as readAll does
+	if _, err := readImage(httptest.NewRequest("GET", "/", nil), bytes.NewReader(expected), 0); err != nil {
+		t.Fatalf("Cannot read image: %s", err)
+	}
+	if n := GetBufferPoolStats().InUse - inUse; n != 0 {
+		t.Errorf("Unexpected pooled buffer: %d", n)
+	}
+	holdImageBuffers(context.Background())()
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// CacheVersionParam is the query param versioning the image URLs, whose responses are
+// cached with the immutable TTL, if defined.
+const CacheVersionParam = "v"
+
+// CacheOptions represents the processed responses Cache-Control tuning, extending the
+// HTTP cache TTL. Negative TTLs preserve the HTTP cache TTL.
+type CacheOptions struct {
+	ImmutableTTL         int
+	ErrorTTL             int
+	StaleWhileRevalidate int
+	StaleIfError         int
+	PreferOrigin         bool
+}
+
+// cacheWriter sets the response cache headers once the response status is known, since
+// the error responses are cached with their own TTL.
+type cacheWriter struct {
+	http.ResponseWriter
+	req     *http.Request
+	o       ServerOptions
+	written bool
+}
+
+func (w *cacheWriter) WriteHeader(status int) {
+	if !w.written {
+		w.written = true
+		setCacheControl(w.Header(), w.req, status, w.o)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *cacheWriter) Write(buf []byte) (int, error) {
+	if !w.written {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(buf)
+}
+
+// setCacheControl sets the cache headers of the given response status: the error TTL for
+// error responses, the cache policy of the preset applied to the request, the immutable TTL
+// for versioned image URLs, or the HTTP cache TTL. The HTTP source cache headers, if passed
+// through, are preserved if preferred, or replaced by the configured ones otherwise.
+func setCacheControl(header http.Header, r *http.Request, status int, o ServerOptions) {
+	preset := requestPresetCache(r)
+	if status >= 400 {
+		preset = nil
+	}
+	if o.HTTPCacheTTL < 0 && preset == nil {
+		return
+	}
+
+	ttl, immutable := o.HTTPCacheTTL, false
+	if status >= 400 {
+		if o.HTTPCache.ErrorTTL >= 0 {
+			ttl = o.HTTPCache.ErrorTTL
+		}
+	} else if o.HTTPCache.ImmutableTTL > 0 && r.URL.Query().Get(CacheVersionParam) != "" {
+		ttl, immutable = o.HTTPCache.ImmutableTTL, true
+	}
+
+	if header.Get("Expires") != "" || header.Get("Cache-Control") != "" {
+		if o.HTTPCache.PreferOrigin && preset == nil && status < 400 {
+			return
+		}
+		header.Del("Expires")
+		header.Del("Cache-Control")
+	}
+
+	// The cache policy of the applied preset overrides the configured one
+	if preset != nil && preset.Control != "" {
+		header.Set("Cache-Control", preset.Control)
+		return
+	}
+	if preset != nil {
+		ttl, immutable = *preset.TTL, preset.Immutable
+	}
+
+	expires := time.Now().Add(time.Duration(ttl) * time.Second)
+	header.Set("Expires", strings.Replace(expires.Format(time.RFC1123), "UTC", "GMT", -1))
+	header.Set("Cache-Control", getCacheControl(ttl, immutable, o.HTTPCache))
+}
+
+func getCacheControl(ttl int, immutable bool, o CacheOptions) string {
+	if ttl == 0 {
+		return "private, no-cache, no-store, must-revalidate"
+	}
+	value := fmt.Sprintf("public, s-maxage=%d, max-age=%d, no-transform", ttl, ttl)
+	if immutable {
+		value += ", immutable"
+	}
+	if o.StaleWhileRevalidate > 0 {
+		value += fmt.Sprintf(", stale-while-revalidate=%d", o.StaleWhileRevalidate)
+	}
+	if o.StaleIfError > 0 {
+		value += fmt.Sprintf(", stale-if-error=%d", o.StaleIfError)
+	}
+	return value
+}
+
+// PresetCache represents the cache policy of the responses of a preset, defined by its cache
+// key, such as {"ttl": 31536000, "immutable": true} or {"control": "private, max-age=60"},
+// so the mutable and immutable renditions can be cached accordingly by the same instance.
+type PresetCache struct {
+	TTL       *int   `json:"ttl"`
+	Immutable bool   `json:"immutable"`
+	Control   string `json:"control"`
+}
+
+// presetCacheKey is the request context key of the preset cache policy of the request
+type presetCacheKey struct{}
+
+// parsePresetCaches extracts the cache policies of the given presets, removing their cache
+// key, so it is not applied as an image param.
+func parsePresetCaches(presets map[string]map[string]interface{}) (map[string]*PresetCache, error) {
+	caches := map[string]*PresetCache{}
+	for name, preset := range presets {
+		value, ok := preset["cache"]
+		if !ok {
+			continue
+		}
+		delete(preset, "cache")
+
+		cache := &PresetCache{}
+		buf, _ := json.Marshal(value)
+		if err := json.Unmarshal(buf, cache); err != nil {
+			return nil, fmt.Errorf("preset %s: invalid cache: %s", name, err)
+		}
+		if (cache.TTL == nil) == (cache.Control == "") {
+			return nil, fmt.Errorf("preset %s: the cache must define either the ttl or control", name)
+		}
+		if cache.TTL != nil && *cache.TTL < 0 {
+			return nil, fmt.Errorf("preset %s: invalid cache ttl: %d", name, *cache.TTL)
+		}
+		caches[name] = cache
+	}
+	return caches, nil
+}
+
+// hasPresetCaches reports whether any preset of the rewrite rules or the request scripts
+// defines its cache policy.
+func (o ServerOptions) hasPresetCaches() bool {
+	return o.RewriteRules != nil && len(o.RewriteRules.caches) > 0 || o.Scripts != nil && len(o.Scripts.caches) > 0
+}
+
+// withPresetCaches returns the given request carrying the holder of the cache policy of
+// the preset applied to it, set once the request scripts or rewrite rules are applied.
+func withPresetCaches(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), presetCacheKey{}, new(*PresetCache)))
+}
+
+// setPresetCache sets the cache policy of the preset applied to the given request, if any
+func setPresetCache(r *http.Request, cache *PresetCache) {
+	if holder, ok := r.Context().Value(presetCacheKey{}).(**PresetCache); ok && cache != nil {
+		*holder = cache
+	}
+}
+
+// requestPresetCache returns the cache policy of the preset applied to the given request, if any
+func requestPresetCache(r *http.Request) *PresetCache {
+	if holder, ok := r.Context().Value(presetCacheKey{}).(**PresetCache); ok {
+		return *holder
+	}
+	return nil
+}
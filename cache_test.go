@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGetCacheControl(t *testing.T) {
+	cases := []struct {
+		ttl       int
+		immutable bool
+		opts      CacheOptions
+		expected  string
+	}{
+		{0, false, CacheOptions{}, "private, no-cache, no-store, must-revalidate"},
+		{60, false, CacheOptions{}, "public, s-maxage=60, max-age=60, no-transform"},
+		{60, true, CacheOptions{}, "public, s-maxage=60, max-age=60, no-transform, immutable"},
+		{60, false, CacheOptions{StaleWhileRevalidate: 30, StaleIfError: 600}, "public, s-maxage=60, max-age=60, no-transform, stale-while-revalidate=30, stale-if-error=600"},
+	}
+
+	for _, c := range cases {
+		if value := getCacheControl(c.ttl, c.immutable, c.opts); value != c.expected {
+			t.Errorf("Invalid Cache-Control header: %s", value)
+		}
+	}
+}
+
+func TestSetCacheHeaders(t *testing.T) {
+	opts := ServerOptions{HTTPCacheTTL: 60, HTTPCache: CacheOptions{ImmutableTTL: 31536000, ErrorTTL: 10}}
+
+	cases := []struct {
+		url      string
+		status   int
+		origin   string
+		prefer   bool
+		expected string
+	}{
+		{"/resize?width=100", 200, "", false, "public, s-maxage=60, max-age=60, no-transform"},
+		{"/resize?width=100&v=2", 200, "", false, "public, s-maxage=31536000, max-age=31536000, no-transform, immutable"},
+		{"/resize?width=100&v=2", 400, "", false, "public, s-maxage=10, max-age=10, no-transform"},
+		{"/resize?width=100", 200, "max-age=5", false, "public, s-maxage=60, max-age=60, no-transform"},
+		{"/resize?width=100", 200, "max-age=5", true, "max-age=5"},
+		{"/resize?width=100", 500, "max-age=5", true, "public, s-maxage=10, max-age=10, no-transform"},
+	}
+
+	for _, c := range cases {
+		c := c
+		opts.HTTPCache.PreferOrigin = c.prefer
+		handler := setCacheHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if c.origin != "" {
+				w.Header().Add("Cache-Control", c.origin)
+			}
+			w.WriteHeader(c.status)
+			w.Write([]byte("image"))
+		}), opts)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", c.url, nil))
+		if values := w.Header()["Cache-Control"]; len(values) != 1 || values[0] != c.expected {
+			t.Errorf("Invalid Cache-Control header of %s (%d): %v", c.url, c.status, values)
+		}
+		if w.Header().Get("Expires") == "" && !c.prefer {
+			t.Errorf("Missing Expires header of %s", c.url)
+		}
+	}
+
+	// POST requests and public paths are not cached
+	handler := setCacheHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("image"))
+	}), opts)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/resize", nil))
+	if w.Header().Get("Cache-Control") != "" {
+		t.Error("Unexpected Cache-Control header of POST request")
+	}
+}
+
+func TestParsePresetCaches(t *testing.T) {
+	presets := map[string]map[string]interface{}{
+		"avatar":  {"width": 100, "cache": map[string]interface{}{"ttl": 300}},
+		"article": {"width": 800, "cache": map[string]interface{}{"ttl": 31536000, "immutable": true}},
+		"private": {"width": 800, "cache": map[string]interface{}{"control": "private, max-age=60"}},
+		"plain":   {"width": 800},
+	}
+	caches, err := parsePresetCaches(presets)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(caches) != 3 || *caches["avatar"].TTL != 300 || !caches["article"].Immutable || caches["private"].Control != "private, max-age=60" {
+		t.Errorf("Invalid preset caches: %#v", caches)
+	}
+	if _, ok := presets["avatar"]["cache"]; ok {
+		t.Error("The preset cache should not be applied as param")
+	}
+
+	for _, cache := range []interface{}{"300", map[string]interface{}{}, map[string]interface{}{"ttl": -1}, map[string]interface{}{"ttl": 60, "control": "no-store"}} {
+		if _, err := parsePresetCaches(map[string]map[string]interface{}{"avatar": {"cache": cache}}); err == nil {
+			t.Errorf("Expected preset cache error: %v", cache)
+		}
+	}
+}
+
+func TestPresetCacheHeaders(t *testing.T) {
+	ttl := 300
+	scripts := &RequestScripts{caches: map[string]*PresetCache{"avatar": {TTL: &ttl}}}
+	cases := []struct {
+		cache    *PresetCache
+		status   int
+		cacheTTL int
+		expected string
+	}{
+		{&PresetCache{TTL: &ttl}, 200, -1, "public, s-maxage=300, max-age=300, no-transform"},
+		{&PresetCache{TTL: &ttl, Immutable: true}, 200, 60, "public, s-maxage=300, max-age=300, no-transform, immutable"},
+		{&PresetCache{Control: "private, max-age=60"}, 200, 60, "private, max-age=60"},
+		{&PresetCache{TTL: &ttl}, 500, 60, "public, s-maxage=60, max-age=60, no-transform"},
+		{&PresetCache{TTL: &ttl}, 500, -1, ""},
+		{nil, 200, 60, "public, s-maxage=60, max-age=60, no-transform"},
+		{nil, 200, -1, ""},
+	}
+
+	for _, c := range cases {
+		c := c
+		opts := ServerOptions{HTTPCacheTTL: c.cacheTTL, HTTPCache: CacheOptions{ErrorTTL: -1}, Scripts: scripts}
+		handler := setCacheHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			setPresetCache(r, c.cache)
+			w.WriteHeader(c.status)
+		}), opts)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/resize?width=100", nil))
+		if value := w.Header().Get("Cache-Control"); value != c.expected {
+			t.Errorf("Invalid Cache-Control header of preset cache %#v (%d): %s", c.cache, c.status, value)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"strconv"
+	"strings"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// maxCanvasSize is the maximum width or height of the synthesized images
+const maxCanvasSize = 5000
+
+// parseCanvasColor parses CSS like hex colors, such as eee or #333333,
+// or RGB decimal base colors, such as 255,200,150.
+func parseCanvasColor(val string, fallback color.RGBA) color.RGBA {
+	val = strings.TrimPrefix(strings.TrimSpace(val), "#")
+	if val == "" {
+		return fallback
+	}
+
+	if strings.Contains(val, ",") {
+		rgb := parseColor(val)
+		if len(rgb) != 3 {
+			return fallback
+		}
+		return color.RGBA{rgb[0], rgb[1], rgb[2], 0xff}
+	}
+
+	if len(val) == 3 {
+		val = string([]byte{val[0], val[0], val[1], val[1], val[2], val[2]})
+	}
+	if len(val) != 6 {
+		return fallback
+	}
+	n, err := strconv.ParseUint(val, 16, 32)
+	if err != nil {
+		return fallback
+	}
+	return color.RGBA{uint8(n >> 16), uint8(n >> 8), uint8(n), 0xff}
+}
+
+// newCanvas creates a new image filled with a solid color, or with a
+// vertical linear gradient if both colors are different.
+func newCanvas(width, height int, from, to color.RGBA) *image.RGBA {
+	canvas := image.NewRGBA(image.Rect(0, 0, width, height))
+	if from == to {
+		draw.Draw(canvas, canvas.Bounds(), &image.Uniform{from}, image.ZP, draw.Src)
+		return canvas
+	}
+
+	for y := 0; y < height; y++ {
+		line := image.Rect(0, y, width, y+1)
+		draw.Draw(canvas, line, &image.Uniform{mixColors(from, to, float64(y)/float64(height))}, image.ZP, draw.Src)
+	}
+	return canvas
+}
+
+func mixColors(from, to color.RGBA, t float64) color.RGBA {
+	mix := func(a, b uint8) uint8 {
+		return uint8(float64(a) + (float64(b)-float64(a))*t + 0.5)
+	}
+	return color.RGBA{mix(from.R, to.R), mix(from.G, to.G), mix(from.B, to.B), mix(from.A, to.A)}
+}
+
+// drawText renders the given text centered within the canvas.
+func drawText(canvas draw.Image, text, font string, fg color.RGBA) error {
+	bounds := canvas.Bounds()
+	mask, err := vipsTextMask(text, font, bounds.Dx()*9/10, textAlignCentre)
+	if err != nil {
+		return err
+	}
+
+	size := mask.Bounds().Size()
+	drawMask(canvas, mask, fg, bounds.Min.X+(bounds.Dx()-size.X)/2, bounds.Min.Y+(bounds.Dy()-size.Y)/2)
+	return nil
+}
+
+// drawMask fills the given mask with the color at the given canvas position.
+func drawMask(canvas draw.Image, mask image.Image, fg color.Color, x, y int) {
+	size := mask.Bounds().Size()
+	draw.DrawMask(canvas, image.Rect(x, y, x+size.X, y+size.Y), &image.Uniform{fg}, image.ZP, mask, mask.Bounds().Min, draw.Over)
+}
+
+// decodeImage decodes any libvips supported image, resized with the given options.
+func decodeImage(buf []byte, o bimg.Options) (image.Image, error) {
+	o.Type = bimg.PNG
+	img, err := Process(buf, o)
+	if err != nil {
+		return nil, err
+	}
+	return png.Decode(bytes.NewReader(img.Body))
+}
+
+// decodeCanvas decodes the image into a drawable canvas.
+func decodeCanvas(buf []byte) (*image.RGBA, error) {
+	img, err := decodeImage(buf, bimg.Options{})
+	if err != nil {
+		return nil, err
+	}
+	canvas := image.NewRGBA(img.Bounds().Sub(img.Bounds().Min))
+	draw.Draw(canvas, canvas.Bounds(), img, img.Bounds().Min, draw.Src)
+	return canvas, nil
+}
+
+// encodeCanvas encodes the synthesized image with the given output options via libvips.
+func encodeCanvas(canvas image.Image, o bimg.Options) (Image, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, canvas); err != nil {
+		return Image{}, err
+	}
+	if o.Type == bimg.UNKNOWN {
+		o.Type = bimg.PNG
+	}
+	return Process(buf.Bytes(), o)
+}
+
+// orientedSize returns the dimensions of the given image once autorotated by its EXIF orientation,
+// reading its header only.
+func orientedSize(buf []byte) (image.Point, error) {
+	meta, err := bimg.Metadata(buf)
+	if err != nil {
+		return image.Point{}, err
+	}
+	if meta.Orientation >= 5 {
+		return image.Pt(meta.Size.Height, meta.Size.Width), nil
+	}
+	return image.Pt(meta.Size.Width, meta.Size.Height), nil
+}
+
+// outputOptions returns the encoding options of the resultant image, preserving
+// the given image type, unless a different type is defined.
+func outputOptions(buf []byte, o ImageOptions) bimg.Options {
+	output := bimg.Options{Type: ImageType(o.Type), Quality: o.Quality, Compression: o.Compression}
+	if output.Type == bimg.UNKNOWN {
+		output.Type = bimg.DetermineImageType(buf)
+	}
+	return output
+}
+
+// canvasBackground returns the background color param, or transparent if not defined.
+// Images without alpha channel support are flattened onto white instead.
+func canvasBackground(o ImageOptions, t bimg.ImageType) color.RGBA {
+	if len(o.Background) == 3 {
+		return color.RGBA{o.Background[0], o.Background[1], o.Background[2], 0xff}
+	}
+	if t != bimg.PNG && t != bimg.WEBP {
+		return color.RGBA{0xff, 0xff, 0xff, 0xff}
+	}
+	return color.RGBA{}
+}
+
+// overlayPosition returns the top left position of an overlay of the given size in the
+// image, based on the position param, defaulting to the bottom right corner.
+func overlayPosition(position string, bounds image.Rectangle, size image.Point, margin int) image.Point {
+	left, top := bounds.Dx()-size.X-margin, bounds.Dy()-size.Y-margin
+	switch strings.ToLower(position) {
+	case "top-left":
+		left, top = margin, margin
+	case "top-right":
+		top = margin
+	case "bottom-left":
+		left = margin
+	case "centre", "center":
+		left, top = (bounds.Dx()-size.X)/2, (bounds.Dy()-size.Y)/2
+	}
+	return image.Pt(left, top)
+}
+
+func checkCanvasSize(width, height int) error {
+	if width <= 0 || height <= 0 || width > maxCanvasSize || height > maxCanvasSize {
+		return NewError(fmt.Sprintf("Image dimensions must be between 1 and %d pixels", maxCanvasSize), BadRequest)
+	}
+	return nil
+}
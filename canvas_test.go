@@ -0,0 +1,66 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestParseCanvasColor(t *testing.T) {
+	fallback := color.RGBA{1, 2, 3, 0xff}
+	cases := []struct {
+		value    string
+		expected color.RGBA
+	}{
+		{"eee", color.RGBA{0xee, 0xee, 0xee, 0xff}},
+		{"#ff8000", color.RGBA{0xff, 0x80, 0x00, 0xff}},
+		{"255,200,150", color.RGBA{255, 200, 150, 0xff}},
+		{"", fallback},
+		{"zzz", fallback},
+		{"12345", fallback},
+		{"255,200", fallback},
+	}
+
+	for _, test := range cases {
+		if c := parseCanvasColor(test.value, fallback); c != test.expected {
+			t.Errorf("Invalid color for %q: %v", test.value, c)
+		}
+	}
+}
+
+func TestNewCanvas(t *testing.T) {
+	from, to := color.RGBA{0, 0, 0, 0xff}, color.RGBA{200, 200, 200, 0xff}
+
+	canvas := newCanvas(10, 100, from, to)
+	if c := canvas.RGBAAt(5, 0); c != from {
+		t.Errorf("Invalid gradient start color: %v", c)
+	}
+	if c := canvas.RGBAAt(5, 50); c.R != 100 {
+		t.Errorf("Invalid gradient middle color: %v", c)
+	}
+
+	canvas = newCanvas(10, 10, to, to)
+	if c := canvas.RGBAAt(9, 9); c != to {
+		t.Errorf("Invalid solid color: %v", c)
+	}
+}
+
+func TestOverlayPosition(t *testing.T) {
+	bounds := image.Rect(0, 0, 100, 80)
+	cases := []struct {
+		position string
+		expected image.Point
+	}{
+		{"", image.Pt(70, 50)},
+		{"top-left", image.Pt(10, 10)},
+		{"top-right", image.Pt(70, 10)},
+		{"bottom-left", image.Pt(10, 50)},
+		{"centre", image.Pt(40, 30)},
+	}
+
+	for _, test := range cases {
+		if p := overlayPosition(test.position, bounds, image.Pt(20, 20), 10); p != test.expected {
+			t.Errorf("Invalid position for %q: %v", test.position, p)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// Capabilities represents the capabilities of the server, so clients can adapt their requests,
+// such as only requesting AVIF images if supported.
+type Capabilities struct {
+	Versions   Versions             `json:"versions"`
+	Formats    CapabilityFormats    `json:"formats"`
+	Endpoints  []string             `json:"endpoints"`
+	Operations []string             `json:"operations"`
+	Limits     CapabilityLimits     `json:"limits"`
+	Features   map[string]bool      `json:"features"`
+	Streaming  *CapabilityStreaming `json:"streaming,omitempty"`
+}
+
+// CapabilityFormats represents the supported input and output image formats
+type CapabilityFormats struct {
+	Input  []string `json:"input"`
+	Output []string `json:"output"`
+}
+
+// CapabilityLimits represents the processing limits. Zero means no limit.
+type CapabilityLimits struct {
+	MaxAllowedSize  int     `json:"maxAllowedSize"`
+	MaxDimension    int     `json:"maxDimension"`
+	MaxGIFFrames    int     `json:"maxGIFFrames"`
+	MaxPDFPages     int     `json:"maxPDFPages"`
+	MaxTIFFPages    int     `json:"maxTIFFPages"`
+	MaxSVGElements  int     `json:"maxSVGElements"`
+	MaxSVGSize      int     `json:"maxSVGSize"`
+	MaxLegacyPixels int     `json:"maxLegacyPixels"`
+	MaxCost         float64 `json:"maxCost"`
+	Timeout         int     `json:"timeout"`
+}
+
+// CapabilityStreaming represents the streaming of the large images, if enabled, and the response
+// headers omitted by the streamed responses, since they are only known once the image is written.
+type CapabilityStreaming struct {
+	MinSize        int      `json:"minSize"`
+	Sources        bool     `json:"sources"`
+	OmittedHeaders []string `json:"omittedHeaders"`
+}
+
+// capabilityEndpoints are the image endpoints served besides the image operation ones
+var capabilityEndpoints = []string{"/montage", "/document", "/compare", "/qrcode", "/ogimage", "/placeholder", "/srcset"}
+
+// legacyFormats are the input image formats decoded in pure Go, since libvips cannot load them
+var legacyFormats = []string{"bmp", "ico", "pcx", "tga"}
+
+var (
+	detectedFormats     CapabilityFormats
+	detectedFormatsOnce sync.Once
+)
+
+// detectFormats returns the image formats loaded and saved by libvips, saving a generated
+// image to detect the savers compiled in without their encoder, such as AVIF ones.
+// The formats are detected once, since saving every format is expensive.
+func detectFormats() CapabilityFormats {
+	detectedFormatsOnce.Do(func() {
+		detectedFormats = CapabilityFormats{Input: []string{}, Output: []string{}}
+		buf := warmupImage()
+		for _, format := range vipsFormats {
+			if vipsOperationExists(format.Loader) {
+				detectedFormats.Input = append(detectedFormats.Input, format.Name)
+			}
+			if format.Suffix == "" {
+				continue
+			}
+			if _, err := vipsEncode(buf, format.Suffix); err == nil {
+				detectedFormats.Output = append(detectedFormats.Output, format.Name)
+			}
+		}
+	})
+	return detectedFormats
+}
+
+// NewCapabilities returns the capabilities of the server of the given options
+func NewCapabilities(o ServerOptions) Capabilities {
+	detected := detectFormats()
+	formats := CapabilityFormats{
+		Input:  append(append([]string{}, detected.Input...), legacyFormats...),
+		Output: append([]string{}, detected.Output...),
+	}
+	if o.FFmpeg != "" {
+		formats.Input = append(formats.Input, "video")
+	}
+	for _, format := range formats.Output {
+		if format == "png" {
+			formats.Output = append(formats.Output, "ico")
+		}
+	}
+	sort.Strings(formats.Input)
+	sort.Strings(formats.Output)
+
+	endpoints := []string{}
+	paths := append([]string{}, capabilityEndpoints...)
+	for _, endpoint := range imageEndpoints(o) {
+		paths = append(paths, endpoint.Path)
+	}
+	for _, p := range paths {
+		if !o.Endpoints.Disabled(path.Base(p)) {
+			endpoints = append(endpoints, strings.TrimPrefix(p, "/"))
+		}
+	}
+	sort.Strings(endpoints)
+
+	operations := []string{}
+	for name := range OperationsMap {
+		operations = append(operations, name)
+	}
+	sort.Strings(operations)
+
+	var streaming *CapabilityStreaming
+	if o.StreamMinSize > 0 {
+		streaming = &CapabilityStreaming{MinSize: o.StreamMinSize, Sources: o.StreamSources, OmittedHeaders: []string{"Content-Length", OutputSizeHeader}}
+		if o.StreamSources {
+			streaming.OmittedHeaders = append(streaming.OmittedHeaders, InputSizeHeader)
+		}
+	}
+
+	return Capabilities{
+		Versions:   CurrentVersions,
+		Formats:    formats,
+		Endpoints:  endpoints,
+		Operations: operations,
+		Limits: CapabilityLimits{
+			MaxAllowedSize:  o.MaxAllowedSize,
+			MaxDimension:    bimg.MaxSize,
+			MaxGIFFrames:    o.InputLimits.MaxGIFFrames,
+			MaxPDFPages:     o.InputLimits.MaxPDFPages,
+			MaxTIFFPages:    o.InputLimits.MaxTIFFPages,
+			MaxSVGElements:  o.InputLimits.MaxSVGElements,
+			MaxSVGSize:      o.InputLimits.MaxSVGSize,
+			MaxLegacyPixels: o.InputLimits.MaxLegacyPixels,
+			MaxCost:         o.MaxCost,
+			Timeout:         o.ProcessingTimeout,
+		},
+		Features: map[string]bool{
+			"urlSource":         o.EnableURLSource,
+			"mount":             o.Mount != "",
+			"apiKey":            o.APIKey != "",
+			"urlSignature":      o.EnableURLSignature,
+			"placeholder":       len(o.PlaceholderImage) > 0,
+			"errorImage":        o.ErrorImage,
+			"resultCache":       o.ResultCache != nil,
+			"cloudinary":        o.Cloudinary,
+			"imgproxy":          o.Imgproxy,
+			"rewriteRules":      o.RewriteRules != nil,
+			"requestScripts":    o.Scripts != nil,
+			"moderation":        o.Moderation.Moderator != nil,
+			"backgroundRemoval": o.BackgroundRemoval != "",
+			"upscale":           o.Upscaler != "",
+			"video":             o.FFmpeg != "",
+			"ogimage":           len(o.OGTemplates) > 0,
+			"legacyRoutes":      !o.NoLegacyRoutes,
+		},
+		Streaming: streaming,
+	}
+}
+
+// capabilitiesController replies with the capabilities of the server
+func capabilitiesController(o ServerOptions) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, _ := json.Marshal(NewCapabilities(o))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCapabilities(t *testing.T) {
+	o := ServerOptions{Endpoints: Endpoints{"crop", "qrcode"}, EnableURLSource: true, MaxAllowedSize: 1024, MaxCost: 10}
+	c := NewCapabilities(o)
+
+	endpoints := map[string]bool{}
+	for _, endpoint := range c.Endpoints {
+		endpoints[endpoint] = true
+	}
+	if endpoints["crop"] || endpoints["qrcode"] {
+		t.Errorf("Disabled endpoints should not be listed: %v", c.Endpoints)
+	}
+	if !endpoints["resize"] || !endpoints["montage"] {
+		t.Errorf("Missing enabled endpoints: %v", c.Endpoints)
+	}
+
+	if !containsString(c.Formats.Input, "jpeg") || !containsString(c.Formats.Input, "bmp") || containsString(c.Formats.Input, "video") {
+		t.Errorf("Invalid input formats: %v", c.Formats.Input)
+	}
+	if !containsString(c.Formats.Output, "jpeg") || !containsString(c.Formats.Output, "ico") {
+		t.Errorf("Invalid output formats: %v", c.Formats.Output)
+	}
+	if !containsString(c.Operations, "resize") {
+		t.Errorf("Missing resize operation: %v", c.Operations)
+	}
+
+	if c.Limits.MaxAllowedSize != 1024 || c.Limits.MaxCost != 10 || c.Limits.MaxDimension == 0 {
+		t.Errorf("Invalid limits: %#v", c.Limits)
+	}
+	if !c.Features["urlSource"] || c.Features["mount"] || !c.Features["legacyRoutes"] {
+		t.Errorf("Invalid features: %v", c.Features)
+	}
+	if c.Streaming != nil {
+		t.Errorf("Unexpected streaming: %#v", c.Streaming)
+	}
+
+	c = NewCapabilities(ServerOptions{StreamMinSize: 1024, StreamSources: true})
+	if c.Streaming == nil || c.Streaming.MinSize != 1024 || !containsString(c.Streaming.OmittedHeaders, InputSizeHeader) {
+		t.Errorf("Invalid streaming: %#v", c.Streaming)
+	}
+}
+
+func TestCapabilitiesController(t *testing.T) {
+	w := httptest.NewRecorder()
+	capabilitiesController(ServerOptions{FFmpeg: "ffmpeg"})(w, httptest.NewRequest("GET", "/capabilities", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("Invalid response: %d", w.Code)
+	}
+
+	var c Capabilities
+	if err := json.Unmarshal(w.Body.Bytes(), &c); err != nil {
+		t.Fatalf("Invalid capabilities: %s", err)
+	}
+	if !containsString(c.Formats.Input, "video") || !c.Features["video"] {
+		t.Errorf("Missing video capabilities: %#v", c)
+	}
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
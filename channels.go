@@ -0,0 +1,129 @@
+package main
+
+import (
+	"image"
+	"image/draw"
+	"strings"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// Supported alpha channel modes
+const (
+	AlphaPremultiply   = "premultiply"
+	AlphaUnpremultiply = "unpremultiply"
+)
+
+// channelIndexes maps the channel names to their NRGBA pixel offset
+var channelIndexes = map[rune]int{'r': 0, 'g': 1, 'b': 2, 'a': 3}
+
+// parseChannels parses the output channels layout, such as bgra, rgb or a,
+// returning the source channel offset of each output channel.
+func parseChannels(layout string) ([]int, error) {
+	if layout == "" {
+		return []int{0, 1, 2, 3}, nil
+	}
+
+	channels := []int{}
+	for _, name := range strings.ToLower(layout) {
+		index, ok := channelIndexes[name]
+		if !ok {
+			return nil, NewError("Invalid channels param: "+layout, BadRequest)
+		}
+		channels = append(channels, index)
+	}
+	if n := len(channels); n != 1 && n != 3 && n != 4 {
+		return nil, NewError("Invalid channels param, must define 1, 3 or 4 channels: "+layout, BadRequest)
+	}
+	return channels, nil
+}
+
+// toNRGBA returns the non-alpha-premultiplied pixels of the image, preserving
+// the raw channel values of NRGBA images, such as 8-bit PNG images.
+func toNRGBA(img image.Image) *image.NRGBA {
+	if nrgba, ok := img.(*image.NRGBA); ok && nrgba.Rect.Min == image.ZP {
+		return nrgba
+	}
+	nrgba := image.NewNRGBA(img.Bounds().Sub(img.Bounds().Min))
+	draw.Draw(nrgba, nrgba.Bounds(), img, img.Bounds().Min, draw.Src)
+	return nrgba
+}
+
+// multiplyAlpha premultiplies the color channels by the alpha channel, or
+// reverts it, interpreting the color channels as premultiplied.
+func multiplyAlpha(canvas *image.NRGBA, mode string) {
+	for i := 0; i < len(canvas.Pix); i += 4 {
+		p := canvas.Pix[i : i+4]
+		a := uint32(p[3])
+		for c := 0; c < 3; c++ {
+			v := uint32(p[c])
+			if mode == AlphaPremultiply {
+				v = (v*a + 127) / 255
+			} else if a > 0 {
+				v = (v*255 + a/2) / a
+				if v > 255 {
+					v = 255
+				}
+			}
+			p[c] = uint8(v)
+		}
+	}
+}
+
+// mapChannels returns the image composed of the given source channels, as grayscale
+// image if only one channel is defined, or opaque image if the alpha channel is dropped.
+func mapChannels(canvas *image.NRGBA, channels []int) image.Image {
+	bounds := canvas.Bounds()
+	if len(channels) == 1 {
+		gray := image.NewGray(bounds)
+		for i := 0; i < len(gray.Pix); i++ {
+			gray.Pix[i] = canvas.Pix[i*4+channels[0]]
+		}
+		return gray
+	}
+
+	out := image.NewNRGBA(bounds)
+	for i := 0; i < len(out.Pix); i += 4 {
+		out.Pix[i+3] = 0xff
+		for c, channel := range channels {
+			out.Pix[i+c] = canvas.Pix[i+channel]
+		}
+	}
+	return out
+}
+
+// Channels extracts, swaps or drops the image channels, such as extracting the alpha channel
+// as grayscale image, and optionally premultiplies or unpremultiplies the alpha channel.
+func Channels(buf []byte, o ImageOptions) (Image, error) {
+	if o.Channels == "" && o.Alpha == "" {
+		return Image{}, NewError("Missing required param: channels or alpha", BadRequest)
+	}
+
+	alpha := strings.ToLower(o.Alpha)
+	switch alpha {
+	case "", AlphaPremultiply, AlphaUnpremultiply:
+	default:
+		return Image{}, NewError("Unsupported alpha mode: "+o.Alpha, BadRequest)
+	}
+
+	channels, err := parseChannels(o.Channels)
+	if err != nil {
+		return Image{}, err
+	}
+
+	src, err := decodeImage(buf, bimg.Options{})
+	if err != nil {
+		return Image{}, err
+	}
+	canvas := toNRGBA(src)
+	if alpha != "" {
+		multiplyAlpha(canvas, alpha)
+	}
+
+	// Keep the grayscale interpretation of single channel images, which must be lossless
+	output := bimg.Options{Type: ImageType(o.Type), Quality: o.Quality, Compression: o.Compression}
+	if len(channels) == 1 {
+		output.Interpretation = bimg.InterpretationBW
+	}
+	return encodeCanvas(mapChannels(canvas, channels), output)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"testing"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+func TestParseChannels(t *testing.T) {
+	cases := []struct {
+		layout   string
+		expected []int
+		fail     bool
+	}{
+		{"", []int{0, 1, 2, 3}, false},
+		{"bgra", []int{2, 1, 0, 3}, false},
+		{"RGB", []int{0, 1, 2}, false},
+		{"a", []int{3}, false},
+		{"ra", nil, true},
+		{"rgbx", nil, true},
+	}
+
+	for _, test := range cases {
+		channels, err := parseChannels(test.layout)
+		if test.fail {
+			if err == nil {
+				t.Errorf("Expected error for channels %q", test.layout)
+			}
+			continue
+		}
+		if err != nil || len(channels) != len(test.expected) {
+			t.Fatalf("Invalid channels %q: %v (%v)", test.layout, channels, err)
+		}
+		for i := range channels {
+			if channels[i] != test.expected[i] {
+				t.Errorf("Invalid channels %q: %v", test.layout, channels)
+			}
+		}
+	}
+}
+
+func TestMultiplyAlpha(t *testing.T) {
+	canvas := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+	copy(canvas.Pix, []uint8{200, 100, 0, 128})
+
+	multiplyAlpha(canvas, AlphaPremultiply)
+	if !bytes.Equal(canvas.Pix, []uint8{100, 50, 0, 128}) {
+		t.Errorf("Invalid premultiplied pixel: %v", canvas.Pix)
+	}
+
+	multiplyAlpha(canvas, AlphaUnpremultiply)
+	if !bytes.Equal(canvas.Pix, []uint8{199, 100, 0, 128}) {
+		t.Errorf("Invalid unpremultiplied pixel: %v", canvas.Pix)
+	}
+}
+
+func TestMapChannels(t *testing.T) {
+	canvas := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+	copy(canvas.Pix, []uint8{10, 20, 30, 40})
+
+	if swapped := mapChannels(canvas, []int{2, 1, 0, 3}).(*image.NRGBA); !bytes.Equal(swapped.Pix, []uint8{30, 20, 10, 40}) {
+		t.Errorf("Invalid swapped channels: %v", swapped.Pix)
+	}
+	if opaque := mapChannels(canvas, []int{0, 1, 2}).(*image.NRGBA); !bytes.Equal(opaque.Pix, []uint8{10, 20, 30, 0xff}) {
+		t.Errorf("Invalid dropped alpha channel: %v", opaque.Pix)
+	}
+	if gray := mapChannels(canvas, []int{3}).(*image.Gray); !bytes.Equal(gray.Pix, []uint8{40}) {
+		t.Errorf("Invalid extracted channel: %v", gray.Pix)
+	}
+}
+
+func TestChannels(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+	size, _ := bimg.Size(buf)
+
+	image, err := Channels(buf, ImageOptions{Channels: "a"})
+	if err != nil {
+		t.Fatalf("Cannot extract the image channel: %s", err)
+	}
+	if image.Mime != "image/png" {
+		t.Errorf("Invalid image MIME type: %s", image.Mime)
+	}
+
+	img, err := png.Decode(bytes.NewReader(image.Body))
+	if err != nil {
+		t.Fatalf("Cannot decode the image: %s", err)
+	}
+	if img.Bounds().Dx() != size.Width || img.Bounds().Dy() != size.Height {
+		t.Errorf("Invalid image size: %v", img.Bounds().Size())
+	}
+	// Opaque images alpha channel is fully white
+	if r, _, _, _ := img.At(0, 0).RGBA(); r != 0xffff {
+		t.Errorf("Invalid alpha channel value: %d", r)
+	}
+
+	if _, err := Channels(buf, ImageOptions{}); err == nil {
+		t.Error("Expected missing params error")
+	}
+	if _, err := Channels(buf, ImageOptions{Alpha: "invert"}); err == nil {
+		t.Error("Expected unsupported alpha mode error")
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+)
+
+// ClientLimiter limits the number of simultaneously processing image requests per client,
+// in addition to the global throttle, so a single client cannot starve the other ones.
+type ClientLimiter struct {
+	max    int
+	mutex  sync.Mutex
+	active map[string]int
+}
+
+// NewClientLimiter creates a new client limiter of the given maximum concurrent requests per client
+func NewClientLimiter(max int) *ClientLimiter {
+	return &ClientLimiter{max: max, active: map[string]int{}}
+}
+
+// Acquire reserves a processing slot of the given client, reporting whether it is available
+func (l *ClientLimiter) Acquire(client string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.active[client] >= l.max {
+		return false
+	}
+	l.active[client]++
+	return true
+}
+
+// Release releases a processing slot of the given client
+func (l *ClientLimiter) Release(client string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.active[client] <= 1 {
+		delete(l.active, client)
+		return
+	}
+	l.active[client]--
+}
+
+// clientHost returns the IP address of the client of the given request
+func clientHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// apiKeyID returns the id of the API key of the given request, or empty if unmatched
+func apiKeyID(r *http.Request, o ServerOptions) string {
+	key := r.Header.Get("API-Key")
+	if key == "" {
+		key = r.URL.Query().Get("key")
+	}
+	if match, ok := apiKeys(o).Match(key); ok && key != "" {
+		return match.ID
+	}
+	return ""
+}
+
+// requestClient returns the client of the given request, identified by the id of its
+// API key, or by its IP address if the key has no id, such as the single API key.
+func requestClient(r *http.Request, o ServerOptions) string {
+	if id := apiKeyID(r, o); id != "" {
+		return "key:" + id
+	}
+	return "ip:" + clientHost(r)
+}
+
+// limitClients rejects the image requests of the clients with the maximum number of
+// simultaneously processing requests, if limited.
+func limitClients(fn func(http.ResponseWriter, *http.Request), o ServerOptions) func(http.ResponseWriter, *http.Request) {
+	if o.ClientLimiter == nil {
+		return fn
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		client := requestClient(r, o)
+		if !o.ClientLimiter.Acquire(client) {
+			audit(o, r, AuditRateLimited, ErrTooManyRequests.Message)
+			ErrorReply(r, w, ErrTooManyRequests, o)
+			return
+		}
+		defer o.ClientLimiter.Release(client)
+		fn(w, r)
+	}
+}
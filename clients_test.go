@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientLimiter(t *testing.T) {
+	limiter := NewClientLimiter(2)
+	if !limiter.Acquire("a") || !limiter.Acquire("a") {
+		t.Fatal("Expected available slots")
+	}
+	if limiter.Acquire("a") {
+		t.Error("Unexpected slot over the limit")
+	}
+	if !limiter.Acquire("b") {
+		t.Error("Expected available slot of another client")
+	}
+	limiter.Release("a")
+	if !limiter.Acquire("a") {
+		t.Error("Expected released slot")
+	}
+	limiter.Release("a")
+	limiter.Release("a")
+	limiter.Release("b")
+	if len(limiter.active) != 0 {
+		t.Errorf("Unexpected active clients: %#v", limiter.active)
+	}
+}
+
+func TestRequestClient(t *testing.T) {
+	keys, _ := parseKeyRing("importer:secret1,secret2", true)
+	o := ServerOptions{APIKey: "secret1", APIKeys: keys}
+
+	r := httptest.NewRequest("GET", "/resize?key=secret1", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	if client := requestClient(r, o); client != "key:importer" {
+		t.Errorf("Invalid API key client: %s", client)
+	}
+
+	r = httptest.NewRequest("GET", "/resize", nil)
+	r.Header.Set("API-Key", "secret2")
+	r.RemoteAddr = "10.0.0.1:1234"
+	if client := requestClient(r, o); client != "ip:10.0.0.1" {
+		t.Errorf("Invalid client IP of the key without id: %s", client)
+	}
+}
+
+func TestLimitClients(t *testing.T) {
+	o := ServerOptions{ClientLimiter: NewClientLimiter(1)}
+	var inner int
+	var handler func(http.ResponseWriter, *http.Request)
+	handler = limitClients(func(w http.ResponseWriter, r *http.Request) {
+		inner++
+		if inner == 1 {
+			// Nested request of the same client while processing
+			nested := httptest.NewRecorder()
+			handler(nested, r)
+			if nested.Code != http.StatusTooManyRequests {
+				t.Errorf("Invalid status of the concurrent request: %d", nested.Code)
+			}
+		}
+	}, o)
+
+	r := httptest.NewRequest("GET", "/resize", nil)
+	handler(httptest.NewRecorder(), r)
+	handler(httptest.NewRecorder(), r)
+	if inner != 2 {
+		t.Errorf("Invalid processed requests: %d", inner)
+	}
+}
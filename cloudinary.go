@@ -0,0 +1,314 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// cloudinaryTransformation matches the comma separated parameters of a Cloudinary
+// transformation component, such as c_fill,w_300,h_200
+var cloudinaryTransformation = regexp.MustCompile(`^[a-z]{1,3}_[^,]+(,[a-z]{1,3}_[^,]+)*$`)
+
+// cloudinaryVersion matches the optional asset version component of the Cloudinary URLs
+var cloudinaryVersion = regexp.MustCompile(`^v\d+$`)
+
+// cloudinaryGravities maps the Cloudinary gravities to the gravity param values. Face
+// detection gravities are approximated by the smart crop.
+var cloudinaryGravities = map[string]string{
+	"center": "centre",
+	"north":  "north",
+	"south":  "south",
+	"east":   "east",
+	"west":   "west",
+	"auto":   "smart",
+	"face":   "smart",
+	"faces":  "smart",
+}
+
+// cloudinaryColors maps the Cloudinary named background colors to the background param values
+var cloudinaryColors = map[string]string{
+	"white": "255,255,255",
+	"black": "0,0,0",
+	"red":   "255,0,0",
+	"green": "0,128,0",
+	"blue":  "0,0,255",
+	"gray":  "128,128,128",
+	"grey":  "128,128,128",
+}
+
+// parseCloudinaryPath splits the given Cloudinary delivery path, such as
+// c_fill,w_300/v1612/photos/cat.jpg, into its transformation components and
+// source image, skipping the asset version, if any. The last segment is always the source.
+func parseCloudinaryPath(path string) ([]string, string) {
+	segments := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	i := 0
+	for i < len(segments)-1 && cloudinaryTransformation.MatchString(segments[i]) {
+		i++
+	}
+	components := segments[:i]
+	if i < len(segments)-1 && cloudinaryVersion.MatchString(segments[i]) {
+		i++
+	}
+	return components, strings.Join(segments[i:], "/")
+}
+
+// cloudinaryDimension translates the given Cloudinary width or height, scaled by the given
+// device pixel ratio. Fractional values up to 1 are relative to the source image dimensions.
+func cloudinaryDimension(value string, dpr float64) (interface{}, error) {
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("invalid dimension: %s", value)
+	}
+	if strings.Contains(value, ".") && n <= 1 {
+		return strconv.FormatFloat(n*dpr*100, 'f', -1, 64) + "%", nil
+	}
+	return int(n*dpr + 0.5), nil
+}
+
+// cloudinaryColor translates the given Cloudinary color, named or rgb:RRGGBB
+func cloudinaryColor(value string) (string, error) {
+	if color, ok := cloudinaryColors[value]; ok {
+		return color, nil
+	}
+	hex := strings.TrimPrefix(strings.TrimPrefix(value, "rgb:"), "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	rgb, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil || len(hex) != 6 {
+		return "", fmt.Errorf("invalid color: %s", value)
+	}
+	return fmt.Sprintf("%d,%d,%d", rgb>>16, (rgb>>8)&0xff, rgb&0xff), nil
+}
+
+// cloudinaryOutput represents the output params of the Cloudinary transformations,
+// applied to every operation and to the endpoint request.
+type cloudinaryOutput struct {
+	Type        string
+	Quality     string
+	Interlace   bool
+	AspectRatio string
+	Vary        bool
+}
+
+// translateCloudinaryComponent translates the given transformation component into its
+// operations: the cropping or resizing operation, and the rotation and effects ones.
+func translateCloudinaryComponent(component string, out *cloudinaryOutput, accept string) (PipelineOperations, error) {
+	params := map[string]string{}
+	for _, param := range strings.Split(component, ",") {
+		parts := strings.SplitN(param, "_", 2)
+		params[parts[0]] = parts[1]
+	}
+
+	dpr := 1.0
+	if value, ok := params["dpr"]; ok && value != "auto" {
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil || n <= 0 || n > 5 {
+			return nil, fmt.Errorf("invalid dpr: %s", value)
+		}
+		dpr = n
+	}
+
+	operations := PipelineOperations{}
+	op := map[string]interface{}{}
+	for _, param := range strings.Split(component, ",") {
+		parts := strings.SplitN(param, "_", 2)
+		key, value := parts[0], parts[1]
+		var err error
+		switch key {
+		case "w":
+			op["width"], err = cloudinaryDimension(value, dpr)
+		case "h":
+			op["height"], err = cloudinaryDimension(value, dpr)
+		case "x", "y":
+			n, e := strconv.Atoi(value)
+			if e != nil || n < 0 {
+				err = fmt.Errorf("invalid offset: %s", value)
+			}
+			op[map[string]string{"x": "left", "y": "top"}[key]] = n
+		case "g":
+			gravity, ok := cloudinaryGravities[strings.Split(strings.Split(value, ":")[0], "_")[0]]
+			if !ok {
+				err = fmt.Errorf("unsupported gravity: %s", value)
+			}
+			op["gravity"] = gravity
+		case "b":
+			op["background"], err = cloudinaryColor(value)
+		case "q":
+			if strings.HasPrefix(value, "auto") {
+				out.Quality = "auto"
+			} else if n, e := strconv.Atoi(value); e == nil && n > 0 && n <= 100 {
+				out.Quality = value
+			} else {
+				err = fmt.Errorf("invalid quality: %s", value)
+			}
+		case "f":
+			out.Type = value
+			if value == "jpg" {
+				out.Type = "jpeg"
+			} else if value == "auto" {
+				out.Type, out.Vary = determineAcceptMimeType(accept), true
+			}
+		case "fl":
+			out.Interlace = out.Interlace || value == "progressive"
+		case "ar":
+			out.AspectRatio = value
+		case "a":
+			switch value {
+			case "hflip":
+				operations = append(operations, PipelineOperation{Name: "flop", Params: map[string]interface{}{}})
+			case "vflip":
+				operations = append(operations, PipelineOperation{Name: "flip", Params: map[string]interface{}{}})
+			case "auto", "exif", "ignore":
+			default:
+				n, e := strconv.Atoi(value)
+				if e != nil || n%90 != 0 {
+					err = fmt.Errorf("unsupported angle: %s", value)
+				}
+				operations = append(operations, PipelineOperation{Name: "rotate", Params: map[string]interface{}{"rotate": (n%360 + 360) % 360}})
+			}
+		case "e":
+			effect := strings.SplitN(value, ":", 2)
+			strength := 0
+			if len(effect) == 2 {
+				strength, _ = strconv.Atoi(effect[1])
+			}
+			switch effect[0] {
+			case "grayscale", "greyscale":
+				op["colorspace"] = "bw"
+			case "blur":
+				if strength <= 0 {
+					strength = 100
+				}
+				operations = append(operations, PipelineOperation{Name: "blur", Params: map[string]interface{}{"sigma": float64(strength) / 20}})
+			case "pixelate":
+				if strength <= 0 {
+					strength = 5
+				}
+				operations = append(operations, PipelineOperation{Name: "pixelate", Params: map[string]interface{}{"pixelate": strength}})
+			default:
+				err = fmt.Errorf("unsupported effect: %s", value)
+			}
+		case "c", "dpr":
+		default:
+			err = fmt.Errorf("unsupported transformation: %s_%s", key, value)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_, width := op["width"]
+	_, height := op["height"]
+	crop, ok := params["c"]
+	if !width && !height {
+		if ok {
+			return nil, fmt.Errorf("missing width or height of the %s crop mode", crop)
+		}
+		if op["colorspace"] != nil {
+			return nil, fmt.Errorf("the grayscale effect requires a width or height")
+		}
+		return operations, nil
+	}
+
+	name := "resize"
+	switch crop {
+	case "", "scale":
+		op["force"] = width && height
+	case "fit", "limit":
+		if width && height {
+			name = "fit"
+		}
+	case "fill", "lfill", "fill_pad", "thumb":
+		name = "crop"
+	case "crop":
+		name = "crop"
+		if op["left"] != nil || op["top"] != nil {
+			name = "extract"
+			op["areawidth"], op["areaheight"] = op["width"], op["height"]
+			delete(op, "width")
+			delete(op, "height")
+		}
+	case "pad", "lpad", "mpad":
+		op["embed"], op["nocrop"], op["extend"] = true, true, "background"
+		if op["background"] == nil {
+			op["background"] = cloudinaryColors["white"]
+		}
+	default:
+		return nil, fmt.Errorf("unsupported crop mode: %s", crop)
+	}
+	return append(PipelineOperations{{Name: name, Params: op}}, operations...), nil
+}
+
+// translateCloudinary translates the given Cloudinary transformation components into the
+// endpoint and params processing them.
+func translateCloudinary(components []string, accept string) (string, url.Values, bool, error) {
+	out := &cloudinaryOutput{}
+	operations := PipelineOperations{}
+	for _, component := range components {
+		ops, err := translateCloudinaryComponent(component, out, accept)
+		if err != nil {
+			return "", nil, false, err
+		}
+		operations = append(operations, ops...)
+	}
+
+	output := url.Values{}
+	if out.Type != "" {
+		output.Set("type", out.Type)
+	}
+	if out.Quality != "" {
+		output.Set("quality", out.Quality)
+	}
+	if out.Interlace {
+		output.Set("interlace", "true")
+	}
+	if out.AspectRatio != "" {
+		if len(operations) > 1 {
+			return "", nil, false, fmt.Errorf("the aspect ratio is only supported by the transformations of a single operation")
+		}
+		output.Set("ar", out.AspectRatio)
+	}
+
+	endpoint, query := operationsRequest(operations, output)
+	return endpoint, query, out.Vary, nil
+}
+
+// cloudinaryController serves the Cloudinary delivery URLs of the uploaded images, mapped to
+// the mounted files, and of the fetched remote images, such as /image/upload/c_fill,w_300/cat.jpg
+// or /image/fetch/w_300/https://example.com/cat.jpg, translated into the image endpoint params.
+func cloudinaryController(o ServerOptions) func(http.ResponseWriter, *http.Request) {
+	controller := newCompatController(o)
+	return func(w http.ResponseWriter, r *http.Request) {
+		delivery := strings.SplitN(strings.TrimPrefix(r.URL.Path, apiRoute(r, o, "/image/")), "/", 2)
+		if len(delivery) != 2 || (delivery[0] != "upload" && delivery[0] != "fetch") {
+			ErrorReply(r, w, ErrNotFound, o)
+			return
+		}
+
+		components, source := parseCloudinaryPath(delivery[1])
+		if source == "" {
+			ErrorReply(r, w, ErrMissingImageSource, o)
+			return
+		}
+		endpoint, params, vary, err := translateCloudinary(components, r.Header.Get("Accept"))
+		if err != nil {
+			ErrorReply(r, w, NewError("Invalid transformation: "+err.Error(), BadRequest), o)
+			return
+		}
+
+		if delivery[0] == "fetch" {
+			params.Set("url", remoteSourceURL(source))
+		} else {
+			params.Set("file", source)
+		}
+		if vary {
+			w.Header().Set("Vary", "Accept")
+		}
+		controller.Serve(w, r, o, endpoint, params)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseCloudinaryPath(t *testing.T) {
+	cases := []struct {
+		path       string
+		components []string
+		source     string
+	}{
+		{"c_fill,w_300,h_200,q_auto/v1612/photos/cat.jpg", []string{"c_fill,w_300,h_200,q_auto"}, "photos/cat.jpg"},
+		{"/w_300/a_90/cat.jpg", []string{"w_300", "a_90"}, "cat.jpg"},
+		{"v1612/cat.jpg", []string{}, "cat.jpg"},
+		{"cat.jpg", []string{}, "cat.jpg"},
+		{"w_300/https:/example.com/cat.jpg", []string{"w_300"}, "https:/example.com/cat.jpg"},
+		{"w_300/my_cat.jpg", []string{"w_300"}, "my_cat.jpg"},
+		{"w_300", []string{}, "w_300"},
+	}
+
+	for _, test := range cases {
+		components, source := parseCloudinaryPath(test.path)
+		if !reflect.DeepEqual(components, test.components) || source != test.source {
+			t.Errorf("Invalid path %s: %#v %s", test.path, components, source)
+		}
+	}
+}
+
+func TestCloudinaryColor(t *testing.T) {
+	cases := map[string]string{
+		"rgb:ff8000": "255,128,0",
+		"rgb:f80":    "255,136,0",
+		"white":      "255,255,255",
+	}
+	for value, expected := range cases {
+		if color, err := cloudinaryColor(value); err != nil || color != expected {
+			t.Errorf("Invalid color %s: %s", value, color)
+		}
+	}
+	if _, err := cloudinaryColor("rgb:zz"); err == nil {
+		t.Error("Expected invalid color error")
+	}
+}
+
+func TestTranslateCloudinary(t *testing.T) {
+	cases := []struct {
+		components []string
+		accept     string
+		endpoint   string
+		params     map[string]string
+		vary       bool
+	}{
+		{[]string{"c_fill,w_300,h_200,q_auto"}, "", "crop", map[string]string{"width": "300", "height": "200", "quality": "auto"}, false},
+		{[]string{"w_300,h_200"}, "", "resize", map[string]string{"width": "300", "height": "200", "force": "true"}, false},
+		{[]string{"c_limit,w_0.5,dpr_2"}, "", "resize", map[string]string{"width": "100%"}, false},
+		{[]string{"c_fit,w_300,h_200,f_auto"}, "image/webp,*/*", "fit", map[string]string{"width": "300", "height": "200", "type": "webp"}, true},
+		{[]string{"c_crop,w_100,h_50,x_10,y_20"}, "", "extract", map[string]string{"areawidth": "100", "areaheight": "50", "left": "10", "top": "20"}, false},
+		{[]string{"c_pad,w_300,h_300,b_rgb:000000"}, "", "resize", map[string]string{"width": "300", "height": "300", "embed": "true", "nocrop": "true", "extend": "background", "background": "0,0,0"}, false},
+		{[]string{"c_thumb,w_100,h_100,g_face"}, "", "crop", map[string]string{"width": "100", "height": "100", "gravity": "smart"}, false},
+		{[]string{"c_fill,w_300,ar_16:9"}, "", "crop", map[string]string{"width": "300", "ar": "16:9"}, false},
+		{[]string{"a_-90"}, "", "rotate", map[string]string{"rotate": "270"}, false},
+		{[]string{"f_jpg,q_80,fl_progressive"}, "", "convert", map[string]string{"type": "jpeg", "quality": "80", "interlace": "true"}, false},
+		{[]string{}, "", "noop", map[string]string{}, false},
+	}
+
+	for _, test := range cases {
+		endpoint, query, vary, err := translateCloudinary(test.components, test.accept)
+		if err != nil {
+			t.Errorf("Cannot translate %s: %s", test.components, err)
+			continue
+		}
+		params := map[string]string{}
+		for key := range query {
+			params[key] = query.Get(key)
+		}
+		if endpoint != test.endpoint || !reflect.DeepEqual(params, test.params) || vary != test.vary {
+			t.Errorf("Invalid translation of %s: %s %#v %t", test.components, endpoint, params, vary)
+		}
+	}
+}
+
+func TestTranslateCloudinaryPipeline(t *testing.T) {
+	endpoint, query, _, err := translateCloudinary([]string{"c_fill,w_300,h_200,e_grayscale", "a_hflip,e_blur:200", "q_75"}, "")
+	if err != nil || endpoint != "pipeline" {
+		t.Fatalf("Invalid pipeline translation: %s %v", endpoint, err)
+	}
+
+	operations := PipelineOperations{}
+	if err := json.Unmarshal([]byte(query.Get("operations")), &operations); err != nil {
+		t.Fatalf("Invalid pipeline operations: %s", err)
+	}
+	names := []string{}
+	for _, operation := range operations {
+		names = append(names, operation.Name)
+		if operation.Params["quality"] != float64(75) {
+			t.Errorf("Missing quality param of the %s operation", operation.Name)
+		}
+	}
+	if !reflect.DeepEqual(names, []string{"crop", "flop", "blur"}) {
+		t.Errorf("Invalid pipeline operations: %#v", names)
+	}
+	if operations[0].Params["colorspace"] != "bw" || operations[2].Params["sigma"] != float64(10) {
+		t.Errorf("Invalid pipeline operations params: %#v", operations)
+	}
+	if query.Get("quality") != "75" {
+		t.Errorf("Invalid pipeline quality param: %s", query.Get("quality"))
+	}
+}
+
+func TestTranslateCloudinaryErrors(t *testing.T) {
+	cases := [][]string{
+		{"c_fill"},
+		{"c_imagga_crop,w_100,h_100"},
+		{"w_100,zz_1"},
+		{"w_-1"},
+		{"q_500"},
+		{"a_45"},
+		{"e_cartoonify"},
+		{"e_grayscale"},
+		{"g_xy_center,w_100"},
+		{"w_100,ar_16:9", "a_90"},
+	}
+	for _, components := range cases {
+		if _, _, _, err := translateCloudinary(components, ""); err == nil {
+			t.Errorf("Expected translation error of %s", components)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"image"
+	"image/color"
+	"math"
+	"net/http"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// comparisonMaxPSNR is the PSNR reported for identical images, whose PSNR is infinite
+const comparisonMaxPSNR = 100
+
+// ImageComparison represents the similarity metrics of two images
+type ImageComparison struct {
+	Width      int     `json:"width"`
+	Height     int     `json:"height"`
+	SSIM       float64 `json:"ssim"`
+	DSSIM      float64 `json:"dssim"`
+	PSNR       float64 `json:"psnr"`
+	DiffPixels int     `json:"diffPixels"`
+	DiffRatio  float64 `json:"diffRatio"`
+	Identical  bool    `json:"identical"`
+}
+
+// compareController compares the two image sources defined via repeated url or file
+// query params, or the repeated multipart form field files.
+func compareController(o ServerOptions) func(http.ResponseWriter, *http.Request) {
+	return multiImageController(o, Compare)
+}
+
+// Compare returns the similarity metrics of the given images, both of the same dimensions,
+// or the visual diff image if the diff param is defined, highlighting the different pixels
+// in red over the faded first image, as visual regression testing systems do.
+func Compare(images [][]byte, o ImageOptions) (Image, error) {
+	if len(images) != 2 {
+		return Image{}, NewError("Comparisons require exactly 2 images", BadRequest)
+	}
+
+	a, err := decodeCanvas(images[0])
+	if err != nil {
+		return Image{}, NewError("Cannot decode the first image: "+err.Error(), BadRequest)
+	}
+	b, err := decodeCanvas(images[1])
+	if err != nil {
+		return Image{}, NewError("Cannot decode the second image: "+err.Error(), BadRequest)
+	}
+	if a.Bounds().Size() != b.Bounds().Size() {
+		return Image{}, NewError("Compared images must have the same dimensions", BadRequest)
+	}
+
+	if o.Diff {
+		return encodeCanvas(diffImage(a, b), bimg.Options{Type: ImageType(o.Type), Quality: o.Quality, Compression: o.Compression})
+	}
+
+	body, _ := json.Marshal(compareImages(a, b))
+	return Image{Body: body, Mime: "application/json"}, nil
+}
+
+// compareImages returns the similarity metrics of the given images of the same dimensions
+func compareImages(a, b *image.RGBA) ImageComparison {
+	size := a.Bounds().Size()
+	comparison := ImageComparison{Width: size.X, Height: size.Y}
+
+	var squares float64
+	for y := 0; y < size.Y; y++ {
+		pa, pb := a.Pix[y*a.Stride:], b.Pix[y*b.Stride:]
+		for x := 0; x < size.X; x++ {
+			different := false
+			for c := x * 4; c < x*4+4; c++ {
+				d := float64(pa[c]) - float64(pb[c])
+				if c%4 != 3 {
+					squares += d * d
+				}
+				different = different || d != 0
+			}
+			if different {
+				comparison.DiffPixels++
+			}
+		}
+	}
+
+	if pixels := size.X * size.Y; pixels > 0 {
+		comparison.DiffRatio = float64(comparison.DiffPixels) / float64(pixels)
+		comparison.PSNR = comparisonMaxPSNR
+		if mse := squares / float64(pixels*3); mse > 0 {
+			comparison.PSNR = math.Min(comparisonMaxPSNR, 10*math.Log10(255*255/mse))
+		}
+	}
+	comparison.SSIM = ssim(a, b)
+	comparison.DSSIM = dssim(a, b)
+	comparison.Identical = comparison.DiffPixels == 0
+	return comparison
+}
+
+// diffImage returns the visual diff of the given images of the same dimensions, where the
+// different pixels are red and the identical pixels are the faded luma of the first image.
+func diffImage(a, b *image.RGBA) *image.RGBA {
+	size := a.Bounds().Size()
+	diff := image.NewRGBA(a.Bounds())
+	red := color.RGBA{255, 0, 0, 255}
+	for y := 0; y < size.Y; y++ {
+		for x := 0; x < size.X; x++ {
+			i := y*a.Stride + x*4
+			pa, pb := a.Pix[i:i+4], b.Pix[i:i+4]
+			if pa[0] != pb[0] || pa[1] != pb[1] || pa[2] != pb[2] || pa[3] != pb[3] {
+				diff.SetRGBA(x, y, red)
+				continue
+			}
+			l := uint8(191 + 0.25*(0.299*float64(pa[0])+0.587*float64(pa[1])+0.114*float64(pa[2])))
+			diff.SetRGBA(x, y, color.RGBA{l, l, l, 255})
+		}
+	}
+	return diff
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"testing"
+)
+
+func TestCompareImages(t *testing.T) {
+	a := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	for i := range a.Pix {
+		a.Pix[i] = 128
+	}
+	b := copyCanvas(a)
+
+	comparison := compareImages(a, b)
+	if !comparison.Identical || comparison.DiffPixels != 0 || comparison.PSNR != comparisonMaxPSNR || comparison.SSIM != 1 {
+		t.Errorf("Invalid identical images comparison: %+v", comparison)
+	}
+
+	b.SetRGBA(3, 4, color.RGBA{255, 0, 0, 255})
+	b.SetRGBA(10, 12, color.RGBA{0, 0, 0, 255})
+	comparison = compareImages(a, b)
+	if comparison.Identical || comparison.DiffPixels != 2 || comparison.DiffRatio != 2.0/256 {
+		t.Errorf("Invalid different pixels: %+v", comparison)
+	}
+	if comparison.PSNR <= 0 || comparison.PSNR >= comparisonMaxPSNR || comparison.SSIM >= 1 {
+		t.Errorf("Invalid similarity metrics: %+v", comparison)
+	}
+
+	diff := diffImage(a, b)
+	if c := diff.RGBAAt(3, 4); c != (color.RGBA{255, 0, 0, 255}) {
+		t.Errorf("Invalid different pixel color: %v", c)
+	}
+	if c := diff.RGBAAt(0, 0); c.R != c.G || c.R < 191 {
+		t.Errorf("Invalid identical pixel color: %v", c)
+	}
+}
+
+func TestCompare(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+	png, _ := ioutil.ReadAll(readFile("test.png"))
+
+	image, err := Compare([][]byte{buf, buf}, ImageOptions{})
+	if err != nil {
+		t.Fatalf("Cannot compare the images: %s", err)
+	}
+	if image.Mime != "application/json" {
+		t.Errorf("Invalid MIME type: %s", image.Mime)
+	}
+	var comparison ImageComparison
+	if err := json.Unmarshal(image.Body, &comparison); err != nil {
+		t.Fatalf("Invalid comparison: %s", err)
+	}
+	if !comparison.Identical || comparison.Width != 550 || comparison.Height != 740 {
+		t.Errorf("Invalid comparison: %+v", comparison)
+	}
+
+	image, err = Compare([][]byte{buf, buf}, ImageOptions{Diff: true})
+	if err != nil {
+		t.Fatalf("Cannot diff the images: %s", err)
+	}
+	if err := assertSize(image.Body, 550, 740); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := Compare([][]byte{buf, png}, ImageOptions{}); err == nil {
+		t.Error("Expected an error with images of different dimensions")
+	}
+	if _, err := Compare([][]byte{buf}, ImageOptions{}); err == nil {
+		t.Error("Expected an error with a single image")
+	}
+}
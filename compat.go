@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// compatController serves the requests of the URL formats of other image services,
+// translated into the image endpoints requests processing them.
+type compatController map[string]func(http.ResponseWriter, *http.Request)
+
+// newCompatController creates a new controller of the image endpoints of the given options
+func newCompatController(o ServerOptions) compatController {
+	controllers := compatController{}
+	for _, endpoint := range imageEndpoints(o) {
+		controllers[strings.Trim(endpoint.Path, "/")] = scriptRequests(cacheResults(imageController(o, endpoint.Operation), o), o)
+	}
+	return controllers
+}
+
+// Serve processes the given request by the given endpoint and params, overriding
+// the request query params, such as the API key, of the same name.
+func (c compatController) Serve(w http.ResponseWriter, r *http.Request, o ServerOptions, endpoint string, params url.Values) {
+	if _, ok := c[endpoint]; !ok || o.Endpoints.Disabled(endpoint) {
+		ErrorReply(r, w, NewError(fmt.Sprintf("The %s endpoint is not available", endpoint), NotImplemented), o)
+		return
+	}
+
+	query := r.URL.Query()
+	for key := range params {
+		query.Set(key, params.Get(key))
+	}
+	req := r.WithContext(r.Context())
+	req.URL = &url.URL{Path: apiRoute(r, o, "/"+endpoint), RawQuery: query.Encode()}
+	c[endpoint](w, req)
+}
+
+// operationsRequest returns the endpoint and params processing the given operations and output
+// params. Several operations are processed by the pipeline endpoint, every operation getting the
+// output params, while a single operation is processed by its own endpoint.
+func operationsRequest(operations PipelineOperations, output url.Values) (string, url.Values) {
+	query := url.Values{}
+	for key := range output {
+		query.Set(key, output.Get(key))
+	}
+
+	if len(operations) == 0 {
+		name := "noop"
+		if query.Get("type") != "" {
+			name = "convert"
+		}
+		return name, query
+	}
+	if len(operations) == 1 {
+		for key, value := range operations[0].Params {
+			query.Set(key, fmt.Sprint(value))
+		}
+		return operations[0].Name, query
+	}
+
+	for _, operation := range operations {
+		for key := range output {
+			if value, ok := pipelineParam(key, output.Get(key)); ok {
+				operation.Params[key] = value
+			}
+		}
+	}
+	buf, _ := json.Marshal(operations)
+	query.Set("operations", string(buf))
+	return "pipeline", query
+}
+
+// pipelineParam returns the pipeline operation param value of the given param, typed by its kind
+func pipelineParam(key, value string) (interface{}, bool) {
+	switch allowedParams[key] {
+	case "int":
+		n, err := strconv.Atoi(value)
+		return n, err == nil
+	case "float":
+		n, err := strconv.ParseFloat(value, 64)
+		return n, err == nil
+	case "bool":
+		b, err := strconv.ParseBool(value)
+		return b, err == nil
+	}
+	return value, true
+}
+
+// remoteSourceURL restores the scheme slashes of the given remote image URL of a
+// request path, merged by the path cleaning of the server mux.
+func remoteSourceURL(source string) string {
+	for _, scheme := range []string{"http:/", "https:/"} {
+		if strings.HasPrefix(source, scheme) && !strings.HasPrefix(source, scheme+"/") {
+			return scheme + "/" + strings.TrimPrefix(source, scheme)
+		}
+	}
+	return source
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// Supported composite blend modes
+const (
+	BlendNormal   = "normal"
+	BlendMultiply = "multiply"
+	BlendScreen   = "screen"
+	BlendOverlay  = "overlay"
+)
+
+// blendFunc blends the base and overlay color channels, normalized to 0-1.
+type blendFunc func(base, overlay float64) float64
+
+var blendModes = map[string]blendFunc{
+	BlendNormal: func(b, s float64) float64 {
+		return s
+	},
+	BlendMultiply: func(b, s float64) float64 {
+		return b * s
+	},
+	BlendScreen: func(b, s float64) float64 {
+		return 1 - (1-b)*(1-s)
+	},
+	BlendOverlay: func(b, s float64) float64 {
+		if b < 0.5 {
+			return 2 * b * s
+		}
+		return 1 - 2*(1-b)*(1-s)
+	},
+}
+
+// Base image dimensions the overlay scale is relative to
+const (
+	ScaleByWidth  = "width"
+	ScaleByHeight = "height"
+)
+
+// vipsBlendModes maps the blend modes to the libvips blend modes composited via vips_composite2
+var vipsBlendModes = map[string]int{
+	BlendNormal:   vipsBlendModeOver,
+	BlendMultiply: vipsBlendModeMultiply,
+	BlendScreen:   vipsBlendModeScreen,
+	BlendOverlay:  vipsBlendModeOverlay,
+}
+
+// fetchOverlayImage fetches the overlay image via the HTTP image source, bound to the given
+// request context, if any.
+func fetchOverlayImage(ctx context.Context, rawurl string) ([]byte, error) {
+	source, ok := imageSourceMap[ImageSourceTypeHttp].(*HttpImageSource)
+	if !ok {
+		return nil, ErrURLSourceDisabled
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return source.FetchURL(ctx, rawurl)
+}
+
+// Composite overlays the image of the given URL onto the image, at the given position,
+// scale and opacity, blending both images with the given blend mode via libvips, so the
+// image is not decoded into a Go canvas. The tiled overlays are rendered into a transparent
+// layer of the image size first, which is then composited as a single overlay.
+func Composite(buf []byte, o ImageOptions) (Image, error) {
+	if o.Image == "" {
+		return Image{}, NewError("Missing required param: image", BadRequest)
+	}
+
+	mode, ok := vipsBlendModes[strings.ToLower(o.Blend)]
+	if o.Blend == "" {
+		mode, ok = vipsBlendModes[BlendNormal], true
+	}
+	if !ok {
+		return Image{}, NewError("Unsupported blend mode: "+o.Blend, BadRequest)
+	}
+	if o.Opacity < 0 || o.Opacity > 1 {
+		return Image{}, NewError("Invalid opacity param, must be between 0 and 1", BadRequest)
+	}
+	if o.Scale < 0 || o.Scale > 1 {
+		return Image{}, NewError("Invalid scale param, must be between 0 and 1", BadRequest)
+	}
+	if o.ScaleBy != "" && o.ScaleBy != ScaleByWidth && o.ScaleBy != ScaleByHeight {
+		return Image{}, NewError("Invalid scaleby param, must be width or height", BadRequest)
+	}
+	if err := checkTile(o); err != nil {
+		return Image{}, err
+	}
+	if o.OverlayMin < 0 || o.OverlayMax < 0 || (o.OverlayMax > 0 && o.OverlayMin > o.OverlayMax) {
+		return Image{}, NewError("Invalid overlay size bounds, overlaymin cannot be greater than overlaymax", BadRequest)
+	}
+
+	overlayBuf, err := fetchOverlayImage(o.Context, o.Image)
+	if err != nil {
+		if e, ok := err.(Error); ok {
+			return Image{}, e
+		}
+		return Image{}, NewSourceError("Cannot fetch the overlay image: ", err)
+	}
+
+	size, err := orientedSize(buf)
+	if err != nil {
+		return Image{}, NewError("Cannot retrieve image metadata: "+err.Error(), BadRequest)
+	}
+	overlaySize, err := orientedSize(overlayBuf)
+	if err != nil {
+		return Image{}, NewError("Cannot decode the overlay image: "+err.Error(), BadRequest)
+	}
+
+	opts := overlayOptions(size, bimg.ImageSize{Width: overlaySize.X, Height: overlaySize.Y}, o)
+	if opts.Width > 0 || opts.Height > 0 {
+		opts.Type = bimg.PNG
+		resized, err := Process(overlayBuf, opts)
+		if err != nil {
+			return Image{}, NewError("Cannot decode the overlay image: "+err.Error(), BadRequest)
+		}
+		overlayBuf = resized.Body
+		if overlaySize, err = orientedSize(overlayBuf); err != nil {
+			return Image{}, NewError("Cannot decode the overlay image: "+err.Error(), BadRequest)
+		}
+	}
+
+	opacity := float64(o.Opacity)
+	if opacity == 0 {
+		opacity = 1
+	}
+
+	at := image.Pt(o.Left, o.Top)
+	if o.Tile {
+		at = image.Point{}
+		if overlayBuf, err = tileLayer(size, overlayBuf, o); err != nil {
+			return Image{}, err
+		}
+	} else if o.Left == 0 && o.Top == 0 {
+		at = overlayPosition(o.Position, image.Rectangle{Max: size}, overlaySize, o.Margin)
+	}
+
+	// The libvips savers support a subset of the output formats, encoded via bimg otherwise
+	output := outputOptions(buf, o)
+	switch output.Type {
+	case bimg.JPEG, bimg.PNG, bimg.WEBP:
+		body, err := vipsComposite(buf, overlayBuf, mode, at, opacity, thumbnailSaveSuffix(output.Type, o))
+		if err != nil {
+			return Image{}, err
+		}
+		return Image{Body: body, Mime: GetImageMimeType(output.Type)}, nil
+	}
+	body, err := vipsComposite(buf, overlayBuf, mode, at, opacity, thumbnailSaveSuffix(bimg.PNG, o))
+	if err != nil {
+		return Image{}, err
+	}
+	return Process(body, output)
+}
+
+// tileLayer renders the given overlay, repeated across the whole image as the tile params
+// define, into a transparent PNG layer of the given image size.
+func tileLayer(size image.Point, overlayBuf []byte, o ImageOptions) ([]byte, error) {
+	overlay, err := decodeImage(overlayBuf, bimg.Options{})
+	if err != nil {
+		return nil, NewError("Cannot decode the overlay image: "+err.Error(), BadRequest)
+	}
+	layer := image.NewRGBA(image.Rectangle{Max: size})
+	if err := tileOverlay(layer, overlay, o, blendModes[BlendNormal], 1); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, layer); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// overlayOptions returns the overlay resize options, whose width, or height if scaled by
+// the image height, is relative to the image dimensions by the given scale and bounded
+// by the overlaymin and overlaymax pixels, so a single request fits any image size.
+func overlayOptions(canvas image.Point, overlay bimg.ImageSize, o ImageOptions) bimg.Options {
+	base, size := canvas.X, overlay.Width
+	if o.ScaleBy == ScaleByHeight {
+		base, size = canvas.Y, overlay.Height
+	}
+
+	scaled := size
+	if o.Scale > 0 {
+		scaled = int(float64(base) * o.Scale)
+	}
+	if o.OverlayMin > 0 && scaled < o.OverlayMin {
+		scaled = o.OverlayMin
+	}
+	if o.OverlayMax > 0 && scaled > o.OverlayMax {
+		scaled = o.OverlayMax
+	}
+	if scaled == size || scaled <= 0 {
+		return bimg.Options{}
+	}
+
+	opts := bimg.Options{Enlarge: true}
+	if o.ScaleBy == ScaleByHeight {
+		opts.Height = scaled
+	} else {
+		opts.Width = scaled
+	}
+	return opts
+}
+
+// compositeImage blends the overlay onto the canvas at the given position, weighting
+// the blended color by the overlay alpha channel and the given opacity.
+func compositeImage(canvas *image.RGBA, overlay image.Image, at image.Point, blend blendFunc, opacity float64) {
+	bounds := overlay.Bounds()
+	area := bounds.Sub(bounds.Min).Add(at).Intersect(canvas.Bounds())
+
+	for y := area.Min.Y; y < area.Max.Y; y++ {
+		for x := area.Min.X; x < area.Max.X; x++ {
+			s := color.NRGBAModel.Convert(overlay.At(x-at.X+bounds.Min.X, y-at.Y+bounds.Min.Y)).(color.NRGBA)
+			if s.A == 0 {
+				continue
+			}
+			alpha := float64(s.A) / 0xff * opacity
+
+			b := canvas.RGBAAt(x, y)
+			canvas.SetRGBA(x, y, color.RGBA{
+				R: blendChannel(b.R, s.R, blend, alpha),
+				G: blendChannel(b.G, s.G, blend, alpha),
+				B: blendChannel(b.B, s.B, blend, alpha),
+				A: b.A + uint8(float64(0xff-b.A)*alpha),
+			})
+		}
+	}
+}
+
+func blendChannel(base, overlay uint8, blend blendFunc, alpha float64) uint8 {
+	b, s := float64(base)/0xff, float64(overlay)/0xff
+	c := b + (blend(b, s)-b)*alpha
+	return uint8(c*0xff + 0.5)
+}
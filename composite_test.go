@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+func TestBlendModes(t *testing.T) {
+	cases := []struct {
+		mode     string
+		base     uint8
+		overlay  uint8
+		expected uint8
+	}{
+		{BlendNormal, 200, 100, 100},
+		{BlendMultiply, 0xff, 100, 100},
+		{BlendMultiply, 0, 100, 0},
+		{BlendScreen, 0, 100, 100},
+		{BlendScreen, 0xff, 100, 0xff},
+		{BlendOverlay, 0, 100, 0},
+		{BlendOverlay, 0xff, 100, 0xff},
+	}
+
+	for _, test := range cases {
+		if c := blendChannel(test.base, test.overlay, blendModes[test.mode], 1); c != test.expected {
+			t.Errorf("Invalid %s blend of %d and %d: %d", test.mode, test.base, test.overlay, c)
+		}
+	}
+
+	if c := blendChannel(200, 100, blendModes[BlendNormal], 0.5); c != 150 {
+		t.Errorf("Invalid half opacity blend: %d", c)
+	}
+}
+
+func TestCompositeImage(t *testing.T) {
+	canvas := newCanvas(10, 10, color.RGBA{0xff, 0xff, 0xff, 0xff}, color.RGBA{0xff, 0xff, 0xff, 0xff})
+	overlay := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	overlay.SetNRGBA(0, 0, color.NRGBA{0xff, 0, 0, 0xff})
+	overlay.SetNRGBA(1, 0, color.NRGBA{0xff, 0, 0, 0})
+
+	compositeImage(canvas, overlay, image.Pt(8, 8), blendModes[BlendMultiply], 1)
+
+	if c := canvas.RGBAAt(8, 8); c != (color.RGBA{0xff, 0, 0, 0xff}) {
+		t.Errorf("Invalid blended color: %v", c)
+	}
+	if c := canvas.RGBAAt(9, 8); c != (color.RGBA{0xff, 0xff, 0xff, 0xff}) {
+		t.Errorf("Transparent overlay pixels must be skipped: %v", c)
+	}
+}
+
+func TestComposite(t *testing.T) {
+	LoadSources(ServerOptions{EnableURLSource: true})
+	defer LoadSources(ServerOptions{})
+
+	tsImage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		buf, _ := ioutil.ReadFile("testdata/test.png")
+		w.Write(buf)
+	}))
+	defer tsImage.Close()
+
+	buf, _ := ioutil.ReadAll(readFile("large.jpg"))
+	image, err := Composite(buf, ImageOptions{Image: tsImage.URL, Scale: 0.25, Blend: "screen", Opacity: 0.8})
+	if err != nil {
+		t.Fatalf("Cannot composite the image: %s", err)
+	}
+	if image.Mime != "image/jpeg" {
+		t.Errorf("Invalid image MIME type: %s", image.Mime)
+	}
+
+	src, _ := ioutil.ReadAll(readFile("large.jpg"))
+	size, _ := bimg.Size(src)
+	if err := assertSize(image.Body, size.Width, size.Height); err != nil {
+		t.Error(err)
+	}
+
+	image, err = Composite(buf, ImageOptions{Image: tsImage.URL, Scale: 0.1, Tile: true, TileAngle: -30, Type: "png"})
+	if err != nil {
+		t.Fatalf("Cannot composite the tiled image: %s", err)
+	}
+	if err := assertSize(image.Body, size.Width, size.Height); err != nil {
+		t.Error(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Composite(buf, ImageOptions{Image: tsImage.URL, Context: ctx}); err == nil {
+		t.Error("Expected the overlay fetch to be bound to the canceled request")
+	}
+
+	if _, err := Composite(buf, ImageOptions{Image: tsImage.URL, Blend: "dodge"}); err == nil {
+		t.Error("Expected unsupported blend mode error")
+	}
+	if _, err := Composite(buf, ImageOptions{}); err == nil {
+		t.Error("Expected missing image param error")
+	}
+	if _, err := Composite(buf, ImageOptions{Image: tsImage.URL, OverlayMin: 200, OverlayMax: 100}); err == nil {
+		t.Error("Expected invalid overlay size bounds error")
+	}
+}
+
+func TestOverlayOptions(t *testing.T) {
+	overlay := bimg.ImageSize{Width: 200, Height: 100}
+	cases := []struct {
+		canvas        image.Point
+		opts          ImageOptions
+		width, height int
+	}{
+		{image.Pt(1000, 500), ImageOptions{}, 0, 0},
+		{image.Pt(1000, 500), ImageOptions{Scale: 0.1}, 100, 0},
+		{image.Pt(1000, 500), ImageOptions{Scale: 0.1, ScaleBy: ScaleByHeight}, 0, 50},
+		{image.Pt(1000, 500), ImageOptions{Scale: 0.2}, 0, 0},
+		{image.Pt(4000, 3000), ImageOptions{Scale: 0.1, OverlayMax: 300}, 300, 0},
+		{image.Pt(300, 200), ImageOptions{Scale: 0.1, OverlayMin: 64}, 64, 0},
+		{image.Pt(300, 200), ImageOptions{OverlayMax: 150}, 150, 0},
+		{image.Pt(300, 200), ImageOptions{OverlayMin: 150, ScaleBy: ScaleByHeight}, 0, 150},
+	}
+
+	for _, c := range cases {
+		opts := overlayOptions(c.canvas, overlay, c.opts)
+		if opts.Width != c.width || opts.Height != c.height {
+			t.Errorf("Invalid overlay size for %v %+v: %dx%d", c.canvas, c.opts, opts.Width, opts.Height)
+		}
+	}
+}
+
+func TestCompositeURLSourceDisabled(t *testing.T) {
+	LoadSources(ServerOptions{})
+
+	buf, _ := ioutil.ReadAll(readFile("large.jpg"))
+	if _, err := Composite(buf, ImageOptions{Image: "http://localhost/overlay.png"}); err != ErrURLSourceDisabled {
+		t.Errorf("Expected URL source disabled error, got: %v", err)
+	}
+}
@@ -1,12 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"image/color"
+	"math"
 	"mime"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"gopkg.in/h2non/bimg.v1"
 	"gopkg.in/h2non/filetype.v0"
@@ -37,6 +42,11 @@ func imageController(o ServerOptions, operation Operation) func(http.ResponseWri
 			ErrorReply(req, w, ErrMissingImageSource, o)
 			return
 		}
+		setSurrogateKeyHeaders(w, req, o)
+
+		// The source images are read into pooled buffers, released once the response is written
+		req = withImageBuffers(req)
+		defer releaseImageBuffers(req)
 
 		var (
 			buf     []byte
@@ -44,14 +54,26 @@ func imageController(o ServerOptions, operation Operation) func(http.ResponseWri
 			err     error
 		)
 
-		if cacheableImageSource, ok := imageSource.(CacheableImageSource); o.HTTPCachePassthru && ok {
+		start := time.Now()
+		passthru := o.HTTPCachePassthru || len(o.ForwardHeaders) > 0
+		if streamableImageSource, ok := imageSource.(StreamableImageSource); ok && (isSourceStreamEligible(req, o) || isSourceOutputStreamEligible(req, o)) {
+			var replied bool
+			if replied, buf, headers, err = streamSource(w, req, streamableImageSource, o); replied {
+				return
+			}
+		} else if cacheableImageSource, ok := imageSource.(CacheableImageSource); passthru && ok {
 			buf, headers, err = cacheableImageSource.GetImageWithCacheHeaders(req)
 		} else {
 			buf, err = imageSource.GetImage(req)
 		}
 
+		if replyContextError(req, w, o) {
+			return
+		}
+
 		if err != nil {
-			ErrorReply(req, w, NewError(err.Error(), BadRequest), o)
+			auditSourceError(o, req, err)
+			ErrorReply(req, w, NewSourceError("", err), o)
 			return
 		}
 
@@ -59,6 +81,21 @@ func imageController(o ServerOptions, operation Operation) func(http.ResponseWri
 			ErrorReply(req, w, ErrEmptyBody, o)
 			return
 		}
+		if o.DebugHeaders {
+			w.Header().Add(ServerTimingHeader, formatTiming("fetch", time.Since(start)))
+		}
+
+		if err := o.InputLimits.Check(buf); err != nil {
+			audit(o, req, AuditOversizedInput, err.Error())
+			ErrorReply(req, w, err.(Error), o)
+			return
+		}
+
+		// Reply with the source image unmodified, if the original is requested
+		if originalRequested(req, o) {
+			replyOriginal(w, req, buf, headers, o)
+			return
+		}
 
 		imageHandler(w, req, buf, operation, o, headers)
 	}
@@ -79,8 +116,9 @@ func determineAcceptMimeType(accept string) string {
 	return ""
 }
 
-func imageHandler(w http.ResponseWriter, r *http.Request, buf []byte, Operation Operation, o ServerOptions, cacheHeaders http.Header) {
-	// Infer the body MIME type via mimesniff algorithm
+// detectMimeType infers the MIME type of the given image body via the mimesniff algorithm,
+// or via its magic numbers if it cannot be sniffed.
+func detectMimeType(buf []byte) string {
 	mimeType := http.DetectContentType(buf)
 
 	// If cannot infer the type, infer it via magic numbers
@@ -97,6 +135,93 @@ func imageHandler(w http.ResponseWriter, r *http.Request, buf []byte, Operation
 			mimeType = "image/svg+xml"
 		}
 	}
+	return mimeType
+}
+
+func imageHandler(w http.ResponseWriter, r *http.Request, buf []byte, Operation Operation, o ServerOptions, cacheHeaders http.Header) {
+	timings, start, source := newTimings(o), time.Now(), buf
+
+	// Wait for a processing slot by priority class, if the server is saturated, once the source
+	// image is read, since the decoding and the inspection of the image are heavy work too.
+	// The slot is released once the request ends, unless handed over to the image operation.
+	if o.ProcessingQueue.Acquire(r.Context(), requestPriority(r, o)) != nil {
+		replyContextError(r, w, o)
+		return
+	}
+	queued := true
+	defer func() {
+		if queued {
+			o.ProcessingQueue.Release()
+		}
+	}()
+	timings.Since("queue", start)
+	start = time.Now()
+
+	// Extract the largest image of ICO images, since libvips cannot load them
+	if isICO(buf) {
+		image, err := decodeICO(buf)
+		if err != nil {
+			ErrorReply(r, w, NewError(err.Error(), BadRequest), o)
+			return
+		}
+		buf = image
+	}
+
+	mimeType := detectMimeType(buf)
+	opts := readParams(r.URL.Query())
+
+	// Extract a still frame of video sources via ffmpeg, since libvips cannot load them
+	if isVideoMimeType(mimeType) && o.FFmpeg != "" {
+		frame, err := videoFrame(r.Context(), o.FFmpeg, buf, opts.Frame, o.ProcessingTimeoutFor(r))
+		if err != nil {
+			if e, ok := err.(Error); ok {
+				ErrorReply(r, w, e, o)
+				return
+			}
+			ErrorReply(r, w, NewError("Error while extracting the video frame: "+err.Error(), BadRequest), o)
+			return
+		}
+		buf, mimeType = frame, "image/png"
+	} else if opts.Density != 0 && isVectorImage(buf) {
+		// Rasterize the selected page of PDF and SVG sources at the requested density
+		page, _ := selectedPage(opts)
+		image, err := rasterize(buf, page, opts.Density)
+		if err != nil {
+			if e, ok := err.(Error); ok {
+				ErrorReply(r, w, e, o)
+				return
+			}
+			ErrorReply(r, w, NewError("Error while rasterizing the image: "+err.Error(), BadRequest), o)
+			return
+		}
+		buf, mimeType = image, "image/png"
+	} else if page, ok := selectedPage(opts); ok && isMultiPage(buf) {
+		// Extract the selected page of multi-page sources as still image
+		image, err := extractPage(buf, page)
+		if err != nil {
+			if e, ok := err.(Error); ok {
+				ErrorReply(r, w, e, o)
+				return
+			}
+			ErrorReply(r, w, NewError("Error while extracting the image page: "+err.Error(), BadRequest), o)
+			return
+		}
+		buf, mimeType = image, "image/png"
+	}
+
+	// Decode the legacy BMP, PCX and TGA images in pure Go, since libvips cannot load them
+	if IsImageMimeTypeSupported(mimeType) == false && isLegacyImage(buf) {
+		image, err := decodeLegacyImage(buf, o.InputLimits.MaxLegacyPixels)
+		if err != nil {
+			if e, ok := err.(Error); ok {
+				ErrorReply(r, w, e, o)
+				return
+			}
+			ErrorReply(r, w, NewError(err.Error(), BadRequest), o)
+			return
+		}
+		buf, mimeType = image, "image/png"
+	}
 
 	// Finally check if image MIME type is supported
 	if IsImageMimeTypeSupported(mimeType) == false {
@@ -104,25 +229,199 @@ func imageHandler(w http.ResponseWriter, r *http.Request, buf []byte, Operation
 		return
 	}
 
-	opts := readParams(r.URL.Query())
+	timings.Since("decode", start)
+
+	// Classify the source image via the content moderation service, if configured
+	start = time.Now()
+	if !moderate(w, r, buf, mimeType, o) {
+		return
+	}
+	if o.Moderation.Moderator != nil {
+		timings.Since("moderation", start)
+	}
+
+	// ICO output is encoded from the PNG output image
+	icoOutput := opts.Type == "ico"
+	if icoOutput {
+		opts.Type = "png"
+	}
+
 	vary := ""
+	smart := opts.Type == "smart"
 	if opts.Type == "auto" {
 		opts.Type = determineAcceptMimeType(r.Header.Get("Accept"))
 		vary = "Accept" // Ensure caches behave correctly for negotiated content
+	} else if smart {
+		// Select the output type by the image content, regardless of the Accept header
+		imageType, err := smartType(buf)
+		if err != nil {
+			ErrorReply(r, w, NewError("Error while inspecting the image: "+err.Error(), BadRequest), o)
+			return
+		}
+		opts.Type = imageType
 	} else if opts.Type != "" && ImageType(opts.Type) == 0 {
 		ErrorReply(r, w, ErrOutputFormat, o)
 		return
 	}
 
-	image, err := Operation.Run(buf, opts)
+	// Resolve the relative dimensions and the aspect ratio against the source image size
+	opts, err := relativeOptions(buf, opts)
+	if err != nil {
+		ErrorReply(r, w, err.(Error), o)
+		return
+	}
+	if opts.AspectRatio != "" {
+		if opts, err = aspectRatioOptions(buf, opts); err != nil {
+			ErrorReply(r, w, err.(Error), o)
+			return
+		}
+	}
+
+	// Apply the quality ladder default of the estimated output image width, unless defined per request
+	if len(o.QualityLadder) > 0 {
+		if size, err := bimg.Size(buf); err == nil {
+			width, _, _ := estimateDimensions(endpointName(r), size.Width, size.Height, opts)
+			if quality, ok := ladderQuality(r, width, o); ok {
+				opts.Quality = quality
+			}
+		}
+	}
+
+	// Apply the interlacing server default of the output image type, unless defined per request
+	if r.URL.Query().Get("interlace") == "" {
+		outputType := opts.Type
+		if outputType == "" {
+			outputType = ExtractImageTypeFromMime(mimeType)
+		}
+		opts.Interlace = o.InterlacedByDefault(outputType)
+	}
+
+	// Record the duration of every operation wrapper, besides the endpoint operation itself
+	Operation = timings.Operation(endpointName(r), Operation)
+	opts.Timings = timings
+	opts.Context = r.Context()
+	if opts.Denoise != 0 {
+		Operation = timings.Operation("denoise", Denoise(Operation))
+	}
+	if opts.Border != "" {
+		Operation = timings.Operation("border", Border(Operation))
+	}
+	if isAnimationControlled(opts) || (smart && opts.Type == "gif") {
+		Operation = timings.Operation("animate", Animate(Operation))
+	}
+	if opts.Upscale != "" {
+		Operation = timings.Operation("upscale", Upscale(o.Upscaler, Operation))
+	}
+	if opts.Density != 0 {
+		Operation = timings.Operation("density", Density(Operation))
+	}
+	if opts.NearLossless != 0 || opts.Effort != 0 {
+		Operation = timings.Operation("webp", WebP(Operation))
+	}
+	if opts.Subsample != "" {
+		Operation = timings.Operation("subsample", Subsample(Operation))
+	}
+	if opts.AutoQuality {
+		Operation = timings.Operation("autoquality", AutoQuality(Operation))
+	}
+	if opts.MaxBytes > 0 {
+		Operation = timings.Operation("maxbytes", MaxBytes(Operation))
+	}
+	if opts.LQIP {
+		Operation = timings.Operation("lqip", LQIP(Operation))
+	}
+
+	// Reject the requests exceeding the processing cost budget, before decoding the image
+	if err := checkCost(w, buf, opts, o); err != nil {
+		audit(o, r, AuditOversizedInput, err.Error())
+		ErrorReply(r, w, err.(Error), o)
+		return
+	}
+
+	// Reply with what would be done instead of processing the image, if explain is requested
+	if explainRequested(r, o) {
+		replyExplanation(w, r, buf, mimeType, opts, icoOutput, o)
+		return
+	}
+
+	// Reply with the source image unchanged, if it is already within the requested threshold.
+	// The untouched source image is checked, rather than the image decoded from it, if any.
+	if image, ok := thresholdImage(endpointName(r), source, opts); ok && !icoOutput {
+		w.Header().Set(BypassHeader, "threshold")
+		setSavingsHeaders(w, source, source, image)
+		setDebugHeaders(w, timings)
+		replyProcessedImage(w, r, image, vary, cacheHeaders, true)
+		return
+	}
+
+	// Stream the output image of the large fit and convert requests, instead of buffering it,
+	// unless the output image is cached, since the cached images are buffered anyway, in which
+	// case the output image is encoded into a pooled buffer
+	if isStreamEligible(endpointName(r), buf, opts, icoOutput, o) && isResultCached(r, o) {
+		start = time.Now()
+		image, out, err := bufferStreamedImage(r, buf, opts)
+		if out != nil {
+			defer putBuffer(out)
+			timings.Since(endpointName(r), start)
+			setSavingsHeaders(w, source, buf, image)
+			setDebugHeaders(w, timings)
+			replyProcessedImage(w, r, image, vary, cacheHeaders, false)
+			return
+		}
+		if err != nil {
+			debug("image buffering failed, falling back: %s", err)
+		}
+	} else if isStreamEligible(endpointName(r), buf, opts, icoOutput, o) {
+		streamed, err := streamImage(w, r, source, buf, opts, timings)
+		if streamed {
+			if err != nil {
+				// The response is partially written, so abort it to signal the failure to the client
+				debug("cannot stream the image: %s", err)
+				panic(http.ErrAbortHandler)
+			}
+			return
+		}
+		if err != nil {
+			debug("image streaming failed, falling back: %s", err)
+		}
+	}
+
+	queued = false
+	image, err := runOperation(r.Context(), Operation, buf, opts, o.ProcessingQueue.Release)
+	if replyContextError(r, w, o) {
+		return
+	}
+	start = time.Now()
+	if err == nil && icoOutput && image.Mime != "application/json" {
+		image, err = encodeICOImage(image.Body, parseICOSizes(r.URL.Query().Get("icosizes")))
+	}
 	if err != nil {
 		ErrorReply(r, w, NewError("Error while processing the image: "+err.Error(), BadRequest), o)
 		return
 	}
 
-	// Expose Content-Length response header
-	w.Header().Set("Content-Length", strconv.Itoa(len(image.Body)))
-	w.Header().Set("Content-Type", image.Mime)
+	// Reply with the untouched source image, if re-encoding it would not make it smaller
+	original := opts.SkipLarger && isLargerOutput(source, image, opts)
+	if original {
+		image = Image{Body: source, Mime: image.Mime}
+		buf = source
+		w.Header().Set(BypassHeader, "larger-output")
+	}
+
+	if image.CropBox != nil {
+		w.Header().Set(CropBoxHeader, image.CropBox.String())
+	}
+	timings.Since("encode", start)
+	setSavingsHeaders(w, source, buf, image)
+	setDebugHeaders(w, timings)
+
+	replyProcessedImage(w, r, image, vary, cacheHeaders, original)
+}
+
+// replyProcessedImage writes the given processed image as response body, with the given Vary
+// header, if any, and the forwarded source image cache headers. The Range requests of the
+// original images, replied unmodified, are honored.
+func replyProcessedImage(w http.ResponseWriter, r *http.Request, image Image, vary string, cacheHeaders http.Header, original bool) {
 	if vary != "" {
 		w.Header().Set("Vary", vary)
 	}
@@ -133,9 +432,159 @@ func imageHandler(w http.ResponseWriter, r *http.Request, buf []byte, Operation
 			}
 		}
 	}
+	if original {
+		replyImageRange(w, r, image)
+		return
+	}
+	replyImage(w, image)
+}
+
+// StatusClientClosedRequest is the non-standard status code used to log
+// requests abandoned by the client before the response could be written.
+const StatusClientClosedRequest = 499
+
+// replyContextError replies accordingly if the request context is already done,
+// either because the processing deadline was exceeded or the client went away.
+func replyContextError(r *http.Request, w http.ResponseWriter, o ServerOptions) bool {
+	switch r.Context().Err() {
+	case context.DeadlineExceeded:
+		ErrorReply(r, w, ErrProcessingTimeout, o)
+		return true
+	case context.Canceled:
+		debug("client disconnected, aborting request: %s", r.URL.Path)
+		w.WriteHeader(StatusClientClosedRequest)
+		return true
+	}
+	return false
+}
+
+// runOperation runs the image operation until it finishes or the given context is done.
+// libvips cannot be interrupted, so an expired operation keeps running in background
+// but its result is discarded. The given done function, if any, is called once the
+// operation ends, so the resources held by the operation outlive the expired requests,
+// as the pooled source images of the request do.
+func runOperation(ctx context.Context, operation Operation, buf []byte, opts ImageOptions, done func()) (Image, error) {
+	release, finish := holdImageBuffers(ctx), done
+	done = func() {
+		if finish != nil {
+			finish()
+		}
+		release()
+	}
+	if ctx.Done() == nil {
+		defer done()
+		return operation.Run(buf, opts)
+	}
+
+	// Skip the processing if the client already went away
+	if err := ctx.Err(); err != nil {
+		done()
+		return Image{}, err
+	}
+
+	type result struct {
+		image Image
+		err   error
+	}
+
+	results := make(chan result, 1)
+	go func() {
+		defer done()
+		// The panics of the detached goroutine cannot be recovered by the handler middleware
+		defer func() {
+			if rec := recover(); rec != nil {
+				results <- result{err: NewError(fmt.Sprintf("Image processing panic: %v", rec), InternalError)}
+			}
+		}()
+		image, err := operation.Run(buf, opts)
+		results <- result{image, err}
+	}()
+
+	select {
+	case res := <-results:
+		return res.image, res.err
+	case <-ctx.Done():
+		return Image{}, ctx.Err()
+	}
+}
+
+// runQueuedOperation waits for a processing slot by priority class, if the server is saturated,
+// then runs the image operation within the request deadline, releasing the slot once it ends.
+func runQueuedOperation(r *http.Request, operation Operation, buf []byte, opts ImageOptions, o ServerOptions) (Image, error) {
+	if err := o.ProcessingQueue.Acquire(r.Context(), requestPriority(r, o)); err != nil {
+		return Image{}, err
+	}
+	return runOperation(r.Context(), operation, buf, opts, o.ProcessingQueue.Release)
+}
+
+// placeholderController synthesizes a placeholder image with a solid or gradient
+// background and the image dimensions or a custom text, without any image source.
+func placeholderController(o ServerOptions) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		width, height := parseInt(query.Get("width")), parseInt(query.Get("height"))
+		if width == 0 && height == 0 {
+			width, height = 400, 300
+		} else if width == 0 {
+			width = height
+		} else if height == 0 {
+			height = width
+		}
+		if err := checkCanvasSize(width, height); err != nil {
+			ErrorReply(r, w, err.(Error), o)
+			return
+		}
+
+		bg := parseCanvasColor(query.Get("bg"), color.RGBA{0xee, 0xee, 0xee, 0xff})
+		fg := parseCanvasColor(query.Get("fg"), color.RGBA{0x33, 0x33, 0x33, 0xff})
+		canvas := newCanvas(width, height, bg, parseCanvasColor(query.Get("gradient"), bg))
+
+		text := query.Get("text")
+		if text == "" {
+			text = fmt.Sprintf("%d×%d", width, height)
+		}
+		font := query.Get("font")
+		if font == "" {
+			font = fmt.Sprintf("sans %d", int(math.Max(8, math.Min(float64(width), float64(height))/8)))
+		}
+		if err := drawText(canvas, text, font, fg); err != nil {
+			ErrorReply(r, w, NewError("Error rendering placeholder text: "+err.Error(), BadRequest), o)
+			return
+		}
+
+		imageType := query.Get("type")
+		if imageType == "auto" {
+			imageType = determineAcceptMimeType(r.Header.Get("Accept"))
+		}
+		image, err := encodeCanvas(canvas, bimg.Options{Type: ImageType(imageType), Quality: parseInt(query.Get("quality"))})
+		if err != nil {
+			ErrorReply(r, w, NewError("Error while processing the image: "+err.Error(), BadRequest), o)
+			return
+		}
+
+		replyImage(w, image)
+	}
+}
+
+// replyImage writes the given image as response body.
+func replyImage(w http.ResponseWriter, image Image) {
+	w.Header().Set("Content-Type", image.Mime)
+	w.Header().Set("Content-Length", strconv.Itoa(len(image.Body)))
 	w.Write(image.Body)
 }
 
+// replyImageRange writes the given unmodified or cached image as response body, honoring the
+// Range requests with 206 partial responses, so the large assets and resumable downloads work.
+func replyImageRange(w http.ResponseWriter, r *http.Request, image Image) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		replyImage(w, image)
+		return
+	}
+	w.Header().Set("Content-Type", image.Mime)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(image.Body))
+}
+
 func formController(w http.ResponseWriter, r *http.Request) {
 	operations := []struct {
 		name   string
@@ -148,6 +597,7 @@ func formController(w http.ResponseWriter, r *http.Request) {
 		{"SmartCrop", "crop", "width=300&height=260&quality=95&gravity=smart"},
 		{"Extract", "extract", "top=100&left=100&areawidth=300&areaheight=150"},
 		{"Enlarge", "enlarge", "width=1440&height=900&quality=95"},
+		{"Fit outside", "fit", "width=300&height=300&outside=true"},
 		{"Rotate", "rotate", "rotate=180"},
 		{"Flip", "flip", ""},
 		{"Flop", "flop", ""},
@@ -157,6 +607,7 @@ func formController(w http.ResponseWriter, r *http.Request) {
 		{"Add watermark", "watermark", "textwidth=100&text=Hello&font=sans%2012&opacity=0.5&color=255,200,50"},
 		{"Convert format", "convert", "type=png"},
 		{"Image metadata", "info", ""},
+		{"Image statistics", "stats", ""},
 		{"Gaussian blur", "blur", "sigma=15.0&minampl=0.2"},
 		{"Pipeline (image reduction via multiple transformations)", "pipeline", "operations=%5B%7B%22operation%22:%20%22crop%22,%20%22params%22:%20%7B%22width%22:%20300,%20%22height%22:%20260%7D%7D,%20%7B%22operation%22:%20%22convert%22,%20%22params%22:%20%7B%22type%22:%20%22webp%22%7D%7D%5D"},
 	}
@@ -166,7 +617,7 @@ func formController(w http.ResponseWriter, r *http.Request) {
 	for _, form := range operations {
 		html += fmt.Sprintf(`
     <h1>%s</h1>
-    <form method="POST" action="/%s?%s" enctype="multipart/form-data">
+    <form method="POST" action="%s?%s" enctype="multipart/form-data">
       <input type="file" name="file" />
       <input type="submit" value="Upload" />
     </form>`, form.name, form.method, form.args)
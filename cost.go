@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// CostHeader is the response header exposing the estimated processing cost of the image requests
+const CostHeader = "X-Imaginary-Cost"
+
+// wrapperOperations returns the names of the operations wrapping the endpoint operation of
+// the given options, in the order they are run.
+func wrapperOperations(o ImageOptions) []string {
+	names := []string{}
+	for _, wrapper := range []struct {
+		name    string
+		enabled bool
+	}{
+		{"denoise", o.Denoise != 0},
+		{"border", o.Border != ""},
+		{"animate", isAnimationControlled(o)},
+		{"upscale", o.Upscale != ""},
+		{"density", o.Density != 0},
+		{"webp", o.NearLossless != 0 || o.Effort != 0},
+		{"subsample", o.Subsample != ""},
+		{"autoquality", o.AutoQuality},
+		{"maxbytes", o.MaxBytes > 0},
+		{"lqip", o.LQIP},
+	} {
+		if wrapper.enabled {
+			names = append(names, wrapper.name)
+		}
+	}
+	return names
+}
+
+// operationsCount returns the number of image operations run by the given options: the
+// pipeline operations, or the endpoint operation, and the operations wrapping it. Every
+// overlay image, such as the composite ones, is one more operation, since it is decoded too.
+func operationsCount(o ImageOptions) int {
+	count := len(o.Operations)
+	for _, operation := range o.Operations {
+		if image, ok := operation.Params["image"].(string); ok && image != "" {
+			count++
+		}
+	}
+	if count == 0 {
+		count = 1
+		if o.Image != "" {
+			count++
+		}
+	}
+	return count + len(wrapperOperations(o))
+}
+
+// estimateCost estimates the processing cost of the given image and options, which is
+// the image megapixels multiplied by the number of operations, before decoding the image.
+func estimateCost(buf []byte, o ImageOptions) (float64, error) {
+	size, err := bimg.Size(buf)
+	if err != nil {
+		return 0, NewError("Cannot retrieve image metadata: "+err.Error(), BadRequest)
+	}
+	return sizeCost(size, o), nil
+}
+
+// sizeCost returns the processing cost of the given image size and options
+func sizeCost(size bimg.ImageSize, o ImageOptions) float64 {
+	megapixels := float64(size.Width) * float64(size.Height) / 1e6
+	return megapixels * float64(operationsCount(o))
+}
+
+// checkCost exposes the estimated processing cost of the given image request via the
+// cost response header, failing if it exceeds the maximum allowed cost, if any.
+func checkCost(w http.ResponseWriter, buf []byte, opts ImageOptions, o ServerOptions) error {
+	cost, err := estimateCost(buf, opts)
+	if err != nil {
+		return err
+	}
+	return checkCostLimit(w, cost, o)
+}
+
+// checkCostLimit exposes the given processing cost via the cost response header, failing
+// if it exceeds the maximum allowed cost, if any.
+func checkCostLimit(w http.ResponseWriter, cost float64, o ServerOptions) error {
+	w.Header().Set(CostHeader, strconv.FormatFloat(cost, 'f', 2, 64))
+	if o.MaxCost > 0 && cost > o.MaxCost {
+		return NewError(fmt.Sprintf("Image exceeds the maximum allowed processing cost: %.2f > %.2f", cost, o.MaxCost), TooLarge)
+	}
+	return nil
+}
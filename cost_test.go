@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOperationsCount(t *testing.T) {
+	cases := []struct {
+		options ImageOptions
+		count   int
+	}{
+		{ImageOptions{}, 1},
+		{ImageOptions{Border: "10", AutoQuality: true}, 3},
+		{ImageOptions{Operations: PipelineOperations{{Name: "crop"}, {Name: "blur"}}}, 2},
+		{ImageOptions{Operations: PipelineOperations{{Name: "crop"}}, LQIP: true}, 2},
+		{ImageOptions{Image: "http://server/logo.png"}, 2},
+		{ImageOptions{Operations: PipelineOperations{{Name: "composite", Params: map[string]interface{}{"image": "http://server/logo.png"}}, {Name: "blur"}}}, 3},
+	}
+	for _, test := range cases {
+		if count := operationsCount(test.options); count != test.count {
+			t.Errorf("Invalid operations count of %#v: %d != %d", test.options, count, test.count)
+		}
+	}
+}
+
+func TestCheckCost(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("large.jpg"))
+	opts := ImageOptions{Operations: PipelineOperations{{Name: "crop"}, {Name: "blur"}, {Name: "flip"}}}
+
+	cost, err := estimateCost(buf, opts)
+	if err != nil || cost < 6.22 || cost > 6.23 {
+		t.Fatalf("Invalid cost of 3 operations of a 1920x1080 image: %f %v", cost, err)
+	}
+
+	w := httptest.NewRecorder()
+	if err := checkCost(w, buf, opts, ServerOptions{MaxCost: 10}); err != nil {
+		t.Errorf("Unexpected cost error: %s", err)
+	}
+	if header := w.Header().Get(CostHeader); header != "6.22" {
+		t.Errorf("Invalid cost header: %s", header)
+	}
+
+	err = checkCost(httptest.NewRecorder(), buf, opts, ServerOptions{MaxCost: 5})
+	if err == nil {
+		t.Fatal("Expected cost budget error")
+	}
+	if code := err.(Error).HTTPCode(); code != 413 {
+		t.Errorf("Invalid cost budget error status: %d", code)
+	}
+
+	if _, err := estimateCost([]byte("not an image"), opts); err == nil {
+		t.Error("Expected invalid image error")
+	}
+}
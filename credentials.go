@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// OriginCredential represents the credential of a protected image source server: a bearer
+// token, basic auth user:password pair, custom header value, AWS SigV4 credentials or
+// OAuth2 client credentials.
+type OriginCredential struct {
+	Bearer string            `json:"bearer"`
+	Basic  string            `json:"basic"`
+	Header string            `json:"header"`
+	Value  string            `json:"value"`
+	AWS    *AWSCredential    `json:"aws"`
+	OAuth2 *OAuth2Credential `json:"oauth2"`
+}
+
+// OriginCredentials maps the image source server hosts, such as cdn.example.com,
+// or any subdomain of a domain, such as *.example.com, to their credential.
+type OriginCredentials map[string]OriginCredential
+
+// parseOriginCredentials parses the origin credentials JSON document
+func parseOriginCredentials(buf []byte) (OriginCredentials, error) {
+	credentials := OriginCredentials{}
+	if err := json.Unmarshal(buf, &credentials); err != nil {
+		return nil, err
+	}
+
+	for host, c := range credentials {
+		defined := 0
+		for _, value := range []string{c.Bearer, c.Basic, c.Header} {
+			if value != "" {
+				defined++
+			}
+		}
+		if c.AWS != nil {
+			defined++
+		}
+		if c.OAuth2 != nil {
+			defined++
+		}
+		if defined != 1 {
+			return nil, fmt.Errorf("origin %s must define one of bearer, basic, header, aws or oauth2 credentials", host)
+		}
+		if c.OAuth2 != nil {
+			if err := c.OAuth2.load(); err != nil {
+				return nil, fmt.Errorf("origin %s oauth2 credentials: %s", host, err)
+			}
+		}
+		if c.AWS != nil {
+			if err := c.AWS.load(); err != nil {
+				return nil, fmt.Errorf("origin %s aws credentials: %s", host, err)
+			}
+		}
+		if c.Basic != "" && !strings.Contains(c.Basic, ":") {
+			return nil, fmt.Errorf("origin %s basic credentials must be a user:password pair", host)
+		}
+		if c.Header != "" && c.Value == "" {
+			return nil, fmt.Errorf("origin %s header credentials require a value", host)
+		}
+	}
+	return credentials, nil
+}
+
+// Lookup returns the credential of the given host, matching the host with port first,
+// then the host name and finally the wildcard subdomains, from the most specific one.
+func (c OriginCredentials) Lookup(host string) (OriginCredential, bool) {
+	if credential, ok := c[host]; ok {
+		return credential, true
+	}
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+		if credential, ok := c[host]; ok {
+			return credential, true
+		}
+	}
+	for domain := host; strings.Contains(domain, "."); {
+		domain = domain[strings.Index(domain, ".")+1:]
+		if credential, ok := c["*."+domain]; ok {
+			return credential, true
+		}
+	}
+	return OriginCredential{}, false
+}
+
+// strip removes the credential headers of the given image source server request
+func (c OriginCredential) strip(req *http.Request) {
+	switch {
+	case c.Header != "":
+		req.Header.Del(c.Header)
+	case c.AWS != nil:
+		for _, name := range []string{"X-Amz-Date", "X-Amz-Content-Sha256", "X-Amz-Security-Token"} {
+			req.Header.Del(name)
+		}
+	}
+	req.Header.Del("Authorization")
+}
+
+// apply sets the credential header of the given image source server request
+func (c OriginCredential) apply(req *http.Request) error {
+	switch {
+	case c.Bearer != "":
+		req.Header.Set("Authorization", "Bearer "+c.Bearer)
+	case c.Basic != "":
+		req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(c.Basic)))
+	case c.Header != "":
+		req.Header.Set(c.Header, c.Value)
+	case c.AWS != nil:
+		c.AWS.sign(req, time.Now())
+	case c.OAuth2 != nil:
+		token, err := c.OAuth2.Token()
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return nil
+}
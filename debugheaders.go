@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Debug response headers of the image requests, emitted if the debug headers are enabled
+const (
+	ServerTimingHeader = "Server-Timing"
+	DebugCacheHeader   = "X-Imaginary-Cache"
+)
+
+// Timings records the durations of the processing phases and operations of an image request,
+// replied via the Server-Timing header. A nil Timings records nothing.
+type Timings struct {
+	mutex   sync.Mutex
+	metrics []string
+	nested  time.Duration
+}
+
+// newTimings returns the timings of an image request, or nil if the debug headers are disabled
+func newTimings(o ServerOptions) *Timings {
+	if !o.DebugHeaders {
+		return nil
+	}
+	return &Timings{}
+}
+
+// Add records the given duration of the given phase or operation
+func (t *Timings) Add(name string, duration time.Duration) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.metrics = append(t.metrics, formatTiming(name, duration))
+}
+
+// Since records the duration of the given phase or operation started at the given time
+func (t *Timings) Since(name string, start time.Time) {
+	t.Add(name, time.Since(start))
+}
+
+// Operation wraps the given operation recording its duration, excluding the durations
+// of the operations it wraps, which record their own duration.
+func (t *Timings) Operation(name string, operation Operation) Operation {
+	if t == nil {
+		return operation
+	}
+	return func(buf []byte, o ImageOptions) (Image, error) {
+		outer := t.swapNested(0)
+		start := time.Now()
+		image, err := operation.Run(buf, o)
+		elapsed := time.Since(start)
+		t.Add(name, elapsed-t.swapNested(outer+elapsed))
+		return image, err
+	}
+}
+
+// swapNested replaces the duration of the nested operations by the given one, returning the previous one
+func (t *Timings) swapNested(nested time.Duration) time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	previous := t.nested
+	t.nested = nested
+	return previous
+}
+
+// String returns the recorded timings as Server-Timing header value
+func (t *Timings) String() string {
+	if t == nil {
+		return ""
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return strings.Join(t.metrics, ", ")
+}
+
+// formatTiming returns the Server-Timing metric of the given duration, in milliseconds
+func formatTiming(name string, duration time.Duration) string {
+	return fmt.Sprintf("%s;dur=%.1f", name, float64(duration)/float64(time.Millisecond))
+}
+
+// setDebugHeaders sets the Server-Timing header of the recorded timings, if enabled
+func setDebugHeaders(w http.ResponseWriter, timings *Timings) {
+	if timings != nil {
+		w.Header().Add(ServerTimingHeader, timings.String())
+	}
+}
+
+// debugCacheStatus returns the given result cache status, such as hit or miss, if the debug headers are enabled
+func debugCacheStatus(status string, o ServerOptions) string {
+	if !o.DebugHeaders {
+		return ""
+	}
+	return status
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimingsOperation(t *testing.T) {
+	timings := &Timings{}
+	sleep := func(duration time.Duration, operation Operation) Operation {
+		return func(buf []byte, o ImageOptions) (Image, error) {
+			time.Sleep(duration)
+			if operation == nil {
+				return Image{}, nil
+			}
+			return operation.Run(buf, o)
+		}
+	}
+
+	inner := timings.Operation("inner", sleep(50*time.Millisecond, nil))
+	timings.Operation("outer", sleep(5*time.Millisecond, inner)).Run(nil, ImageOptions{})
+
+	metrics := strings.Split(timings.String(), ", ")
+	if len(metrics) != 2 || !strings.HasPrefix(metrics[0], "inner;dur=") || !strings.HasPrefix(metrics[1], "outer;dur=") {
+		t.Fatalf("Invalid timings: %s", timings)
+	}
+	if outer, _ := strconv.ParseFloat(strings.TrimPrefix(metrics[1], "outer;dur="), 64); outer >= 50 {
+		t.Errorf("The outer duration should exclude the inner one: %s", metrics[1])
+	}
+
+	var disabled *Timings
+	disabled.Add("resize", time.Second)
+	if disabled.String() != "" {
+		t.Error("Disabled timings should record nothing")
+	}
+}
+
+func TestDebugHeaders(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("large.jpg"))
+	req := httptest.NewRequest("GET", "/resize?width=300&border=10", nil)
+	w := httptest.NewRecorder()
+
+	imageHandler(w, req, buf, Resize, ServerOptions{}, nil)
+	if w.Header().Get(ServerTimingHeader) != "" {
+		t.Fatalf("Debug headers should be disabled by default: %v", w.Header())
+	}
+
+	w = httptest.NewRecorder()
+	imageHandler(w, req, buf, Resize, ServerOptions{DebugHeaders: true}, nil)
+	timing := w.Header().Get(ServerTimingHeader)
+	for _, metric := range []string{"decode;dur=", "queue;dur=", "resize;dur=", "border;dur=", "encode;dur="} {
+		if !strings.Contains(timing, metric) {
+			t.Errorf("Missing %s timing: %s", metric, timing)
+		}
+	}
+}
+
+func TestDebugCacheHeader(t *testing.T) {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(ServerTimingHeader, "resize;dur=10.0")
+		w.Write([]byte("image"))
+	}
+	handler := cacheResults(fn, ServerOptions{ResultCache: NewResultCache(1024 * 1024), DebugHeaders: true})
+
+	for _, status := range []string{"miss", "hit"} {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "/resize?width=100", nil))
+		if w.Header().Get(DebugCacheHeader) != status {
+			t.Errorf("Invalid cache status: %s", w.Header().Get(DebugCacheHeader))
+		}
+		if status == "hit" && w.Header().Get(ServerTimingHeader) != "cache;desc=hit" {
+			t.Errorf("Cache hits should not report the cached image timings: %s", w.Header().Get(ServerTimingHeader))
+		}
+	}
+}
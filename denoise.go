@@ -0,0 +1,36 @@
+package main
+
+import "gopkg.in/h2non/bimg.v1"
+
+// maxDenoiseStrength is the maximum denoise strength, matching a 11x11 median window
+const maxDenoiseStrength = 5
+
+// denoiseSaveSuffix encodes the denoised image losslessly and fast, since
+// it is processed again by the operation.
+const denoiseSaveSuffix = ".png[compression=1]"
+
+// Denoise returns the operation smoothing the image noise via a median filter before
+// performing the given operation, such as heavy downscales of noisy phone photos,
+// which also improves the output compression efficiency.
+// The denoise strength defines the median window radius, from 1 (3x3) to 5 (11x11).
+func Denoise(operation Operation) Operation {
+	return func(buf []byte, o ImageOptions) (Image, error) {
+		if o.Denoise == 0 {
+			return operation.Run(buf, o)
+		}
+		if o.Denoise < 0 || o.Denoise > maxDenoiseStrength {
+			return Image{}, NewError("Invalid denoise param, must be between 1 and 5", BadRequest)
+		}
+
+		denoised, err := vipsMedian(buf, o.Denoise*2+1, denoiseSaveSuffix)
+		if err != nil {
+			return Image{}, err
+		}
+
+		// Preserve the source image type, since the denoised image is always PNG
+		if t := bimg.DetermineImageType(buf); o.Type == "" && bimg.IsImageTypeSupportedByVips(t).Save {
+			o.Type = bimg.ImageTypeName(t)
+		}
+		return operation.Run(denoised, o)
+	}
+}
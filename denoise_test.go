@@ -0,0 +1,39 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+func TestDenoise(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+
+	image, err := Denoise(Resize)(buf, ImageOptions{Width: 300, Denoise: 2})
+	if err != nil {
+		t.Fatalf("Cannot denoise the image: %s", err)
+	}
+	if image.Mime != "image/jpeg" {
+		t.Errorf("Invalid image MIME type: %s", image.Mime)
+	}
+	if size, _ := bimg.Size(image.Body); size.Width != 300 {
+		t.Errorf("Invalid image width: %d", size.Width)
+	}
+
+	if _, err := Denoise(Resize)(buf, ImageOptions{Width: 300, Denoise: 10}); err == nil {
+		t.Error("Expected invalid denoise error")
+	}
+}
+
+func TestDenoiseDisabled(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+
+	image, err := Denoise(Noop)(buf, ImageOptions{})
+	if err != nil {
+		t.Fatalf("Cannot process the image: %s", err)
+	}
+	if len(image.Body) != len(buf) {
+		t.Error("The image must not be processed if denoise is not defined")
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// maxDensity is the maximum output density, in dots per inch
+const maxDensity = 2400
+
+// isVectorImage reports whether the given image is rasterized at a given density, such as PDF or SVG images
+func isVectorImage(buf []byte) bool {
+	t := bimg.DetermineImageType(buf)
+	return t == bimg.PDF || t == bimg.SVG
+}
+
+// checkDensity returns an error if the given density is out of the supported range
+func checkDensity(density int) error {
+	if density < 0 || density > maxDensity {
+		return NewError(fmt.Sprintf("Density must be between 1 and %d DPI", maxDensity), BadRequest)
+	}
+	return nil
+}
+
+// rasterize rasterizes the given page of the PDF, or SVG, image at the given density,
+// instead of the 72 DPI default, encoded as PNG, to be processed as any other still image.
+func rasterize(buf []byte, page, density int) ([]byte, error) {
+	if err := checkDensity(density); err != nil {
+		return nil, err
+	}
+	if page < 0 {
+		return nil, NewError("Page number must be a positive number", BadRequest)
+	}
+	if bimg.DetermineImageType(buf) != bimg.PDF {
+		page = -1
+	}
+	return vipsRasterize(buf, page, density, pageSaveSuffix)
+}
+
+// Density wraps the given operation, tagging its JPEG, PNG or TIFF output with the given
+// physical resolution, since print vendors usually reject the 72 DPI default.
+func Density(operation Operation) Operation {
+	return func(buf []byte, o ImageOptions) (Image, error) {
+		if err := checkDensity(o.Density); err != nil {
+			return Image{}, err
+		}
+
+		output := outputOptions(buf, o).Type
+		suffix := densitySaveSuffix(output, o)
+		if suffix == "" {
+			return operation(buf, o)
+		}
+
+		reference, err := losslessOutput(operation, buf, o)
+		if err != nil || reference.Mime != "image/png" {
+			return reference, err
+		}
+
+		body, err := vipsResolution(reference.Body, float64(o.Density)/25.4, suffix)
+		if err != nil {
+			return Image{}, err
+		}
+		return Image{Body: body, Mime: GetImageMimeType(output)}, nil
+	}
+}
+
+// densitySaveSuffix returns the libvips save suffix of the given image type, if it stores
+// the physical resolution, such as the JFIF density, or the PNG pHYs chunk.
+func densitySaveSuffix(t bimg.ImageType, o ImageOptions) string {
+	switch t {
+	case bimg.JPEG, bimg.PNG:
+		return thumbnailSaveSuffix(t, o)
+	case bimg.TIFF:
+		if o.StripMetadata {
+			return ".tif[strip]"
+		}
+		return ".tif"
+	}
+	return ""
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"testing"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// jfifDensity returns the horizontal density, in dots per inch, of the given JPEG image JFIF segment
+func jfifDensity(buf []byte) float64 {
+	i := bytes.Index(buf, []byte("JFIF\x00"))
+	if i < 0 || i+10 > len(buf) {
+		return 0
+	}
+	density := float64(binary.BigEndian.Uint16(buf[i+8:]))
+	switch buf[i+7] {
+	case 1:
+		return density
+	case 2:
+		return density * 2.54
+	}
+	return 0
+}
+
+// pngDensity returns the horizontal density, in dots per inch, of the given PNG image pHYs chunk
+func pngDensity(buf []byte) float64 {
+	i := bytes.Index(buf, []byte("pHYs"))
+	if i < 0 || i+13 > len(buf) || buf[i+12] != 1 {
+		return 0
+	}
+	return float64(binary.BigEndian.Uint32(buf[i+4:])) * 0.0254
+}
+
+func TestDensitySaveSuffix(t *testing.T) {
+	cases := []struct {
+		imageType bimg.ImageType
+		expected  string
+	}{
+		{bimg.JPEG, ".jpg[Q=80]"},
+		{bimg.PNG, ".png[compression=6]"},
+		{bimg.TIFF, ".tif"},
+		{bimg.WEBP, ""},
+		{bimg.GIF, ""},
+	}
+
+	for _, c := range cases {
+		if suffix := densitySaveSuffix(c.imageType, ImageOptions{}); suffix != c.expected {
+			t.Errorf("Invalid density save suffix: %s != %s", suffix, c.expected)
+		}
+	}
+}
+
+func TestDensity(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+
+	image, err := Density(Resize)(buf, ImageOptions{Width: 300, Height: 200, Density: 300})
+	if err != nil {
+		t.Fatalf("Cannot tag the image density: %s", err)
+	}
+	if image.Mime != "image/jpeg" {
+		t.Errorf("Invalid image MIME type: %s", image.Mime)
+	}
+	if density := jfifDensity(image.Body); math.Abs(density-300) > 1 {
+		t.Errorf("Invalid JPEG density: %g", density)
+	}
+	if err := assertSize(image.Body, 300, 200); err != nil {
+		t.Error(err)
+	}
+
+	image, err = Density(Resize)(buf, ImageOptions{Width: 300, Density: 150, Type: "png"})
+	if err != nil {
+		t.Fatalf("Cannot tag the image density: %s", err)
+	}
+	if density := pngDensity(image.Body); math.Abs(density-150) > 1 {
+		t.Errorf("Invalid PNG density: %g", density)
+	}
+
+	if _, err := Density(Resize)(buf, ImageOptions{Width: 300, Density: 5000}); err == nil {
+		t.Error("Expected an error with an invalid density")
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// Supported output bit depths, in bits per sample
+const (
+	depth8  = 8
+	depth16 = 16
+)
+
+// checkDepth returns an error if the given output bit depth is not supported
+func checkDepth(depth int) error {
+	if depth != 0 && depth != depth8 && depth != depth16 {
+		return NewError(fmt.Sprintf("Depth must be %d or %d bits", depth8, depth16), BadRequest)
+	}
+	return nil
+}
+
+// highDepthPath processes the resize and conversion requests of high bit depth sources, such as
+// 16-bit PNG or TIFF images, via vips_thumbnail, preserving their depth for the PNG or TIFF output
+// instead of flattening it to 8 bits, as bimg does, if the depth param requests it.
+// It returns false if the request is not eligible, in which case the regular processing must be used.
+func highDepthPath(buf []byte, o ImageOptions, crop bool) (Image, bool) {
+	if o.Depth != depth16 || hasTransformParams(o) || (crop && (o.Width == 0 || o.Height == 0)) {
+		return Image{}, false
+	}
+
+	outputType := ImageType(o.Type)
+	if outputType == bimg.UNKNOWN {
+		outputType = bimg.DetermineImageType(buf)
+	}
+	if outputType != bimg.PNG && outputType != bimg.TIFF {
+		return Image{}, false
+	}
+
+	if depth, err := vipsBitDepth(buf); err != nil || depth <= depth8 {
+		return Image{}, false
+	}
+
+	body, err := vipsThumbnail(buf, o.Width, o.Height, crop, densitySaveSuffix(outputType, o))
+	if err != nil {
+		debug("high depth path failed, falling back: %s", err)
+		return Image{}, false
+	}
+
+	return Image{Body: body, Mime: GetImageMimeType(outputType)}, true
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"testing"
+)
+
+// pngBitDepth returns the bits per sample of the given PNG image header
+func pngBitDepth(buf []byte) int {
+	if len(buf) < 25 {
+		return 0
+	}
+	return int(buf[24])
+}
+
+func TestHighDepth(t *testing.T) {
+	img := image.NewRGBA64(image.Rect(0, 0, 64, 48))
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			img.SetRGBA64(x, y, color.RGBA64{uint16(x * 1000), uint16(y * 1300), 12345, 0xFFFF})
+		}
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+
+	image, err := Resize(buf.Bytes(), ImageOptions{Width: 32, Type: "png", Depth: 16})
+	if err != nil {
+		t.Fatalf("Cannot resize the image: %s", err)
+	}
+	if depth := pngBitDepth(image.Body); depth != 16 {
+		t.Errorf("Invalid bit depth: %d", depth)
+	}
+	if err := assertSize(image.Body, 32, 24); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHighDepthSource(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("test.png"))
+
+	image, err := Convert(buf, ImageOptions{Type: "png", Depth: 16})
+	if err != nil {
+		t.Fatalf("Cannot convert the image: %s", err)
+	}
+	if depth := pngBitDepth(image.Body); depth != 8 {
+		t.Errorf("Invalid bit depth of an 8-bit source: %d", depth)
+	}
+
+	if _, err := Convert(buf, ImageOptions{Type: "png", Depth: 12}); err == nil {
+		t.Error("Expected an error with an invalid depth")
+	}
+}
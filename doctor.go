@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+const doctorUsage = `imaginary doctor %s
+
+Verifies the runtime environment of the server started with the given flags:
+the libvips version and image formats, the writable and mounted directories,
+the configuration files and the reachability of the allowed origins.
+Exits with a non-zero status if any check fails.
+
+Usage:
+  imaginary doctor
+  imaginary doctor -mount ./images -rewrite-rules ./rules.json -allowed-origins https://images.example.com
+
+Options:
+  The server options, such as -mount, -allowed-origins and the configuration file paths
+`
+
+// doctorTimeout is the maximum time to wait for the allowed origins responses
+const doctorTimeout = 5 * time.Second
+
+// DoctorCheck represents the result of a runtime environment check. Failed optional
+// checks are reported as warnings, not failing the doctor subcommand.
+type DoctorCheck struct {
+	Name     string
+	Detail   string
+	Err      error
+	Optional bool
+}
+
+// vipsFormat represents an image format, its libvips loader operation and its save suffix, if any
+type vipsFormat struct {
+	Name     string
+	Loader   string
+	Suffix   string
+	Required bool
+}
+
+// vipsFormats are the image formats checked by the doctor subcommand
+var vipsFormats = []vipsFormat{
+	{"jpeg", "jpegload_buffer", ".jpg", true},
+	{"png", "pngload_buffer", ".png", true},
+	{"webp", "webpload_buffer", ".webp", false},
+	{"gif", "gifload_buffer", ".gif", false},
+	{"tiff", "tiffload_buffer", ".tiff", false},
+	{"heif", "heifload_buffer", ".heic", false},
+	{"avif", "heifload_buffer", ".avif", false},
+	{"pdf", "pdfload_buffer", "", false},
+	{"svg", "svgload_buffer", "", false},
+}
+
+// doctorFile represents a configuration file of the given flag, validated by the given loader
+type doctorFile struct {
+	Flag string
+	Path string
+	Load func(path string) error
+}
+
+// doctorVips checks the libvips version, and the loaders and savers of the image formats,
+// saving a generated image, since the savers can be compiled in without their encoder.
+func doctorVips() []DoctorCheck {
+	checks := []DoctorCheck{{Name: "libvips version", Detail: bimg.VipsVersion}}
+	if bimg.VipsMajorVersion < 8 || (bimg.VipsMajorVersion == 8 && bimg.VipsMinorVersion < 6) {
+		checks[0].Err = errors.New("libvips 8.6+ is recommended, some operations are slower or not supported")
+		checks[0].Optional = true
+	}
+
+	buf := warmupImage()
+	for _, format := range vipsFormats {
+		loader := DoctorCheck{Name: format.Name + " loader", Detail: format.Loader, Optional: !format.Required}
+		if !vipsOperationExists(format.Loader) {
+			loader.Err = errors.New("not compiled in libvips")
+		}
+		checks = append(checks, loader)
+
+		if format.Suffix != "" {
+			saver := DoctorCheck{Name: format.Name + " saver", Detail: format.Suffix, Optional: !format.Required}
+			if _, err := vipsEncode(buf, format.Suffix); err != nil {
+				saver.Err = fmt.Errorf("cannot save: %s", strings.TrimSpace(err.Error()))
+			}
+			checks = append(checks, saver)
+		}
+	}
+	return checks
+}
+
+// doctorDirectories checks the given writable directories, such as the temporary one used
+// by libvips, and the given mounted directory, if any.
+func doctorDirectories(writable []string, mount string) []DoctorCheck {
+	checks := []DoctorCheck{}
+	for _, dir := range writable {
+		check := DoctorCheck{Name: "writable directory", Detail: dir}
+		file, err := ioutil.TempFile(dir, ".imaginary-doctor")
+		if err != nil {
+			check.Err = err
+		} else {
+			file.Close()
+			os.Remove(file.Name())
+		}
+		checks = append(checks, check)
+	}
+
+	if mount != "" {
+		check := DoctorCheck{Name: "mounted directory", Detail: mount}
+		dir, err := os.Open(mount)
+		if err == nil {
+			_, err = dir.Readdirnames(1)
+			dir.Close()
+		}
+		if err != nil && err != io.EOF {
+			check.Err = err
+		}
+		checks = append(checks, check)
+	}
+	return checks
+}
+
+// doctorFiles checks the given configuration files, loading them
+func doctorFiles(files []doctorFile) []DoctorCheck {
+	checks := []DoctorCheck{}
+	for _, file := range files {
+		if file.Path == "" {
+			continue
+		}
+		checks = append(checks, DoctorCheck{Name: "-" + file.Flag + " file", Detail: file.Path, Err: file.Load(file.Path)})
+	}
+	return checks
+}
+
+// doctorOrigins checks the allowed origins are reachable, replying to a HEAD request of
+// their base URL with whatever status, ignoring the wildcard origins.
+func doctorOrigins(origins []*url.URL) []DoctorCheck {
+	client := &http.Client{Timeout: doctorTimeout}
+	checks := []DoctorCheck{}
+	for _, origin := range origins {
+		if origin.Host == "" || strings.Contains(origin.Host, "*") {
+			continue
+		}
+		u := &url.URL{Scheme: origin.Scheme, Host: origin.Host, Path: origin.Path}
+		check := DoctorCheck{Name: "allowed origin", Detail: u.String()}
+		res, err := client.Head(u.String())
+		if err != nil {
+			check.Err = err
+		} else {
+			res.Body.Close()
+		}
+		checks = append(checks, check)
+	}
+	return checks
+}
+
+// writeDoctorReport writes the report of the given checks, returning the number of failures
+func writeDoctorReport(w io.Writer, checks []DoctorCheck) int {
+	failures := 0
+	for _, check := range checks {
+		status := "ok"
+		if check.Err != nil && check.Optional {
+			status = "warn"
+		} else if check.Err != nil {
+			status = "fail"
+			failures++
+		}
+		line := fmt.Sprintf("%-5s %s: %s", status, check.Name, check.Detail)
+		if check.Err != nil {
+			line += " (" + check.Err.Error() + ")"
+		}
+		fmt.Fprintln(w, line)
+	}
+	fmt.Fprintf(w, "\n%d checks, %d failed\n", len(checks), failures)
+	return failures
+}
+
+// runDoctor verifies the runtime environment of the server started with the given flags,
+// exiting with a non-zero status if any check fails.
+func runDoctor(args []string) {
+	flag.CommandLine.Usage = func() {
+		fmt.Fprintf(os.Stderr, doctorUsage, Version)
+	}
+	flag.CommandLine.Parse(args)
+
+	writable := []string{os.TempDir()}
+	for _, path := range []string{*aAccessLog, *aAuditLog, *aPIDFile} {
+		if path != "" {
+			writable = append(writable, filepath.Dir(path))
+		}
+	}
+
+	files := []doctorFile{
+		{"rewrite-rules", *aRewriteRules, func(path string) error { _, err := LoadRewriteRules(path); return err }},
+		{"request-scripts", *aRequestScripts, func(path string) error { _, err := LoadRequestScripts(path); return err }},
+		{"ogimage-templates", *aOGTemplates, func(path string) error { _, err := LoadOGTemplates(path); return err }},
+		{"cdn-purge", *aCDNPurge, func(path string) error { _, err := LoadCDNPurgers(path); return err }},
+		{"worker", *aWorker, func(path string) error { _, err := LoadWorkerOptions(path); return err }},
+		{"jobs", *aJobs, func(path string) error { _, err := LoadJobsOptions(path); return err }},
+		{"api-key-file", *aAPIKeyFile, func(path string) error {
+			_, err := NewSecrets(SecretsOptions{APIKeyFile: path, KeyRotation: *aKeyRotation})
+			return err
+		}},
+		{"url-signature-key-file", *aURLSignatureFile, func(path string) error {
+			_, err := NewSecrets(SecretsOptions{URLSignatureKeyFile: path, KeyRotation: *aKeyRotation})
+			return err
+		}},
+		{"authorization-file", *aAuthorizationFile, func(path string) error { _, err := NewSecrets(SecretsOptions{AuthorizationFile: path}); return err }},
+		{"origin-credentials", *aOriginCredentials, func(path string) error { _, err := NewSecrets(SecretsOptions{OriginsFile: path}); return err }},
+		{"placeholder", *aPlaceholder, func(path string) error {
+			buf, err := ioutil.ReadFile(path)
+			if err == nil {
+				_, err = bimg.Size(buf)
+			}
+			return err
+		}},
+		{"certfile", *aCertFile, func(path string) error { _, err := tls.LoadX509KeyPair(path, *aKeyFile); return err }},
+	}
+
+	checks := doctorVips()
+	checks = append(checks, doctorDirectories(writable, *aMount)...)
+	checks = append(checks, doctorFiles(files)...)
+	checks = append(checks, doctorOrigins(parseOrigins(*aAllowedOrigins))...)
+
+	fmt.Printf("imaginary %s (bimg %s)\n\n", Version, bimg.Version)
+	if writeDoctorReport(os.Stdout, checks) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDoctorDirectories(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imaginary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	checks := doctorDirectories([]string{dir, filepath.Join(dir, "missing")}, dir)
+	if len(checks) != 3 || checks[0].Err != nil || checks[1].Err == nil || checks[2].Err != nil {
+		t.Errorf("Invalid directory checks: %#v", checks)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("Unexpected files left in the writable directory: %d", len(files))
+	}
+	if checks := doctorDirectories(nil, filepath.Join(dir, "missing")); len(checks) != 1 || checks[0].Err == nil {
+		t.Errorf("Expected missing mounted directory error: %#v", checks)
+	}
+}
+
+func TestDoctorFiles(t *testing.T) {
+	checks := doctorFiles([]doctorFile{
+		{"rewrite-rules", "", func(string) error { return errors.New("unexpected") }},
+		{"request-scripts", "scripts.json", func(path string) error { return errors.New("invalid " + path) }},
+		{"cdn-purge", "purge.json", func(string) error { return nil }},
+	})
+	if len(checks) != 2 || checks[0].Name != "-request-scripts file" || checks[0].Err == nil || checks[1].Err != nil {
+		t.Errorf("Invalid file checks: %#v", checks)
+	}
+}
+
+func TestDoctorOrigins(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "HEAD" {
+			t.Errorf("Invalid origin check method: %s", r.Method)
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	defer ts.Close()
+
+	checks := doctorOrigins(parseOrigins(ts.URL + ",https://*.example.com," + closed.URL))
+	if len(checks) != 2 || checks[0].Err != nil || checks[1].Err == nil {
+		t.Errorf("Invalid origin checks: %#v", checks)
+	}
+}
+
+func TestWriteDoctorReport(t *testing.T) {
+	out := &bytes.Buffer{}
+	failures := writeDoctorReport(out, []DoctorCheck{
+		{Name: "jpeg loader", Detail: "jpegload_buffer"},
+		{Name: "avif saver", Detail: ".avif", Err: errors.New("cannot save"), Optional: true},
+		{Name: "mounted directory", Detail: "./images", Err: errors.New("no such file or directory")},
+	})
+	if failures != 1 {
+		t.Errorf("Invalid failures count: %d", failures)
+	}
+	for _, line := range []string{"ok    jpeg loader: jpegload_buffer", "warn  avif saver: .avif (cannot save)", "fail  mounted directory: ./images", "3 checks, 1 failed"} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("Missing report line %q in: %s", line, out.String())
+		}
+	}
+}
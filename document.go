@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"net/http"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// documentController assembles the multiple image sources into a single multi-page document
+func documentController(o ServerOptions) func(http.ResponseWriter, *http.Request) {
+	return multiImageController(o, Document)
+}
+
+// Document assembles the given images, processed with the common width, height and
+// transformation params, into a single multi-page PDF document, or TIFF image, so
+// document-scanning workflows can download one artifact.
+func Document(images [][]byte, o ImageOptions) (Image, error) {
+	if len(images) == 0 {
+		return Image{}, ErrMissingImageSource
+	}
+	if len(images) > maxImages {
+		return Image{}, ErrTooManyImages
+	}
+
+	format := bimg.PDF
+	if o.Type != "" {
+		format = ImageType(o.Type)
+	}
+	if format != bimg.PDF && format != bimg.TIFF {
+		return Image{}, NewError("Documents can be only assembled as pdf or tiff", BadRequest)
+	}
+
+	// PDF documents embed the JPEG pages as is, while TIFF images embed the RGB pixels
+	pageOpts := o
+	pageOpts.Type = "png"
+	if format == bimg.PDF {
+		pageOpts.Type = "jpeg"
+	}
+	operation := Convert
+	if o.Width > 0 && o.Height > 0 {
+		operation = Fit
+	}
+
+	pages := make([]Image, len(images))
+	for i, buf := range images {
+		page, err := operation(buf, pageOpts)
+		if err != nil {
+			return Image{}, err
+		}
+		pages[i] = page
+	}
+
+	if format == bimg.TIFF {
+		body, err := encodeTIFFPages(pages)
+		if err != nil {
+			return Image{}, err
+		}
+		return Image{Body: body, Mime: "image/tiff"}, nil
+	}
+
+	body, err := encodePDFPages(pages)
+	if err != nil {
+		return Image{}, err
+	}
+	return Image{Body: body, Mime: "application/pdf"}, nil
+}
+
+// encodePDFPages encodes the given JPEG pages as a PDF document, one image per page,
+// sized at 72 DPI, embedding the JPEG data as is via the DCTDecode filter.
+func encodePDFPages(pages []Image) ([]byte, error) {
+	var buf bytes.Buffer
+	var offsets []int
+
+	object := func(body string, stream []byte) {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\n", len(offsets), body)
+		if stream != nil {
+			buf.WriteString("stream\n")
+			buf.Write(stream)
+			buf.WriteString("\nendstream\n")
+		}
+		buf.WriteString("endobj\n")
+	}
+
+	buf.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+
+	// The catalog and page tree objects precede the page, content and image objects of each page
+	kids := ""
+	for i := range pages {
+		kids += fmt.Sprintf("%d 0 R ", 3+3*i)
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>", nil)
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", kids, len(pages)), nil)
+
+	for i, page := range pages {
+		meta, err := bimg.Metadata(page.Body)
+		if err != nil {
+			return nil, err
+		}
+		size, colorspace := meta.Size, "/DeviceRGB"
+		switch meta.Channels {
+		case 1:
+			colorspace = "/DeviceGray"
+		case 4:
+			colorspace = "/DeviceCMYK"
+		}
+		id := 3 + 3*i
+		content := []byte(fmt.Sprintf("q %d 0 0 %d 0 0 cm /Im0 Do Q", size.Width, size.Height))
+
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /XObject << /Im0 %d 0 R >> >> /Contents %d 0 R >>",
+			size.Width, size.Height, id+2, id+1), nil)
+		object(fmt.Sprintf("<< /Length %d >>", len(content)), content)
+		object(fmt.Sprintf("<< /Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace %s /BitsPerComponent 8 /Filter /DCTDecode /Length %d >>",
+			size.Width, size.Height, colorspace, len(page.Body)), page.Body)
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+
+	return buf.Bytes(), nil
+}
+
+// TIFF tags of the multi-page TIFF images
+const (
+	tiffNewSubfileType = 254
+	tiffImageWidth     = 256
+	tiffImageLength    = 257
+	tiffBitsPerSample  = 258
+	tiffCompression    = 259
+	tiffPhotometric    = 262
+	tiffStripOffsets   = 273
+	tiffSamplesPerPix  = 277
+	tiffRowsPerStrip   = 278
+	tiffStripCounts    = 279
+	tiffPlanarConfig   = 284
+	tiffPageNumber     = 297
+)
+
+// TIFF field types
+const (
+	tiffShort = 3
+	tiffLong  = 4
+)
+
+// tiffEntry represents a TIFF directory entry, whose values fit in the entry value offset field,
+// short values being left-justified by the little endian byte order
+type tiffEntry struct {
+	tag, kind uint16
+	count     uint32
+	value     uint32
+}
+
+// encodeTIFFPages encodes the given pages as a multi-page TIFF image, one directory per page,
+// storing the RGB pixels, composed over white, as a single deflate compressed strip.
+func encodeTIFFPages(pages []Image) ([]byte, error) {
+	var buf bytes.Buffer
+	le := binary.LittleEndian
+
+	// Header, whose first directory offset is patched once the first page is written
+	buf.Write([]byte{'I', 'I', 42, 0, 0, 0, 0, 0})
+	next := 4
+
+	for i, page := range pages {
+		canvas, err := decodeCanvas(page.Body)
+		if err != nil {
+			return nil, err
+		}
+		size := canvas.Bounds().Size()
+
+		rgb := image.NewRGBA(canvas.Bounds())
+		draw.Draw(rgb, rgb.Bounds(), image.NewUniform(color.White), image.ZP, draw.Src)
+		draw.Draw(rgb, rgb.Bounds(), canvas, image.ZP, draw.Over)
+
+		var strip bytes.Buffer
+		zw := zlib.NewWriter(&strip)
+		row := make([]byte, size.X*3)
+		for y := 0; y < size.Y; y++ {
+			pix := rgb.Pix[y*rgb.Stride:]
+			for x := 0; x < size.X; x++ {
+				copy(row[x*3:x*3+3], pix[x*4:x*4+3])
+			}
+			zw.Write(row)
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+
+		// Bits per sample values do not fit in the entry, so they are stored before the strip
+		bitsOffset := buf.Len()
+		binary.Write(&buf, le, []uint16{8, 8, 8})
+		stripOffset := buf.Len()
+		buf.Write(strip.Bytes())
+		if buf.Len()%2 != 0 {
+			buf.WriteByte(0)
+		}
+
+		entries := []tiffEntry{
+			{tiffNewSubfileType, tiffLong, 1, 2},
+			{tiffImageWidth, tiffLong, 1, uint32(size.X)},
+			{tiffImageLength, tiffLong, 1, uint32(size.Y)},
+			{tiffBitsPerSample, tiffShort, 3, uint32(bitsOffset)},
+			{tiffCompression, tiffShort, 1, 8},
+			{tiffPhotometric, tiffShort, 1, 2},
+			{tiffStripOffsets, tiffLong, 1, uint32(stripOffset)},
+			{tiffSamplesPerPix, tiffShort, 1, 3},
+			{tiffRowsPerStrip, tiffLong, 1, uint32(size.Y)},
+			{tiffStripCounts, tiffLong, 1, uint32(strip.Len())},
+			{tiffPlanarConfig, tiffShort, 1, 1},
+			{tiffPageNumber, tiffShort, 2, uint32(i) | uint32(len(pages))<<16},
+		}
+
+		ifd := buf.Len()
+		le.PutUint32(buf.Bytes()[next:], uint32(ifd))
+		binary.Write(&buf, le, uint16(len(entries)))
+		for _, e := range entries {
+			binary.Write(&buf, le, e.tag)
+			binary.Write(&buf, le, e.kind)
+			binary.Write(&buf, le, e.count)
+			binary.Write(&buf, le, e.value)
+		}
+		next = buf.Len()
+		binary.Write(&buf, le, uint32(0))
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strconv"
+	"testing"
+)
+
+func readDocumentImages() [][]byte {
+	first, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+	second, _ := ioutil.ReadAll(readFile("test.png"))
+	return [][]byte{first, second}
+}
+
+func TestDocumentPDF(t *testing.T) {
+	image, err := Document(readDocumentImages(), ImageOptions{Width: 300, Height: 300})
+	if err != nil {
+		t.Fatalf("Cannot assemble the document: %s", err)
+	}
+	if image.Mime != "application/pdf" {
+		t.Errorf("Invalid document MIME type: %s", image.Mime)
+	}
+
+	body := image.Body
+	if !bytes.HasPrefix(body, []byte("%PDF-1.4")) || !bytes.HasSuffix(body, []byte("%%EOF\n")) {
+		t.Fatal("Invalid PDF document")
+	}
+	if !bytes.Contains(body, []byte("/Count 2")) {
+		t.Error("Invalid PDF pages count")
+	}
+
+	// The cross-reference table must point to the objects
+	start := bytes.LastIndex(body, []byte("startxref\n")) + len("startxref\n")
+	end := start + bytes.IndexByte(body[start:], '\n')
+	xref, _ := strconv.Atoi(string(body[start:end]))
+	if !bytes.HasPrefix(body[xref:], []byte("xref\n0 9\n")) {
+		t.Fatalf("Invalid PDF cross-reference table offset: %d", xref)
+	}
+	entry := body[xref+len("xref\n0 9\n")+20:]
+	offset, _ := strconv.Atoi(string(entry[:10]))
+	if !bytes.HasPrefix(body[offset:], []byte("1 0 obj")) {
+		t.Errorf("Invalid PDF object offset: %d", offset)
+	}
+}
+
+func TestDocumentTIFF(t *testing.T) {
+	image, err := Document(readDocumentImages(), ImageOptions{Width: 300, Height: 300, Type: "tiff"})
+	if err != nil {
+		t.Fatalf("Cannot assemble the document: %s", err)
+	}
+	if image.Mime != "image/tiff" {
+		t.Errorf("Invalid document MIME type: %s", image.Mime)
+	}
+	if err := assertSize(image.Body, 222, 300); err != nil {
+		t.Error(err)
+	}
+
+	page, err := extractPage(image.Body, 1)
+	if err != nil {
+		t.Fatalf("Cannot extract the second page: %s", err)
+	}
+	if err := assertSize(page, 300, 225); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDocumentErrors(t *testing.T) {
+	if _, err := Document(readDocumentImages(), ImageOptions{Type: "png"}); err == nil {
+		t.Error("Expected an error with a PNG document")
+	}
+	if _, err := Document(nil, ImageOptions{}); err != ErrMissingImageSource {
+		t.Errorf("Expected the missing image source error, got: %v", err)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"strings"
+)
+
+// Default gradient and vignette params
+const (
+	gradientDefaultOpacity = 0.8
+	vignetteDefaultOpacity = 0.6
+	vignetteDefaultRadius  = 0.5
+)
+
+// shadeImage mixes every canvas pixel with the given color, weighted by the given function,
+// preserving the canvas alpha channel.
+func shadeImage(canvas *image.RGBA, c color.RGBA, weight func(x, y int) float64) {
+	bounds := canvas.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			w := weight(x, y)
+			if w <= 0 {
+				continue
+			}
+			base := canvas.RGBAAt(x, y)
+			mixed := mixColors(base, c, w)
+			mixed.A = base.A
+			canvas.SetRGBA(x, y, mixed)
+		}
+	}
+}
+
+// radialDistance returns the normalized elliptical distance from the canvas
+// centre, which is 1 at the canvas corners.
+func radialDistance(bounds image.Rectangle) func(x, y int) float64 {
+	cx, cy := float64(bounds.Dx())/2, float64(bounds.Dy())/2
+	return func(x, y int) float64 {
+		dx, dy := (float64(x)+0.5-cx)/cx, (float64(y)+0.5-cy)/cy
+		return math.Sqrt((dx*dx + dy*dy) / 2)
+	}
+}
+
+// linearDistance returns the normalized distance from the opposite canvas side of
+// the given direction, which is 1 at the direction side.
+func linearDistance(bounds image.Rectangle, direction string) (func(x, y int) float64, error) {
+	w, h := float64(bounds.Dx()-1), float64(bounds.Dy()-1)
+	w, h = math.Max(w, 1), math.Max(h, 1)
+
+	switch strings.ToLower(direction) {
+	case "", "bottom":
+		return func(x, y int) float64 { return float64(y) / h }, nil
+	case "top":
+		return func(x, y int) float64 { return 1 - float64(y)/h }, nil
+	case "right":
+		return func(x, y int) float64 { return float64(x) / w }, nil
+	case "left":
+		return func(x, y int) float64 { return 1 - float64(x)/w }, nil
+	}
+	return nil, NewError("Invalid direction param: "+direction, BadRequest)
+}
+
+// smoothstep performs the Hermite interpolation of x between the edges.
+func smoothstep(edge0, edge1, x float64) float64 {
+	if x <= edge0 {
+		return 0
+	}
+	if x >= edge1 {
+		return 1
+	}
+	t := (x - edge0) / (edge1 - edge0)
+	return t * t * (3 - 2*t)
+}
+
+func shadeColor(c []uint8) color.RGBA {
+	if len(c) == 3 {
+		return color.RGBA{c[0], c[1], c[2], 0xff}
+	}
+	return color.RGBA{0, 0, 0, 0xff}
+}
+
+func shadeOpacity(opacity float32, fallback float64) (float64, error) {
+	if opacity < 0 || opacity > 1 {
+		return 0, NewError("Invalid opacity param, must be between 0 and 1", BadRequest)
+	}
+	if opacity == 0 {
+		return fallback, nil
+	}
+	return float64(opacity), nil
+}
+
+// Gradient overlays a linear gradient, from transparent to the given color in the given
+// direction, or a radial gradient, from transparent at the centre to the color at the edges.
+func Gradient(buf []byte, o ImageOptions) (Image, error) {
+	opacity, err := shadeOpacity(o.Opacity, gradientDefaultOpacity)
+	if err != nil {
+		return Image{}, err
+	}
+
+	canvas, err := decodeCanvas(buf)
+	if err != nil {
+		return Image{}, err
+	}
+
+	var distance func(x, y int) float64
+	switch strings.ToLower(o.Shape) {
+	case "", "linear":
+		if distance, err = linearDistance(canvas.Bounds(), o.Direction); err != nil {
+			return Image{}, err
+		}
+	case "radial":
+		distance = radialDistance(canvas.Bounds())
+	default:
+		return Image{}, NewError("Invalid shape param: "+o.Shape, BadRequest)
+	}
+
+	shadeImage(canvas, shadeColor(o.Color), func(x, y int) float64 {
+		return math.Min(distance(x, y), 1) * opacity
+	})
+	return encodeCanvas(canvas, outputOptions(buf, o))
+}
+
+// Vignette darkens the image edges, smoothly from the given radius, relative
+// to the distance from the image centre to the corners.
+func Vignette(buf []byte, o ImageOptions) (Image, error) {
+	opacity, err := shadeOpacity(o.Opacity, vignetteDefaultOpacity)
+	if err != nil {
+		return Image{}, err
+	}
+	radius := o.Radius
+	if radius == 0 {
+		radius = vignetteDefaultRadius
+	}
+	if radius < 0 || radius >= 1 {
+		return Image{}, NewError("Invalid radius param, must be between 0 and 1", BadRequest)
+	}
+
+	canvas, err := decodeCanvas(buf)
+	if err != nil {
+		return Image{}, err
+	}
+
+	distance := radialDistance(canvas.Bounds())
+	shadeImage(canvas, shadeColor(o.Color), func(x, y int) float64 {
+		return smoothstep(radius, 1, distance(x, y)) * opacity
+	})
+	return encodeCanvas(canvas, outputOptions(buf, o))
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"io/ioutil"
+	"math"
+	"testing"
+)
+
+func TestLinearDistance(t *testing.T) {
+	bounds := image.Rect(0, 0, 11, 11)
+	cases := []struct {
+		direction string
+		x, y      int
+		expected  float64
+	}{
+		{"", 0, 10, 1},
+		{"bottom", 0, 0, 0},
+		{"top", 0, 0, 1},
+		{"right", 5, 0, 0.5},
+		{"left", 10, 0, 0},
+	}
+
+	for _, test := range cases {
+		distance, err := linearDistance(bounds, test.direction)
+		if err != nil {
+			t.Fatalf("Cannot create linear distance: %s", err)
+		}
+		if d := distance(test.x, test.y); d != test.expected {
+			t.Errorf("Invalid %q distance: %f", test.direction, d)
+		}
+	}
+
+	if _, err := linearDistance(bounds, "diagonal"); err == nil {
+		t.Error("Expected invalid direction error")
+	}
+}
+
+func TestRadialDistance(t *testing.T) {
+	distance := radialDistance(image.Rect(0, 0, 100, 50))
+	if d := distance(50, 25); d > 0.02 {
+		t.Errorf("Invalid centre distance: %f", d)
+	}
+	if d := distance(99, 49); math.Abs(d-1) > 0.02 {
+		t.Errorf("Invalid corner distance: %f", d)
+	}
+}
+
+func TestShadeImage(t *testing.T) {
+	white := color.RGBA{0xff, 0xff, 0xff, 0x80}
+	canvas := newCanvas(2, 1, white, white)
+
+	shadeImage(canvas, color.RGBA{0, 0, 0, 0xff}, func(x, y int) float64 {
+		return float64(x) / 2
+	})
+
+	if c := canvas.RGBAAt(0, 0); c != white {
+		t.Errorf("Invalid unshaded color: %v", c)
+	}
+	if c := canvas.RGBAAt(1, 0); c != (color.RGBA{0x80, 0x80, 0x80, 0x80}) {
+		t.Errorf("Invalid shaded color: %v", c)
+	}
+}
+
+func TestGradient(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("test.png"))
+
+	for _, shape := range []string{"linear", "radial"} {
+		image, err := Gradient(buf, ImageOptions{Shape: shape, Opacity: 1})
+		if err != nil {
+			t.Fatalf("Cannot apply %s gradient: %s", shape, err)
+		}
+		if image.Mime != "image/png" {
+			t.Errorf("Invalid image MIME type: %s", image.Mime)
+		}
+
+		canvas, _ := decodeCanvas(image.Body)
+		size := canvas.Bounds().Size()
+		if c := canvas.RGBAAt(size.X-1, size.Y-1); c.R > 8 || c.G > 8 || c.B > 8 {
+			t.Errorf("Invalid %s gradient end color: %v", shape, c)
+		}
+	}
+
+	if _, err := Gradient(buf, ImageOptions{Shape: "conic"}); err == nil {
+		t.Error("Expected invalid shape error")
+	}
+}
+
+func TestVignette(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+	src, _ := decodeCanvas(buf)
+
+	image, err := Vignette(buf, ImageOptions{Opacity: 1})
+	if err != nil {
+		t.Fatalf("Cannot apply vignette: %s", err)
+	}
+	if image.Mime != "image/jpeg" {
+		t.Errorf("Invalid image MIME type: %s", image.Mime)
+	}
+
+	canvas, _ := decodeCanvas(image.Body)
+	if canvas.Bounds() != src.Bounds() {
+		t.Fatalf("Invalid image size: %v", canvas.Bounds().Size())
+	}
+	if c := canvas.RGBAAt(0, 0); c.R > 8 || c.G > 8 || c.B > 8 {
+		t.Errorf("Invalid vignette corner color: %v", c)
+	}
+
+	if _, err := Vignette(buf, ImageOptions{Radius: 1}); err == nil {
+		t.Error("Expected invalid radius error")
+	}
+}
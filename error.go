@@ -19,31 +19,115 @@ const (
 	NotFound
 	NotImplemented
 	Forbidden
+	Timeout
+	TooLarge
+	TooManyRequests
+	BadGateway
 )
 
+// ProblemContentType is the content type of the RFC 7807 problem details error responses
+const ProblemContentType = "application/problem+json"
+
+// Stable machine readable error codes of the problem details, which clients can branch on
+const (
+	ProblemUnavailable       = "unavailable"
+	ProblemInvalidParam      = "invalid_param"
+	ProblemMethodNotAllowed  = "method_not_allowed"
+	ProblemUnsupportedFormat = "unsupported_format"
+	ProblemUnauthorized      = "unauthorized"
+	ProblemInternalError     = "internal_error"
+	ProblemNotFound          = "not_found"
+	ProblemNotImplemented    = "not_implemented"
+	ProblemForbidden         = "forbidden"
+	ProblemTimeout           = "timeout"
+	ProblemTooLarge          = "too_large"
+	ProblemTooManyRequests   = "too_many_requests"
+	ProblemBadGateway        = "bad_gateway"
+	ProblemOriginDenied      = "origin_denied"
+	ProblemOriginFetchFailed = "origin_fetch_failed"
+)
+
+// problemCodes are the default problem codes of the error codes
+var problemCodes = map[uint8]string{
+	Unavailable:     ProblemUnavailable,
+	BadRequest:      ProblemInvalidParam,
+	NotAllowed:      ProblemMethodNotAllowed,
+	Unsupported:     ProblemUnsupportedFormat,
+	Unauthorized:    ProblemUnauthorized,
+	InternalError:   ProblemInternalError,
+	NotFound:        ProblemNotFound,
+	NotImplemented:  ProblemNotImplemented,
+	Forbidden:       ProblemForbidden,
+	Timeout:         ProblemTimeout,
+	TooLarge:        ProblemTooLarge,
+	TooManyRequests: ProblemTooManyRequests,
+	BadGateway:      ProblemBadGateway,
+}
+
 var (
 	ErrNotFound             = NewError("Not found", NotFound)
 	ErrInvalidApiKey        = NewError("Invalid or missing API key", Unauthorized)
 	ErrMethodNotAllowed     = NewError("Method not allowed", NotAllowed)
 	ErrUnsupportedMedia     = NewError("Unsupported media type", Unsupported)
-	ErrOutputFormat         = NewError("Unsupported output image format", BadRequest)
+	ErrOutputFormat         = NewError("Unsupported output image format", BadRequest).WithProblem(ProblemUnsupportedFormat)
 	ErrEmptyBody            = NewError("Empty image", BadRequest)
 	ErrMissingParamFile     = NewError("Missing required param: file", BadRequest)
 	ErrInvalidFilePath      = NewError("Invalid file path", BadRequest)
 	ErrInvalidImageURL      = NewError("Invalid image URL", BadRequest)
+	ErrURLSourceDisabled    = NewError("Remote image URLs are not enabled", NotAllowed).WithProblem(ProblemOriginDenied)
 	ErrMissingImageSource   = NewError("Cannot process the image due to missing or invalid params", BadRequest)
 	ErrNotImplemented       = NewError("Not implemented endpoint", NotImplemented)
 	ErrInvalidURLSignature  = NewError("Invalid URL signature", BadRequest)
 	ErrURLSignatureMismatch = NewError("URL signature mismatch", Forbidden)
+	ErrInvalidURLExpiry     = NewError("Invalid or missing URL signature expiry", BadRequest)
+	ErrURLSignatureExpired  = NewError("URL signature expired", Forbidden)
+	ErrClientIPNotAllowed   = NewError("Client IP address not allowed", Forbidden)
+	ErrProcessingTimeout    = NewError("Image processing timeout exceeded", Timeout)
+	ErrTooManyRequests      = NewError("Too many concurrent requests of the client", TooManyRequests)
+	ErrRateLimitExceeded    = NewError("Request rate limit exceeded", TooManyRequests)
+	ErrInternalServer       = NewError("Internal server error", InternalError)
 )
 
 type Error struct {
-	Message string `json:"message,omitempty"`
-	Code    uint8  `json:"code"`
+	Message string
+	Code    uint8
+	Problem string
+}
+
+// Problem represents the RFC 7807 problem details of an error, extended with its stable error code.
+// The problem type is always about:blank, since the code identifies the error.
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	Code   string `json:"code"`
+}
+
+// WithProblem returns the error with the given problem code, instead of the default one of its error code
+func (e Error) WithProblem(problem string) Error {
+	e.Problem = problem
+	return e
 }
 
+// ProblemCode returns the stable problem code of the error
+func (e Error) ProblemCode() string {
+	if e.Problem != "" {
+		return e.Problem
+	}
+	return problemCodes[e.Code]
+}
+
+// JSON returns the problem details JSON of the error
 func (e Error) JSON() []byte {
-	buf, _ := json.Marshal(e)
+	status := e.HTTPCode()
+	buf, _ := json.Marshal(Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: e.Message,
+		Code:   e.ProblemCode(),
+	})
 	return buf
 }
 
@@ -76,31 +160,95 @@ func (e Error) HTTPCode() int {
 	if e.Code == Forbidden {
 		return http.StatusForbidden
 	}
+	if e.Code == Timeout {
+		return http.StatusGatewayTimeout
+	}
+	if e.Code == TooLarge {
+		return http.StatusRequestEntityTooLarge
+	}
+	if e.Code == TooManyRequests {
+		return http.StatusTooManyRequests
+	}
+	if e.Code == BadGateway {
+		return http.StatusBadGateway
+	}
 	return http.StatusServiceUnavailable
 }
 
 func NewError(err string, code uint8) Error {
 	err = strings.Replace(err, "\n", "", -1)
-	return Error{err, code}
+	return Error{err, code, ""}
+}
+
+// NewSourceError creates a bad request error of the given image source error, prefixed
+// by the given message, with the problem code of the denied origins, the failed origin
+// fetches and the oversized images, which are replied as too large requests.
+func NewSourceError(prefix string, err error) Error {
+	e := NewError(prefix+err.Error(), BadRequest)
+	switch err := err.(type) {
+	case Error:
+		e.Problem = err.ProblemCode()
+	case FetchError:
+		e.Problem = ProblemOriginFetchFailed
+	case AuditError:
+		if err.Event == AuditOriginDenied {
+			e.Problem = ProblemOriginDenied
+		} else if err.Event == AuditOversizedInput {
+			e.Code, e.Problem = TooLarge, ProblemTooLarge
+		}
+	}
+	return e
+}
+
+// errorImageSize returns the requested dimensions of the error and placeholder images,
+// failing if they exceed the synthesized images limits, since they are replied to
+// unauthorized requests too.
+func errorImageSize(req *http.Request) (int, int, error) {
+	query := req.URL.Query()
+	width, height := parseInt(query.Get("width")), parseInt(query.Get("height"))
+	if width == 0 && height == 0 {
+		return 0, 0, nil
+	}
+	checkWidth, checkHeight := width, height
+	if checkWidth == 0 {
+		checkWidth = 1
+	}
+	if checkHeight == 0 {
+		checkHeight = 1
+	}
+	return width, height, checkCanvasSize(checkWidth, checkHeight)
+}
+
+// replyWithProblem replies the given error as JSON problem details
+func replyWithProblem(w http.ResponseWriter, err Error) error {
+	w.Header().Set("Content-Type", ProblemContentType)
+	w.WriteHeader(err.HTTPCode())
+	w.Write(err.JSON())
+	return err
 }
 
 func replyWithPlaceholder(req *http.Request, w http.ResponseWriter, err Error, o ServerOptions) error {
 	image := o.PlaceholderImage
 
+	width, height, _err := errorImageSize(req)
+	if _err != nil {
+		return replyWithProblem(w, err)
+	}
+
 	// Resize placeholder to expected output
 	buf, _err := bimg.Resize(o.PlaceholderImage, bimg.Options{
 		Force:   true,
 		Crop:    true,
 		Enlarge: true,
-		Width:   parseInt(req.URL.Query().Get("width")),
-		Height:  parseInt(req.URL.Query().Get("height")),
+		Width:   width,
+		Height:  height,
 		Type:    ImageType(req.URL.Query().Get("type")),
 	})
 
 	if _err != nil {
-		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Type", ProblemContentType)
 		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(fmt.Sprintf("{\"error\":\"%s\", \"code\": %d}", _err.Error(), BadRequest)))
+		w.Write(NewError(_err.Error(), BadRequest).JSON())
 		return _err
 	}
 
@@ -115,13 +263,108 @@ func replyWithPlaceholder(req *http.Request, w http.ResponseWriter, err Error, o
 	return err
 }
 
+// replyWithErrorImage renders the error message into the placeholder image,
+// resized to the requested dimensions and encoded in the requested image type.
+// Dimensions beyond the synthesized images limits are replied as JSON problem instead.
+func replyWithErrorImage(req *http.Request, w http.ResponseWriter, err Error, o ServerOptions) error {
+	image := o.PlaceholderImage
+	if len(image) == 0 {
+		image = placeholder
+	}
+
+	width, height, _err := errorImageSize(req)
+	if _err != nil {
+		return replyWithProblem(w, err)
+	}
+
+	buf, _err := bimg.Resize(image, bimg.Options{
+		Force:   true,
+		Crop:    true,
+		Enlarge: true,
+		Width:   width,
+		Height:  height,
+		Type:    errorImageType(req),
+	})
+	if _err == nil {
+		buf, _err = renderErrorText(buf, err.Message)
+	}
+
+	if _err != nil {
+		return replyWithProblem(w, err)
+	}
+
+	w.Header().Set("Content-Type", GetImageMimeType(bimg.DetermineImageType(buf)))
+	w.Header().Set("Error", string(err.JSON()))
+	w.WriteHeader(err.HTTPCode())
+	w.Write(buf)
+	return err
+}
+
+// errorImageType returns the requested output image type, defaulting to JPEG.
+func errorImageType(req *http.Request) bimg.ImageType {
+	name := req.URL.Query().Get("type")
+	if name == "auto" {
+		name = determineAcceptMimeType(req.Header.Get("Accept"))
+	}
+	if imageType := ImageType(name); imageType != bimg.UNKNOWN && bimg.IsImageTypeSupportedByVips(imageType).Save {
+		return imageType
+	}
+	return bimg.JPEG
+}
+
+// renderErrorText draws the given message as text over the image, scaling the font to the image width.
+func renderErrorText(buf []byte, message string) ([]byte, error) {
+	size, err := bimg.NewImage(buf).Size()
+	if err != nil {
+		return nil, err
+	}
+
+	margin := size.Width / 20
+	fontSize := size.Width / 40
+	if fontSize < 8 {
+		fontSize = 8
+	}
+
+	return bimg.NewImage(buf).Watermark(bimg.Watermark{
+		Text:        message,
+		Font:        fmt.Sprintf("sans bold %d", fontSize),
+		Width:       size.Width - margin*2,
+		Margin:      margin,
+		Opacity:     1,
+		NoReplicate: true,
+		Background:  bimg.Color{R: 60, G: 60, B: 60},
+	})
+}
+
+// shouldReplyWithErrorImage reports whether the error must be rendered as image,
+// which can be enabled globally or per request via the onerror param.
+func shouldReplyWithErrorImage(req *http.Request, o ServerOptions) bool {
+	switch req.URL.Query().Get("onerror") {
+	case "image":
+		return true
+	case "json":
+		return false
+	}
+	return o.ErrorImage
+}
+
 func ErrorReply(req *http.Request, w http.ResponseWriter, err Error, o ServerOptions) error {
+	// Report server side errors, if required
+	if code := err.HTTPCode(); code >= 500 && code != http.StatusNotImplemented {
+		reportError(o, NewErrorReport(req, err.Message, code))
+	}
+
+	// Reply with the error rendered as image, if required
+	if shouldReplyWithErrorImage(req, o) {
+		return replyWithErrorImage(req, w, err, o)
+	}
+
 	// Reply with placeholder if required
 	if o.EnablePlaceholder || o.Placeholder != "" {
 		return replyWithPlaceholder(req, w, err, o)
 	}
 
-	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Type", ProblemContentType)
 	w.WriteHeader(err.HTTPCode())
 	w.Write(err.JSON())
 	return err
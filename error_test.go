@@ -1,6 +1,11 @@
 package main
 
-import "testing"
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
 
 func TestError(t *testing.T) {
 	err := NewError("oops!\n\n", 1)
@@ -18,7 +23,87 @@ func TestError(t *testing.T) {
 	}
 
 	json := string(err.JSON())
-	if json != "{\"message\":\"oops!\",\"code\":1}" {
+	if json != "{\"type\":\"about:blank\",\"title\":\"Bad Request\",\"status\":400,\"detail\":\"oops!\",\"code\":\"invalid_param\"}" {
 		t.Fatalf("Invalid JSON output: %s", json)
 	}
 }
+
+func TestErrorProblemCodes(t *testing.T) {
+	for code := Unavailable; code <= TooManyRequests; code++ {
+		if (Error{Code: code}).ProblemCode() == "" {
+			t.Errorf("Missing problem code of the error code %d", code)
+		}
+	}
+	if ErrOutputFormat.ProblemCode() != ProblemUnsupportedFormat || ErrURLSourceDisabled.ProblemCode() != ProblemOriginDenied {
+		t.Error("Invalid problem codes of the predefined errors")
+	}
+}
+
+func TestNewSourceError(t *testing.T) {
+	cases := []struct {
+		err     error
+		code    uint8
+		problem string
+	}{
+		{errors.New("oops"), BadRequest, ProblemInvalidParam},
+		{ErrURLSourceDisabled, BadRequest, ProblemOriginDenied},
+		{NewFetchError("Error downloading image: (status=%d)", 404), BadRequest, ProblemOriginFetchFailed},
+		{NewAuditError(AuditOriginDenied, "Not allowed remote URL origin: foo.com"), BadRequest, ProblemOriginDenied},
+		{NewAuditError(AuditOversizedInput, "Content-Length 10 exceeds maximum allowed 5 bytes"), TooLarge, ProblemTooLarge},
+	}
+	for _, c := range cases {
+		err := NewSourceError("Cannot fetch: ", c.err)
+		if err.Code != c.code || err.ProblemCode() != c.problem || err.Message != "Cannot fetch: "+c.err.Error() {
+			t.Errorf("Invalid source error of %q: %#v", c.err, err)
+		}
+	}
+}
+
+func TestErrorReply(t *testing.T) {
+	req := httptest.NewRequest("GET", "/resize?width=300", nil)
+	w := httptest.NewRecorder()
+
+	ErrorReply(req, w, ErrInvalidApiKey, ServerOptions{})
+
+	if w.Code != 401 || w.Header().Get("Content-Type") != ProblemContentType {
+		t.Fatalf("Invalid response: %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	if body := w.Body.String(); !strings.Contains(body, `"code":"unauthorized"`) || !strings.Contains(body, `"detail":"Invalid or missing API key"`) {
+		t.Errorf("Invalid problem details: %s", body)
+	}
+}
+
+func TestErrorImageReply(t *testing.T) {
+	req := httptest.NewRequest("GET", "/resize?width=300&height=200&type=png&onerror=image", nil)
+	w := httptest.NewRecorder()
+
+	ErrorReply(req, w, ErrMissingImageSource, ServerOptions{})
+
+	if w.Code != 400 {
+		t.Fatalf("Invalid response status: %d", w.Code)
+	}
+	if w.Header().Get("Content-Type") != "image/png" {
+		t.Fatalf("Invalid content type: %s", w.Header().Get("Content-Type"))
+	}
+	if err := assertSize(w.Body.Bytes(), 300, 200); err != nil {
+		t.Error(err)
+	}
+
+	req = httptest.NewRequest("GET", "/resize?key=bad&width=30000&height=30000&onerror=image", nil)
+	w = httptest.NewRecorder()
+
+	ErrorReply(req, w, ErrInvalidApiKey, ServerOptions{})
+
+	if w.Code != 401 || w.Header().Get("Content-Type") != ProblemContentType {
+		t.Fatalf("Invalid oversized error image response: %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	req = httptest.NewRequest("GET", "/resize?width=300&onerror=json", nil)
+	w = httptest.NewRecorder()
+
+	ErrorReply(req, w, ErrMissingImageSource, ServerOptions{ErrorImage: true})
+
+	if w.Header().Get("Content-Type") != ProblemContentType {
+		t.Fatalf("Invalid content type: %s", w.Header().Get("Content-Type"))
+	}
+}
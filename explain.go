@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// ExplainHeader is the request header enabling the explain mode, as the explain param does
+const ExplainHeader = "X-Imaginary-Explain"
+
+// Explanation represents what an image request would do, replied by the explain mode
+// instead of processing the image.
+type Explanation struct {
+	Endpoint   string               `json:"endpoint"`
+	Source     ExplainedSource      `json:"source"`
+	Operations []ExplainedOperation `json:"operations"`
+	Output     ExplainedOutput      `json:"output"`
+	Cost       float64              `json:"cost"`
+}
+
+// ExplainedSource represents the resolved source image of an explained request
+type ExplainedSource struct {
+	Type   ImageSourceType `json:"type"`
+	URL    string          `json:"url,omitempty"`
+	File   string          `json:"file,omitempty"`
+	Mime   string          `json:"mime"`
+	Size   int             `json:"size"`
+	Width  int             `json:"width"`
+	Height int             `json:"height"`
+}
+
+// ExplainedOperation represents an image operation and its normalized params
+type ExplainedOperation struct {
+	Name   string                 `json:"name"`
+	Params map[string]interface{} `json:"params,omitempty"`
+}
+
+// ExplainedOutput represents the output format and the estimated output image dimensions
+type ExplainedOutput struct {
+	Type   string `json:"type"`
+	Mime   string `json:"mime"`
+	Width  int    `json:"width,omitempty"`
+	Height int    `json:"height,omitempty"`
+}
+
+// explainRequested reports whether the explain mode is requested via the explain param
+// or the explain header, if enabled.
+func explainRequested(r *http.Request, o ServerOptions) bool {
+	return o.EnableExplain && (parseBool(r.URL.Query().Get("explain")) || parseBool(r.Header.Get(ExplainHeader)))
+}
+
+// explainSource returns the resolved source image of the given request
+func explainSource(r *http.Request, buf []byte, mimeType string) ExplainedSource {
+	source := ExplainedSource{Type: ImageSourceTypeBody, Mime: mimeType, Size: len(buf)}
+	query := r.URL.Query()
+	if source.URL = query.Get("url"); source.URL != "" {
+		source.Type = ImageSourceTypeHttp
+	} else if source.File = query.Get("file"); source.File != "" {
+		source.Type = ImageSourceTypeFileSystem
+	}
+	if size, err := bimg.Size(buf); err == nil {
+		source.Width, source.Height = size.Width, size.Height
+	}
+	return source
+}
+
+// explainParams returns the normalized image params of the given query: the parsed values
+// of the defined params, the resolved relative dimensions and the negotiated output type.
+func explainParams(query url.Values, o ImageOptions) map[string]interface{} {
+	params := map[string]interface{}{}
+	for name, kind := range allowedParams {
+		value := query.Get(name)
+		if value == "" || name == "operations" {
+			continue
+		}
+		switch kind {
+		case "int":
+			params[name] = parseInt(value)
+		case "float":
+			params[name] = parseFloat(value)
+		case "bool":
+			params[name] = parseBool(value)
+		default:
+			params[name] = value
+		}
+	}
+
+	for name, value := range map[string]int{"width": o.Width, "height": o.Height, "top": o.Top, "left": o.Left, "areawidth": o.AreaWidth, "areaheight": o.AreaHeight} {
+		if value != 0 {
+			params[name] = value
+		}
+	}
+	if o.AutoQuality {
+		params["quality"] = "auto"
+	}
+	if o.Type != "" {
+		params["type"] = o.Type
+	}
+	return params
+}
+
+// estimateDimensions estimates the output image dimensions of the given endpoint and options,
+// from the given source image dimensions, without processing the image.
+func estimateDimensions(endpoint string, width, height int, o ImageOptions) (int, int, error) {
+	if len(o.Operations) > 0 || endpoint == "pipeline" {
+		if err := validatePipelineOperations(o.Operations); err != nil {
+			return 0, 0, err
+		}
+		for _, operation := range o.Operations {
+			var err error
+			if width, height, err = estimateDimensions(operation.Name, width, height, readMapParams(operation.Params)); err != nil {
+				return 0, 0, err
+			}
+		}
+		return width, height, nil
+	}
+
+	switch endpoint {
+	case "extract":
+		width, height = o.AreaWidth, o.AreaHeight
+	case "zoom":
+		if o.AreaWidth > 0 && o.AreaHeight > 0 {
+			width, height = o.AreaWidth, o.AreaHeight
+		}
+		if o.Factor > 0 {
+			width, height = width*o.Factor, height*o.Factor
+		}
+	case "fit", "thumbnail":
+		width, height = fitDimensions(width, height, o.Width, o.Height, endpoint == "fit" && o.Outside)
+	default:
+		width, height = scaleDimensions(width, height, o.Width, o.Height)
+	}
+
+	if o.Rotate == 90 || o.Rotate == 270 {
+		width, height = height, width
+	}
+	return width, height, nil
+}
+
+// scaleDimensions returns the given dimensions resized to the given box, keeping
+// the aspect ratio if only one of the box dimensions is defined.
+func scaleDimensions(width, height, boxWidth, boxHeight int) (int, int) {
+	switch {
+	case boxWidth > 0 && boxHeight > 0:
+		return boxWidth, boxHeight
+	case boxWidth > 0 && width > 0:
+		return boxWidth, boxWidth * height / width
+	case boxHeight > 0 && height > 0:
+		return boxHeight * width / height, boxHeight
+	}
+	return width, height
+}
+
+// fitDimensions returns the given dimensions fitted within the given box keeping the aspect
+// ratio, or covering the box instead, as the fit operation does.
+func fitDimensions(width, height, boxWidth, boxHeight int, outside bool) (int, int) {
+	if boxWidth == 0 || boxHeight == 0 || width == 0 || height == 0 {
+		return scaleDimensions(width, height, boxWidth, boxHeight)
+	}
+	if (width*boxHeight > boxWidth*height) != outside {
+		return boxWidth, boxWidth * height / width
+	}
+	return boxHeight * width / height, boxHeight
+}
+
+// explainImage returns the explanation of the given image request, the source image, its MIME
+// type and the resolved options, and whether the output image is encoded as ICO, failing if the
+// pipeline operations are invalid, as processing the image would.
+func explainImage(r *http.Request, buf []byte, mimeType string, opts ImageOptions, icoOutput bool) (Explanation, error) {
+	endpoint := endpointName(r)
+	explanation := Explanation{
+		Endpoint:   endpoint,
+		Source:     explainSource(r, buf, mimeType),
+		Operations: []ExplainedOperation{},
+	}
+
+	if len(opts.Operations) > 0 {
+		for _, operation := range opts.Operations {
+			explanation.Operations = append(explanation.Operations, ExplainedOperation{Name: operation.Name, Params: operation.Params})
+		}
+	} else {
+		explanation.Operations = append(explanation.Operations, ExplainedOperation{Name: endpoint, Params: explainParams(r.URL.Query(), opts)})
+	}
+	for _, name := range wrapperOperations(opts) {
+		explanation.Operations = append(explanation.Operations, ExplainedOperation{Name: name})
+	}
+
+	outputType := opts.Type
+	if outputType == "" {
+		outputType = ExtractImageTypeFromMime(mimeType)
+	}
+	if endpoint == "info" {
+		explanation.Output = ExplainedOutput{Type: "json", Mime: "application/json"}
+	} else {
+		width, height, err := estimateDimensions(endpoint, explanation.Source.Width, explanation.Source.Height, opts)
+		if err != nil {
+			return Explanation{}, err
+		}
+		explanation.Output = ExplainedOutput{Type: outputType, Mime: GetImageMimeType(ImageType(outputType)), Width: width, Height: height}
+	}
+	if icoOutput {
+		explanation.Output.Type, explanation.Output.Mime = "ico", ICOMimeType
+	}
+
+	explanation.Cost, _ = estimateCost(buf, opts)
+	return explanation, nil
+}
+
+// replyExplanation replies with the explanation of the given image request, which is never cached
+func replyExplanation(w http.ResponseWriter, r *http.Request, buf []byte, mimeType string, opts ImageOptions, icoOutput bool, o ServerOptions) {
+	explanation, err := explainImage(r, buf, mimeType, opts, icoOutput)
+	if err != nil {
+		ErrorReply(r, w, err.(Error), o)
+		return
+	}
+	body, _ := json.Marshal(explanation)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(body)
+}
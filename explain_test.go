@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEstimateDimensions(t *testing.T) {
+	cases := []struct {
+		endpoint      string
+		options       ImageOptions
+		width, height int
+	}{
+		{"resize", ImageOptions{Width: 300}, 300, 150},
+		{"resize", ImageOptions{Height: 100}, 200, 100},
+		{"crop", ImageOptions{Width: 300, Height: 300}, 300, 300},
+		{"fit", ImageOptions{Width: 300, Height: 300}, 300, 150},
+		{"fit", ImageOptions{Width: 300, Height: 300, Outside: true}, 600, 300},
+		{"thumbnail", ImageOptions{Width: 100, Height: 100}, 100, 50},
+		{"extract", ImageOptions{AreaWidth: 50, AreaHeight: 40}, 50, 40},
+		{"zoom", ImageOptions{Factor: 2}, 1600, 800},
+		{"rotate", ImageOptions{Rotate: 90}, 400, 800},
+		{"convert", ImageOptions{Type: "png"}, 800, 400},
+		{"pipeline", ImageOptions{Operations: PipelineOperations{
+			{Name: "crop", Params: map[string]interface{}{"width": float64(400), "height": float64(400)}},
+			{Name: "rotate", Params: map[string]interface{}{"rotate": float64(270)}},
+			{Name: "resize", Params: map[string]interface{}{"width": float64(100)}},
+		}}, 100, 100},
+	}
+	for _, test := range cases {
+		width, height, err := estimateDimensions(test.endpoint, 800, 400, test.options)
+		if err != nil || width != test.width || height != test.height {
+			t.Errorf("Invalid %s dimensions of %#v: %dx%d %v", test.endpoint, test.options, width, height, err)
+		}
+	}
+
+	for _, operations := range []PipelineOperations{
+		nil,
+		{{Name: "melt"}},
+		{{Name: "resize", Params: map[string]interface{}{"width": "wide"}}},
+	} {
+		if _, _, err := estimateDimensions("pipeline", 800, 400, ImageOptions{Operations: operations}); err == nil {
+			t.Errorf("Expected invalid pipeline error of %#v", operations)
+		}
+	}
+}
+
+func TestExplainRequested(t *testing.T) {
+	req := httptest.NewRequest("GET", "/resize?width=300&explain=true", nil)
+	if explainRequested(req, ServerOptions{}) {
+		t.Error("Explain mode should be disabled by default")
+	}
+	if !explainRequested(req, ServerOptions{EnableExplain: true}) {
+		t.Error("Explain mode should be requested via the explain param")
+	}
+
+	req = httptest.NewRequest("GET", "/resize?width=300", nil)
+	req.Header.Set(ExplainHeader, "1")
+	if !explainRequested(req, ServerOptions{EnableExplain: true}) {
+		t.Error("Explain mode should be requested via the explain header")
+	}
+}
+
+func TestExplainReply(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("large.jpg"))
+	req := httptest.NewRequest("GET", "/resize?width=50%25&type=webp&border=10&file=large.jpg&explain=true", nil)
+	w := httptest.NewRecorder()
+
+	imageHandler(w, req, buf, Resize, ServerOptions{EnableExplain: true}, nil)
+
+	if w.Header().Get("Content-Type") != "application/json" || w.Header().Get("Cache-Control") != "no-store" {
+		t.Fatalf("Invalid explain response headers: %v", w.Header())
+	}
+	var explanation Explanation
+	if err := json.Unmarshal(w.Body.Bytes(), &explanation); err != nil {
+		t.Fatalf("Invalid explanation: %s", err)
+	}
+
+	source := explanation.Source
+	if source.Type != ImageSourceTypeFileSystem || source.File != "large.jpg" || source.Width != 1920 || source.Height != 1080 || source.Mime != "image/jpeg" {
+		t.Errorf("Invalid explained source: %#v", source)
+	}
+	if len(explanation.Operations) != 2 || explanation.Operations[0].Name != "resize" || explanation.Operations[1].Name != "border" {
+		t.Fatalf("Invalid explained operations: %#v", explanation.Operations)
+	}
+	if params := explanation.Operations[0].Params; params["width"] != float64(960) || params["type"] != "webp" {
+		t.Errorf("Invalid normalized params: %v", params)
+	}
+	if output := explanation.Output; output.Type != "webp" || output.Mime != "image/webp" || output.Width != 960 || output.Height != 540 {
+		t.Errorf("Invalid explained output: %#v", output)
+	}
+	if explanation.Cost == 0 {
+		t.Error("Missing estimated cost")
+	}
+}
+
+func TestExplainReplyInvalidPipeline(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("large.jpg"))
+	req := httptest.NewRequest("GET", "/pipeline?operations=%5B%7B%22operation%22%3A%22melt%22%7D%5D&file=large.jpg&explain=true", nil)
+	w := httptest.NewRecorder()
+	imageHandler(w, req, buf, Pipeline, ServerOptions{EnableExplain: true}, nil)
+
+	if w.Code != 400 {
+		t.Errorf("Invalid pipelines should be rejected: %d", w.Code)
+	}
+}
@@ -0,0 +1,576 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// exprOperators are the expression operators, longest first
+var exprOperators = []string{"||", "&&", "==", "!=", "<=", ">=", "<", ">", "+", "-", "*", "/", "%", "!", "(", ")", "[", "]", ","}
+
+// exprPrecedence are the binary operators precedence, the higher binding the tighter
+var exprPrecedence = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"==": 3, "!=": 3,
+	"<": 4, "<=": 4, ">": 4, ">=": 4, "in": 4,
+	"+": 5, "-": 5,
+	"*": 6, "/": 6, "%": 6,
+}
+
+// ExprFunc represents a function callable by the expressions
+type ExprFunc func(args []interface{}) (interface{}, error)
+
+// ExprEnv represents the variables and functions of an expression evaluation
+type ExprEnv struct {
+	Vars  map[string]interface{}
+	Funcs map[string]ExprFunc
+}
+
+// Expr represents a parsed expression, such as header('X-Tenant') == 'acme' && param('width') > 1200,
+// evaluated to a string, number, boolean, list or null value. Strings are compared and added as
+// numbers when both operands are numeric, as the request params are strings.
+type Expr struct {
+	Source string
+	root   exprNode
+}
+
+type exprNode interface {
+	eval(env ExprEnv) (interface{}, error)
+}
+
+type exprLiteral struct{ value interface{} }
+type exprVar struct{ name string }
+type exprList struct{ items []exprNode }
+type exprUnary struct {
+	op      string
+	operand exprNode
+}
+type exprBinary struct {
+	op          string
+	left, right exprNode
+}
+type exprCall struct {
+	name string
+	args []exprNode
+}
+
+// exprToken represents a lexical token: an operator, identifier, number or string
+type exprToken struct {
+	kind  string
+	value string
+}
+
+// lexExpr splits the given expression source into tokens
+func lexExpr(source string) ([]exprToken, error) {
+	tokens := []exprToken{}
+	for i := 0; i < len(source); {
+		c := rune(source[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '\'' || c == '"':
+			j := i + 1
+			value := []byte{}
+			for ; j < len(source) && rune(source[j]) != c; j++ {
+				if source[j] == '\\' && j+1 < len(source) {
+					j++
+				}
+				value = append(value, source[j])
+			}
+			if j == len(source) {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			tokens = append(tokens, exprToken{"string", string(value)})
+			i = j + 1
+		case unicode.IsDigit(c) || (c == '.' && i+1 < len(source) && unicode.IsDigit(rune(source[i+1]))):
+			j := i
+			for j < len(source) && (unicode.IsDigit(rune(source[j])) || source[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, exprToken{"number", source[i:j]})
+			i = j
+		case unicode.IsLetter(c) || c == '_':
+			j := i
+			for j < len(source) && (unicode.IsLetter(rune(source[j])) || unicode.IsDigit(rune(source[j])) || source[j] == '_') {
+				j++
+			}
+			tokens = append(tokens, exprToken{"ident", source[i:j]})
+			i = j
+		default:
+			matched := false
+			for _, op := range exprOperators {
+				if strings.HasPrefix(source[i:], op) {
+					tokens = append(tokens, exprToken{"op", op})
+					i += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("unexpected character %q at %d", c, i)
+			}
+		}
+	}
+	return tokens, nil
+}
+
+// exprParser represents a precedence climbing parser of the expression tokens
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+}
+
+func (p *exprParser) peek() exprToken {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return exprToken{kind: "eof"}
+}
+
+func (p *exprParser) next() exprToken {
+	token := p.peek()
+	p.pos++
+	return token
+}
+
+func (p *exprParser) expect(op string) error {
+	if token := p.next(); token.kind != "op" || token.value != op {
+		return fmt.Errorf("expected %s", op)
+	}
+	return nil
+}
+
+// binaryOperator returns the binary operator of the next token, if any
+func (p *exprParser) binaryOperator() (string, bool) {
+	token := p.peek()
+	if token.kind == "op" || (token.kind == "ident" && token.value == "in") {
+		_, ok := exprPrecedence[token.value]
+		return token.value, ok
+	}
+	return "", false
+}
+
+func (p *exprParser) parseExpr(precedence int) (exprNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.binaryOperator()
+		if !ok || exprPrecedence[op] < precedence {
+			return left, nil
+		}
+		p.next()
+		right, err := p.parseExpr(exprPrecedence[op] + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = exprBinary{op, left, right}
+	}
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if token := p.peek(); token.kind == "op" && (token.value == "!" || token.value == "-") {
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return exprUnary{token.value, operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+// parseList parses the comma separated expressions up to the given closing operator
+func (p *exprParser) parseList(closing string) ([]exprNode, error) {
+	items := []exprNode{}
+	if token := p.peek(); token.kind == "op" && token.value == closing {
+		p.next()
+		return items, nil
+	}
+	for {
+		item, err := p.parseExpr(1)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+		if token := p.next(); token.kind != "op" || (token.value != "," && token.value != closing) {
+			return nil, fmt.Errorf("expected , or %s", closing)
+		} else if token.value == closing {
+			return items, nil
+		}
+	}
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	token := p.next()
+	switch token.kind {
+	case "number":
+		n, err := strconv.ParseFloat(token.value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number: %s", token.value)
+		}
+		return exprLiteral{n}, nil
+	case "string":
+		return exprLiteral{token.value}, nil
+	case "ident":
+		switch token.value {
+		case "true", "false":
+			return exprLiteral{token.value == "true"}, nil
+		case "null":
+			return exprLiteral{nil}, nil
+		}
+		if next := p.peek(); next.kind == "op" && next.value == "(" {
+			p.next()
+			args, err := p.parseList(")")
+			if err != nil {
+				return nil, err
+			}
+			return exprCall{token.value, args}, nil
+		}
+		return exprVar{token.value}, nil
+	case "op":
+		if token.value == "(" {
+			node, err := p.parseExpr(1)
+			if err != nil {
+				return nil, err
+			}
+			return node, p.expect(")")
+		}
+		if token.value == "[" {
+			items, err := p.parseList("]")
+			return exprList{items}, err
+		}
+	case "eof":
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unexpected %s", token.value)
+}
+
+// ParseExpr parses the given expression source
+func ParseExpr(source string) (*Expr, error) {
+	tokens, err := lexExpr(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens}
+	root, err := p.parseExpr(1)
+	if err != nil {
+		return nil, err
+	}
+	if token := p.peek(); token.kind != "eof" {
+		return nil, fmt.Errorf("unexpected %s", token.value)
+	}
+	return &Expr{Source: source, root: root}, nil
+}
+
+// Eval evaluates the expression in the given environment
+func (e *Expr) Eval(env ExprEnv) (interface{}, error) {
+	return e.root.eval(env)
+}
+
+func (n exprLiteral) eval(env ExprEnv) (interface{}, error) {
+	return n.value, nil
+}
+
+func (n exprVar) eval(env ExprEnv) (interface{}, error) {
+	value, ok := env.Vars[n.name]
+	if !ok {
+		return nil, fmt.Errorf("undefined variable: %s", n.name)
+	}
+	return value, nil
+}
+
+func (n exprList) eval(env ExprEnv) (interface{}, error) {
+	return evalExprs(n.items, env)
+}
+
+func (n exprCall) eval(env ExprEnv) (interface{}, error) {
+	fn, ok := env.Funcs[n.name]
+	if !ok {
+		fn, ok = exprBuiltins[n.name]
+	}
+	if !ok {
+		return nil, fmt.Errorf("undefined function: %s", n.name)
+	}
+	args, err := evalExprs(n.args, env)
+	if err != nil {
+		return nil, err
+	}
+	return fn(args)
+}
+
+func (n exprUnary) eval(env ExprEnv) (interface{}, error) {
+	value, err := n.operand.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if n.op == "!" {
+		return !exprTruthy(value), nil
+	}
+	number, ok := exprNumber(value)
+	if !ok {
+		return nil, fmt.Errorf("cannot negate %v", value)
+	}
+	return -number, nil
+}
+
+func (n exprBinary) eval(env ExprEnv) (interface{}, error) {
+	left, err := n.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	// Short-circuit the logical operators
+	if n.op == "||" && exprTruthy(left) {
+		return true, nil
+	}
+	if n.op == "&&" && !exprTruthy(left) {
+		return false, nil
+	}
+	right, err := n.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "||", "&&":
+		return exprTruthy(right), nil
+	case "==":
+		return exprEqual(left, right), nil
+	case "!=":
+		return !exprEqual(left, right), nil
+	case "in":
+		list, ok := right.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("the in operator requires a list")
+		}
+		for _, item := range list {
+			if exprEqual(left, item) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "+":
+		a, aok := exprNumber(left)
+		b, bok := exprNumber(right)
+		if aok && bok {
+			return a + b, nil
+		}
+		return exprString(left) + exprString(right), nil
+	}
+
+	a, aok := exprNumber(left)
+	b, bok := exprNumber(right)
+	if !aok || !bok {
+		return nil, fmt.Errorf("the %s operator requires numbers: %v, %v", n.op, left, right)
+	}
+	switch n.op {
+	case "<":
+		return a < b, nil
+	case "<=":
+		return a <= b, nil
+	case ">":
+		return a > b, nil
+	case ">=":
+		return a >= b, nil
+	case "-":
+		return a - b, nil
+	case "*":
+		return a * b, nil
+	}
+	if b == 0 {
+		return nil, fmt.Errorf("division by zero")
+	}
+	if n.op == "%" {
+		return math.Mod(a, b), nil
+	}
+	return a / b, nil
+}
+
+func evalExprs(nodes []exprNode, env ExprEnv) ([]interface{}, error) {
+	values := []interface{}{}
+	for _, node := range nodes {
+		value, err := node.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// exprTruthy returns whether the given value is true: not null, false, zero or empty
+func exprTruthy(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	case []interface{}:
+		return len(v) > 0
+	}
+	return true
+}
+
+// exprNumber returns the number of the given number, or numeric string, value
+func exprNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case string:
+		n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+// exprString returns the string representation of the given value
+func exprString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprint(value)
+}
+
+// exprEqual returns whether the given values are equal, numerically if both are numbers
+func exprEqual(a, b interface{}) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	x, xok := exprNumber(a)
+	y, yok := exprNumber(b)
+	if xok && yok {
+		return x == y
+	}
+	return exprString(a) == exprString(b)
+}
+
+// exprStrings returns the string representation of the given function arguments,
+// failing unless the given number of arguments is given.
+func exprStrings(name string, args []interface{}, count int) ([]string, error) {
+	if len(args) != count {
+		return nil, fmt.Errorf("%s requires %d arguments", name, count)
+	}
+	values := []string{}
+	for _, arg := range args {
+		values = append(values, exprString(arg))
+	}
+	return values, nil
+}
+
+// exprNumbers returns the numbers of the given function arguments
+func exprNumbers(name string, args []interface{}) ([]float64, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("%s requires arguments", name)
+	}
+	numbers := []float64{}
+	for _, arg := range args {
+		n, ok := exprNumber(arg)
+		if !ok {
+			return nil, fmt.Errorf("%s requires numbers: %v", name, arg)
+		}
+		numbers = append(numbers, n)
+	}
+	return numbers, nil
+}
+
+// exprBuiltins are the functions available to every expression
+var exprBuiltins = map[string]ExprFunc{
+	"lower": func(args []interface{}) (interface{}, error) {
+		s, err := exprStrings("lower", args, 1)
+		if err != nil {
+			return nil, err
+		}
+		return strings.ToLower(s[0]), nil
+	},
+	"upper": func(args []interface{}) (interface{}, error) {
+		s, err := exprStrings("upper", args, 1)
+		if err != nil {
+			return nil, err
+		}
+		return strings.ToUpper(s[0]), nil
+	},
+	"contains": func(args []interface{}) (interface{}, error) {
+		s, err := exprStrings("contains", args, 2)
+		if err != nil {
+			return nil, err
+		}
+		return strings.Contains(s[0], s[1]), nil
+	},
+	"startsWith": func(args []interface{}) (interface{}, error) {
+		s, err := exprStrings("startsWith", args, 2)
+		if err != nil {
+			return nil, err
+		}
+		return strings.HasPrefix(s[0], s[1]), nil
+	},
+	"endsWith": func(args []interface{}) (interface{}, error) {
+		s, err := exprStrings("endsWith", args, 2)
+		if err != nil {
+			return nil, err
+		}
+		return strings.HasSuffix(s[0], s[1]), nil
+	},
+	"matches": func(args []interface{}) (interface{}, error) {
+		s, err := exprStrings("matches", args, 2)
+		if err != nil {
+			return nil, err
+		}
+		return regexp.MatchString(s[1], s[0])
+	},
+	"len": func(args []interface{}) (interface{}, error) {
+		if len(args) == 1 {
+			if list, ok := args[0].([]interface{}); ok {
+				return float64(len(list)), nil
+			}
+		}
+		s, err := exprStrings("len", args, 1)
+		if err != nil {
+			return nil, err
+		}
+		return float64(len(s[0])), nil
+	},
+	"int": func(args []interface{}) (interface{}, error) {
+		n, err := exprNumbers("int", args)
+		if err != nil || len(n) != 1 {
+			return nil, fmt.Errorf("int requires a number")
+		}
+		return math.Trunc(n[0]), nil
+	},
+	"min": func(args []interface{}) (interface{}, error) {
+		n, err := exprNumbers("min", args)
+		if err != nil {
+			return nil, err
+		}
+		min := n[0]
+		for _, v := range n {
+			min = math.Min(min, v)
+		}
+		return min, nil
+	},
+	"max": func(args []interface{}) (interface{}, error) {
+		n, err := exprNumbers("max", args)
+		if err != nil {
+			return nil, err
+		}
+		max := n[0]
+		for _, v := range n {
+			max = math.Max(max, v)
+		}
+		return max, nil
+	},
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpr(t *testing.T) {
+	env := ExprEnv{
+		Vars: map[string]interface{}{"host": "cdn.acme.com", "width": "1600"},
+		Funcs: map[string]ExprFunc{
+			"header": func(args []interface{}) (interface{}, error) { return "acme", nil },
+		},
+	}
+	cases := []struct {
+		source string
+		value  interface{}
+	}{
+		{"1 + 2 * 3", float64(7)},
+		{"(1 + 2) * 3 % 4", float64(1)},
+		{"-width / 2", float64(-800)},
+		{"width > 1200 && header('X-Tenant') == 'acme'", true},
+		{"width == 1600.0", true},
+		{"!(width < 1200) || false", true},
+		{"'a' + \"b\" + 1", "ab1"},
+		{"width + 1", float64(1601)},
+		{"host in ['cdn.acme.com', 'img.acme.com']", true},
+		{"startsWith(host, 'cdn.') && endsWith(host, '.com') && contains(host, 'acme')", true},
+		{"matches(host, '^cdn\\\\.')", true},
+		{"upper(lower('AbC'))", "ABC"},
+		{"min(width, 1200, 3000)", float64(1200)},
+		{"max(int(2.7), len('abc'), len([1, 2]))", float64(3)},
+		{"null == null && !''", true},
+	}
+	for _, test := range cases {
+		expr, err := ParseExpr(test.source)
+		if err != nil {
+			t.Errorf("Cannot parse %s: %s", test.source, err)
+			continue
+		}
+		value, err := expr.Eval(env)
+		if err != nil || !reflect.DeepEqual(value, test.value) {
+			t.Errorf("Invalid value of %s: %#v %v", test.source, value, err)
+		}
+	}
+}
+
+func TestExprErrors(t *testing.T) {
+	for _, source := range []string{"", "1 +", "(1", "'abc", "1 2", "a $ b", "[1, 2"} {
+		if _, err := ParseExpr(source); err == nil {
+			t.Errorf("Expected parse error of %s", source)
+		}
+	}
+
+	for _, source := range []string{"undefined", "unknown()", "'a' > 1", "1 / 0", "1 in 'a'", "lower()", "-'a'"} {
+		expr, err := ParseExpr(source)
+		if err != nil {
+			t.Errorf("Cannot parse %s: %s", source, err)
+			continue
+		}
+		if _, err := expr.Eval(ExprEnv{}); err == nil {
+			t.Errorf("Expected evaluation error of %s", source)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"sort"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// Favicon represents an icon of the favicons bundle.
+type Favicon struct {
+	Name string
+	Size int
+}
+
+// FaviconSizes defines the sizes embedded in the favicon.ico image
+var FaviconSizes = []int{16, 32, 48}
+
+// FaviconIcons defines the PNG icons of the favicons bundle
+var FaviconIcons = []Favicon{
+	{"favicon-16x16.png", 16},
+	{"favicon-32x32.png", 32},
+	{"apple-touch-icon.png", 180},
+	{"android-chrome-192x192.png", 192},
+	{"android-chrome-512x512.png", 512},
+}
+
+// Maskable icon params: its safe zone is a centered circle with a radius
+// of 40% of the icon size, so the image is scaled to fit in it.
+const (
+	maskableIconName     = "maskable-icon-512x512.png"
+	maskableIconSize     = 512
+	maskableIconSafeSize = maskableIconSize * 4 / 5
+)
+
+const faviconsHTML = `<link rel="icon" type="image/x-icon" href="/favicon.ico">
+<link rel="icon" type="image/png" sizes="32x32" href="/favicon-32x32.png">
+<link rel="icon" type="image/png" sizes="16x16" href="/favicon-16x16.png">
+<link rel="apple-touch-icon" sizes="180x180" href="/apple-touch-icon.png">
+<link rel="manifest" href="/site.webmanifest">
+`
+
+// webManifestIcon represents a web app manifest icon.
+type webManifestIcon struct {
+	Src     string `json:"src"`
+	Sizes   string `json:"sizes"`
+	Type    string `json:"type"`
+	Purpose string `json:"purpose,omitempty"`
+}
+
+// Favicons generates the standard favicons bundle from the given image:
+// a multi-size favicon.ico, the PNG touch icons and a maskable icon,
+// plus the web app manifest and HTML snippets, returned as a ZIP archive.
+func Favicons(buf []byte, o ImageOptions) (Image, error) {
+	files := map[string][]byte{}
+
+	icons := make([][]byte, len(FaviconSizes))
+	for i, size := range FaviconSizes {
+		icon, err := faviconPNG(buf, size, o)
+		if err != nil {
+			return Image{}, err
+		}
+		icons[i] = icon
+	}
+	ico, err := encodeICO(icons)
+	if err != nil {
+		return Image{}, err
+	}
+	files["favicon.ico"] = ico
+
+	for _, favicon := range FaviconIcons {
+		icon, err := faviconPNG(buf, favicon.Size, o)
+		if err != nil {
+			return Image{}, err
+		}
+		files[favicon.Name] = icon
+	}
+
+	maskable, err := maskableIcon(buf, o)
+	if err != nil {
+		return Image{}, err
+	}
+	files[maskableIconName] = maskable
+
+	files["site.webmanifest"] = webManifest()
+	files["favicons.html"] = []byte(faviconsHTML)
+
+	body, err := zipFiles(files)
+	if err != nil {
+		return Image{}, err
+	}
+	return Image{Body: body, Mime: "application/zip"}, nil
+}
+
+// faviconPNG crops the image into a square PNG icon of the given size.
+func faviconPNG(buf []byte, size int, o ImageOptions) ([]byte, error) {
+	opts := bimg.Options{
+		Width:         size,
+		Height:        size,
+		Crop:          true,
+		Enlarge:       true,
+		Gravity:       o.Gravity,
+		StripMetadata: true,
+		Type:          bimg.PNG,
+	}
+	image, err := Process(buf, opts)
+	return image.Body, err
+}
+
+// maskableIcon scales the image into the maskable icon safe zone, filling the
+// remaining area with the requested background color, white by default.
+func maskableIcon(buf []byte, o ImageOptions) ([]byte, error) {
+	icon, err := faviconPNG(buf, maskableIconSafeSize, o)
+	if err != nil {
+		return nil, err
+	}
+	src, err := png.Decode(bytes.NewReader(icon))
+	if err != nil {
+		return nil, err
+	}
+
+	background := color.RGBA{0xff, 0xff, 0xff, 0xff}
+	if len(o.Background) == 3 {
+		background = color.RGBA{o.Background[0], o.Background[1], o.Background[2], 0xff}
+	}
+	canvas := newCanvas(maskableIconSize, maskableIconSize, background, background)
+
+	offset := (maskableIconSize - src.Bounds().Dx()) / 2
+	draw.Draw(canvas, src.Bounds().Add(image.Pt(offset, offset)), src, src.Bounds().Min, draw.Over)
+
+	var out bytes.Buffer
+	err = png.Encode(&out, canvas)
+	return out.Bytes(), err
+}
+
+func webManifest() []byte {
+	icons := []webManifestIcon{
+		{"/android-chrome-192x192.png", "192x192", "image/png", ""},
+		{"/android-chrome-512x512.png", "512x512", "image/png", ""},
+		{"/" + maskableIconName, fmt.Sprintf("%dx%d", maskableIconSize, maskableIconSize), "image/png", "maskable"},
+	}
+	body, _ := json.MarshalIndent(map[string]interface{}{"icons": icons}, "", "  ")
+	return body
+}
+
+func zipFiles(files map[string][]byte) ([]byte, error) {
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		f, err := archive.Create(name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := f.Write(files[name]); err != nil {
+			return nil, err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"testing"
+)
+
+func TestFavicons(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("large.jpg"))
+
+	img, err := Favicons(buf, ImageOptions{})
+	if err != nil {
+		t.Fatalf("Cannot generate favicons: %s", err)
+	}
+	if img.Mime != "application/zip" {
+		t.Fatalf("Invalid MIME type: %s", img.Mime)
+	}
+
+	archive, err := zip.NewReader(bytes.NewReader(img.Body), int64(len(img.Body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string][]byte{}
+	for _, f := range archive.File {
+		r, _ := f.Open()
+		files[f.Name], _ = ioutil.ReadAll(r)
+		r.Close()
+	}
+
+	for _, favicon := range FaviconIcons {
+		if err := assertSize(files[favicon.Name], favicon.Size, favicon.Size); err != nil {
+			t.Errorf("Invalid %s: %s", favicon.Name, err)
+		}
+	}
+	if err := assertSize(files[maskableIconName], maskableIconSize, maskableIconSize); err != nil {
+		t.Errorf("Invalid maskable icon: %s", err)
+	}
+	for _, name := range []string{"site.webmanifest", "favicons.html"} {
+		if len(files[name]) == 0 {
+			t.Errorf("Missing bundle file: %s", name)
+		}
+	}
+
+	ico := files["favicon.ico"]
+	if len(ico) < 6 || binary.LittleEndian.Uint16(ico[2:4]) != 1 || int(binary.LittleEndian.Uint16(ico[4:6])) != len(FaviconSizes) {
+		t.Fatalf("Invalid ICO header")
+	}
+	for i, size := range FaviconSizes {
+		entry := ico[6+i*16:]
+		if int(entry[0]) != size || int(entry[1]) != size {
+			t.Errorf("Invalid ICO entry size: %dx%d", entry[0], entry[1])
+		}
+	}
+}
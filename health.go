@@ -11,11 +11,12 @@ var start = time.Now()
 const MB float64 = 1.0 * 1024 * 1024
 
 type HealthStats struct {
-	Uptime               int64   `json:"uptime"`
-	AllocatedMemory      float64 `json:"allocatedMemory"`
-	TotalAllocatedMemory float64 `json:"totalAllocatedMemory"`
-	Goroutines           int     `json:"goroutines"`
-	NumberOfCPUs         int     `json:"cpus"`
+	Uptime               int64           `json:"uptime"`
+	AllocatedMemory      float64         `json:"allocatedMemory"`
+	TotalAllocatedMemory float64         `json:"totalAllocatedMemory"`
+	Goroutines           int             `json:"goroutines"`
+	NumberOfCPUs         int             `json:"cpus"`
+	BufferPool           BufferPoolStats `json:"bufferPool"`
 }
 
 func GetHealthStats() *HealthStats {
@@ -28,6 +29,7 @@ func GetHealthStats() *HealthStats {
 		TotalAllocatedMemory: toMegaBytes(mem.TotalAlloc),
 		Goroutines:           runtime.NumGoroutine(),
 		NumberOfCPUs:         runtime.NumCPU(),
+		BufferPool:           GetBufferPoolStats(),
 	}
 }
 
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"strings"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// maxICOSize is the maximum width or height of an ICO image entry
+const maxICOSize = 256
+
+// icoDirEntry represents an ICO directory entry header.
+type icoDirEntry struct {
+	Width       uint8
+	Height      uint8
+	ColorCount  uint8
+	Reserved    uint8
+	Planes      uint16
+	BitCount    uint16
+	BytesInRes  uint32
+	ImageOffset uint32
+}
+
+// encodeICO creates a multi-size ICO image embedding the given PNG images,
+// which is supported by any browser and by Windows Vista (or newer).
+func encodeICO(images [][]byte) ([]byte, error) {
+	if len(images) == 0 {
+		return nil, errors.New("ICO requires at least one image")
+	}
+
+	entries := make([]icoDirEntry, len(images))
+	offset := 6 + 16*len(images)
+	for i, image := range images {
+		size, err := bimg.Size(image)
+		if err != nil {
+			return nil, err
+		}
+		if size.Width > maxICOSize || size.Height > maxICOSize {
+			return nil, errors.New("ICO images cannot be larger than 256x256")
+		}
+
+		// A zero size means 256 pixels
+		entries[i] = icoDirEntry{
+			Width:       uint8(size.Width % maxICOSize),
+			Height:      uint8(size.Height % maxICOSize),
+			Planes:      1,
+			BitCount:    32,
+			BytesInRes:  uint32(len(image)),
+			ImageOffset: uint32(offset),
+		}
+		offset += len(image)
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, offset))
+	binary.Write(buf, binary.LittleEndian, []uint16{0, 1, uint16(len(images))})
+	binary.Write(buf, binary.LittleEndian, entries)
+	for _, image := range images {
+		buf.Write(image)
+	}
+	return buf.Bytes(), nil
+}
+
+// icoMagic is the ICO image header signature: reserved (0) and type (1)
+var icoMagic = []byte{0, 0, 1, 0}
+
+// pngMagic is the PNG image signature
+var pngMagic = []byte{0x89, 'P', 'N', 'G'}
+
+// ICOMimeType is the ICO images MIME type
+const ICOMimeType = "image/x-icon"
+
+// isICO reports whether the given buffer is an ICO image.
+func isICO(buf []byte) bool {
+	return len(buf) > 6 && bytes.HasPrefix(buf, icoMagic) && binary.LittleEndian.Uint16(buf[4:6]) > 0
+}
+
+// decodeICO extracts the largest image embedded in the given ICO image,
+// encoded as PNG, since libvips cannot load ICO images.
+func decodeICO(buf []byte) ([]byte, error) {
+	count := int(binary.LittleEndian.Uint16(buf[4:6]))
+	if len(buf) < 6+16*count {
+		return nil, errors.New("Invalid ICO image: truncated directory")
+	}
+
+	entries := make([]icoDirEntry, count)
+	if err := binary.Read(bytes.NewReader(buf[6:]), binary.LittleEndian, entries); err != nil {
+		return nil, err
+	}
+
+	best := -1
+	for i, entry := range entries {
+		if int(entry.ImageOffset)+int(entry.BytesInRes) > len(buf) || entry.BytesInRes == 0 {
+			continue
+		}
+		if best == -1 || icoEntrySize(entry) > icoEntrySize(entries[best]) ||
+			(icoEntrySize(entry) == icoEntrySize(entries[best]) && entry.BitCount > entries[best].BitCount) {
+			best = i
+		}
+	}
+	if best == -1 {
+		return nil, errors.New("Invalid ICO image: no valid images found")
+	}
+
+	entry := entries[best]
+	data := buf[entry.ImageOffset : entry.ImageOffset+entry.BytesInRes]
+	if bytes.HasPrefix(data, pngMagic) {
+		return data, nil
+	}
+
+	img, err := decodeICOBitmap(data)
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	err = png.Encode(&out, img)
+	return out.Bytes(), err
+}
+
+func icoEntrySize(entry icoDirEntry) int {
+	if entry.Width == 0 {
+		return maxICOSize
+	}
+	return int(entry.Width)
+}
+
+// decodeICOBitmap decodes an ICO embedded device independent bitmap (DIB), whose
+// height is doubled to include the 1-bit transparency (AND) mask after the pixels.
+func decodeICOBitmap(data []byte) (image.Image, error) {
+	if len(data) < 40 {
+		return nil, errors.New("Invalid ICO bitmap: truncated header")
+	}
+
+	headerSize := int(binary.LittleEndian.Uint32(data[0:4]))
+	width := int(int32(binary.LittleEndian.Uint32(data[4:8])))
+	height := int(int32(binary.LittleEndian.Uint32(data[8:12]))) / 2
+	bitCount := int(binary.LittleEndian.Uint16(data[14:16]))
+	compression := binary.LittleEndian.Uint32(data[16:20])
+	colors := int(binary.LittleEndian.Uint32(data[32:36]))
+
+	if width <= 0 || height <= 0 || width > maxICOSize || height > maxICOSize || headerSize < 40 || headerSize > len(data) {
+		return nil, errors.New("Invalid ICO bitmap: unsupported dimensions")
+	}
+	if compression != 0 {
+		return nil, errors.New("Invalid ICO bitmap: compression is not supported")
+	}
+
+	var palette []color.RGBA
+	switch bitCount {
+	case 1, 4, 8:
+		if colors == 0 {
+			colors = 1 << uint(bitCount)
+		}
+		if headerSize+colors*4 > len(data) {
+			return nil, errors.New("Invalid ICO bitmap: truncated palette")
+		}
+		palette = make([]color.RGBA, colors)
+		for i := range palette {
+			p := data[headerSize+i*4:]
+			palette[i] = color.RGBA{p[2], p[1], p[0], 0xff}
+		}
+	case 24, 32:
+	default:
+		return nil, fmt.Errorf("Invalid ICO bitmap: unsupported bit count %d", bitCount)
+	}
+
+	stride := (width*bitCount + 31) / 32 * 4
+	maskStride := (width + 31) / 32 * 4
+	pixels := headerSize + len(palette)*4
+	mask := pixels + stride*height
+	if mask > len(data) {
+		return nil, errors.New("Invalid ICO bitmap: truncated pixels")
+	}
+	hasMask := mask+maskStride*height <= len(data)
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	hasAlpha := false
+	for y := 0; y < height; y++ {
+		// Rows are stored bottom-up
+		row := data[pixels+(height-1-y)*stride:]
+		for x := 0; x < width; x++ {
+			var c color.RGBA
+			switch bitCount {
+			case 32:
+				c = color.RGBA{row[x*4+2], row[x*4+1], row[x*4], row[x*4+3]}
+				hasAlpha = hasAlpha || c.A != 0
+			case 24:
+				c = color.RGBA{row[x*3+2], row[x*3+1], row[x*3], 0xff}
+			default:
+				bit := x * bitCount
+				index := int(row[bit/8]>>uint(8-bitCount-bit%8)) & (1<<uint(bitCount) - 1)
+				if index < len(palette) {
+					c = palette[index]
+				}
+			}
+			img.SetNRGBA(x, y, color.NRGBA{c.R, c.G, c.B, c.A})
+		}
+	}
+
+	// Apply the transparency mask, unless the 32-bit pixels define the alpha channel
+	if hasMask && !hasAlpha {
+		for y := 0; y < height; y++ {
+			row := data[mask+(height-1-y)*maskStride:]
+			for x := 0; x < width; x++ {
+				c := img.NRGBAAt(x, y)
+				c.A = 0xff
+				if row[x/8]&(0x80>>uint(x%8)) != 0 {
+					c.A = 0
+				}
+				img.SetNRGBA(x, y, c)
+			}
+		}
+	}
+
+	return img, nil
+}
+
+// encodeICOImage encodes the given image as ICO embedding each one of the given squared sizes,
+// or the image itself, cropped and downscaled to the maximum ICO size if required.
+func encodeICOImage(buf []byte, sizes []int) (Image, error) {
+	if len(sizes) == 0 {
+		size, err := bimg.Size(buf)
+		if err != nil {
+			return Image{}, err
+		}
+		if size.Width <= maxICOSize && size.Height <= maxICOSize && bimg.DetermineImageType(buf) == bimg.PNG {
+			return icoImage([][]byte{buf})
+		}
+		sizes = []int{int(math.Min(maxICOSize, math.Max(float64(size.Width), float64(size.Height))))}
+	}
+
+	images := make([][]byte, len(sizes))
+	for i, size := range sizes {
+		if size <= 0 || size > maxICOSize {
+			return Image{}, NewError("ICO sizes must be between 1 and 256 pixels", BadRequest)
+		}
+		image, err := Process(buf, bimg.Options{Width: size, Height: size, Crop: true, Enlarge: true, Type: bimg.PNG})
+		if err != nil {
+			return Image{}, err
+		}
+		images[i] = image.Body
+	}
+	return icoImage(images)
+}
+
+func icoImage(images [][]byte) (Image, error) {
+	body, err := encodeICO(images)
+	if err != nil {
+		return Image{}, err
+	}
+	return Image{Body: body, Mime: ICOMimeType}, nil
+}
+
+// parseICOSizes parses the comma separated ICO sizes.
+func parseICOSizes(input string) []int {
+	sizes := []int{}
+	for _, value := range strings.Split(input, ",") {
+		if size := parseInt(strings.TrimSpace(value)); size > 0 {
+			sizes = append(sizes, size)
+		}
+	}
+	return sizes
+}
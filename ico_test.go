@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image/png"
+	"io/ioutil"
+	"testing"
+)
+
+// icoBitmap creates a 2x2 pixels 24-bit ICO bitmap, whose top left pixel is transparent
+func icoBitmap() []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, []uint32{40, 2, 4})
+	binary.Write(&buf, binary.LittleEndian, []uint16{1, 24})
+	binary.Write(&buf, binary.LittleEndian, []uint32{0, 0, 0, 0, 0, 0})
+
+	// Pixel rows (BGR), bottom-up and padded to 4 bytes
+	buf.Write([]byte{0, 0, 255, 0, 255, 0, 0, 0})
+	buf.Write([]byte{255, 0, 0, 255, 255, 255, 0, 0})
+
+	// Transparency mask rows, bottom-up and padded to 4 bytes
+	buf.Write([]byte{0, 0, 0, 0})
+	buf.Write([]byte{0x80, 0, 0, 0})
+	return buf.Bytes()
+}
+
+func TestDecodeICO(t *testing.T) {
+	bitmap := icoBitmap()
+
+	var ico bytes.Buffer
+	binary.Write(&ico, binary.LittleEndian, []uint16{0, 1, 1})
+	binary.Write(&ico, binary.LittleEndian, icoDirEntry{Width: 2, Height: 2, Planes: 1, BitCount: 24, BytesInRes: uint32(len(bitmap)), ImageOffset: 22})
+	ico.Write(bitmap)
+
+	if !isICO(ico.Bytes()) {
+		t.Fatal("Invalid ICO image detection")
+	}
+
+	buf, err := decodeICO(ico.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := png.Decode(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != 2 || img.Bounds().Dy() != 2 {
+		t.Fatalf("Invalid image size: %v", img.Bounds())
+	}
+
+	cases := []struct {
+		x, y       int
+		r, g, b, a uint32
+	}{
+		{0, 0, 0, 0, 0xffff, 0},
+		{1, 0, 0xffff, 0xffff, 0xffff, 0xffff},
+		{0, 1, 0xffff, 0, 0, 0xffff},
+		{1, 1, 0, 0xffff, 0, 0xffff},
+	}
+	for _, test := range cases {
+		r, g, b, a := img.At(test.x, test.y).RGBA()
+		if a != test.a || (a != 0 && (r != test.r || g != test.g || b != test.b)) {
+			t.Errorf("Invalid pixel %d,%d color: %d,%d,%d,%d", test.x, test.y, r, g, b, a)
+		}
+	}
+}
+
+func TestEncodeICOImage(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("test.png"))
+
+	img, err := encodeICOImage(buf, []int{16, 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Mime != ICOMimeType || !isICO(img.Body) {
+		t.Fatalf("Invalid ICO image")
+	}
+
+	// The largest embedded PNG image must be extracted
+	largest, err := decodeICO(img.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := assertSize(largest, 64, 64); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := encodeICOImage(buf, []int{512}); err == nil {
+		t.Error("Expected error for oversized ICO image")
+	}
+}
@@ -12,27 +12,42 @@ import (
 // OperationsMap defines the allowed image transformation operations listed by name.
 // Used for pipeline image processing.
 var OperationsMap = map[string]Operation{
-	"crop":      Crop,
-	"resize":    Resize,
-	"enlarge":   Enlarge,
-	"extract":   Extract,
-	"rotate":    Rotate,
-	"flip":      Flip,
-	"flop":      Flop,
-	"thumbnail": Thumbnail,
-	"zoom":      Zoom,
-	"convert":   Convert,
-	"watermark": Watermark,
-	"blur":      GaussianBlur,
-	"smartcrop": SmartCrop,
-	"fit":       Fit,
-	"noop":      Noop,
+	"crop":        Crop,
+	"resize":      Resize,
+	"enlarge":     Enlarge,
+	"extract":     Extract,
+	"rotate":      Rotate,
+	"flip":        Flip,
+	"flop":        Flop,
+	"thumbnail":   Thumbnail,
+	"zoom":        Zoom,
+	"convert":     Convert,
+	"watermark":   Watermark,
+	"blur":        GaussianBlur,
+	"smartcrop":   SmartCrop,
+	"fit":         Fit,
+	"noop":        Noop,
+	"qrcode":      QR,
+	"composite":   Composite,
+	"gradient":    Gradient,
+	"vignette":    Vignette,
+	"border":      Border(Noop),
+	"shadow":      DropShadow,
+	"pixelate":    Pixelate,
+	"posterize":   Posterize,
+	"channels":    Channels,
+	"affine":      Affine,
+	"perspective": Perspective,
+	"skew":        Skew,
 }
 
 // Image stores an image binary buffer and its MIME type
 type Image struct {
 	Body []byte
 	Mime string
+
+	// CropBox is the source image area of the smart crop, if requested
+	CropBox *CropBox
 }
 
 // Operation implements an image transformation runnable interface
@@ -53,6 +68,8 @@ type ImageInfo struct {
 	Profile     bool   `json:"hasProfile"`
 	Channels    int    `json:"channels"`
 	Orientation int    `json:"orientation"`
+
+	Assessment *ImageAssessment `json:"assessment,omitempty"`
 }
 
 func Info(buf []byte, o ImageOptions) (Image, error) {
@@ -76,6 +93,15 @@ func Info(buf []byte, o ImageOptions) (Image, error) {
 		Orientation: meta.Orientation,
 	}
 
+	if o.Assess {
+		canvas, err := decodeCanvas(buf)
+		if err != nil {
+			return image, NewError("Cannot decode the image: "+err.Error(), BadRequest)
+		}
+		assessment := assessImage(canvas, o.BlurThreshold)
+		info.Assessment = &assessment
+	}
+
 	body, _ := json.Marshal(info)
 	image.Body = body
 
@@ -86,6 +112,16 @@ func Resize(buf []byte, o ImageOptions) (Image, error) {
 	if o.Width == 0 && o.Height == 0 {
 		return Image{}, NewError("Missing required param: height or width", BadRequest)
 	}
+	if err := checkDepth(o.Depth); err != nil {
+		return Image{}, err
+	}
+
+	if image, ok := highDepthPath(buf, o, resizeCrop(o)); ok {
+		return image, nil
+	}
+	if image, ok := thumbnailFastPath(buf, o, resizeCrop(o)); ok {
+		return image, nil
+	}
 
 	opts := BimgOptions(o)
 	opts.Embed = true
@@ -108,8 +144,9 @@ func Fit(buf []byte, o ImageOptions) (Image, error) {
 	}
 
 	// if input ratio > output ratio
-	// (calculation multiplied through by denominators to avoid float division)
-	if dims.Width*o.Height > o.Width*dims.Height {
+	// (calculation multiplied through by denominators to avoid float division).
+	// Fitting outside the box matches the shortest side instead, so the image covers the box.
+	if (dims.Width*o.Height > o.Width*dims.Height) != o.Outside {
 		// constrained by width
 		if dims.Width != 0 {
 			o.Height = o.Width * dims.Height / dims.Width
@@ -121,6 +158,13 @@ func Fit(buf []byte, o ImageOptions) (Image, error) {
 		}
 	}
 
+	if err := checkDepth(o.Depth); err != nil {
+		return Image{}, err
+	}
+	if image, ok := highDepthPath(buf, o, false); ok {
+		return image, nil
+	}
+
 	opts := BimgOptions(o)
 	opts.Embed = true
 
@@ -161,6 +205,10 @@ func Crop(buf []byte, o ImageOptions) (Image, error) {
 		return Image{}, NewError("Missing required param: height or width", BadRequest)
 	}
 
+	if isSmartCropRequest(o) {
+		return smartCrop(buf, o)
+	}
+
 	opts := BimgOptions(o)
 	opts.Crop = true
 	return Process(buf, opts)
@@ -202,6 +250,20 @@ func Thumbnail(buf []byte, o ImageOptions) (Image, error) {
 	if o.Width == 0 && o.Height == 0 {
 		return Image{}, NewError("Missing required params: width or height", BadRequest)
 	}
+	if err := checkDepth(o.Depth); err != nil {
+		return Image{}, err
+	}
+
+	if isSmartCropRequest(o) {
+		return smartCrop(buf, o)
+	}
+
+	if image, ok := highDepthPath(buf, o, false); ok {
+		return image, nil
+	}
+	if image, ok := thumbnailFastPath(buf, o, false); ok {
+		return image, nil
+	}
 
 	return Process(buf, BimgOptions(o))
 }
@@ -237,7 +299,13 @@ func Convert(buf []byte, o ImageOptions) (Image, error) {
 		return Image{}, NewError("Missing required param: type", BadRequest)
 	}
 	if ImageType(o.Type) == bimg.UNKNOWN {
-		return Image{}, NewError("Invalid image type: "+o.Type, BadRequest)
+		return Image{}, NewError("Invalid image type: "+o.Type, BadRequest).WithProblem(ProblemUnsupportedFormat)
+	}
+	if err := checkDepth(o.Depth); err != nil {
+		return Image{}, err
+	}
+	if image, ok := highDepthPath(buf, o, false); ok {
+		return image, nil
 	}
 	opts := BimgOptions(o)
 
@@ -249,6 +317,10 @@ func Watermark(buf []byte, o ImageOptions) (Image, error) {
 		return Image{}, NewError("Missing required param: text", BadRequest)
 	}
 
+	if o.Tile {
+		return tileWatermark(buf, o)
+	}
+
 	opts := BimgOptions(o)
 	opts.Watermark.DPI = o.DPI
 	opts.Watermark.Text = o.Text
@@ -279,27 +351,46 @@ func Noop(buf []byte, o ImageOptions) (Image, error) {
 	return Image{Body: buf, Mime: mime}, nil
 }
 
-func Pipeline(buf []byte, o ImageOptions) (Image, error) {
-	if len(o.Operations) == 0 {
-		return Image{}, NewError("Missing or invalid pipeline operations JSON", BadRequest)
+// validatePipelineOperations validates the number, the names and the params of the given pipeline operations
+func validatePipelineOperations(operations PipelineOperations) error {
+	if len(operations) == 0 {
+		return NewError("Missing or invalid pipeline operations JSON", BadRequest)
+	}
+	if len(operations) > 10 {
+		return NewError("Maximum allowed pipeline operations exceeded", BadRequest)
+	}
+
+	for _, operation := range operations {
+		// Validate supported operation name
+		if _, exists := OperationsMap[operation.Name]; !exists {
+			name := strings.TrimSpace(strings.ToLower(operation.Name))
+			return NewError(fmt.Sprintf("Unsupported operation name: %s", name), BadRequest)
+		}
+		if err := validateMapParams(operation.Params); err != nil {
+			return err
+		}
 	}
-	if len(o.Operations) > 10 {
-		return Image{}, NewError("Maximum allowed pipeline operations exceeded", BadRequest)
+	return nil
+}
+
+func Pipeline(buf []byte, o ImageOptions) (Image, error) {
+	if err := validatePipelineOperations(o.Operations); err != nil {
+		return Image{}, err
 	}
 
-	// Validate and built operations
+	// Build operations
 	for i, operation := range o.Operations {
 		// Normalize operation name
 		name := strings.TrimSpace(strings.ToLower(operation.Name))
 
-		// Validate supported operation name
-		var exists bool
-		if operation.Operation, exists = OperationsMap[operation.Name]; !exists {
-			return Image{}, NewError(fmt.Sprintf("Unsupported operation name: %s", name), BadRequest)
-		}
-
 		// Parse and construct operation options
+		operation.Operation = OperationsMap[operation.Name]
 		operation.ImageOptions = readMapParams(operation.Params)
+		if operation.ImageOptions.Denoise != 0 {
+			operation.Operation = Denoise(operation.Operation)
+		}
+		operation.Operation = o.Timings.Operation(name, operation.Operation)
+		operation.ImageOptions.Context = o.Context
 
 		// Mutate list by value
 		o.Operations[i] = operation
@@ -312,7 +403,11 @@ func Pipeline(buf []byte, o ImageOptions) (Image, error) {
 	image = Image{Body: buf}
 	for _, operation := range o.Operations {
 		var curImage Image
-		curImage, err = operation.Operation(image.Body, operation.ImageOptions)
+		var opts ImageOptions
+		if opts, err = relativeOptions(image.Body, operation.ImageOptions); err != nil {
+			return Image{}, err
+		}
+		curImage, err = operation.Operation(image.Body, opts)
 		if err != nil && !operation.IgnoreFailure {
 			return Image{}, err
 		}
@@ -1,8 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
 	"testing"
+
+	"gopkg.in/h2non/bimg.v1"
 )
 
 func TestImageResize(t *testing.T) {
@@ -38,6 +46,20 @@ func TestImageFit(t *testing.T) {
 	}
 }
 
+func TestImageFitOutside(t *testing.T) {
+	opts := ImageOptions{Width: 300, Height: 300, Outside: true}
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+
+	img, err := Fit(buf, opts)
+	if err != nil {
+		t.Errorf("Cannot process image: %s", err)
+	}
+	// 550x740 -> 300x403
+	if assertSize(img.Body, 300, 403) != nil {
+		t.Errorf("Invalid image size, expected: %dx%d", 300, 403)
+	}
+}
+
 func TestImagePipelineOperations(t *testing.T) {
 	width, height := 300, 260
 
@@ -71,3 +93,189 @@ func TestImagePipelineOperations(t *testing.T) {
 		t.Errorf("Invalid image size, expected: %dx%d", width, height)
 	}
 }
+
+func TestImageThumbnailFastPath(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("large.jpg"))
+
+	cases := []struct {
+		opts     ImageOptions
+		crop     bool
+		eligible bool
+	}{
+		{ImageOptions{Width: 300}, false, true},
+		{ImageOptions{Height: 300, Type: "webp"}, false, true},
+		{ImageOptions{Width: 300, Height: 200}, true, true},
+		{ImageOptions{Width: 300, Height: 200}, false, false},
+		{ImageOptions{Width: 300}, true, false},
+		{ImageOptions{Width: 300, Flip: true}, false, false},
+		{ImageOptions{Width: 300, Gravity: bimg.GravitySmart}, false, false},
+		{ImageOptions{Width: 300, Type: "tiff"}, false, false},
+		{ImageOptions{Width: 3000}, false, false},
+	}
+
+	for _, test := range cases {
+		if test.opts.Colorspace == 0 {
+			test.opts.Colorspace = bimg.InterpretationSRGB
+		}
+		if isThumbnailFastPathEligible(buf, test.opts, test.crop) != test.eligible {
+			t.Errorf("Invalid fast path eligibility for %#v", test.opts)
+		}
+	}
+
+	img, ok := thumbnailFastPath(buf, ImageOptions{Width: 300, Height: 200, Colorspace: bimg.InterpretationSRGB}, true)
+	if !ok {
+		t.Fatal("Cannot process image via thumbnail fast path")
+	}
+	if img.Mime != "image/jpeg" {
+		t.Error("Invalid image MIME type")
+	}
+	if assertSize(img.Body, 300, 200) != nil {
+		t.Error("Invalid image size, expected: 300x200")
+	}
+}
+
+func TestResizeCrop(t *testing.T) {
+	cases := []struct {
+		opts ImageOptions
+		crop bool
+	}{
+		{ImageOptions{Width: 300, Height: 200}, true},
+		{ImageOptions{Width: 300}, false},
+		{ImageOptions{Height: 200}, false},
+		{ImageOptions{Width: 300, Height: 200, NoCrop: true}, false},
+	}
+	for _, test := range cases {
+		if crop := resizeCrop(test.opts); crop != test.crop {
+			t.Errorf("Invalid resize crop of %#v: %t", test.opts, crop)
+		}
+	}
+}
+
+// TestHasTransformParams fails if a new image option is neither a transform param nor
+// an output size, encoding or wrapping operation param listed below.
+func TestHasTransformParams(t *testing.T) {
+	nonTransform := map[string]bool{
+		"Width": true, "Height": true, "Quality": true, "Compression": true, "Type": true,
+		"StripMetadata": true, "Lossless": true, "NearLossless": true, "Effort": true,
+		"Interlace": true, "Subsample": true, "NoCrop": true, "Operations": true,
+		"AutoQuality": true, "MinQuality": true, "MaxQuality": true, "DSSIM": true,
+		"MaxBytes": true, "SkipLarger": true, "Threshold": true, "Denoise": true,
+		"Border": true, "Upscale": true, "Density": true, "Depth": true, "CropBox": true,
+		"Frame": true, "Frames": true, "FrameStep": true, "Loop": true, "Duration": true,
+		"Page": true, "AspectRatio": true, "Relative": true, "LQIP": true, "LQIPWidth": true,
+		"LQIPBlur": true, "LQIPJSON": true, "Timings": true, "Context": true,
+	}
+
+	if hasTransformParams(ImageOptions{}) || hasTransformParams(ImageOptions{Colorspace: bimg.InterpretationSRGB}) {
+		t.Fatal("The default options should not have transform params")
+	}
+
+	fields := reflect.TypeOf(ImageOptions{})
+	for i := 0; i < fields.NumField(); i++ {
+		o := ImageOptions{}
+		field := reflect.ValueOf(&o).Elem().Field(i)
+		switch field.Kind() {
+		case reflect.Bool:
+			field.SetBool(true)
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			field.SetInt(field.Int() + 1)
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			field.SetUint(field.Uint() + 1)
+		case reflect.Float32, reflect.Float64:
+			field.SetFloat(0.5)
+		case reflect.String:
+			field.SetString("value")
+		case reflect.Slice:
+			field.Set(reflect.MakeSlice(field.Type(), 1, 1))
+		case reflect.Map:
+			field.Set(reflect.MakeMap(field.Type()))
+			field.SetMapIndex(reflect.Zero(field.Type().Key()), reflect.Zero(field.Type().Elem()))
+		case reflect.Ptr:
+			field.Set(reflect.New(field.Type().Elem()))
+		case reflect.Interface:
+			field.Set(reflect.ValueOf(context.Background()))
+		default:
+			t.Fatalf("Unsupported image option kind: %s %s", fields.Field(i).Name, field.Kind())
+		}
+
+		name := fields.Field(i).Name
+		if transform := hasTransformParams(o); transform == nonTransform[name] {
+			t.Errorf("Invalid transform param %s: %t", name, transform)
+		}
+	}
+}
+
+func TestImageLQIP(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("large.jpg"))
+
+	img, err := LQIP(Resize)(buf, ImageOptions{Width: 300, LQIPBlur: 2})
+	if err != nil {
+		t.Fatalf("Cannot process image: %s", err)
+	}
+	if img.Mime != "image/jpeg" {
+		t.Fatalf("Invalid image MIME type: %s", img.Mime)
+	}
+	if size, _ := bimg.Size(img.Body); size.Width != lqipDefaultWidth {
+		t.Errorf("Invalid LQIP width: %d", size.Width)
+	}
+
+	img, err = LQIP(Resize)(buf, ImageOptions{Width: 300, LQIPWidth: 16, LQIPJSON: true, Type: "webp"})
+	if err != nil {
+		t.Fatalf("Cannot process image: %s", err)
+	}
+
+	info := LQIPInfo{}
+	if err := json.Unmarshal(img.Body, &info); err != nil {
+		t.Fatalf("Invalid LQIP JSON response: %s", img.Body)
+	}
+	if info.Width != 16 || info.Type != "webp" || !strings.HasPrefix(info.DataURI, "data:image/webp;base64,") {
+		t.Errorf("Invalid LQIP info: %#v", info)
+	}
+}
+
+func TestThumbnailSaveSuffix(t *testing.T) {
+	cases := []struct {
+		imageType bimg.ImageType
+		opts      ImageOptions
+		expected  string
+	}{
+		{bimg.JPEG, ImageOptions{}, ".jpg[Q=80]"},
+		{bimg.JPEG, ImageOptions{Quality: 90, Interlace: true}, ".jpg[Q=90,interlace]"},
+		{bimg.JPEG, ImageOptions{Subsample: "444"}, ".jpg[Q=80,no_subsample]"},
+		{bimg.PNG, ImageOptions{Interlace: true, StripMetadata: true}, ".png[compression=6,strip,interlace]"},
+		{bimg.WEBP, ImageOptions{Lossless: true}, ".webp[Q=80,lossless]"},
+	}
+
+	for _, c := range cases {
+		if suffix := thumbnailSaveSuffix(c.imageType, c.opts); suffix != c.expected {
+			t.Errorf("Invalid save suffix: %s != %s", suffix, c.expected)
+		}
+	}
+}
+
+func TestInterlace(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+	o := ServerOptions{Interlace: []string{"jpeg"}}
+	ts := testServer(func(w http.ResponseWriter, r *http.Request) {
+		imageHandler(w, r, buf, Resize, o, nil)
+	})
+	defer ts.Close()
+
+	// Progressive JPEG images define a progressive DCT start of frame (SOF2) marker
+	progressive := []byte{0xff, 0xc2}
+	for query, expected := range map[string]bool{"": true, "&interlace=false": false} {
+		res, err := http.Get(ts.URL + "?width=200" + query)
+		if err != nil {
+			t.Fatal("Cannot perform the request")
+		}
+		image, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if bytes.Contains(image, progressive) != expected {
+			t.Errorf("Invalid progressive JPEG image of %q query", query)
+		}
+	}
+
+	if !o.InterlacedByDefault("jpeg") || o.InterlacedByDefault("png") {
+		t.Error("Invalid interlaced image types")
+	}
+}
@@ -3,8 +3,11 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"runtime"
@@ -24,30 +27,125 @@ var (
 	aHelp               = flag.Bool("h", false, "Show help")
 	aHelpl              = flag.Bool("help", false, "Show help")
 	aPathPrefix         = flag.String("path-prefix", "/", "Url path prefix to listen to")
+	aNoLegacyRoutes     = flag.Bool("no-legacy-routes", false, "Disable the legacy routes not prefixed by the /v1 API version")
+	aCloudinary         = flag.Bool("enable-cloudinary", false, "Enable the Cloudinary-style transformation URLs of the /image endpoint")
+	aImgproxy           = flag.Bool("enable-imgproxy", false, "Enable the imgproxy processing options URLs of the unmatched paths")
+	aImgproxyKey        = flag.String("imgproxy-key", "", "Comma separated hex encoded imgproxy URL signature keys. Defaults to the IMGPROXY_KEY env variable")
+	aImgproxySalt       = flag.String("imgproxy-salt", "", "Comma separated hex encoded imgproxy URL signature salts, paired with the keys. Defaults to the IMGPROXY_SALT env variable")
+	aRewriteRules       = flag.String("rewrite-rules", "", "URL rewrite rules JSON file path, mapping the public URL paths to the image endpoints, params and sources")
+	aRequestScripts     = flag.String("request-scripts", "", "Request scripts JSON file path, adjusting the params of the image requests or rejecting them by expressions")
 	aCors               = flag.Bool("cors", false, "Enable CORS support")
+	aCorsOrigins        = flag.String("cors-allowed-origins", "", "CORS allowed origins, wildcards supported (separated by commas). Defaults to any origin")
+	aCorsHeaders        = flag.String("cors-allowed-headers", "", "CORS allowed request headers (separated by commas)")
+	aCorsExposed        = flag.String("cors-exposed-headers", "", "CORS response headers exposed to the browser (separated by commas)")
+	aCorsMaxAge         = flag.Int("cors-max-age", 0, "CORS preflight response max age in seconds")
+	aCorsCredentials    = flag.Bool("cors-allow-credentials", false, "Allow CORS requests including user credentials")
 	aGzip               = flag.Bool("gzip", false, "Enable gzip compression (deprecated)")
 	aAuthForwarding     = flag.Bool("enable-auth-forwarding", false, "Forwards X-Forward-Authorization or Authorization header to the image source server. -enable-url-source flag must be defined. Tip: secure your server from public access to prevent attack vectors")
 	aEnableURLSource    = flag.Bool("enable-url-source", false, "Enable remote HTTP URL image source processing")
 	aEnablePlaceholder  = flag.Bool("enable-placeholder", false, "Enable image response placeholder to be used in case of error")
+	aSrcsetWidths       = flag.String("srcset-widths", "320,640,960,1280,1920", "Comma separated default image widths ladder of the /srcset endpoint")
+	aSrcsetDestination  = flag.String("srcset-destination", "", "Srcset renditions destination JSON file path, storing every rendition of the /srcset endpoint in an S3 bucket")
+	aOGTemplates        = flag.String("ogimage-templates", "", "Social media card templates JSON file path used by the /ogimage endpoint")
+	aInterlace          = flag.String("interlace", "", "Comma separated output image types interlaced by default, such as jpeg,png (progressive JPEG and Adam7 PNG)")
+	aQualityLadder      = flag.String("quality-ladder", "", "Comma separated default output image qualities by maximum output width, unless the quality is requested. E.g: 200:60,800:75,*:82")
+	aFFmpeg             = flag.String("ffmpeg", "", "FFmpeg binary path used to convert animated GIF images into videos and to extract still frames of video sources")
+	aBackgroundRemoval  = flag.String("bgremoval-url", "", "Background removal service URL the images are posted to, replying the foreground cutout")
+	aUpscaler           = flag.String("upscale-url", "", "Super-resolution service URL the images are posted to by upscale=ai requests, replying the upscaled image")
+	aErrorImage         = flag.Bool("error-image", false, "Reply with the errors rendered as images matching the requested dimensions and type")
 	aEnableURLSignature = flag.Bool("enable-url-signature", false, "Enable URL signature (URL-safe Base64-encoded HMAC digest)")
-	aURLSignatureKey    = flag.String("url-signature-key", "", "The URL signature key (32 characters minimum)")
+	aURLSignatureKey    = flag.String("url-signature-key", "", "The URL signature key (32 characters minimum), or comma separated id:key pairs to rotate keys with -enable-key-rotation")
+	aURLSignatureTTL    = flag.Int("url-signature-ttl", 0, "Maximum signed URL lifetime in seconds, requiring the expires param")
 	aAllowedOrigins     = flag.String("allowed-origins", "", "Restrict remote image source processing to certain origins (separated by commas)")
+	aAllowedIPs         = flag.String("allowed-ips", "", "Restrict image processing requests to certain client IPs or CIDR ranges (separated by commas)")
+	aDeniedIPs          = flag.String("denied-ips", "", "Deny image processing requests from certain client IPs or CIDR ranges (separated by commas)")
+	aAdminAllowedIPs    = flag.String("admin-allowed-ips", "", "Restrict admin endpoints access to certain client IPs or CIDR ranges (separated by commas)")
+	aAdminDeniedIPs     = flag.String("admin-denied-ips", "", "Deny admin endpoints access from certain client IPs or CIDR ranges (separated by commas)")
 	aMaxAllowedSize     = flag.Int("max-allowed-size", 0, "Restrict maximum size of http image source (in bytes)")
-	aKey                = flag.String("key", "", "Define API key for authorization")
+	aMaxGIFFrames       = flag.Int("max-gif-frames", 0, "Restrict maximum number of frames of GIF input images")
+	aMaxPDFPages        = flag.Int("max-pdf-pages", 0, "Restrict maximum number of pages of PDF input documents")
+	aMaxTIFFPages       = flag.Int("max-tiff-pages", 0, "Restrict maximum number of directories (pages) of TIFF input images")
+	aMaxSVGElements     = flag.Int("max-svg-elements", 0, "Restrict maximum number of elements of SVG input images")
+	aMaxSVGSize         = flag.Int("max-svg-size", 0, "Restrict maximum size of SVG input images (in bytes)")
+	aMaxLegacyPixels    = flag.Int("max-legacy-pixels", 50000000, "Restrict maximum number of pixels of BMP, PCX and TGA input images, decoded in pure Go")
+	aMaxBandwidth       = flag.Int("max-bandwidth", 0, "Maximum outbound bandwidth per response in bytes per second, beyond the bandwidth threshold")
+	aBandwidthThreshold = flag.Int("bandwidth-threshold", 1048576, "Response size in bytes from which the outbound bandwidth is limited")
+	aMaxCost            = flag.Float64("max-cost", 0, "Restrict maximum estimated processing cost of images (input megapixels × operations)")
+	aStrictParams       = flag.Bool("strict-params", false, "Reject the requests of unknown, invalid or conflicting query params instead of ignoring them")
+	aEnableExplain      = flag.Bool("enable-explain", false, "Enable the explain mode, replying what the image requests would do without processing them")
+	aEnableOriginal     = flag.Bool("enable-original", false, "Enable the /original endpoint and the raw param, replying the source images unmodified")
+	aOriginalTypes      = flag.String("original-types", "", "Comma separated MIME types, or type/* wildcards, of the source images replied unmodified")
+	aStreamMinSize      = flag.Int("stream-min-size", 0, "Stream the fit and convert output images of the source images from the given size (in bytes), instead of buffering them")
+	aStreamSources      = flag.Bool("stream-sources", false, "Shrink the eligible remote source images on load as they are downloaded, instead of buffering them")
+	aDebugHeaders       = flag.Bool("debug-headers", false, "Reply the processing timings and cache status via debug response headers")
+	aKey                = flag.String("key", "", "Define API key for authorization, or comma separated id:key pairs to rotate keys with -enable-key-rotation")
+	aKeyRotation        = flag.Bool("enable-key-rotation", false, "Parse the API and URL signature keys, and their files, as comma separated id:key pairs to rotate keys")
 	aMount              = flag.String("mount", "", "Mount server local directory")
 	aCertFile           = flag.String("certfile", "", "TLS certificate file path")
 	aKeyFile            = flag.String("keyfile", "", "TLS private key file path")
+	aAPIKeyFile         = flag.String("api-key-file", "", "File path of the API key, or comma separated id:key pairs with -enable-key-rotation, reloaded on change")
+	aURLSignatureFile   = flag.String("url-signature-key-file", "", "File path of the URL signature key, or comma separated id:key pairs with -enable-key-rotation, reloaded on change")
+	aAuthorizationFile  = flag.String("authorization-file", "", "File path of the Authorization header value passed to all the image source servers, reloaded on change")
+	aOriginCredentials  = flag.String("origin-credentials", "", "JSON file path mapping image source server hosts to their credentials, reloaded on change")
+	aSecretsReload      = flag.Int("secrets-reload", 10, "Secret files reload check interval in seconds")
 	aAuthorization      = flag.String("authorization", "", "Defines a constant Authorization header value passed to all the image source servers. -enable-url-source flag must be defined. This overwrites authorization headers forwarding behavior via X-Forward-Authorization")
 	aPlaceholder        = flag.String("placeholder", "", "Image path to image custom placeholder to be used in case of error. Recommended minimum image size is: 1200x1200")
 	aDisableEndpoints   = flag.String("disable-endpoints", "", "Comma separated endpoints to disable. E.g: form,crop,rotate,health")
 	aHTTPCacheTTL       = flag.Int("http-cache-ttl", -1, "The TTL in seconds")
 	aHTTPCachePassthru  = flag.Bool("http-cache-passthru", false, "Enable cache header passthrough for HTTP sources")
+	aHTTPCacheImmutable = flag.Int("http-cache-immutable-ttl", 0, "The TTL in seconds of the versioned image URLs, defined by the v param, marked as immutable")
+	aHTTPCacheErrorTTL  = flag.Int("http-cache-error-ttl", -1, "The TTL in seconds of the error responses. Defaults to the -http-cache-ttl")
+	aHTTPCacheSWR       = flag.Int("http-cache-stale-while-revalidate", 0, "The stale-while-revalidate Cache-Control directive in seconds")
+	aHTTPCacheSIE       = flag.Int("http-cache-stale-if-error", 0, "The stale-if-error Cache-Control directive in seconds")
+	aHTTPCachePrefer    = flag.Bool("http-cache-prefer-origin", false, "Prefer the HTTP source cache headers, if passed through, over the -http-cache-ttl ones")
+	aForwardHeaders     = flag.String("forward-response-headers", "", "Comma separated HTTP source response headers passed through to the client. E.g: ETag,Content-Language")
+	aSurrogateKeys      = flag.Bool("enable-surrogate-keys", false, "Enable the Surrogate-Key and Cache-Tag response headers tagging every image derived from the same source image, for CDN purging")
+	aSurrogateKeyPrefix = flag.String("surrogate-key-prefix", "", "Prefix of the surrogate keys, namespacing them in CDN services shared by several applications")
+	aCacheSize          = flag.Int("cache-size", 0, "Size in megabytes of the in memory processed images cache of the GET requests. Disabled by default")
+	aCachePeers         = flag.String("cache-peers", "", "Comma separated base URLs of every imaginary replica sharing the processed images cache, or dns+ prefixed names resolved to every replica. E.g: dns+http://imaginary:8088")
+	aCacheSelf          = flag.String("cache-self", "", "Base URL of this replica in the -cache-peers. Defaults to the peer of the local network addresses and port")
+	aCacheHints         = flag.Bool("cache-hints", false, "Enable the Imaginary-Cache-Owner response header of the replica owning the cached images of the source image, for load balancers routing by owner")
+	aCachePeerSecret    = flag.String("cache-peer-secret", "", "Shared secret authenticating the requests forwarded between the -cache-peers. Required by the -cache-peers flag")
+	aCDNPurge           = flag.String("cdn-purge", "", "CDN purge JSON file path, enabling the /purge endpoint purging the Cloudflare, Fastly or CloudFront cached images of a source image. Requires an API key or -admin-allowed-ips")
+	aWorker             = flag.String("worker", "", "Pre-processing worker JSON file path, running a worker generating the renditions of the images notified via SQS instead of the server")
+	aJobs               = flag.String("jobs", "", "Job queue JSON file path, processing the jobs of a NATS JetStream consumer or Kafka topic instead of running the server")
 	aReadTimeout        = flag.Int("http-read-timeout", 60, "HTTP read timeout in seconds")
 	aWriteTimeout       = flag.Int("http-write-timeout", 60, "HTTP write timeout in seconds")
+	aGracefulUpgrade    = flag.Bool("graceful-upgrade", false, "Upgrade the binary on SIGUSR2 signal, handing over the listening socket to a new process and draining the current one")
+	aDrainTimeout       = flag.Int("drain-timeout", 30, "Maximum time in seconds to serve the in flight requests of the process drained by a graceful upgrade or a leak check shutdown")
+	aWarmup             = flag.Bool("warmup", false, "Warm up the libvips operations, fonts and placeholder image, and resolve the configured origin hosts, before serving")
+	aPIDFile            = flag.String("pid-file", "", "Process id file path, updated by the graceful upgrades")
+	aProcessTimeout     = flag.Int("processing-timeout", 0, "Maximum time in seconds to fetch, process and encode an image")
+	aEndpointTimeouts   = flag.String("endpoint-timeouts", "", "Comma separated per endpoint processing timeouts in seconds. E.g: resize:10,pipeline:30")
 	aConcurrency        = flag.Int("concurrency", 0, "Throttle concurrency limit per second")
 	aBurst              = flag.Int("burst", 100, "Throttle burst max cache size")
+	aClientConcurrency  = flag.Int("client-concurrency", 0, "Maximum number of simultaneously processing image requests per API key id or client IP")
+	aMaxProcessing      = flag.Int("max-processing", 0, "Maximum number of simultaneously processing images, queueing the other ones by priority class")
+	aKeyPriorities      = flag.String("key-priorities", "", "Comma separated API key id priority classes: high, normal or low. E.g: frontend:high,importer:low")
+	aPriorityClients    = flag.String("priority-clients", "", "Comma separated API key ids, client IPs or CIDR ranges allowed to define their priority class via the Imaginary-Priority header")
 	aMRelease           = flag.Int("mrelease", 30, "OS memory release interval in seconds")
 	aCpus               = flag.Int("cpus", runtime.GOMAXPROCS(-1), "Number of cpu cores to use")
+	aSentryDSN          = flag.String("sentry-dsn", "", "Sentry project DSN to report server errors and panics to")
+	aErrorWebhook       = flag.String("error-webhook", "", "Webhook URL to report server errors and panics to as JSON")
+	aModerationURL      = flag.String("moderation-url", "", "Content classification service URL the source images are posted to before processing")
+	aModerationAction   = flag.String("moderation-action", "flag", "Action for the images flagged by the content moderation: flag or block")
+	aModerationScore    = flag.Float64("moderation-threshold", moderationDefaultThreshold, "Content classification score from which images are flagged")
+	aStatsdAddr         = flag.String("statsd-addr", "", "Statsd server address to send metrics to. E.g: localhost:8125")
+	aStatsdPrefix       = flag.String("statsd-prefix", "imaginary", "Statsd metrics name prefix")
+	aStatsdTags         = flag.String("statsd-tags", "", "Comma separated DogStatsD tags added to every metric. E.g: env:prod,region:eu")
+	aDogStatsd          = flag.Bool("dogstatsd", false, "Use the DogStatsD tags extension in statsd metrics")
+	aVipsCacheMax       = flag.Int("vips-cache-max", -1, "Maximum number of operations kept in the libvips operation cache")
+	aVipsCacheMaxMem    = flag.Int("vips-cache-max-mem", -1, "Maximum memory in bytes used by the libvips operation cache")
+	aVipsConcurrency    = flag.Int("vips-concurrency", -1, "Number of libvips worker threads per image operation")
+	aVipsLeakCheck      = flag.Bool("vips-leak-check", false, "Enable libvips memory leak reporting on shutdown")
+	aAccessLog          = flag.String("access-log", "", "Access log file path. Defaults to stdout")
+	aAccessLogFormat    = flag.String("access-log-format", "default", "Access log format: default, combined or json")
+	aAccessLogRedact    = flag.String("access-log-redact", "", "Comma separated query params whose values are redacted in the access log. E.g: key,sign,token")
+	aAccessLogSample    = flag.Float64("access-log-sample", 100, "Percentage of requests to write in the access log")
+	aAccessLogMaxSize   = flag.Int("access-log-max-size", 0, "Rotate the access log file once it reaches the given size in megabytes")
+	aAccessLogBackups   = flag.Int("access-log-max-backups", 5, "Maximum number of rotated access log files to keep")
+	aAuditLog           = flag.String("audit-log", "", "Enable audit mode, writing security events as JSON lines to the given file path")
+	aAuditWebhook       = flag.String("audit-webhook", "", "Enable audit mode, sending security events as JSON to the given webhook URL")
 )
 
 const usage = `imaginary %s
@@ -55,16 +153,31 @@ const usage = `imaginary %s
 Usage:
   imaginary -p 80
   imaginary -cors
+  imaginary -cors -cors-allowed-origins https://*.example.com -cors-max-age 600
   imaginary -concurrency 10
-  imaginary -path-prefix /api/v1
+  imaginary -concurrency 20 -client-concurrency 4
+  imaginary -graceful-upgrade -pid-file /run/imaginary.pid
+  imaginary -warmup -placeholder ./placeholder.jpg -allowed-origins https://images.example.com
+  imaginary -enable-key-rotation -key v1:secret1,importer:secret2 -max-processing 8 -key-priorities importer:low
+  imaginary -path-prefix /api
+  imaginary -no-legacy-routes
+  imaginary -enable-url-source -mount ./images -enable-cloudinary
+  imaginary -enable-url-source -rewrite-rules ./rules.json
+  imaginary -enable-url-source -request-scripts ./scripts.json
+  imaginary -enable-url-source -enable-imgproxy -imgproxy-key 943b421c9eb07c83 -imgproxy-salt 520f986b998545b4
   imaginary -enable-url-source
   imaginary -disable-endpoints form,health,crop,rotate
   imaginary -enable-url-source -allowed-origins http://localhost,http://server.com
+  imaginary -allowed-ips 10.0.0.0/8 -admin-allowed-ips 127.0.0.1
   imaginary -enable-url-source -enable-auth-forwarding
   imaginary -enable-url-source -authorization "Basic AwDJdL2DbwrD=="
   imaginary -enable-placeholder
   imaginary -enable-url-source -placeholder ./placeholder.jpg
   imaginary -enable-url-signature -url-signature-key 4f46feebafc4b5e988f131c4ff8b5997
+  imaginary -access-log /var/log/imaginary.log -access-log-format json -access-log-redact key,sign
+  imaginary bench -image ./image.jpg -n 1000 -c 10
+  imaginary openapi > openapi.json
+  imaginary doctor -mount ./images -rewrite-rules ./rules.json
   imaginary -h | -help
   imaginary -v | -version
 
@@ -74,38 +187,147 @@ Options:
   -h, -help                 Show help
   -v, -version              Show version
   -path-prefix <value>      Url path prefix to listen to [default: "/"]
+  -no-legacy-routes         Disable the legacy routes not prefixed by the /v1 API version [default: false]
+  -enable-cloudinary        Enable the Cloudinary-style transformation URLs of the /image endpoint [default: false]
+  -enable-imgproxy          Enable the imgproxy processing options URLs of the unmatched paths [default: false]
+  -imgproxy-key <keys>      Comma separated hex encoded imgproxy URL signature keys. Defaults to the IMGPROXY_KEY env variable
+  -imgproxy-salt <salts>    Comma separated hex encoded imgproxy URL signature salts, paired with the keys. Defaults to the IMGPROXY_SALT env variable
+  -rewrite-rules <path>     URL rewrite rules JSON file path, mapping the public URL paths to the image endpoints, params and sources
+  -request-scripts <path>   Request scripts JSON file path, adjusting the params of the image requests or rejecting them by expressions
   -cors                     Enable CORS support [default: false]
+  -cors-allowed-origins     CORS allowed origins, wildcards supported (separated by commas) [default: "*"]
+  -cors-allowed-headers     CORS allowed request headers (separated by commas)
+  -cors-exposed-headers     CORS response headers exposed to the browser (separated by commas)
+  -cors-max-age <num>       CORS preflight response max age in seconds [default: 0]
+  -cors-allow-credentials   Allow CORS requests including user credentials [default: false]
   -gzip                     Enable gzip compression (deprecated) [default: false]
   -disable-endpoints        Comma separated endpoints to disable. E.g: form,crop,rotate,health [default: ""]
-  -key <key>                Define API key for authorization
+  -key <key>                Define API key for authorization, or comma separated id:key pairs to rotate keys with -enable-key-rotation
+  -enable-key-rotation      Parse the API and URL signature keys, and their files, as comma separated id:key pairs to rotate keys [default: false]
   -mount <path>             Mount server local directory
   -http-cache-ttl <num>     The TTL in seconds. Adds caching headers to locally served files.
   -http-cache-passthru      Enable cache header passthrough for HTTP sources [default: false]
+  -http-cache-immutable-ttl <num> The TTL in seconds of the versioned image URLs, defined by the v param, marked as immutable
+  -http-cache-error-ttl <num> The TTL in seconds of the error responses [default: -http-cache-ttl]
+  -http-cache-stale-while-revalidate <num> The stale-while-revalidate Cache-Control directive in seconds
+  -http-cache-stale-if-error <num> The stale-if-error Cache-Control directive in seconds
+  -http-cache-prefer-origin Prefer the HTTP source cache headers, if passed through, over the -http-cache-ttl ones [default: false]
+  -forward-response-headers Comma separated HTTP source response headers passed through to the client. E.g: ETag,Content-Language
+  -enable-surrogate-keys    Enable the Surrogate-Key and Cache-Tag response headers tagging every image derived from the same source image, for CDN purging [default: false]
+  -surrogate-key-prefix <prefix> Prefix of the surrogate keys, namespacing them in CDN services shared by several applications
+  -cache-size <num>         Size in megabytes of the in memory processed images cache of the GET requests [default: disabled]
+  -cache-peers <urls>       Comma separated base URLs of every imaginary replica sharing the processed images cache, or dns+ prefixed names resolved to every replica. E.g: dns+http://imaginary:8088
+  -cache-self <url>         Base URL of this replica in the -cache-peers [default: the peer of the local network addresses and port]
+  -cache-hints              Enable the Imaginary-Cache-Owner response header of the replica owning the cached images of the source image, for load balancers routing by owner [default: false]
+  -cache-peer-secret <secret> Shared secret authenticating the requests forwarded between the -cache-peers. Required by the -cache-peers flag
+  -cdn-purge <path>         CDN purge JSON file path, enabling the /purge endpoint purging the Cloudflare, Fastly or CloudFront cached images of a source image. Requires an API key or -admin-allowed-ips
+  -worker <path>            Pre-processing worker JSON file path, running a worker generating the renditions of the images notified via SQS instead of the server
+  -jobs <path>              Job queue JSON file path, processing the jobs of a NATS JetStream consumer or Kafka topic instead of running the server
   -http-read-timeout <num>  HTTP read timeout in seconds [default: 30]
   -http-write-timeout <num> HTTP write timeout in seconds [default: 30]
+  -graceful-upgrade         Upgrade the binary on SIGUSR2 signal, handing over the listening socket to a new process and draining the current one [default: false]
+  -drain-timeout <num>      Maximum time in seconds to serve the in flight requests of the process drained by a graceful upgrade or a leak check shutdown [default: 30]
+  -pid-file <path>          Process id file path, updated by the graceful upgrades
+  -warmup                   Warm up the libvips operations, fonts and placeholder image, and resolve the configured origin hosts, before serving [default: false]
+  -processing-timeout <num> Maximum time in seconds to fetch, process and encode an image [default: disabled]
+  -endpoint-timeouts        Comma separated per endpoint processing timeouts in seconds. E.g: resize:10,pipeline:30 [default: ""]
   -enable-url-source        Restrict remote image source processing to certain origins (separated by commas)
   -enable-placeholder       Enable image response placeholder to be used in case of error [default: false]
+  -srcset-widths <list>     Comma separated default image widths ladder of the /srcset endpoint [default: 320,640,960,1280,1920]
+  -srcset-destination <path> Srcset renditions destination JSON file path, storing every rendition of the /srcset endpoint in an S3 bucket
+  -ogimage-templates <path> Social media card templates JSON file path used by the /ogimage endpoint
+  -interlace <types>        Comma separated output image types interlaced by default, such as jpeg,png (progressive JPEG and Adam7 PNG)
+  -quality-ladder <steps>   Comma separated default output image qualities by maximum output width, unless the quality is requested. E.g: 200:60,800:75,*:82 [default: disabled]
+  -ffmpeg <path>            FFmpeg binary path used to convert animated GIF images into videos and to extract still frames of video sources
+  -bgremoval-url <url>      Background removal service URL the images are posted to, replying the foreground cutout
+  -upscale-url <url>        Super-resolution service URL the images are posted to by upscale=ai requests, replying the upscaled image
+  -error-image              Reply with the errors rendered as images matching the requested dimensions and type [default: false]
   -enable-auth-forwarding   Forwards X-Forward-Authorization or Authorization header to the image source server. -enable-url-source flag must be defined. Tip: secure your server from public access to prevent attack vectors
   -enable-url-signature     Enable URL signature (URL-safe Base64-encoded HMAC digest) [default: false]
-  -url-signature-key        The URL signature key (32 characters minimum)
+  -url-signature-key        The URL signature key (32 characters minimum), or comma separated id:key pairs to rotate keys with -enable-key-rotation
+  -url-signature-ttl <num>  Maximum signed URL lifetime in seconds, requiring the signed expires param [default: disabled]
   -allowed-origins <urls>   Restrict remote image source processing to certain origins (separated by commas)
   -max-allowed-size <bytes> Restrict maximum size of http image source (in bytes)
+  -max-gif-frames <num>     Restrict maximum number of frames of GIF input images
+  -max-pdf-pages <num>      Restrict maximum number of pages of PDF input documents
+  -max-tiff-pages <num>     Restrict maximum number of directories (pages) of TIFF input images
+  -max-svg-elements <num>   Restrict maximum number of elements of SVG input images
+  -max-svg-size <bytes>     Restrict maximum size of SVG input images (in bytes)
+  -max-legacy-pixels <num>  Restrict maximum number of pixels of BMP, PCX and TGA input images, decoded in pure Go [default: 50000000]
+  -max-bandwidth <bytes>    Maximum outbound bandwidth per response in bytes per second, beyond the bandwidth threshold [default: disabled]
+  -bandwidth-threshold <bytes> Response size in bytes from which the outbound bandwidth is limited [default: 1048576]
+  -max-cost <num>           Restrict maximum estimated processing cost of images (input megapixels × operations)
+  -strict-params            Reject the requests of unknown, invalid or conflicting query params instead of ignoring them [default: false]
+  -enable-explain           Enable the explain mode, replying what the image requests would do without processing them [default: false]
+  -enable-original          Enable the /original endpoint and the raw param, replying the source images unmodified [default: false]
+  -original-types <types>   Comma separated MIME types, or type/* wildcards, of the source images replied unmodified [default: the supported image types but SVG]
+  -stream-min-size <bytes>  Stream the fit and convert output images of the source images from the given size (in bytes), instead of buffering them [default: disabled]
+  -stream-sources           Shrink the eligible remote source images on load as they are downloaded, instead of buffering them [default: false]
+  -debug-headers            Reply the processing timings and cache status via debug response headers [default: false]
+  -allowed-ips <ips>        Restrict image processing requests to certain client IPs or CIDR ranges (separated by commas)
+  -denied-ips <ips>         Deny image processing requests from certain client IPs or CIDR ranges (separated by commas)
+  -admin-allowed-ips <ips>  Restrict admin endpoints (health, /-/stats, purge) access to certain client IPs or CIDR ranges (separated by commas)
+  -admin-denied-ips <ips>   Deny admin endpoints (health, /-/stats, purge) access from certain client IPs or CIDR ranges (separated by commas)
   -certfile <path>          TLS certificate file path
   -keyfile <path>           TLS private key file path
   -authorization <value>    Defines a constant Authorization header value passed to all the image source servers. -enable-url-source flag must be defined. This overwrites authorization headers forwarding behavior via X-Forward-Authorization
+  -api-key-file <path>      File path of the API key, or comma separated id:key pairs with -enable-key-rotation, reloaded on change. E.g: Docker or Kubernetes secrets
+  -url-signature-key-file   File path of the URL signature key, or comma separated id:key pairs with -enable-key-rotation, reloaded on change
+  -authorization-file <path> File path of the Authorization header value passed to all the image source servers, reloaded on change
+  -origin-credentials <path> JSON file path mapping image source server hosts to their bearer, basic or header credentials, reloaded on change
+  -secrets-reload <num>     Secret files reload check interval in seconds [default: 10]
   -placeholder <path>       Image path to image custom placeholder to be used in case of error. Recommended minimum image size is: 1200x1200
   -concurrency <num>        Throttle concurrency limit per second [default: disabled]
   -burst <num>              Throttle burst max cache size [default: 100]
+  -client-concurrency <num> Maximum number of simultaneously processing image requests per API key id or client IP [default: disabled]
+  -max-processing <num>     Maximum number of simultaneously processing images, queueing the other ones by priority class [default: disabled]
+  -key-priorities <list>    Comma separated API key id priority classes: high, normal or low. E.g: frontend:high,importer:low
+  -priority-clients <list>  Comma separated API key ids, client IPs or CIDR ranges allowed to define their priority class via the Imaginary-Priority header [default: none]
   -mrelease <num>           OS memory release interval in seconds [default: 30]
   -cpus <num>               Number of used cpu cores.
                             (default for current machine is %d cores)
+  -sentry-dsn <dsn>         Sentry project DSN to report server errors and panics to. Env: SENTRY_DSN
+  -error-webhook <url>      Webhook URL to report server errors and panics to as JSON
+  -moderation-url <url>     Content classification service URL the source images are posted to before processing
+  -moderation-action <action> Action for the images flagged by the content moderation: flag or block [default: flag]
+  -moderation-threshold <score> Content classification score from which images are flagged [default: 0.8]
+  -statsd-addr <addr>       Statsd server address to send metrics to. E.g: localhost:8125
+  -statsd-prefix <prefix>   Statsd metrics name prefix [default: imaginary]
+  -statsd-tags <tags>       Comma separated DogStatsD tags added to every metric. E.g: env:prod,region:eu
+  -dogstatsd                Use the DogStatsD tags extension in statsd metrics [default: false]
+  -vips-cache-max <num>     Maximum number of operations kept in the libvips operation cache. Env: VIPS_CACHE_MAX [default: 500]
+  -vips-cache-max-mem       Maximum memory in bytes used by the libvips operation cache. Env: VIPS_CACHE_MAX_MEM [default: 104857600]
+  -vips-concurrency <num>   Number of libvips worker threads per image operation. Env: VIPS_CONCURRENCY [default: 1]
+  -vips-leak-check          Enable libvips memory leak reporting on shutdown. Env: VIPS_LEAK [default: false]
+  -access-log <path>        Access log file path. Defaults to stdout
+  -access-log-format <fmt>  Access log format: default, combined or json [default: default]
+  -access-log-redact <list> Comma separated query params whose values are redacted in the access log. E.g: key,sign,token
+  -access-log-sample <num>  Percentage of requests to write in the access log [default: 100]
+  -access-log-max-size      Rotate the access log file once it reaches the given size in megabytes. Disabled by default
+  -access-log-max-backups   Maximum number of rotated access log files to keep [default: 5]
+  -audit-log <path>         Enable audit mode, writing security events as JSON lines to the given file path
+  -audit-webhook <url>      Enable audit mode, sending security events as JSON to the given webhook URL
 `
 
 type URLSignature struct {
-	Key  string
+	Key string
 }
 
 func main() {
+	// Run subcommands, if required
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		runBench(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "openapi" {
+		runOpenAPI(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "doctor" {
+		runDoctor(os.Args[2:])
+		return
+	}
+
 	flag.Usage = func() {
 		fmt.Fprint(os.Stderr, fmt.Sprintf(usage, Version, runtime.NumCPU()))
 	}
@@ -128,13 +350,24 @@ func main() {
 		Port:               port,
 		Address:            *aAddr,
 		CORS:               *aCors,
+		CORSAllowedOrigins: parseList(*aCorsOrigins),
+		CORSAllowedHeaders: parseList(*aCorsHeaders),
+		CORSExposedHeaders: parseList(*aCorsExposed),
+		CORSMaxAge:         *aCorsMaxAge,
+		CORSCredentials:    *aCorsCredentials,
 		AuthForwarding:     *aAuthForwarding,
 		EnableURLSource:    *aEnableURLSource,
 		EnablePlaceholder:  *aEnablePlaceholder,
+		ErrorImage:         *aErrorImage,
+		FFmpeg:             *aFFmpeg,
+		BackgroundRemoval:  *aBackgroundRemoval,
+		Upscaler:           *aUpscaler,
 		EnableURLSignature: *aEnableURLSignature,
-		URLSignatureKey:    urlSignature.Key,
+		URLSignatureTTL:    *aURLSignatureTTL,
 		PathPrefix:         *aPathPrefix,
-		APIKey:             *aKey,
+		NoLegacyRoutes:     *aNoLegacyRoutes,
+		Cloudinary:         *aCloudinary,
+		Imgproxy:           *aImgproxy,
 		Concurrency:        *aConcurrency,
 		Burst:              *aBurst,
 		Mount:              *aMount,
@@ -143,11 +376,35 @@ func main() {
 		Placeholder:        *aPlaceholder,
 		HTTPCacheTTL:       *aHTTPCacheTTL,
 		HTTPCachePassthru:  *aHTTPCachePassthru,
+		ForwardHeaders:     parseForwardHeaders(*aForwardHeaders),
+		SurrogateKeys:      *aSurrogateKeys,
+		SurrogateKeyPrefix: *aSurrogateKeyPrefix,
 		HTTPReadTimeout:    *aReadTimeout,
 		HTTPWriteTimeout:   *aWriteTimeout,
+		GracefulUpgrade:    *aGracefulUpgrade,
+		DrainTimeout:       *aDrainTimeout,
+		PIDFile:            *aPIDFile,
+		ProcessingTimeout:  *aProcessTimeout,
+		StatsdAddr:         *aStatsdAddr,
+		StatsdPrefix:       *aStatsdPrefix,
+		StatsdTags:         parseList(*aStatsdTags),
+		DogStatsd:          *aDogStatsd,
+		AccessLog:          *aAccessLog,
+		AccessLogMaxSize:   *aAccessLogMaxSize,
+		AccessLogBackups:   *aAccessLogBackups,
 		Authorization:      *aAuthorization,
 		AllowedOrigins:     parseOrigins(*aAllowedOrigins),
 		MaxAllowedSize:     *aMaxAllowedSize,
+		MaxCost:            *aMaxCost,
+		StrictParams:       *aStrictParams,
+		EnableExplain:      *aEnableExplain,
+		EnableOriginal:     *aEnableOriginal,
+		OriginalTypes:      parseList(*aOriginalTypes),
+		DebugHeaders:       *aDebugHeaders,
+		StreamMinSize:      *aStreamMinSize,
+		StreamSources:      *aStreamSources,
+		MaxBandwidth:       *aMaxBandwidth,
+		BandwidthThreshold: *aBandwidthThreshold,
 	}
 
 	// Show warning if gzip flag is passed
@@ -155,6 +412,11 @@ func main() {
 		fmt.Println("warning: -gzip flag is deprecated and will not have effect")
 	}
 
+	// Tune libvips runtime params, if required
+	vipsOptions := getVipsOptions(*aVipsCacheMax, *aVipsCacheMaxMem, *aVipsConcurrency, *aVipsLeakCheck)
+	ConfigureVips(vipsOptions)
+	opts.VipsLeakCheck = vipsOptions.LeakCheck
+
 	// Create a memory release goroutine
 	if *aMRelease > 0 {
 		memoryRelease(*aMRelease)
@@ -169,6 +431,253 @@ func main() {
 	if *aHTTPCacheTTL != -1 {
 		checkHttpCacheTtl(*aHTTPCacheTTL)
 	}
+	opts.HTTPCache = CacheOptions{
+		ImmutableTTL:         *aHTTPCacheImmutable,
+		ErrorTTL:             *aHTTPCacheErrorTTL,
+		StaleWhileRevalidate: *aHTTPCacheSWR,
+		StaleIfError:         *aHTTPCacheSIE,
+		PreferOrigin:         *aHTTPCachePrefer,
+	}
+	for name, ttl := range map[string]int{
+		"http-cache-immutable-ttl":          *aHTTPCacheImmutable,
+		"http-cache-error-ttl":              *aHTTPCacheErrorTTL,
+		"http-cache-stale-while-revalidate": *aHTTPCacheSWR,
+		"http-cache-stale-if-error":         *aHTTPCacheSIE,
+	} {
+		if ttl < -1 || ttl > 31556926 {
+			exitWithError("The -%s flag only accepts a value from 0 to 31556926", name)
+		}
+	}
+
+	// Parse the API and URL signature key rings, whose primary keys are the default ones
+	opts.APIKeys = parseKeyRingOrExit("API", *aKey, *aKeyRotation)
+	opts.APIKey = opts.APIKeys.Primary().Secret
+	opts.URLSignatureKeys = parseKeyRingOrExit("URL signature", urlSignature.Key, *aKeyRotation)
+	opts.URLSignatureKey = opts.URLSignatureKeys.Primary().Secret
+
+	// Read the secret files, if present, taking precedence over the flags
+	if *aAPIKeyFile != "" || *aURLSignatureFile != "" || *aAuthorizationFile != "" || *aOriginCredentials != "" {
+		secrets, err := NewSecrets(SecretsOptions{
+			APIKeyFile:          *aAPIKeyFile,
+			URLSignatureKeyFile: *aURLSignatureFile,
+			AuthorizationFile:   *aAuthorizationFile,
+			OriginsFile:         *aOriginCredentials,
+			KeyRotation:         *aKeyRotation,
+		})
+		if err != nil {
+			exitWithError("cannot read secrets: %s", err)
+		}
+		if key := secrets.APIKeys().Primary(); key.Secret != "" {
+			opts.APIKey = key.Secret
+		}
+		if key := secrets.URLSignatureKeys().Primary(); key.Secret != "" {
+			opts.URLSignatureKey = key.Secret
+		}
+		if *aSecretsReload > 0 {
+			secrets.Watch(time.Duration(*aSecretsReload) * time.Second)
+		}
+		opts.Secrets = secrets
+	}
+
+	// Parse client IP access lists, if present
+	opts.AllowedIPs = parseIPNetsOrExit(*aAllowedIPs)
+	opts.DeniedIPs = parseIPNetsOrExit(*aDeniedIPs)
+	opts.AdminAllowedIPs = parseIPNetsOrExit(*aAdminAllowedIPs)
+	opts.AdminDeniedIPs = parseIPNetsOrExit(*aAdminDeniedIPs)
+
+	// Configure the error reporting service, if present
+	if dsn := getSentryDSN(*aSentryDSN); dsn != "" {
+		reporter, err := NewSentryReporter(dsn)
+		if err != nil {
+			exitWithError("invalid Sentry DSN: %s", err)
+		}
+		opts.ErrorReporter = reporter
+	} else if *aErrorWebhook != "" {
+		opts.ErrorReporter = &WebhookReporter{URL: *aErrorWebhook}
+	}
+
+	// Configure the content moderation service, if present
+	if *aModerationURL != "" {
+		if *aModerationAction != ModerationFlag && *aModerationAction != ModerationBlock {
+			exitWithError("invalid -moderation-action value: %s", *aModerationAction)
+		}
+		opts.Moderation = ModerationOptions{
+			Moderator: &HTTPModerator{URL: *aModerationURL},
+			Action:    *aModerationAction,
+			Threshold: *aModerationScore,
+		}
+	}
+
+	// Parse the srcset widths ladder
+	widths, err := parseSrcsetWidths(*aSrcsetWidths, nil)
+	if err != nil {
+		exitWithError("invalid -srcset-widths value: %s", err)
+	}
+	opts.SrcsetWidths = widths
+
+	// Load the srcset renditions destination, if present
+	if *aSrcsetDestination != "" {
+		destination, err := LoadSrcsetDestination(*aSrcsetDestination)
+		if err != nil {
+			exitWithError("cannot load the srcset destination: %s", err)
+		}
+		opts.SrcsetDestination = destination
+	}
+
+	// Parse the interlaced output image types
+	for _, name := range parseList(*aInterlace) {
+		if t := ImageType(name); t != bimg.JPEG && t != bimg.PNG {
+			exitWithError("invalid -interlace image type: %s", name)
+		}
+		opts.Interlace = append(opts.Interlace, strings.ToLower(name))
+	}
+
+	// Parse the quality ladder, if present
+	ladder, err := parseQualityLadder(*aQualityLadder)
+	if err != nil {
+		exitWithError("invalid -quality-ladder value: %s", err)
+	}
+	opts.QualityLadder = ladder
+
+	// Load the social media card templates, if present
+	if *aOGTemplates != "" {
+		templates, err := LoadOGTemplates(*aOGTemplates)
+		if err != nil {
+			exitWithError("cannot load the ogimage templates: %s", err)
+		}
+		opts.OGTemplates = templates
+	}
+
+	// Create the processed images cache, shared by the cache peers, if required
+	if *aCacheSize > 0 {
+		opts.ResultCache = NewResultCache(int64(*aCacheSize) * 1024 * 1024)
+	}
+	if *aCachePeers != "" {
+		if opts.ResultCache == nil {
+			exitWithError("the -cache-peers flag requires the -cache-size flag")
+		}
+		peers, err := parsePeers(*aCachePeers)
+		if err != nil {
+			exitWithError("invalid -cache-peers value: %s", err)
+		}
+		resolved, err := resolvePeers(peers)
+		if err != nil {
+			exitWithError("cannot resolve the cache peers: %s", err)
+		}
+		opts.ResultCache.Ring = NewPeerRing(resolved)
+		opts.ResultCache.Self = strings.TrimSuffix(*aCacheSelf, "/")
+		if opts.ResultCache.Self == "" {
+			opts.ResultCache.Self = detectSelfPeer(resolved, opts.Port)
+		}
+		if opts.ResultCache.Self == "" {
+			exitWithError("cannot detect this replica in the cache peers, define it via the -cache-self flag")
+		}
+		if *aCachePeerSecret == "" {
+			exitWithError("the -cache-peers flag requires the -cache-peer-secret flag")
+		}
+		opts.ResultCache.Secret = *aCachePeerSecret
+		opts.ResultCache.Hints = *aCacheHints
+		watchPeers(opts.ResultCache.Ring, peers)
+	} else if *aCacheHints {
+		exitWithError("the -cache-hints flag requires the -cache-peers flag")
+	}
+
+	// Load the URL rewrite rules, if present
+	if *aRewriteRules != "" {
+		rules, err := LoadRewriteRules(*aRewriteRules)
+		if err != nil {
+			exitWithError("cannot load the rewrite rules: %s", err)
+		}
+		opts.RewriteRules = rules
+	}
+
+	// Load the request scripts, if present
+	if *aRequestScripts != "" {
+		scripts, err := LoadRequestScripts(*aRequestScripts)
+		if err != nil {
+			exitWithError("cannot load the request scripts: %s", err)
+		}
+		opts.Scripts = scripts
+	}
+
+	// Load the CDN purge configuration, if present
+	if *aCDNPurge != "" {
+		purgers, err := LoadCDNPurgers(*aCDNPurge)
+		if err != nil {
+			exitWithError("cannot load the CDN purge configuration: %s", err)
+		}
+		if !opts.AdminAuthenticated() {
+			exitWithError("the -cdn-purge flag requires an API key, via the -key or -api-key-file flags, or the -admin-allowed-ips flag")
+		}
+		opts.CDNPurgers = purgers
+	}
+
+	// Limit the concurrent image requests per client, if required
+	if *aClientConcurrency > 0 {
+		opts.ClientLimiter = NewClientLimiter(*aClientConcurrency)
+	}
+
+	// Queue the processing images by priority class, if required
+	if *aMaxProcessing > 0 {
+		opts.ProcessingQueue = NewProcessingQueue(*aMaxProcessing)
+	}
+	if *aKeyPriorities != "" {
+		priorities, err := parseKeyPriorities(*aKeyPriorities)
+		if err != nil {
+			exitWithError("invalid -key-priorities value: %s", err)
+		}
+		opts.KeyPriorities = priorities
+	}
+	if *aPriorityClients != "" {
+		keys, ips, err := parsePriorityClients(*aPriorityClients)
+		if err != nil {
+			exitWithError("invalid -priority-clients value: %s", err)
+		}
+		opts.PriorityKeys, opts.PriorityIPs = keys, ips
+	}
+
+	// Set format specific input limits
+	opts.InputLimits = InputLimits{
+		MaxGIFFrames:   *aMaxGIFFrames,
+		MaxPDFPages:    *aMaxPDFPages,
+		MaxTIFFPages:   *aMaxTIFFPages,
+		MaxSVGElements: *aMaxSVGElements,
+		MaxSVGSize:     *aMaxSVGSize,
+
+		MaxLegacyPixels: *aMaxLegacyPixels,
+	}
+
+	// Validate access log params
+	opts.AccessLogOptions = LogOptions{
+		Format:     *aAccessLogFormat,
+		Redact:     parseList(*aAccessLogRedact),
+		SampleRate: *aAccessLogSample,
+	}
+	if err := checkAccessLogOptions(opts.AccessLogOptions); err != nil {
+		exitWithError("%s", err)
+	}
+
+	// Enable audit mode, if required
+	if *aAuditLog != "" || *aAuditWebhook != "" {
+		var out io.Writer
+		if *aAuditLog != "" {
+			file, err := NewRotatingFile(*aAuditLog, 0, 0)
+			if err != nil {
+				exitWithError("cannot open the audit log: %s", err)
+			}
+			out = file
+		}
+		opts.Auditor = NewAuditor(out, *aAuditWebhook)
+	}
+
+	// Parse per endpoint processing timeouts, if present
+	if *aEndpointTimeouts != "" {
+		timeouts, err := parseEndpointTimeouts(*aEndpointTimeouts)
+		if err != nil {
+			exitWithError("invalid -endpoint-timeouts value: %s", err)
+		}
+		opts.EndpointTimeouts = timeouts
+	}
 
 	// Parse endpoint names to disabled, if present
 	if *aDisableEndpoints != "" {
@@ -195,22 +704,63 @@ func main() {
 
 	// Check URL signature key, if required
 	if *aEnableURLSignature == true {
-		if urlSignature.Key == "" {
+		if opts.URLSignatureKey == "" {
 			exitWithError("URL signature key is required")
 		}
 
-		if len(urlSignature.Key) < 32 {
-			exitWithError("URL signature key must be a minimum of 32 characters")
+		for _, key := range urlSignatureKeys(opts) {
+			if len(key.Secret) < 32 {
+				exitWithError("URL signature key must be a minimum of 32 characters")
+			}
 		}
 	}
 
-	debug("imaginary server listening on port :%d/%s", opts.Port, strings.TrimPrefix(opts.PathPrefix, "/"))
+	// Check the imgproxy URL signature keys, required if the URL signatures are enabled
+	if *aImgproxy {
+		keys, err := parseImgproxyKeys(getImgproxyKeys(*aImgproxyKey, *aImgproxySalt))
+		if err != nil {
+			exitWithError("%s", err)
+		}
+		if *aEnableURLSignature && len(keys) == 0 {
+			exitWithError("imgproxy key and salt are required by the signed URLs")
+		}
+		opts.ImgproxyKeys = keys
+	}
 
 	// Load image source providers
 	LoadSources(opts)
 
+	// Run the pre-processing worker instead of the server, if required
+	if *aWorker != "" {
+		workerOpts, err := LoadWorkerOptions(*aWorker)
+		if err != nil {
+			exitWithError("cannot load the worker configuration: %s", err)
+		}
+		workerOpts.AllowedOrigins, workerOpts.MaxAllowedSize = opts.AllowedOrigins, opts.MaxAllowedSize
+		RunWorker(workerOpts)
+	}
+
+	// Process the job queue jobs instead of running the server, if required
+	if *aJobs != "" {
+		jobsOpts, err := LoadJobsOptions(*aJobs)
+		if err != nil {
+			exitWithError("cannot load the job queue configuration: %s", err)
+		}
+		jobsOpts.AllowedOrigins, jobsOpts.MaxAllowedSize = opts.AllowedOrigins, opts.MaxAllowedSize
+		RunJobs(jobsOpts)
+	}
+
+	debug("imaginary server listening on port :%d/%s", opts.Port, strings.TrimPrefix(opts.PathPrefix, "/"))
+
+	// Warm up the image processing before serving, if required
+	if *aWarmup {
+		if err := Warmup(opts); err != nil {
+			exitWithError("cannot warm up the server: %s", err)
+		}
+	}
+
 	// Start the server
-	err := Server(opts)
+	err = Server(opts)
 	if err != nil {
 		exitWithError("cannot start the server: %s", err)
 	}
@@ -234,6 +784,20 @@ func getURLSignature(key string) URLSignature {
 	return URLSignature{key}
 }
 
+func getImgproxyKeys(keys, salts string) (string, string) {
+	if keyEnv := os.Getenv("IMGPROXY_KEY"); keys == "" && keyEnv != "" {
+		keys, salts = keyEnv, os.Getenv("IMGPROXY_SALT")
+	}
+	return keys, salts
+}
+
+func getSentryDSN(dsn string) string {
+	if dsnEnv := os.Getenv("SENTRY_DSN"); dsn == "" && dsnEnv != "" {
+		return dsnEnv
+	}
+	return dsn
+}
+
 func showUsage() {
 	flag.Usage()
 	os.Exit(1)
@@ -267,6 +831,19 @@ func checkHttpCacheTtl(ttl int) {
 	}
 }
 
+func checkAccessLogOptions(o LogOptions) error {
+	switch o.Format {
+	case LogFormatDefault, LogFormatCombined, LogFormatJSON:
+	default:
+		return fmt.Errorf("The -access-log-format flag only accepts default, combined or json")
+	}
+
+	if o.SampleRate <= 0 || o.SampleRate > 100 {
+		return fmt.Errorf("The -access-log-sample flag only accepts a value greater than 0 and up to 100")
+	}
+	return nil
+}
+
 func parseOrigins(origins string) []*url.URL {
 	urls := []*url.URL{}
 	if origins == "" {
@@ -282,6 +859,81 @@ func parseOrigins(origins string) []*url.URL {
 	return urls
 }
 
+func parseIPNets(input string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, value := range strings.Split(input, ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+
+		// Plain IP addresses are treated as single host ranges
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address: %s", value)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipnet, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR range: %s", value)
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+func parseIPNetsOrExit(input string) []*net.IPNet {
+	nets, err := parseIPNets(input)
+	if err != nil {
+		exitWithError("cannot parse client IP list: %s", err)
+	}
+	return nets
+}
+
+// reservedHeaders are the response headers defined by imaginary, which cannot be forwarded
+var reservedHeaders = []string{"Content-Length", "Content-Type", "Content-Encoding", "Transfer-Encoding", "Connection"}
+
+func parseForwardHeaders(input string) []string {
+	headers := []string{}
+	for _, name := range parseList(input) {
+		name = http.CanonicalHeaderKey(name)
+		for _, reserved := range reservedHeaders {
+			if name == reserved {
+				exitWithError("cannot forward the %s response header", name)
+			}
+		}
+		headers = append(headers, name)
+	}
+	return headers
+}
+
+func parseKeyRingOrExit(name, input string, rotation bool) KeyRing {
+	ring, err := parseKeyRing(input, rotation)
+	if err != nil {
+		exitWithError("cannot parse %s keys: %s", name, err)
+	}
+	return ring
+}
+
+func parseList(input string) []string {
+	list := []string{}
+	for _, value := range strings.Split(input, ",") {
+		value = strings.TrimSpace(value)
+		if value != "" {
+			list = append(list, value)
+		}
+	}
+	return list
+}
+
 func parseEndpoints(input string) Endpoints {
 	endpoints := Endpoints{}
 	for _, endpoint := range strings.Split(input, ",") {
@@ -293,6 +945,22 @@ func parseEndpoints(input string) Endpoints {
 	return endpoints
 }
 
+func parseEndpointTimeouts(input string) (map[string]int, error) {
+	timeouts := make(map[string]int)
+	for _, value := range parseList(input) {
+		parts := strings.SplitN(value, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("missing timeout for endpoint: %s", value)
+		}
+		seconds, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || seconds < 0 {
+			return nil, fmt.Errorf("invalid timeout for endpoint: %s", value)
+		}
+		timeouts[strings.ToLower(strings.TrimSpace(parts[0]))] = seconds
+	}
+	return timeouts, nil
+}
+
 func memoryRelease(interval int) {
 	ticker := time.NewTicker(time.Duration(interval) * time.Second)
 	go func() {
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// imgproxyGravities maps the imgproxy gravity types to the gravity param values. Corner
+// gravities are approximated by their vertical side.
+var imgproxyGravities = map[string]string{
+	"ce":   "centre",
+	"no":   "north",
+	"so":   "south",
+	"ea":   "east",
+	"we":   "west",
+	"noea": "north",
+	"nowe": "north",
+	"soea": "south",
+	"sowe": "south",
+	"sm":   "smart",
+}
+
+// imgproxyOptionNames maps the imgproxy processing option short names to their full names
+var imgproxyOptionNames = map[string]string{
+	"rs":  "resize",
+	"s":   "size",
+	"rt":  "resizing_type",
+	"w":   "width",
+	"h":   "height",
+	"el":  "enlarge",
+	"ex":  "extend",
+	"g":   "gravity",
+	"c":   "crop",
+	"q":   "quality",
+	"f":   "format",
+	"ext": "format",
+	"bg":  "background",
+	"bl":  "blur",
+	"pix": "pixelate",
+	"rot": "rotate",
+	"fl":  "flip",
+	"sm":  "strip_metadata",
+	"ar":  "auto_rotate",
+	"exp": "expires",
+	"cb":  "cachebuster",
+	"fn":  "filename",
+	"att": "return_attachment",
+	"scp": "strip_color_profile",
+	"kcr": "keep_copyright",
+}
+
+// imgproxyIgnoredOptions are the imgproxy processing options with no effect on the processed image
+var imgproxyIgnoredOptions = map[string]bool{
+	"cachebuster":         true,
+	"filename":            true,
+	"return_attachment":   true,
+	"strip_color_profile": true,
+	"keep_copyright":      true,
+}
+
+// ImgproxyKey represents an imgproxy URL signature key and salt pair
+type ImgproxyKey struct {
+	Key  []byte
+	Salt []byte
+}
+
+// parseImgproxyKeys parses the given comma separated hex encoded imgproxy keys and salts, paired by position
+func parseImgproxyKeys(keys, salts string) ([]ImgproxyKey, error) {
+	keyList, saltList := parseList(keys), parseList(salts)
+	if len(keyList) != len(saltList) {
+		return nil, fmt.Errorf("every imgproxy key requires a salt")
+	}
+
+	pairs := []ImgproxyKey{}
+	for i := range keyList {
+		key, err := hex.DecodeString(keyList[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid imgproxy key: %s", err)
+		}
+		salt, err := hex.DecodeString(saltList[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid imgproxy salt: %s", err)
+		}
+		pairs = append(pairs, ImgproxyKey{Key: key, Salt: salt})
+	}
+	return pairs, nil
+}
+
+// validImgproxySignature returns whether the given URL-safe Base64 encoded signature
+// is the HMAC-SHA256 digest of the salted path, signed by any of the given keys.
+func validImgproxySignature(keys []ImgproxyKey, signature, path string) bool {
+	sign, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(signature, "="))
+	if err != nil {
+		return false
+	}
+	for _, key := range keys {
+		mac := hmac.New(sha256.New, key.Key)
+		mac.Write(key.Salt)
+		mac.Write([]byte(path))
+		if hmac.Equal(sign, mac.Sum(nil)) {
+			return true
+		}
+	}
+	return false
+}
+
+// imgproxyURL represents the parts of an imgproxy URL path:
+// /<signature>/<processing options>/plain/<source URL>@<extension> or
+// /<signature>/<processing options>/<Base64 encoded source URL>.<extension>
+type imgproxyURL struct {
+	Signature string
+	Path      string
+	Options   []string
+	Source    string
+	Extension string
+}
+
+// parseImgproxyPath parses the given escaped imgproxy URL path
+func parseImgproxyPath(path string) (imgproxyURL, error) {
+	u := imgproxyURL{}
+	parts := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)
+	if len(parts) != 2 {
+		return u, fmt.Errorf("missing source URL")
+	}
+	u.Signature, u.Path = parts[0], "/"+parts[1]
+
+	segments := strings.Split(parts[1], "/")
+	i := 0
+	for i < len(segments) && strings.Contains(segments[i], ":") {
+		option, err := url.PathUnescape(segments[i])
+		if err != nil {
+			return u, err
+		}
+		u.Options = append(u.Options, option)
+		i++
+	}
+	segments = segments[i:]
+	if len(segments) == 0 {
+		return u, fmt.Errorf("missing source URL")
+	}
+
+	switch segments[0] {
+	case "plain":
+		source, err := url.PathUnescape(strings.Join(segments[1:], "/"))
+		if err != nil {
+			return u, err
+		}
+		if i := strings.LastIndex(source, "@"); i >= 0 && !strings.Contains(source[i:], "/") {
+			source, u.Extension = source[:i], source[i+1:]
+		}
+		u.Source = imgproxySource(source)
+		// Sign the source URL scheme slashes merged by the path cleaning, as signed by the client
+		u.Path = "/" + strings.Join(strings.Split(parts[1], "/")[:i+1], "/") + "/" + imgproxySource(strings.Join(segments[1:], "/"))
+	case "enc":
+		return u, fmt.Errorf("encrypted source URLs are not supported")
+	default:
+		encoded := strings.Join(segments, "")
+		if i := strings.Index(encoded, "."); i >= 0 {
+			encoded, u.Extension = encoded[:i], encoded[i+1:]
+		}
+		source, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+		if err != nil {
+			return u, fmt.Errorf("invalid Base64 encoded source URL")
+		}
+		u.Source = string(source)
+	}
+
+	if u.Source == "" {
+		return u, fmt.Errorf("missing source URL")
+	}
+	return u, nil
+}
+
+// imgproxySource restores the scheme slashes of the given plain source URL, merged by the path cleaning
+func imgproxySource(source string) string {
+	if strings.HasPrefix(source, "local:/") {
+		return "local:///" + strings.TrimLeft(strings.TrimPrefix(source, "local:"), "/")
+	}
+	return remoteSourceURL(source)
+}
+
+// imgproxyBool parses the given imgproxy boolean argument
+func imgproxyBool(value string) bool {
+	return value == "1" || value == "t" || value == "true"
+}
+
+// imgproxyColor translates the given imgproxy R:G:B or hex encoded color arguments
+func imgproxyColor(args []string) (string, error) {
+	if len(args) == 3 {
+		for _, arg := range args {
+			if n, err := strconv.Atoi(arg); err != nil || n < 0 || n > 255 {
+				return "", fmt.Errorf("invalid color: %s", strings.Join(args, ":"))
+			}
+		}
+		return strings.Join(args, ","), nil
+	}
+	return cloudinaryColor(strings.Join(args, ""))
+}
+
+// translateImgproxy translates the given imgproxy processing options and output extension, if any,
+// into the endpoint and params processing them, at the given time checking the URL expiration.
+func translateImgproxy(options []string, extension string, now time.Time) (string, url.Values, error) {
+	resizing, width, height, dpr := "fit", 0, 0, 1.0
+	enlarge, extend := false, false
+	gravity, background := "", ""
+	output := url.Values{}
+	operations := PipelineOperations{}
+	effects := PipelineOperations{}
+
+	if extension != "" {
+		output.Set("type", extension)
+	}
+
+	for _, option := range options {
+		args := strings.Split(option, ":")
+		name := args[0]
+		if full, ok := imgproxyOptionNames[name]; ok {
+			name = full
+		}
+		args = args[1:]
+
+		var err error
+		atoi := func(i int) int {
+			if i >= len(args) || args[i] == "" {
+				return 0
+			}
+			n, e := strconv.Atoi(args[i])
+			if e != nil || n < 0 {
+				err = fmt.Errorf("invalid %s argument: %s", name, args[i])
+			}
+			return n
+		}
+		arg := func(i int) string {
+			if i >= len(args) {
+				return ""
+			}
+			return args[i]
+		}
+
+		switch name {
+		case "resize", "size":
+			if name == "resize" && len(args) > 0 {
+				resizing, args = args[0], args[1:]
+			}
+			width, height = atoi(0), atoi(1)
+			enlarge, extend = imgproxyBool(arg(2)), imgproxyBool(arg(3))
+		case "resizing_type":
+			resizing = arg(0)
+		case "width":
+			width = atoi(0)
+		case "height":
+			height = atoi(0)
+		case "dpr":
+			if dpr, err = strconv.ParseFloat(arg(0), 64); err != nil || dpr <= 0 || dpr > 5 {
+				err = fmt.Errorf("invalid dpr argument: %s", arg(0))
+			}
+		case "enlarge":
+			enlarge = imgproxyBool(arg(0))
+		case "extend":
+			extend = imgproxyBool(arg(0))
+		case "gravity":
+			var ok bool
+			if gravity, ok = imgproxyGravities[arg(0)]; !ok {
+				err = fmt.Errorf("unsupported gravity: %s", arg(0))
+			}
+		case "crop":
+			crop := map[string]interface{}{}
+			if n := atoi(0); n > 0 {
+				crop["width"] = n
+			}
+			if n := atoi(1); n > 0 {
+				crop["height"] = n
+			}
+			if g, ok := imgproxyGravities[arg(2)]; ok {
+				crop["gravity"] = g
+			} else if arg(2) != "" {
+				err = fmt.Errorf("unsupported gravity: %s", arg(2))
+			}
+			if len(crop) > 0 {
+				operations = append(operations, PipelineOperation{Name: "crop", Params: crop})
+			}
+		case "quality":
+			if q := atoi(0); q > 100 {
+				err = fmt.Errorf("invalid quality argument: %s", arg(0))
+			} else if q > 0 {
+				output.Set("quality", strconv.Itoa(q))
+			}
+		case "format":
+			output.Set("type", arg(0))
+		case "background":
+			background, err = imgproxyColor(args)
+		case "blur":
+			sigma, e := strconv.ParseFloat(arg(0), 64)
+			if e != nil || sigma < 0 {
+				err = fmt.Errorf("invalid blur argument: %s", arg(0))
+			} else if sigma > 0 {
+				effects = append(effects, PipelineOperation{Name: "blur", Params: map[string]interface{}{"sigma": sigma}})
+			}
+		case "pixelate":
+			if n := atoi(0); n > 1 {
+				effects = append(effects, PipelineOperation{Name: "pixelate", Params: map[string]interface{}{"pixelate": n}})
+			}
+		case "rotate":
+			if n := atoi(0); n%90 != 0 {
+				err = fmt.Errorf("unsupported rotation angle: %d", n)
+			} else if n%360 != 0 {
+				effects = append(effects, PipelineOperation{Name: "rotate", Params: map[string]interface{}{"rotate": n % 360}})
+			}
+		case "flip":
+			if imgproxyBool(arg(0)) {
+				effects = append(effects, PipelineOperation{Name: "flop", Params: map[string]interface{}{}})
+			}
+			if imgproxyBool(arg(1)) {
+				effects = append(effects, PipelineOperation{Name: "flip", Params: map[string]interface{}{}})
+			}
+		case "strip_metadata":
+			if imgproxyBool(arg(0)) {
+				output.Set("stripmeta", "true")
+			}
+		case "auto_rotate":
+			if !imgproxyBool(arg(0)) {
+				output.Set("norotation", "true")
+			}
+		case "expires":
+			if expires := atoi(0); err == nil && now.Unix() > int64(expires) {
+				err = fmt.Errorf("the URL has expired")
+			}
+		default:
+			if !imgproxyIgnoredOptions[name] {
+				err = fmt.Errorf("unsupported processing option: %s", name)
+			}
+		}
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	if output.Get("type") == "jpg" {
+		output.Set("type", "jpeg")
+	}
+
+	resize := map[string]interface{}{}
+	if width > 0 {
+		resize["width"] = int(float64(width)*dpr + 0.5)
+	}
+	if height > 0 {
+		resize["height"] = int(float64(height)*dpr + 0.5)
+	}
+	both := width > 0 && height > 0
+	if len(resize) > 0 {
+		name := "resize"
+		switch resizing {
+		case "fit":
+			if both && extend {
+				resize["embed"], resize["nocrop"], resize["extend"] = true, true, "background"
+				if background != "" {
+					resize["background"] = background
+				}
+			} else if both {
+				name = "fit"
+			}
+		case "fill", "fill-down", "auto":
+			if both {
+				name = "crop"
+				if enlarge {
+					name = "enlarge"
+				}
+				if gravity != "" {
+					resize["gravity"] = gravity
+				}
+			}
+		case "force":
+			resize["force"] = both
+		default:
+			return "", nil, fmt.Errorf("unsupported resizing type: %s", resizing)
+		}
+		operations = append(operations, PipelineOperation{Name: name, Params: resize})
+	}
+
+	endpoint, query := operationsRequest(append(operations, effects...), output)
+	return endpoint, query, nil
+}
+
+// imgproxyController serves the imgproxy URLs of the remote images, and of the mounted
+// files of the local:// source URLs, verifying their signature if the keys are defined.
+func imgproxyController(o ServerOptions) func(http.ResponseWriter, *http.Request) {
+	controller := newCompatController(o)
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, err := parseImgproxyPath(strings.TrimPrefix(r.URL.EscapedPath(), strings.TrimSuffix(join(o, "/"), "/")))
+		if err != nil {
+			ErrorReply(r, w, NewError("Invalid imgproxy URL: "+err.Error(), BadRequest), o)
+			return
+		}
+		if len(o.ImgproxyKeys) > 0 && !validImgproxySignature(o.ImgproxyKeys, u.Signature, u.Path) {
+			ErrorReply(r, w, ErrInvalidURLSignature, o)
+			return
+		}
+
+		endpoint, params, err := translateImgproxy(u.Options, u.Extension, time.Now())
+		if err != nil {
+			ErrorReply(r, w, NewError("Invalid processing options: "+err.Error(), BadRequest), o)
+			return
+		}
+
+		if strings.HasPrefix(u.Source, "local:///") {
+			params.Set("file", strings.TrimPrefix(u.Source, "local:///"))
+		} else {
+			params.Set("url", u.Source)
+		}
+
+		// The signatures only cover the path, so the query params of the request are not merged
+		req := r.WithContext(r.Context())
+		req.URL = &url.URL{Path: r.URL.Path, RawPath: r.URL.RawPath}
+		controller.Serve(w, req, o, endpoint, params)
+	}
+}
+
+// imgproxyRoutes serves the unmatched paths of the given index handler as imgproxy URLs
+func imgproxyRoutes(index http.Handler, o ServerOptions) http.Handler {
+	imgproxy := imgproxyMiddleware(imgproxyController(o), o)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == join(o, "/") {
+			index.ServeHTTP(w, r)
+			return
+		}
+		imgproxy.ServeHTTP(w, r)
+	})
+}
+
+// imgproxyMiddleware wraps the imgproxy controller, signed by the imgproxy URL signatures
+// instead of the -enable-url-signature ones.
+func imgproxyMiddleware(fn func(http.ResponseWriter, *http.Request), o ServerOptions) http.Handler {
+	o.EnableURLSignature = false
+	return imageControllerMiddleware(fn, o)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseImgproxyKeys(t *testing.T) {
+	keys, err := parseImgproxyKeys("943b421c,0a0b", "520f986b,0c0d")
+	if err != nil || len(keys) != 2 || !reflect.DeepEqual(keys[1], ImgproxyKey{Key: []byte{10, 11}, Salt: []byte{12, 13}}) {
+		t.Errorf("Invalid keys: %#v %v", keys, err)
+	}
+	if _, err := parseImgproxyKeys("943b421c", ""); err == nil {
+		t.Error("Expected missing salt error")
+	}
+	if _, err := parseImgproxyKeys("zz", "0a"); err == nil {
+		t.Error("Expected invalid key error")
+	}
+}
+
+func TestValidImgproxySignature(t *testing.T) {
+	keys, _ := parseImgproxyKeys(
+		"0a0b,943b421c9eb07c830af81030552c86009268de4e532ba2ee2eab8247c6da0881",
+		"0c0d,520f986b998545b4785e0defbc4f3c1203f22de2374a3d53cb7a7fe9fea309c5",
+	)
+	path := "/rs:fill:300:400:0/g:sm/aHR0cDovL2V4YW1w/bGUuY29tL2ltYWdl/cy9jdXJpb3NpdHku/anBn.png"
+	if !validImgproxySignature(keys, "90UxdwGRAI2bpLSHKkZculJau5ahfxfS0h3fMuQAf40", path) {
+		t.Error("Invalid signature")
+	}
+	if validImgproxySignature(keys, "90UxdwGRAI2bpLSHKkZculJau5ahfxfS0h3fMuQAf40", path+"?") {
+		t.Error("Unexpected valid signature of another path")
+	}
+	if validImgproxySignature(keys, "insecure", path) {
+		t.Error("Unexpected valid insecure signature")
+	}
+}
+
+func TestParseImgproxyPath(t *testing.T) {
+	cases := []struct {
+		path string
+		url  imgproxyURL
+	}{
+		{
+			"/insecure/rs:fill:300:400:0/g:sm/aHR0cDovL2V4YW1w/bGUuY29tL2ltYWdl/cy9jdXJpb3NpdHku/anBn.png",
+			imgproxyURL{"insecure", "/rs:fill:300:400:0/g:sm/aHR0cDovL2V4YW1w/bGUuY29tL2ltYWdl/cy9jdXJpb3NpdHku/anBn.png", []string{"rs:fill:300:400:0", "g:sm"}, "http://example.com/images/curiosity.jpg", "png"},
+		},
+		{
+			"/_/w:300/plain/http://example.com/cat.jpg@webp",
+			imgproxyURL{"_", "/w:300/plain/http://example.com/cat.jpg@webp", []string{"w:300"}, "http://example.com/cat.jpg", "webp"},
+		},
+		{
+			"/_/w:300/plain/https:/example.com/cat.jpg",
+			imgproxyURL{"_", "/w:300/plain/https://example.com/cat.jpg", []string{"w:300"}, "https://example.com/cat.jpg", ""},
+		},
+		{
+			"/_/plain/http%3A%2F%2Fuser@example.com%2Fcat.jpg",
+			imgproxyURL{"_", "/plain/http%3A%2F%2Fuser@example.com%2Fcat.jpg", nil, "http://user@example.com/cat.jpg", ""},
+		},
+		{
+			"/_/plain/local:/photos/cat.jpg",
+			imgproxyURL{"_", "/plain/local:///photos/cat.jpg", nil, "local:///photos/cat.jpg", ""},
+		},
+	}
+
+	for _, test := range cases {
+		u, err := parseImgproxyPath(test.path)
+		if err != nil || !reflect.DeepEqual(u, test.url) {
+			t.Errorf("Invalid path %s: %#v %v", test.path, u, err)
+		}
+	}
+
+	for _, path := range []string{"/insecure", "/insecure/w:300", "/_/enc/abc", "/_/w:300/!!"} {
+		if _, err := parseImgproxyPath(path); err == nil {
+			t.Errorf("Expected invalid path error of %s", path)
+		}
+	}
+}
+
+func TestTranslateImgproxy(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	cases := []struct {
+		options   []string
+		extension string
+		endpoint  string
+		params    map[string]string
+	}{
+		{[]string{"rs:fill:300:400:0", "g:sm"}, "png", "crop", map[string]string{"width": "300", "height": "400", "gravity": "smart", "type": "png"}},
+		{[]string{"rs:fit:300:400"}, "", "fit", map[string]string{"width": "300", "height": "400"}},
+		{[]string{"w:300", "dpr:2", "q:80"}, "jpg", "resize", map[string]string{"width": "600", "quality": "80", "type": "jpeg"}},
+		{[]string{"s:300:300:0:1", "bg:255:0:0"}, "", "resize", map[string]string{"width": "300", "height": "300", "embed": "true", "nocrop": "true", "extend": "background", "background": "255,0,0"}},
+		{[]string{"rt:force", "w:100", "h:50", "sm:1", "ar:0"}, "", "resize", map[string]string{"width": "100", "height": "50", "force": "true", "stripmeta": "true", "norotation": "true"}},
+		{[]string{"rs:fill:300:300:1"}, "", "enlarge", map[string]string{"width": "300", "height": "300"}},
+		{[]string{"rot:270"}, "", "rotate", map[string]string{"rotate": "270"}},
+		{[]string{"f:webp", "cb:123", "exp:1600000000"}, "", "convert", map[string]string{"type": "webp"}},
+		{[]string{}, "", "noop", map[string]string{}},
+	}
+
+	for _, test := range cases {
+		endpoint, query, err := translateImgproxy(test.options, test.extension, now)
+		if err != nil {
+			t.Errorf("Cannot translate %s: %s", test.options, err)
+			continue
+		}
+		params := map[string]string{}
+		for key := range query {
+			params[key] = query.Get(key)
+		}
+		if endpoint != test.endpoint || !reflect.DeepEqual(params, test.params) {
+			t.Errorf("Invalid translation of %s: %s %#v", test.options, endpoint, params)
+		}
+	}
+
+	endpoint, query, err := translateImgproxy([]string{"c:500:500:ce", "rs:fit:300:300", "bl:2", "fl:1:0"}, "webp", now)
+	if err != nil || endpoint != "pipeline" {
+		t.Fatalf("Invalid pipeline translation: %s %v", endpoint, err)
+	}
+	operations := parseJSONOperations(query.Get("operations"))
+	names := []string{}
+	for _, operation := range operations {
+		names = append(names, operation.Name)
+		if operation.Params["type"] != "webp" {
+			t.Errorf("Missing type param of the %s operation", operation.Name)
+		}
+	}
+	if !reflect.DeepEqual(names, []string{"crop", "fit", "blur", "flop"}) {
+		t.Errorf("Invalid pipeline operations: %#v", names)
+	}
+}
+
+func TestTranslateImgproxyErrors(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	cases := [][]string{
+		{"rs:fill-up:100:100"},
+		{"w:abc"},
+		{"g:fp:0.5:0.5"},
+		{"q:101"},
+		{"rot:45"},
+		{"sh:0.5"},
+		{"exp:1400000000"},
+		{"bg:zz"},
+	}
+	for _, options := range cases {
+		if _, _, err := translateImgproxy(options, "", now); err == nil {
+			t.Errorf("Expected translation error of %s", options)
+		}
+	}
+}
+
+func TestImgproxyQueryParams(t *testing.T) {
+	keys, _ := parseImgproxyKeys("0a0b", "0c0d")
+	o := ServerOptions{Imgproxy: true, ImgproxyKeys: keys, Mount: "testdata"}
+	LoadSources(o)
+
+	path := "/rs:fit:300:0/" + base64.RawURLEncoding.EncodeToString([]byte("local:///large.jpg"))
+	mac := hmac.New(sha256.New, keys[0].Key)
+	mac.Write(keys[0].Salt)
+	mac.Write([]byte(path))
+	signature := base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+
+	w := httptest.NewRecorder()
+	NewServerMux(o).ServeHTTP(w, httptest.NewRequest("GET", "/"+signature+path+"?type=png", nil))
+	if w.Code != 200 || w.Header().Get("Content-Type") != "image/jpeg" {
+		t.Errorf("The unsigned query params should not be processed: %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+}
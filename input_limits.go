@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// InputLimits represents the per input format guards against image bombs,
+// checked before the image is decoded by libvips. Zero means no limit.
+type InputLimits struct {
+	MaxGIFFrames   int
+	MaxPDFPages    int
+	MaxTIFFPages   int
+	MaxSVGElements int
+	MaxSVGSize     int
+
+	// MaxLegacyPixels limits the BMP, PCX and TGA images decoded in pure Go,
+	// checked by the decoders before allocating the image.
+	MaxLegacyPixels int
+}
+
+// maxTIFFDirectories limits the IFD chain traversal of malformed TIFF images
+const maxTIFFDirectories = 65536
+
+var (
+	pdfPageRegexp  = regexp.MustCompile(`/Type\s*/Page\b[^s]`)
+	pdfCountRegexp = regexp.MustCompile(`/Count\s+(\d+)`)
+)
+
+// Check validates the given image buffer against the limits of its format.
+func (l InputLimits) Check(buf []byte) error {
+	if l == (InputLimits{}) {
+		return nil
+	}
+
+	switch bimg.DetermineImageType(buf) {
+	case bimg.GIF:
+		return checkLimit("GIF frames", buf, countGIFFrames, l.MaxGIFFrames)
+	case bimg.PDF:
+		return checkLimit("PDF pages", buf, countPDFPages, l.MaxPDFPages)
+	case bimg.TIFF:
+		return checkLimit("TIFF directories", buf, countTIFFDirectories, l.MaxTIFFPages)
+	case bimg.SVG:
+		if err := checkLimit("SVG size in bytes", buf, func(b []byte) int { return len(b) }, l.MaxSVGSize); err != nil {
+			return err
+		}
+		return checkLimit("SVG elements", buf, countSVGElements, l.MaxSVGElements)
+	}
+	return nil
+}
+
+func checkLimit(name string, buf []byte, count func([]byte) int, max int) error {
+	if max <= 0 {
+		return nil
+	}
+	if value := count(buf); value > max {
+		return NewError(fmt.Sprintf("Image exceeds the maximum allowed %s: %d > %d", name, value, max), TooLarge)
+	}
+	return nil
+}
+
+// countGIFFrames counts the image descriptors walking the GIF blocks,
+// skipping the extensions and image data sub-blocks without decoding them.
+func countGIFFrames(buf []byte) int {
+	if len(buf) < 13 {
+		return 0
+	}
+
+	// Skip header, logical screen descriptor and global color table
+	pos := 13
+	if buf[10]&0x80 != 0 {
+		pos += 3 << (uint(buf[10]&0x07) + 1)
+	}
+
+	frames := 0
+	for pos < len(buf) {
+		switch buf[pos] {
+		case 0x21: // Extension
+			pos = skipGIFSubBlocks(buf, pos+2)
+		case 0x2C: // Image descriptor
+			frames++
+			if pos+10 > len(buf) {
+				return frames
+			}
+			flags := buf[pos+9]
+			pos += 10
+			if flags&0x80 != 0 {
+				pos += 3 << (uint(flags&0x07) + 1)
+			}
+			// Skip LZW minimum code size and image data
+			pos = skipGIFSubBlocks(buf, pos+1)
+		default: // Trailer or malformed data
+			return frames
+		}
+	}
+	return frames
+}
+
+func skipGIFSubBlocks(buf []byte, pos int) int {
+	for pos < len(buf) {
+		size := int(buf[pos])
+		pos++
+		if size == 0 {
+			break
+		}
+		pos += size
+	}
+	return pos
+}
+
+// countPDFPages returns the greatest of the page objects count and the
+// page tree counts, since page objects can be hidden in compressed streams.
+func countPDFPages(buf []byte) int {
+	pages := len(pdfPageRegexp.FindAllIndex(buf, -1))
+	for _, match := range pdfCountRegexp.FindAllSubmatch(buf, -1) {
+		if count, err := strconv.Atoi(string(match[1])); err == nil && count > pages {
+			pages = count
+		}
+	}
+	return pages
+}
+
+// countTIFFDirectories walks the TIFF image file directories (IFD) chain.
+func countTIFFDirectories(buf []byte) int {
+	if len(buf) < 8 {
+		return 0
+	}
+
+	var order binary.ByteOrder = binary.LittleEndian
+	if buf[0] == 'M' {
+		order = binary.BigEndian
+	}
+
+	count := 0
+	visited := map[uint32]bool{}
+	offset := order.Uint32(buf[4:8])
+	for offset != 0 && !visited[offset] && count < maxTIFFDirectories {
+		visited[offset] = true
+		pos := int(offset)
+		if pos+2 > len(buf) {
+			break
+		}
+		count++
+
+		next := pos + 2 + int(order.Uint16(buf[pos:pos+2]))*12
+		if next+4 > len(buf) {
+			break
+		}
+		offset = order.Uint32(buf[next : next+4])
+	}
+	return count
+}
+
+// countSVGElements counts the opening XML element tags.
+func countSVGElements(buf []byte) int {
+	count := 0
+	for i := bytes.IndexByte(buf, '<'); i != -1 && i+1 < len(buf); {
+		if c := buf[i+1]; (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') {
+			count++
+		}
+		j := bytes.IndexByte(buf[i+1:], '<')
+		if j == -1 {
+			break
+		}
+		i += j + 1
+	}
+	return count
+}
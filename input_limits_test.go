@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color/palette"
+	"image/gif"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestInputLimits(t *testing.T) {
+	animated := &bytes.Buffer{}
+	frames := &gif.GIF{}
+	for i := 0; i < 3; i++ {
+		frames.Image = append(frames.Image, image.NewPaletted(image.Rect(0, 0, 10, 10), palette.Plan9))
+		frames.Delay = append(frames.Delay, 10)
+	}
+	if err := gif.EncodeAll(animated, frames); err != nil {
+		t.Fatal(err)
+	}
+
+	pdf := []byte("%PDF-1.4\n1 0 obj << /Type /Pages /Kids [2 0 R 3 0 R] /Count 2 >> endobj\n" +
+		"2 0 obj << /Type /Page /Parent 1 0 R >> endobj\n3 0 obj << /Type /Page /Parent 1 0 R >> endobj\n%%EOF")
+
+	// Little endian TIFF with two chained empty directories
+	tiff := []byte{'I', 'I', 42, 0, 8, 0, 0, 0, 0, 0, 14, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+
+	jpeg, _ := ioutil.ReadAll(readFile("large.jpg"))
+
+	svg := []byte(`<?xml version="1.0"?><svg xmlns="http://www.w3.org/2000/svg"><rect/><circle/><!-- comment --></svg>`)
+
+	cases := []struct {
+		name    string
+		buf     []byte
+		limits  InputLimits
+		allowed bool
+	}{
+		{"gif", animated.Bytes(), InputLimits{MaxGIFFrames: 3}, true},
+		{"gif", animated.Bytes(), InputLimits{MaxGIFFrames: 2}, false},
+		{"pdf", pdf, InputLimits{MaxPDFPages: 2}, true},
+		{"pdf", pdf, InputLimits{MaxPDFPages: 1}, false},
+		{"tiff", tiff, InputLimits{MaxTIFFPages: 2}, true},
+		{"tiff", tiff, InputLimits{MaxTIFFPages: 1}, false},
+		{"svg", svg, InputLimits{MaxSVGElements: 3}, true},
+		{"svg", svg, InputLimits{MaxSVGElements: 2}, false},
+		{"svg", svg, InputLimits{MaxSVGSize: 10}, false},
+		{"jpeg", jpeg, InputLimits{MaxGIFFrames: 1, MaxPDFPages: 1}, true},
+	}
+
+	for _, test := range cases {
+		err := test.limits.Check(test.buf)
+		if test.allowed && err != nil {
+			t.Errorf("Unexpected %s input limit error: %s", test.name, err)
+		}
+		if !test.allowed {
+			if err == nil {
+				t.Errorf("Expected %s input limit error with limits %#v", test.name, test.limits)
+			} else if code := err.(Error).HTTPCode(); code != 413 {
+				t.Errorf("Invalid %s input limit error status: %d", test.name, code)
+			}
+		}
+	}
+}
+
+func TestInputLimitsCounters(t *testing.T) {
+	if n := countSVGElements([]byte(strings.Repeat("<g>", 100))); n != 100 {
+		t.Errorf("Invalid SVG elements count: %d", n)
+	}
+	if n := countTIFFDirectories([]byte{'M', 'M', 0, 42, 0, 0, 0, 8, 0, 0, 0, 0, 0, 8}); n != 1 {
+		t.Errorf("Invalid circular TIFF directories count: %d", n)
+	}
+	if n := countGIFFrames([]byte("GIF89a")); n != 0 {
+		t.Errorf("Invalid truncated GIF frames count: %d", n)
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// Job completion event statuses
+const (
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+)
+
+// Job represents an asynchronous processing job: the source image, the pipeline operations
+// applied to it, the destination storing the output image and the optional callback URL
+// notified of the job completion event.
+type Job struct {
+	ID          string             `json:"id"`
+	Source      JobSource          `json:"source"`
+	Operations  PipelineOperations `json:"operations"`
+	Destination JobDestination     `json:"destination"`
+	Callback    string             `json:"callback"`
+}
+
+// JobSource represents the job source image URL or S3 object
+type JobSource struct {
+	URL    string `json:"url,omitempty"`
+	Bucket string `json:"bucket,omitempty"`
+	Key    string `json:"key,omitempty"`
+	Region string `json:"region,omitempty"`
+}
+
+// JobDestination represents the job output image URL, such as an S3 presigned URL, or S3 object
+type JobDestination struct {
+	URL          string `json:"url,omitempty"`
+	Bucket       string `json:"bucket,omitempty"`
+	Key          string `json:"key,omitempty"`
+	Region       string `json:"region,omitempty"`
+	CacheControl string `json:"cacheControl,omitempty"`
+}
+
+// JobEvent represents the job completion event, published by the broker and sent to the job
+// callback. Failed jobs to be retried by the broker are published on every failed attempt.
+type JobEvent struct {
+	ID          string          `json:"id"`
+	Status      string          `json:"status"`
+	Destination *JobDestination `json:"destination,omitempty"`
+	Mime        string          `json:"mime,omitempty"`
+	Size        int             `json:"size,omitempty"`
+	Error       string          `json:"error,omitempty"`
+	Retry       bool            `json:"retry,omitempty"`
+}
+
+// JobsOptions represents the job queue mode configuration file, defining the NATS JetStream
+// consumer or Kafka topic of the jobs and the S3 credentials of the job buckets, if any.
+// The source image URLs are restricted as the worker ones.
+type JobsOptions struct {
+	NATS           *NATSOptions   `json:"nats"`
+	Kafka          *KafkaOptions  `json:"kafka"`
+	Concurrency    int            `json:"concurrency"`
+	S3Endpoint     string         `json:"s3Endpoint"`
+	AWS            *AWSCredential `json:"aws"`
+	AllowedOrigins []*url.URL     `json:"-"`
+	MaxAllowedSize int            `json:"-"`
+}
+
+// jobMessage represents a received job message, identified by its broker specific fields
+type jobMessage struct {
+	Data      []byte
+	Reply     string
+	Topic     string
+	Partition int
+	Offset    int64
+}
+
+// jobBroker receives the job messages and publishes the job completion events
+type jobBroker interface {
+	// Receive waits for the next job messages, at most the given number of them if supported
+	Receive(max int) ([]jobMessage, error)
+	// Settle acknowledges the given processed messages, requesting the redelivery of the
+	// messages of the given indexes to retry.
+	Settle(messages []jobMessage, retry map[int]bool) error
+	// Publish publishes the given job completion event
+	Publish(event JobEvent) error
+}
+
+var jobCallbackClient = &http.Client{Timeout: 10 * time.Second}
+
+// LoadJobsOptions loads the job queue mode configuration JSON file
+func LoadJobsOptions(path string) (JobsOptions, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return JobsOptions{}, err
+	}
+	return parseJobsOptions(buf)
+}
+
+// parseJobsOptions parses and validates the job queue mode configuration, filling its defaults
+func parseJobsOptions(buf []byte) (JobsOptions, error) {
+	var o JobsOptions
+	if err := json.Unmarshal(buf, &o); err != nil {
+		return o, err
+	}
+
+	if (o.NATS == nil) == (o.Kafka == nil) {
+		return o, fmt.Errorf("must define either nats or kafka broker")
+	}
+	if o.NATS != nil {
+		if err := o.NATS.load(); err != nil {
+			return o, fmt.Errorf("nats: %s", err)
+		}
+	}
+	if o.Kafka != nil {
+		if err := o.Kafka.load(); err != nil {
+			return o, fmt.Errorf("kafka: %s", err)
+		}
+	}
+	if o.Concurrency <= 0 {
+		o.Concurrency = 1
+	}
+	if o.AWS != nil {
+		if err := o.AWS.load(); err != nil {
+			return o, fmt.Errorf("aws credentials: %s", err)
+		}
+	}
+	return o, nil
+}
+
+// RunJobs consumes the broker job messages forever, processing up to the configured
+// concurrency of jobs at once.
+func RunJobs(o JobsOptions) {
+	var broker jobBroker
+	if o.NATS != nil {
+		broker = &natsBroker{Options: *o.NATS}
+	} else {
+		broker = &kafkaBroker{Options: *o.Kafka}
+	}
+
+	debug("imaginary consuming processing jobs")
+	for {
+		messages, err := broker.Receive(o.Concurrency)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cannot receive the jobs: %s\n", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		if len(messages) == 0 {
+			continue
+		}
+
+		var (
+			wg    sync.WaitGroup
+			mutex sync.Mutex
+		)
+		retry := map[int]bool{}
+		slots := make(chan struct{}, o.Concurrency)
+		for i, message := range messages {
+			wg.Add(1)
+			slots <- struct{}{}
+			go func(i int, message jobMessage) {
+				defer func() { <-slots; wg.Done() }()
+				event := processJob(o, message.Data)
+				if event.Retry {
+					mutex.Lock()
+					retry[i] = true
+					mutex.Unlock()
+				}
+				if err := broker.Publish(event); err != nil {
+					fmt.Fprintf(os.Stderr, "cannot publish the job %s event: %s\n", event.ID, err)
+				}
+			}(i, message)
+		}
+		wg.Wait()
+
+		if err := broker.Settle(messages, retry); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot acknowledge the jobs: %s\n", err)
+		}
+	}
+}
+
+// processJob runs the given job message, returning its completion event. Source and
+// destination errors are retried, while invalid jobs or images fail permanently.
+func processJob(o JobsOptions, data []byte) JobEvent {
+	var job Job
+	if err := json.Unmarshal(data, &job); err != nil {
+		return JobEvent{Status: JobFailed, Error: "invalid job: " + err.Error()}
+	}
+
+	event := runJob(o, job)
+	if job.Callback != "" {
+		if err := sendJobCallback(job.Callback, event); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot send the job %s callback: %s\n", job.ID, err)
+		}
+	}
+	if event.Status == JobFailed {
+		debug("job %s failed: %s", job.ID, event.Error)
+	}
+	return event
+}
+
+// runJob validates, processes and stores the given job output image
+func runJob(o JobsOptions, job Job) (event JobEvent) {
+	failed := func(err error, retry bool) JobEvent {
+		return JobEvent{ID: job.ID, Status: JobFailed, Error: err.Error(), Retry: retry}
+	}
+
+	// A malformed job or image must not crash the processor, only fail the job permanently
+	defer func() {
+		if rec := recover(); rec != nil {
+			event = failed(fmt.Errorf("Error while processing the image: %v", rec), false)
+		}
+	}()
+
+	if err := validateJob(job); err != nil {
+		return failed(err, false)
+	}
+
+	source := workerObject{URL: job.Source.URL, Bucket: job.Source.Bucket, Key: job.Source.Key, Region: job.Source.Region}
+	buf, err := fetchObject(o.S3Endpoint, o.AWS, source, o.AllowedOrigins, o.MaxAllowedSize)
+	if err != nil {
+		return failed(err, true)
+	}
+
+	image, err := Pipeline(buf, ImageOptions{Operations: job.Operations})
+	if err != nil {
+		return failed(fmt.Errorf("Error while processing the image: %s", err), false)
+	}
+
+	destination := job.Destination
+	if destination.URL != "" {
+		err = putObject(destination.URL, nil, image, destination.CacheControl)
+	} else if o.AWS == nil {
+		err = fmt.Errorf("missing AWS credentials of the %s bucket", destination.Bucket)
+	} else {
+		if destination.Region == "" {
+			destination.Region = o.AWS.Region
+		}
+		credential := awsService(o.AWS, "s3", destination.Region)
+		err = putObject(s3URL(o.S3Endpoint, destination.Bucket, destination.Region, destination.Key).String(), &credential, image, destination.CacheControl)
+	}
+	if err != nil {
+		return failed(err, true)
+	}
+
+	// Presigned destination URLs are not exposed in the events
+	destination.URL = ""
+	event = JobEvent{ID: job.ID, Status: JobSucceeded, Mime: image.Mime, Size: len(image.Body)}
+	if destination.Bucket != "" {
+		event.Destination = &destination
+	}
+	return event
+}
+
+// validateJob validates the job source, operations and destination
+func validateJob(job Job) error {
+	if job.Source.URL == "" && (job.Source.Bucket == "" || job.Source.Key == "") {
+		return fmt.Errorf("missing job source url, or bucket and key")
+	}
+	if job.Destination.URL == "" && (job.Destination.Bucket == "" || job.Destination.Key == "") {
+		return fmt.Errorf("missing job destination url, or bucket and key")
+	}
+	if len(job.Operations) == 0 {
+		return fmt.Errorf("missing job operations")
+	}
+	for _, operation := range job.Operations {
+		if _, exists := OperationsMap[operation.Name]; !exists {
+			return fmt.Errorf("unsupported operation name: %s", operation.Name)
+		}
+		if err := validateMapParams(operation.Params); err != nil {
+			return fmt.Errorf("%s operation: %s", operation.Name, err)
+		}
+	}
+	return nil
+}
+
+// sendJobCallback posts the given job completion event to the given callback URL
+func sendJobCallback(callback string, event JobEvent) error {
+	body, _ := json.Marshal(event)
+	req, err := http.NewRequest("POST", callback, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "imaginary/"+Version)
+
+	res, err := jobCallbackClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("(status=%d)", res.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Kafka REST Proxy v2 API content types
+const (
+	kafkaContentType = "application/vnd.kafka.v2+json"
+	kafkaJSONType    = "application/vnd.kafka.json.v2+json"
+	kafkaFetchWait   = 10 * time.Second
+)
+
+var kafkaClient = &http.Client{Timeout: kafkaFetchWait + 30*time.Second}
+
+// KafkaOptions represents the Kafka REST Proxy consumer group of the jobs topic
+// and the topic of the job completion events, if any.
+type KafkaOptions struct {
+	RESTProxy string `json:"restProxy"`
+	Group     string `json:"group"`
+	Topic     string `json:"topic"`
+	Events    string `json:"events"`
+}
+
+// load validates the Kafka options, defaulting the consumer group
+func (o *KafkaOptions) load() error {
+	if u, err := url.Parse(o.RESTProxy); err != nil || u.Host == "" {
+		return fmt.Errorf("invalid REST proxy URL: %s", o.RESTProxy)
+	}
+	if o.Topic == "" {
+		return fmt.Errorf("missing jobs topic")
+	}
+	if o.Group == "" {
+		o.Group = "imaginary"
+	}
+	o.RESTProxy = strings.TrimSuffix(o.RESTProxy, "/")
+	return nil
+}
+
+// kafkaRecord represents a fetched Kafka record of JSON value
+type kafkaRecord struct {
+	Topic     string          `json:"topic"`
+	Value     json.RawMessage `json:"value"`
+	Partition int             `json:"partition"`
+	Offset    int64           `json:"offset"`
+}
+
+// kafkaBroker consumes the jobs topic via the Kafka REST Proxy, committing the offsets of the
+// processed jobs. Partitions of jobs to retry are rewound to the first job to retry, so its
+// records are fetched again, since Kafka has no per record redelivery.
+type kafkaBroker struct {
+	Options KafkaOptions
+
+	baseURI string
+}
+
+// subscribe creates the consumer group instance, subscribing it to the jobs topic
+func (b *kafkaBroker) subscribe() error {
+	id := make([]byte, 8)
+	rand.Read(id)
+	var instance struct {
+		BaseURI string `json:"base_uri"`
+	}
+	err := b.call("POST", b.Options.RESTProxy+"/consumers/"+url.QueryEscape(b.Options.Group), map[string]string{
+		"name":               "imaginary-" + hex.EncodeToString(id),
+		"format":             "json",
+		"auto.offset.reset":  "earliest",
+		"auto.commit.enable": "false",
+	}, &instance)
+	if err != nil {
+		return err
+	}
+	if err := b.call("POST", instance.BaseURI+"/subscription", map[string][]string{"topics": {b.Options.Topic}}, nil); err != nil {
+		return err
+	}
+	b.baseURI = instance.BaseURI
+	return nil
+}
+
+// Receive fetches the next job records. The REST proxy has no record count limit.
+func (b *kafkaBroker) Receive(max int) ([]jobMessage, error) {
+	if b.baseURI == "" {
+		if err := b.subscribe(); err != nil {
+			return nil, err
+		}
+	}
+
+	var records []kafkaRecord
+	rawurl := fmt.Sprintf("%s/records?timeout=%d", b.baseURI, kafkaFetchWait/time.Millisecond)
+	if err := b.call("GET", rawurl, nil, &records); err != nil {
+		return nil, err
+	}
+
+	messages := make([]jobMessage, len(records))
+	for i, record := range records {
+		messages[i] = jobMessage{Data: record.Value, Topic: record.Topic, Partition: record.Partition, Offset: record.Offset}
+	}
+	return messages, nil
+}
+
+// Settle rewinds the partitions of the jobs to retry to the first of them, committing
+// the offsets of the processed jobs. The offsets are committed explicitly, since committing
+// without offsets commits every fetched record, including the ones to retry.
+func (b *kafkaBroker) Settle(messages []jobMessage, retry map[int]bool) error {
+	type partitionOffset struct {
+		Topic     string `json:"topic"`
+		Partition int    `json:"partition"`
+		Offset    int64  `json:"offset"`
+	}
+	rewinds := map[string]partitionOffset{}
+	commits := map[string]partitionOffset{}
+	for i, message := range messages {
+		key := fmt.Sprintf("%s/%d", message.Topic, message.Partition)
+		if retry[i] {
+			if rewind, ok := rewinds[key]; !ok || message.Offset < rewind.Offset {
+				rewinds[key] = partitionOffset{message.Topic, message.Partition, message.Offset}
+			}
+		} else if commit, ok := commits[key]; !ok || message.Offset+1 > commit.Offset {
+			commits[key] = partitionOffset{message.Topic, message.Partition, message.Offset + 1}
+		}
+	}
+
+	// Partitions of jobs to retry are committed up to the first of them
+	for key, rewind := range rewinds {
+		commits[key] = rewind
+	}
+	sortedOffsets := func(partitions map[string]partitionOffset) []partitionOffset {
+		offsets := []partitionOffset{}
+		for _, offset := range partitions {
+			offsets = append(offsets, offset)
+		}
+		sort.Slice(offsets, func(i, j int) bool {
+			if offsets[i].Topic != offsets[j].Topic {
+				return offsets[i].Topic < offsets[j].Topic
+			}
+			return offsets[i].Partition < offsets[j].Partition
+		})
+		return offsets
+	}
+
+	if len(rewinds) > 0 {
+		if err := b.call("POST", b.baseURI+"/positions", map[string][]partitionOffset{"offsets": sortedOffsets(rewinds)}, nil); err != nil {
+			return err
+		}
+	}
+	if len(commits) == 0 {
+		return nil
+	}
+	return b.call("POST", b.baseURI+"/offsets", map[string][]partitionOffset{"offsets": sortedOffsets(commits)}, nil)
+}
+
+// Publish produces the job completion event to the events topic, if defined, keyed by job id
+func (b *kafkaBroker) Publish(event JobEvent) error {
+	if b.Options.Events == "" {
+		return nil
+	}
+	records := map[string][]map[string]interface{}{"records": {{"key": event.ID, "value": event}}}
+	req, err := b.request("POST", b.Options.RESTProxy+"/topics/"+url.QueryEscape(b.Options.Events), records)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", kafkaJSONType)
+	return b.do(req, nil)
+}
+
+// call sends the given REST proxy API request, decoding its JSON response
+func (b *kafkaBroker) call(method, rawurl string, params interface{}, response interface{}) error {
+	req, err := b.request(method, rawurl, params)
+	if err != nil {
+		return err
+	}
+	return b.do(req, response)
+}
+
+// request creates the given REST proxy API request of the given JSON body, if any
+func (b *kafkaBroker) request(method, rawurl string, params interface{}) (*http.Request, error) {
+	var body []byte
+	if params != nil {
+		body, _ = json.Marshal(params)
+	}
+	req, err := http.NewRequest(method, rawurl, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", kafkaContentType)
+	req.Header.Set("Accept", kafkaJSONType+", "+kafkaContentType)
+	req.Header.Set("User-Agent", "imaginary/"+Version)
+	return req, nil
+}
+
+// do sends the given REST proxy API request, subscribing again if the consumer instance expired
+func (b *kafkaBroker) do(req *http.Request, response interface{}) error {
+	res, err := kafkaClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound && b.baseURI != "" && strings.HasPrefix(req.URL.String(), b.baseURI) {
+		b.baseURI = ""
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		buf, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("Kafka REST proxy error: (status=%d) %s", res.StatusCode, bytes.TrimSpace(buf))
+	}
+	if response == nil || res.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(response)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestKafkaBroker(t *testing.T) {
+	var (
+		subscribed bool
+		positions  map[string][]map[string]interface{}
+		committed  map[string][]map[string]interface{}
+		produced   map[string][]map[string]interface{}
+	)
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != kafkaContentType && r.Header.Get("Content-Type") != kafkaJSONType {
+			t.Errorf("Invalid content type: %s", r.Header.Get("Content-Type"))
+		}
+		base := "/consumers/group/instances/imaginary"
+		switch r.Method + " " + r.URL.Path {
+		case "POST /consumers/group":
+			json.NewEncoder(w).Encode(map[string]string{"instance_id": "imaginary", "base_uri": ts.URL + base})
+		case "POST " + base + "/subscription":
+			subscribed = true
+			w.WriteHeader(http.StatusNoContent)
+		case "GET " + base + "/records":
+			w.Write([]byte(`[
+				{"topic": "jobs", "partition": 0, "offset": 7, "value": {"id": "a"}},
+				{"topic": "jobs", "partition": 0, "offset": 8, "value": {"id": "b"}},
+				{"topic": "jobs", "partition": 1, "offset": 3, "value": {"id": "c"}}
+			]`))
+		case "POST " + base + "/positions":
+			json.NewDecoder(r.Body).Decode(&positions)
+			w.WriteHeader(http.StatusNoContent)
+		case "POST " + base + "/offsets":
+			json.NewDecoder(r.Body).Decode(&committed)
+			w.WriteHeader(http.StatusNoContent)
+		case "POST /topics/events":
+			json.NewDecoder(r.Body).Decode(&produced)
+			w.Write([]byte(`{"offsets": [{"partition": 0, "offset": 1}]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	b := &kafkaBroker{Options: KafkaOptions{RESTProxy: ts.URL, Group: "group", Topic: "jobs", Events: "events"}}
+	messages, err := b.Receive(1)
+	if err != nil || !subscribed {
+		t.Fatalf("Cannot receive the messages: %s", err)
+	}
+	if len(messages) != 3 || string(messages[1].Data) != `{"id": "b"}` || messages[1].Offset != 8 {
+		t.Fatalf("Invalid messages: %#v", messages)
+	}
+
+	if err := b.Settle(messages, map[int]bool{1: true}); err != nil || committed == nil {
+		t.Fatalf("Cannot settle the messages: %s", err)
+	}
+	offsets := positions["offsets"]
+	if len(offsets) != 1 || offsets[0]["partition"].(float64) != 0 || offsets[0]["offset"].(float64) != 8 {
+		t.Errorf("Invalid rewound positions: %v", positions)
+	}
+
+	// The partition of the retried job is committed up to it, the other one past its last job
+	offsets = committed["offsets"]
+	if len(offsets) != 2 || offsets[0]["topic"] != "jobs" ||
+		offsets[0]["partition"].(float64) != 0 || offsets[0]["offset"].(float64) != 8 ||
+		offsets[1]["partition"].(float64) != 1 || offsets[1]["offset"].(float64) != 4 {
+		t.Errorf("Invalid committed offsets: %v", committed)
+	}
+
+	if err := b.Publish(JobEvent{ID: "a", Status: JobSucceeded}); err != nil {
+		t.Fatalf("Cannot publish the event: %s", err)
+	}
+	if records := produced["records"]; len(records) != 1 || records[0]["key"] != "a" {
+		t.Errorf("Invalid produced records: %v", produced)
+	}
+
+	// Expired consumer instances are subscribed again
+	b.baseURI = ts.URL + "/consumers/group/instances/expired"
+	if _, err := b.Receive(1); err == nil || b.baseURI != "" {
+		t.Errorf("Expected expired consumer instance error")
+	}
+}
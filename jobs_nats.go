@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NATS JetStream pull requests defaults
+const (
+	natsPullExpiry  = 30 * time.Second
+	natsDialTimeout = 10 * time.Second
+)
+
+// NATSOptions represents the NATS JetStream durable pull consumer of the jobs stream
+// and the subject of the job completion events, if any.
+type NATSOptions struct {
+	URL      string `json:"url"`
+	Token    string `json:"token"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+	Stream   string `json:"stream"`
+	Consumer string `json:"consumer"`
+	Events   string `json:"events"`
+}
+
+// load validates the NATS options, reading the credentials of the server URL, if any
+func (o *NATSOptions) load() error {
+	u, err := url.Parse(o.URL)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid server URL: %s", o.URL)
+	}
+	if u.User != nil && o.User == "" && o.Token == "" {
+		if password, ok := u.User.Password(); ok {
+			o.User, o.Password = u.User.Username(), password
+		} else {
+			o.Token = u.User.Username()
+		}
+	}
+	if o.Stream == "" || o.Consumer == "" {
+		return fmt.Errorf("missing JetStream stream or consumer")
+	}
+	return nil
+}
+
+// natsMsg represents a received NATS message. Status is the header status code of
+// the JetStream pull request status messages, such as 408 for expired requests.
+type natsMsg struct {
+	Subject string
+	Reply   string
+	Status  string
+	Data    []byte
+}
+
+// natsBroker consumes the jobs of a JetStream pull consumer via the NATS client protocol,
+// acknowledging the processed jobs and negatively acknowledging the ones to retry, which
+// are redelivered by JetStream according to the consumer max deliveries.
+type natsBroker struct {
+	Options NATSOptions
+
+	mutex sync.Mutex
+	conn  net.Conn
+	inbox string
+	msgs  chan natsMsg
+	errs  chan error
+	done  chan struct{}
+}
+
+// connect connects to the NATS server, subscribing to the pull requests inbox
+func (b *natsBroker) connect() error {
+	u, _ := url.Parse(b.Options.URL)
+	conn, err := net.DialTimeout("tcp", u.Host, natsDialTimeout)
+	if err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return fmt.Errorf("invalid NATS server greeting: %q", line)
+	}
+	var info struct {
+		TLSRequired bool `json:"tls_required"`
+	}
+	json.Unmarshal([]byte(strings.TrimPrefix(line, "INFO ")), &info)
+	if info.TLSRequired || u.Scheme == "tls" {
+		host, _, _ := net.SplitHostPort(u.Host)
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: host})
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return err
+		}
+		conn = tlsConn
+		reader = bufio.NewReader(conn)
+	}
+
+	options := map[string]interface{}{
+		"verbose":       false,
+		"pedantic":      false,
+		"name":          "imaginary",
+		"lang":          "go",
+		"version":       Version,
+		"protocol":      1,
+		"headers":       true,
+		"no_responders": true,
+	}
+	if b.Options.Token != "" {
+		options["auth_token"] = b.Options.Token
+	}
+	if b.Options.User != "" {
+		options["user"], options["pass"] = b.Options.User, b.Options.Password
+	}
+	connect, _ := json.Marshal(options)
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\nPING\r\n", connect); err != nil {
+		conn.Close()
+		return err
+	}
+	// Skip the asynchronous INFO updates until the PONG or -ERR reply
+	for line = "INFO"; strings.HasPrefix(line, "INFO") || line == "+OK"; line = strings.TrimSpace(line) {
+		if line, err = reader.ReadString('\n'); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	if line != "PONG" {
+		conn.Close()
+		return fmt.Errorf("cannot connect to the NATS server: %s", line)
+	}
+
+	id := make([]byte, 8)
+	rand.Read(id)
+	b.inbox = "_INBOX." + hex.EncodeToString(id)
+	if _, err := fmt.Fprintf(conn, "SUB %s 1\r\n", b.inbox); err != nil {
+		conn.Close()
+		return err
+	}
+
+	b.conn = conn
+	b.msgs = make(chan natsMsg)
+	b.errs = make(chan error, 1)
+	b.done = make(chan struct{})
+	go b.read(conn, reader, b.msgs, b.errs, b.done)
+	return nil
+}
+
+// read reads the server messages, answering the server pings, until the connection is closed
+func (b *natsBroker) read(conn net.Conn, reader *bufio.Reader, msgs chan natsMsg, errs chan error, done chan struct{}) {
+	for {
+		msg, err := b.readMsg(conn, reader)
+		if err != nil {
+			errs <- err
+			return
+		}
+		if msg == nil {
+			continue
+		}
+		select {
+		case msgs <- *msg:
+		case <-done:
+			return
+		}
+	}
+}
+
+// readMsg reads the next server operation, returning the MSG and HMSG messages
+func (b *natsBroker) readMsg(conn net.Conn, reader *bufio.Reader) (*natsMsg, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		return nil, nil
+	}
+
+	op := strings.ToUpper(args[0])
+	switch op {
+	case "PING":
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		_, err := io.WriteString(conn, "PONG\r\n")
+		return nil, err
+	case "-ERR":
+		return nil, fmt.Errorf("NATS server error: %s", strings.TrimSpace(strings.TrimPrefix(line, args[0])))
+	case "MSG", "HMSG":
+	default:
+		return nil, nil
+	}
+
+	// MSG <subject> <sid> [reply-to] <#bytes> and HMSG <subject> <sid> [reply-to] <#header bytes> <#total bytes>
+	headers := op == "HMSG"
+	sizes := 1
+	if headers {
+		sizes = 2
+	}
+	if len(args) < 3+sizes || len(args) > 4+sizes {
+		return nil, fmt.Errorf("invalid NATS message: %q", line)
+	}
+	msg := &natsMsg{Subject: args[1]}
+	if len(args) == 4+sizes {
+		msg.Reply = args[3]
+	}
+	total, err := strconv.Atoi(args[len(args)-1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid NATS message: %q", line)
+	}
+	headerSize := 0
+	if headers {
+		if headerSize, err = strconv.Atoi(args[len(args)-2]); err != nil || headerSize > total {
+			return nil, fmt.Errorf("invalid NATS message: %q", line)
+		}
+	}
+
+	payload := make([]byte, total+2)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+	msg.Data = payload[headerSize:total]
+
+	// Status header line: NATS/1.0 <status> <description>
+	if headers {
+		status := strings.Fields(strings.SplitN(string(payload[:headerSize]), "\r\n", 2)[0])
+		if len(status) > 1 {
+			msg.Status = status[1]
+		}
+	}
+	return msg, nil
+}
+
+// publish publishes the given message to the given subject
+func (b *natsBroker) publish(subject, reply string, data []byte) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if reply != "" {
+		reply += " "
+	}
+	if _, err := fmt.Fprintf(b.conn, "PUB %s %s%d\r\n", subject, reply, len(data)); err != nil {
+		return err
+	}
+	_, err := b.conn.Write(append(data, '\r', '\n'))
+	return err
+}
+
+// close closes the broken server connection, reconnecting on the next pull request
+func (b *natsBroker) close() {
+	close(b.done)
+	b.conn.Close()
+	b.conn = nil
+}
+
+// Receive pulls the next batch of up to the given number of job messages from the consumer
+func (b *natsBroker) Receive(max int) ([]jobMessage, error) {
+	if b.conn == nil {
+		if err := b.connect(); err != nil {
+			return nil, err
+		}
+	}
+
+	pull, _ := json.Marshal(map[string]int64{"batch": int64(max), "expires": int64(natsPullExpiry)})
+	if err := b.publish("$JS.API.CONSUMER.MSG.NEXT."+b.Options.Stream+"."+b.Options.Consumer, b.inbox, pull); err != nil {
+		b.close()
+		return nil, err
+	}
+
+	messages := []jobMessage{}
+	timeout := time.After(natsPullExpiry + natsDialTimeout)
+	for len(messages) < max {
+		select {
+		case msg := <-b.msgs:
+			switch msg.Status {
+			case "":
+				messages = append(messages, jobMessage{Data: msg.Data, Reply: msg.Reply})
+			case "100":
+				// Idle heartbeat
+			case "404", "408":
+				return messages, nil
+			default:
+				return messages, fmt.Errorf("JetStream pull request error: status %s", msg.Status)
+			}
+		case err := <-b.errs:
+			b.close()
+			return messages, err
+		case <-timeout:
+			return messages, nil
+		}
+	}
+	return messages, nil
+}
+
+// Settle acknowledges the processed job messages, negatively acknowledging the ones to retry
+func (b *natsBroker) Settle(messages []jobMessage, retry map[int]bool) error {
+	if b.conn == nil {
+		return fmt.Errorf("NATS connection closed")
+	}
+	for i, message := range messages {
+		ack := "+ACK"
+		if retry[i] {
+			ack = "-NAK"
+		}
+		if err := b.publish(message.Reply, "", []byte(ack)); err != nil {
+			b.close()
+			return err
+		}
+	}
+	return nil
+}
+
+// Publish publishes the job completion event to the events subject, if defined
+func (b *natsBroker) Publish(event JobEvent) error {
+	if b.Options.Events == "" || b.conn == nil {
+		return nil
+	}
+	data, _ := json.Marshal(event)
+	return b.publish(b.Options.Events, "", data)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseJobsOptions(t *testing.T) {
+	o, err := parseJobsOptions([]byte(`{"nats": {"url": "nats://token@localhost:4222", "stream": "JOBS", "consumer": "imaginary"}}`))
+	if err != nil {
+		t.Fatalf("Cannot parse the job queue options: %s", err)
+	}
+	if o.Concurrency != 1 || o.NATS.Token != "token" {
+		t.Errorf("Invalid job queue options: %#v", o.NATS)
+	}
+
+	o, err = parseJobsOptions([]byte(`{"kafka": {"restProxy": "http://localhost:8082/", "topic": "jobs"}, "concurrency": 4}`))
+	if err != nil {
+		t.Fatalf("Cannot parse the job queue options: %s", err)
+	}
+	if o.Concurrency != 4 || o.Kafka.Group != "imaginary" || o.Kafka.RESTProxy != "http://localhost:8082" {
+		t.Errorf("Invalid job queue options: %#v", o.Kafka)
+	}
+
+	invalid := []string{
+		`{}`,
+		`{"nats": {"url": "nats://localhost:4222", "stream": "JOBS", "consumer": "imaginary"}, "kafka": {"restProxy": "http://localhost:8082", "topic": "jobs"}}`,
+		`{"nats": {"url": "nats://localhost:4222"}}`,
+		`{"kafka": {"restProxy": "http://localhost:8082"}}`,
+		`{"kafka": {"restProxy": "http://localhost:8082", "topic": "jobs"}, "aws": {"accessKeyId": "AKID", "secretAccessKey": "secret"}}`,
+	}
+	for _, config := range invalid {
+		if _, err := parseJobsOptions([]byte(config)); err == nil {
+			t.Errorf("Expected error of %s", config)
+		}
+	}
+}
+
+func TestValidateJob(t *testing.T) {
+	operations := PipelineOperations{{Name: "resize", Params: map[string]interface{}{"width": 100}}}
+	valid := Job{Source: JobSource{URL: "http://localhost/cat.jpg"}, Operations: operations, Destination: JobDestination{Bucket: "images", Key: "cat.jpg"}}
+	if err := validateJob(valid); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+
+	invalid := []Job{
+		{Operations: operations, Destination: valid.Destination},
+		{Source: JobSource{Bucket: "images"}, Operations: operations, Destination: valid.Destination},
+		{Source: valid.Source, Operations: operations},
+		{Source: valid.Source, Destination: valid.Destination},
+		{Source: valid.Source, Operations: PipelineOperations{{Name: "unknown"}}, Destination: valid.Destination},
+		{Source: valid.Source, Operations: PipelineOperations{{Name: "resize", Params: map[string]interface{}{"text": float64(5)}}}, Destination: valid.Destination},
+	}
+	for _, job := range invalid {
+		if err := validateJob(job); err == nil {
+			t.Errorf("Expected error of job: %#v", job)
+		}
+	}
+}
+
+func TestProcessJob(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+
+	var stored []byte
+	var callback JobEvent
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/cat.jpg":
+			w.Write(buf)
+		case "/upload":
+			stored, _ = ioutil.ReadAll(r.Body)
+		case "/callback":
+			json.NewDecoder(r.Body).Decode(&callback)
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+
+	job := `{"id": "job-1", "source": {"url": "` + ts.URL + `/cat.jpg"}, "destination": {"url": "` + ts.URL + `/upload?signature=secret"},
+		"operations": [{"operation": "resize", "params": {"width": 100, "type": "png"}}], "callback": "` + ts.URL + `/callback"}`
+	event := processJob(JobsOptions{}, []byte(job))
+	if event.Status != JobSucceeded || event.ID != "job-1" || event.Mime != "image/png" || event.Size != len(stored) || event.Retry {
+		t.Errorf("Invalid job event: %#v", event)
+	}
+	if callback.ID != "job-1" || callback.Status != JobSucceeded {
+		t.Errorf("Invalid job callback event: %#v", callback)
+	}
+	if event.Destination != nil {
+		t.Errorf("Destination URLs must not be exposed: %#v", event.Destination)
+	}
+
+	cases := []struct {
+		job   string
+		retry bool
+	}{
+		{strings.Replace(job, "/cat.jpg", "/missing.jpg", 1), true},
+		{strings.Replace(job, "/upload", "/unavailable", 1), true},
+		{strings.Replace(job, `"resize"`, `"unknown"`, 1), false},
+		{strings.Replace(job, `"width": 100`, `"width": 100, "text": 5`, 1), false},
+		{`not json`, false},
+	}
+	for _, c := range cases {
+		event := processJob(JobsOptions{}, []byte(c.job))
+		if event.Status != JobFailed || event.Error == "" || event.Retry != c.retry {
+			t.Errorf("Invalid failed job event: %#v", event)
+		}
+	}
+}
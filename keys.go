@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"strings"
+)
+
+// Key represents an API key or URL signature key, identified by the given id
+type Key struct {
+	ID     string
+	Secret string
+}
+
+// KeyRing represents the concurrently valid keys, so keys can be rotated without
+// invalidating the previously issued API keys or signed URLs at once. The first
+// key is the primary one, used to sign the URLs generated by imaginary.
+type KeyRing []Key
+
+// parseKeyRing parses the comma separated list of keys, optionally prefixed by their id
+// and a colon, such as "v2:secret2,v1:secret1". Keys without id are identified by an empty id.
+// Unless the key rotation is enabled, the input is a single key, which can contain commas and
+// colons, as the keys defined before the key rotation support.
+func parseKeyRing(input string, rotation bool) (KeyRing, error) {
+	ring := KeyRing{}
+	if !rotation {
+		if input != "" {
+			ring = append(ring, Key{Secret: input})
+		}
+		return ring, nil
+	}
+	for _, value := range parseList(input) {
+		key := Key{Secret: value}
+		if i := strings.Index(value, ":"); i > 0 {
+			key = Key{ID: value[:i], Secret: value[i+1:]}
+		}
+		if key.Secret == "" {
+			return nil, fmt.Errorf("empty key secret of key id %q", key.ID)
+		}
+		if _, exists := ring.Lookup(key.ID); exists {
+			return nil, fmt.Errorf("duplicated key id %q", key.ID)
+		}
+		ring = append(ring, key)
+	}
+	return ring, nil
+}
+
+// Primary returns the primary key, or an empty key if the ring is empty
+func (k KeyRing) Primary() Key {
+	if len(k) == 0 {
+		return Key{}
+	}
+	return k[0]
+}
+
+// Lookup returns the key of the given id
+func (k KeyRing) Lookup(id string) (Key, bool) {
+	for _, key := range k {
+		if key.ID == id {
+			return key, true
+		}
+	}
+	return Key{}, false
+}
+
+// Match returns the key of the given secret, comparing every key in constant time
+func (k KeyRing) Match(secret string) (Key, bool) {
+	var match Key
+	found := false
+	for _, key := range k {
+		if subtle.ConstantTimeCompare([]byte(key.Secret), []byte(secret)) == 1 {
+			match, found = key, true
+		}
+	}
+	return match, found
+}
+
+// apiKeys returns the valid API keys, the ones read from file taking precedence,
+// defaulting to the single API key
+func apiKeys(o ServerOptions) KeyRing {
+	if ring := o.Secrets.APIKeys(); len(ring) > 0 {
+		return ring
+	}
+	if len(o.APIKeys) > 0 {
+		return o.APIKeys
+	}
+	return KeyRing{{Secret: o.APIKey}}
+}
+
+// urlSignatureKeys returns the valid URL signature keys, the ones read from file taking
+// precedence, defaulting to the single signature key
+func urlSignatureKeys(o ServerOptions) KeyRing {
+	if ring := o.Secrets.URLSignatureKeys(); len(ring) > 0 {
+		return ring
+	}
+	if len(o.URLSignatureKeys) > 0 {
+		return o.URLSignatureKeys
+	}
+	return KeyRing{{Secret: o.URLSignatureKey}}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestParseKeyRing(t *testing.T) {
+	ring, err := parseKeyRing("v2:secret2, v1:secret1,legacy", true)
+	if err != nil {
+		t.Fatalf("Cannot parse the key ring: %s", err)
+	}
+	if len(ring) != 3 {
+		t.Fatalf("Invalid number of keys: %d", len(ring))
+	}
+	if primary := ring.Primary(); primary.ID != "v2" || primary.Secret != "secret2" {
+		t.Errorf("Invalid primary key: %+v", primary)
+	}
+	if key, ok := ring.Lookup(""); !ok || key.Secret != "legacy" {
+		t.Errorf("Invalid key without id: %+v", key)
+	}
+	if key, ok := ring.Match("secret1"); !ok || key.ID != "v1" {
+		t.Errorf("Invalid matched key: %+v", key)
+	}
+	if _, ok := ring.Match("secret3"); ok {
+		t.Error("Unexpected matched key")
+	}
+
+	for _, input := range []string{"v1:a,v1:b", "a,b", "v1:"} {
+		if _, err := parseKeyRing(input, true); err == nil {
+			t.Errorf("Expected invalid key ring error: %s", input)
+		}
+	}
+
+	// Without key rotation, the keys are defined as is
+	ring, err = parseKeyRing("a:b,c", false)
+	if err != nil || len(ring) != 1 || ring.Primary().ID != "" || ring.Primary().Secret != "a:b,c" {
+		t.Errorf("Invalid single key: %+v %v", ring, err)
+	}
+	if ring, _ := parseKeyRing("", false); len(ring) != 0 {
+		t.Errorf("Invalid empty key ring: %+v", ring)
+	}
+}
+
+func TestAuthorizeClientKeyRotation(t *testing.T) {
+	ring, _ := parseKeyRing("v2:new-secret,v1:old-secret", true)
+	opts := ServerOptions{APIKey: ring.Primary().Secret, APIKeys: ring}
+	handler := authorizeClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}), opts)
+
+	cases := map[string]int{"new-secret": 200, "old-secret": 200, "v1:old-secret": 401, "": 401}
+	for key, status := range cases {
+		req := httptest.NewRequest("GET", "/resize", nil)
+		req.Header.Set("API-Key", key)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != status {
+			t.Errorf("Invalid response status for key %q: %d", key, w.Code)
+		}
+	}
+}
+
+func TestValidateURLSignatureKeyRotation(t *testing.T) {
+	ring, _ := parseKeyRing("v2:c4ff8b59974f46feebafc4b5e988f131,v1:4f46feebafc4b5e988f131c4ff8b5997", true)
+	opts := ServerOptions{URLSignatureKey: ring.Primary().Secret, URLSignatureKeys: ring}
+	handler := validateURLSignature(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}), opts)
+
+	cases := []struct {
+		keyid, secret string
+		status        int
+	}{
+		{"v2", "c4ff8b59974f46feebafc4b5e988f131", 200},
+		{"v1", "4f46feebafc4b5e988f131c4ff8b5997", 200},
+		{"v1", "c4ff8b59974f46feebafc4b5e988f131", 403},
+		{"v3", "c4ff8b59974f46feebafc4b5e988f131", 403},
+		{"", "4f46feebafc4b5e988f131c4ff8b5997", 403},
+	}
+
+	for _, c := range cases {
+		query := url.Values{"width": {"300"}}
+		if c.keyid != "" {
+			query.Set("keyid", c.keyid)
+		}
+		query = signURL(c.secret, "/resize", query)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/resize?"+query.Encode(), nil))
+		if w.Code != c.status {
+			t.Errorf("Invalid response status for key id %q: %d", c.keyid, w.Code)
+		}
+	}
+}
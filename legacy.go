@@ -0,0 +1,601 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// maxLegacySize is the maximum width and height of the legacy images decoded in pure Go
+const maxLegacySize = 16384
+
+// tgaFooter is the TGA 2.0 images footer signature
+var tgaFooter = []byte("TRUEVISION-XFILE.\x00")
+
+// isLegacyImage reports whether the given buffer is a legacy BMP, PCX or TGA image,
+// which libvips cannot load, unless it was built with ImageMagick support.
+func isLegacyImage(buf []byte) bool {
+	return isBMP(buf) || isPCX(buf) || isTGA(buf)
+}
+
+// decodeLegacyImage decodes the given legacy BMP, PCX or TGA image, encoded as PNG.
+// Images of more pixels than the given maximum, unless zero, are rejected before decoding.
+func decodeLegacyImage(buf []byte, maxPixels int) ([]byte, error) {
+	var img image.Image
+	var err error
+	switch {
+	case isBMP(buf):
+		img, err = decodeBMP(buf, maxPixels)
+	case isPCX(buf):
+		img, err = decodePCX(buf, maxPixels)
+	default:
+		img, err = decodeTGA(buf, maxPixels)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	err = png.Encode(&out, img)
+	return out.Bytes(), err
+}
+
+// checkLegacySize returns an error if the given image dimensions are not supported,
+// or exceed the given maximum pixels, unless zero.
+func checkLegacySize(format string, width, height, maxPixels int) error {
+	if width <= 0 || height <= 0 || width > maxLegacySize || height > maxLegacySize {
+		return fmt.Errorf("Invalid %s image: unsupported dimensions %dx%d", format, width, height)
+	}
+	if maxPixels > 0 && width*height > maxPixels {
+		return NewError(fmt.Sprintf("Image exceeds the maximum allowed legacy image pixels: %d > %d", width*height, maxPixels), TooLarge)
+	}
+	return nil
+}
+
+// isBMP reports whether the given buffer is a Windows or OS/2 bitmap image
+func isBMP(buf []byte) bool {
+	if len(buf) < 26 || buf[0] != 'B' || buf[1] != 'M' {
+		return false
+	}
+	switch binary.LittleEndian.Uint32(buf[14:18]) {
+	case 12, 40, 52, 56, 64, 108, 124:
+		return true
+	}
+	return false
+}
+
+// Bitmap compression methods
+const (
+	bmpRGB       = 0
+	bmpRLE8      = 1
+	bmpRLE4      = 2
+	bmpBitfields = 3
+	bmpAlphaBits = 6
+)
+
+// decodeBMP decodes the 1, 4, 8, 16, 24 and 32-bit bitmap images, either uncompressed,
+// run-length encoded or defined by bit field masks, stored bottom-up or top-down.
+func decodeBMP(buf []byte, maxPixels int) (image.Image, error) {
+	le := binary.LittleEndian
+	pixels := int(le.Uint32(buf[10:14]))
+	dib := buf[14:]
+	headerSize := int(le.Uint32(dib[0:4]))
+	if headerSize > len(dib) {
+		return nil, errors.New("Invalid BMP image: truncated header")
+	}
+
+	var width, height, bitCount, colors int
+	var compression uint32
+	entrySize := 4
+	if headerSize == 12 {
+		// OS/2 bitmap core header
+		width = int(le.Uint16(dib[4:6]))
+		height = int(int16(le.Uint16(dib[6:8])))
+		bitCount = int(le.Uint16(dib[10:12]))
+		entrySize = 3
+	} else {
+		width = int(int32(le.Uint32(dib[4:8])))
+		height = int(int32(le.Uint32(dib[8:12])))
+		bitCount = int(le.Uint16(dib[14:16]))
+		compression = le.Uint32(dib[16:20])
+		colors = int(le.Uint32(dib[32:36]))
+	}
+
+	topDown := height < 0
+	if topDown {
+		height = -height
+	}
+	if err := checkLegacySize("BMP", width, height, maxPixels); err != nil {
+		return nil, err
+	}
+
+	// Channel masks are defined by the header, or right after the 40 bytes header
+	masks := []uint32{0x7c00, 0x3e0, 0x1f, 0}
+	if bitCount == 32 {
+		masks = []uint32{0xff0000, 0xff00, 0xff, 0}
+	}
+	paletteOffset := 14 + headerSize
+	if compression == bmpBitfields || compression == bmpAlphaBits {
+		count := 3
+		if compression == bmpAlphaBits || headerSize >= 56 {
+			count = 4
+		}
+		if headerSize == 40 {
+			paletteOffset += count * 4
+		}
+		if 14+40+count*4 > len(buf) {
+			return nil, errors.New("Invalid BMP image: truncated bit field masks")
+		}
+		for i := 0; i < count; i++ {
+			masks[i] = le.Uint32(dib[40+i*4:])
+		}
+	} else if compression != bmpRGB && compression != bmpRLE8 && compression != bmpRLE4 {
+		return nil, fmt.Errorf("Invalid BMP image: unsupported compression %d", compression)
+	}
+
+	var palette []color.NRGBA
+	switch bitCount {
+	case 1, 4, 8:
+		if colors == 0 || colors > 1<<uint(bitCount) {
+			colors = 1 << uint(bitCount)
+		}
+		if paletteOffset+colors*entrySize > len(buf) {
+			return nil, errors.New("Invalid BMP image: truncated palette")
+		}
+		palette = make([]color.NRGBA, colors)
+		for i := range palette {
+			p := buf[paletteOffset+i*entrySize:]
+			palette[i] = color.NRGBA{p[2], p[1], p[0], 0xff}
+		}
+	case 16, 24, 32:
+	default:
+		return nil, fmt.Errorf("Invalid BMP image: unsupported bit count %d", bitCount)
+	}
+	if pixels <= 0 || pixels > len(buf) {
+		return nil, errors.New("Invalid BMP image: invalid pixels offset")
+	}
+
+	row := func(y int) int {
+		if topDown {
+			return y
+		}
+		return height - 1 - y
+	}
+
+	if compression == bmpRLE8 || compression == bmpRLE4 {
+		indexes, err := decodeBMPRLE(buf[pixels:], width, height, compression == bmpRLE4)
+		if err != nil {
+			return nil, err
+		}
+		// Pixels skipped by the RLE markers are the first palette color
+		img := image.NewNRGBA(image.Rect(0, 0, width, height))
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				index := 0
+				if i := row(y)*width + x; i < len(indexes) {
+					index = int(indexes[i])
+				}
+				if index < len(palette) {
+					img.SetNRGBA(x, y, palette[index])
+				}
+			}
+		}
+		return img, nil
+	}
+
+	// Uncompressed pixels are checked before allocating the image, to reject truncated ones
+	stride := (width*bitCount + 31) / 32 * 4
+	if pixels+stride*height > len(buf) {
+		return nil, errors.New("Invalid BMP image: truncated pixels")
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+
+	hasAlpha := masks[3] != 0
+	for y := 0; y < height; y++ {
+		data := buf[pixels+row(y)*stride:]
+		for x := 0; x < width; x++ {
+			var c color.NRGBA
+			switch bitCount {
+			case 16:
+				c = maskedColor(uint32(le.Uint16(data[x*2:])), masks)
+			case 24:
+				c = color.NRGBA{data[x*3+2], data[x*3+1], data[x*3], 0xff}
+			case 32:
+				c = maskedColor(le.Uint32(data[x*4:]), masks)
+			default:
+				bit := x * bitCount
+				index := int(data[bit/8]>>uint(8-bitCount-bit%8)) & (1<<uint(bitCount) - 1)
+				if index < len(palette) {
+					c = palette[index]
+				}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+
+	// Bitmaps without alpha mask may still define the alpha channel, so frequently zeroed
+	// that it is only honoured if any pixel defines it, as the ICO bitmaps
+	if bitCount == 32 && !hasAlpha {
+		alpha := false
+		for y := 0; y < height && !alpha; y++ {
+			data := buf[pixels+row(y)*stride:]
+			for x := 0; x < width && !alpha; x++ {
+				alpha = data[x*4+3] != 0
+			}
+		}
+		if alpha {
+			for y := 0; y < height; y++ {
+				data := buf[pixels+row(y)*stride:]
+				for x := 0; x < width; x++ {
+					c := img.NRGBAAt(x, y)
+					c.A = data[x*4+3]
+					img.SetNRGBA(x, y, c)
+				}
+			}
+		}
+	}
+
+	return img, nil
+}
+
+// decodeBMPRLE decodes the run-length encoded bitmap pixels into palette indexes,
+// stored in the bitmap rows order. The indexes only grow up to the last decoded pixel,
+// so the images declaring large dimensions but few runs are not allocated upfront.
+func decodeBMPRLE(data []byte, width, height int, nibbles bool) ([]byte, error) {
+	var indexes []byte
+	x, y := 0, 0
+	set := func(index byte) {
+		if x < width && y < height {
+			i := y*width + x
+			if i >= len(indexes) {
+				indexes = append(indexes, make([]byte, i+1-len(indexes))...)
+			}
+			indexes[i] = index
+		}
+		x++
+	}
+
+	for i := 0; i+1 < len(data); {
+		count, value := int(data[i]), data[i+1]
+		i += 2
+
+		if count > 0 {
+			// Encoded run of the same index, or alternating indexes of 4-bit bitmaps
+			for n := 0; n < count; n++ {
+				if nibbles {
+					set(value >> (4 * uint(1-n%2)) & 0x0f)
+				} else {
+					set(value)
+				}
+			}
+			continue
+		}
+
+		switch value {
+		case 0:
+			x, y = 0, y+1
+		case 1:
+			return indexes, nil
+		case 2:
+			if i+1 >= len(data) {
+				return nil, errors.New("Invalid BMP image: truncated RLE delta")
+			}
+			x, y = x+int(data[i]), y+int(data[i+1])
+			i += 2
+		default:
+			// Absolute run of the given number of indexes, padded to 16 bits
+			count = int(value)
+			size := count
+			if nibbles {
+				size = (count + 1) / 2
+			}
+			if i+size > len(data) {
+				return nil, errors.New("Invalid BMP image: truncated RLE run")
+			}
+			for n := 0; n < count; n++ {
+				if nibbles {
+					set(data[i+n/2] >> (4 * uint(1-n%2)) & 0x0f)
+				} else {
+					set(data[i+n])
+				}
+			}
+			i += size + size%2
+		}
+	}
+	return indexes, nil
+}
+
+// maskedColor returns the color of the given pixel value defined by the channel masks
+func maskedColor(value uint32, masks []uint32) color.NRGBA {
+	channel := func(mask uint32) uint8 {
+		if mask == 0 {
+			return 0xff
+		}
+		shift := uint(0)
+		for mask&(1<<shift) == 0 {
+			shift++
+		}
+		max := mask >> shift
+		return uint8((value & mask >> shift) * 0xff / max)
+	}
+	return color.NRGBA{channel(masks[0]), channel(masks[1]), channel(masks[2]), channel(masks[3])}
+}
+
+// isPCX reports whether the given buffer is a ZSoft PCX image
+func isPCX(buf []byte) bool {
+	if len(buf) < 128 || buf[0] != 0x0a || buf[2] != 1 {
+		return false
+	}
+	switch buf[1] {
+	case 0, 2, 3, 4, 5:
+	default:
+		return false
+	}
+	switch buf[3] {
+	case 1, 2, 4, 8:
+		return true
+	}
+	return false
+}
+
+// decodePCX decodes the monochrome, 16 colors, 256 colors and true color PCX images
+func decodePCX(buf []byte, maxPixels int) (image.Image, error) {
+	le := binary.LittleEndian
+	bits := int(buf[3])
+	width := int(le.Uint16(buf[8:10])) - int(le.Uint16(buf[4:6])) + 1
+	height := int(le.Uint16(buf[10:12])) - int(le.Uint16(buf[6:8])) + 1
+	planes := int(buf[65])
+	bytesPerLine := int(le.Uint16(buf[66:68]))
+	if err := checkLegacySize("PCX", width, height, maxPixels); err != nil {
+		return nil, err
+	}
+	if bytesPerLine*8 < width*bits {
+		return nil, errors.New("Invalid PCX image: invalid bytes per line")
+	}
+
+	var palette []color.NRGBA
+	egaPalette := func() {
+		for i := 0; i < 16; i++ {
+			p := buf[16+i*3:]
+			palette = append(palette, color.NRGBA{p[0], p[1], p[2], 0xff})
+		}
+	}
+	switch {
+	case bits == 8 && planes == 1:
+		// The 256 colors palette is appended after the pixels
+		if len(buf) < 128+769 || buf[len(buf)-769] != 0x0c {
+			return nil, errors.New("Invalid PCX image: missing 256 colors palette")
+		}
+		for i := 0; i < 256; i++ {
+			p := buf[len(buf)-768+i*3:]
+			palette = append(palette, color.NRGBA{p[0], p[1], p[2], 0xff})
+		}
+	case bits == 8 && (planes == 3 || planes == 4):
+	case bits == 1 && planes == 1:
+		palette = []color.NRGBA{{0, 0, 0, 0xff}, {0xff, 0xff, 0xff, 0xff}}
+	case (bits == 1 && planes == 4) || (bits == 4 && planes == 1):
+		egaPalette()
+	default:
+		return nil, fmt.Errorf("Invalid PCX image: unsupported %d bits and %d planes", bits, planes)
+	}
+
+	// Scanlines are run-length encoded, each plane line after the other, in runs
+	// of up to 63 bytes, so truncated images are rejected before allocating them
+	line := make([]byte, planes*bytesPerLine)
+	if 128+height*2*((len(line)+62)/63) > len(buf) {
+		return nil, errors.New("Invalid PCX image: truncated pixels")
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	i := 128
+	for y := 0; y < height; y++ {
+		for n := 0; n < len(line); {
+			if i >= len(buf) {
+				return nil, errors.New("Invalid PCX image: truncated pixels")
+			}
+			count, value := 1, buf[i]
+			i++
+			if value&0xc0 == 0xc0 {
+				if i >= len(buf) {
+					return nil, errors.New("Invalid PCX image: truncated pixels")
+				}
+				count, value = int(value&0x3f), buf[i]
+				i++
+			}
+			for ; count > 0 && n < len(line); count-- {
+				line[n] = value
+				n++
+			}
+		}
+
+		for x := 0; x < width; x++ {
+			var c color.NRGBA
+			switch {
+			case bits == 8 && planes == 1:
+				c = palette[line[x]]
+			case bits == 8:
+				c = color.NRGBA{line[x], line[bytesPerLine+x], line[2*bytesPerLine+x], 0xff}
+				if planes == 4 {
+					c.A = line[3*bytesPerLine+x]
+				}
+			case bits == 4:
+				c = palette[line[x/2]>>(4*uint(1-x%2))&0x0f]
+			default:
+				// Each plane defines one bit of the palette index
+				index := 0
+				for p := 0; p < planes; p++ {
+					index |= int(line[p*bytesPerLine+x/8]>>uint(7-x%8)&1) << uint(p)
+				}
+				c = palette[index]
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+
+	return img, nil
+}
+
+// TGA image types
+const (
+	tgaColorMapped    = 1
+	tgaTrueColor      = 2
+	tgaGrayscale      = 3
+	tgaRLEColorMapped = 9
+	tgaRLETrueColor   = 10
+	tgaRLEGrayscale   = 11
+)
+
+// isTGA reports whether the given buffer is a Truevision TGA image, either by its
+// TGA 2.0 footer, or by its header if the image type cannot be otherwise determined,
+// since TGA 1.0 images have no signature.
+func isTGA(buf []byte) bool {
+	if len(buf) < 18 {
+		return false
+	}
+	if !bytes.HasSuffix(buf, tgaFooter) && bimg.DetermineImageType(buf) != bimg.UNKNOWN {
+		return false
+	}
+	return isTGAHeader(buf)
+}
+
+// isTGAHeader reports whether the given TGA header defines a supported image type, pixel depth
+// and color map.
+func isTGAHeader(buf []byte) bool {
+	colorMapType, imageType, depth, mapDepth := buf[1], buf[2], buf[16], buf[7]
+	if colorMapType == 1 && mapDepth != 15 && mapDepth != 16 && mapDepth != 24 && mapDepth != 32 {
+		return false
+	}
+	switch imageType {
+	case tgaColorMapped, tgaRLEColorMapped:
+		return colorMapType == 1 && depth == 8
+	case tgaTrueColor, tgaRLETrueColor:
+		return colorMapType <= 1 && (depth == 15 || depth == 16 || depth == 24 || depth == 32)
+	case tgaGrayscale, tgaRLEGrayscale:
+		return colorMapType <= 1 && depth == 8
+	}
+	return false
+}
+
+// decodeTGA decodes the color-mapped, true color and grayscale TGA images,
+// either uncompressed or run-length encoded.
+func decodeTGA(buf []byte, maxPixels int) (image.Image, error) {
+	if len(buf) < 18 || len(buf) < 18+int(buf[0]) {
+		return nil, errors.New("Invalid TGA image: truncated header")
+	}
+	if !isTGAHeader(buf) {
+		return nil, errors.New("Invalid TGA image: unsupported image type")
+	}
+
+	le := binary.LittleEndian
+	imageType := buf[2]
+	mapFirst, mapLength, mapDepth := int(le.Uint16(buf[3:5])), int(le.Uint16(buf[5:7])), int(buf[7])
+	width, height := int(le.Uint16(buf[12:14])), int(le.Uint16(buf[14:16]))
+	depth, descriptor := int(buf[16]), buf[17]
+	if err := checkLegacySize("TGA", width, height, maxPixels); err != nil {
+		return nil, err
+	}
+
+	// Alpha is only defined by the 32-bit pixels with attribute bits
+	alpha := descriptor&0x0f != 0
+	pixel := func(data []byte, depth int) color.NRGBA {
+		switch depth {
+		case 8:
+			return color.NRGBA{data[0], data[0], data[0], 0xff}
+		case 15, 16:
+			v := le.Uint16(data)
+			return color.NRGBA{uint8(v >> 10 & 0x1f * 0xff / 0x1f), uint8(v >> 5 & 0x1f * 0xff / 0x1f), uint8(v & 0x1f * 0xff / 0x1f), 0xff}
+		case 24:
+			return color.NRGBA{data[2], data[1], data[0], 0xff}
+		}
+		c := color.NRGBA{data[2], data[1], data[0], 0xff}
+		if alpha {
+			c.A = data[3]
+		}
+		return c
+	}
+
+	offset := 18 + int(buf[0])
+	var palette []color.NRGBA
+	if buf[1] == 1 {
+		entrySize := (mapDepth + 7) / 8
+		if offset+mapLength*entrySize > len(buf) {
+			return nil, errors.New("Invalid TGA image: truncated color map")
+		}
+		palette = make([]color.NRGBA, mapFirst+mapLength)
+		for i := 0; i < mapLength; i++ {
+			palette[mapFirst+i] = pixel(buf[offset+i*entrySize:], mapDepth)
+		}
+		offset += mapLength * entrySize
+	}
+
+	pixelSize := (depth + 7) / 8
+	data := buf[offset:]
+	if imageType >= tgaRLEColorMapped {
+		var err error
+		if data, err = decodeTGARLE(data, width*height, pixelSize); err != nil {
+			return nil, err
+		}
+	}
+	if len(data) < width*height*pixelSize {
+		return nil, errors.New("Invalid TGA image: truncated pixels")
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for i := 0; i < width*height; i++ {
+		x, y := i%width, i/width
+		// Pixels are stored bottom-up and left to right, unless defined otherwise
+		if descriptor&0x10 != 0 {
+			x = width - 1 - x
+		}
+		if descriptor&0x20 == 0 {
+			y = height - 1 - y
+		}
+
+		p := data[i*pixelSize:]
+		if imageType == tgaColorMapped || imageType == tgaRLEColorMapped {
+			if index := int(p[0]); index < len(palette) {
+				img.SetNRGBA(x, y, palette[index])
+			}
+			continue
+		}
+		img.SetNRGBA(x, y, pixel(p, depth))
+	}
+
+	return img, nil
+}
+
+// decodeTGARLE decodes the given number of run-length encoded TGA pixels
+func decodeTGARLE(data []byte, pixels, pixelSize int) ([]byte, error) {
+	var out []byte
+	for i := 0; len(out) < pixels*pixelSize; {
+		if i >= len(data) {
+			return nil, errors.New("Invalid TGA image: truncated RLE pixels")
+		}
+		count := int(data[i]&0x7f) + 1
+		run := data[i]&0x80 != 0
+		i++
+
+		size := pixelSize
+		if !run {
+			size *= count
+		}
+		if i+size > len(data) {
+			return nil, errors.New("Invalid TGA image: truncated RLE pixels")
+		}
+		if run {
+			for n := 0; n < count; n++ {
+				out = append(out, data[i:i+pixelSize]...)
+			}
+		} else {
+			out = append(out, data[i:i+size]...)
+		}
+		i += size
+	}
+	return out[:pixels*pixelSize], nil
+}
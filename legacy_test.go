@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"testing"
+)
+
+// testBMP returns a bitmap image of the given DIB header fields, palette and pixels
+func testBMP(width, height, bitCount, compression int, palette, pixels []byte) []byte {
+	le := binary.LittleEndian
+	dib := make([]byte, 40)
+	le.PutUint32(dib[0:], 40)
+	le.PutUint32(dib[4:], uint32(int32(width)))
+	le.PutUint32(dib[8:], uint32(int32(height)))
+	le.PutUint16(dib[12:], 1)
+	le.PutUint16(dib[14:], uint16(bitCount))
+	le.PutUint32(dib[16:], uint32(compression))
+	le.PutUint32(dib[32:], uint32(len(palette)/4))
+
+	header := make([]byte, 14)
+	header[0], header[1] = 'B', 'M'
+	le.PutUint32(header[2:], uint32(14+len(dib)+len(palette)+len(pixels)))
+	le.PutUint32(header[10:], uint32(14+len(dib)+len(palette)))
+	return append(append(append(header, dib...), palette...), pixels...)
+}
+
+func assertPixel(t *testing.T, name string, img image.Image, x, y int, expected color.NRGBA) {
+	if c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA); c != expected {
+		t.Errorf("Invalid %s pixel at %dx%d: %v", name, x, y, c)
+	}
+}
+
+func TestDecodeBMP(t *testing.T) {
+	red, blue := color.NRGBA{0xff, 0, 0, 0xff}, color.NRGBA{0, 0, 0xff, 0xff}
+
+	// 24-bit bottom-up rows, padded to 4 bytes: the first row is the bottom one
+	pixels := []byte{0xff, 0, 0, 0, 0, 0, 0xff, 0}
+	cases := []struct {
+		name string
+		buf  []byte
+	}{
+		{"24-bit", testBMP(1, 2, 24, bmpRGB, nil, pixels)},
+		{"top-down 8-bit", testBMP(1, -2, 8, bmpRGB, []byte{0, 0, 0xff, 0, 0xff, 0, 0, 0}, []byte{0, 0, 0, 0, 1, 0, 0, 0})},
+		{"RLE8", testBMP(1, 2, 8, bmpRLE8, []byte{0xff, 0, 0, 0, 0, 0, 0xff, 0}, []byte{1, 0, 0, 0, 1, 1, 0, 1})},
+	}
+
+	for _, c := range cases {
+		if !isBMP(c.buf) || !isLegacyImage(c.buf) {
+			t.Errorf("Expected a %s BMP image", c.name)
+			continue
+		}
+		img, err := decodeBMP(c.buf, 0)
+		if err != nil {
+			t.Errorf("Cannot decode the %s BMP image: %s", c.name, err)
+			continue
+		}
+		if img.Bounds().Dx() != 1 || img.Bounds().Dy() != 2 {
+			t.Errorf("Invalid %s BMP image size: %v", c.name, img.Bounds())
+		}
+		assertPixel(t, c.name, img, 0, 0, red)
+		assertPixel(t, c.name, img, 0, 1, blue)
+	}
+
+	if _, err := decodeBMP(testBMP(1, 2, 24, bmpRGB, nil, pixels[:4]), 0); err == nil {
+		t.Error("Expected an error decoding a truncated BMP image")
+	}
+}
+
+func TestDecodeTGA(t *testing.T) {
+	// 32-bit RLE top-down image of a red run followed by a raw semi-transparent blue pixel
+	buf := []byte{0, 0, tgaRLETrueColor, 0, 0, 0, 0, 0, 0, 0, 0, 0, 3, 0, 1, 0, 32, 0x28,
+		0x81, 0, 0, 0xff, 0xff, 0x00, 0xff, 0, 0, 0x80}
+	buf = append(append(buf, make([]byte, 8)...), tgaFooter...)
+	if !isTGA(buf) || !isLegacyImage(buf) {
+		t.Fatal("Expected a TGA image")
+	}
+
+	img, err := decodeTGA(buf, 0)
+	if err != nil {
+		t.Fatalf("Cannot decode the TGA image: %s", err)
+	}
+	assertPixel(t, "TGA", img, 0, 0, color.NRGBA{0xff, 0, 0, 0xff})
+	assertPixel(t, "TGA", img, 1, 0, color.NRGBA{0xff, 0, 0, 0xff})
+	assertPixel(t, "TGA", img, 2, 0, color.NRGBA{0, 0, 0xff, 0x80})
+
+	header := append([]byte{}, buf[:18]...)
+	invalid := map[string][]byte{
+		"header":     buf[:10],
+		"image ID":   append([]byte{0xff}, buf[1:20]...),
+		"depth":      append(append([]byte{}, buf[:16]...), 0, 0x28),
+		"map depth":  append(append([]byte{0, 1, tgaColorMapped, 0, 0, 1, 0, 9}, header[8:16]...), 8, 0x28),
+		"color map":  append(append([]byte{0, 1, tgaColorMapped, 0, 0, 0xff, 0, 24}, header[8:16]...), 8, 0x28),
+		"RLE pixels": append(header, 0x81, 0, 0),
+	}
+	for name, b := range invalid {
+		if _, err := decodeTGA(b, 0); err == nil {
+			t.Errorf("Expected an error decoding a TGA image of invalid %s", name)
+		}
+	}
+
+	if isTGA([]byte("\xff\xd8\xff\xe0" + string(make([]byte, 20)))) {
+		t.Error("Unexpected TGA image of JPEG image")
+	}
+}
+
+func TestDecodePCX(t *testing.T) {
+	// 24-bit RLE image of 2x1 pixels, whose planes lines are red, green and blue
+	header := make([]byte, 128)
+	header[0], header[1], header[2], header[3] = 0x0a, 5, 1, 8
+	binary.LittleEndian.PutUint16(header[8:], 1)
+	header[65] = 3
+	binary.LittleEndian.PutUint16(header[66:], 2)
+	buf := append(header, 0xc2, 0xff, 0x00, 0x10, 0xc2, 0x20)
+
+	if !isPCX(buf) || !isLegacyImage(buf) {
+		t.Fatal("Expected a PCX image")
+	}
+	img, err := decodePCX(buf, 0)
+	if err != nil {
+		t.Fatalf("Cannot decode the PCX image: %s", err)
+	}
+	assertPixel(t, "PCX", img, 0, 0, color.NRGBA{0xff, 0x00, 0x20, 0xff})
+	assertPixel(t, "PCX", img, 1, 0, color.NRGBA{0xff, 0x10, 0x20, 0xff})
+}
+
+func TestDecodeLegacyImage(t *testing.T) {
+	buf, err := decodeLegacyImage(testBMP(3, 2, 24, bmpRGB, nil, make([]byte, 24)), 0)
+	if err != nil {
+		t.Fatalf("Cannot decode the legacy image: %s", err)
+	}
+	img, err := png.Decode(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatalf("Invalid PNG image: %s", err)
+	}
+	if img.Bounds().Size() != image.Pt(3, 2) {
+		t.Errorf("Invalid image size: %v", img.Bounds())
+	}
+}
+
+func TestDecodeLegacyImageBomb(t *testing.T) {
+	// RLE8 bitmap declaring 16384x16384 pixels, ending right away
+	bomb := testBMP(16384, 16384, 8, bmpRLE8, make([]byte, 8), []byte{0, 1})
+	_, err := decodeLegacyImage(bomb, 50000000)
+	if e, ok := err.(Error); !ok || e.HTTPCode() != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected a too large error decoding the BMP bomb, got: %v", err)
+	}
+
+	indexes, err := decodeBMPRLE([]byte{0, 1}, 16384, 16384, false)
+	if err != nil || len(indexes) != 0 {
+		t.Errorf("Unexpected RLE indexes of an empty bitmap: %d, %v", len(indexes), err)
+	}
+
+	// Uncompressed pixels shorter than the declared dimensions
+	if _, err := decodeBMP(testBMP(4096, 4096, 24, bmpRGB, nil, make([]byte, 64)), 0); err == nil {
+		t.Error("Expected an error decoding a truncated BMP image")
+	}
+}
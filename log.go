@@ -1,8 +1,10 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
+	"math/rand"
 	"net/http"
 	"strings"
 	"time"
@@ -10,6 +12,32 @@ import (
 
 const formatPattern = "%s - - [%s] \"%s\" %d %d %.4f\n"
 
+const combinedFormatPattern = "%s - - [%s] \"%s\" %d %d \"%s\" \"%s\" %.4f\n"
+
+// Supported access log formats
+const (
+	LogFormatDefault  = "default"
+	LogFormatCombined = "combined"
+	LogFormatJSON     = "json"
+)
+
+// redactedValue is used to replace the redacted query param values in the logged URIs
+const redactedValue = "REDACTED"
+
+// LogOptions represents the access log customization options.
+type LogOptions struct {
+	// Format is the access log record format: default, combined or json.
+	Format string
+	// Redact is the list of query params whose values must not be logged.
+	Redact []string
+	// SampleRate is the percentage of requests to log, from 0 to 100.
+	// Zero means all the requests are logged.
+	SampleRate float64
+}
+
+// DefaultLogOptions represents the default access log options.
+var DefaultLogOptions = LogOptions{Format: LogFormatDefault, SampleRate: 100}
+
 // LogRecords implements a Apache-compatible HTTP logging
 type LogRecord struct {
 	http.ResponseWriter
@@ -17,15 +45,55 @@ type LogRecord struct {
 	responseBytes         int64
 	ip                    string
 	method, uri, protocol string
+	referer, userAgent    string
 	time                  time.Time
 	elapsedTime           time.Duration
 }
 
+// logEntry represents the JSON access log record.
+type logEntry struct {
+	Time      string  `json:"time"`
+	IP        string  `json:"ip"`
+	Method    string  `json:"method"`
+	URI       string  `json:"uri"`
+	Protocol  string  `json:"protocol"`
+	Status    int     `json:"status"`
+	Bytes     int64   `json:"bytes"`
+	Duration  float64 `json:"duration"`
+	Referer   string  `json:"referer,omitempty"`
+	UserAgent string  `json:"userAgent,omitempty"`
+}
+
 // Log writes a log entry in the passed io.Writer stream
 func (r *LogRecord) Log(out io.Writer) {
+	r.LogFormat(out, LogFormatDefault)
+}
+
+// LogFormat writes a log entry in the passed io.Writer stream using the given format
+func (r *LogRecord) LogFormat(out io.Writer, format string) {
 	timeFormat := r.time.Format("02/Jan/2006 15:04:05")
 	request := fmt.Sprintf("%s %s %s", r.method, r.uri, r.protocol)
-	fmt.Fprintf(out, formatPattern, r.ip, timeFormat, request, r.status, r.responseBytes, r.elapsedTime.Seconds())
+
+	switch format {
+	case LogFormatJSON:
+		buf, _ := json.Marshal(logEntry{
+			Time:      r.time.Format(time.RFC3339),
+			IP:        r.ip,
+			Method:    r.method,
+			URI:       r.uri,
+			Protocol:  r.protocol,
+			Status:    r.status,
+			Bytes:     r.responseBytes,
+			Duration:  r.elapsedTime.Seconds(),
+			Referer:   r.referer,
+			UserAgent: r.userAgent,
+		})
+		out.Write(append(buf, '\n'))
+	case LogFormatCombined:
+		fmt.Fprintf(out, combinedFormatPattern, r.ip, timeFormat, request, r.status, r.responseBytes, r.referer, r.userAgent, r.elapsedTime.Seconds())
+	default:
+		fmt.Fprintf(out, formatPattern, r.ip, timeFormat, request, r.status, r.responseBytes, r.elapsedTime.Seconds())
+	}
 }
 
 // Write acts like a proxy passing the given bytes buffer to the ResponseWritter
@@ -46,15 +114,26 @@ func (r *LogRecord) WriteHeader(status int) {
 type LogHandler struct {
 	handler http.Handler
 	io      io.Writer
+	options LogOptions
 }
 
 // Creates a new logger
 func NewLog(handler http.Handler, io io.Writer) http.Handler {
-	return &LogHandler{handler, io}
+	return NewLogWithOptions(handler, io, DefaultLogOptions)
+}
+
+// Creates a new logger with custom format, redaction and sampling options
+func NewLogWithOptions(handler http.Handler, io io.Writer, options LogOptions) http.Handler {
+	return &LogHandler{handler, io, options}
 }
 
 // Implementes the required method as standard HTTP handler, serving the request.
 func (h *LogHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.sampled() {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+
 	clientIP := r.RemoteAddr
 	if colon := strings.LastIndex(clientIP, ":"); colon != -1 {
 		clientIP = clientIP[:colon]
@@ -65,8 +144,10 @@ func (h *LogHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		ip:             clientIP,
 		time:           time.Time{},
 		method:         r.Method,
-		uri:            r.RequestURI,
+		uri:            redactURI(r.RequestURI, h.options.Redact),
 		protocol:       r.Proto,
+		referer:        r.Referer(),
+		userAgent:      r.UserAgent(),
 		status:         http.StatusOK,
 		elapsedTime:    time.Duration(0),
 	}
@@ -78,5 +159,30 @@ func (h *LogHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	record.time = finishTime.UTC()
 	record.elapsedTime = finishTime.Sub(startTime)
 
-	record.Log(h.io)
+	record.LogFormat(h.io, h.options.Format)
+}
+
+func (h *LogHandler) sampled() bool {
+	return h.options.SampleRate <= 0 || h.options.SampleRate >= 100 || rand.Float64()*100 < h.options.SampleRate
+}
+
+// redactURI replaces the values of the given query params in the request URI,
+// preserving the original params order and encoding.
+func redactURI(uri string, params []string) string {
+	i := strings.Index(uri, "?")
+	if len(params) == 0 || i == -1 {
+		return uri
+	}
+
+	pairs := strings.Split(uri[i+1:], "&")
+	for n, pair := range pairs {
+		key := strings.SplitN(pair, "=", 2)[0]
+		for _, param := range params {
+			if key == param {
+				pairs[n] = key + "=" + redactedValue
+				break
+			}
+		}
+	}
+	return uri[:i+1] + strings.Join(pairs, "&")
 }
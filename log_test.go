@@ -1,8 +1,11 @@
 package main
 
 import (
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -38,3 +41,85 @@ func TestLog(t *testing.T) {
 		t.Fatalf("Invalid log output: %s", data)
 	}
 }
+
+func TestLogFormats(t *testing.T) {
+	cases := []struct {
+		format   string
+		expected []string
+	}{
+		{LogFormatDefault, []string{"GET /?width=100&key=REDACTED HTTP/1.1", " 200 "}},
+		{LogFormatCombined, []string{"GET /?width=100&key=REDACTED HTTP/1.1", " 200 ", "\"http://example.com\" \"tester\""}},
+		{LogFormatJSON, []string{`"uri":"/?width=100&key=REDACTED"`, `"status":200`, `"userAgent":"tester"`}},
+	}
+
+	for _, test := range cases {
+		var buf []byte
+		writer := fakeWriter(func(b []byte) (int, error) {
+			buf = b
+			return len(b), nil
+		})
+
+		noopHandler := func(w http.ResponseWriter, r *http.Request) {}
+		options := LogOptions{Format: test.format, Redact: []string{"key"}}
+		ts := httptest.NewServer(NewLogWithOptions(http.HandlerFunc(noopHandler), writer, options))
+
+		req, _ := http.NewRequest("GET", ts.URL+"/?width=100&key=secret", nil)
+		req.Header.Set("Referer", "http://example.com")
+		req.Header.Set("User-Agent", "tester")
+		_, err := http.DefaultClient.Do(req)
+		ts.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data := string(buf)
+		for _, expected := range test.expected {
+			if !strings.Contains(data, expected) {
+				t.Errorf("Invalid %s log output, missing %s: %s", test.format, expected, data)
+			}
+		}
+		if strings.Contains(data, "secret") {
+			t.Errorf("Redacted param value logged: %s", data)
+		}
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imaginary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "access.log")
+	file, err := NewRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := file.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := map[string]string{
+		path:        "fourth\n",
+		path + ".1": "third\n",
+		path + ".2": "second\n",
+	}
+	for name, content := range expected {
+		buf, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != content {
+			t.Errorf("Invalid %s content: %q", name, buf)
+		}
+	}
+
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Unexpected rotated file: %s.3", path)
+	}
+}
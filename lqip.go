@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// Default low quality image placeholder (LQIP) rendition params
+const (
+	lqipDefaultWidth = 32
+	lqipQuality      = 20
+)
+
+// LQIPInfo represents the JSON response of a low quality image placeholder,
+// ready to be inlined as image data URI.
+type LQIPInfo struct {
+	Width   int    `json:"width"`
+	Height  int    `json:"height"`
+	Type    string `json:"type"`
+	Size    int    `json:"size"`
+	DataURI string `json:"dataUri"`
+}
+
+// LQIP wraps the given operation, shrinking its output into a tiny, heavily
+// compressed and optionally blurred rendition, suitable for inlining.
+func LQIP(operation Operation) Operation {
+	return func(buf []byte, o ImageOptions) (Image, error) {
+		image, err := operation.Run(buf, o)
+		if err != nil || image.Mime == "application/json" {
+			return image, err
+		}
+
+		width := o.LQIPWidth
+		if width == 0 {
+			width = lqipDefaultWidth
+		}
+
+		opts := bimg.Options{
+			Width:         width,
+			Quality:       lqipQuality,
+			StripMetadata: true,
+			NoProfile:     true,
+			Type:          ImageType(o.Type),
+		}
+		if opts.Type == bimg.UNKNOWN {
+			opts.Type = bimg.JPEG
+		}
+		if o.LQIPBlur > 0 {
+			opts.GaussianBlur = bimg.GaussianBlur{Sigma: o.LQIPBlur}
+		}
+
+		image, err = Process(image.Body, opts)
+		if err != nil || !o.LQIPJSON {
+			return image, err
+		}
+		return lqipJSON(image)
+	}
+}
+
+func lqipJSON(image Image) (Image, error) {
+	size, err := bimg.Size(image.Body)
+	if err != nil {
+		return Image{}, err
+	}
+
+	body, _ := json.Marshal(LQIPInfo{
+		Width:   size.Width,
+		Height:  size.Height,
+		Type:    bimg.DetermineImageTypeName(image.Body),
+		Size:    len(image.Body),
+		DataURI: "data:" + image.Mime + ";base64," + base64.StdEncoding.EncodeToString(image.Body),
+	})
+	return Image{Body: body, Mime: "application/json"}, nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Admin stats rolling window, made of one minute buckets. The distinct operations and
+// origin hosts counted per minute are limited, the others being counted as "other".
+const (
+	statsBuckets  = 5
+	statsBucket   = time.Minute
+	statsWindow   = statsBuckets * statsBucket
+	statsSamples  = 1024
+	statsMaxKeys  = 256
+	statsTopHosts = 10
+)
+
+// requestsBucket represents the request counters of a minute
+type requestsBucket struct {
+	start     time.Time
+	requests  map[string]map[int]int64
+	hosts     map[string]int64
+	count     int64
+	total     time.Duration
+	durations []time.Duration
+}
+
+// ServerStats collects the rolling request counters of the last minutes, exposed by the
+// /-/stats admin endpoint. Processing times are sampled, up to the given number of samples
+// per minute, preserving the percentiles of busy servers.
+type ServerStats struct {
+	mutex    sync.Mutex
+	buckets  [statsBuckets]requestsBucket
+	inFlight int64
+	now      func() time.Time
+}
+
+// AdminStats represents the /-/stats admin endpoint response
+type AdminStats struct {
+	Window      int                         `json:"window"`
+	Requests    int64                       `json:"requests"`
+	Operations  map[string]map[string]int64 `json:"operations"`
+	Latency     LatencyStats                `json:"latency"`
+	TopOrigins  []OriginStats               `json:"topOrigins"`
+	InFlight    int64                       `json:"inFlight"`
+	QueueDepth  int                         `json:"queueDepth"`
+	BufferPool  BufferPoolStats             `json:"bufferPool"`
+	ResultCache *ResultCacheStats           `json:"resultCache,omitempty"`
+}
+
+// LatencyStats represents the request processing times, in milliseconds
+type LatencyStats struct {
+	Average float64 `json:"average"`
+	P50     float64 `json:"p50"`
+	P90     float64 `json:"p90"`
+	P99     float64 `json:"p99"`
+	Max     float64 `json:"max"`
+}
+
+// OriginStats represents the requests count of a source image origin host
+type OriginStats struct {
+	Host     string `json:"host"`
+	Requests int64  `json:"requests"`
+}
+
+// originsByRequests sorts the origins by descending requests count, then by host
+type originsByRequests []OriginStats
+
+func (o originsByRequests) Len() int      { return len(o) }
+func (o originsByRequests) Swap(i, j int) { o[i], o[j] = o[j], o[i] }
+func (o originsByRequests) Less(i, j int) bool {
+	if o[i].Requests != o[j].Requests {
+		return o[i].Requests > o[j].Requests
+	}
+	return o[i].Host < o[j].Host
+}
+
+// NewServerStats creates a new rolling request counters collector
+func NewServerStats() *ServerStats {
+	return &ServerStats{now: time.Now}
+}
+
+// bucket returns the bucket of the current minute, resetting it if expired
+func (s *ServerStats) bucket() *requestsBucket {
+	start := s.now().Truncate(statsBucket)
+	b := &s.buckets[(start.Unix()/int64(statsBucket/time.Second))%statsBuckets]
+	if !b.start.Equal(start) {
+		*b = requestsBucket{start: start, requests: map[string]map[int]int64{}, hosts: map[string]int64{}}
+	}
+	return b
+}
+
+// Record counts the given request of the given operation, response status,
+// source image origin host, if any, and processing time.
+func (s *ServerStats) Record(operation string, status int, host string, elapsed time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	b := s.bucket()
+	if b.requests[operation] == nil {
+		if len(b.requests) >= statsMaxKeys {
+			operation = "other"
+		}
+		if b.requests[operation] == nil {
+			b.requests[operation] = map[int]int64{}
+		}
+	}
+	b.requests[operation][status]++
+	if host != "" {
+		if _, ok := b.hosts[host]; !ok && len(b.hosts) >= statsMaxKeys {
+			host = "other"
+		}
+		b.hosts[host]++
+	}
+
+	b.count++
+	b.total += elapsed
+	if len(b.durations) < statsSamples {
+		b.durations = append(b.durations, elapsed)
+	} else if i := rand.Int63n(b.count); i < statsSamples {
+		b.durations[i] = elapsed
+	}
+}
+
+// Snapshot returns the request counters of the rolling window and the given result cache, if any
+func (s *ServerStats) Snapshot(cache *ResultCache) AdminStats {
+	stats := AdminStats{
+		Window:     int(statsWindow / time.Second),
+		Operations: map[string]map[string]int64{},
+		TopOrigins: []OriginStats{},
+		InFlight:   atomic.LoadInt64(&s.inFlight),
+		BufferPool: GetBufferPoolStats(),
+	}
+
+	s.mutex.Lock()
+	var total time.Duration
+	samples := durations{}
+	hosts := map[string]int64{}
+	since := s.now().Truncate(statsBucket).Add(-statsWindow)
+	for _, b := range s.buckets {
+		if !b.start.After(since) {
+			continue
+		}
+		for operation, statuses := range b.requests {
+			if stats.Operations[operation] == nil {
+				stats.Operations[operation] = map[string]int64{}
+			}
+			for status, count := range statuses {
+				stats.Operations[operation][strconv.Itoa(status)] += count
+			}
+		}
+		for host, count := range b.hosts {
+			hosts[host] += count
+		}
+		stats.Requests += b.count
+		total += b.total
+		samples = append(samples, b.durations...)
+	}
+	s.mutex.Unlock()
+
+	for host, count := range hosts {
+		stats.TopOrigins = append(stats.TopOrigins, OriginStats{Host: host, Requests: count})
+	}
+	sort.Sort(originsByRequests(stats.TopOrigins))
+	if len(stats.TopOrigins) > statsTopHosts {
+		stats.TopOrigins = stats.TopOrigins[:statsTopHosts]
+	}
+
+	if len(samples) > 0 {
+		sort.Sort(samples)
+		percentile := func(p int) float64 {
+			return toMilliseconds(samples[(len(samples)-1)*p/100])
+		}
+		stats.Latency = LatencyStats{
+			Average: toMilliseconds(total / time.Duration(stats.Requests)),
+			P50:     percentile(50),
+			P90:     percentile(90),
+			P99:     percentile(99),
+			Max:     toMilliseconds(samples[len(samples)-1]),
+		}
+	}
+
+	if cache != nil {
+		cacheStats := cache.Stats()
+		stats.ResultCache = &cacheStats
+	}
+	return stats
+}
+
+func toMilliseconds(d time.Duration) float64 {
+	return toFixed(float64(d)/float64(time.Millisecond), 2)
+}
+
+// originHost returns the lower case host of the source image URL of the given request, if any
+func originHost(r *http.Request) string {
+	if u, err := url.Parse(r.URL.Query().Get("url")); err == nil {
+		return strings.ToLower(u.Host)
+	}
+	return ""
+}
+
+// NewStatsHandler creates a new HTTP handler counting the requests in the given stats,
+// but the admin stats requests themselves.
+func NewStatsHandler(handler http.Handler, stats *ServerStats, o ServerOptions) http.Handler {
+	statsPath, legacyPath := join(o, APIVersionPrefix+"/-/stats"), join(o, "/-/stats")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == statsPath || r.URL.Path == legacyPath {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		record := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		atomic.AddInt64(&stats.inFlight, 1)
+		start := time.Now()
+		handler.ServeHTTP(record, r)
+		elapsed := time.Since(start)
+		atomic.AddInt64(&stats.inFlight, -1)
+
+		operation := endpointName(r)
+		if operation == "" {
+			operation = "index"
+		}
+		stats.Record(operation, record.status, originHost(r), elapsed)
+	})
+}
+
+// statsController replies with the rolling request counters
+func statsController(o ServerOptions) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stats := o.Stats.Snapshot(o.ResultCache)
+		stats.QueueDepth = o.ProcessingQueue.Waiting()
+		body, _ := json.Marshal(stats)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestServerStats(t *testing.T) {
+	now := time.Date(2017, 1, 1, 12, 0, 30, 0, time.UTC)
+	stats := NewServerStats()
+	stats.now = func() time.Time { return now }
+
+	for i := 1; i <= 100; i++ {
+		stats.Record("resize", 200, "cdn.example.com", time.Duration(i)*time.Millisecond)
+	}
+	stats.Record("resize", 400, "", time.Millisecond)
+	stats.Record("crop", 200, "example.com", time.Millisecond)
+
+	snapshot := stats.Snapshot(nil)
+	if snapshot.Requests != 102 || snapshot.Operations["resize"]["200"] != 100 || snapshot.Operations["resize"]["400"] != 1 {
+		t.Errorf("Invalid request counters: %#v", snapshot.Operations)
+	}
+	if len(snapshot.TopOrigins) != 2 || snapshot.TopOrigins[0] != (OriginStats{"cdn.example.com", 100}) {
+		t.Errorf("Invalid top origins: %#v", snapshot.TopOrigins)
+	}
+	if snapshot.Latency.P50 != 49 || snapshot.Latency.P99 != 98 || snapshot.Latency.Max != 100 {
+		t.Errorf("Invalid latency percentiles: %#v", snapshot.Latency)
+	}
+	if snapshot.ResultCache != nil {
+		t.Error("Unexpected result cache stats")
+	}
+
+	// Requests older than the rolling window are not counted
+	now = now.Add(statsWindow - time.Minute)
+	stats.Record("crop", 200, "", time.Millisecond)
+	if snapshot := stats.Snapshot(nil); snapshot.Requests != 103 {
+		t.Errorf("Invalid requests count of the window: %d", snapshot.Requests)
+	}
+	now = now.Add(time.Minute)
+	if snapshot := stats.Snapshot(nil); snapshot.Requests != 1 || snapshot.Operations["resize"] != nil {
+		t.Errorf("Invalid requests count of the expired window: %d", snapshot.Requests)
+	}
+}
+
+func TestServerStatsMaxKeys(t *testing.T) {
+	stats := NewServerStats()
+	for i := 0; i < statsMaxKeys+10; i++ {
+		stats.Record(fmt.Sprintf("op%d", i), 404, fmt.Sprintf("host%d", i), time.Millisecond)
+	}
+	snapshot := stats.Snapshot(nil)
+	if len(snapshot.Operations) != statsMaxKeys+1 || snapshot.Operations["other"]["404"] != 10 {
+		t.Errorf("Invalid operations limit: %d", len(snapshot.Operations))
+	}
+	if snapshot.TopOrigins[0] != (OriginStats{"other", 10}) || len(snapshot.TopOrigins) != statsTopHosts {
+		t.Errorf("Invalid top origins limit: %#v", snapshot.TopOrigins)
+	}
+}
+
+func TestStatsHandler(t *testing.T) {
+	o := ServerOptions{Stats: NewServerStats(), ResultCache: NewResultCache(1024)}
+	var depth int64
+	handler := NewStatsHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/-/stats" {
+			statsController(o)(w, r)
+			return
+		}
+		depth = o.Stats.Snapshot(nil).InFlight
+		w.WriteHeader(http.StatusBadRequest)
+	}), o.Stats, o)
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/resize?url=http://Example.com/cat.jpg", nil))
+	if depth != 1 {
+		t.Errorf("Invalid in flight requests while processing: %d", depth)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/-/stats", nil))
+	var stats AdminStats
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("Invalid stats response: %s", err)
+	}
+	if stats.Requests != 1 || stats.Operations["resize"]["400"] != 1 || stats.InFlight != 0 || stats.QueueDepth != 0 {
+		t.Errorf("Invalid stats: %#v", stats)
+	}
+	if len(stats.TopOrigins) != 1 || stats.TopOrigins[0].Host != "example.com" {
+		t.Errorf("Invalid top origins: %#v", stats.TopOrigins)
+	}
+	if stats.ResultCache == nil {
+		t.Error("Missing result cache stats")
+	}
+}
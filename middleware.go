@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
+	"net"
 	"net/http"
+	"net/url"
+	d "runtime/debug"
+	"strconv"
 	"strings"
 	"time"
-	"crypto/hmac"
-	"crypto/sha256"
-	"encoding/base64"
 
 	"github.com/rs/cors"
 	"gopkg.in/h2non/bimg.v1"
@@ -25,27 +30,88 @@ func Middleware(fn func(http.ResponseWriter, *http.Request), o ServerOptions) ht
 		next = throttle(next, o)
 	}
 	if o.CORS {
-		next = cors.Default().Handler(next)
+		next = cors.New(corsOptions(o)).Handler(next)
 	}
 	if o.APIKey != "" {
 		next = authorizeClient(next, o)
 	}
-	if o.HTTPCacheTTL >= 0 {
-		next = setCacheHeaders(next, o.HTTPCacheTTL)
+	if len(o.AllowedIPs) > 0 || len(o.DeniedIPs) > 0 {
+		next = filterClientIP(next, o)
+	}
+	if o.HTTPCacheTTL >= 0 || o.hasPresetCaches() {
+		next = setCacheHeaders(next, o)
+	}
+	if o.MaxBandwidth > 0 {
+		next = limitBandwidth(next, o)
 	}
 
-	return validate(defaultHeaders(next), o)
+	return recoverPanic(validate(defaultHeaders(next), o), o)
+}
+
+// recoverPanic recovers from panics while serving the request, replying with
+// a server error and reporting it, if an error reporter is configured.
+func recoverPanic(next http.Handler, o ServerOptions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if rec := recover(); rec != nil {
+				// Aborted responses, such as the failed streamed images, are not server errors
+				if rec == http.ErrAbortHandler {
+					panic(rec)
+				}
+				report := NewErrorReport(r, fmt.Sprintf("panic: %v", rec), http.StatusInternalServerError)
+				report.Stacktrace = string(d.Stack())
+				report.Panic = true
+				reportError(o, report)
+
+				w.Header().Set("Content-Type", ProblemContentType)
+				w.WriteHeader(ErrInternalServer.HTTPCode())
+				w.Write(ErrInternalServer.JSON())
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// AdminMiddleware wraps administrative endpoints, applying the admin
+// specific client IP access lists instead of the data plane ones.
+func AdminMiddleware(fn func(http.ResponseWriter, *http.Request), o ServerOptions) http.Handler {
+	o.AllowedIPs = o.AdminAllowedIPs
+	o.DeniedIPs = o.AdminDeniedIPs
+	return Middleware(fn, o)
 }
 
 func ImageMiddleware(o ServerOptions) func(Operation) http.Handler {
 	return func(fn Operation) http.Handler {
-		handler := validateImage(Middleware(imageController(o, Operation(fn)), o), o)
+		return imageControllerMiddleware(scriptRequests(cacheResults(imageController(o, Operation(fn)), o), o), o)
+	}
+}
 
-		if o.EnableURLSignature == true {
-			return validateURLSignature(handler, o)
-		}
+// imageControllerMiddleware wraps image processing controllers.
+func imageControllerMiddleware(fn func(http.ResponseWriter, *http.Request), o ServerOptions) http.Handler {
+	return processingMiddleware(validateImage(Middleware(limitClients(strictParams(fn, o), o), o), o), o)
+}
 
-		return handler
+// processingMiddleware applies the processing timeouts and the URL signature validation.
+func processingMiddleware(handler http.Handler, o ServerOptions) http.Handler {
+	if o.ProcessingTimeout > 0 || len(o.EndpointTimeouts) > 0 {
+		handler = processingTimeout(handler, o)
+	}
+
+	if o.EnableURLSignature == true {
+		return validateURLSignature(handler, o)
+	}
+
+	return handler
+}
+
+func corsOptions(o ServerOptions) cors.Options {
+	return cors.Options{
+		AllowedOrigins:   o.CORSAllowedOrigins,
+		AllowedMethods:   []string{"GET", "POST"},
+		AllowedHeaders:   o.CORSAllowedHeaders,
+		ExposedHeaders:   o.CORSExposedHeaders,
+		AllowCredentials: o.CORSCredentials,
+		MaxAge:           o.CORSMaxAge,
 	}
 }
 
@@ -59,22 +125,38 @@ func filterEndpoint(next http.Handler, o ServerOptions) http.Handler {
 	})
 }
 
-func throttleError(err error) http.Handler {
+// processingTimeout attaches the configured processing deadline to the request context,
+// which is honored by image sources and by the image processing itself.
+func processingTimeout(next http.Handler, o ServerOptions) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		http.Error(w, "throttle error: "+err.Error(), http.StatusInternalServerError)
+		timeout := o.ProcessingTimeoutFor(r)
+		if timeout <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func throttleError(err error, o ServerOptions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ErrorReply(r, w, NewError("throttle error: "+err.Error(), InternalError), o)
 	})
 }
 
 func throttle(next http.Handler, o ServerOptions) http.Handler {
 	store, err := memstore.New(65536)
 	if err != nil {
-		return throttleError(err)
+		return throttleError(err, o)
 	}
 
 	quota := throttled.RateQuota{throttled.PerSec(o.Concurrency), o.Burst}
 	rateLimiter, err := throttled.NewGCRARateLimiter(store, quota)
 	if err != nil {
-		return throttleError(err)
+		return throttleError(err, o)
 	}
 
 	httpRateLimiter := throttled.HTTPRateLimiter{
@@ -82,12 +164,19 @@ func throttle(next http.Handler, o ServerOptions) http.Handler {
 		VaryBy:      &throttled.VaryBy{Method: true},
 	}
 
+	httpRateLimiter.DeniedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		audit(o, r, AuditRateLimited, ErrRateLimitExceeded.Message)
+		ErrorReply(r, w, ErrRateLimitExceeded, o)
+	})
+
 	return httpRateLimiter.RateLimit(next)
 }
 
 func validate(next http.Handler, o ServerOptions) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "GET" && r.Method != "POST" {
+		// CORS preflight requests are answered by the CORS handler
+		preflight := o.CORS && r.Method == "OPTIONS"
+		if r.Method != "GET" && r.Method != "POST" && !preflight {
 			ErrorReply(r, w, ErrMethodNotAllowed, o)
 			return
 		}
@@ -120,7 +209,8 @@ func authorizeClient(next http.Handler, o ServerOptions) http.Handler {
 			key = r.URL.Query().Get("key")
 		}
 
-		if key != o.APIKey {
+		if _, ok := apiKeys(o).Match(key); !ok || key == "" {
+			audit(o, r, AuditInvalidAPIKey, ErrInvalidApiKey.Message)
 			ErrorReply(r, w, ErrInvalidApiKey, o)
 			return
 		}
@@ -129,6 +219,44 @@ func authorizeClient(next http.Handler, o ServerOptions) http.Handler {
 	})
 }
 
+func filterClientIP(next http.Handler, o ServerOptions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isClientIPAllowed(r, o.AllowedIPs, o.DeniedIPs) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		audit(o, r, AuditClientIPDenied, ErrClientIPNotAllowed.Message)
+		ErrorReply(r, w, ErrClientIPNotAllowed, o)
+	})
+}
+
+// isClientIPAllowed reports whether the request remote address passes the given
+// access lists. Deny rules take precedence, and a non-empty allow list must match.
+func isClientIPAllowed(r *http.Request, allowed, denied []*net.IPNet) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if containsIP(denied, ip) {
+		return false
+	}
+	return len(allowed) == 0 || containsIP(allowed, ip)
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 func defaultHeaders(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Server", fmt.Sprintf("imaginary %s (bimg %s)", Version, bimg.Version))
@@ -136,33 +264,23 @@ func defaultHeaders(next http.Handler) http.Handler {
 	})
 }
 
-func setCacheHeaders(next http.Handler, ttl int) http.Handler {
+func setCacheHeaders(next http.Handler, o ServerOptions) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		defer next.ServeHTTP(w, r)
-
-		if r.Method != "GET" || isPublicPath(r.URL.Path) {
+		if r.Method != "GET" || isPublicPath(r.URL.Path) || explainRequested(r, o) {
+			next.ServeHTTP(w, r)
 			return
 		}
-
-		// Only add TTL headers if there are none set upstream
-		if w.Header().Get("Expires") == "" && w.Header().Get("Cache-Control") == "" {
-			ttlDiff := time.Duration(ttl) * time.Second
-			expires := time.Now().Add(ttlDiff)
-
-			w.Header().Add("Expires", strings.Replace(expires.Format(time.RFC1123), "UTC", "GMT", -1))
-			w.Header().Add("Cache-Control", getCacheControl(ttl))
+		if o.hasPresetCaches() {
+			r = withPresetCaches(r)
 		}
+		next.ServeHTTP(&cacheWriter{ResponseWriter: w, req: r, o: o}, r)
 	})
 }
 
-func getCacheControl(ttl int) string {
-	if ttl == 0 {
-		return "private, no-cache, no-store, must-revalidate"
-	}
-	return fmt.Sprintf("public, s-maxage=%d, max-age=%d, no-transform", ttl, ttl)
-}
-
 func isPublicPath(path string) bool {
+	if strings.HasPrefix(path, APIVersionPrefix+"/") {
+		path = strings.TrimPrefix(path, APIVersionPrefix)
+	}
 	return path == "/" || path == "/health" || path == "/form"
 }
 
@@ -173,23 +291,65 @@ func validateURLSignature(next http.Handler, o ServerOptions) http.Handler {
 		sign := query.Get("sign")
 		query.Del("sign")
 
-		// Compute expected URL signature
-		h := hmac.New(sha256.New, []byte(o.URLSignatureKey))
-		h.Write([]byte(r.URL.Path))
-		h.Write([]byte(query.Encode()))
-		expectedSign := h.Sum(nil)
-
 		urlSign, err := base64.RawURLEncoding.DecodeString(sign)
 		if err != nil {
+			audit(o, r, AuditInvalidSignature, ErrInvalidURLSignature.Message)
 			ErrorReply(r, w, ErrInvalidURLSignature, o)
 			return
 		}
 
-		if hmac.Equal(urlSign, expectedSign) == false {
+		// Compute expected URL signature with the key of the signed key id, if any
+		key, ok := urlSignatureKeys(o).Lookup(query.Get("keyid"))
+		if !ok || hmac.Equal(urlSign, computeURLSignature(key.Secret, r.URL.Path, query)) == false {
+			audit(o, r, AuditInvalidSignature, ErrURLSignatureMismatch.Message)
 			ErrorReply(r, w, ErrURLSignatureMismatch, o)
 			return
 		}
 
+		if err := checkURLExpiry(query.Get("expires"), o.URLSignatureTTL, time.Now()); err != nil {
+			audit(o, r, AuditInvalidSignature, err.Error())
+			ErrorReply(r, w, err.(Error), o)
+			return
+		}
+
 		next.ServeHTTP(w, r)
 	})
 }
+
+// computeURLSignature computes the HMAC digest of the given URL path and query params.
+func computeURLSignature(key, path string, query url.Values) []byte {
+	h := hmac.New(sha256.New, []byte(key))
+	h.Write([]byte(path))
+	h.Write([]byte(query.Encode()))
+	return h.Sum(nil)
+}
+
+// checkURLExpiry validates the signed expires param, a Unix timestamp in seconds, which is
+// required and cannot be further than the given maximum TTL in seconds, if defined.
+func checkURLExpiry(expires string, ttl int, now time.Time) error {
+	if expires == "" {
+		if ttl > 0 {
+			return ErrInvalidURLExpiry
+		}
+		return nil
+	}
+
+	timestamp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return ErrInvalidURLExpiry
+	}
+	if now.Unix() > timestamp {
+		return ErrURLSignatureExpired
+	}
+	if ttl > 0 && timestamp-now.Unix() > int64(ttl) {
+		return ErrInvalidURLExpiry
+	}
+	return nil
+}
+
+// signURL returns the given URL query params with the URL signature.
+func signURL(key, path string, query url.Values) url.Values {
+	query.Del("sign")
+	query.Set("sign", base64.RawURLEncoding.EncodeToString(computeURLSignature(key, path, query)))
+	return query
+}
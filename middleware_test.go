@@ -0,0 +1,177 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseIPNets(t *testing.T) {
+	nets, err := parseIPNets("10.0.0.0/8, 192.168.1.20,,::1")
+	if err != nil {
+		t.Fatalf("Cannot parse IP list: %s", err)
+	}
+	if len(nets) != 3 {
+		t.Fatalf("Invalid number of IP ranges: %d", len(nets))
+	}
+
+	if _, err := parseIPNets("10.0.0.0/33"); err == nil {
+		t.Error("Invalid CIDR range should fail")
+	}
+	if _, err := parseIPNets("foo"); err == nil {
+		t.Error("Invalid IP address should fail")
+	}
+}
+
+func TestIsClientIPAllowed(t *testing.T) {
+	allowed, _ := parseIPNets("10.0.0.0/8,::1")
+	denied, _ := parseIPNets("10.0.5.0/24")
+
+	cases := []struct {
+		remoteAddr string
+		allowed    []*net.IPNet
+		denied     []*net.IPNet
+		expected   bool
+	}{
+		{"10.1.2.3:1234", allowed, denied, true},
+		{"[::1]:1234", allowed, denied, true},
+		{"10.0.5.9:1234", allowed, denied, false},
+		{"192.168.1.1:1234", allowed, denied, false},
+		{"192.168.1.1:1234", nil, denied, true},
+		{"10.0.5.9:1234", nil, denied, false},
+		{"invalid", allowed, nil, false},
+	}
+
+	for _, test := range cases {
+		r := &http.Request{RemoteAddr: test.remoteAddr}
+		if isClientIPAllowed(r, test.allowed, test.denied) != test.expected {
+			t.Errorf("Invalid client IP access for %s: expected %t", test.remoteAddr, test.expected)
+		}
+	}
+}
+
+func TestAdminMiddlewareIPFilter(t *testing.T) {
+	denied, _ := parseIPNets("127.0.0.1")
+	opts := ServerOptions{DeniedIPs: denied}
+
+	ts := httptest.NewServer(AdminMiddleware(healthController, opts))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("Admin endpoint should not use data plane IP lists: %d", res.StatusCode)
+	}
+
+	opts = ServerOptions{AdminDeniedIPs: denied}
+	ts = httptest.NewServer(AdminMiddleware(healthController, opts))
+	defer ts.Close()
+
+	res, err = http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != 403 {
+		t.Fatalf("Invalid response status: %d", res.StatusCode)
+	}
+}
+
+func TestCORSPolicy(t *testing.T) {
+	opts := ServerOptions{
+		CORS:               true,
+		CORSAllowedOrigins: []string{"https://*.example.com"},
+		CORSExposedHeaders: []string{"Error"},
+		CORSMaxAge:         600,
+	}
+
+	ts := httptest.NewServer(Middleware(healthController, opts))
+	defer ts.Close()
+
+	req, _ := http.NewRequest("OPTIONS", ts.URL, nil)
+	req.Header.Set("Origin", "https://foo.example.com")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Header.Get("Access-Control-Allow-Origin") != "https://foo.example.com" {
+		t.Fatalf("Invalid allowed origin header: %s", res.Header.Get("Access-Control-Allow-Origin"))
+	}
+	if res.Header.Get("Access-Control-Max-Age") != "600" {
+		t.Fatalf("Invalid max age header: %s", res.Header.Get("Access-Control-Max-Age"))
+	}
+
+	req, _ = http.NewRequest("GET", ts.URL, nil)
+	req.Header.Set("Origin", "https://foo.com")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Header.Get("Access-Control-Allow-Origin") != "" {
+		t.Fatal("Origin should not be allowed")
+	}
+}
+
+func TestCheckURLExpiry(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	cases := []struct {
+		expires string
+		ttl     int
+		err     error
+	}{
+		{"", 0, nil},
+		{"", 60, ErrInvalidURLExpiry},
+		{"1500000060", 0, nil},
+		{"1500000060", 60, nil},
+		{"1500000061", 60, ErrInvalidURLExpiry},
+		{"1499999999", 0, ErrURLSignatureExpired},
+		{"tomorrow", 0, ErrInvalidURLExpiry},
+	}
+
+	for _, c := range cases {
+		if err := checkURLExpiry(c.expires, c.ttl, now); err != c.err {
+			t.Errorf("Invalid expiry validation of %q with TTL %d: %v", c.expires, c.ttl, err)
+		}
+	}
+}
+
+func TestValidateURLSignatureExpiry(t *testing.T) {
+	opts := ServerOptions{URLSignatureKey: "4f46feebafc4b5e988f131c4ff8b5997"}
+	handler := validateURLSignature(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}), opts)
+
+	cases := []struct {
+		expires int64
+		status  int
+	}{
+		{time.Now().Add(time.Hour).Unix(), 200},
+		{time.Now().Add(-time.Hour).Unix(), 403},
+	}
+
+	for _, c := range cases {
+		query := url.Values{"width": {"300"}, "expires": {strconv.FormatInt(c.expires, 10)}}
+		query = signURL(opts.URLSignatureKey, "/resize", query)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/resize?"+query.Encode(), nil))
+		if w.Code != c.status {
+			t.Errorf("Invalid response status for expiry %d: %d", c.expires, w.Code)
+		}
+	}
+
+	// Tampering the expiry invalidates the signature
+	query := signURL(opts.URLSignatureKey, "/resize", url.Values{"expires": {"1500000000"}})
+	query.Set("expires", strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/resize?"+query.Encode(), nil))
+	if w.Code != 403 {
+		t.Errorf("Invalid response status for a tampered expiry: %d", w.Code)
+	}
+}
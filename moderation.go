@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Content moderation actions of the flagged images
+const (
+	ModerationFlag  = "flag"
+	ModerationBlock = "block"
+)
+
+// Content moderation response headers of the verdict and the score of the flagged images
+const (
+	ModerationHeader      = "X-Imaginary-Moderation"
+	ModerationScoreHeader = "X-Imaginary-Moderation-Score"
+)
+
+// Content moderation verdicts, exposed via the ModerationHeader response header
+const (
+	ModerationSafe    = "safe"
+	ModerationFlagged = "flagged"
+	ModerationError   = "error"
+)
+
+// moderationDefaultThreshold is the default score from which images are flagged
+const moderationDefaultThreshold = 0.8
+
+// ErrModerationBlocked is returned when the image is blocked by the content moderation
+var ErrModerationBlocked = NewError("Image rejected by the content moderation", Forbidden)
+
+// ModerationResult represents the content classification of an image, where the score is the
+// probability, between 0 and 1, of the image being unsafe, such as NSFW content.
+type ModerationResult struct {
+	Score  float64  `json:"score"`
+	Labels []string `json:"labels,omitempty"`
+}
+
+// Moderator defines the interface of the content classification services, classifying the
+// images within the given context lifetime.
+type Moderator interface {
+	Classify(ctx context.Context, buf []byte, mimeType string) (ModerationResult, error)
+}
+
+var moderationClient = &http.Client{Timeout: 10 * time.Second}
+
+// HTTPModerator classifies the images via an external service, posting the image bytes
+// to its URL, which replies the classification result as JSON.
+type HTTPModerator struct {
+	URL string
+}
+
+// Classify sends the image to the classification service.
+func (m *HTTPModerator) Classify(ctx context.Context, buf []byte, mimeType string) (ModerationResult, error) {
+	var result ModerationResult
+
+	req, err := http.NewRequest("POST", m.URL, bytes.NewReader(buf))
+	if err != nil {
+		return result, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", mimeType)
+	req.Header.Set("User-Agent", "imaginary/"+Version)
+
+	res, err := moderationClient.Do(req)
+	if err != nil {
+		return result, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		return result, fmt.Errorf("invalid response status: %d", res.StatusCode)
+	}
+
+	err = json.NewDecoder(res.Body).Decode(&result)
+	return result, err
+}
+
+// ModerationOptions represents the content moderation params.
+type ModerationOptions struct {
+	Moderator Moderator
+	Action    string
+	Threshold float64
+}
+
+// moderate classifies the source image, if a moderator is configured, before processing it,
+// exposing the verdict via the ModerationHeader response header, and reports whether the
+// processing can continue. Flagged images, and images that cannot be classified, are
+// rejected with an error reply if the block action is configured.
+func moderate(w http.ResponseWriter, r *http.Request, buf []byte, mimeType string, o ServerOptions) bool {
+	return moderateImages(w, r, [][]byte{buf}, []string{mimeType}, o)
+}
+
+// moderateImages classifies every given source image of the given MIME types, as moderate
+// does, exposing the verdict of the most unsafe image, so a single flagged image flags the
+// image composed of them all. The classification requests are bound to the request lifetime.
+func moderateImages(w http.ResponseWriter, r *http.Request, images [][]byte, mimeTypes []string, o ServerOptions) bool {
+	m := o.Moderation
+	if m.Moderator == nil {
+		return true
+	}
+
+	threshold := m.Threshold
+	if threshold == 0 {
+		threshold = moderationDefaultThreshold
+	}
+
+	verdict, score := ModerationSafe, 0.0
+	for i, buf := range images {
+		result, err := m.Moderator.Classify(r.Context(), buf, mimeTypes[i])
+		if err != nil {
+			debug("cannot classify the image: %s", err)
+			if verdict == ModerationSafe {
+				verdict = ModerationError
+			}
+			continue
+		}
+		if result.Score >= threshold && result.Score >= score {
+			verdict, score = ModerationFlagged, result.Score
+		}
+	}
+
+	w.Header().Set(ModerationHeader, verdict)
+	switch {
+	case verdict == ModerationError && m.Action == ModerationBlock:
+		ErrorReply(r, w, NewError("Content moderation is unavailable", Unavailable), o)
+		return false
+	case verdict == ModerationFlagged:
+		w.Header().Set(ModerationScoreHeader, fmt.Sprintf("%.2f", score))
+		if m.Action == ModerationBlock {
+			audit(o, r, AuditModerationBlocked, fmt.Sprintf("image score %.2f", score))
+			ErrorReply(r, w, ErrModerationBlocked, o)
+			return false
+		}
+	}
+	return true
+}
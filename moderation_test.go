@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+type moderatorFunc func([]byte, string) (ModerationResult, error)
+
+func (f moderatorFunc) Classify(ctx context.Context, buf []byte, mimeType string) (ModerationResult, error) {
+	return f(buf, mimeType)
+}
+
+func TestHTTPModerator(t *testing.T) {
+	ts := testServer(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.Header.Get("Content-Type") != "image/jpeg" {
+			t.Errorf("Invalid classification request: %s %s", r.Method, r.Header.Get("Content-Type"))
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if string(body) != "image" {
+			t.Errorf("Invalid classification request body: %s", body)
+		}
+		w.Write([]byte(`{"score": 0.93, "labels": ["nsfw"]}`))
+	})
+	defer ts.Close()
+
+	result, err := (&HTTPModerator{URL: ts.URL}).Classify(context.Background(), []byte("image"), "image/jpeg")
+	if err != nil {
+		t.Fatalf("Cannot classify the image: %s", err)
+	}
+	if result.Score != 0.93 || len(result.Labels) != 1 || result.Labels[0] != "nsfw" {
+		t.Errorf("Invalid classification result: %+v", result)
+	}
+}
+
+func TestModeration(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+	score := 0.0
+	moderator := moderatorFunc(func(buf []byte, mimeType string) (ModerationResult, error) {
+		if score < 0 {
+			return ModerationResult{}, errors.New("unavailable")
+		}
+		return ModerationResult{Score: score}, nil
+	})
+
+	cases := []struct {
+		action  string
+		score   float64
+		status  int
+		verdict string
+	}{
+		{ModerationFlag, 0.1, http.StatusOK, ModerationSafe},
+		{ModerationFlag, 0.9, http.StatusOK, ModerationFlagged},
+		{ModerationFlag, -1, http.StatusOK, ModerationError},
+		{ModerationBlock, 0.1, http.StatusOK, ModerationSafe},
+		{ModerationBlock, 0.9, http.StatusForbidden, ModerationFlagged},
+		{ModerationBlock, -1, http.StatusServiceUnavailable, ModerationError},
+	}
+
+	for _, c := range cases {
+		score = c.score
+		o := ServerOptions{Moderation: ModerationOptions{Moderator: moderator, Action: c.action}}
+		ts := testServer(func(w http.ResponseWriter, r *http.Request) {
+			imageHandler(w, r, buf, Resize, o, nil)
+		})
+
+		res, err := http.Get(ts.URL + "?width=200")
+		if err != nil {
+			t.Fatal("Cannot perform the request")
+		}
+		res.Body.Close()
+		ts.Close()
+
+		if res.StatusCode != c.status {
+			t.Errorf("Invalid response status of %s action and %g score: %d", c.action, c.score, res.StatusCode)
+		}
+		if verdict := res.Header.Get(ModerationHeader); verdict != c.verdict {
+			t.Errorf("Invalid moderation verdict of %s action and %g score: %s", c.action, c.score, verdict)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// maxImages is the maximum number of images composing a montage or a document
+const maxImages = 36
+
+// montageDefaultTileSize is the montage tiles size, if no width is defined
+const montageDefaultTileSize = 300
+
+// ErrTooManyImages is returned when the montage or document exceeds the maximum number of images
+var ErrTooManyImages = NewError(fmt.Sprintf("Requests are limited to %d images", maxImages), BadRequest)
+
+// MultiOperation represents an operation composing a single image from multiple images
+type MultiOperation func([][]byte, ImageOptions) (Image, error)
+
+// montageController composes a montage from the multiple image sources defined via
+// repeated url or file query params, or the repeated multipart form field files.
+func montageController(o ServerOptions) func(http.ResponseWriter, *http.Request) {
+	return multiImageController(o, Montage)
+}
+
+// multiImageController runs the given operation with the multiple image sources defined
+// via repeated url or file query params, or the repeated multipart form field files.
+func multiImageController(o ServerOptions, operation MultiOperation) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		images, err := readImages(r)
+		if replyContextError(r, w, o) {
+			return
+		}
+		if err != nil {
+			if e, ok := err.(Error); ok {
+				ErrorReply(r, w, e, o)
+				return
+			}
+			auditSourceError(o, r, err)
+			ErrorReply(r, w, NewSourceError("", err), o)
+			return
+		}
+
+		// Wait for a processing slot by priority class once the images are read, before decoding
+		// them, releasing it once the request ends, unless handed over to the operation
+		if o.ProcessingQueue.Acquire(r.Context(), requestPriority(r, o)) != nil {
+			replyContextError(r, w, o)
+			return
+		}
+		queued := true
+		defer func() {
+			if queued {
+				o.ProcessingQueue.Release()
+			}
+		}()
+
+		for i, buf := range images {
+			if len(buf) == 0 {
+				ErrorReply(r, w, ErrEmptyBody, o)
+				return
+			}
+			if err := o.InputLimits.Check(buf); err != nil {
+				audit(o, r, AuditOversizedInput, err.Error())
+				ErrorReply(r, w, err.(Error), o)
+				return
+			}
+			if isICO(buf) {
+				if images[i], err = decodeICO(buf); err != nil {
+					ErrorReply(r, w, NewError(err.Error(), BadRequest), o)
+					return
+				}
+			} else if isLegacyImage(buf) {
+				if images[i], err = decodeLegacyImage(buf, o.InputLimits.MaxLegacyPixels); err != nil {
+					if e, ok := err.(Error); ok {
+						ErrorReply(r, w, e, o)
+						return
+					}
+					ErrorReply(r, w, NewError(err.Error(), BadRequest), o)
+					return
+				}
+			}
+		}
+
+		// Classify every source image via the content moderation service, if configured
+		mimeTypes := make([]string, len(images))
+		for i, buf := range images {
+			mimeTypes[i] = detectMimeType(buf)
+		}
+		if !moderateImages(w, r, images, mimeTypes, o) {
+			return
+		}
+
+		// The operation runs within the processing deadline, as the single image operations
+		run := Operation(func(_ []byte, opts ImageOptions) (Image, error) {
+			return operation(images, opts)
+		})
+		queued = false
+		image, err := runOperation(r.Context(), run, nil, readParams(r.URL.Query()), o.ProcessingQueue.Release)
+		if replyContextError(r, w, o) {
+			return
+		}
+		if err != nil {
+			if e, ok := err.(Error); ok {
+				ErrorReply(r, w, e, o)
+				return
+			}
+			ErrorReply(r, w, NewError("Error while processing the image: "+err.Error(), BadRequest), o)
+			return
+		}
+		replyImage(w, image)
+	}
+}
+
+// readImages reads the multiple images, fetching concurrently each
+// one of the GET request sources via the registered image sources.
+func readImages(r *http.Request) ([][]byte, error) {
+	if r.Method != "GET" {
+		return readFormImages(r)
+	}
+
+	query := r.URL.Query()
+	key := "url"
+	if len(query[key]) == 0 {
+		key = "file"
+	}
+	sources := query[key]
+	if len(sources) == 0 {
+		return nil, ErrMissingImageSource
+	}
+	if len(sources) > maxImages {
+		return nil, ErrTooManyImages
+	}
+
+	// Each image is read via a request copy defining only one source
+	requests := make([]*http.Request, len(sources))
+	for i, source := range sources {
+		req := new(http.Request)
+		*req = *r
+		u := *r.URL
+		u.RawQuery = url.Values{key: []string{source}}.Encode()
+		req.URL = &u
+		if MatchSource(req) == nil {
+			return nil, ErrMissingImageSource
+		}
+		requests[i] = req
+	}
+
+	images := make([][]byte, len(sources))
+	errs := make([]error, len(sources))
+
+	var wg sync.WaitGroup
+	for i, req := range requests {
+		wg.Add(1)
+		go func(i int, req *http.Request) {
+			defer wg.Done()
+			images[i], errs[i] = MatchSource(req).GetImage(req)
+		}(i, req)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return images, nil
+}
+
+func readFormImages(r *http.Request) ([][]byte, error) {
+	if !isFormBody(r) {
+		return nil, NewError("Images must be sent as multipart/form-data payload", BadRequest)
+	}
+	if err := r.ParseMultipartForm(maxMemory); err != nil {
+		return nil, err
+	}
+
+	files := r.MultipartForm.File[formField(r)]
+	if len(files) == 0 {
+		return nil, ErrMissingImageSource
+	}
+	if len(files) > maxImages {
+		return nil, ErrTooManyImages
+	}
+
+	images := make([][]byte, len(files))
+	for i, header := range files {
+		file, err := header.Open()
+		if err != nil {
+			return nil, err
+		}
+		images[i], err = readAll(file, int(header.Size))
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return images, nil
+}
+
+// parseMontageGrid parses the grid layout as columns x rows, such as 3x2, defaulting
+// to the most squared grid fitting the given number of images.
+func parseMontageGrid(grid string, images int) (int, int, error) {
+	if grid == "" {
+		cols := int(math.Ceil(math.Sqrt(float64(images))))
+		return cols, (images + cols - 1) / cols, nil
+	}
+
+	parts := strings.Split(strings.ToLower(grid), "x")
+	if len(parts) != 2 {
+		return 0, 0, NewError("Invalid grid param: "+grid, BadRequest)
+	}
+	cols, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil || cols < 1 {
+		return 0, 0, NewError("Invalid grid param: "+grid, BadRequest)
+	}
+
+	// Rows can be omitted, such as 3x
+	rows := (images + cols - 1) / cols
+	if parts[1] != "" {
+		rows, err = strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || rows < 1 {
+			return 0, 0, NewError("Invalid grid param: "+grid, BadRequest)
+		}
+	}
+
+	if cols*rows < images {
+		return 0, 0, NewError(fmt.Sprintf("Grid %dx%d cannot fit %d images", cols, rows, images), BadRequest)
+	}
+	return cols, rows, nil
+}
+
+// montageTileSize returns the tile size fitting the given montage size,
+// or zero if the montage size is not defined.
+func montageTileSize(size, tiles, gap, margin int) int {
+	if size == 0 {
+		return 0
+	}
+	return (size - margin*2 - gap*(tiles-1)) / tiles
+}
+
+// Montage composes the given images into a grid, cropping each image to fill its
+// tile, with the gap between the tiles, the margin and background color defined.
+func Montage(images [][]byte, o ImageOptions) (Image, error) {
+	if len(images) == 0 {
+		return Image{}, ErrMissingImageSource
+	}
+	if len(images) > maxImages {
+		return Image{}, ErrTooManyImages
+	}
+
+	cols, rows, err := parseMontageGrid(o.Grid, len(images))
+	if err != nil {
+		return Image{}, err
+	}
+
+	tileWidth := montageTileSize(o.Width, cols, o.Gap, o.Margin)
+	tileHeight := montageTileSize(o.Height, rows, o.Gap, o.Margin)
+	if o.Width == 0 && o.Height == 0 {
+		tileWidth, tileHeight = montageDefaultTileSize, montageDefaultTileSize
+	} else if o.Width == 0 {
+		tileWidth = tileHeight
+	} else if o.Height == 0 {
+		tileHeight = tileWidth
+	}
+	if tileWidth < 1 || tileHeight < 1 {
+		return Image{}, NewError("Montage size is too small to fit the grid", BadRequest)
+	}
+
+	width := tileWidth*cols + o.Gap*(cols-1) + o.Margin*2
+	height := tileHeight*rows + o.Gap*(rows-1) + o.Margin*2
+	if err := checkCanvasSize(width, height); err != nil {
+		return Image{}, err
+	}
+
+	background := color.RGBA{0xff, 0xff, 0xff, 0xff}
+	if len(o.Background) == 3 {
+		background = color.RGBA{o.Background[0], o.Background[1], o.Background[2], 0xff}
+	}
+	canvas := newCanvas(width, height, background, background)
+
+	for i, buf := range images {
+		img, err := decodeImage(buf, bimg.Options{Width: tileWidth, Height: tileHeight, Crop: true, Enlarge: true, Gravity: o.Gravity})
+		if err != nil {
+			return Image{}, err
+		}
+		x := o.Margin + (i%cols)*(tileWidth+o.Gap)
+		y := o.Margin + (i/cols)*(tileHeight+o.Gap)
+		draw.Draw(canvas, image.Rect(x, y, x+tileWidth, y+tileHeight), img, img.Bounds().Min, draw.Over)
+	}
+
+	output := bimg.Options{Type: ImageType(o.Type), Quality: o.Quality, Compression: o.Compression}
+	if output.Type == bimg.UNKNOWN {
+		output.Type = bimg.DetermineImageType(images[0])
+	}
+	return encodeCanvas(canvas, output)
+}
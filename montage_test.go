@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseMontageGrid(t *testing.T) {
+	cases := []struct {
+		grid   string
+		images int
+		cols   int
+		rows   int
+		fail   bool
+	}{
+		{"", 1, 1, 1, false},
+		{"", 4, 2, 2, false},
+		{"", 5, 3, 2, false},
+		{"3x2", 6, 3, 2, false},
+		{"4x", 6, 4, 2, false},
+		{"2x2", 5, 0, 0, true},
+		{"x2", 2, 0, 0, true},
+		{"foo", 2, 0, 0, true},
+	}
+
+	for _, test := range cases {
+		cols, rows, err := parseMontageGrid(test.grid, test.images)
+		if test.fail {
+			if err == nil {
+				t.Errorf("Expected error for grid %q", test.grid)
+			}
+			continue
+		}
+		if err != nil || cols != test.cols || rows != test.rows {
+			t.Errorf("Invalid grid %q: %dx%d (%v)", test.grid, cols, rows, err)
+		}
+	}
+}
+
+func TestMontage(t *testing.T) {
+	jpg, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+	png, _ := ioutil.ReadAll(readFile("test.png"))
+	images := [][]byte{jpg, png, jpg}
+
+	cases := []struct {
+		options ImageOptions
+		width   int
+		height  int
+	}{
+		{ImageOptions{}, 600, 600},
+		{ImageOptions{Grid: "3x1", Width: 620, Gap: 10}, 620, 200},
+		{ImageOptions{Grid: "1x3", Height: 340, Gap: 15, Margin: 5}, 110, 340},
+		{ImageOptions{Width: 400, Height: 300}, 400, 300},
+	}
+
+	for _, test := range cases {
+		image, err := Montage(images, test.options)
+		if err != nil {
+			t.Fatalf("Cannot compose montage: %s", err)
+		}
+		if image.Mime != "image/jpeg" {
+			t.Errorf("Invalid image MIME type: %s", image.Mime)
+		}
+		if err := assertSize(image.Body, test.width, test.height); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if _, err := Montage(images, ImageOptions{Width: 10, Gap: 10}); err == nil {
+		t.Error("Expected too small montage error")
+	}
+}
+
+func TestMontageController(t *testing.T) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for _, file := range []string{"imaginary.jpg", "test.png"} {
+		part, _ := form.CreateFormFile("file", file)
+		buf, _ := ioutil.ReadAll(readFile(file))
+		part.Write(buf)
+	}
+	form.Close()
+
+	ts := testServer(montageController(ServerOptions{}))
+	defer ts.Close()
+
+	res, err := http.Post(ts.URL+"?grid=2x1&width=200&type=png", form.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("Invalid response status: %s", res.Status)
+	}
+	if res.Header.Get("Content-Type") != "image/png" {
+		t.Errorf("Invalid content type: %s", res.Header.Get("Content-Type"))
+	}
+
+	image, _ := ioutil.ReadAll(res.Body)
+	if err := assertSize(image, 200, 100); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMontageModeration(t *testing.T) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for _, file := range []string{"imaginary.jpg", "test.png"} {
+		part, _ := form.CreateFormFile("file", file)
+		buf, _ := ioutil.ReadAll(readFile(file))
+		part.Write(buf)
+	}
+	form.Close()
+
+	// A single flagged image blocks the whole montage
+	moderator := moderatorFunc(func(buf []byte, mimeType string) (ModerationResult, error) {
+		if mimeType == "image/png" {
+			return ModerationResult{Score: 0.9}, nil
+		}
+		return ModerationResult{Score: 0.1}, nil
+	})
+	ts := testServer(montageController(ServerOptions{Moderation: ModerationOptions{Moderator: moderator, Action: ModerationBlock}}))
+	defer ts.Close()
+
+	res, err := http.Post(ts.URL+"?grid=2x1&width=200", form.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden || res.Header.Get(ModerationHeader) != ModerationFlagged {
+		t.Errorf("The montages of flagged images should be blocked: %s", res.Status)
+	}
+}
+
+func TestMultiImageControllerTimeout(t *testing.T) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("file", "imaginary.jpg")
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+	part.Write(buf)
+	form.Close()
+
+	slow := func(images [][]byte, opts ImageOptions) (Image, error) {
+		time.Sleep(200 * time.Millisecond)
+		return Image{Body: images[0], Mime: "image/jpeg"}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	r := httptest.NewRequest("POST", "/montage", &body).WithContext(ctx)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	w := httptest.NewRecorder()
+	multiImageController(ServerOptions{}, slow)(w, r)
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("Invalid response status of expired operation: %d", w.Code)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OAuth2 token requests defaults
+const (
+	oauth2Timeout       = 10 * time.Second
+	oauth2RefreshMargin = 30 * time.Second
+)
+
+var oauth2Client = &http.Client{Timeout: oauth2Timeout}
+
+// OAuth2Credential represents the OAuth2 client credentials grant of an image source server
+// protected by an identity provider, whose access token is cached and refreshed before its
+// expiry, used as the origin requests bearer token.
+type OAuth2Credential struct {
+	TokenURL     string   `json:"tokenUrl"`
+	ClientID     string   `json:"clientId"`
+	ClientSecret string   `json:"clientSecret"`
+	Scopes       []string `json:"scopes"`
+	Audience     string   `json:"audience"`
+
+	mutex   sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// oauth2Token represents the token endpoint response
+type oauth2Token struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// load validates the credential
+func (c *OAuth2Credential) load() error {
+	if c.ClientID == "" || c.ClientSecret == "" {
+		return fmt.Errorf("missing OAuth2 client id or secret")
+	}
+	if u, err := url.Parse(c.TokenURL); err != nil || u.Host == "" {
+		return fmt.Errorf("invalid OAuth2 token URL: %s", c.TokenURL)
+	}
+	return nil
+}
+
+// Token returns the cached access token, requesting a new one if the cached token
+// expired or expires within the refresh margin.
+func (c *OAuth2Credential) Token() (string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.token != "" && (c.expires.IsZero() || time.Now().Add(oauth2RefreshMargin).Before(c.expires)) {
+		return c.token, nil
+	}
+
+	token, err := c.requestToken()
+	if err != nil {
+		return "", err
+	}
+	c.token = token.AccessToken
+	c.expires = time.Time{}
+	if token.ExpiresIn > 0 {
+		c.expires = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	}
+	return c.token, nil
+}
+
+// requestToken requests an access token via the client credentials grant, authenticating
+// the client via HTTP basic auth.
+func (c *OAuth2Credential) requestToken() (oauth2Token, error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(c.Scopes) > 0 {
+		form.Set("scope", strings.Join(c.Scopes, " "))
+	}
+	if c.Audience != "" {
+		form.Set("audience", c.Audience)
+	}
+
+	req, err := http.NewRequest("POST", c.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return oauth2Token{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", "imaginary/"+Version)
+	req.SetBasicAuth(url.QueryEscape(c.ClientID), url.QueryEscape(c.ClientSecret))
+
+	res, err := oauth2Client.Do(req)
+	if err != nil {
+		return oauth2Token{}, fmt.Errorf("Cannot request the OAuth2 token: %s", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return oauth2Token{}, fmt.Errorf("Cannot request the OAuth2 token: (status=%d) (url=%s)", res.StatusCode, c.TokenURL)
+	}
+
+	var token oauth2Token
+	if err := json.NewDecoder(res.Body).Decode(&token); err != nil {
+		return oauth2Token{}, fmt.Errorf("Invalid OAuth2 token response: %s", err)
+	}
+	if token.AccessToken == "" {
+		return oauth2Token{}, fmt.Errorf("Invalid OAuth2 token response: missing access token")
+	}
+	if token.TokenType != "" && !strings.EqualFold(token.TokenType, "bearer") {
+		return oauth2Token{}, fmt.Errorf("Unsupported OAuth2 token type: %s", token.TokenType)
+	}
+	return token, nil
+}
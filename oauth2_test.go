@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestOAuth2CredentialToken(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		user, password, _ := r.BasicAuth()
+		if r.Method != "POST" || user != "imaginary" || password != "secret" {
+			w.WriteHeader(401)
+			return
+		}
+		if r.FormValue("grant_type") != "client_credentials" || r.FormValue("scope") != "images:read images:list" {
+			w.WriteHeader(400)
+			return
+		}
+		fmt.Fprintf(w, `{"access_token": "token%d", "token_type": "Bearer", "expires_in": 3600}`, requests)
+	}))
+	defer ts.Close()
+
+	credential := &OAuth2Credential{TokenURL: ts.URL, ClientID: "imaginary", ClientSecret: "secret", Scopes: []string{"images:read", "images:list"}}
+	if err := credential.load(); err != nil {
+		t.Fatalf("Invalid credential: %s", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		token, err := credential.Token()
+		if err != nil {
+			t.Fatalf("Cannot request the token: %s", err)
+		}
+		if token != "token1" || requests != 1 {
+			t.Errorf("Expected the cached token: %s (%d requests)", token, requests)
+		}
+	}
+
+	// Tokens are refreshed before their expiry
+	credential.expires = time.Now().Add(10 * time.Second)
+	if token, _ := credential.Token(); token != "token2" {
+		t.Errorf("Expected the refreshed token: %s", token)
+	}
+
+	req := &http.Request{Header: make(http.Header)}
+	if err := (OriginCredential{OAuth2: credential}).apply(req); err != nil {
+		t.Fatalf("Cannot apply the credential: %s", err)
+	}
+	if req.Header.Get("Authorization") != "Bearer token2" {
+		t.Errorf("Invalid Authorization header: %s", req.Header.Get("Authorization"))
+	}
+
+	invalid := &OAuth2Credential{TokenURL: ts.URL, ClientID: "imaginary", ClientSecret: "invalid"}
+	if _, err := invalid.Token(); err == nil {
+		t.Error("Expected token request error")
+	}
+}
+
+func TestOAuth2CredentialLoad(t *testing.T) {
+	cases := []*OAuth2Credential{
+		{TokenURL: "https://auth.example.com/token", ClientID: "imaginary"},
+		{TokenURL: "/token", ClientID: "imaginary", ClientSecret: "secret"},
+	}
+	for _, c := range cases {
+		if err := c.load(); err == nil {
+			t.Errorf("Expected invalid credential error: %s", c.TokenURL)
+		}
+	}
+}
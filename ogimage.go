@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/draw"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// Social media card default size, as recommended for og:image
+const (
+	ogImageWidth  = 1200
+	ogImageHeight = 630
+)
+
+// OGText represents a social media card text style.
+type OGText struct {
+	Font  string `json:"font"`
+	Color string `json:"color"`
+}
+
+// OGTemplate represents a social media card template, defined server side.
+type OGTemplate struct {
+	Width          int     `json:"width"`
+	Height         int     `json:"height"`
+	Padding        int     `json:"padding"`
+	Align          string  `json:"align"`
+	Background     string  `json:"background"`
+	Gradient       string  `json:"gradient"`
+	Overlay        string  `json:"overlay"`
+	OverlayOpacity float64 `json:"overlayOpacity"`
+	Logo           string  `json:"logo"`
+	LogoWidth      int     `json:"logoWidth"`
+	Title          OGText  `json:"title"`
+	Subtitle       OGText  `json:"subtitle"`
+	logo           image.Image
+}
+
+// DefaultOGTemplate is the template used if no templates file is defined.
+var DefaultOGTemplate = OGTemplate{
+	Width:          ogImageWidth,
+	Height:         ogImageHeight,
+	Padding:        80,
+	Align:          "left",
+	Background:     "1e293b",
+	Overlay:        "000",
+	OverlayOpacity: 0.5,
+	LogoWidth:      160,
+	Title:          OGText{Font: "sans bold 64", Color: "fff"},
+	Subtitle:       OGText{Font: "sans 36", Color: "cbd5e1"},
+}
+
+// LoadOGTemplates reads the social media card templates JSON file, which maps
+// template names to templates. Undefined template fields use the default values.
+func LoadOGTemplates(path string) (map[string]*OGTemplate, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := map[string]json.RawMessage{}
+	if err := json.Unmarshal(buf, &raw); err != nil {
+		return nil, err
+	}
+
+	templates := make(map[string]*OGTemplate, len(raw))
+	for name, data := range raw {
+		template := DefaultOGTemplate
+		if err := json.Unmarshal(data, &template); err != nil {
+			return nil, fmt.Errorf("invalid template %s: %s", name, err)
+		}
+		if err := template.load(); err != nil {
+			return nil, fmt.Errorf("invalid template %s: %s", name, err)
+		}
+		templates[name] = &template
+	}
+	return templates, nil
+}
+
+func (t *OGTemplate) load() error {
+	if err := checkCanvasSize(t.Width, t.Height); err != nil {
+		return err
+	}
+	if t.Logo == "" {
+		return nil
+	}
+
+	buf, err := ioutil.ReadFile(t.Logo)
+	if err != nil {
+		return err
+	}
+	t.logo, err = decodeImage(buf, bimg.Options{Width: t.LogoWidth})
+	return err
+}
+
+// ogTemplate returns the requested template, or the default one.
+func ogTemplate(o ServerOptions, name string) (*OGTemplate, bool) {
+	if name == "" {
+		name = "default"
+	}
+	if len(o.OGTemplates) == 0 {
+		return &DefaultOGTemplate, name == "default"
+	}
+	template, ok := o.OGTemplates[name]
+	return template, ok
+}
+
+// ogimageController composes a social media card from a template, with the title
+// and subtitle texts, using the image source as background, if present.
+func ogimageController(o ServerOptions) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		template, ok := ogTemplate(o, query.Get("template"))
+		if !ok {
+			ErrorReply(r, w, NewError("Unknown template: "+query.Get("template"), BadRequest), o)
+			return
+		}
+
+		operation := OGImage(template, query.Get("title"), query.Get("subtitle"))
+		if MatchSource(r) != nil {
+			validateImage(http.HandlerFunc(imageController(o, operation)), o).ServeHTTP(w, r)
+			return
+		}
+
+		image, err := runQueuedOperation(r, operation, nil, readParams(query), o)
+		if replyContextError(r, w, o) {
+			return
+		}
+		if err != nil {
+			ErrorReply(r, w, NewError("Error while processing the image: "+err.Error(), BadRequest), o)
+			return
+		}
+		replyImage(w, image)
+	}
+}
+
+// OGImage returns the operation composing a social media card, using the
+// given image buffer as background, if not empty.
+func OGImage(t *OGTemplate, title, subtitle string) Operation {
+	return func(buf []byte, o ImageOptions) (Image, error) {
+		background := parseCanvasColor(t.Background, color.RGBA{0, 0, 0, 0xff})
+		canvas := newCanvas(t.Width, t.Height, background, parseCanvasColor(t.Gradient, background))
+
+		if len(buf) > 0 {
+			img, err := decodeImage(buf, bimg.Options{Width: t.Width, Height: t.Height, Crop: true, Enlarge: true, Gravity: o.Gravity})
+			if err != nil {
+				return Image{}, err
+			}
+			draw.Draw(canvas, canvas.Bounds(), img, img.Bounds().Min, draw.Src)
+
+			if t.OverlayOpacity > 0 {
+				overlay := parseCanvasColor(t.Overlay, color.RGBA{0, 0, 0, 0xff})
+				opacity := &image.Uniform{color.Alpha{uint8(255 * t.OverlayOpacity)}}
+				draw.DrawMask(canvas, canvas.Bounds(), &image.Uniform{overlay}, image.ZP, opacity, image.ZP, draw.Over)
+			}
+		}
+
+		align := textAlignLeft
+		switch strings.ToLower(t.Align) {
+		case "centre", "center":
+			align = textAlignCentre
+		case "right":
+			align = textAlignRight
+		}
+		alignX := func(width int) int {
+			switch align {
+			case textAlignCentre:
+				return (t.Width - width) / 2
+			case textAlignRight:
+				return t.Width - t.Padding - width
+			}
+			return t.Padding
+		}
+
+		top := t.Padding
+		if t.logo != nil {
+			bounds := t.logo.Bounds()
+			x := alignX(bounds.Dx())
+			draw.Draw(canvas, image.Rect(x, t.Padding, x+bounds.Dx(), t.Padding+bounds.Dy()), t.logo, bounds.Min, draw.Over)
+			top += bounds.Dy() + t.Padding/2
+		}
+
+		// Render the wrapped texts, vertically centered below the logo
+		texts := []struct {
+			text  string
+			style OGText
+		}{{title, t.Title}, {subtitle, t.Subtitle}}
+
+		masks := []*image.Alpha{}
+		colors := []color.RGBA{}
+		height := 0
+		for _, text := range texts {
+			if text.text == "" {
+				continue
+			}
+			if len(masks) > 0 {
+				height += t.Padding / 4
+			}
+			// libvips parses the text as Pango markup, so the user defined texts are escaped
+			mask, err := vipsTextMask(html.EscapeString(text.text), text.style.Font, t.Width-t.Padding*2, align)
+			if err != nil {
+				return Image{}, err
+			}
+			masks = append(masks, mask)
+			colors = append(colors, parseCanvasColor(text.style.Color, color.RGBA{0xff, 0xff, 0xff, 0xff}))
+			height += mask.Bounds().Dy()
+		}
+
+		y := (t.Height - height) / 2
+		if y < top {
+			y = top
+		}
+		for i, mask := range masks {
+			drawMask(canvas, mask, colors[i], alignX(mask.Bounds().Dx()), y)
+			y += mask.Bounds().Dy() + t.Padding/4
+		}
+
+		return encodeCanvas(canvas, bimg.Options{Type: ImageType(o.Type), Quality: o.Quality})
+	}
+}
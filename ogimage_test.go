@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadOGTemplates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imaginary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "templates.json")
+	data := `{"blog": {"background": "fff", "logo": "testdata/test.png", "logoWidth": 100, "title": {"color": "000"}}}`
+	ioutil.WriteFile(path, []byte(data), 0644)
+
+	templates, err := LoadOGTemplates(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template, ok := templates["blog"]
+	if !ok {
+		t.Fatal("Missing template")
+	}
+	if template.Background != "fff" || template.Title.Color != "000" || template.Title.Font != DefaultOGTemplate.Title.Font {
+		t.Errorf("Invalid template: %#v", template)
+	}
+	if template.logo == nil || template.logo.Bounds().Dx() != 100 {
+		t.Errorf("Invalid template logo")
+	}
+
+	if _, ok := ogTemplate(ServerOptions{OGTemplates: templates}, ""); ok {
+		t.Error("Unexpected default template")
+	}
+
+	ioutil.WriteFile(path, []byte(`{"blog": {"width": 100000}}`), 0644)
+	if _, err := LoadOGTemplates(path); err == nil {
+		t.Error("Expected invalid template error")
+	}
+}
+
+func TestOGImage(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("large.jpg"))
+	operation := OGImage(&DefaultOGTemplate, "Hello world", "A long subtitle which must be wrapped within the card width")
+
+	for _, source := range [][]byte{nil, buf} {
+		img, err := operation(source, ImageOptions{Type: "jpeg"})
+		if err != nil {
+			t.Fatalf("Cannot compose the card: %s", err)
+		}
+		if img.Mime != "image/jpeg" {
+			t.Errorf("Invalid MIME type: %s", img.Mime)
+		}
+		if err := assertSize(img.Body, ogImageWidth, ogImageHeight); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// The texts are not parsed as Pango markup
+	operation = OGImage(&DefaultOGTemplate, "Tom & Jerry <b>", "</span> <i>unbalanced")
+	if _, err := operation(nil, ImageOptions{Type: "png"}); err != nil {
+		t.Errorf("Cannot compose the card of markup texts: %s", err)
+	}
+}
+
+func TestOGImageController(t *testing.T) {
+	ts := testServer(ogimageController(ServerOptions{}))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "?title=Hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != 200 || res.Header.Get("Content-Type") != "image/png" {
+		t.Fatalf("Invalid response: %s %s", res.Status, res.Header.Get("Content-Type"))
+	}
+
+	res, err = http.Get(ts.URL + "?title=Hello&template=foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != 400 {
+		t.Fatalf("Invalid response status: %s", res.Status)
+	}
+}
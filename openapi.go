@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// openAPIVersion is the OpenAPI specification version of the generated document
+const openAPIVersion = "3.0.3"
+
+// openAPIKindSchemas are the OpenAPI schemas of the param kinds parsed by parseParam
+var openAPIKindSchemas = map[string]map[string]interface{}{
+	"int":        {"type": "integer", "minimum": 0},
+	"float":      {"type": "number", "minimum": 0},
+	"bool":       {"type": "boolean"},
+	"string":     {"type": "string"},
+	"color":      {"type": "string", "pattern": "^\\d{1,3}(,\\d{1,3}){0,3}$", "example": "255,200,150"},
+	"colorspace": {"type": "string", "enum": []string{"srgb", "bw"}},
+	"gravity":    {"type": "string", "enum": sortedKeys(gravities)},
+	"extend":     {"type": "string", "enum": sortedKeys(extendModes)},
+	"json":       {"type": "string", "format": "json", "description": "JSON encoded pipeline operations"},
+}
+
+// openAPISourceParams are the source, authorization and signature query params
+// of the image endpoints, defined in addition to the allowed image params.
+var openAPISourceParams = []map[string]interface{}{
+	{"name": "url", "in": "query", "description": "Remote source image URL, if enabled via -enable-url-source", "schema": map[string]interface{}{"type": "string", "format": "uri"}},
+	{"name": "file", "in": "query", "description": "Source image path of the -mount directory", "schema": map[string]interface{}{"type": "string"}},
+	{"name": CacheVersionParam, "in": "query", "description": "Source image version, caching the response forever", "schema": map[string]interface{}{"type": "string"}},
+	{"name": "sign", "in": "query", "description": "URL signature, if enabled via -enable-url-signature", "schema": map[string]interface{}{"type": "string"}},
+	{"name": "keyid", "in": "query", "description": "URL signature key id, if the URL signature keys are rotated", "schema": map[string]interface{}{"type": "string"}},
+	{"name": "expires", "in": "query", "description": "URL signature expiry Unix timestamp", "schema": map[string]interface{}{"type": "integer"}},
+}
+
+// sortedKeys returns the sorted keys of the given map of string keys
+func sortedKeys(m interface{}) []string {
+	keys := []string{}
+	for _, key := range reflect.ValueOf(m).MapKeys() {
+		keys = append(keys, key.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// openAPIParamSchema returns the OpenAPI schema of the given image param, accepting
+// percentages for the relative dimension params and auto for the quality param.
+func openAPIParamSchema(name, kind string) map[string]interface{} {
+	schema := openAPIKindSchemas[kind]
+	if _, ok := relativeParams[name]; ok {
+		return map[string]interface{}{"oneOf": []interface{}{schema, map[string]interface{}{"type": "string", "pattern": "^\\d+(\\.\\d+)?%$"}}}
+	}
+	if name == "quality" {
+		return map[string]interface{}{"oneOf": []interface{}{schema, map[string]interface{}{"type": "string", "enum": []string{"auto"}}}}
+	}
+	return schema
+}
+
+// openAPIErrorStatuses returns the HTTP statuses of the error codes, described by the error responses
+func openAPIErrorStatuses() []int {
+	statuses := map[int]bool{}
+	for code := Unavailable; code <= TooManyRequests; code++ {
+		statuses[Error{Code: code}.HTTPCode()] = true
+	}
+	list := []int{}
+	for status := range statuses {
+		list = append(list, status)
+	}
+	sort.Ints(list)
+	return list
+}
+
+// openAPIProblemCodes returns the problem codes of the error responses
+func openAPIProblemCodes() []string {
+	codes := map[string]bool{ProblemOriginDenied: true, ProblemOriginFetchFailed: true}
+	for _, code := range problemCodes {
+		codes[code] = true
+	}
+	return sortedKeys(codes)
+}
+
+// OpenAPIDocument generates the OpenAPI 3 document of the enabled image endpoints of the given
+// options, from the same allowed params and endpoints used by the params parsing and the server mux.
+func OpenAPIDocument(o ServerOptions) map[string]interface{} {
+	params := []interface{}{}
+	for _, param := range openAPISourceParams {
+		params = append(params, param)
+	}
+	for _, name := range sortedKeys(allowedParams) {
+		params = append(params, map[string]interface{}{
+			"name":   name,
+			"in":     "query",
+			"schema": openAPIParamSchema(name, allowedParams[name]),
+		})
+	}
+
+	responses := map[string]interface{}{
+		"200": map[string]interface{}{
+			"description": "Processed image, or JSON image metadata of the metadata endpoints",
+			"content": map[string]interface{}{
+				"image/*":          map[string]interface{}{"schema": map[string]interface{}{"type": "string", "format": "binary"}},
+				"application/json": map[string]interface{}{"schema": map[string]interface{}{"type": "object"}},
+			},
+		},
+	}
+	errors := map[string]interface{}{}
+	for _, status := range openAPIErrorStatuses() {
+		name := strings.Replace(http.StatusText(status), " ", "", -1)
+		errors[name] = map[string]interface{}{
+			"description": http.StatusText(status),
+			"content": map[string]interface{}{
+				ProblemContentType: map[string]interface{}{"schema": map[string]interface{}{"$ref": "#/components/schemas/Error"}},
+			},
+		}
+		responses[fmt.Sprintf("%d", status)] = map[string]interface{}{"$ref": "#/components/responses/" + name}
+	}
+
+	security := []interface{}{}
+	if o.APIKey != "" {
+		security = []interface{}{map[string][]string{"apiKeyHeader": {}}, map[string][]string{"apiKeyQuery": {}}}
+	}
+
+	paths := map[string]interface{}{}
+	for _, endpoint := range imageEndpoints(o) {
+		if o.Endpoints.Disabled(path.Base(endpoint.Path)) {
+			continue
+		}
+		name := strings.Trim(endpoint.Path, "/")
+		id := strings.Replace(name, "/", "-", -1)
+		operation := func(method string) map[string]interface{} {
+			op := map[string]interface{}{
+				"operationId": method + "-" + id,
+				"summary":     "Image " + name + " operation",
+				"tags":        []string{"image"},
+				"responses":   responses,
+				"security":    security,
+			}
+			if method == "post" {
+				op["requestBody"] = map[string]interface{}{
+					"required": true,
+					"content": map[string]interface{}{
+						"image/*":             map[string]interface{}{"schema": map[string]interface{}{"type": "string", "format": "binary"}},
+						"multipart/form-data": map[string]interface{}{"schema": map[string]interface{}{"type": "object", "properties": map[string]interface{}{formFieldName: map[string]interface{}{"type": "string", "format": "binary"}}}},
+					},
+				}
+			}
+			return op
+		}
+		paths[join(o, APIVersionPrefix+endpoint.Path)] = map[string]interface{}{
+			"parameters": params,
+			"get":        operation("get"),
+			"post":       operation("post"),
+		}
+	}
+
+	return map[string]interface{}{
+		"openapi": openAPIVersion,
+		"info": map[string]interface{}{
+			"title":       "imaginary",
+			"description": "Fast HTTP microservice for high-level image processing",
+			"version":     Version,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": map[string]interface{}{
+				"Error": map[string]interface{}{
+					"type":     "object",
+					"required": []string{"type", "title", "status", "code"},
+					"properties": map[string]interface{}{
+						"type":   map[string]interface{}{"type": "string", "format": "uri-reference"},
+						"title":  map[string]interface{}{"type": "string"},
+						"status": map[string]interface{}{"type": "integer"},
+						"detail": map[string]interface{}{"type": "string"},
+						"code":   map[string]interface{}{"type": "string", "enum": openAPIProblemCodes()},
+					},
+				},
+			},
+			"responses": errors,
+			"securitySchemes": map[string]interface{}{
+				"apiKeyHeader": map[string]interface{}{"type": "apiKey", "in": "header", "name": "API-Key"},
+				"apiKeyQuery":  map[string]interface{}{"type": "apiKey", "in": "query", "name": "key"},
+			},
+		},
+	}
+}
+
+// openAPIController replies with the OpenAPI document of the server
+func openAPIController(o ServerOptions) func(http.ResponseWriter, *http.Request) {
+	body, _ := json.Marshal(OpenAPIDocument(o))
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}
+}
+
+// runOpenAPI writes the OpenAPI document to the standard output, for generating client SDKs
+func runOpenAPI(args []string) {
+	flags := flag.NewFlagSet("openapi", flag.ExitOnError)
+	pathPrefix := flags.String("path-prefix", "/", "Url path prefix of the endpoints")
+	apiKey := flags.Bool("key", false, "Require the API key in every endpoint")
+	flags.Parse(args)
+
+	o := ServerOptions{PathPrefix: *pathPrefix}
+	if *apiKey {
+		o.APIKey = "required"
+	}
+	body, _ := json.MarshalIndent(OpenAPIDocument(o), "", "  ")
+	fmt.Fprintf(os.Stdout, "%s\n", body)
+}
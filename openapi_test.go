@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOpenAPIParamKinds(t *testing.T) {
+	for name, kind := range allowedParams {
+		if openAPIKindSchemas[kind] == nil {
+			t.Errorf("Missing OpenAPI schema of the %s param kind %s", name, kind)
+		}
+	}
+}
+
+func TestOpenAPIDocument(t *testing.T) {
+	o := ServerOptions{PathPrefix: "/api", APIKey: "secret", Endpoints: Endpoints{"crop"}}
+	buf, _ := json.Marshal(OpenAPIDocument(o))
+
+	var doc struct {
+		OpenAPI string `json:"openapi"`
+		Paths   map[string]struct {
+			Parameters []struct {
+				Name string `json:"name"`
+			} `json:"parameters"`
+			Get struct {
+				Responses map[string]interface{} `json:"responses"`
+				Security  []interface{}          `json:"security"`
+			} `json:"get"`
+		} `json:"paths"`
+	}
+	if err := json.Unmarshal(buf, &doc); err != nil {
+		t.Fatalf("Invalid OpenAPI document: %s", err)
+	}
+	if doc.OpenAPI != openAPIVersion {
+		t.Errorf("Invalid OpenAPI version: %s", doc.OpenAPI)
+	}
+
+	if _, ok := doc.Paths["/api/v1/crop"]; ok {
+		t.Error("Disabled endpoints should not be described")
+	}
+	for _, endpoint := range imageEndpoints(o) {
+		if endpoint.Path == "/crop" {
+			continue
+		}
+		item, ok := doc.Paths["/api/v1"+endpoint.Path]
+		if !ok {
+			t.Errorf("Missing endpoint %s", endpoint.Path)
+			continue
+		}
+		if len(item.Parameters) != len(allowedParams)+len(openAPISourceParams) {
+			t.Errorf("Invalid %s params: %d", endpoint.Path, len(item.Parameters))
+		}
+		if item.Get.Responses["400"] == nil || item.Get.Responses["200"] == nil || len(item.Get.Security) != 2 {
+			t.Errorf("Invalid %s operation: %#v", endpoint.Path, item.Get)
+		}
+	}
+}
+
+func TestOpenAPIController(t *testing.T) {
+	w := httptest.NewRecorder()
+	openAPIController(ServerOptions{})(w, httptest.NewRequest("GET", "/openapi.json", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("Invalid response: %d", w.Code)
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil || doc["paths"] == nil {
+		t.Errorf("Invalid OpenAPI document: %s", w.Body.String())
+	}
+}
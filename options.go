@@ -1,6 +1,10 @@
 package main
 
-import "gopkg.in/h2non/bimg.v1"
+import (
+	"context"
+
+	"gopkg.in/h2non/bimg.v1"
+)
 
 // ImageOptions represent all the supported image transformation params as first level members
 type ImageOptions struct {
@@ -22,6 +26,7 @@ type ImageOptions struct {
 	Force         bool
 	Embed         bool
 	NoCrop        bool
+	Outside       bool
 	NoReplicate   bool
 	NoRotation    bool
 	NoProfile     bool
@@ -38,6 +43,69 @@ type ImageOptions struct {
 	Gravity       bimg.Gravity
 	Colorspace    bimg.Interpretation
 	Operations    PipelineOperations
+	Position      string
+	QRLevel       string
+	Grid          string
+	Gap           int
+	Image         string
+	Blend         string
+	Scale         float64
+	ScaleBy       string
+	OverlayMin    int
+	OverlayMax    int
+	Tile          bool
+	TileSpacing   int
+	TileAngle     float64
+	Shape         string
+	Direction     string
+	Radius        float64
+	Border        string
+	ShadowX       int
+	ShadowY       int
+	Pixelate      int
+	Denoise       int
+	Levels        int
+	Dither        string
+	Channels      string
+	Alpha         string
+	Matrix        string
+	Corners       string
+	SkewX         float64
+	SkewY         float64
+	Format        string
+	Frame         float64
+	Frames        int
+	FrameStep     int
+	Loop          int
+	Duration      float64
+	Page          *int
+	AutoQuality   bool
+	MinQuality    int
+	MaxQuality    int
+	DSSIM         float64
+	MaxBytes      int
+	SkipLarger    bool
+	Threshold     bool
+	Lossless      bool
+	NearLossless  int
+	Effort        int
+	Interlace     bool
+	Subsample     string
+	Density       int
+	Depth         int
+	Diff          bool
+	Assess        bool
+	BlurThreshold float64
+	Upscale       string
+	CropBox       bool
+	AspectRatio   string
+	Relative      map[string]float64
+	LQIP          bool
+	LQIPWidth     int
+	LQIPBlur      float64
+	LQIPJSON      bool
+	Timings       *Timings
+	Context       context.Context
 }
 
 // PipelineOperation represents the structure for an operation field.
@@ -60,6 +128,8 @@ func BimgOptions(o ImageOptions) bimg.Options {
 		Flip:           o.Flip,
 		Flop:           o.Flop,
 		Quality:        o.Quality,
+		Lossless:       o.Lossless,
+		Interlace:      o.Interlace,
 		Compression:    o.Compression,
 		NoAutoRotate:   o.NoRotation,
 		NoProfile:      o.NoProfile,
@@ -73,6 +143,11 @@ func BimgOptions(o ImageOptions) bimg.Options {
 		Rotate:         bimg.Angle(o.Rotate),
 	}
 
+	// The entropy gravity is only supported by the smart crop requests, otherwise it is the attention one
+	if o.Gravity == GravityEntropy {
+		opts.Gravity = bimg.GravitySmart
+	}
+
 	if len(o.Background) != 0 {
 		opts.Background = bimg.Color{o.Background[0], o.Background[1], o.Background[2]}
 	}
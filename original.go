@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// originalRequested reports whether the given request asks for its source image unmodified,
+// via the original endpoint or the raw param of any image endpoint, if enabled.
+func originalRequested(r *http.Request, o ServerOptions) bool {
+	return o.EnableOriginal && (endpointName(r) == "original" || parseBool(r.URL.Query().Get("raw")))
+}
+
+// isOriginalTypeAllowed reports whether the source images of the given MIME type can be replied
+// unmodified: the types allowed by the given MIME types or type/* wildcards, if any, otherwise
+// the supported image types but SVG, since SVG images can embed scripts.
+func isOriginalTypeAllowed(mimeType string, allowed []string) bool {
+	mimeType = strings.ToLower(strings.TrimSpace(strings.Split(mimeType, ";")[0]))
+	if len(allowed) == 0 {
+		return strings.HasPrefix(mimeType, "image/") && mimeType != "image/svg+xml" && IsImageMimeTypeSupported(mimeType)
+	}
+	for _, t := range allowed {
+		t = strings.ToLower(t)
+		if t == mimeType || strings.HasSuffix(t, "/*") && strings.HasPrefix(mimeType, strings.TrimSuffix(t, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// replyOriginal replies with the given source image unmodified, with the forwarded source image
+// cache headers, honoring the Range requests. The source image is already restricted by the
+// origin and size limits of its image source, and is classified by the content moderation, as
+// the processed images. The unmodified content is sandboxed, so the active content allowed by
+// the original types, such as SVG scripts, does not run in the server origin.
+func replyOriginal(w http.ResponseWriter, r *http.Request, buf []byte, cacheHeaders http.Header, o ServerOptions) {
+	mimeType := detectMimeType(buf)
+	if !isOriginalTypeAllowed(mimeType, o.OriginalTypes) {
+		ErrorReply(r, w, ErrUnsupportedMedia, o)
+		return
+	}
+	if !moderate(w, r, buf, mimeType, o) {
+		return
+	}
+
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	image := Image{Body: buf, Mime: mimeType}
+	setSavingsHeaders(w, buf, buf, image)
+	replyProcessedImage(w, r, image, "", cacheHeaders, true)
+}
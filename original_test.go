@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOriginalRequested(t *testing.T) {
+	o := ServerOptions{EnableOriginal: true}
+	cases := []struct {
+		url       string
+		options   ServerOptions
+		requested bool
+	}{
+		{"/original", o, true},
+		{"/v1/original", o, true},
+		{"/resize?width=300&raw=true", o, true},
+		{"/resize?width=300", o, false},
+		{"/original", ServerOptions{}, false},
+		{"/resize?width=300&raw=true", ServerOptions{}, false},
+	}
+	for _, c := range cases {
+		if requested := originalRequested(httptest.NewRequest("GET", c.url, nil), c.options); requested != c.requested {
+			t.Errorf("Invalid original request of %s: %t", c.url, requested)
+		}
+	}
+}
+
+func TestIsOriginalTypeAllowed(t *testing.T) {
+	cases := []struct {
+		mimeType string
+		allowed  []string
+		expected bool
+	}{
+		{"image/jpeg", nil, true},
+		{"image/png", nil, true},
+		{"image/svg+xml", nil, false},
+		{"image/svg+xml", []string{"image/*"}, true},
+		{"video/mp4", nil, false},
+		{"text/html; charset=utf-8", nil, false},
+		{"image/png", []string{"image/jpeg"}, false},
+		{"image/jpeg", []string{"image/jpeg"}, true},
+		{"video/mp4", []string{"image/*", "video/*"}, true},
+		{"text/plain", []string{"image/*"}, false},
+	}
+	for _, c := range cases {
+		if allowed := isOriginalTypeAllowed(c.mimeType, c.allowed); allowed != c.expected {
+			t.Errorf("Invalid original type allowance of %s %v: %t", c.mimeType, c.allowed, allowed)
+		}
+	}
+}
+
+func TestOriginalEndpoint(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("large.jpg"))
+	o := ServerOptions{EnableOriginal: true}
+	LoadSources(o)
+	mux := NewServerMux(o)
+
+	for _, url := range []string{"/original", "/resize?width=300&raw=true"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", url, bytes.NewReader(buf))
+		r.Header.Set("Content-Type", "image/jpeg")
+		mux.ServeHTTP(w, r)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/jpeg" || !bytes.Equal(w.Body.Bytes(), buf) {
+			t.Errorf("Invalid original response of %s: %d %d bytes", url, w.Code, w.Body.Len())
+		}
+		if w.Header().Get("Content-Security-Policy") != "sandbox" {
+			t.Errorf("The original images should be sandboxed: %s", w.Header().Get("Content-Security-Policy"))
+		}
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/original", bytes.NewReader([]byte("<html><body>not an image</body></html>")))
+	r.Header.Set("Content-Type", "image/jpeg")
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("The disallowed original types should be rejected: %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	NewServerMux(ServerOptions{}).ServeHTTP(w, httptest.NewRequest("POST", "/original", bytes.NewReader(buf)))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("The original endpoint should be disabled by default: %d", w.Code)
+	}
+}
+
+func TestOriginalModeration(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("large.jpg"))
+	moderator := moderatorFunc(func(buf []byte, mimeType string) (ModerationResult, error) {
+		return ModerationResult{Score: 0.9}, nil
+	})
+	o := ServerOptions{EnableOriginal: true, Moderation: ModerationOptions{Moderator: moderator, Action: ModerationBlock}}
+
+	w := httptest.NewRecorder()
+	replyOriginal(w, httptest.NewRequest("GET", "/original", nil), buf, nil, o)
+	if w.Code != http.StatusForbidden || w.Header().Get(ModerationHeader) != ModerationFlagged {
+		t.Errorf("The flagged original images should be blocked: %d", w.Code)
+	}
+}
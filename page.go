@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// pageSaveSuffix is the lossless libvips save suffix of the extracted pages
+const pageSaveSuffix = ".png[compression=1]"
+
+// heifBrands are the ISO base media file brands of HEIF images and bursts
+var heifBrands = []string{"heic", "heix", "heim", "heis", "hevc", "hevx", "mif1", "msf1"}
+
+// isHEIF reports whether the given buffer is a HEIF image, by its file type box brand
+func isHEIF(buf []byte) bool {
+	if len(buf) < 12 || !bytes.Equal(buf[4:8], []byte("ftyp")) {
+		return false
+	}
+	brand := string(buf[8:12])
+	for _, b := range heifBrands {
+		if brand == b {
+			return true
+		}
+	}
+	return false
+}
+
+// isMultiPage reports whether the given image type can contain multiple pages or frames
+func isMultiPage(buf []byte) bool {
+	switch bimg.DetermineImageType(buf) {
+	case bimg.GIF, bimg.WEBP, bimg.TIFF, bimg.PDF:
+		return true
+	}
+	return isHEIF(buf)
+}
+
+// selectedPage returns the zero-based page, or frame, selected by the page param,
+// and whether the param is defined, since the page zero is a valid selection.
+func selectedPage(o ImageOptions) (int, bool) {
+	if o.Page == nil {
+		return 0, false
+	}
+	return *o.Page, true
+}
+
+// extractPage extracts the given zero-based page, or frame, of multi-page images,
+// such as animated GIF and WebP images, multi-page TIFF images or HEIF bursts,
+// encoded as PNG, to be processed as any other still image.
+func extractPage(buf []byte, page int) ([]byte, error) {
+	if page < 0 {
+		return nil, NewError("Page number must be a non-negative number", BadRequest)
+	}
+	return vipsPage(buf, page, pageSaveSuffix)
+}
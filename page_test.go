@@ -0,0 +1,71 @@
+package main
+
+import (
+	"image/png"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+func TestIsHEIF(t *testing.T) {
+	heic := []byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00")
+	if !isHEIF(heic) || !isMultiPage(heic) {
+		t.Error("Expected a HEIF image")
+	}
+	if isHEIF([]byte("\x00\x00\x00\x18ftypisom\x00\x00\x00\x00")) {
+		t.Error("Unexpected HEIF image of MP4 video")
+	}
+}
+
+func TestSelectedPage(t *testing.T) {
+	if n, ok := selectedPage(readParams(url.Values{"page": {"0"}})); !ok || n != 0 {
+		t.Errorf("Invalid selected page: %d %t", n, ok)
+	}
+	if n, ok := selectedPage(readMapParams(map[string]interface{}{"page": 2.0})); !ok || n != 2 {
+		t.Errorf("Invalid selected page: %d %t", n, ok)
+	}
+	if _, ok := selectedPage(readParams(url.Values{"frame": {"1.5"}})); ok {
+		t.Error("Unexpected page selected by the frame param")
+	}
+}
+
+func TestFirstPage(t *testing.T) {
+	w := httptest.NewRecorder()
+	imageHandler(w, httptest.NewRequest("GET", "/convert?type=png&page=0", nil), testGIF(t), Convert, ServerOptions{}, nil)
+	if w.Code != 200 {
+		t.Fatalf("Invalid response status: %d", w.Code)
+	}
+
+	// Only the first frame has its first white pixel on the first row
+	img, err := png.Decode(w.Body)
+	if err != nil {
+		t.Fatalf("Cannot decode the page image: %s", err)
+	}
+	if r, g, b, _ := img.At(0, 0).RGBA(); r != 0xffff || g != 0xffff || b != 0xffff {
+		t.Errorf("Invalid page pixel: %d %d %d", r, g, b)
+	}
+}
+
+func TestExtractPage(t *testing.T) {
+	buf := testGIF(t)
+	if _, err := extractPage(buf, -1); err == nil {
+		t.Error("Expected an error with a negative page")
+	}
+
+	page, err := extractPage(buf, 2)
+	if err != nil {
+		t.Fatalf("Cannot extract the image page: %s", err)
+	}
+	if bimg.DetermineImageType(page) != bimg.PNG {
+		t.Error("Invalid page image type")
+	}
+	if err := assertSize(page, 31, 21); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := extractPage(buf, 10); err == nil {
+		t.Error("Expected an error with an out of range page")
+	}
+}
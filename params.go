@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"math"
 	"net/url"
 	"strconv"
@@ -11,40 +12,100 @@ import (
 )
 
 var allowedParams = map[string]string{
-	"width":       "int",
-	"height":      "int",
-	"quality":     "int",
-	"top":         "int",
-	"left":        "int",
-	"areawidth":   "int",
-	"areaheight":  "int",
-	"compression": "int",
-	"rotate":      "int",
-	"margin":      "int",
-	"factor":      "int",
-	"dpi":         "int",
-	"textwidth":   "int",
-	"opacity":     "float",
-	"flip":        "bool",
-	"flop":        "bool",
-	"nocrop":      "bool",
-	"noprofile":   "bool",
-	"norotation":  "bool",
-	"noreplicate": "bool",
-	"force":       "bool",
-	"embed":       "bool",
-	"stripmeta":   "bool",
-	"text":        "string",
-	"font":        "string",
-	"type":        "string",
-	"color":       "color",
-	"colorspace":  "colorspace",
-	"gravity":     "gravity",
-	"background":  "color",
-	"extend":      "extend",
-	"sigma":       "float",
-	"minampl":     "float",
-	"operations":  "json",
+	"width":         "int",
+	"height":        "int",
+	"quality":       "int",
+	"top":           "int",
+	"left":          "int",
+	"areawidth":     "int",
+	"areaheight":    "int",
+	"compression":   "int",
+	"rotate":        "int",
+	"margin":        "int",
+	"factor":        "int",
+	"dpi":           "int",
+	"textwidth":     "int",
+	"opacity":       "float",
+	"flip":          "bool",
+	"flop":          "bool",
+	"nocrop":        "bool",
+	"outside":       "bool",
+	"noprofile":     "bool",
+	"norotation":    "bool",
+	"noreplicate":   "bool",
+	"force":         "bool",
+	"embed":         "bool",
+	"stripmeta":     "bool",
+	"text":          "string",
+	"font":          "string",
+	"type":          "string",
+	"color":         "color",
+	"colorspace":    "colorspace",
+	"gravity":       "gravity",
+	"background":    "color",
+	"extend":        "extend",
+	"sigma":         "float",
+	"minampl":       "float",
+	"operations":    "json",
+	"position":      "string",
+	"qrlevel":       "string",
+	"grid":          "string",
+	"gap":           "int",
+	"image":         "string",
+	"blend":         "string",
+	"scale":         "float",
+	"scaleby":       "string",
+	"overlaymin":    "int",
+	"overlaymax":    "int",
+	"tile":          "bool",
+	"tilespacing":   "int",
+	"tileangle":     "float",
+	"shape":         "string",
+	"direction":     "string",
+	"radius":        "float",
+	"border":        "string",
+	"shadowx":       "int",
+	"shadowy":       "int",
+	"pixelate":      "int",
+	"denoise":       "int",
+	"levels":        "int",
+	"dither":        "string",
+	"channels":      "string",
+	"alpha":         "string",
+	"matrix":        "string",
+	"corners":       "string",
+	"skewx":         "float",
+	"skewy":         "float",
+	"format":        "string",
+	"frame":         "float",
+	"frames":        "int",
+	"framestep":     "int",
+	"loop":          "int",
+	"duration":      "float",
+	"page":          "int",
+	"minquality":    "int",
+	"maxquality":    "int",
+	"dssim":         "float",
+	"maxbytes":      "int",
+	"skiplarger":    "bool",
+	"threshold":     "bool",
+	"lossless":      "bool",
+	"effort":        "int",
+	"interlace":     "bool",
+	"subsample":     "string",
+	"density":       "int",
+	"depth":         "int",
+	"diff":          "bool",
+	"assess":        "bool",
+	"upscale":       "string",
+	"cropbox":       "bool",
+	"ar":            "string",
+	"lqip":          "bool",
+	"lqipwidth":     "int",
+	"lqipblur":      "float",
+	"lqipjson":      "bool",
+	"nearlossless":  "int",
+	"blurthreshold": "float",
 }
 
 func readParams(query url.Values) ImageOptions {
@@ -55,38 +116,107 @@ func readParams(query url.Values) ImageOptions {
 		params[key] = parseParam(param, kind)
 	}
 
-	return mapImageParams(params)
+	// The automatic quality selection is defined by the quality=auto param
+	opts := mapImageParams(params)
+	opts.AutoQuality = query.Get("quality") == "auto"
+	opts.Relative = readRelativeParams(query.Get)
+	opts.Page = readPage(query.Get("page"))
+	return opts
 }
 
 func readMapParams(options map[string]interface{}) ImageOptions {
 	params := make(map[string]interface{})
 
 	for key, kind := range allowedParams {
-		value, ok := options[key]
+		value, ok := mapParam(options[key], kind)
 		if !ok {
 			// Force type defaults
-			params[key] = parseParam("", kind)
-			continue
+			value = parseParam("", kind)
 		}
+		params[key] = value
+	}
 
-		// Parse non JSON primitive types that would be represented as string types
-		if kind == "color" || kind == "colorspace" || kind == "gravity" || kind == "extend" {
-			if v, ok := value.(string); ok {
-				params[key] = parseParam(v, kind)
-			}
-		} else if kind == "int" {
-			if v, ok := value.(float64); ok {
-				params[key] = int(v)
-			}
-			if v, ok := value.(int); ok {
-				params[key] = v
+	opts := mapImageParams(params)
+	opts.Relative = readRelativeParams(func(key string) string {
+		v, _ := options[key].(string)
+		return v
+	})
+	opts.Page = readPage(options["page"])
+	return opts
+}
+
+// readPage returns the zero-based page selected by the given page param value,
+// or nil if the param is absent, since the page zero is a valid selection.
+func readPage(value interface{}) *int {
+	if value == nil || value == "" {
+		return nil
+	}
+	page, ok := mapParam(value, "int")
+	if !ok {
+		return nil
+	}
+	n := page.(int)
+	return &n
+}
+
+// validateMapParams validates the types of the given pipeline operation params, since
+// they are defined by any JSON value, instead of the query params strings.
+func validateMapParams(options map[string]interface{}) error {
+	for key, value := range options {
+		kind, ok := allowedParams[key]
+		if !ok {
+			continue
+		}
+		if _, ok := mapParam(value, kind); !ok {
+			kindType, ok := paramKindTypes[kind]
+			if !ok {
+				kindType = "string"
 			}
-		} else {
-			params[key] = value
+			return NewError(fmt.Sprintf("Invalid %s param: must be a %s: %v", key, kindType, value), BadRequest)
 		}
 	}
+	return nil
+}
+
+// paramKindTypes are the JSON value types of the param kinds, other than strings
+var paramKindTypes = map[string]string{
+	"int":   "number",
+	"float": "number",
+	"bool":  "boolean",
+}
+
+// mapParam converts the given JSON value of a param of the given kind, parsing the strings as
+// the query params, and reports whether the value is of a valid type. Missing params are valid.
+func mapParam(value interface{}, kind string) (interface{}, bool) {
+	if value == nil {
+		return parseParam("", kind), true
+	}
 
-	return mapImageParams(params)
+	// Parse non JSON primitive types that would be represented as string types
+	if v, ok := value.(string); ok {
+		return parseParam(v, kind), true
+	}
+	switch v := value.(type) {
+	case float64:
+		if kind == "int" {
+			return int(v), true
+		}
+		if kind == "float" {
+			return v, true
+		}
+	case int:
+		if kind == "int" {
+			return v, true
+		}
+		if kind == "float" {
+			return float64(v), true
+		}
+	case bool:
+		if kind == "bool" {
+			return v, true
+		}
+	}
+	return nil, false
 }
 
 func parseParam(param, kind string) interface{} {
@@ -139,6 +269,7 @@ func mapImageParams(params map[string]interface{}) ImageOptions {
 		Flop:          params["flop"].(bool),
 		Embed:         params["embed"].(bool),
 		NoCrop:        params["nocrop"].(bool),
+		Outside:       params["outside"].(bool),
 		Force:         params["force"].(bool),
 		NoReplicate:   params["noreplicate"].(bool),
 		NoRotation:    params["norotation"].(bool),
@@ -152,6 +283,64 @@ func mapImageParams(params map[string]interface{}) ImageOptions {
 		Sigma:         params["sigma"].(float64),
 		MinAmpl:       params["minampl"].(float64),
 		Operations:    params["operations"].(PipelineOperations),
+		Position:      params["position"].(string),
+		QRLevel:       params["qrlevel"].(string),
+		Grid:          params["grid"].(string),
+		Gap:           params["gap"].(int),
+		Image:         params["image"].(string),
+		Blend:         params["blend"].(string),
+		Scale:         params["scale"].(float64),
+		ScaleBy:       params["scaleby"].(string),
+		OverlayMin:    params["overlaymin"].(int),
+		OverlayMax:    params["overlaymax"].(int),
+		Tile:          params["tile"].(bool),
+		TileSpacing:   params["tilespacing"].(int),
+		TileAngle:     params["tileangle"].(float64),
+		Shape:         params["shape"].(string),
+		Direction:     params["direction"].(string),
+		Radius:        params["radius"].(float64),
+		Border:        params["border"].(string),
+		ShadowX:       params["shadowx"].(int),
+		ShadowY:       params["shadowy"].(int),
+		Pixelate:      params["pixelate"].(int),
+		Denoise:       params["denoise"].(int),
+		Levels:        params["levels"].(int),
+		Dither:        params["dither"].(string),
+		Channels:      params["channels"].(string),
+		Alpha:         params["alpha"].(string),
+		Matrix:        params["matrix"].(string),
+		Corners:       params["corners"].(string),
+		SkewX:         params["skewx"].(float64),
+		SkewY:         params["skewy"].(float64),
+		Format:        params["format"].(string),
+		Frame:         params["frame"].(float64),
+		Frames:        params["frames"].(int),
+		FrameStep:     params["framestep"].(int),
+		Loop:          params["loop"].(int),
+		Duration:      params["duration"].(float64),
+		MinQuality:    params["minquality"].(int),
+		MaxQuality:    params["maxquality"].(int),
+		DSSIM:         params["dssim"].(float64),
+		MaxBytes:      params["maxbytes"].(int),
+		SkipLarger:    params["skiplarger"].(bool),
+		Threshold:     params["threshold"].(bool),
+		Lossless:      params["lossless"].(bool),
+		NearLossless:  params["nearlossless"].(int),
+		Effort:        params["effort"].(int),
+		Interlace:     params["interlace"].(bool),
+		Subsample:     params["subsample"].(string),
+		Density:       params["density"].(int),
+		Depth:         params["depth"].(int),
+		Diff:          params["diff"].(bool),
+		Assess:        params["assess"].(bool),
+		BlurThreshold: params["blurthreshold"].(float64),
+		Upscale:       params["upscale"].(string),
+		CropBox:       params["cropbox"].(bool),
+		AspectRatio:   params["ar"].(string),
+		LQIP:          params["lqip"].(bool),
+		LQIPWidth:     params["lqipwidth"].(int),
+		LQIPBlur:      params["lqipblur"].(float64),
+		LQIPJSON:      params["lqipjson"].(bool),
 	}
 }
 
@@ -194,34 +383,38 @@ func parseJSONOperations(data string) PipelineOperations {
 	return operations
 }
 
+// extendModes are the extend param values, black being the default
+var extendModes = map[string]bimg.Extend{
+	"black":      bimg.ExtendBlack,
+	"white":      bimg.ExtendWhite,
+	"copy":       bimg.ExtendCopy,
+	"mirror":     bimg.ExtendMirror,
+	"background": bimg.ExtendBackground,
+}
+
 func parseExtendMode(val string) bimg.Extend {
 	val = strings.TrimSpace(strings.ToLower(val))
-	if val == "white" {
-		return bimg.ExtendWhite
-	}
-	if val == "copy" {
-		return bimg.ExtendCopy
-	}
-	if val == "mirror" {
-		return bimg.ExtendMirror
-	}
-	if val == "background" {
-		return bimg.ExtendBackground
+	if mode, ok := extendModes[val]; ok {
+		return mode
 	}
 	return bimg.ExtendBlack
 }
 
-func parseGravity(val string) bimg.Gravity {
-	var m = map[string]bimg.Gravity{
-		"south": bimg.GravitySouth,
-		"north": bimg.GravityNorth,
-		"east":  bimg.GravityEast,
-		"west":  bimg.GravityWest,
-		"smart": bimg.GravitySmart,
-	}
+// gravities are the gravity param values, centre being the default
+var gravities = map[string]bimg.Gravity{
+	"centre":    bimg.GravityCentre,
+	"south":     bimg.GravitySouth,
+	"north":     bimg.GravityNorth,
+	"east":      bimg.GravityEast,
+	"west":      bimg.GravityWest,
+	"smart":     bimg.GravitySmart,
+	"attention": bimg.GravitySmart,
+	"entropy":   GravityEntropy,
+}
 
+func parseGravity(val string) bimg.Gravity {
 	val = strings.TrimSpace(strings.ToLower(val))
-	if g, ok := m[val]; ok {
+	if g, ok := gravities[val]; ok {
 		return g
 	}
 
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"net/http"
 	"net/url"
 	"testing"
 
@@ -213,3 +214,25 @@ func TestReadMapParams(t *testing.T) {
 		}
 	}
 }
+
+func TestValidateMapParams(t *testing.T) {
+	valid := map[string]interface{}{"width": float64(100), "height": "50%", "embed": true, "opacity": 1, "text": "foo", "color": "255,0,0"}
+	if err := validateMapParams(valid); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+
+	for _, params := range []map[string]interface{}{
+		{"text": float64(5)},
+		{"width": true},
+		{"embed": float64(1)},
+		{"color": []interface{}{255, 0, 0}},
+		{"operations": []interface{}{}},
+	} {
+		err := validateMapParams(params)
+		if err == nil || err.(Error).HTTPCode() != http.StatusBadRequest {
+			t.Errorf("Expected a bad request error of %#v: %v", params, err)
+		}
+		// The invalid params fall back to the defaults
+		readMapParams(params)
+	}
+}
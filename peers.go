@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"hash/crc32"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Peer ring defaults
+const (
+	peerReplicas      = 50
+	peerDNSScheme     = "dns+"
+	peerDNSRefreshing = 30 * time.Second
+)
+
+// peerHashes sorts the peer ring hashes
+type peerHashes []uint32
+
+func (h peerHashes) Len() int           { return len(h) }
+func (h peerHashes) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h peerHashes) Less(i, j int) bool { return h[i] < h[j] }
+
+// PeerRing represents the consistent hash ring of the imaginary replicas, mapping every
+// cache key to the replica owning it, so adding or removing replicas only moves the keys
+// of a fraction of the ring. Every peer is placed at the given number of ring points.
+type PeerRing struct {
+	mutex  sync.RWMutex
+	peers  []string
+	hashes peerHashes
+	owners map[uint32]string
+}
+
+// NewPeerRing creates a new ring of the given peer base URLs
+func NewPeerRing(peers []string) *PeerRing {
+	r := &PeerRing{}
+	r.Set(peers)
+	return r
+}
+
+// Set replaces the ring peers
+func (r *PeerRing) Set(peers []string) {
+	hashes := peerHashes{}
+	owners := map[uint32]string{}
+	for _, peer := range peers {
+		for i := 0; i < peerReplicas; i++ {
+			hash := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + peer))
+			hashes = append(hashes, hash)
+			owners[hash] = peer
+		}
+	}
+	sort.Sort(hashes)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.peers = append([]string{}, peers...)
+	r.hashes = hashes
+	r.owners = owners
+}
+
+// Peers returns the ring peers
+func (r *PeerRing) Peers() []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.peers
+}
+
+// Has returns whether the given peer is in the ring
+func (r *PeerRing) Has(peer string) bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for _, value := range r.peers {
+		if value == peer {
+			return true
+		}
+	}
+	return false
+}
+
+// Get returns the peer owning the given key, the first peer clockwise of the key hash
+func (r *PeerRing) Get(key string) string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if len(r.hashes) == 0 {
+		return ""
+	}
+
+	hash := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= hash })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.owners[r.hashes[i]]
+}
+
+// parsePeers validates the given peer base URLs, such as http://10.0.0.1:8088, or DNS
+// names resolved to every replica address, such as dns+http://imaginary.svc:8088.
+func parsePeers(input string) ([]string, error) {
+	peers := parseList(input)
+	for i, peer := range peers {
+		u, err := url.Parse(strings.TrimPrefix(peer, peerDNSScheme))
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("invalid peer URL: %s", peer)
+		}
+		peers[i] = strings.TrimSuffix(peer, "/")
+	}
+	return peers, nil
+}
+
+// resolvePeers returns the peer base URLs, resolving the DNS peers to their addresses
+func resolvePeers(peers []string) ([]string, error) {
+	resolved := []string{}
+	for _, peer := range peers {
+		if !strings.HasPrefix(peer, peerDNSScheme) {
+			resolved = append(resolved, peer)
+			continue
+		}
+
+		u, _ := url.Parse(strings.TrimPrefix(peer, peerDNSScheme))
+		addrs, err := net.LookupHost(u.Hostname())
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(addrs)
+		for _, addr := range addrs {
+			host := addr
+			if port := u.Port(); port != "" {
+				host = net.JoinHostPort(addr, port)
+			} else if strings.Contains(addr, ":") {
+				host = "[" + addr + "]"
+			}
+			resolved = append(resolved, u.Scheme+"://"+host)
+		}
+	}
+	return resolved, nil
+}
+
+// detectSelfPeer returns the peer of the local network interface addresses and the given port
+func detectSelfPeer(peers []string, port int) string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ""
+	}
+	local := map[string]bool{}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok {
+			local[ipnet.IP.String()] = true
+		}
+	}
+
+	for _, peer := range peers {
+		u, err := url.Parse(peer)
+		if err != nil {
+			continue
+		}
+		peerPort := u.Port()
+		if peerPort == "" {
+			peerPort = map[string]string{"http": "80", "https": "443"}[u.Scheme]
+		}
+		if peerPort != strconv.Itoa(port) {
+			continue
+		}
+		if ips, err := net.LookupHost(u.Hostname()); err == nil {
+			for _, ip := range ips {
+				if local[ip] {
+					return peer
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// watchPeers resolves the DNS peers, if any, every refresh interval, updating the ring peers
+func watchPeers(ring *PeerRing, peers []string) {
+	dns := false
+	for _, peer := range peers {
+		dns = dns || strings.HasPrefix(peer, peerDNSScheme)
+	}
+	if !dns {
+		return
+	}
+
+	go func() {
+		for range time.Tick(peerDNSRefreshing) {
+			resolved, err := resolvePeers(peers)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "cannot resolve the cache peers: %s\n", err)
+				continue
+			}
+			ring.Set(resolved)
+		}
+	}()
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestPeerRing(t *testing.T) {
+	peers := []string{"http://10.0.0.1:8088", "http://10.0.0.2:8088", "http://10.0.0.3:8088"}
+	ring := NewPeerRing(peers)
+
+	owners := map[string]string{}
+	counts := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		owners[key] = ring.Get(key)
+		counts[owners[key]]++
+	}
+	for _, peer := range peers {
+		if counts[peer] < 150 {
+			t.Errorf("Unbalanced keys of peer %s: %d", peer, counts[peer])
+		}
+	}
+
+	// Removing a peer only moves its own keys
+	ring.Set(peers[:2])
+	for key, owner := range owners {
+		if value := ring.Get(key); owner != peers[2] && value != owner {
+			t.Errorf("Key %s should not move: %s != %s", key, value, owner)
+		}
+	}
+
+	if !ring.Has(peers[1]) || ring.Has(peers[2]) {
+		t.Error("Invalid ring peers")
+	}
+	if value := NewPeerRing(nil).Get("key"); value != "" {
+		t.Errorf("Empty ring should not have owners: %s", value)
+	}
+}
+
+func TestParsePeers(t *testing.T) {
+	peers, err := parsePeers("http://10.0.0.1:8088/, dns+https://imaginary.svc")
+	if err != nil {
+		t.Fatalf("Cannot parse the peers: %s", err)
+	}
+	if len(peers) != 2 || peers[0] != "http://10.0.0.1:8088" || peers[1] != "dns+https://imaginary.svc" {
+		t.Errorf("Invalid peers: %#v", peers)
+	}
+
+	invalid := []string{"10.0.0.1:8088", "ftp://10.0.0.1", "dns+imaginary.svc", "http://"}
+	for _, input := range invalid {
+		if _, err := parsePeers(input); err == nil {
+			t.Errorf("Expected error of %s", input)
+		}
+	}
+}
+
+func TestResolvePeers(t *testing.T) {
+	peers, err := resolvePeers([]string{"http://10.0.0.1:8088", "dns+http://127.0.0.1:8088"})
+	if err != nil {
+		t.Fatalf("Cannot resolve the peers: %s", err)
+	}
+	if len(peers) != 2 || peers[0] != "http://10.0.0.1:8088" || peers[1] != "http://127.0.0.1:8088" {
+		t.Errorf("Invalid resolved peers: %#v", peers)
+	}
+
+	if self := detectSelfPeer(peers, 8088); self != "http://127.0.0.1:8088" {
+		t.Errorf("Invalid self peer: %s", self)
+	}
+	if self := detectSelfPeer(peers, 9000); self != "" {
+		t.Errorf("Unexpected self peer of another port: %s", self)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"image"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// maxPixelateBlockSize is the maximum pixelate block size in pixels
+const maxPixelateBlockSize = 512
+
+// Pixelate pixelates the image with square blocks of the given size, or only the area
+// defined via the top, left, areawidth and areaheight params, such as for coarse redaction.
+func Pixelate(buf []byte, o ImageOptions) (Image, error) {
+	if o.Pixelate == 0 {
+		return Image{}, NewError("Missing required param: pixelate", BadRequest)
+	}
+	if o.Pixelate < 2 || o.Pixelate > maxPixelateBlockSize {
+		return Image{}, NewError("Invalid pixelate param, must be between 2 and 512", BadRequest)
+	}
+
+	// The area is relative to the autorotated image, as libvips pixelates it after the autorotation
+	area := image.Rect(o.Left, o.Top, o.Left+o.AreaWidth, o.Top+o.AreaHeight)
+	if o.AreaWidth > 0 || o.AreaHeight > 0 {
+		size, err := orientedSize(buf)
+		if err != nil {
+			return Image{}, NewError("Cannot retrieve image metadata: "+err.Error(), BadRequest)
+		}
+		if area.Empty() || !area.In(image.Rectangle{Max: size}) {
+			return Image{}, NewError("Pixelate area must be within the image bounds", BadRequest)
+		}
+	}
+
+	// The libvips savers support a subset of the output formats
+	outputType := ImageType(o.Type)
+	if outputType == bimg.UNKNOWN {
+		outputType = bimg.DetermineImageType(buf)
+	}
+	switch outputType {
+	case bimg.JPEG, bimg.PNG, bimg.WEBP:
+	default:
+		outputType = bimg.PNG
+	}
+
+	body, err := vipsPixelate(buf, o.Pixelate, area, thumbnailSaveSuffix(outputType, o))
+	if err != nil {
+		return Image{}, err
+	}
+	return Image{Body: body, Mime: GetImageMimeType(outputType)}, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+func TestPixelate(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+	size, _ := bimg.Size(buf)
+
+	image, err := Pixelate(buf, ImageOptions{Pixelate: 10, Type: "png"})
+	if err != nil {
+		t.Fatalf("Cannot pixelate the image: %s", err)
+	}
+	if image.Mime != "image/png" {
+		t.Errorf("Invalid image MIME type: %s", image.Mime)
+	}
+	if err := assertSize(image.Body, size.Width, size.Height); err != nil {
+		t.Error(err)
+	}
+
+	canvas, _ := decodeCanvas(image.Body)
+	block := canvas.RGBAAt(10, 10)
+	for y := 10; y < 20; y++ {
+		for x := 10; x < 20; x++ {
+			if c := canvas.RGBAAt(x, y); c != block {
+				t.Fatalf("Invalid block color at %dx%d: %v", x, y, c)
+			}
+		}
+	}
+}
+
+func TestPixelateArea(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("test.png"))
+	src, _ := decodeCanvas(buf)
+
+	image, err := Pixelate(buf, ImageOptions{Pixelate: 8, Top: 0, Left: 0, AreaWidth: 40, AreaHeight: 40})
+	if err != nil {
+		t.Fatalf("Cannot pixelate the image area: %s", err)
+	}
+
+	canvas, _ := decodeCanvas(image.Body)
+	if canvas.Bounds() != src.Bounds() {
+		t.Fatalf("Invalid image size: %v", canvas.Bounds().Size())
+	}
+	size := src.Bounds().Size()
+	if c := canvas.RGBAAt(size.X-1, size.Y-1); c != src.RGBAAt(size.X-1, size.Y-1) {
+		t.Errorf("Pixels out of the area must be preserved: %v", c)
+	}
+}
+
+func TestPixelateInvalidParams(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("test.png"))
+
+	cases := []ImageOptions{
+		{},
+		{Pixelate: 1},
+		{Pixelate: 1000},
+		{Pixelate: 8, AreaWidth: 100000, AreaHeight: 10},
+	}
+	for _, options := range cases {
+		if _, err := Pixelate(buf, options); err == nil {
+			t.Errorf("Expected error for params: %+v", options)
+		}
+	}
+}
+
+// withEXIFOrientation inserts an EXIF segment of the given orientation after the JFIF segment of the given JPEG image
+func withEXIFOrientation(buf []byte, orientation byte) []byte {
+	tiff := []byte("II*\x00\x08\x00\x00\x00\x01\x00\x12\x01\x03\x00\x01\x00\x00\x00" + string([]byte{orientation}) + "\x00\x00\x00\x00\x00\x00\x00")
+	segment := append([]byte{0xFF, 0xE1, 0, byte(2 + 6 + len(tiff))}, "Exif\x00\x00"...)
+	segment = append(segment, tiff...)
+
+	jfif := 4 + (int(buf[4])<<8 | int(buf[5]))
+	out := append([]byte{}, buf[:jfif]...)
+	out = append(out, segment...)
+	return append(out, buf[jfif:]...)
+}
+
+func TestPixelateOrientedArea(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("large.jpg"))
+	buf = withEXIFOrientation(buf, 6)
+
+	// The 1920x1080 image is 1080x1920 once autorotated
+	image, err := Pixelate(buf, ImageOptions{Pixelate: 8, Top: 1500, AreaWidth: 100, AreaHeight: 100})
+	if err != nil {
+		t.Fatalf("Cannot pixelate the autorotated image area: %s", err)
+	}
+	if err := assertSize(image.Body, 1080, 1920); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := Pixelate(buf, ImageOptions{Pixelate: 8, Left: 1500, AreaWidth: 100, AreaHeight: 100}); err == nil {
+		t.Error("Expected the area out of the autorotated image bounds to be rejected")
+	}
+}
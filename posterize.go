@@ -0,0 +1,142 @@
+package main
+
+import (
+	"image"
+	"image/draw"
+	"math"
+	"strings"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// Supported dithering modes
+const (
+	DitherNone      = "none"
+	DitherOrdered   = "ordered"
+	DitherDiffusion = "diffusion"
+)
+
+// bayerMatrix is the 8x8 Bayer ordered dithering threshold map
+var bayerMatrix = [8][8]float64{
+	{0, 32, 8, 40, 2, 34, 10, 42},
+	{48, 16, 56, 24, 50, 18, 58, 26},
+	{12, 44, 4, 36, 14, 46, 6, 38},
+	{60, 28, 52, 20, 62, 30, 54, 22},
+	{3, 35, 11, 43, 1, 33, 9, 41},
+	{51, 19, 59, 27, 49, 17, 57, 25},
+	{15, 47, 7, 39, 13, 45, 5, 37},
+	{63, 31, 55, 23, 61, 29, 53, 21},
+}
+
+// Posterize reduces each color channel to the given number of tonal levels, optionally
+// dithered, such as for stylistic output or e-ink displays and receipt printers.
+// The image is converted to grayscale first if the colorspace is bw.
+func Posterize(buf []byte, o ImageOptions) (Image, error) {
+	if o.Levels == 0 {
+		return Image{}, NewError("Missing required param: levels", BadRequest)
+	}
+	if o.Levels < 2 || o.Levels > 256 {
+		return Image{}, NewError("Invalid levels param, must be between 2 and 256", BadRequest)
+	}
+
+	dither := strings.ToLower(o.Dither)
+	switch dither {
+	case "", DitherNone, DitherOrdered, DitherDiffusion:
+	default:
+		return Image{}, NewError("Unsupported dither mode: "+o.Dither, BadRequest)
+	}
+
+	src, err := decodeImage(buf, bimg.Options{})
+	if err != nil {
+		return Image{}, err
+	}
+	canvas := image.NewNRGBA(src.Bounds().Sub(src.Bounds().Min))
+	draw.Draw(canvas, canvas.Bounds(), src, src.Bounds().Min, draw.Src)
+
+	if o.Colorspace == bimg.InterpretationBW {
+		grayscale(canvas)
+	}
+
+	switch dither {
+	case DitherOrdered:
+		posterizeOrdered(canvas, o.Levels)
+	case DitherDiffusion:
+		posterizeDiffusion(canvas, o.Levels)
+	default:
+		posterizeImage(canvas, o.Levels)
+	}
+
+	return encodeCanvas(canvas, outputOptions(buf, o))
+}
+
+// grayscale converts the image to grayscale, based on the ITU-R BT.601 luma.
+func grayscale(canvas *image.NRGBA) {
+	for i := 0; i < len(canvas.Pix); i += 4 {
+		p := canvas.Pix[i : i+3]
+		y := uint8(0.299*float64(p[0]) + 0.587*float64(p[1]) + 0.114*float64(p[2]) + 0.5)
+		p[0], p[1], p[2] = y, y, y
+	}
+}
+
+// quantize returns the nearest level value of the given channel value.
+func quantize(v float64, levels int) uint8 {
+	step := 255 / float64(levels-1)
+	level := math.Floor(v/step + 0.5)
+	return uint8(math.Max(0, math.Min(level*step, 255)) + 0.5)
+}
+
+func posterizeImage(canvas *image.NRGBA, levels int) {
+	for i := 0; i < len(canvas.Pix); i += 4 {
+		for c := 0; c < 3; c++ {
+			canvas.Pix[i+c] = quantize(float64(canvas.Pix[i+c]), levels)
+		}
+	}
+}
+
+// posterizeOrdered quantizes the channel values biased by the Bayer threshold map.
+func posterizeOrdered(canvas *image.NRGBA, levels int) {
+	step := 255 / float64(levels-1)
+	bounds := canvas.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			bias := ((bayerMatrix[y%8][x%8]+0.5)/64 - 0.5) * step
+			i := canvas.PixOffset(x, y)
+			for c := 0; c < 3; c++ {
+				canvas.Pix[i+c] = quantize(float64(canvas.Pix[i+c])+bias, levels)
+			}
+		}
+	}
+}
+
+// posterizeDiffusion quantizes the channel values diffusing the quantization
+// error to the neighbour pixels, based on the Floyd-Steinberg algorithm.
+func posterizeDiffusion(canvas *image.NRGBA, levels int) {
+	bounds := canvas.Bounds()
+	width := bounds.Dx()
+
+	// Errors of the current and next rows, with an extra pixel on both sides
+	current := make([]float64, (width+2)*3)
+	next := make([]float64, (width+2)*3)
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := 0; x < width; x++ {
+			i := canvas.PixOffset(bounds.Min.X+x, y)
+			for c := 0; c < 3; c++ {
+				e := (x+1)*3 + c
+				v := float64(canvas.Pix[i+c]) + current[e]
+				q := quantize(v, levels)
+				canvas.Pix[i+c] = q
+
+				diff := v - float64(q)
+				current[e+3] += diff * 7 / 16
+				next[e-3] += diff * 3 / 16
+				next[e] += diff * 5 / 16
+				next[e+3] += diff * 1 / 16
+			}
+		}
+		current, next = next, current
+		for i := range next {
+			next[i] = 0
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"image"
+	"io/ioutil"
+	"testing"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+func TestQuantize(t *testing.T) {
+	cases := []struct {
+		value    float64
+		levels   int
+		expected uint8
+	}{
+		{60, 2, 0},
+		{128, 2, 255},
+		{64, 4, 85},
+		{200, 4, 170},
+		{300, 4, 255},
+		{-20, 4, 0},
+	}
+
+	for _, test := range cases {
+		if v := quantize(test.value, test.levels); v != test.expected {
+			t.Errorf("Invalid %d levels quantization of %f: %d", test.levels, test.value, v)
+		}
+	}
+}
+
+func TestDithering(t *testing.T) {
+	cases := []struct {
+		name   string
+		dither func(*image.NRGBA, int)
+		value  uint8
+		white  int
+	}{
+		{DitherOrdered, posterizeOrdered, 128, 128},
+		{DitherDiffusion, posterizeDiffusion, 64, 64},
+	}
+
+	for _, test := range cases {
+		canvas := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+		for i := range canvas.Pix {
+			canvas.Pix[i] = test.value
+		}
+		test.dither(canvas, 2)
+
+		white := 0
+		for i := 0; i < len(canvas.Pix); i += 4 {
+			if canvas.Pix[i] == 0xff {
+				white++
+			}
+		}
+		if white != test.white {
+			t.Errorf("Invalid %s dithering white pixels: %d", test.name, white)
+		}
+	}
+}
+
+func TestPosterize(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+	size, _ := bimg.Size(buf)
+
+	for _, dither := range []string{"", DitherOrdered, DitherDiffusion} {
+		image, err := Posterize(buf, ImageOptions{Levels: 2, Dither: dither, Colorspace: bimg.InterpretationBW, Type: "png"})
+		if err != nil {
+			t.Fatalf("Cannot posterize the image: %s", err)
+		}
+		if err := assertSize(image.Body, size.Width, size.Height); err != nil {
+			t.Error(err)
+		}
+
+		canvas, _ := decodeCanvas(image.Body)
+		for i := 0; i < len(canvas.Pix); i += 4 {
+			if p := canvas.Pix[i]; p != 0 && p != 0xff {
+				t.Fatalf("Invalid %q posterized value: %d", dither, p)
+			}
+		}
+	}
+
+	if _, err := Posterize(buf, ImageOptions{Levels: 1}); err == nil {
+		t.Error("Expected invalid levels error")
+	}
+	if _, err := Posterize(buf, ImageOptions{Levels: 4, Dither: "random"}); err == nil {
+		t.Error("Expected unsupported dither error")
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// PriorityHeader is the request header defining the priority class of the image requests
+const PriorityHeader = "Imaginary-Priority"
+
+// Priority classes of the image requests, processed from the highest to the lowest one
+// by the processing queue, once the server is saturated.
+const (
+	LowPriority = iota
+	NormalPriority
+	HighPriority
+)
+
+// priorityClasses maps the priority class names to the priority classes
+var priorityClasses = map[string]int{
+	"low":    LowPriority,
+	"normal": NormalPriority,
+	"high":   HighPriority,
+}
+
+// parsePriority parses the given priority class name
+func parsePriority(name string) (int, bool) {
+	priority, ok := priorityClasses[strings.ToLower(strings.TrimSpace(name))]
+	return priority, ok
+}
+
+// parseKeyPriorities parses the comma separated API key id priority classes, such as "importer:low,frontend:high"
+func parseKeyPriorities(input string) (map[string]int, error) {
+	priorities := make(map[string]int)
+	for _, value := range parseList(input) {
+		parts := strings.SplitN(value, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("missing priority class for API key id: %s", value)
+		}
+		priority, ok := parsePriority(parts[1])
+		if !ok {
+			return nil, fmt.Errorf("invalid priority class for API key id: %s", value)
+		}
+		priorities[strings.TrimSpace(parts[0])] = priority
+	}
+	return priorities, nil
+}
+
+// parsePriorityClients parses the comma separated API key ids, client IPs and CIDR ranges
+// allowed to define their priority class via the priority header.
+func parsePriorityClients(input string) (map[string]bool, []*net.IPNet, error) {
+	keys := make(map[string]bool)
+	var ips []string
+	for _, value := range parseList(input) {
+		if strings.Contains(value, "/") || net.ParseIP(value) != nil {
+			ips = append(ips, value)
+		} else {
+			keys[value] = true
+		}
+	}
+	nets, err := parseIPNets(strings.Join(ips, ","))
+	return keys, nets, err
+}
+
+// requestPriority returns the priority class of the given request, which is the one of its
+// API key id, if defined, or the one of its priority header, if sent by a trusted client,
+// defaulting to the normal one.
+func requestPriority(r *http.Request, o ServerOptions) int {
+	id := apiKeyID(r, o)
+	if len(o.KeyPriorities) > 0 {
+		if priority, ok := o.KeyPriorities[id]; ok {
+			return priority
+		}
+	}
+	trusted := id != "" && o.PriorityKeys[id] || len(o.PriorityIPs) > 0 && isClientIPAllowed(r, o.PriorityIPs, nil)
+	if priority, ok := parsePriority(r.Header.Get(PriorityHeader)); ok && trusted {
+		return priority
+	}
+	return NormalPriority
+}
+
+// ProcessingQueue limits the number of simultaneously processing images, queueing the
+// other ones by priority class, then by arrival order, until a processing slot is released.
+type ProcessingQueue struct {
+	slots   int
+	mutex   sync.Mutex
+	active  int
+	waiting [HighPriority + 1][]chan struct{}
+}
+
+// NewProcessingQueue creates a new processing queue of the given simultaneously processing images
+func NewProcessingQueue(slots int) *ProcessingQueue {
+	return &ProcessingQueue{slots: slots}
+}
+
+// Acquire waits for a processing slot of the given priority class, until the given context is done.
+// A nil queue never waits.
+func (q *ProcessingQueue) Acquire(ctx context.Context, priority int) error {
+	if q == nil {
+		return nil
+	}
+
+	q.mutex.Lock()
+	if q.active < q.slots {
+		q.active++
+		q.mutex.Unlock()
+		return nil
+	}
+	ready := make(chan struct{})
+	q.waiting[priority] = append(q.waiting[priority], ready)
+	q.mutex.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		q.mutex.Lock()
+		defer q.mutex.Unlock()
+		for i, waiting := range q.waiting[priority] {
+			if waiting == ready {
+				q.waiting[priority] = append(q.waiting[priority][:i], q.waiting[priority][i+1:]...)
+				return ctx.Err()
+			}
+		}
+		// The slot was handed over meanwhile, so release it
+		q.release()
+		return ctx.Err()
+	}
+}
+
+// Release releases a processing slot, handing it over to the next queued image, if any
+func (q *ProcessingQueue) Release() {
+	if q == nil {
+		return
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.release()
+}
+
+// Waiting returns the number of images queued for a processing slot. A nil queue never queues.
+func (q *ProcessingQueue) Waiting() int {
+	if q == nil {
+		return 0
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	waiting := 0
+	for _, queued := range q.waiting {
+		waiting += len(queued)
+	}
+	return waiting
+}
+
+func (q *ProcessingQueue) release() {
+	for priority := HighPriority; priority >= LowPriority; priority-- {
+		if waiting := q.waiting[priority]; len(waiting) > 0 {
+			q.waiting[priority] = waiting[1:]
+			close(waiting[0])
+			return
+		}
+	}
+	q.active--
+}
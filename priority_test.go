@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseKeyPriorities(t *testing.T) {
+	priorities, err := parseKeyPriorities("frontend:high, importer:LOW")
+	if err != nil || !reflect.DeepEqual(priorities, map[string]int{"frontend": HighPriority, "importer": LowPriority}) {
+		t.Errorf("Invalid key priorities: %#v %v", priorities, err)
+	}
+	for _, input := range []string{"importer", "importer:urgent"} {
+		if _, err := parseKeyPriorities(input); err == nil {
+			t.Errorf("Expected invalid key priorities error of %s", input)
+		}
+	}
+}
+
+func TestParsePriorityClients(t *testing.T) {
+	keys, ips, err := parsePriorityClients("frontend, 10.0.0.0/8, 192.0.2.1")
+	if err != nil || !reflect.DeepEqual(keys, map[string]bool{"frontend": true}) || len(ips) != 2 {
+		t.Errorf("Invalid priority clients: %#v %v %v", keys, ips, err)
+	}
+	if _, _, err := parsePriorityClients("10.0.0.0/33"); err == nil {
+		t.Error("Expected invalid priority clients error")
+	}
+}
+
+func TestRequestPriority(t *testing.T) {
+	keys, _ := parseKeyRing("importer:secret1,frontend:secret2,batch:secret3", true)
+	o := ServerOptions{APIKeys: keys, KeyPriorities: map[string]int{"importer": LowPriority}, PriorityKeys: map[string]bool{"frontend": true}}
+	_, trustedIPs, _ := parsePriorityClients("192.0.2.0/24")
+
+	cases := []struct {
+		key      string
+		header   string
+		ips      []*net.IPNet
+		priority int
+	}{
+		{"", "", nil, NormalPriority},
+		{"", "high", nil, NormalPriority},
+		{"", "high", trustedIPs, HighPriority},
+		{"", "invalid", trustedIPs, NormalPriority},
+		{"secret1", "high", trustedIPs, LowPriority},
+		{"secret2", "high", nil, HighPriority},
+		{"secret3", "high", nil, NormalPriority},
+	}
+	for _, test := range cases {
+		r := httptest.NewRequest("GET", "/resize", nil)
+		r.Header.Set("API-Key", test.key)
+		r.Header.Set(PriorityHeader, test.header)
+		o.PriorityIPs = test.ips
+		if priority := requestPriority(r, o); priority != test.priority {
+			t.Errorf("Invalid priority of key %q and header %q: %d", test.key, test.header, priority)
+		}
+	}
+}
+
+func TestProcessingQueue(t *testing.T) {
+	queue := NewProcessingQueue(1)
+	ctx := context.Background()
+	if err := queue.Acquire(ctx, NormalPriority); err != nil {
+		t.Fatal(err)
+	}
+
+	order := make(chan int, 3)
+	for _, priority := range []int{LowPriority, NormalPriority, HighPriority} {
+		go func(priority int) {
+			if err := queue.Acquire(ctx, priority); err == nil {
+				order <- priority
+				queue.Release()
+			}
+		}(priority)
+		// Ensure the arrival order
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := queue.Acquire(timeout, HighPriority); err != context.DeadlineExceeded {
+		t.Errorf("Expected queue wait timeout: %v", err)
+	}
+
+	if waiting := queue.Waiting(); waiting != 3 {
+		t.Errorf("Invalid queued images: %d", waiting)
+	}
+
+	queue.Release()
+	for _, expected := range []int{HighPriority, NormalPriority, LowPriority} {
+		if priority := <-order; priority != expected {
+			t.Errorf("Invalid processing order: %d != %d", priority, expected)
+		}
+	}
+	if queue.Acquire(ctx, LowPriority) != nil || queue.active != 1 {
+		t.Errorf("Invalid active slots: %d", queue.active)
+	}
+	if waiting := queue.Waiting(); waiting != 0 {
+		t.Errorf("Invalid queued images: %d", waiting)
+	}
+}
+
+func TestProcessingQueueControllers(t *testing.T) {
+	o := ServerOptions{ProcessingQueue: NewProcessingQueue(1)}
+	o.ProcessingQueue.Acquire(context.Background(), NormalPriority)
+
+	// The invalid legacy images are not decoded until a processing slot is free
+	bmp := testBMP(4, 4, 24, bmpRGB, nil, nil)
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("file", "image.bmp")
+	part.Write(bmp)
+	form.Close()
+
+	multi := multiImageController(o, func(images [][]byte, opts ImageOptions) (Image, error) {
+		t.Error("Unexpected multiple images operation without processing slot")
+		return Image{}, nil
+	})
+	cases := []struct {
+		name    string
+		request *http.Request
+		handler func(http.ResponseWriter, *http.Request)
+	}{
+		{"image", httptest.NewRequest("GET", "/resize?width=100", nil), func(w http.ResponseWriter, r *http.Request) {
+			imageHandler(w, r, bmp, Resize, o, nil)
+		}},
+		{"qrcode", httptest.NewRequest("GET", "/qrcode?text=hello", nil), qrcodeController(o)},
+		{"montage", httptest.NewRequest("POST", "/montage", &body), multi},
+	}
+	for _, c := range cases {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		r := c.request.WithContext(ctx)
+		r.Header.Set("Content-Type", form.FormDataContentType())
+		w := httptest.NewRecorder()
+		c.handler(w, r)
+		cancel()
+		if w.Code != http.StatusGatewayTimeout {
+			t.Errorf("Invalid %s response status of saturated server: %d", c.name, w.Code)
+		}
+	}
+	if waiting := o.ProcessingQueue.Waiting(); waiting != 0 || o.ProcessingQueue.active != 1 {
+		t.Errorf("Invalid processing queue: %d active, %d waiting", o.ProcessingQueue.active, waiting)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CDN purge APIs base URLs
+var (
+	cloudflareAPI = "https://api.cloudflare.com/client/v4"
+	fastlyAPI     = "https://api.fastly.com"
+	cloudFrontAPI = "https://cloudfront.amazonaws.com/2020-05-31"
+)
+
+// CDN purge API limits of surrogate keys per request
+const (
+	cloudflareMaxTags = 30
+	fastlyMaxKeys     = 256
+)
+
+var cdnPurgeClient = &http.Client{Timeout: 30 * time.Second}
+
+// CDNPurger purges the CDN cached images tagged by the given surrogate keys
+type CDNPurger interface {
+	Purge(keys []string) error
+}
+
+// CDNPurgers purges the images from every configured CDN
+type CDNPurgers []CDNPurger
+
+// CDNPurgeOptions represents the CDN purge configuration file, defining the CDN services
+// to purge when the images of a source image are purged via the /purge endpoint.
+type CDNPurgeOptions struct {
+	Cloudflare *CloudflarePurger `json:"cloudflare"`
+	Fastly     *FastlyPurger     `json:"fastly"`
+	CloudFront *CloudFrontPurger `json:"cloudfront"`
+}
+
+// CloudflarePurger purges the Cloudflare zone cached images by cache tag
+type CloudflarePurger struct {
+	ZoneID   string `json:"zoneId"`
+	APIToken string `json:"apiToken"`
+}
+
+// FastlyPurger purges the Fastly service cached images by surrogate key, optionally
+// marking them as stale instead of evicting them.
+type FastlyPurger struct {
+	ServiceID string `json:"serviceId"`
+	APIToken  string `json:"apiToken"`
+	Soft      bool   `json:"soft"`
+}
+
+// CloudFrontPurger invalidates the CloudFront distribution cached images. Since CloudFront
+// has no tag based invalidation, the configured paths are invalidated, every path by default.
+type CloudFrontPurger struct {
+	DistributionID string         `json:"distributionId"`
+	Paths          []string       `json:"paths"`
+	AWS            *AWSCredential `json:"aws"`
+}
+
+// LoadCDNPurgers loads the CDN purge configuration JSON file
+func LoadCDNPurgers(path string) (CDNPurgers, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseCDNPurgers(buf)
+}
+
+// parseCDNPurgers parses the CDN purge configuration JSON document
+func parseCDNPurgers(buf []byte) (CDNPurgers, error) {
+	var o CDNPurgeOptions
+	if err := json.Unmarshal(buf, &o); err != nil {
+		return nil, err
+	}
+
+	purgers := CDNPurgers{}
+	if c := o.Cloudflare; c != nil {
+		if c.ZoneID == "" || c.APIToken == "" {
+			return nil, fmt.Errorf("cloudflare purge requires a zone id and API token")
+		}
+		purgers = append(purgers, c)
+	}
+	if c := o.Fastly; c != nil {
+		if c.ServiceID == "" || c.APIToken == "" {
+			return nil, fmt.Errorf("fastly purge requires a service id and API token")
+		}
+		purgers = append(purgers, c)
+	}
+	if c := o.CloudFront; c != nil {
+		if c.DistributionID == "" {
+			return nil, fmt.Errorf("cloudfront purge requires a distribution id")
+		}
+		if len(c.Paths) == 0 {
+			c.Paths = []string{"/*"}
+		}
+		if c.AWS == nil {
+			c.AWS = &AWSCredential{}
+		}
+		c.AWS.Region, c.AWS.Service = "us-east-1", "cloudfront"
+		if err := c.AWS.load(); err != nil {
+			return nil, fmt.Errorf("cloudfront purge aws credentials: %s", err)
+		}
+		purgers = append(purgers, c)
+	}
+	if len(purgers) == 0 {
+		return nil, fmt.Errorf("no CDN defined")
+	}
+	return purgers, nil
+}
+
+// Purge purges the given surrogate keys from every CDN, failing on the first CDN error
+func (p CDNPurgers) Purge(keys []string) error {
+	for _, purger := range p {
+		if err := purger.Purge(keys); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Purge purges the given cache tags, in batches of the Cloudflare API limit
+func (c *CloudflarePurger) Purge(keys []string) error {
+	for len(keys) > 0 {
+		batch := keys
+		if len(batch) > cloudflareMaxTags {
+			batch = batch[:cloudflareMaxTags]
+		}
+		keys = keys[len(batch):]
+
+		body, _ := json.Marshal(map[string][]string{"tags": batch})
+		req, err := http.NewRequest("POST", cloudflareAPI+"/zones/"+c.ZoneID+"/purge_cache", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+c.APIToken)
+		req.Header.Set("Content-Type", "application/json")
+		if err := doCDNPurge("cloudflare", req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Purge purges the given surrogate keys, in batches of the Fastly API limit
+func (c *FastlyPurger) Purge(keys []string) error {
+	for len(keys) > 0 {
+		batch := keys
+		if len(batch) > fastlyMaxKeys {
+			batch = batch[:fastlyMaxKeys]
+		}
+		keys = keys[len(batch):]
+
+		req, err := http.NewRequest("POST", fastlyAPI+"/service/"+c.ServiceID+"/purge", nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Fastly-Key", c.APIToken)
+		req.Header.Set("Surrogate-Key", strings.Join(batch, " "))
+		if c.Soft {
+			req.Header.Set("Fastly-Soft-Purge", "1")
+		}
+		if err := doCDNPurge("fastly", req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cloudFrontInvalidation represents the CloudFront invalidation batch request
+type cloudFrontInvalidation struct {
+	XMLName         xml.Name `xml:"http://cloudfront.amazonaws.com/doc/2020-05-31/ InvalidationBatch"`
+	CallerReference string   `xml:"CallerReference"`
+	Quantity        int      `xml:"Paths>Quantity"`
+	Paths           []string `xml:"Paths>Items>Path"`
+}
+
+// Purge creates an invalidation of the configured paths, regardless of the given keys
+func (c *CloudFrontPurger) Purge(keys []string) error {
+	now := time.Now()
+	body, err := xml.Marshal(cloudFrontInvalidation{
+		CallerReference: "imaginary-" + strconv.FormatInt(now.UnixNano(), 10),
+		Quantity:        len(c.Paths),
+		Paths:           c.Paths,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", cloudFrontAPI+"/distribution/"+c.DistributionID+"/invalidation", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/xml")
+	c.AWS.signPayload(req, body, now)
+	return doCDNPurge("cloudfront", req)
+}
+
+// doCDNPurge sends the given CDN purge API request, failing on non successful responses
+func doCDNPurge(cdn string, req *http.Request) error {
+	req.Header.Set("User-Agent", "imaginary/"+Version)
+	res, err := cdnPurgeClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("cannot purge the %s cache: %s", cdn, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("cannot purge the %s cache: (status=%d) %s", cdn, res.StatusCode, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+// purgeKeys returns the surrogate keys of the given purge request: the keys of the url and
+// file params source images plus the raw surrogate keys of the tag params.
+func purgeKeys(r *http.Request, o ServerOptions) []string {
+	query := r.URL.Query()
+	keys := []string{}
+	for _, name := range []string{"url", "file"} {
+		for _, source := range query[name] {
+			keys = append(keys, SurrogateKey(source, o.SurrogateKeyPrefix))
+		}
+	}
+	for _, tag := range query["tag"] {
+		keys = append(keys, parseList(tag)...)
+	}
+	return keys
+}
+
+// purgeController purges every cached image of the given source images
+func purgeController(o ServerOptions) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			ErrorReply(r, w, ErrMethodNotAllowed, o)
+			return
+		}
+
+		keys := purgeKeys(r, o)
+		if len(keys) == 0 {
+			ErrorReply(r, w, NewError("Missing required param: url, file or tag", BadRequest), o)
+			return
+		}
+
+		// Evict the cached images of every replica first, so the CDN cannot fetch them again
+		evicted := 0
+		peer := o.ResultCache != nil && o.ResultCache.isPeerRequest(r)
+		if o.ResultCache != nil {
+			evicted = o.ResultCache.Purge(keys)
+			if !peer {
+				o.ResultCache.purgePeers(r)
+			}
+		}
+
+		// The CDN caches are purged by the replica receiving the purge request only
+		if !peer {
+			if err := o.CDNPurgers.Purge(keys); err != nil {
+				ErrorReply(r, w, NewError(err.Error(), InternalError), o)
+				return
+			}
+		}
+		debug("purged surrogate keys: %s", strings.Join(keys, " "))
+
+		body, _ := json.Marshal(map[string]interface{}{"keys": keys, "evicted": evicted})
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}
+}
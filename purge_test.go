@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseCDNPurgers(t *testing.T) {
+	purgers, err := parseCDNPurgers([]byte(`{
+		"cloudflare": {"zoneId": "zone", "apiToken": "token"},
+		"fastly": {"serviceId": "service", "apiToken": "token", "soft": true},
+		"cloudfront": {"distributionId": "E123", "aws": {"accessKeyId": "AKID", "secretAccessKey": "secret"}}
+	}`))
+	if err != nil {
+		t.Fatalf("Cannot parse the CDN purgers: %s", err)
+	}
+	if len(purgers) != 3 {
+		t.Fatalf("Invalid CDN purgers: %d", len(purgers))
+	}
+	cloudfront := purgers[2].(*CloudFrontPurger)
+	if len(cloudfront.Paths) != 1 || cloudfront.Paths[0] != "/*" || cloudfront.AWS.Service != "cloudfront" {
+		t.Errorf("Invalid CloudFront purger defaults: %#v", cloudfront)
+	}
+
+	invalid := []string{
+		`{}`,
+		`{"cloudflare": {"zoneId": "zone"}}`,
+		`{"fastly": {"apiToken": "token"}}`,
+		`{"cloudfront": {"aws": {"accessKeyId": "AKID", "secretAccessKey": "secret"}}}`,
+		`not json`,
+	}
+	for _, config := range invalid {
+		if _, err := parseCDNPurgers([]byte(config)); err == nil {
+			t.Errorf("Expected error of %s", config)
+		}
+	}
+}
+
+func TestCloudflarePurger(t *testing.T) {
+	var batches [][]string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/zones/zone/purge_cache" || r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("Invalid purge request: %s %s", r.URL.Path, r.Header.Get("Authorization"))
+		}
+		var body map[string][]string
+		json.NewDecoder(r.Body).Decode(&body)
+		batches = append(batches, body["tags"])
+		w.Write([]byte(`{"success": true}`))
+	}))
+	defer ts.Close()
+	defer func(api string) { cloudflareAPI = api }(cloudflareAPI)
+	cloudflareAPI = ts.URL
+
+	keys := make([]string, cloudflareMaxTags+5)
+	for i := range keys {
+		keys[i] = "key"
+	}
+	if err := (&CloudflarePurger{ZoneID: "zone", APIToken: "token"}).Purge(keys); err != nil {
+		t.Fatalf("Cannot purge: %s", err)
+	}
+	if len(batches) != 2 || len(batches[0]) != cloudflareMaxTags || len(batches[1]) != 5 {
+		t.Errorf("Invalid purge batches: %d", len(batches))
+	}
+}
+
+func TestFastlyPurger(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/service/service/purge" || r.Header.Get("Fastly-Key") != "token" {
+			t.Errorf("Invalid purge request: %s", r.URL.Path)
+		}
+		if r.Header.Get("Surrogate-Key") != "a b" || r.Header.Get("Fastly-Soft-Purge") != "1" {
+			t.Errorf("Invalid purge headers: %v", r.Header)
+		}
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("invalid token"))
+	}))
+	defer ts.Close()
+	defer func(api string) { fastlyAPI = api }(fastlyAPI)
+	fastlyAPI = ts.URL
+
+	err := (&FastlyPurger{ServiceID: "service", APIToken: "token", Soft: true}).Purge([]string{"a", "b"})
+	if err == nil || !strings.Contains(err.Error(), "status=403") {
+		t.Errorf("Expected purge error: %v", err)
+	}
+}
+
+func TestCloudFrontPurger(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.URL.Path != "/distribution/E123/invalidation" {
+			t.Errorf("Invalid invalidation path: %s", r.URL.Path)
+		}
+		if !strings.Contains(string(body), "<Paths><Quantity>1</Quantity><Items><Path>/resize*</Path></Items></Paths>") {
+			t.Errorf("Invalid invalidation batch: %s", body)
+		}
+		if auth := r.Header.Get("Authorization"); !strings.Contains(auth, "/us-east-1/cloudfront/aws4_request") {
+			t.Errorf("Invalid Authorization header: %s", auth)
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer ts.Close()
+	defer func(api string) { cloudFrontAPI = api }(cloudFrontAPI)
+	cloudFrontAPI = ts.URL
+
+	aws := &AWSCredential{AccessKeyID: "AKID", SecretAccessKey: "secret", Region: "us-east-1", Service: "cloudfront"}
+	if err := (&CloudFrontPurger{DistributionID: "E123", Paths: []string{"/resize*"}, AWS: aws}).Purge(nil); err != nil {
+		t.Errorf("Cannot purge: %s", err)
+	}
+}
+
+type purgerFunc func([]string) error
+
+func (f purgerFunc) Purge(keys []string) error { return f(keys) }
+
+func TestPurgeController(t *testing.T) {
+	var purged []string
+	o := ServerOptions{SurrogateKeyPrefix: "img-", CDNPurgers: CDNPurgers{purgerFunc(func(keys []string) error {
+		purged = keys
+		return nil
+	})}}
+
+	w := httptest.NewRecorder()
+	purgeController(o)(w, httptest.NewRequest("POST", "/purge?url=http://cdn.example.com/cat.jpg&file=dog.jpg&tag=a,b", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Invalid response status: %d", w.Code)
+	}
+	expected := []string{SurrogateKey("http://cdn.example.com/cat.jpg", "img-"), SurrogateKey("dog.jpg", "img-"), "a", "b"}
+	if strings.Join(purged, " ") != strings.Join(expected, " ") {
+		t.Errorf("Invalid purged keys: %v", purged)
+	}
+
+	w = httptest.NewRecorder()
+	purgeController(o)(w, httptest.NewRequest("POST", "/purge", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Invalid response status of missing params: %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	purgeController(o)(w, httptest.NewRequest("GET", "/purge?tag=a", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Invalid response status of GET requests: %d", w.Code)
+	}
+}
+
+func TestPurgeControllerResultCache(t *testing.T) {
+	var forwarded int
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.Header.Get(CachePeerHeader) != "peer-secret" || r.URL.Query().Get("tag") != "cat" {
+			t.Errorf("Invalid forwarded purge request: %s %s", r.Method, r.URL)
+		}
+		forwarded++
+	}))
+	defer peer.Close()
+
+	var purges int
+	o := ServerOptions{ResultCache: NewResultCache(1024 * 1024), CDNPurgers: CDNPurgers{purgerFunc(func(keys []string) error {
+		purges++
+		return nil
+	})}}
+	o.ResultCache.Ring = NewPeerRing([]string{"http://127.0.0.1:8088", peer.URL})
+	o.ResultCache.Self = "http://127.0.0.1:8088"
+	o.ResultCache.Secret = "peer-secret"
+	o.ResultCache.Add("a", &cachedResult{Status: http.StatusOK, Body: []byte("image"), Surrogate: "cat"})
+
+	w := httptest.NewRecorder()
+	purgeController(o)(w, httptest.NewRequest("POST", "/purge?tag=cat", nil))
+	var body struct {
+		Evicted int `json:"evicted"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if body.Evicted != 1 || forwarded != 1 || purges != 1 {
+		t.Errorf("Invalid purge: evicted %d, forwarded %d, CDN purges %d", body.Evicted, forwarded, purges)
+	}
+
+	// Purge requests of the peers are neither forwarded nor purging the CDN again
+	r := httptest.NewRequest("POST", "/purge?tag=cat", nil)
+	r.Header.Set(CachePeerHeader, "peer-secret")
+	purgeController(o)(httptest.NewRecorder(), r)
+	if forwarded != 1 || purges != 1 {
+		t.Errorf("Peer purge requests should be local: forwarded %d, CDN purges %d", forwarded, purges)
+	}
+
+	// Purge requests without the peer secret are not trusted as forwarded
+	r = httptest.NewRequest("POST", "/purge?tag=cat", nil)
+	r.Header.Set(CachePeerHeader, "1")
+	purgeController(o)(httptest.NewRecorder(), r)
+	if forwarded != 2 || purges != 2 {
+		t.Errorf("Forged peer purge requests should be forwarded: forwarded %d, CDN purges %d", forwarded, purges)
+	}
+}
+
+func TestPurgeRouteAuthentication(t *testing.T) {
+	var purges int
+	o := ServerOptions{CDNPurgers: CDNPurgers{purgerFunc(func(keys []string) error {
+		purges++
+		return nil
+	})}}
+
+	// Unauthenticated servers do not serve the CDN purges
+	w := httptest.NewRecorder()
+	NewServerMux(o).ServeHTTP(w, httptest.NewRequest("POST", "/purge?tag=cat", nil))
+	if purges != 0 || w.Code != http.StatusNotFound {
+		t.Errorf("Unexpected unauthenticated CDN purge: %d, %d purges", w.Code, purges)
+	}
+
+	o.APIKey = "secret"
+	w = httptest.NewRecorder()
+	NewServerMux(o).ServeHTTP(w, httptest.NewRequest("POST", "/purge?tag=cat", nil))
+	if purges != 0 || w.Code != http.StatusUnauthorized {
+		t.Errorf("Invalid response status of missing API key: %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	NewServerMux(o).ServeHTTP(w, httptest.NewRequest("POST", "/purge?tag=cat&key=secret", nil))
+	if purges != 1 || w.Code != http.StatusOK {
+		t.Errorf("Invalid response status of authorized purge: %d, %d purges", w.Code, purges)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"testing"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+func TestReedSolomonRemainder(t *testing.T) {
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	expected := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+
+	if ecc := reedSolomonRemainder(data, reedSolomonDivisor(10)); !bytes.Equal(ecc, expected) {
+		t.Errorf("Invalid error correction codewords: %v", ecc)
+	}
+}
+
+func TestQRDataCodewords(t *testing.T) {
+	cases := []struct {
+		version  int
+		level    QRLevel
+		expected int
+	}{
+		{1, QRLevelL, 19},
+		{1, QRLevelM, 16},
+		{1, QRLevelQ, 13},
+		{1, QRLevelH, 9},
+		{40, QRLevelL, 2956},
+		{40, QRLevelH, 1276},
+	}
+
+	for _, test := range cases {
+		if n := qrDataCodewords(test.version, test.level); n != test.expected {
+			t.Errorf("Invalid data codewords for version %d: %d", test.version, n)
+		}
+	}
+}
+
+func TestQRAlignmentPositions(t *testing.T) {
+	cases := []struct {
+		version  int
+		expected []int
+	}{
+		{1, nil},
+		{7, []int{6, 22, 38}},
+		{32, []int{6, 34, 60, 86, 112, 138}},
+	}
+
+	for _, test := range cases {
+		positions := qrAlignmentPositions(test.version)
+		if len(positions) != len(test.expected) {
+			t.Fatalf("Invalid alignment positions for version %d: %v", test.version, positions)
+		}
+		for i := range positions {
+			if positions[i] != test.expected[i] {
+				t.Errorf("Invalid alignment positions for version %d: %v", test.version, positions)
+			}
+		}
+	}
+}
+
+func TestEncodeQR(t *testing.T) {
+	code, err := EncodeQR([]byte("https://example.com/ticket/12345"), QRLevelM)
+	if err != nil {
+		t.Fatalf("Cannot encode QR code: %s", err)
+	}
+	if code.Size != 29 {
+		t.Errorf("Invalid QR code size: %d", code.Size)
+	}
+	// Finder pattern corners
+	if !code.Dark(0, 0) || !code.Dark(code.Size-1, 0) || !code.Dark(0, code.Size-1) {
+		t.Error("Missing QR code finder patterns")
+	}
+
+	if _, err := EncodeQR(make([]byte, 3000), QRLevelL); err != ErrQRDataTooLong {
+		t.Errorf("Expected data too long error, got: %v", err)
+	}
+}
+
+func TestQR(t *testing.T) {
+	image, err := QR(nil, ImageOptions{Text: "imaginary", Width: 300, Type: "png"})
+	if err != nil {
+		t.Fatalf("Cannot generate QR code: %s", err)
+	}
+	if image.Mime != "image/png" {
+		t.Errorf("Invalid image MIME type: %s", image.Mime)
+	}
+
+	img, err := png.Decode(bytes.NewReader(image.Body))
+	if err != nil {
+		t.Fatalf("Cannot decode QR code: %s", err)
+	}
+	// 21 modules + quiet zone, scaled to the largest size fitting in 300px
+	if size := img.Bounds().Dx(); size != 290 {
+		t.Errorf("Invalid QR code size: %d", size)
+	}
+	if c := color.RGBAModel.Convert(img.At(0, 0)).(color.RGBA); c.R != 0xff {
+		t.Errorf("Invalid quiet zone color: %v", c)
+	}
+
+	if _, err := QR(nil, ImageOptions{}); err == nil {
+		t.Error("Expected missing text error")
+	}
+}
+
+func TestQROverlay(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("large.jpg"))
+
+	image, err := QR(buf, ImageOptions{Text: "imaginary", Position: "top-left"})
+	if err != nil {
+		t.Fatalf("Cannot overlay QR code: %s", err)
+	}
+	if image.Mime != "image/jpeg" {
+		t.Errorf("Invalid image MIME type: %s", image.Mime)
+	}
+
+	size, _ := bimg.Size(image.Body)
+	src, _ := bimg.Size(buf)
+	if size.Width != src.Width || size.Height != src.Height {
+		t.Errorf("Invalid image size: %dx%d", size.Width, size.Height)
+	}
+
+	if _, err := QR(buf, ImageOptions{Text: "imaginary", Width: 100000}); err == nil {
+		t.Error("Expected an error with an overlay exceeding the maximum canvas size")
+	}
+}
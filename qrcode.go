@@ -0,0 +1,139 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"net/http"
+	"strings"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// qrQuietZone is the QR code light border size in modules
+const qrQuietZone = 4
+
+// Default QR code params
+const (
+	qrDefaultSize          = 300
+	qrDefaultOverlayFactor = 0.2
+)
+
+// parseQRLevel parses the QR code error correction level, defaulting to M.
+func parseQRLevel(val string) QRLevel {
+	switch strings.ToUpper(strings.TrimSpace(val)) {
+	case "L":
+		return QRLevelL
+	case "Q":
+		return QRLevelQ
+	case "H":
+		return QRLevelH
+	}
+	return QRLevelM
+}
+
+// renderQR renders the QR code with its quiet zone, scaled by the maximum
+// integer module size fitting in the given size, to keep the modules sharp.
+func renderQR(q *QRCode, size int, fg, bg color.RGBA) *image.RGBA {
+	modules := q.Size + qrQuietZone*2
+	scale := size / modules
+	if scale < 1 {
+		scale = 1
+	}
+
+	canvas := newCanvas(modules*scale, modules*scale, bg, bg)
+	dark := &image.Uniform{fg}
+	for y := 0; y < q.Size; y++ {
+		for x := 0; x < q.Size; x++ {
+			if q.Dark(x, y) {
+				px, py := (x+qrQuietZone)*scale, (y+qrQuietZone)*scale
+				draw.Draw(canvas, image.Rect(px, py, px+scale, py+scale), dark, image.ZP, draw.Src)
+			}
+		}
+	}
+	return canvas
+}
+
+// QR generates a QR code image encoding the text param or, if the image buffer is
+// not empty, overlays the generated QR code onto the image at the given position.
+func QR(buf []byte, o ImageOptions) (Image, error) {
+	if o.Text == "" {
+		return Image{}, NewError("Missing required param: text", BadRequest)
+	}
+
+	code, err := EncodeQR([]byte(o.Text), parseQRLevel(o.QRLevel))
+	if err != nil {
+		return Image{}, NewError(err.Error(), BadRequest)
+	}
+
+	fg, bg := color.RGBA{0, 0, 0, 0xff}, color.RGBA{0xff, 0xff, 0xff, 0xff}
+	if len(o.Color) == 3 {
+		fg = color.RGBA{o.Color[0], o.Color[1], o.Color[2], 0xff}
+	}
+	if len(o.Background) == 3 {
+		bg = color.RGBA{o.Background[0], o.Background[1], o.Background[2], 0xff}
+	}
+
+	output := bimg.Options{Type: ImageType(o.Type), Quality: o.Quality, Compression: o.Compression}
+
+	if len(buf) == 0 {
+		size := o.Width
+		if size == 0 {
+			size = qrDefaultSize
+		}
+		if err := checkCanvasSize(size, size); err != nil {
+			return Image{}, err
+		}
+		return encodeCanvas(renderQR(code, size, fg, bg), output)
+	}
+
+	canvas, err := decodeCanvas(buf)
+	if err != nil {
+		return Image{}, err
+	}
+
+	// The default overlay size is bounded by the source image
+	size := o.Width
+	if size == 0 {
+		size = int(float64(minInt(canvas.Bounds().Dx(), canvas.Bounds().Dy())) * qrDefaultOverlayFactor)
+	} else if err := checkCanvasSize(size, size); err != nil {
+		return Image{}, err
+	}
+	qr := renderQR(code, size, fg, bg)
+
+	at := image.Pt(o.Left, o.Top)
+	if o.Left == 0 && o.Top == 0 {
+		at = overlayPosition(o.Position, canvas.Bounds(), qr.Bounds().Size(), o.Margin)
+	}
+	draw.Draw(canvas, qr.Bounds().Add(at), qr, image.ZP, draw.Src)
+
+	if output.Type == bimg.UNKNOWN {
+		output.Type = bimg.DetermineImageType(buf)
+	}
+	return encodeCanvas(canvas, output)
+}
+
+// qrcodeController generates QR code images or, if an image source is
+// present, overlays the QR code onto the source image.
+func qrcodeController(o ServerOptions) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if MatchSource(r) != nil {
+			validateImage(http.HandlerFunc(imageController(o, QR)), o).ServeHTTP(w, r)
+			return
+		}
+
+		image, err := runQueuedOperation(r, QR, nil, readParams(r.URL.Query()), o)
+		if replyContextError(r, w, o) {
+			return
+		}
+		if err != nil {
+			if e, ok := err.(Error); ok {
+				ErrorReply(r, w, e, o)
+				return
+			}
+			ErrorReply(r, w, NewError("Error while processing the image: "+err.Error(), BadRequest), o)
+			return
+		}
+		replyImage(w, image)
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// Automatic quality selection defaults
+const (
+	autoQualityMin   = 40
+	autoQualityMax   = 95
+	autoQualityDSSIM = 0.015
+)
+
+// isLossyType reports whether the given image type encoding quality is configurable
+func isLossyType(t bimg.ImageType) bool {
+	return t == bimg.JPEG || t == bimg.WEBP
+}
+
+// AutoQuality wraps the given operation, encoding its output at the lowest quality, within
+// the minquality and maxquality bounds, whose perceptual difference to the lossless output,
+// approximated via DSSIM, does not exceed the dssim threshold.
+func AutoQuality(operation Operation) Operation {
+	return func(buf []byte, o ImageOptions) (Image, error) {
+		output := outputOptions(buf, o)
+		if !isLossyType(output.Type) {
+			return operation(buf, o)
+		}
+
+		min, max, threshold := autoQualityBounds(o)
+		if min > max {
+			return Image{}, NewError("Minimum quality cannot be greater than maximum quality", BadRequest)
+		}
+
+		reference, err := losslessOutput(operation, buf, o)
+		if err != nil || reference.Mime != "image/png" {
+			return reference, err
+		}
+		ref, err := decodeCanvas(reference.Body)
+		if err != nil {
+			return Image{}, err
+		}
+
+		encode := func(quality int) (Image, error) {
+			return reencode(reference.Body, output.Type, quality, o)
+		}
+		acceptable := func(image Image) (bool, error) {
+			candidate, err := decodeCanvas(image.Body)
+			if err != nil {
+				return false, err
+			}
+			return dssim(ref, candidate) <= threshold, nil
+		}
+
+		// Binary search of the lowest acceptable quality, defaulting to the maximum quality
+		best, err := encode(max)
+		if err != nil {
+			return Image{}, err
+		}
+		for min < max {
+			quality := (min + max) / 2
+			image, err := encode(quality)
+			if err != nil {
+				return Image{}, err
+			}
+			ok, err := acceptable(image)
+			if err != nil {
+				return Image{}, err
+			}
+			if ok {
+				best, max = image, quality
+			} else {
+				min = quality + 1
+			}
+		}
+		return best, nil
+	}
+}
+
+// MaxBytes wraps the given operation, encoding its output at the highest quality, within the
+// minquality and maxquality bounds, whose size does not exceed the maxbytes param.
+func MaxBytes(operation Operation) Operation {
+	return func(buf []byte, o ImageOptions) (Image, error) {
+		image, err := operation(buf, o)
+		if err != nil || len(image.Body) <= o.MaxBytes || image.Mime == "application/json" {
+			return image, err
+		}
+
+		output := outputOptions(buf, o)
+		if !isLossyType(output.Type) {
+			return Image{}, errMaxBytes(o.MaxBytes)
+		}
+
+		min, max := o.MinQuality, o.MaxQuality
+		if min == 0 {
+			min = 1
+		}
+		if max == 0 || max > 100 {
+			max = autoQualityMax
+			if o.Quality > 0 && o.Quality <= 100 {
+				max = o.Quality
+			}
+		}
+		if min > max {
+			return Image{}, NewError("Minimum quality cannot be greater than maximum quality", BadRequest)
+		}
+
+		reference, err := losslessOutput(operation, buf, o)
+		if err != nil || reference.Mime != "image/png" {
+			return reference, err
+		}
+
+		// Binary search of the highest quality fitting the maximum size
+		var best Image
+		for min <= max {
+			quality := (min + max) / 2
+			image, err := reencode(reference.Body, output.Type, quality, o)
+			if err != nil {
+				return Image{}, err
+			}
+			if len(image.Body) <= o.MaxBytes {
+				best, min = image, quality+1
+			} else {
+				max = quality - 1
+			}
+		}
+		if best.Body == nil {
+			return Image{}, errMaxBytes(o.MaxBytes)
+		}
+		return best, nil
+	}
+}
+
+// errMaxBytes returns the error of the outputs exceeding the given maximum size
+func errMaxBytes(size int) Error {
+	return NewError(fmt.Sprintf("Cannot encode the image within %d bytes", size), BadRequest)
+}
+
+// reencode encodes the given lossless PNG reference output to the given type and quality, with
+// every encoding param of the given request: the compression, interlacing, lossless and metadata
+// stripping ones, and the chroma subsampling and WebP encoding wrappers params.
+func reencode(reference []byte, t bimg.ImageType, quality int, o ImageOptions) (Image, error) {
+	opts := ImageOptions{
+		Type:          bimg.ImageTypeName(t),
+		Quality:       quality,
+		Compression:   o.Compression,
+		Interlace:     o.Interlace,
+		Lossless:      o.Lossless,
+		StripMetadata: o.StripMetadata,
+		Subsample:     o.Subsample,
+		NearLossless:  o.NearLossless,
+		Effort:        o.Effort,
+	}
+
+	var encoder Operation = func(buf []byte, o ImageOptions) (Image, error) {
+		// The lossless output of the encoding wrappers is the reference itself
+		if o.Type == "png" {
+			return Image{Body: buf, Mime: "image/png"}, nil
+		}
+		return Process(buf, BimgOptions(o))
+	}
+	if opts.NearLossless != 0 || opts.Effort != 0 {
+		encoder = WebP(encoder)
+	}
+	if opts.Subsample != "" {
+		encoder = Subsample(encoder)
+	}
+	return encoder(reference, opts)
+}
+
+// losslessOutput returns the lossless PNG output of the given operation, which is
+// the reference of the encoding quality candidates.
+func losslessOutput(operation Operation, buf []byte, o ImageOptions) (Image, error) {
+	lossless := o
+	lossless.Type = "png"
+	lossless.Quality = 0
+	return operation(buf, lossless)
+}
+
+// autoQualityBounds returns the quality bounds and the DSSIM threshold, or their defaults
+func autoQualityBounds(o ImageOptions) (int, int, float64) {
+	min, max, threshold := o.MinQuality, o.MaxQuality, o.DSSIM
+	if min == 0 {
+		min = autoQualityMin
+	}
+	if max == 0 || max > 100 {
+		max = autoQualityMax
+	}
+	if threshold == 0 {
+		threshold = autoQualityDSSIM
+	}
+	return min, max, threshold
+}
+
+// dssim approximates the structural dissimilarity of the given images as 1/SSIM - 1,
+// so 0 means identical images. Images of different sizes are completely dissimilar.
+func dssim(a, b *image.RGBA) float64 {
+	similarity := ssim(a, b)
+	if similarity <= 0 {
+		return 1
+	}
+	return 1/similarity - 1
+}
+
+// ssim returns the mean structural similarity of the given images luma over 8x8 pixels
+// windows, where 1 means identical images, or 0 for images of different sizes.
+func ssim(a, b *image.RGBA) float64 {
+	if a.Bounds().Size() != b.Bounds().Size() {
+		return 0
+	}
+
+	const (
+		window = 8
+		c1     = (0.01 * 255) * (0.01 * 255)
+		c2     = (0.03 * 255) * (0.03 * 255)
+	)
+
+	size := a.Bounds().Size()
+	la, lb := luma(a), luma(b)
+	total, count := 0.0, 0
+	for y := 0; y < size.Y; y += window {
+		for x := 0; x < size.X; x += window {
+			var sa, sb, saa, sbb, sab, n float64
+			for wy := y; wy < y+window && wy < size.Y; wy++ {
+				for wx := x; wx < x+window && wx < size.X; wx++ {
+					va, vb := la[wy*size.X+wx], lb[wy*size.X+wx]
+					sa += va
+					sb += vb
+					saa += va * va
+					sbb += vb * vb
+					sab += va * vb
+					n++
+				}
+			}
+			ma, mb := sa/n, sb/n
+			va, vb, cov := saa/n-ma*ma, sbb/n-mb*mb, sab/n-ma*mb
+			total += ((2*ma*mb + c1) * (2*cov + c2)) / ((ma*ma + mb*mb + c1) * (va + vb + c2))
+			count++
+		}
+	}
+
+	if count == 0 {
+		return 0
+	}
+	return total / float64(count)
+}
+
+// luma returns the Rec. 601 luma of the given image pixels
+func luma(img *image.RGBA) []float64 {
+	size := img.Bounds().Size()
+	out := make([]float64, size.X*size.Y)
+	for y := 0; y < size.Y; y++ {
+		for x := 0; x < size.X; x++ {
+			p := img.Pix[y*img.Stride+x*4:]
+			out[y*size.X+x] = 0.299*float64(p[0]) + 0.587*float64(p[1]) + 0.114*float64(p[2])
+		}
+	}
+	return out
+}
+
+// isLargerOutput reports whether the given output is a re-encoding of the given source image,
+// whose type and dimensions are preserved, that is not smaller than the source image itself.
+func isLargerOutput(buf []byte, image Image, o ImageOptions) bool {
+	if o.Width != 0 || o.Height != 0 || len(image.Body) < len(buf) {
+		return false
+	}
+	if image.Mime != GetImageMimeType(bimg.DetermineImageType(buf)) {
+		return false
+	}
+	source, err := bimg.Size(buf)
+	if err != nil {
+		return false
+	}
+	output, err := bimg.Size(image.Body)
+	return err == nil && source == output
+}
+
+// QualityStep defines the default quality of the output images up to the given width,
+// or of any larger width if the width is zero.
+type QualityStep struct {
+	Width   int
+	Quality int
+}
+
+// QualityLadder defines the default quality of the output images by their width, applied
+// if the quality is not requested. The steps are sorted by width, the unbounded step last.
+type QualityLadder []QualityStep
+
+// Quality returns the default quality of the output images of the given width, or zero
+// if the width exceeds every step, keeping the libvips default quality.
+func (l QualityLadder) Quality(width int) int {
+	for _, step := range l {
+		if step.Width == 0 || width <= step.Width {
+			return step.Quality
+		}
+	}
+	return 0
+}
+
+// parseQualityLadder parses the comma separated width:quality steps of a quality ladder,
+// such as 200:60,800:75,*:82, the * width defining the quality of any larger width.
+func parseQualityLadder(input string) (QualityLadder, error) {
+	ladder := QualityLadder{}
+	for _, value := range parseList(input) {
+		parts := strings.SplitN(value, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("missing quality for width: %s", value)
+		}
+		step := QualityStep{}
+		if width := strings.TrimSpace(parts[0]); width != "*" {
+			var err error
+			if step.Width, err = strconv.Atoi(width); err != nil || step.Width <= 0 {
+				return nil, fmt.Errorf("invalid width: %s", value)
+			}
+		}
+		quality, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || quality < 1 || quality > 100 {
+			return nil, fmt.Errorf("invalid quality for width: %s", value)
+		}
+		step.Quality = quality
+		ladder = append(ladder, step)
+	}
+
+	sort.SliceStable(ladder, func(i, j int) bool {
+		a, b := ladder[i].Width, ladder[j].Width
+		return a != 0 && (b == 0 || a < b)
+	})
+	return ladder, nil
+}
+
+// ladderQuality returns the default quality of the given request output image width, defined by
+// the quality ladder, unless the request defines the quality.
+func ladderQuality(r *http.Request, width int, o ServerOptions) (int, bool) {
+	if len(o.QualityLadder) == 0 || r.URL.Query().Get("quality") != "" {
+		return 0, false
+	}
+	quality := o.QualityLadder.Quality(width)
+	return quality, quality > 0
+}
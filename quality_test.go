@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+func TestDSSIM(t *testing.T) {
+	a := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	b := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	for x := 0; x < 16; x++ {
+		a.Set(x, x, color.White)
+		b.Set(x, 15-x, color.White)
+	}
+
+	if d := dssim(a, a); d != 0 {
+		t.Errorf("Invalid DSSIM of identical images: %f", d)
+	}
+	if d := dssim(a, b); d <= 0.1 {
+		t.Errorf("Invalid DSSIM of different images: %f", d)
+	}
+	if d := dssim(a, image.NewRGBA(image.Rect(0, 0, 8, 8))); d != 1 {
+		t.Errorf("Invalid DSSIM of different sizes: %f", d)
+	}
+}
+
+func TestReadAutoQuality(t *testing.T) {
+	if o := readParams(url.Values{"quality": []string{"auto"}}); !o.AutoQuality || o.Quality != 0 {
+		t.Errorf("Invalid automatic quality params: %+v", o)
+	}
+	if o := readParams(url.Values{"quality": []string{"80"}}); o.AutoQuality || o.Quality != 80 {
+		t.Errorf("Invalid quality params: %+v", o)
+	}
+}
+
+func TestAutoQuality(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+	opts := ImageOptions{Width: 300, Height: 200, Type: "jpeg"}
+
+	// A lenient threshold selects a lower quality than a strict one
+	opts.DSSIM = 0.1
+	lenient, err := AutoQuality(Resize)(buf, opts)
+	if err != nil {
+		t.Fatalf("Cannot select the image quality: %s", err)
+	}
+	opts.DSSIM = 0.0001
+	strict, err := AutoQuality(Resize)(buf, opts)
+	if err != nil {
+		t.Fatalf("Cannot select the image quality: %s", err)
+	}
+
+	if bimg.DetermineImageType(lenient.Body) != bimg.JPEG {
+		t.Error("Invalid image type")
+	}
+	if err := assertSize(lenient.Body, 300, 200); err != nil {
+		t.Error(err)
+	}
+	if len(lenient.Body) >= len(strict.Body) {
+		t.Errorf("Invalid image sizes: lenient %d, strict %d", len(lenient.Body), len(strict.Body))
+	}
+
+	if _, err := AutoQuality(Resize)(buf, ImageOptions{Width: 300, MinQuality: 90, MaxQuality: 50}); err == nil {
+		t.Error("Expected an error with invalid quality bounds")
+	}
+}
+
+func TestAutoQualityEncoding(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+	opts := ImageOptions{Width: 300, Height: 200, Type: "jpeg", DSSIM: 0.01, Interlace: true, Subsample: "444"}
+
+	image, err := AutoQuality(Subsample(Resize))(buf, opts)
+	if err != nil {
+		t.Fatalf("Cannot select the image quality: %s", err)
+	}
+	// Progressive JPEG images define a progressive DCT start of frame (SOF2) marker
+	if !bytes.Contains(image.Body, []byte{0xff, 0xc2}) {
+		t.Error("The automatic quality candidates should be interlaced")
+	}
+	if sampling := jpegLumaSampling(image.Body); sampling != 0x11 {
+		t.Errorf("Invalid 4:4:4 sampling factors: %#x", sampling)
+	}
+}
+
+func TestMaxBytes(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+	opts := ImageOptions{Width: 300, Height: 200, Type: "jpeg", Quality: 95}
+
+	full, err := Resize(buf, opts)
+	if err != nil {
+		t.Fatalf("Cannot resize the image: %s", err)
+	}
+	opts.MaxBytes = len(full.Body) / 2
+
+	image, err := MaxBytes(Resize)(buf, opts)
+	if err != nil {
+		t.Fatalf("Cannot encode the image within the maximum size: %s", err)
+	}
+	if len(image.Body) > opts.MaxBytes {
+		t.Errorf("Invalid image size: %d > %d", len(image.Body), opts.MaxBytes)
+	}
+	if err := assertSize(image.Body, 300, 200); err != nil {
+		t.Error(err)
+	}
+
+	opts.MaxBytes = 100
+	if _, err := MaxBytes(Resize)(buf, opts); err == nil {
+		t.Error("Expected an error with an unreachable maximum size")
+	}
+	opts.MaxBytes, opts.Type = 100, "png"
+	if _, err := MaxBytes(Resize)(buf, opts); err == nil {
+		t.Error("Expected an error with a lossless image type")
+	}
+}
+
+func TestMaxBytesEncoding(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+	opts := ImageOptions{Width: 300, Height: 200, Type: "jpeg", MaxBytes: 20000, Interlace: true, Subsample: "444"}
+
+	image, err := MaxBytes(Subsample(Resize))(buf, opts)
+	if err != nil {
+		t.Fatalf("Cannot encode the image within the maximum size: %s", err)
+	}
+	// Progressive JPEG images define a progressive DCT start of frame (SOF2) marker
+	if !bytes.Contains(image.Body, []byte{0xff, 0xc2}) {
+		t.Error("The maximum size candidates should be interlaced")
+	}
+	if sampling := jpegLumaSampling(image.Body); sampling != 0x11 {
+		t.Errorf("Invalid 4:4:4 sampling factors: %#x", sampling)
+	}
+}
+
+func TestSkipLarger(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+	ts := testServer(controller(Convert))
+	defer ts.Close()
+
+	res, err := http.Post(ts.URL+"?type=jpeg&quality=100&skiplarger=true", "image/jpeg", bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("Invalid response status: %s", res.Status)
+	}
+	if res.Header.Get(BypassHeader) != "larger-output" {
+		t.Errorf("Invalid bypass header: %s", res.Header.Get(BypassHeader))
+	}
+	image, _ := ioutil.ReadAll(res.Body)
+	if !bytes.Equal(image, buf) {
+		t.Error("Expected the source image")
+	}
+
+	smaller, _ := Convert(buf, ImageOptions{Type: "jpeg", Quality: 10})
+	if isLargerOutput(buf, smaller, ImageOptions{}) {
+		t.Error("Unexpected larger output of a lower quality")
+	}
+	larger, _ := Convert(buf, ImageOptions{Type: "jpeg", Quality: 100})
+	if isLargerOutput(buf, larger, ImageOptions{Width: 550}) {
+		t.Error("Unexpected larger output with a requested width")
+	}
+
+	// The images decoded from the source image, such as the legacy ones, are not the source image
+	bmp := testBMP(3, 2, 24, bmpRGB, nil, make([]byte, 24))
+	res, err = http.Post(ts.URL+"?type=png&compression=0&skiplarger=true", "image/bmp", bytes.NewReader(bmp))
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	if res.StatusCode != 200 || res.Header.Get(BypassHeader) != "" {
+		t.Errorf("The decoded image should not be replied as the source image: %s %s", res.Status, res.Header.Get(BypassHeader))
+	}
+}
+
+func TestParseQualityLadder(t *testing.T) {
+	ladder, err := parseQualityLadder("*:82, 800:75,200:60")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := QualityLadder{{200, 60}, {800, 75}, {0, 82}}
+	if len(ladder) != len(expected) {
+		t.Fatalf("Invalid quality ladder: %v", ladder)
+	}
+	for i, step := range expected {
+		if ladder[i] != step {
+			t.Errorf("Invalid quality ladder step %d: %v", i, ladder[i])
+		}
+	}
+
+	for _, input := range []string{"200", "x:60", "0:60", "200:0", "200:101"} {
+		if _, err := parseQualityLadder(input); err == nil {
+			t.Errorf("Expected an error with the quality ladder: %s", input)
+		}
+	}
+}
+
+func TestQualityLadder(t *testing.T) {
+	ladder := QualityLadder{{200, 60}, {800, 75}, {0, 82}}
+	for width, quality := range map[int]int{100: 60, 200: 60, 201: 75, 800: 75, 1920: 82} {
+		if q := ladder.Quality(width); q != quality {
+			t.Errorf("Invalid quality of width %d: %d", width, q)
+		}
+	}
+	if q := (QualityLadder{{200, 60}}).Quality(300); q != 0 {
+		t.Errorf("The widths exceeding the ladder should keep the default quality: %d", q)
+	}
+
+	o := ServerOptions{QualityLadder: ladder}
+	r := httptest.NewRequest("GET", "/resize?width=150", nil)
+	if quality, ok := ladderQuality(r, 150, o); !ok || quality != 60 {
+		t.Errorf("Invalid ladder quality: %d", quality)
+	}
+	r = httptest.NewRequest("GET", "/resize?width=150&quality=90", nil)
+	if _, ok := ladderQuality(r, 150, o); ok {
+		t.Error("The requested quality should take precedence over the ladder")
+	}
+}
+
+func TestQualityLadderRequest(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("large.jpg"))
+	o := ServerOptions{QualityLadder: QualityLadder{{200, 10}, {0, 95}}}
+	size := func(url string, o ServerOptions) int {
+		w := httptest.NewRecorder()
+		imageHandler(w, httptest.NewRequest("POST", url, nil), buf, Resize, o, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Invalid response: %d %s", w.Code, w.Body.String())
+		}
+		return w.Body.Len()
+	}
+
+	if ladder, defaults := size("/resize?width=200", o), size("/resize?width=200", ServerOptions{}); ladder >= defaults {
+		t.Errorf("The ladder quality should apply to the small outputs: %d >= %d bytes", ladder, defaults)
+	}
+	if ladder, requested := size("/resize?width=200&quality=80", o), size("/resize?width=200&quality=80", ServerOptions{}); ladder != requested {
+		t.Errorf("The requested quality should take precedence: %d != %d bytes", ladder, requested)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// relativeParams are the dimension params accepting percentages of the source image
+// dimensions, such as width=50%, mapped to whether they are horizontal dimensions.
+var relativeParams = map[string]bool{
+	"width":      true,
+	"left":       true,
+	"areawidth":  true,
+	"height":     false,
+	"top":        false,
+	"areaheight": false,
+}
+
+// parsePercent parses the given percentage, such as 50%, as fraction, reporting whether the
+// value is a percentage. Invalid percentages are negative fractions.
+func parsePercent(val string) (float64, bool) {
+	val = strings.TrimSpace(val)
+	if !strings.HasSuffix(val, "%") {
+		return 0, false
+	}
+	percent, err := strconv.ParseFloat(strings.TrimSuffix(val, "%"), 64)
+	if err != nil || percent < 0 || math.IsInf(percent, 0) || math.IsNaN(percent) {
+		return -1, true
+	}
+	return percent / 100, true
+}
+
+// readRelativeParams reads the percentage values of the relative dimension params as fractions
+func readRelativeParams(get func(string) string) map[string]float64 {
+	var relative map[string]float64
+	for key := range relativeParams {
+		if fraction, ok := parsePercent(get(key)); ok {
+			if relative == nil {
+				relative = make(map[string]float64)
+			}
+			relative[key] = fraction
+		}
+	}
+	return relative
+}
+
+// relativeOptions resolves the percentage dimension params, and the scale param of the
+// non composite requests, against the source image dimensions, so callers can express
+// transformations relative to unknown source image dimensions.
+func relativeOptions(buf []byte, o ImageOptions) (ImageOptions, error) {
+	scale := o.Scale > 0 && o.Image == "" && o.Width == 0 && o.Height == 0
+	if len(o.Relative) == 0 && !scale {
+		return o, nil
+	}
+
+	meta, err := bimg.Metadata(buf)
+	if err != nil {
+		return o, NewError("Cannot retrieve image metadata: "+err.Error(), BadRequest)
+	}
+	width, height := meta.Size.Width, meta.Size.Height
+	if meta.Orientation >= 5 && !o.NoRotation {
+		width, height = height, width
+	}
+
+	if scale {
+		o.Width = int(math.Max(1, float64(width)*o.Scale+0.5))
+		o.Height = int(math.Max(1, float64(height)*o.Scale+0.5))
+		o.Scale = 0
+	}
+
+	for key, fraction := range o.Relative {
+		if fraction < 0 {
+			return o, NewError("Invalid percentage param: "+key, BadRequest)
+		}
+		size := height
+		if relativeParams[key] {
+			size = width
+		}
+		value := int(float64(size)*fraction + 0.5)
+
+		switch key {
+		case "width":
+			o.Width = value
+		case "height":
+			o.Height = value
+		case "left":
+			o.Left = value
+		case "top":
+			o.Top = value
+		case "areawidth":
+			o.AreaWidth = value
+		case "areaheight":
+			o.AreaHeight = value
+		}
+	}
+	o.Relative = nil
+	return o, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/url"
+	"testing"
+)
+
+func TestParsePercent(t *testing.T) {
+	cases := []struct {
+		value    string
+		fraction float64
+		percent  bool
+	}{
+		{"50%", 0.5, true},
+		{"12.5%", 0.125, true},
+		{"200", 0, false},
+		{"", 0, false},
+		{"-5%", -1, true},
+		{"abc%", -1, true},
+	}
+
+	for _, c := range cases {
+		if fraction, percent := parsePercent(c.value); fraction != c.fraction || percent != c.percent {
+			t.Errorf("Invalid %q percentage: %g, %t", c.value, fraction, percent)
+		}
+	}
+}
+
+func TestReadRelativeParams(t *testing.T) {
+	query, _ := url.ParseQuery("width=50%&height=200&top=10%")
+	opts := readParams(query)
+	if opts.Width != 0 || opts.Height != 200 {
+		t.Errorf("Invalid dimensions: %dx%d", opts.Width, opts.Height)
+	}
+	if len(opts.Relative) != 2 || opts.Relative["width"] != 0.5 || opts.Relative["top"] != 0.1 {
+		t.Errorf("Invalid relative params: %v", opts.Relative)
+	}
+
+	opts = readMapParams(map[string]interface{}{"width": "25%", "height": float64(100)})
+	if opts.Width != 0 || opts.Height != 100 || opts.Relative["width"] != 0.25 {
+		t.Errorf("Invalid pipeline relative params: %+v", opts)
+	}
+}
+
+func TestRelativeOptions(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+
+	opts, err := relativeOptions(buf, ImageOptions{Relative: map[string]float64{"width": 0.5, "areaheight": 0.25, "left": 0.1}})
+	if err != nil {
+		t.Fatalf("Cannot resolve the relative params: %s", err)
+	}
+	if opts.Width != 275 || opts.AreaHeight != 185 || opts.Left != 55 || opts.Relative != nil {
+		t.Errorf("Invalid relative params: %+v", opts)
+	}
+
+	opts, err = relativeOptions(buf, ImageOptions{Scale: 0.5})
+	if err != nil {
+		t.Fatalf("Cannot resolve the scale param: %s", err)
+	}
+	if opts.Width != 275 || opts.Height != 370 || opts.Scale != 0 {
+		t.Errorf("Invalid scaled dimensions: %dx%d", opts.Width, opts.Height)
+	}
+
+	// The composite overlay scale is preserved
+	if opts, _ := relativeOptions(buf, ImageOptions{Scale: 0.5, Image: "http://server/overlay.png"}); opts.Scale != 0.5 || opts.Width != 0 {
+		t.Errorf("Invalid composite scale: %+v", opts)
+	}
+
+	if _, err := relativeOptions(buf, ImageOptions{Relative: map[string]float64{"width": -1}}); err == nil {
+		t.Error("Expected an error with an invalid percentage")
+	}
+
+	image, err := Resize(buf, mustRelativeOptions(t, buf, ImageOptions{Relative: map[string]float64{"width": 0.5}}))
+	if err != nil {
+		t.Fatalf("Cannot resize the image: %s", err)
+	}
+	if err := assertSize(image.Body, 275, 370); err != nil {
+		t.Error(err)
+	}
+}
+
+func mustRelativeOptions(t *testing.T, buf []byte, o ImageOptions) ImageOptions {
+	opts, err := relativeOptions(buf, o)
+	if err != nil {
+		t.Fatalf("Cannot resolve the relative params: %s", err)
+	}
+	return opts
+}
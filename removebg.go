@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// ErrBackgroundRemovalDisabled is returned when no background removal service is configured
+var ErrBackgroundRemovalDisabled = NewError("Background removal is not enabled, see the -bgremoval-url flag", NotImplemented)
+
+var backgroundRemovalClient = &http.Client{Timeout: 60 * time.Second}
+
+// maxBackgroundRemovalSize is the maximum size of the background removal service output
+const maxBackgroundRemovalSize = 64 * 1024 * 1024
+
+// RemoveBackground returns the operation removing the image background via the external service
+// of the given URL, which replies the image foreground cutout, with transparent background,
+// and composites it over the background color, or the background image of the image param,
+// normalizing product photos. The background stays transparent if none is defined.
+func RemoveBackground(service string) Operation {
+	return func(buf []byte, o ImageOptions) (Image, error) {
+		if service == "" {
+			return Image{}, ErrBackgroundRemovalDisabled
+		}
+
+		body, err := removeBackground(o.Context, service, buf)
+		if err != nil {
+			return Image{}, NewError("Cannot remove the image background: "+err.Error(), BadGateway)
+		}
+		cutout, err := decodeCanvas(body)
+		if err != nil {
+			return Image{}, NewError("Cannot decode the background removal output: "+err.Error(), BadGateway)
+		}
+
+		size := cutout.Bounds().Size()
+		canvas := image.NewRGBA(cutout.Bounds())
+		switch {
+		case o.Image != "":
+			backgroundBuf, err := fetchOverlayImage(o.Context, o.Image)
+			if err != nil {
+				if e, ok := err.(Error); ok {
+					return Image{}, e
+				}
+				return Image{}, NewSourceError("Cannot fetch the background image: ", err)
+			}
+			background, err := decodeImage(backgroundBuf, bimg.Options{Width: size.X, Height: size.Y, Crop: true, Enlarge: true})
+			if err != nil {
+				return Image{}, NewError("Cannot decode the background image: "+err.Error(), BadRequest)
+			}
+			draw.Draw(canvas, canvas.Bounds(), background, background.Bounds().Min, draw.Src)
+		case len(o.Background) == 3:
+			c := color.RGBA{o.Background[0], o.Background[1], o.Background[2], 0xff}
+			draw.Draw(canvas, canvas.Bounds(), image.NewUniform(c), image.ZP, draw.Src)
+		}
+		compositeImage(canvas, cutout, image.ZP, blendModes[BlendNormal], 1)
+
+		// Transparent backgrounds require an alpha channel, unlike JPEG images
+		output := outputOptions(buf, o)
+		if o.Type == "" && !canvas.Opaque() {
+			output.Type = bimg.PNG
+		}
+		return encodeCanvas(canvas, output)
+	}
+}
+
+// removeBackground posts the image to the background removal service, returning its output,
+// bound to the given request context, if any, and limited to the maximum output size.
+func removeBackground(ctx context.Context, service string, buf []byte) ([]byte, error) {
+	req, err := http.NewRequest("POST", service, bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	if ctx != nil {
+		req = req.WithContext(ctx)
+	}
+	req.Header.Set("Content-Type", GetImageMimeType(bimg.DetermineImageType(buf)))
+	req.Header.Set("User-Agent", "imaginary/"+Version)
+
+	res, err := backgroundRemovalClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		return nil, fmt.Errorf("invalid response status: %d", res.StatusCode)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxBackgroundRemovalSize+1))
+	if err == nil && len(body) > maxBackgroundRemovalSize {
+		err = fmt.Errorf("output exceeds maximum allowed %d bytes", maxBackgroundRemovalSize)
+	}
+	return body, err
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+func TestRemoveBackground(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+
+	// The fake service cuts out the left half of a 40x20 image
+	cutout := image.NewNRGBA(image.Rect(0, 0, 40, 20))
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 20; x++ {
+			cutout.Set(x, y, color.NRGBA{0, 0, 255, 255})
+		}
+	}
+	var body bytes.Buffer
+	png.Encode(&body, cutout)
+
+	ts := testServer(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "image/jpeg" {
+			t.Errorf("Invalid background removal request type: %s", r.Header.Get("Content-Type"))
+		}
+		w.Write(body.Bytes())
+	})
+	defer ts.Close()
+
+	image, err := RemoveBackground(ts.URL)(buf, ImageOptions{})
+	if err != nil {
+		t.Fatalf("Cannot remove the image background: %s", err)
+	}
+	if bimg.DetermineImageType(image.Body) != bimg.PNG {
+		t.Error("Expected a PNG image with transparent background")
+	}
+	if err := assertSize(image.Body, 40, 20); err != nil {
+		t.Error(err)
+	}
+
+	image, err = RemoveBackground(ts.URL)(buf, ImageOptions{Background: []uint8{255, 255, 255}})
+	if err != nil {
+		t.Fatalf("Cannot remove the image background: %s", err)
+	}
+	if bimg.DetermineImageType(image.Body) != bimg.JPEG {
+		t.Error("Expected a JPEG image with white background")
+	}
+	canvas, _ := decodeCanvas(image.Body)
+	if c := canvas.RGBAAt(30, 10); c.R < 240 || c.G < 240 || c.B < 240 {
+		t.Errorf("Invalid background color: %v", c)
+	}
+	if c := canvas.RGBAAt(5, 10); c.B < 200 || c.R > 50 {
+		t.Errorf("Invalid foreground color: %v", c)
+	}
+}
+
+func TestRemoveBackgroundDisabled(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+	if _, err := RemoveBackground("")(buf, ImageOptions{}); err != ErrBackgroundRemovalDisabled {
+		t.Errorf("Expected the disabled background removal error: %v", err)
+	}
+}
+
+func TestRemoveBackgroundServiceError(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+	ts := testServer(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	defer ts.Close()
+
+	_, err := RemoveBackground(ts.URL)(buf, ImageOptions{})
+	if e, ok := err.(Error); !ok || e.HTTPCode() != http.StatusBadGateway {
+		t.Errorf("Expected a bad gateway error of the failed service: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := RemoveBackground(ts.URL)(buf, ImageOptions{Context: ctx}); err == nil {
+		t.Error("Expected an error of the canceled request")
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// ErrorReport represents the details of a reported server error or panic.
+type ErrorReport struct {
+	Message    string    `json:"message"`
+	Status     int       `json:"status"`
+	Operation  string    `json:"operation"`
+	SourceHost string    `json:"sourceHost,omitempty"`
+	Stacktrace string    `json:"stacktrace,omitempty"`
+	Panic      bool      `json:"panic"`
+	Time       time.Time `json:"time"`
+}
+
+// ErrorReporter defines the interface for external error reporting services.
+type ErrorReporter interface {
+	Report(ErrorReport) error
+}
+
+var reporterClient = &http.Client{Timeout: 10 * time.Second}
+
+// NewErrorReport creates a new error report for the given request.
+// Only the origin host is exposed from the image source URL, since the path
+// or query params may carry secrets.
+func NewErrorReport(r *http.Request, message string, status int) ErrorReport {
+	report := ErrorReport{
+		Message:   message,
+		Status:    status,
+		Operation: endpointName(r),
+		Time:      time.Now().UTC(),
+	}
+	if u, err := url.Parse(r.URL.Query().Get("url")); err == nil {
+		report.SourceHost = u.Hostname()
+	}
+	return report
+}
+
+// reportError sends the error report in background, if a reporter is configured.
+func reportError(o ServerOptions, report ErrorReport) {
+	if o.ErrorReporter == nil {
+		return
+	}
+	go func() {
+		if err := o.ErrorReporter.Report(report); err != nil {
+			debug("cannot report error: %s", err)
+		}
+	}()
+}
+
+// WebhookReporter reports errors as JSON via HTTP POST requests to a generic webhook URL.
+type WebhookReporter struct {
+	URL string
+}
+
+// Report sends the error report to the webhook.
+func (w *WebhookReporter) Report(report ErrorReport) error {
+	body, _ := json.Marshal(report)
+	return postJSON(w.URL, body, nil)
+}
+
+// SentryReporter reports errors to Sentry using its HTTP store API.
+type SentryReporter struct {
+	storeURL  string
+	publicKey string
+	secretKey string
+}
+
+// NewSentryReporter creates a new Sentry reporter based on the given project DSN,
+// such as: https://<key>@sentry.io/<project>
+func NewSentryReporter(dsn string) (*SentryReporter, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if u.User == nil || u.User.Username() == "" {
+		return nil, fmt.Errorf("missing Sentry DSN public key")
+	}
+
+	path := strings.TrimSuffix(u.Path, "/")
+	i := strings.LastIndex(path, "/")
+	if i == -1 || path[i+1:] == "" {
+		return nil, fmt.Errorf("missing Sentry DSN project ID")
+	}
+
+	secret, _ := u.User.Password()
+	storeURL := fmt.Sprintf("%s://%s%s/api/%s/store/", u.Scheme, u.Host, path[:i], path[i+1:])
+	return &SentryReporter{storeURL: storeURL, publicKey: u.User.Username(), secretKey: secret}, nil
+}
+
+// Report sends the error report as Sentry event.
+func (s *SentryReporter) Report(report ErrorReport) error {
+	hostname, _ := os.Hostname()
+	event := map[string]interface{}{
+		"event_id":    newEventID(),
+		"timestamp":   report.Time.Format("2006-01-02T15:04:05"),
+		"level":       "error",
+		"logger":      "imaginary",
+		"platform":    "go",
+		"message":     report.Message,
+		"server_name": hostname,
+		"release":     Version,
+		"tags": map[string]string{
+			"operation":   report.Operation,
+			"source_host": report.SourceHost,
+			"status":      fmt.Sprintf("%d", report.Status),
+			"panic":       fmt.Sprintf("%t", report.Panic),
+		},
+		"extra": map[string]string{
+			"stacktrace": report.Stacktrace,
+		},
+	}
+
+	auth := fmt.Sprintf("Sentry sentry_version=7, sentry_client=imaginary/%s, sentry_timestamp=%d, sentry_key=%s",
+		Version, report.Time.Unix(), s.publicKey)
+	if s.secretKey != "" {
+		auth += ", sentry_secret=" + s.secretKey
+	}
+
+	body, _ := json.Marshal(event)
+	return postJSON(s.storeURL, body, http.Header{"X-Sentry-Auth": []string{auth}})
+}
+
+func newEventID() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+func postJSON(url string, body []byte, headers http.Header) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range headers {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "imaginary/"+Version)
+
+	res, err := reporterClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("invalid response status: %d", res.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/golang-lru/simplelru"
+)
+
+// CachePeerHeader marks the requests forwarded by the replicas to the cache key owner, which
+// are never forwarded again, by the shared secret of the replicas, so clients cannot forge it.
+const CachePeerHeader = "Imaginary-Cache-Peer"
+
+// CacheOwnerHeader is the routing hint of the replica owning the cached images of a source
+// image, sent in the responses if enabled, and honored in the requests of load balancers.
+const CacheOwnerHeader = "Imaginary-Cache-Owner"
+
+// cacheForwardedHeaders are the request headers forwarded to the cache key owner
+var cacheForwardedHeaders = []string{"Accept", "API-Key", "Authorization", "X-Forward-Authorization"}
+
+// cachePeerHopHeaders are the owner response headers set by every replica itself
+var cachePeerHopHeaders = map[string]bool{"Connection": true, "Date": true, "Keep-Alive": true, "Server": true, "Transfer-Encoding": true, CacheOwnerHeader: true}
+
+var cachePeerClient = &http.Client{Timeout: 2 * time.Minute}
+
+// cachedResult represents a processed image response
+type cachedResult struct {
+	Status    int
+	Header    http.Header
+	Body      []byte
+	Surrogate string
+}
+
+// resultFlight represents an in flight image processing of a cache key, shared by the
+// concurrent requests of the same image.
+type resultFlight struct {
+	done   chan struct{}
+	result *cachedResult
+	shared bool
+}
+
+// ResultCacheStats represents the result cache usage counters
+type ResultCacheStats struct {
+	Items     int     `json:"items"`
+	Bytes     int64   `json:"bytes"`
+	Hits      int64   `json:"hits"`
+	Misses    int64   `json:"misses"`
+	PeerHits  int64   `json:"peerHits"`
+	PeerFails int64   `json:"peerFails"`
+	HitRatio  float64 `json:"hitRatio"`
+}
+
+// ResultCache caches the processed images of the GET requests in memory, up to the given
+// size in bytes, evicting the least recently used images. When peers are defined, every
+// image is cached by its owner replica only, via the consistent hash ring of the replicas,
+// so scaling out does not multiply the source image fetches and processing.
+type ResultCache struct {
+	mutex      sync.Mutex
+	lru        *simplelru.LRU
+	size       int64
+	maxSize    int64
+	flights    map[string]*resultFlight
+	surrogates map[string]map[string]bool
+
+	Ring   *PeerRing
+	Self   string
+	Secret string
+	Hints  bool
+
+	hits, misses, peerHits, peerFails int64
+}
+
+// NewResultCache creates a new result cache of the given size, in bytes
+func NewResultCache(maxSize int64) *ResultCache {
+	c := &ResultCache{
+		maxSize:    maxSize,
+		flights:    map[string]*resultFlight{},
+		surrogates: map[string]map[string]bool{},
+	}
+	c.lru, _ = simplelru.NewLRU(math.MaxInt32, c.evicted)
+	return c
+}
+
+// evicted updates the cache size and surrogate keys index of the evicted image
+func (c *ResultCache) evicted(key, value interface{}) {
+	result := value.(*cachedResult)
+	c.size -= int64(len(result.Body))
+	if keys := c.surrogates[result.Surrogate]; keys != nil {
+		delete(keys, key.(string))
+		if len(keys) == 0 {
+			delete(c.surrogates, result.Surrogate)
+		}
+	}
+}
+
+// Get returns the cached image of the given key
+func (c *ResultCache) Get(key string) (*cachedResult, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	value, ok := c.lru.Get(key)
+	if !ok {
+		return nil, false
+	}
+	return value.(*cachedResult), true
+}
+
+// Add caches the given image, evicting the least recently used images if the cache is full.
+// Images larger than an eighth of the cache are not cached, preserving the cache hit ratio.
+func (c *ResultCache) Add(key string, result *cachedResult) {
+	size := int64(len(result.Body))
+	if size > c.maxSize/8 {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.lru.Remove(key)
+	c.lru.Add(key, result)
+	c.size += size
+	if result.Surrogate != "" {
+		if c.surrogates[result.Surrogate] == nil {
+			c.surrogates[result.Surrogate] = map[string]bool{}
+		}
+		c.surrogates[result.Surrogate][key] = true
+	}
+	for c.size > c.maxSize {
+		c.lru.RemoveOldest()
+	}
+}
+
+// Purge evicts every cached image of the given surrogate keys, returning the evicted images count
+func (c *ResultCache) Purge(surrogates []string) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	purged := 0
+	for _, surrogate := range surrogates {
+		for key := range c.surrogates[surrogate] {
+			if c.lru.Remove(key) {
+				purged++
+			}
+		}
+	}
+	return purged
+}
+
+// Stats returns the cache usage counters
+func (c *ResultCache) Stats() ResultCacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	stats := ResultCacheStats{
+		Items:     c.lru.Len(),
+		Bytes:     c.size,
+		Hits:      atomic.LoadInt64(&c.hits),
+		Misses:    atomic.LoadInt64(&c.misses),
+		PeerHits:  atomic.LoadInt64(&c.peerHits),
+		PeerFails: atomic.LoadInt64(&c.peerFails),
+	}
+	if lookups := stats.Hits + stats.Misses; lookups > 0 {
+		stats.HitRatio = toFixed(float64(stats.Hits)/float64(lookups), 4)
+	}
+	return stats
+}
+
+// Owner returns the peer owning the cached images of the given request, or an empty string
+// without peers. Every image of a source image is owned by the peer of the source hash, so
+// its renditions are cached together, while images of no source are owned by the peer of
+// their cache key. The routing hint of the request is honored if it names a ring peer.
+func (c *ResultCache) Owner(r *http.Request, key string, o ServerOptions) string {
+	if c.Ring == nil {
+		return ""
+	}
+	if hint := r.Header.Get(CacheOwnerHeader); hint != "" && c.Ring.Has(hint) {
+		return hint
+	}
+	if source := requestSurrogateKey(r, o); source != "" {
+		key = source
+	}
+	return c.Ring.Get(key)
+}
+
+// isPeerRequest reports whether the given request is forwarded by a replica, authenticated
+// by the shared secret of the replicas.
+func (c *ResultCache) isPeerRequest(r *http.Request) bool {
+	value := r.Header.Get(CachePeerHeader)
+	return c.Secret != "" && subtle.ConstantTimeCompare([]byte(value), []byte(c.Secret)) == 1
+}
+
+// do returns the cached image of the given key, otherwise running the given processing once
+// for every concurrent request of the key, caching its successful result. Results of canceled
+// requests are not shared, so the concurrent requests process the image themselves.
+// It also reports whether the returned image is a cached or shared one.
+func (c *ResultCache) do(key string, process func() (*cachedResult, bool)) (*cachedResult, bool) {
+	c.mutex.Lock()
+	if value, ok := c.lru.Get(key); ok {
+		c.mutex.Unlock()
+		atomic.AddInt64(&c.hits, 1)
+		return value.(*cachedResult), true
+	}
+	if flight, ok := c.flights[key]; ok {
+		c.mutex.Unlock()
+		<-flight.done
+		if !flight.shared {
+			result, _ := process()
+			return result, false
+		}
+		atomic.AddInt64(&c.hits, 1)
+		return flight.result, true
+	}
+	flight := &resultFlight{done: make(chan struct{})}
+	c.flights[key] = flight
+	c.mutex.Unlock()
+
+	atomic.AddInt64(&c.misses, 1)
+	defer func() {
+		c.mutex.Lock()
+		delete(c.flights, key)
+		c.mutex.Unlock()
+		close(flight.done)
+	}()
+
+	flight.result, flight.shared = process()
+	if flight.shared && flight.result.Status == http.StatusOK {
+		c.Add(key, flight.result)
+	}
+	return flight.result, false
+}
+
+// resultCacheKey returns the cache key of the given request: the digest of the endpoint,
+// the sorted query params but the API key, the negotiated output type and the forwarded
+// origin authorization, if enabled.
+func resultCacheKey(r *http.Request, o ServerOptions) string {
+	query := r.URL.Query()
+	query.Del("key")
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	buf.WriteString(r.URL.Path)
+	for _, name := range names {
+		for _, value := range query[name] {
+			buf.WriteString("\n" + url.QueryEscape(name) + "=" + url.QueryEscape(value))
+		}
+	}
+	buf.WriteString("\naccept=" + determineAcceptMimeType(r.Header.Get("Accept")))
+	if o.AuthForwarding {
+		buf.WriteString("\nauth=" + r.Header.Get("X-Forward-Authorization") + r.Header.Get("Authorization"))
+	}
+
+	digest := sha256.Sum256(buf.Bytes())
+	return hex.EncodeToString(digest[:])
+}
+
+// resultRecorder records the processed image response
+type resultRecorder struct {
+	result *cachedResult
+	body   bytes.Buffer
+}
+
+func (r *resultRecorder) Header() http.Header {
+	return r.result.Header
+}
+
+func (r *resultRecorder) WriteHeader(status int) {
+	if r.result.Status == 0 {
+		r.result.Status = status
+	}
+}
+
+func (r *resultRecorder) Write(buf []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.body.Write(buf)
+}
+
+// writeResult replies with the given processed image response and its cache status debug
+// header, if any, replacing the timings of the cached image processing on cache hits.
+// The Range requests of the cached images are honored.
+func writeResult(w http.ResponseWriter, r *http.Request, result *cachedResult, cacheStatus string) {
+	for name, values := range result.Header {
+		w.Header()[name] = append([]string(nil), values...)
+	}
+	if cacheStatus != "" {
+		w.Header().Set(DebugCacheHeader, cacheStatus)
+	}
+	if cacheStatus == "hit" {
+		w.Header().Set(ServerTimingHeader, "cache;desc=hit")
+	}
+	if result.Status == http.StatusOK {
+		replyImageRange(w, r, Image{Body: result.Body, Mime: result.Header.Get("Content-Type")})
+		return
+	}
+	w.WriteHeader(result.Status)
+	w.Write(result.Body)
+}
+
+// isResultCached reports whether the processed image of the given request is cached by the
+// result cache, if enabled: the GET requests, but the explained and original ones.
+func isResultCached(r *http.Request, o ServerOptions) bool {
+	return o.ResultCache != nil && r.Method == "GET" && !explainRequested(r, o) && !originalRequested(r, o)
+}
+
+// cacheResults wraps the given image controller, replying with the cached images of the GET
+// requests, or forwarding them to the replica owning their source image. The original source
+// images, replied unmodified, are not cached.
+func cacheResults(fn func(http.ResponseWriter, *http.Request), o ServerOptions) func(http.ResponseWriter, *http.Request) {
+	c := o.ResultCache
+	if c == nil {
+		return fn
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isResultCached(r, o) {
+			fn(w, r)
+			return
+		}
+
+		key := resultCacheKey(r, o)
+		owner := c.Owner(r, key, o)
+		if c.Hints && owner != "" {
+			w.Header().Set(CacheOwnerHeader, owner)
+		}
+		if owner != "" && owner != c.Self && !c.isPeerRequest(r) {
+			result, err := fetchPeerResult(owner, c.Secret, r)
+			if err == nil {
+				atomic.AddInt64(&c.peerHits, 1)
+				writeResult(w, r, result, debugCacheStatus("peer", o))
+				return
+			}
+			// Process the image locally if the owner is unavailable
+			atomic.AddInt64(&c.peerFails, 1)
+			debug("cannot fetch the cached image of peer %s: %s", owner, err)
+		}
+
+		result, hit := c.do(key, func() (*cachedResult, bool) {
+			recorder := &resultRecorder{result: &cachedResult{Header: http.Header{}, Surrogate: requestSurrogateKey(r, o)}}
+			fn(recorder, r)
+			if recorder.result.Status == 0 {
+				recorder.result.Status = http.StatusOK
+			}
+			recorder.result.Body = recorder.body.Bytes()
+			return recorder.result, r.Context().Err() == nil
+		})
+		status := "miss"
+		if hit {
+			status = "hit"
+		}
+		writeResult(w, r, result, debugCacheStatus(status, o))
+	}
+}
+
+// fetchPeerResult forwards the given image request to the given owner peer, authenticated by
+// the given shared secret.
+func fetchPeerResult(peer, secret string, r *http.Request) (*cachedResult, error) {
+	req, err := http.NewRequest("GET", peer+r.URL.RequestURI(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(r.Context())
+	for _, name := range cacheForwardedHeaders {
+		if value := r.Header.Get(name); value != "" {
+			req.Header.Set(name, value)
+		}
+	}
+	req.Header.Set(CachePeerHeader, secret)
+	req.Header.Set("User-Agent", "imaginary/"+Version)
+
+	res, err := cachePeerClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 500 {
+		return nil, fmt.Errorf("(status=%d)", res.StatusCode)
+	}
+
+	var body bytes.Buffer
+	if _, err := io.Copy(&body, res.Body); err != nil {
+		return nil, err
+	}
+	header := http.Header{}
+	for name, values := range res.Header {
+		if !cachePeerHopHeaders[name] && !strings.HasPrefix(name, "Access-Control-") {
+			header[name] = values
+		}
+	}
+	header.Set("Content-Length", strconv.Itoa(body.Len()))
+	return &cachedResult{Status: res.StatusCode, Header: header, Body: body.Bytes()}, nil
+}
+
+// purgePeers forwards the given purge request to the other replicas, evicting their cached images
+func (c *ResultCache) purgePeers(r *http.Request) {
+	if c.Ring == nil {
+		return
+	}
+	for _, peer := range c.Ring.Peers() {
+		if peer == c.Self {
+			continue
+		}
+		req, err := http.NewRequest("POST", peer+r.URL.RequestURI(), nil)
+		if err != nil {
+			continue
+		}
+		if key := r.Header.Get("API-Key"); key != "" {
+			req.Header.Set("API-Key", key)
+		}
+		req.Header.Set(CachePeerHeader, c.Secret)
+		req.Header.Set("User-Agent", "imaginary/"+Version)
+
+		res, err := cachePeerClient.Do(req)
+		if err != nil {
+			debug("cannot purge the cached images of peer %s: %s", peer, err)
+			continue
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			debug("cannot purge the cached images of peer %s: (status=%d)", peer, res.StatusCode)
+		}
+	}
+}
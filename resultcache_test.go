@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestResultCacheEviction(t *testing.T) {
+	c := NewResultCache(800)
+	body := bytes.Repeat([]byte("x"), 100)
+	for _, key := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		c.Add(key, &cachedResult{Status: http.StatusOK, Body: body, Surrogate: "cat"})
+	}
+	c.Get("a")
+	c.Add("i", &cachedResult{Status: http.StatusOK, Body: body, Surrogate: "dog"})
+
+	if _, ok := c.Get("b"); ok {
+		t.Error("Least recently used image should be evicted")
+	}
+	if _, ok := c.Get("a"); !ok {
+		t.Error("Recently used image should not be evicted")
+	}
+	if stats := c.Stats(); stats.Items != 8 || stats.Bytes != 800 {
+		t.Errorf("Invalid cache stats: %#v", stats)
+	}
+
+	c.Add("large", &cachedResult{Status: http.StatusOK, Body: bytes.Repeat([]byte("x"), 101)})
+	if _, ok := c.Get("large"); ok {
+		t.Error("Images larger than an eighth of the cache should not be cached")
+	}
+
+	if purged := c.Purge([]string{"cat", "unknown"}); purged != 7 {
+		t.Errorf("Invalid purged images count: %d", purged)
+	}
+	if _, ok := c.Get("i"); !ok {
+		t.Error("Images of other surrogate keys should not be purged")
+	}
+	if stats := c.Stats(); stats.Items != 1 || stats.Bytes != 100 {
+		t.Errorf("Invalid cache stats after purge: %#v", stats)
+	}
+}
+
+func TestResultCacheKey(t *testing.T) {
+	o := ServerOptions{}
+	key := func(path string, accept string) string {
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("Accept", accept)
+		return resultCacheKey(r, o)
+	}
+
+	expected := key("/resize?width=100&url=http://example.com/cat.jpg", "")
+	if value := key("/resize?url=http://example.com/cat.jpg&width=100&key=secret", ""); value != expected {
+		t.Error("Cache key should ignore the params order and API key")
+	}
+
+	different := []string{
+		key("/resize?width=200&url=http://example.com/cat.jpg", ""),
+		key("/crop?width=100&url=http://example.com/cat.jpg", ""),
+		key("/resize?width=100&url=http://example.com/cat.jpg", "image/webp"),
+	}
+	for _, value := range different {
+		if value == expected {
+			t.Error("Cache key should depend on the endpoint, params and output type")
+		}
+	}
+}
+
+func TestCacheResults(t *testing.T) {
+	var calls int32
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(50 * time.Millisecond)
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write([]byte("image"))
+	}
+	o := ServerOptions{ResultCache: NewResultCache(1024 * 1024)}
+	handler := cacheResults(fn, o)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			handler(w, httptest.NewRequest("GET", "/resize?width=100&url=http://example.com/cat.jpg", nil))
+			if w.Body.String() != "image" || w.Header().Get("Content-Type") != "image/jpeg" {
+				t.Errorf("Invalid cached response: %s", w.Body.String())
+			}
+		}()
+	}
+	wg.Wait()
+	if calls != 1 {
+		t.Errorf("Concurrent requests should be processed once: %d", calls)
+	}
+
+	handler(httptest.NewRecorder(), httptest.NewRequest("POST", "/resize?width=100", strings.NewReader("image")))
+	if calls != 2 {
+		t.Errorf("POST requests should not be cached: %d", calls)
+	}
+	if stats := o.ResultCache.Stats(); stats.Items != 1 || stats.Hits != 4 || stats.Misses != 1 {
+		t.Errorf("Invalid cache stats: %#v", stats)
+	}
+}
+
+func TestIsResultCached(t *testing.T) {
+	o := ServerOptions{ResultCache: NewResultCache(1024 * 1024), EnableOriginal: true}
+	cases := []struct {
+		method  string
+		url     string
+		options ServerOptions
+		cached  bool
+	}{
+		{"GET", "/fit?width=300&height=200", o, true},
+		{"POST", "/fit?width=300&height=200", o, false},
+		{"GET", "/fit?width=300&height=200&raw=true", o, false},
+		{"GET", "/fit?width=300&height=200", ServerOptions{}, false},
+	}
+	for _, c := range cases {
+		if cached := isResultCached(httptest.NewRequest(c.method, c.url, nil), c.options); cached != c.cached {
+			t.Errorf("Invalid result caching of %s %s: %t", c.method, c.url, cached)
+		}
+	}
+}
+
+func TestCacheResultsErrors(t *testing.T) {
+	var calls int32
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	handler := cacheResults(fn, ServerOptions{ResultCache: NewResultCache(1024 * 1024)})
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "/resize?width=0", nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Invalid response status: %d", w.Code)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("Error responses should not be cached: %d", calls)
+	}
+}
+
+func TestCacheResultsPeers(t *testing.T) {
+	var ownerCalls int32
+	owner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&ownerCalls, 1)
+		if r.Header.Get(CachePeerHeader) != "peer-secret" || r.Header.Get("API-Key") != "secret" {
+			t.Errorf("Invalid forwarded request headers: %v", r.Header)
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("owner image"))
+	}))
+	defer owner.Close()
+
+	var calls int32
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Write([]byte("local image"))
+	}
+	o := ServerOptions{ResultCache: NewResultCache(1024 * 1024)}
+	o.ResultCache.Ring = NewPeerRing([]string{owner.URL})
+	o.ResultCache.Self = "http://127.0.0.1:1"
+	o.ResultCache.Secret = "peer-secret"
+	handler := cacheResults(fn, o)
+
+	r := httptest.NewRequest("GET", "/resize?width=100&url=http://example.com/cat.jpg", nil)
+	r.Header.Set("API-Key", "secret")
+	w := httptest.NewRecorder()
+	handler(w, r)
+	if w.Body.String() != "owner image" || w.Header().Get("Content-Type") != "image/png" || calls != 0 {
+		t.Errorf("Image should be fetched from the owner peer: %s", w.Body.String())
+	}
+
+	// Requests forwarded by the peers are processed locally
+	r = httptest.NewRequest("GET", "/resize?width=100&url=http://example.com/cat.jpg", nil)
+	r.Header.Set(CachePeerHeader, "peer-secret")
+	w = httptest.NewRecorder()
+	handler(w, r)
+	if w.Body.String() != "local image" || ownerCalls != 1 {
+		t.Errorf("Forwarded requests should not be forwarded again: %s", w.Body.String())
+	}
+
+	// Requests without the peer secret are not trusted as forwarded
+	r = httptest.NewRequest("GET", "/resize?width=100&url=http://example.com/cat.jpg", nil)
+	r.Header.Set(CachePeerHeader, "1")
+	r.Header.Set("API-Key", "secret")
+	w = httptest.NewRecorder()
+	handler(w, r)
+	if w.Body.String() != "owner image" || ownerCalls != 2 {
+		t.Errorf("Forged peer requests should be forwarded: %s", w.Body.String())
+	}
+
+	// Unavailable owners fall back to local processing
+	o.ResultCache.Ring.Set([]string{"http://127.0.0.1:1"})
+	o.ResultCache.Self = owner.URL
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/resize?width=200&url=http://example.com/cat.jpg", nil))
+	if w.Body.String() != "local image" {
+		t.Errorf("Image should be processed locally: %s", w.Body.String())
+	}
+	if stats := o.ResultCache.Stats(); stats.PeerHits != 2 || stats.PeerFails != 1 {
+		t.Errorf("Invalid peer stats: %#v", stats)
+	}
+}
+
+func TestCacheResultsHints(t *testing.T) {
+	peers := []string{"http://127.0.0.1:1", "http://127.0.0.1:2", "http://127.0.0.1:3"}
+	o := ServerOptions{ResultCache: NewResultCache(1024 * 1024)}
+	o.ResultCache.Ring = NewPeerRing(peers)
+	o.ResultCache.Hints = true
+
+	owner := func(path, hint string) string {
+		r := httptest.NewRequest("GET", path, nil)
+		if hint != "" {
+			r.Header.Set(CacheOwnerHeader, hint)
+		}
+		return o.ResultCache.Owner(r, resultCacheKey(r, o), o)
+	}
+	expected := owner("/resize?width=100&url=http://example.com/cat.jpg", "")
+	if value := owner("/crop?width=300&height=200&url=http://example.com/cat.jpg", ""); value != expected {
+		t.Errorf("Images of the same source should have the same owner: %s != %s", value, expected)
+	}
+	other := peers[0]
+	if other == expected {
+		other = peers[1]
+	}
+	if value := owner("/resize?width=100&url=http://example.com/cat.jpg", other); value != other {
+		t.Errorf("Owner hint of a ring peer should be honored: %s", value)
+	}
+	if value := owner("/resize?width=100&url=http://example.com/cat.jpg", "http://evil.example.com"); value != expected {
+		t.Errorf("Owner hint of unknown peers should be ignored: %s", value)
+	}
+
+	// The owner processes its images, sending the owner hint
+	var calls int32
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Write([]byte("image"))
+	}
+	o.ResultCache.Self = expected
+	w := httptest.NewRecorder()
+	cacheResults(fn, o)(w, httptest.NewRequest("GET", "/resize?width=100&url=http://example.com/cat.jpg", nil))
+	if calls != 1 || w.Header().Get(CacheOwnerHeader) != expected {
+		t.Errorf("Invalid owner response: calls %d, hint %s", calls, w.Header().Get(CacheOwnerHeader))
+	}
+}
+
+func TestCacheResultsRange(t *testing.T) {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write([]byte("0123456789"))
+	}
+	handler := cacheResults(fn, ServerOptions{ResultCache: NewResultCache(1024 * 1024)})
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/resize?width=100&url=http://example.com/cat.jpg", nil)
+		req.Header.Set("Range", "bytes=2-5")
+		handler(w, req)
+		if w.Code != http.StatusPartialContent || w.Body.String() != "2345" || w.Header().Get("Content-Range") != "bytes 2-5/10" {
+			t.Errorf("Invalid range response: %d %s %s", w.Code, w.Body.String(), w.Header().Get("Content-Range"))
+		}
+	}
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/resize?width=100&url=http://example.com/cat.jpg", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "0123456789" || w.Header().Get("Accept-Ranges") != "bytes" {
+		t.Errorf("Invalid full response: %d %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// rewritePlaceholder matches the {name} and {name:regexp} placeholders of the rule patterns and templates
+var rewritePlaceholder = regexp.MustCompile(`\{([a-zA-Z_][a-zA-Z0-9_]*)(:[^{}]+)?\}`)
+
+// RewriteRules represents the URL rewrite rules JSON file, mapping the public URL paths
+// to the image endpoints, params and sources generating them.
+type RewriteRules struct {
+	Presets map[string]map[string]interface{} `json:"presets"`
+	Rules   []*RewriteRule                    `json:"rules"`
+	caches  map[string]*PresetCache
+}
+
+// RewriteRule represents a rewrite rule of the paths matching its pattern, such as
+// /thumbs/{size}/{path}. Placeholders match a path segment, but the placeholder of the
+// whole last segment matching the remaining path, unless defined by a regexp, such as
+// {size:[0-9]+}. The preset, params and source templates are expanded by the matched values.
+type RewriteRule struct {
+	Pattern  string                 `json:"pattern"`
+	Endpoint string                 `json:"endpoint"`
+	Preset   string                 `json:"preset"`
+	Params   map[string]interface{} `json:"params"`
+	URL      string                 `json:"url"`
+	File     string                 `json:"file"`
+	regexp   *regexp.Regexp
+	names    []string
+}
+
+// LoadRewriteRules loads the URL rewrite rules JSON file
+func LoadRewriteRules(path string) (*RewriteRules, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseRewriteRules(buf)
+}
+
+// parseRewriteRules parses and validates the URL rewrite rules, compiling their patterns
+func parseRewriteRules(buf []byte) (*RewriteRules, error) {
+	rules := &RewriteRules{}
+	if err := json.Unmarshal(buf, rules); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if rules.caches, err = parsePresetCaches(rules.Presets); err != nil {
+		return nil, err
+	}
+
+	endpoints := map[string]bool{}
+	for _, endpoint := range imageEndpoints(ServerOptions{}) {
+		endpoints[strings.Trim(endpoint.Path, "/")] = true
+	}
+
+	for i, rule := range rules.Rules {
+		if !strings.HasPrefix(rule.Pattern, "/") {
+			return nil, fmt.Errorf("rule %d: the pattern must start with /", i)
+		}
+		if !endpoints[rule.Endpoint] {
+			return nil, fmt.Errorf("rule %s: invalid endpoint: %s", rule.Pattern, rule.Endpoint)
+		}
+		if (rule.URL == "") == (rule.File == "") {
+			return nil, fmt.Errorf("rule %s: must define either the url or file source", rule.Pattern)
+		}
+		if _, ok := rules.Presets[rule.Preset]; rule.Preset != "" && !ok && !rewritePlaceholder.MatchString(rule.Preset) {
+			return nil, fmt.Errorf("rule %s: undefined preset: %s", rule.Pattern, rule.Preset)
+		}
+		if err := rule.compile(); err != nil {
+			return nil, fmt.Errorf("rule %s: %s", rule.Pattern, err)
+		}
+	}
+	return rules, nil
+}
+
+// compile compiles the rule pattern into the regexp matching the paths
+func (rule *RewriteRule) compile() error {
+	expr := "^"
+	last := 0
+	seen := map[string]bool{}
+	for _, match := range rewritePlaceholder.FindAllStringSubmatchIndex(rule.Pattern, -1) {
+		name := rule.Pattern[match[2]:match[3]]
+		if seen[name] {
+			return fmt.Errorf("duplicated placeholder: %s", name)
+		}
+		seen[name] = true
+		rule.names = append(rule.names, name)
+
+		value := "[^/]+"
+		if match[4] >= 0 {
+			value = rule.Pattern[match[4]+1 : match[5]]
+			if _, err := regexp.Compile(value); err != nil {
+				return fmt.Errorf("invalid placeholder %s regexp: %s", name, err)
+			}
+		} else if match[1] == len(rule.Pattern) && strings.HasSuffix(rule.Pattern[:match[0]], "/") {
+			value = ".+"
+		}
+		expr += regexp.QuoteMeta(rule.Pattern[last:match[0]]) + "(" + value + ")"
+		last = match[1]
+	}
+
+	var err error
+	rule.regexp, err = regexp.Compile(expr + regexp.QuoteMeta(rule.Pattern[last:]) + "$")
+	return err
+}
+
+// Match returns the placeholder values of the given path, if matched by the rule
+func (rule *RewriteRule) Match(path string) (map[string]string, bool) {
+	matches := rule.regexp.FindStringSubmatch(path)
+	if matches == nil {
+		return nil, false
+	}
+	values := map[string]string{}
+	for i, name := range rule.names {
+		values[name] = matches[i+1]
+	}
+	return values, true
+}
+
+// expandRewrite expands the placeholders of the given template by the given values,
+// escaped by the given function, if any.
+func expandRewrite(template string, values map[string]string, escape func(string) string) string {
+	return rewritePlaceholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+		value := values[rewritePlaceholder.FindStringSubmatch(placeholder)[1]]
+		if escape != nil {
+			return escape(value)
+		}
+		return value
+	})
+}
+
+// escapeJSON escapes the given value as the content of a JSON string
+func escapeJSON(value string) string {
+	buf, _ := json.Marshal(value)
+	return string(buf[1 : len(buf)-1])
+}
+
+// escapePath escapes the segments of the given path
+func escapePath(value string) string {
+	segments := strings.Split(value, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// Rewrite returns the endpoint and params of the given path, and whether a rule matched it.
+// A preset param is overridden by the rule param of the same name.
+func (rules *RewriteRules) Rewrite(path string) (string, url.Values, bool) {
+	endpoint, params, _, ok := rules.rewrite(path)
+	return endpoint, params, ok
+}
+
+// rewrite rewrites the given path, also returning the cache policy of the applied preset, if any
+func (rules *RewriteRules) rewrite(path string) (string, url.Values, *PresetCache, bool) {
+	for _, rule := range rules.Rules {
+		values, ok := rule.Match(path)
+		if !ok {
+			continue
+		}
+
+		params := url.Values{}
+		var cache *PresetCache
+		set := func(m map[string]interface{}) {
+			for key, value := range m {
+				if s, ok := value.(string); ok {
+					params.Set(key, expandRewrite(s, values, nil))
+					continue
+				}
+				buf, _ := json.Marshal(value)
+				params.Set(key, expandRewrite(string(buf), values, escapeJSON))
+			}
+		}
+		if rule.Preset != "" {
+			name := expandRewrite(rule.Preset, values, nil)
+			preset, ok := rules.Presets[name]
+			if !ok {
+				continue
+			}
+			set(preset)
+			cache = rules.caches[name]
+		}
+		set(rule.Params)
+
+		if rule.URL != "" {
+			params.Set("url", expandRewrite(rule.URL, values, escapePath))
+		} else {
+			params.Set("file", expandRewrite(rule.File, values, nil))
+		}
+		return rule.Endpoint, params, cache, true
+	}
+	return "", nil, nil, false
+}
+
+// rewriteController serves the paths matched by the rewrite rules, ignoring the image
+// params of the request query, so the public URLs only serve the rule renditions.
+func rewriteController(o ServerOptions) func(http.ResponseWriter, *http.Request) {
+	controller := newCompatController(o)
+	return func(w http.ResponseWriter, r *http.Request) {
+		endpoint, params, cache, _ := o.RewriteRules.rewrite(rewritePath(r, o))
+		setPresetCache(r, cache)
+		query := r.URL.Query()
+		for key := range allowedParams {
+			query.Del(key)
+		}
+		req := r.WithContext(r.Context())
+		req.URL = &url.URL{Path: r.URL.Path, RawQuery: query.Encode()}
+		controller.Serve(w, req, o, endpoint, params)
+	}
+}
+
+// rewritePath returns the request path matched by the rewrite rules, relative to the path prefix
+func rewritePath(r *http.Request, o ServerOptions) string {
+	return "/" + strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, join(o, "/")), "/")
+}
+
+// rewriteRoutes serves the unmatched paths of the given index handler matched by the rewrite rules
+func rewriteRoutes(index http.Handler, o ServerOptions) http.Handler {
+	rules := imageControllerMiddleware(rewriteController(o), o)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, _, ok := o.RewriteRules.Rewrite(rewritePath(r, o)); !ok || r.URL.Path == join(o, "/") {
+			index.ServeHTTP(w, r)
+			return
+		}
+		rules.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+const testRewriteRules = `{
+	"presets": {
+		"small": {"width": 150, "height": 150, "type": "webp"},
+		"large": {"width": 800, "type": "webp", "cache": {"ttl": 31536000, "immutable": true}}
+	},
+	"rules": [
+		{"pattern": "/thumbs/{size}/{path}", "endpoint": "crop", "preset": "{size}", "url": "https://images.s3.amazonaws.com/{path}"},
+		{"pattern": "/avatars/{id:[0-9]+}.jpg", "endpoint": "pipeline", "params": {"operations": [{"operation": "crop", "params": {"width": 64, "height": 64, "text": "{id}"}}]}, "file": "avatars/{id}.png"},
+		{"pattern": "/logos/{name}/{width:[0-9]+}", "endpoint": "resize", "params": {"width": "{width}", "type": "png"}, "file": "logos/{name}.svg"}
+	]
+}`
+
+func TestParseRewriteRules(t *testing.T) {
+	rules, err := parseRewriteRules([]byte(testRewriteRules))
+	if err != nil {
+		t.Fatalf("Cannot parse the rewrite rules: %s", err)
+	}
+	if len(rules.Rules) != 3 || len(rules.Presets) != 2 {
+		t.Errorf("Invalid rewrite rules: %#v", rules)
+	}
+
+	cases := []string{
+		`{"rules": [{"pattern": "thumbs/{path}", "endpoint": "resize", "url": "http://example.com/{path}"}]}`,
+		`{"rules": [{"pattern": "/thumbs/{path}", "endpoint": "unknown", "url": "http://example.com/{path}"}]}`,
+		`{"rules": [{"pattern": "/thumbs/{path}", "endpoint": "resize"}]}`,
+		`{"rules": [{"pattern": "/thumbs/{path}", "endpoint": "resize", "url": "http://example.com/{path}", "file": "{path}"}]}`,
+		`{"rules": [{"pattern": "/thumbs/{path}", "endpoint": "resize", "preset": "small", "url": "http://example.com/{path}"}]}`,
+		`{"rules": [{"pattern": "/thumbs/{path}/{path}", "endpoint": "resize", "url": "http://example.com/{path}"}]}`,
+		`{"rules": [{"pattern": "/thumbs/{size:[0-9}", "endpoint": "resize", "url": "http://example.com/{path}"}]}`,
+		`{"presets": {"small": {"cache": {"ttl": "1h"}}}, "rules": []}`,
+	}
+	for _, config := range cases {
+		if _, err := parseRewriteRules([]byte(config)); err == nil {
+			t.Errorf("Expected rewrite rules error: %s", config)
+		}
+	}
+}
+
+func TestRewriteRules(t *testing.T) {
+	rules, _ := parseRewriteRules([]byte(testRewriteRules))
+	cases := []struct {
+		path     string
+		endpoint string
+		params   map[string]string
+	}{
+		{"/thumbs/small/2017/cat.jpg", "crop", map[string]string{"width": "150", "height": "150", "type": "webp", "url": "https://images.s3.amazonaws.com/2017/cat.jpg"}},
+		{"/thumbs/large/cat?.jpg", "crop", map[string]string{"width": "800", "type": "webp", "url": "https://images.s3.amazonaws.com/cat%3F.jpg"}},
+		{"/avatars/42.jpg", "pipeline", map[string]string{"file": "avatars/42.png", "operations": `[{"operation":"crop","params":{"height":64,"text":"42","width":64}}]`}},
+		{"/logos/acme/300", "resize", map[string]string{"width": "300", "type": "png", "file": "logos/acme.svg"}},
+	}
+	for _, test := range cases {
+		endpoint, query, ok := rules.Rewrite(test.path)
+		params := map[string]string{}
+		for key := range query {
+			params[key] = query.Get(key)
+		}
+		if !ok || endpoint != test.endpoint || !reflect.DeepEqual(params, test.params) {
+			t.Errorf("Invalid rewrite of %s: %s %#v", test.path, endpoint, params)
+		}
+	}
+
+	for _, path := range []string{"/thumbs/medium/cat.jpg", "/thumbs/small", "/avatars/me.jpg", "/logos/acme/300/cat", "/"} {
+		if _, _, ok := rules.Rewrite(path); ok {
+			t.Errorf("Unexpected rewrite of %s", path)
+		}
+	}
+}
+
+func TestRewriteRulesPresetCache(t *testing.T) {
+	rules, _ := parseRewriteRules([]byte(testRewriteRules))
+	if _, _, cache, ok := rules.rewrite("/thumbs/large/cat.jpg"); !ok || cache == nil || *cache.TTL != 31536000 || !cache.Immutable {
+		t.Errorf("Invalid preset cache: %#v", cache)
+	}
+	if _, _, cache, ok := rules.rewrite("/thumbs/small/cat.jpg"); !ok || cache != nil {
+		t.Errorf("Unexpected preset cache: %#v", cache)
+	}
+}
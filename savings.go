@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// Savings response headers of the processed images, so the CDN logs can quantify the bandwidth
+// savings per output format without parsing the response bodies
+const (
+	InputSizeHeader        = "X-Imaginary-Input-Size"
+	InputDimensionsHeader  = "X-Imaginary-Input-Dimensions"
+	OutputSizeHeader       = "X-Imaginary-Output-Size"
+	OutputDimensionsHeader = "X-Imaginary-Output-Dimensions"
+)
+
+// setSavingsHeaders sets the byte sizes and dimensions headers of the given source and output images.
+// The input size is the one of the source image as fetched, while the input dimensions are read
+// from the decoded source image, such as the extracted video frame. Only the image headers are read.
+func setSavingsHeaders(w http.ResponseWriter, source, decoded []byte, image Image) {
+	setInputSavingsHeaders(w, source, decoded)
+	h := w.Header()
+	h.Set(OutputSizeHeader, strconv.Itoa(len(image.Body)))
+	if image.Mime == "application/json" {
+		return
+	}
+	if size, err := bimg.Size(image.Body); err == nil {
+		h.Set(OutputDimensionsHeader, formatDimensions(size))
+	}
+}
+
+// setInputSavingsHeaders sets the byte size and dimensions headers of the given source image
+func setInputSavingsHeaders(w http.ResponseWriter, source, decoded []byte) {
+	w.Header().Set(InputSizeHeader, strconv.Itoa(len(source)))
+	if size, err := bimg.Size(decoded); err == nil {
+		w.Header().Set(InputDimensionsHeader, formatDimensions(size))
+	}
+}
+
+// formatDimensions returns the given image size as WIDTHxHEIGHT
+func formatDimensions(size bimg.ImageSize) string {
+	return fmt.Sprintf("%dx%d", size.Width, size.Height)
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSavingsHeaders(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("large.jpg"))
+	w := httptest.NewRecorder()
+	imageHandler(w, httptest.NewRequest("GET", "/resize?width=300&type=webp", nil), buf, Resize, ServerOptions{}, nil)
+
+	h := w.Header()
+	if h.Get(InputSizeHeader) != strconv.Itoa(len(buf)) || h.Get(InputDimensionsHeader) != "1920x1080" {
+		t.Errorf("Invalid input headers: %s %s", h.Get(InputSizeHeader), h.Get(InputDimensionsHeader))
+	}
+	if h.Get(OutputSizeHeader) != h.Get("Content-Length") || !strings.HasPrefix(h.Get(OutputDimensionsHeader), "300x") {
+		t.Errorf("Invalid output headers: %s %s", h.Get(OutputSizeHeader), h.Get(OutputDimensionsHeader))
+	}
+
+	w = httptest.NewRecorder()
+	imageHandler(w, httptest.NewRequest("GET", "/info", nil), buf, Info, ServerOptions{}, nil)
+	if w.Header().Get(OutputDimensionsHeader) != "" || w.Header().Get(InputDimensionsHeader) != "1920x1080" {
+		t.Errorf("Invalid info response headers: %v", w.Header())
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+)
+
+// RequestScripts represents the request scripts JSON file: the ordered scripts run before
+// processing every image request, and the param presets they can apply.
+type RequestScripts struct {
+	Presets map[string]map[string]interface{} `json:"presets"`
+	Scripts []*RequestScript                  `json:"scripts"`
+	caches  map[string]*PresetCache
+}
+
+// RequestScript represents a request script, applied if its when expression is true, or
+// always if undefined. It rejects the request with the given message and HTTP status, or
+// applies the preset named by its preset expression, then sets the params to its set
+// expressions values and deletes its unset params.
+type RequestScript struct {
+	When   string            `json:"when"`
+	Reject string            `json:"reject"`
+	Status int               `json:"status"`
+	Preset string            `json:"preset"`
+	Set    map[string]string `json:"set"`
+	Unset  []string          `json:"unset"`
+	when   *Expr
+	preset *Expr
+	set    map[string]*Expr
+}
+
+// LoadRequestScripts loads the request scripts JSON file
+func LoadRequestScripts(path string) (*RequestScripts, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseRequestScripts(buf)
+}
+
+// parseRequestScripts parses the request scripts, compiling their expressions
+func parseRequestScripts(buf []byte) (*RequestScripts, error) {
+	scripts := &RequestScripts{}
+	if err := json.Unmarshal(buf, scripts); err != nil {
+		return nil, err
+	}
+
+	compile := func(i int, source string) (*Expr, error) {
+		if source == "" {
+			return nil, nil
+		}
+		expr, err := ParseExpr(source)
+		if err != nil {
+			return nil, fmt.Errorf("script %d: invalid expression %s: %s", i, source, err)
+		}
+		return expr, nil
+	}
+
+	var err error
+	if scripts.caches, err = parsePresetCaches(scripts.Presets); err != nil {
+		return nil, err
+	}
+	for i, script := range scripts.Scripts {
+		if script.when, err = compile(i, script.When); err != nil {
+			return nil, err
+		}
+		if script.preset, err = compile(i, script.Preset); err != nil {
+			return nil, err
+		}
+		script.set = map[string]*Expr{}
+		for key, source := range script.Set {
+			if script.set[key], err = compile(i, source); err != nil {
+				return nil, err
+			}
+		}
+		if script.Reject != "" && script.Status == 0 {
+			script.Status = http.StatusForbidden
+		}
+		if script.Reject != "" && errorCode(script.Status) == InternalError && script.Status != http.StatusInternalServerError {
+			return nil, fmt.Errorf("script %d: unsupported reject status: %d", i, script.Status)
+		}
+	}
+	return scripts, nil
+}
+
+// errorCode returns the error code of the given HTTP status, defaulting to an internal error
+func errorCode(status int) uint8 {
+	for code := Unavailable; code <= TooManyRequests; code++ {
+		if (Error{Code: code}).HTTPCode() == status {
+			return code
+		}
+	}
+	return InternalError
+}
+
+// scriptEnv returns the expression environment of the given request and its current params.
+// The request variables are the endpoint, method, path, source, host, client and keyid ones,
+// and the request functions are header(name) and param(name, default).
+func scriptEnv(r *http.Request, query url.Values, o ServerOptions) ExprEnv {
+	source := query.Get("url")
+	if source == "" {
+		source = query.Get("file")
+	}
+
+	return ExprEnv{
+		Vars: map[string]interface{}{
+			"endpoint": endpointName(r),
+			"method":   r.Method,
+			"path":     r.URL.Path,
+			"source":   source,
+			"host":     originHost(&http.Request{URL: &url.URL{RawQuery: query.Encode()}}),
+			"client":   clientHost(r),
+			"keyid":    apiKeyID(r, o),
+		},
+		Funcs: map[string]ExprFunc{
+			"header": func(args []interface{}) (interface{}, error) {
+				s, err := exprStrings("header", args, 1)
+				if err != nil {
+					return nil, err
+				}
+				return r.Header.Get(s[0]), nil
+			},
+			"param": func(args []interface{}) (interface{}, error) {
+				if len(args) == 2 {
+					if _, ok := query[exprString(args[0])]; !ok {
+						return args[1], nil
+					}
+					args = args[:1]
+				}
+				s, err := exprStrings("param", args, 1)
+				if err != nil {
+					return nil, err
+				}
+				return query.Get(s[0]), nil
+			},
+		},
+	}
+}
+
+// scriptError returns the error of the given script, evaluating the request variables and
+// params, which is a client error
+func scriptError(i int, format string, args ...interface{}) Error {
+	return NewError(fmt.Sprintf("Request script %d error: ", i)+fmt.Sprintf(format, args...), BadRequest)
+}
+
+// Run runs the scripts of the given request, updating its given params. The scripts
+// see the params updated by the previous ones.
+func (s *RequestScripts) Run(r *http.Request, query url.Values, o ServerOptions) error {
+	for i, script := range s.Scripts {
+		env := scriptEnv(r, query, o)
+		if script.when != nil {
+			value, err := script.when.Eval(env)
+			if err != nil {
+				return scriptError(i, "%s", err)
+			}
+			if !exprTruthy(value) {
+				continue
+			}
+		}
+
+		if script.Reject != "" {
+			return NewError(script.Reject, errorCode(script.Status))
+		}
+
+		if script.preset != nil {
+			name, err := script.preset.Eval(env)
+			if err != nil {
+				return scriptError(i, "%s", err)
+			}
+			preset, ok := s.Presets[exprString(name)]
+			if !ok {
+				return scriptError(i, "undefined preset: %v", name)
+			}
+			for key, value := range preset {
+				if str, ok := value.(string); ok {
+					query.Set(key, str)
+				} else {
+					buf, _ := json.Marshal(value)
+					query.Set(key, string(buf))
+				}
+			}
+			setPresetCache(r, s.caches[exprString(name)])
+		}
+
+		// Evaluate every set expression before setting the params, in a stable order
+		keys := []string{}
+		for key := range script.set {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		values := map[string]string{}
+		for _, key := range keys {
+			value, err := script.set[key].Eval(env)
+			if err != nil {
+				return scriptError(i, "%s: %s", key, err)
+			}
+			values[key] = exprString(value)
+		}
+		for _, key := range keys {
+			if values[key] == "" {
+				query.Del(key)
+			} else {
+				query.Set(key, values[key])
+			}
+		}
+		for _, key := range script.Unset {
+			query.Del(key)
+		}
+	}
+	return nil
+}
+
+// RunOperations runs the scripts of every pipeline operation of the given request params, as
+// the requests of the operation endpoints of the request params overridden by the operation
+// params, so the operation params cannot bypass the scripts. The params updated by the
+// scripts are set to the operation params.
+func (s *RequestScripts) RunOperations(r *http.Request, query url.Values, o ServerOptions) error {
+	operations := PipelineOperations{}
+	if err := json.Unmarshal([]byte(query.Get("operations")), &operations); err != nil {
+		// The malformed operations are rejected by the pipeline
+		return nil
+	}
+
+	for i := range operations {
+		operation := &operations[i]
+		params := url.Values{}
+		for key, values := range query {
+			if key != "operations" {
+				params[key] = append([]string(nil), values...)
+			}
+		}
+		for key, value := range operation.Params {
+			if str, ok := value.(string); ok {
+				params.Set(key, str)
+			} else {
+				buf, _ := json.Marshal(value)
+				params.Set(key, string(buf))
+			}
+		}
+		initial := url.Values{}
+		for key, values := range params {
+			initial[key] = values
+		}
+
+		u := *r.URL
+		u.Path = path.Join(path.Dir(r.URL.Path), operation.Name)
+		req := r.WithContext(r.Context())
+		req.URL = &u
+		if err := s.Run(req, params, o); err != nil {
+			return err
+		}
+
+		if operation.Params == nil && len(params) > 0 {
+			operation.Params = map[string]interface{}{}
+		}
+		for key := range initial {
+			if _, ok := params[key]; !ok {
+				delete(operation.Params, key)
+			}
+		}
+		for key := range params {
+			if value := params.Get(key); value != initial.Get(key) {
+				operation.Params[key] = value
+			}
+		}
+	}
+
+	buf, _ := json.Marshal(operations)
+	query.Set("operations", string(buf))
+	return nil
+}
+
+// scriptRequests runs the request scripts, if any, before the given image controller,
+// rejecting the request or processing it with the params updated by the scripts.
+func scriptRequests(fn func(http.ResponseWriter, *http.Request), o ServerOptions) func(http.ResponseWriter, *http.Request) {
+	if o.Scripts == nil {
+		return fn
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		err := o.Scripts.Run(r, query, o)
+		if err == nil && query.Get("operations") != "" {
+			err = o.Scripts.RunOperations(r, query, o)
+		}
+		if err != nil {
+			if e, ok := err.(Error); ok {
+				ErrorReply(r, w, e, o)
+				return
+			}
+			ErrorReply(r, w, NewError("Request script error: "+err.Error(), InternalError), o)
+			return
+		}
+
+		u := *r.URL
+		u.RawQuery = query.Encode()
+		req := r.WithContext(r.Context())
+		req.URL = &u
+		fn(w, req)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+const testRequestScripts = `{
+	"presets": {"thumb": {"width": 200, "height": 200, "type": "webp"}},
+	"scripts": [
+		{"when": "header('X-Tenant') == 'free' && param('width', 0) > 1200", "reject": "Images wider than 1200px require a paid plan", "status": 413},
+		{"when": "host == 'blocked.example.com'", "reject": "Blocked image source"},
+		{"when": "param('preset') != ''", "preset": "param('preset')", "unset": ["preset"]},
+		{"when": "startsWith(host, 'cdn.')", "set": {"quality": "min(param('quality', 90), 75)", "interlace": "''"}}
+	]
+}`
+
+func TestParseRequestScripts(t *testing.T) {
+	scripts, err := parseRequestScripts([]byte(testRequestScripts))
+	if err != nil || len(scripts.Scripts) != 4 || scripts.Scripts[1].Status != http.StatusForbidden {
+		t.Fatalf("Invalid request scripts: %#v %v", scripts, err)
+	}
+
+	cases := []string{
+		`{"scripts": [{"when": "1 +"}]}`,
+		`{"scripts": [{"preset": "("}]}`,
+		`{"scripts": [{"set": {"width": "'a"}}]}`,
+		`{"scripts": [{"reject": "teapot", "status": 418}]}`,
+	}
+	for _, config := range cases {
+		if _, err := parseRequestScripts([]byte(config)); err == nil {
+			t.Errorf("Expected request scripts error: %s", config)
+		}
+	}
+}
+
+func TestRequestScripts(t *testing.T) {
+	scripts, _ := parseRequestScripts([]byte(testRequestScripts))
+	o := ServerOptions{Scripts: scripts}
+
+	cases := []struct {
+		url    string
+		tenant string
+		status int
+		query  string
+	}{
+		{"/resize?width=2000&url=http://cdn.example.com/cat.jpg", "free", http.StatusRequestEntityTooLarge, ""},
+		{"/resize?width=2000&url=http://cdn.example.com/cat.jpg", "paid", http.StatusOK, "quality=75&url=http%3A%2F%2Fcdn.example.com%2Fcat.jpg&width=2000"},
+		{"/resize?width=300&url=http://blocked.example.com/cat.jpg", "", http.StatusForbidden, ""},
+		{"/crop?preset=thumb&interlace=true&quality=60&url=http://cdn.example.com/cat.jpg", "", http.StatusOK, "height=200&quality=60&type=webp&url=http%3A%2F%2Fcdn.example.com%2Fcat.jpg&width=200"},
+		{"/crop?preset=unknown&file=cat.jpg", "", http.StatusBadRequest, ""},
+		{"/resize?width=wide&url=http://cdn.example.com/cat.jpg", "free", http.StatusBadRequest, ""},
+	}
+	for _, test := range cases {
+		query := ""
+		handler := scriptRequests(func(w http.ResponseWriter, r *http.Request) {
+			query = r.URL.RawQuery
+		}, o)
+
+		req := httptest.NewRequest("GET", test.url, nil)
+		req.Header.Set("X-Tenant", test.tenant)
+		w := httptest.NewRecorder()
+		handler(w, req)
+		if w.Code != test.status || query != test.query {
+			t.Errorf("Invalid scripted request %s: %d %s", test.url, w.Code, query)
+		}
+	}
+}
+
+func TestRequestScriptsOperations(t *testing.T) {
+	scripts, _ := parseRequestScripts([]byte(testRequestScripts))
+	o := ServerOptions{Scripts: scripts}
+
+	var operations PipelineOperations
+	handler := scriptRequests(func(w http.ResponseWriter, r *http.Request) {
+		operations = nil
+		json.Unmarshal([]byte(r.URL.Query().Get("operations")), &operations)
+	}, o)
+	request := func(tenant, operations string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/pipeline?url=http://cdn.example.com/cat.jpg&operations="+url.QueryEscape(operations), nil)
+		req.Header.Set("X-Tenant", tenant)
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+
+	if w := request("free", `[{"operation": "crop", "params": {"width": 300}}, {"operation": "resize", "params": {"width": 2000}}]`); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("The scripts should reject the pipeline operations params: %d", w.Code)
+	}
+
+	w := request("paid", `[{"operation": "resize", "params": {"width": 300, "quality": 90, "interlace": true}}, {"operation": "blur"}]`)
+	if w.Code != http.StatusOK || len(operations) != 2 {
+		t.Fatalf("Invalid scripted pipeline: %d %#v", w.Code, operations)
+	}
+	if params := operations[0].Params; params["quality"] != "75" || params["width"] != 300.0 || params["interlace"] != nil {
+		t.Errorf("Invalid scripted operation params: %#v", params)
+	}
+}
+
+func TestRequestScriptsRoutes(t *testing.T) {
+	scripts, _ := parseRequestScripts([]byte(`{"scripts": [{"reject": "Scripted"}]}`))
+	mux := NewServerMux(ServerOptions{Scripts: scripts, EnableURLSource: true})
+	for _, route := range []string{"/montage", "/srcset", "/document", "/compare", "/qrcode", "/ogimage", "/pipeline", "/resize"} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", route+"?url=http://example.com/cat.jpg", nil))
+		if w.Code != http.StatusForbidden {
+			t.Errorf("The scripts should run for the %s requests: %d", route, w.Code)
+		}
+	}
+}
+
+func TestRequestScriptsPresetCache(t *testing.T) {
+	scripts, err := parseRequestScripts([]byte(`{
+		"presets": {
+			"avatar": {"width": 100, "cache": {"ttl": 300}},
+			"article": {"width": 800, "cache": {"ttl": 31536000, "immutable": true}}
+		},
+		"scripts": [{"when": "param('preset') != ''", "preset": "param('preset')", "unset": ["preset"]}]
+	}`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	o := ServerOptions{HTTPCacheTTL: -1, Scripts: scripts}
+
+	cases := []struct {
+		url      string
+		query    string
+		expected string
+	}{
+		{"/resize?preset=avatar&file=cat.jpg", "file=cat.jpg&width=100", "public, s-maxage=300, max-age=300, no-transform"},
+		{"/resize?preset=article&file=cat.jpg", "file=cat.jpg&width=800", "public, s-maxage=31536000, max-age=31536000, no-transform, immutable"},
+		{"/resize?width=300&file=cat.jpg", "file=cat.jpg&width=300", ""},
+	}
+	for _, test := range cases {
+		query := ""
+		handler := setCacheHeaders(http.HandlerFunc(scriptRequests(func(w http.ResponseWriter, r *http.Request) {
+			query = r.URL.RawQuery
+			w.Write([]byte("image"))
+		}, o)), o)
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", test.url, nil))
+		if query != test.query {
+			t.Errorf("Invalid script params of %s: %s", test.url, query)
+		}
+		if value := w.Header().Get("Cache-Control"); value != test.expected {
+			t.Errorf("Invalid Cache-Control header of %s: %s", test.url, value)
+		}
+	}
+}
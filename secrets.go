@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// secretFile represents a file storing a secret, applied whenever the file changes
+type secretFile struct {
+	path    string
+	modTime time.Time
+	apply   func(string) error
+}
+
+// Secrets stores the API keys, URL signature keys and image source servers credentials
+// read from files, such as Docker or Kubernetes secrets, instead of the command line flags
+// visible in ps, reloaded whenever the files change.
+type Secrets struct {
+	mutex            sync.RWMutex
+	files            []*secretFile
+	apiKeys          KeyRing
+	urlSignatureKeys KeyRing
+	authorization    string
+	origins          OriginCredentials
+}
+
+// SecretsOptions represents the secret file paths. Empty paths are not read. The key files
+// are parsed as key rings if the key rotation is enabled.
+type SecretsOptions struct {
+	APIKeyFile          string
+	URLSignatureKeyFile string
+	AuthorizationFile   string
+	OriginsFile         string
+	KeyRotation         bool
+}
+
+// NewSecrets reads the given secret files, failing if any file cannot be read or parsed.
+func NewSecrets(o SecretsOptions) (*Secrets, error) {
+	s := &Secrets{}
+	if o.APIKeyFile != "" {
+		s.files = append(s.files, &secretFile{path: o.APIKeyFile, apply: func(value string) error {
+			ring, err := parseKeyRing(value, o.KeyRotation)
+			if err == nil && len(ring) == 0 {
+				err = fmt.Errorf("empty API key")
+			}
+			if err == nil {
+				s.apiKeys = ring
+			}
+			return err
+		}})
+	}
+	if o.URLSignatureKeyFile != "" {
+		s.files = append(s.files, &secretFile{path: o.URLSignatureKeyFile, apply: func(value string) error {
+			ring, err := parseKeyRing(value, o.KeyRotation)
+			if err == nil && len(ring) == 0 {
+				err = fmt.Errorf("empty URL signature key")
+			}
+			for _, key := range ring {
+				if err == nil && len(key.Secret) < 32 {
+					err = fmt.Errorf("URL signature key must be a minimum of 32 characters")
+				}
+			}
+			if err == nil {
+				s.urlSignatureKeys = ring
+			}
+			return err
+		}})
+	}
+	if o.AuthorizationFile != "" {
+		s.files = append(s.files, &secretFile{path: o.AuthorizationFile, apply: func(value string) error {
+			s.authorization = value
+			return nil
+		}})
+	}
+	if o.OriginsFile != "" {
+		s.files = append(s.files, &secretFile{path: o.OriginsFile, apply: func(value string) error {
+			origins, err := parseOriginCredentials([]byte(value))
+			if err == nil {
+				s.origins = origins
+			}
+			return err
+		}})
+	}
+
+	if _, err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload reads the secret files changed since the last read, reporting whether any secret
+// changed. Invalid secrets are not applied, preserving the previous ones.
+func (s *Secrets) Reload() (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	changed := false
+	for _, file := range s.files {
+		info, err := os.Stat(file.path)
+		if err != nil {
+			return changed, err
+		}
+		if info.ModTime().Equal(file.modTime) {
+			continue
+		}
+
+		buf, err := ioutil.ReadFile(file.path)
+		if err != nil {
+			return changed, err
+		}
+		if err := file.apply(strings.TrimSpace(string(buf))); err != nil {
+			return changed, fmt.Errorf("%s: %s", file.path, err)
+		}
+		file.modTime = info.ModTime()
+		changed = true
+	}
+	return changed, nil
+}
+
+// Watch reloads the changed secret files every given interval
+func (s *Secrets) Watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		for range ticker.C {
+			changed, err := s.Reload()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "cannot reload secrets: %s\n", err)
+			} else if changed {
+				debug("secrets reloaded")
+			}
+		}
+	}()
+}
+
+// APIKeys returns the API keys read from file, if any
+func (s *Secrets) APIKeys() KeyRing {
+	if s == nil {
+		return nil
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.apiKeys
+}
+
+// URLSignatureKeys returns the URL signature keys read from file, if any
+func (s *Secrets) URLSignatureKeys() KeyRing {
+	if s == nil {
+		return nil
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.urlSignatureKeys
+}
+
+// Authorization returns the image source servers Authorization header read from file, if any
+func (s *Secrets) Authorization() string {
+	if s == nil {
+		return ""
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.authorization
+}
+
+// OriginCredentials returns the per image source server credentials read from file, if any
+func (s *Secrets) OriginCredentials() OriginCredentials {
+	if s == nil {
+		return nil
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.origins
+}
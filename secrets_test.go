@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSecretsReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imaginary-secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	apiKeyFile := filepath.Join(dir, "api-key")
+	authFile := filepath.Join(dir, "authorization")
+	ioutil.WriteFile(apiKeyFile, []byte("v1:secret1\n"), 0600)
+	ioutil.WriteFile(authFile, []byte("Bearer token1\n"), 0600)
+
+	secrets, err := NewSecrets(SecretsOptions{APIKeyFile: apiKeyFile, AuthorizationFile: authFile, KeyRotation: true})
+	if err != nil {
+		t.Fatalf("Cannot read the secrets: %s", err)
+	}
+	if key := secrets.APIKeys().Primary(); key.ID != "v1" || key.Secret != "secret1" {
+		t.Errorf("Invalid API key: %+v", key)
+	}
+	if secrets.Authorization() != "Bearer token1" {
+		t.Errorf("Invalid authorization: %s", secrets.Authorization())
+	}
+
+	if changed, err := secrets.Reload(); changed || err != nil {
+		t.Errorf("Unexpected secrets reload: %v, %v", changed, err)
+	}
+
+	ioutil.WriteFile(apiKeyFile, []byte("v2:secret2,v1:secret1"), 0600)
+	os.Chtimes(apiKeyFile, time.Now(), time.Now().Add(time.Minute))
+	if changed, err := secrets.Reload(); !changed || err != nil {
+		t.Fatalf("Expected the secrets to be reloaded: %v, %v", changed, err)
+	}
+	if _, ok := apiKeys(ServerOptions{APIKey: "secret1", Secrets: secrets}).Match("secret2"); !ok {
+		t.Error("Expected the reloaded API key to be valid")
+	}
+
+	// Invalid secrets preserve the previous ones
+	ioutil.WriteFile(apiKeyFile, []byte(""), 0600)
+	os.Chtimes(apiKeyFile, time.Now(), time.Now().Add(2*time.Minute))
+	if _, err := secrets.Reload(); err == nil {
+		t.Error("Expected empty API key error")
+	}
+	if len(secrets.APIKeys()) != 2 {
+		t.Errorf("Invalid API keys: %v", secrets.APIKeys())
+	}
+}
+
+func TestSecretsErrors(t *testing.T) {
+	if _, err := NewSecrets(SecretsOptions{APIKeyFile: "/missing/api-key"}); err == nil {
+		t.Error("Expected missing secret file error")
+	}
+
+	file, _ := ioutil.TempFile("", "imaginary-secrets")
+	defer os.Remove(file.Name())
+	file.WriteString("short")
+	file.Close()
+	if _, err := NewSecrets(SecretsOptions{URLSignatureKeyFile: file.Name()}); err == nil {
+		t.Error("Expected short URL signature key error")
+	}
+
+	var secrets *Secrets
+	if secrets.APIKeys() != nil || secrets.Authorization() != "" {
+		t.Error("Expected empty secrets")
+	}
+}
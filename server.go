@@ -1,6 +1,8 @@
 package main
 
 import (
+	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -10,33 +12,104 @@ import (
 	"time"
 )
 
+// APIVersionPrefix is the path prefix of the current API version routes
+const APIVersionPrefix = "/v1"
+
 type ServerOptions struct {
 	Port               int
 	Burst              int
 	Concurrency        int
+	ClientLimiter      *ClientLimiter
+	ProcessingQueue    *ProcessingQueue
+	KeyPriorities      map[string]int
+	PriorityKeys       map[string]bool
+	PriorityIPs        []*net.IPNet
 	HTTPCacheTTL       int
 	HTTPCachePassthru  bool
+	HTTPCache          CacheOptions
+	ForwardHeaders     []string
+	SurrogateKeys      bool
+	SurrogateKeyPrefix string
+	CDNPurgers         CDNPurgers
+	ResultCache        *ResultCache
+	Stats              *ServerStats
 	HTTPReadTimeout    int
 	HTTPWriteTimeout   int
+	GracefulUpgrade    bool
+	DrainTimeout       int
+	VipsLeakCheck      bool
+	PIDFile            string
+	ProcessingTimeout  int
 	MaxAllowedSize     int
+	MaxCost            float64
+	StrictParams       bool
+	EnableExplain      bool
+	EnableOriginal     bool
+	OriginalTypes      []string
+	DebugHeaders       bool
+	StreamMinSize      int
+	StreamSources      bool
+	MaxBandwidth       int
+	BandwidthThreshold int
 	CORS               bool
+	CORSCredentials    bool
+	CORSMaxAge         int
+	CORSAllowedOrigins []string
+	CORSAllowedHeaders []string
+	CORSExposedHeaders []string
 	Gzip               bool // deprecated
 	AuthForwarding     bool
 	EnableURLSource    bool
 	EnablePlaceholder  bool
+	ErrorImage         bool
+	FFmpeg             string
+	BackgroundRemoval  string
+	Upscaler           string
 	EnableURLSignature bool
 	URLSignatureKey    string
+	URLSignatureTTL    int
+	URLSignatureKeys   KeyRing
 	Address            string
 	PathPrefix         string
+	NoLegacyRoutes     bool
+	Cloudinary         bool
+	Imgproxy           bool
+	ImgproxyKeys       []ImgproxyKey
+	RewriteRules       *RewriteRules
+	Scripts            *RequestScripts
 	APIKey             string
+	APIKeys            KeyRing
+	Secrets            *Secrets
 	Mount              string
 	CertFile           string
 	KeyFile            string
 	Authorization      string
 	Placeholder        string
+	StatsdAddr         string
+	StatsdPrefix       string
+	StatsdTags         []string
+	DogStatsd          bool
+	AccessLog          string
+	AccessLogMaxSize   int
+	AccessLogBackups   int
+	AccessLogOptions   LogOptions
+	InputLimits        InputLimits
+	SrcsetWidths       []int
+	SrcsetDestination  *SrcsetDestination
+	Interlace          []string
+	QualityLadder      QualityLadder
+	OGTemplates        map[string]*OGTemplate
 	PlaceholderImage   []byte
+	ErrorReporter      ErrorReporter
+	Moderation         ModerationOptions
+	Auditor            *Auditor
 	Endpoints          Endpoints
+	EndpointTimeouts   map[string]int
 	AllowedOrigins     []*url.URL
+	AllowedIPs         []*net.IPNet
+	DeniedIPs          []*net.IPNet
+	AdminAllowedIPs    []*net.IPNet
+	AdminDeniedIPs     []*net.IPNet
 }
 
 // Endpoints represents a list of endpoint names to disable.
@@ -44,19 +117,78 @@ type Endpoints []string
 
 // IsValid validates if a given HTTP request endpoint is valid or not.
 func (e Endpoints) IsValid(r *http.Request) bool {
-	parts := strings.Split(r.URL.Path, "/")
-	endpoint := parts[len(parts)-1]
+	return !e.Disabled(endpointName(r))
+}
+
+// Disabled reports whether the given endpoint name is disabled.
+func (e Endpoints) Disabled(endpoint string) bool {
 	for _, name := range e {
 		if endpoint == name {
-			return false
+			return true
 		}
 	}
-	return true
+	return false
+}
+
+// endpointName returns the endpoint name of the given request, which is the last URL path segment,
+// prefixed by the admin routes namespace, such as "-/stats", so they are distinct from the image ones.
+func endpointName(r *http.Request) string {
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) > 2 && parts[len(parts)-2] == "-" {
+		return "-/" + parts[len(parts)-1]
+	}
+	return parts[len(parts)-1]
+}
+
+// ProcessingTimeoutFor returns the processing deadline for the given request
+// endpoint, falling back to the global one. Zero means no deadline.
+func (o ServerOptions) ProcessingTimeoutFor(r *http.Request) time.Duration {
+	if seconds, ok := o.EndpointTimeouts[endpointName(r)]; ok {
+		return time.Duration(seconds) * time.Second
+	}
+	return time.Duration(o.ProcessingTimeout) * time.Second
+}
+
+// AdminAuthenticated reports whether the admin endpoints are restricted to the authorized
+// clients, either by API key or by the admin client IP allow list.
+func (o ServerOptions) AdminAuthenticated() bool {
+	return o.APIKey != "" || len(o.AdminAllowedIPs) > 0
+}
+
+// InterlacedByDefault reports whether the given output image type is interlaced by default
+func (o ServerOptions) InterlacedByDefault(imageType string) bool {
+	for _, t := range o.Interlace {
+		if t == imageType {
+			return true
+		}
+	}
+	return false
 }
 
 func Server(o ServerOptions) error {
 	addr := o.Address + ":" + strconv.Itoa(o.Port)
-	handler := NewLog(NewServerMux(o), os.Stdout)
+	var out io.Writer = os.Stdout
+	if o.AccessLog != "" {
+		file, err := NewRotatingFile(o.AccessLog, int64(o.AccessLogMaxSize)*1024*1024, o.AccessLogBackups)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+	if o.Stats == nil {
+		o.Stats = NewServerStats()
+	}
+	handler := NewLogWithOptions(NewServerMux(o), out, o.AccessLogOptions)
+	handler = NewStatsHandler(handler, o.Stats, o)
+
+	if o.StatsdAddr != "" {
+		client, err := NewStatsdClient(o.StatsdAddr, o.StatsdPrefix, o.StatsdTags, o.DogStatsd)
+		if err != nil {
+			return err
+		}
+		handler = NewStatsdHandler(handler, client)
+	}
 
 	server := &http.Server{
 		Addr:           addr,
@@ -70,6 +202,16 @@ func Server(o ServerOptions) error {
 }
 
 func listenAndServe(s *http.Server, o ServerOptions) error {
+	if o.VipsLeakCheck {
+		return serveUntilInterrupted(s, func() error { return serve(s, o) }, o.DrainTimeout)
+	}
+	return serve(s, o)
+}
+
+func serve(s *http.Server, o ServerOptions) error {
+	if o.GracefulUpgrade {
+		return serveUpgradable(s, o)
+	}
 	if o.CertFile != "" && o.KeyFile != "" {
 		return s.ListenAndServeTLS(o.CertFile, o.KeyFile)
 	}
@@ -84,28 +226,131 @@ func join(o ServerOptions, route string) string {
 func NewServerMux(o ServerOptions) http.Handler {
 	mux := http.NewServeMux()
 
-	mux.Handle(join(o, "/"), Middleware(indexController, o))
-	mux.Handle(join(o, "/form"), Middleware(formController, o))
-	mux.Handle(join(o, "/health"), Middleware(healthController, o))
+	// Every route but the index is served under the API version prefix, and unprefixed as
+	// deprecated legacy route unless disabled, so future behavior changes of new API versions
+	// do not break the existing URLs.
+	handle := func(route string, handler http.Handler) {
+		subtree := ""
+		if strings.HasSuffix(route, "/") {
+			subtree = "/"
+		}
+		mux.Handle(join(o, APIVersionPrefix+route)+subtree, handler)
+		if !o.NoLegacyRoutes {
+			mux.Handle(join(o, route)+subtree, legacyRoute(handler, join(o, APIVersionPrefix+route)+subtree))
+		}
+	}
+
+	// The unmatched paths are served by the rewrite rules and as imgproxy URLs, if enabled
+	index := Middleware(indexController, o)
+	if o.Imgproxy {
+		index = imgproxyRoutes(index, o)
+	}
+	if o.RewriteRules != nil {
+		index = rewriteRoutes(index, o)
+	}
+	if (o.Imgproxy || o.RewriteRules != nil) && join(o, "/") != "/" {
+		mux.Handle(join(o, "/")+"/", index)
+	}
+	mux.Handle(join(o, "/"), index)
+	handle("/form", Middleware(formController, o))
+	handle("/openapi.json", Middleware(openAPIController(o), o))
+	handle("/capabilities", Middleware(capabilitiesController(o), o))
+	handle("/health", AdminMiddleware(healthController, o))
+	// The stats expose the origin hosts, so they are only served to authenticated clients
+	if o.Stats != nil && o.AdminAuthenticated() {
+		handle("/-/stats", AdminMiddleware(statsController(o), o))
+	}
+	// The CDN purges are only served to authenticated clients, since they call the paid CDN APIs
+	purge := o
+	if !o.AdminAuthenticated() {
+		purge.CDNPurgers = nil
+	}
+	if len(purge.CDNPurgers) > 0 || o.ResultCache != nil {
+		handle("/purge", AdminMiddleware(purgeController(purge), o))
+	}
+	handle("/placeholder", Middleware(strictParams(placeholderController(o), o), o))
+	handle("/montage", imageControllerMiddleware(scriptRequests(montageController(o), o), o))
+	handle("/document", imageControllerMiddleware(scriptRequests(documentController(o), o), o))
+	handle("/compare", imageControllerMiddleware(scriptRequests(compareController(o), o), o))
+	handle("/qrcode", processingMiddleware(Middleware(strictParams(scriptRequests(qrcodeController(o), o), o), o), o))
+	handle("/ogimage", processingMiddleware(Middleware(strictParams(scriptRequests(ogimageController(o), o), o), o), o))
 
 	image := ImageMiddleware(o)
-	mux.Handle(join(o, "/resize"), image(Resize))
-	mux.Handle(join(o, "/fit"), image(Fit))
-	mux.Handle(join(o, "/enlarge"), image(Enlarge))
-	mux.Handle(join(o, "/extract"), image(Extract))
-	mux.Handle(join(o, "/crop"), image(Crop))
-	mux.Handle(join(o, "/smartcrop"), image(SmartCrop))
-	mux.Handle(join(o, "/rotate"), image(Rotate))
-	mux.Handle(join(o, "/flip"), image(Flip))
-	mux.Handle(join(o, "/flop"), image(Flop))
-	mux.Handle(join(o, "/thumbnail"), image(Thumbnail))
-	mux.Handle(join(o, "/zoom"), image(Zoom))
-	mux.Handle(join(o, "/convert"), image(Convert))
-	mux.Handle(join(o, "/watermark"), image(Watermark))
-	mux.Handle(join(o, "/info"), image(Info))
-	mux.Handle(join(o, "/blur"), image(GaussianBlur))
-	mux.Handle(join(o, "/noop"), image(Noop))
-	mux.Handle(join(o, "/pipeline"), image(Pipeline))
+	for _, endpoint := range imageEndpoints(o) {
+		handle(endpoint.Path, image(endpoint.Operation))
+	}
+	handle("/srcset", imageControllerMiddleware(scriptRequests(srcsetController(o), o), o))
+	if o.Cloudinary {
+		handle("/image/", imageControllerMiddleware(cloudinaryController(o), o))
+	}
 
 	return mux
 }
+
+// legacyRoute wraps the given handler of a legacy unprefixed route, announcing its deprecation
+// and its successor versioned route.
+func legacyRoute(handler http.Handler, successor string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", "<"+successor+">; rel=\"successor-version\"")
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// apiRoute returns the path of the given route matching the API version of the given request,
+// so the URLs built by the endpoints preserve the versioned or legacy route of the request.
+func apiRoute(r *http.Request, o ServerOptions, route string) string {
+	if o.NoLegacyRoutes || strings.HasPrefix(r.URL.Path, join(o, APIVersionPrefix)+"/") {
+		return join(o, APIVersionPrefix+route)
+	}
+	return join(o, route)
+}
+
+// imageEndpoint represents an image processing endpoint of the given operation
+type imageEndpoint struct {
+	Path      string
+	Operation Operation
+}
+
+// imageEndpoints returns the image processing endpoints, served by the server mux
+// and described by the OpenAPI document.
+func imageEndpoints(o ServerOptions) []imageEndpoint {
+	endpoints := []imageEndpoint{
+		{"/resize", Resize},
+		{"/fit", Fit},
+		{"/enlarge", Enlarge},
+		{"/extract", Extract},
+		{"/crop", Crop},
+		{"/smartcrop", SmartCrop},
+		{"/rotate", Rotate},
+		{"/flip", Flip},
+		{"/flop", Flop},
+		{"/thumbnail", Thumbnail},
+		{"/zoom", Zoom},
+		{"/convert", Convert},
+		{"/watermark", Watermark},
+		{"/info", Info},
+		{"/stats", Stats},
+		{"/detect/skin", DetectSkin},
+		{"/blur", GaussianBlur},
+		{"/composite", Composite},
+		{"/gradient", Gradient},
+		{"/vignette", Vignette},
+		{"/shadow", DropShadow},
+		{"/pixelate", Pixelate},
+		{"/posterize", Posterize},
+		{"/channels", Channels},
+		{"/affine", Affine},
+		{"/perspective", Perspective},
+		{"/skew", Skew},
+		{"/video", Video(o.FFmpeg, time.Duration(o.ProcessingTimeout)*time.Second)},
+		{"/removebg", RemoveBackground(o.BackgroundRemoval)},
+		{"/noop", Noop},
+		{"/pipeline", Pipeline},
+		{"/favicons", Favicons},
+	}
+	if o.EnableOriginal {
+		endpoints = append(endpoints, imageEndpoint{"/original", Noop})
+	}
+	return endpoints
+}
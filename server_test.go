@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -10,6 +11,7 @@ import (
 	"path"
 	"strings"
 	"testing"
+	"time"
 
 	"gopkg.in/h2non/bimg.v1"
 )
@@ -394,6 +396,194 @@ func TestMountInvalidPath(t *testing.T) {
 	}
 }
 
+func TestProcessingTimeout(t *testing.T) {
+	slow := func(buf []byte, o ImageOptions) (Image, error) {
+		time.Sleep(100 * time.Millisecond)
+		return Image{Body: buf, Mime: "image/jpeg"}, nil
+	}
+
+	opts := ServerOptions{EndpointTimeouts: map[string]int{"slow": 0}, ProcessingTimeout: 1}
+	r, _ := http.NewRequest("GET", "http://foo/slow", nil)
+	if opts.ProcessingTimeoutFor(r) != 0 {
+		t.Fatal("Endpoint timeout should take precedence")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	ended := make(chan bool, 1)
+	_, err := runOperation(ctx, Operation(slow), []byte{}, ImageOptions{}, func() { ended <- true })
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Operation should exceed the deadline: %v", err)
+	}
+	select {
+	case <-ended:
+		t.Error("The expired operation should keep running")
+	default:
+	}
+	if !<-ended {
+		t.Error("The expired operation should end")
+	}
+
+	_, err = runOperation(context.Background(), Operation(slow), []byte{}, ImageOptions{}, nil)
+	if err != nil {
+		t.Fatalf("Operation should not fail: %s", err)
+	}
+}
+
+func TestProcessingPanic(t *testing.T) {
+	panics := func(buf []byte, o ImageOptions) (Image, error) {
+		panic("invalid image")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	_, err := runOperation(ctx, Operation(panics), []byte{}, ImageOptions{}, nil)
+	if err == nil || err.(Error).HTTPCode() != http.StatusInternalServerError {
+		t.Fatalf("Operation panic should be replied as a server error: %v", err)
+	}
+}
+
+func TestClientDisconnected(t *testing.T) {
+	called := false
+	op := func(buf []byte, o ImageOptions) (Image, error) {
+		called = true
+		return Image{}, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	r, _ := http.NewRequest("POST", "http://foo/crop", nil)
+	r = r.WithContext(ctx)
+	w := httptest.NewRecorder()
+	buf, _ := ioutil.ReadAll(readFile("large.jpg"))
+	imageHandler(w, r, buf, Operation(op), ServerOptions{}, nil)
+
+	if called {
+		t.Fatal("Operation should not run for disconnected clients")
+	}
+	if w.Code != StatusClientClosedRequest {
+		t.Fatalf("Invalid response status: %d", w.Code)
+	}
+}
+
+func TestPlaceholder(t *testing.T) {
+	ts := testServer(placeholderController(ServerOptions{}))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "?width=400&height=300&bg=eee&gradient=ccc&fg=333&type=jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("Invalid response status: %s", res.Status)
+	}
+
+	image, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := assertSize(image, 400, 300); err != nil {
+		t.Error(err)
+	}
+	if bimg.DetermineImageTypeName(image) != "jpeg" {
+		t.Fatalf("Invalid image type")
+	}
+
+	res, err = http.Get(ts.URL + "?width=100000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != 400 {
+		t.Fatalf("Invalid response status: %s", res.Status)
+	}
+}
+
+func TestReplyImageRange(t *testing.T) {
+	image := Image{Body: []byte("0123456789"), Mime: "image/png"}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/convert?type=png&skiplarger=true", nil)
+	r.Header.Set("Range", "bytes=-3")
+	replyImageRange(w, r, image)
+	if w.Code != http.StatusPartialContent || w.Body.String() != "789" || w.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("Invalid range response: %d %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("POST", "/convert?type=png&skiplarger=true", nil)
+	r.Header.Set("Range", "bytes=-3")
+	replyImageRange(w, r, image)
+	if w.Code != http.StatusOK || w.Body.String() != "0123456789" {
+		t.Errorf("The range of POST requests should be ignored: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestVersionedRoutes(t *testing.T) {
+	mux := NewServerMux(ServerOptions{PathPrefix: "/api"})
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/health", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Deprecation") != "" {
+		t.Errorf("Invalid versioned route response: %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/health", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Deprecation") != "true" {
+		t.Errorf("Invalid legacy route response: %d", w.Code)
+	}
+	if link := w.Header().Get("Link"); link != `</api/v1/health>; rel="successor-version"` {
+		t.Errorf("Invalid legacy route successor: %s", link)
+	}
+
+	w = httptest.NewRecorder()
+	NewServerMux(ServerOptions{NoLegacyRoutes: true}).ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Legacy routes should be disabled: %d", w.Code)
+	}
+}
+
+func TestAPIRoute(t *testing.T) {
+	o := ServerOptions{PathPrefix: "/api"}
+	if route := apiRoute(httptest.NewRequest("GET", "/api/v1/srcset", nil), o, "/resize"); route != "/api/v1/resize" {
+		t.Errorf("Invalid versioned route: %s", route)
+	}
+	if route := apiRoute(httptest.NewRequest("GET", "/api/srcset", nil), o, "/resize"); route != "/api/resize" {
+		t.Errorf("Invalid legacy route: %s", route)
+	}
+	o.NoLegacyRoutes = true
+	if route := apiRoute(httptest.NewRequest("GET", "/api/srcset", nil), o, "/resize"); route != "/api/v1/resize" {
+		t.Errorf("Invalid route of disabled legacy routes: %s", route)
+	}
+}
+
+func TestAdminRoutes(t *testing.T) {
+	if name := endpointName(httptest.NewRequest("GET", "/v1/-/stats", nil)); name != "-/stats" {
+		t.Errorf("Invalid admin endpoint name: %s", name)
+	}
+	if name := endpointName(httptest.NewRequest("GET", "/v1/stats", nil)); name != "stats" {
+		t.Errorf("Invalid image endpoint name: %s", name)
+	}
+
+	// Disabling the image stats endpoint does not disable the admin one
+	o := ServerOptions{Stats: NewServerStats(), APIKey: "secret", Endpoints: Endpoints{"stats"}}
+	w := httptest.NewRecorder()
+	NewServerMux(o).ServeHTTP(w, httptest.NewRequest("GET", "/-/stats?key=secret", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Invalid admin stats response: %d", w.Code)
+	}
+
+	// The admin stats are not served to unauthenticated clients
+	w = httptest.NewRecorder()
+	NewServerMux(ServerOptions{Stats: NewServerStats()}).ServeHTTP(w, httptest.NewRequest("GET", "/-/stats", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Unexpected unauthenticated admin stats response: %d", w.Code)
+	}
+}
+
 func controller(op Operation) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		buf, _ := ioutil.ReadAll(r.Body)
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AWS Signature Version 4 constants
+const (
+	sigV4Algorithm      = "AWS4-HMAC-SHA256"
+	sigV4EmptyPayload   = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	sigV4DefaultService = "s3"
+)
+
+// AWS temporary credentials providers defaults
+const (
+	awsContainerHost      = "http://169.254.170.2"
+	awsMetadataURL        = "http://169.254.169.254/latest"
+	awsCredentialsTimeout = 2 * time.Second
+	awsRefreshMargin      = 5 * time.Minute
+)
+
+var awsCredentialsClient = &http.Client{Timeout: awsCredentialsTimeout}
+
+// AWSCredential represents the AWS credentials signing the image source server requests via
+// AWS Signature Version 4, such as private S3 buckets or API Gateway protected origins.
+// Undefined access keys are read from the standard AWS environment variables, or else are the
+// temporary access keys of the container credentials endpoint or the EC2 instance metadata.
+type AWSCredential struct {
+	AccessKeyID     string `json:"accessKeyId"`
+	SecretAccessKey string `json:"secretAccessKey"`
+	SessionToken    string `json:"sessionToken"`
+	Region          string `json:"region"`
+	Service         string `json:"service"`
+
+	// provider is shared by the credential copies signing other services
+	provider *awsProvider
+}
+
+// awsKeys represents the access keys of an AWS credential, expiring if temporary
+type awsKeys struct {
+	AccessKeyID     string    `json:"AccessKeyId"`
+	SecretAccessKey string    `json:"SecretAccessKey"`
+	Token           string    `json:"Token"`
+	Expiration      time.Time `json:"Expiration"`
+}
+
+// awsProvider caches the temporary access keys of a credentials provider, refreshed before
+// their expiry.
+type awsProvider struct {
+	fetch func() (awsKeys, error)
+
+	mutex sync.Mutex
+	keys  awsKeys
+}
+
+// load fills the undefined access keys from the AWS environment variables, otherwise from the
+// temporary credentials providers, and the service default, validating the credential.
+func (c *AWSCredential) load() error {
+	if c.AccessKeyID == "" && c.SecretAccessKey == "" {
+		c.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		c.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		c.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	if c.Service == "" {
+		c.Service = sigV4DefaultService
+	}
+	if c.AccessKeyID == "" && c.SecretAccessKey == "" {
+		provider := &awsProvider{fetch: fetchAWSCredentials}
+		keys, err := provider.fetch()
+		if err != nil {
+			return fmt.Errorf("missing AWS access keys: %s", err)
+		}
+		provider.keys = keys
+		c.provider = provider
+	}
+	if c.provider == nil && (c.AccessKeyID == "" || c.SecretAccessKey == "") {
+		return fmt.Errorf("missing AWS access keys")
+	}
+	if c.Region == "" {
+		return fmt.Errorf("missing AWS region")
+	}
+	return nil
+}
+
+// keys returns the access keys of the credential, refreshing the temporary access keys if they
+// expire within the refresh margin. The cached keys are used if they cannot be refreshed.
+func (c AWSCredential) keys() awsKeys {
+	if c.provider == nil {
+		return awsKeys{AccessKeyID: c.AccessKeyID, SecretAccessKey: c.SecretAccessKey, Token: c.SessionToken}
+	}
+
+	p := c.provider
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if !p.keys.Expiration.IsZero() && time.Now().Add(awsRefreshMargin).After(p.keys.Expiration) {
+		keys, err := p.fetch()
+		if err != nil {
+			debug("cannot refresh the AWS credentials: %s", err)
+		} else {
+			p.keys = keys
+		}
+	}
+	return p.keys
+}
+
+// fetchAWSCredentials fetches the temporary access keys of the ECS or EKS container credentials
+// endpoint, if defined by the standard AWS environment variables, or else of the instance
+// profile of the EC2 instance metadata service.
+func fetchAWSCredentials() (awsKeys, error) {
+	endpoint := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); uri != "" {
+		endpoint = awsContainerHost + uri
+	}
+	if endpoint != "" {
+		token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+		if file := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); file != "" {
+			buf, err := ioutil.ReadFile(file)
+			if err != nil {
+				return awsKeys{}, err
+			}
+			token = strings.TrimSpace(string(buf))
+		}
+		return requestAWSCredentials(endpoint, http.Header{"Authorization": {token}})
+	}
+
+	// The instance metadata is requested by an IMDSv2 session token
+	req, _ := http.NewRequest("PUT", awsMetadataURL+"/api/token", nil)
+	req.Header.Set("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", "21600")
+	token, err := readAWSMetadata(req)
+	if err != nil {
+		return awsKeys{}, err
+	}
+	header := http.Header{"X-Aws-Ec2-Metadata-Token": {token}}
+	req, _ = http.NewRequest("GET", awsMetadataURL+"/meta-data/iam/security-credentials/", nil)
+	req.Header = header
+	role, err := readAWSMetadata(req)
+	if err != nil {
+		return awsKeys{}, err
+	}
+	return requestAWSCredentials(awsMetadataURL+"/meta-data/iam/security-credentials/"+strings.Split(role, "\n")[0], header)
+}
+
+// readAWSMetadata returns the trimmed response body of the given instance metadata request
+func readAWSMetadata(req *http.Request) (string, error) {
+	res, err := awsCredentialsClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("Cannot request the AWS instance metadata: %s", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Cannot request the AWS instance metadata: (status=%d) (url=%s)", res.StatusCode, req.URL)
+	}
+	buf, err := ioutil.ReadAll(res.Body)
+	return strings.TrimSpace(string(buf)), err
+}
+
+// requestAWSCredentials requests the temporary access keys of the given credentials endpoint
+func requestAWSCredentials(endpoint string, header http.Header) (awsKeys, error) {
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return awsKeys{}, err
+	}
+	req.Header = header
+	req.Header.Set("User-Agent", "imaginary/"+Version)
+
+	res, err := awsCredentialsClient.Do(req)
+	if err != nil {
+		return awsKeys{}, fmt.Errorf("Cannot request the AWS credentials: %s", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return awsKeys{}, fmt.Errorf("Cannot request the AWS credentials: (status=%d) (url=%s)", res.StatusCode, endpoint)
+	}
+
+	var keys awsKeys
+	if err := json.NewDecoder(res.Body).Decode(&keys); err != nil {
+		return awsKeys{}, fmt.Errorf("Invalid AWS credentials response: %s", err)
+	}
+	if keys.AccessKeyID == "" || keys.SecretAccessKey == "" {
+		return awsKeys{}, fmt.Errorf("Invalid AWS credentials response: missing access keys")
+	}
+	return keys, nil
+}
+
+// sign signs the given bodiless request at the given time, setting its Authorization header
+func (c AWSCredential) sign(req *http.Request, now time.Time) {
+	c.signPayload(req, nil, now)
+}
+
+// signPayload signs the given request of the given body at the given time
+func (c AWSCredential) signPayload(req *http.Request, payload []byte, now time.Time) {
+	payloadDigest := sha256.Sum256(payload)
+	payloadHash := hex.EncodeToString(payloadDigest[:])
+
+	keys := c.keys()
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	scope := strings.Join([]string{now.Format("20060102"), c.Region, c.Service, "aws4_request"}, "/")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if c.Service == "s3" {
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+	if keys.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", keys.Token)
+	}
+
+	// Signed headers are the host and the AWS headers
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		if name = strings.ToLower(name); strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders string
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		sigV4Query(req),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	digest := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{sigV4Algorithm, amzDate, scope, hex.EncodeToString(digest[:])}, "\n")
+
+	key := []byte("AWS4" + keys.SecretAccessKey)
+	for _, part := range strings.Split(scope, "/") {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigV4Algorithm, keys.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// sigV4Params sorts the encoded query params by name and value
+type sigV4Params [][2]string
+
+func (p sigV4Params) Len() int      { return len(p) }
+func (p sigV4Params) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p sigV4Params) Less(i, j int) bool {
+	if p[i][0] != p[j][0] {
+		return p[i][0] < p[j][0]
+	}
+	return p[i][1] < p[j][1]
+}
+
+// sigV4Query returns the canonical query string, sorted by param name and value
+func sigV4Query(req *http.Request) string {
+	params := sigV4Params{}
+	for name, values := range req.URL.Query() {
+		for _, value := range values {
+			params = append(params, [2]string{sigV4Escape(name), sigV4Escape(value)})
+		}
+	}
+	sort.Sort(params)
+
+	encoded := make([]string, len(params))
+	for i, param := range params {
+		encoded[i] = param[0] + "=" + param[1]
+	}
+	return strings.Join(encoded, "&")
+}
+
+// sigV4Escape URI encodes every byte but the RFC 3986 unreserved characters
+func sigV4Escape(s string) string {
+	var escaped bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			escaped.WriteByte(c)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", c)
+		}
+	}
+	return escaped.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
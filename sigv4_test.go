@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAWSCredentialSign(t *testing.T) {
+	// AWS SigV4 test suite get-vanilla case
+	credential := AWSCredential{
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		Region:          "us-east-1",
+		Service:         "service",
+	}
+	req, _ := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	credential.sign(req, time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+		"SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if auth := req.Header.Get("Authorization"); auth != expected {
+		t.Errorf("Invalid Authorization header: %s", auth)
+	}
+	if req.Header.Get("X-Amz-Date") != "20150830T123600Z" {
+		t.Errorf("Invalid X-Amz-Date header: %s", req.Header.Get("X-Amz-Date"))
+	}
+}
+
+func TestAWSCredentialSignS3(t *testing.T) {
+	credential := AWSCredential{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "secret", SessionToken: "token", Region: "eu-west-1"}
+	if err := credential.load(); err != nil {
+		t.Fatalf("Invalid credential: %s", err)
+	}
+	req, _ := http.NewRequest("GET", "https://bucket.s3.eu-west-1.amazonaws.com/images/cat.jpg", nil)
+	credential.sign(req, time.Now())
+
+	auth := req.Header.Get("Authorization")
+	if !strings.Contains(auth, "/eu-west-1/s3/aws4_request") ||
+		!strings.Contains(auth, "SignedHeaders=host;x-amz-content-sha256;x-amz-date;x-amz-security-token") {
+		t.Errorf("Invalid Authorization header: %s", auth)
+	}
+	if req.Header.Get("X-Amz-Content-Sha256") != sigV4EmptyPayload || req.Header.Get("X-Amz-Security-Token") != "token" {
+		t.Error("Missing S3 signature headers")
+	}
+}
+
+func TestSigV4Query(t *testing.T) {
+	req, _ := http.NewRequest("GET", "https://example.amazonaws.com/?b=2&a=x%20y&a=1&c=~*", nil)
+	if query := sigV4Query(req); query != "a=1&a=x%20y&b=2&c=~%2A" {
+		t.Errorf("Invalid canonical query: %s", query)
+	}
+}
+
+func TestAWSCredentialLoad(t *testing.T) {
+	if err := (&AWSCredential{Region: "us-east-1", AccessKeyID: "AKIDEXAMPLE"}).load(); err == nil {
+		t.Error("Expected missing access keys error")
+	}
+	if err := (&AWSCredential{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "secret"}).load(); err == nil {
+		t.Error("Expected missing region error")
+	}
+}
+
+func TestAWSCredentialProvider(t *testing.T) {
+	var calls int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "container-token" {
+			t.Errorf("Invalid container credentials authorization: %s", r.Header.Get("Authorization"))
+		}
+		calls++
+		// The keys expire within the refresh margin, so they are refreshed by every signature
+		json.NewEncoder(w).Encode(awsKeys{
+			AccessKeyID:     fmt.Sprintf("AKID%d", calls),
+			SecretAccessKey: "secret",
+			Token:           "token",
+			Expiration:      time.Now().Add(time.Minute),
+		})
+	}))
+	defer ts.Close()
+
+	for name, value := range map[string]string{
+		"AWS_ACCESS_KEY_ID":                      "",
+		"AWS_SECRET_ACCESS_KEY":                  "",
+		"AWS_CONTAINER_CREDENTIALS_FULL_URI":     ts.URL,
+		"AWS_CONTAINER_AUTHORIZATION_TOKEN":      "container-token",
+		"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI": "",
+	} {
+		defer os.Setenv(name, os.Getenv(name))
+		os.Setenv(name, value)
+	}
+
+	credential := &AWSCredential{Region: "eu-west-1"}
+	if err := credential.load(); err != nil {
+		t.Fatalf("Cannot load the container credentials: %s", err)
+	}
+	req, _ := http.NewRequest("GET", "https://bucket.s3.eu-west-1.amazonaws.com/cat.jpg", nil)
+	awsService(credential, "s3", "eu-west-1").sign(req, time.Now())
+	if auth := req.Header.Get("Authorization"); !strings.Contains(auth, "Credential=AKID2/") || calls != 2 {
+		t.Errorf("The expiring access keys should be refreshed: %s", auth)
+	}
+	if req.Header.Get("X-Amz-Security-Token") != "token" {
+		t.Errorf("Invalid X-Amz-Security-Token header: %s", req.Header.Get("X-Amz-Security-Token"))
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"image"
+	"image/draw"
+	"math"
+	"sort"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// Skin tone regions detection params: the analysis size, the minimum region area, relative
+// to the image area, and the regions aspect ratio bounds.
+const (
+	skinDetectionSize = 256
+	skinMinArea       = 0.004
+	skinMinAspect     = 0.5
+	skinMaxAspect     = 2.0
+	skinEllipseFill   = math.Pi / 4
+)
+
+// SkinRegion represents the bounding box of a detected skin tone region, in the image
+// coordinates, and how face shaped the region is, between 0 and 1.
+type SkinRegion struct {
+	Left   int     `json:"left"`
+	Top    int     `json:"top"`
+	Width  int     `json:"width"`
+	Height int     `json:"height"`
+	Score  float64 `json:"score"`
+}
+
+// SkinDetection represents the skin tone regions detected in an image
+type SkinDetection struct {
+	Width   int          `json:"width"`
+	Height  int          `json:"height"`
+	Regions []SkinRegion `json:"regions"`
+}
+
+// DetectSkin returns the bounding boxes and the scores of the face shaped skin tone regions
+// of the image as JSON, sorted by score, which the smart crop attention strategy favours, so
+// client apps can build their own crop UIs. This is a color heuristic, not a face detector:
+// skin colored objects are detected, while faces under colored lights, grayscale images and
+// faces merged with the neck or other skin regions are missed.
+func DetectSkin(buf []byte, o ImageOptions) (Image, error) {
+	output := Image{Mime: "application/json"}
+
+	detection, err := detectSkin(buf)
+	if err != nil {
+		return output, err
+	}
+
+	body, _ := json.Marshal(detection)
+	output.Body = body
+	return output, nil
+}
+
+// detectSkin detects the face shaped skin tone regions of the given image, in the image coordinates
+func detectSkin(buf []byte) (SkinDetection, error) {
+	size, err := bimg.Size(buf)
+	if err != nil {
+		return SkinDetection{}, NewError("Cannot retrieve image metadata: "+err.Error(), BadRequest)
+	}
+
+	// The regions are detected over a downscaled image, since only large regions matter
+	analysis := bimg.Options{}
+	if size.Width > skinDetectionSize || size.Height > skinDetectionSize {
+		if size.Width >= size.Height {
+			analysis.Width = skinDetectionSize
+		} else {
+			analysis.Height = skinDetectionSize
+		}
+	}
+	img, err := decodeImage(buf, analysis)
+	if err != nil {
+		return SkinDetection{}, NewError("Cannot decode the image: "+err.Error(), BadRequest)
+	}
+	canvas := image.NewRGBA(img.Bounds().Sub(img.Bounds().Min))
+	draw.Draw(canvas, canvas.Bounds(), img, img.Bounds().Min, draw.Src)
+
+	detection := SkinDetection{Width: size.Width, Height: size.Height, Regions: []SkinRegion{}}
+	scaleX := float64(size.Width) / float64(canvas.Bounds().Dx())
+	scaleY := float64(size.Height) / float64(canvas.Bounds().Dy())
+	for _, region := range detectSkinRegions(canvas) {
+		detection.Regions = append(detection.Regions, SkinRegion{
+			Left:   int(float64(region.Left) * scaleX),
+			Top:    int(float64(region.Top) * scaleY),
+			Width:  int(math.Ceil(float64(region.Width) * scaleX)),
+			Height: int(math.Ceil(float64(region.Height) * scaleY)),
+			Score:  region.Score,
+		})
+	}
+	return detection, nil
+}
+
+// isSkinTone reports whether the given opaque color is a skin tone, by its YCbCr chroma
+func isSkinTone(r, g, b uint8) bool {
+	fr, fg, fb := float64(r), float64(g), float64(b)
+	cb := 128 - 0.168736*fr - 0.331264*fg + 0.5*fb
+	cr := 128 + 0.5*fr - 0.418688*fg - 0.081312*fb
+	return cb >= 77 && cb <= 127 && cr >= 133 && cr <= 173
+}
+
+// detectSkinRegions returns the face shaped skin tone regions of the given image, as the
+// bounding boxes of the 4-connected skin pixels, large enough and roughly as tall as wide.
+// The score is how close the region fills its box as an ellipse, weighted by its aspect.
+func detectSkinRegions(canvas *image.RGBA) []SkinRegion {
+	size := canvas.Bounds().Size()
+	skin := make([]bool, size.X*size.Y)
+	for y := 0; y < size.Y; y++ {
+		for x := 0; x < size.X; x++ {
+			p := canvas.Pix[y*canvas.Stride+x*4:]
+			skin[y*size.X+x] = p[3] > 0x80 && isSkinTone(p[0], p[1], p[2])
+		}
+	}
+
+	minArea := int(math.Max(4, skinMinArea*float64(size.X*size.Y)))
+	visited := make([]bool, len(skin))
+	var regions []SkinRegion
+	var stack []int
+	for i := range skin {
+		if !skin[i] || visited[i] {
+			continue
+		}
+
+		// Flood fill the region, tracking its area and bounding box
+		area, minX, minY, maxX, maxY := 0, size.X, size.Y, 0, 0
+		visited[i] = true
+		stack = append(stack[:0], i)
+		for len(stack) > 0 {
+			j := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			x, y := j%size.X, j/size.X
+			area++
+			minX, minY = minInt(minX, x), minInt(minY, y)
+			maxX, maxY = maxInt(maxX, x), maxInt(maxY, y)
+
+			for _, n := range [4]int{j - 1, j + 1, j - size.X, j + size.X} {
+				if n < 0 || n >= len(skin) || visited[n] || !skin[n] {
+					continue
+				}
+				if (n == j-1 && x == 0) || (n == j+1 && x == size.X-1) {
+					continue
+				}
+				visited[n] = true
+				stack = append(stack, n)
+			}
+		}
+
+		width, height := maxX-minX+1, maxY-minY+1
+		aspect := float64(height) / float64(width)
+		if area < minArea || aspect < skinMinAspect || aspect > skinMaxAspect {
+			continue
+		}
+
+		fill := float64(area) / float64(width*height)
+		fillScore := math.Max(0, 1-math.Abs(fill-skinEllipseFill)/skinEllipseFill)
+		aspectScore := 1 / (1 + math.Abs(math.Log(aspect/1.3)))
+		regions = append(regions, SkinRegion{
+			Left:   minX,
+			Top:    minY,
+			Width:  width,
+			Height: height,
+			Score:  math.Floor(fillScore*aspectScore*100) / 100,
+		})
+	}
+
+	sort.Stable(byScore(regions))
+	return regions
+}
+
+// byScore sorts the skin tone regions by descending score
+type byScore []SkinRegion
+
+func (r byScore) Len() int           { return len(r) }
+func (r byScore) Less(i, j int) bool { return r[i].Score > r[j].Score }
+func (r byScore) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"testing"
+)
+
+// testSkinCanvas returns a blue image with a skin tone ellipse of the given bounds
+func testSkinCanvas(region image.Rectangle) *image.RGBA {
+	canvas := image.NewRGBA(image.Rect(0, 0, 200, 150))
+	cx, cy := float64(region.Min.X+region.Max.X)/2, float64(region.Min.Y+region.Max.Y)/2
+	rx, ry := float64(region.Dx())/2, float64(region.Dy())/2
+	for y := 0; y < 150; y++ {
+		for x := 0; x < 200; x++ {
+			dx, dy := (float64(x)+0.5-cx)/rx, (float64(y)+0.5-cy)/ry
+			if dx*dx+dy*dy <= 1 {
+				canvas.SetRGBA(x, y, color.RGBA{224, 172, 138, 255})
+			} else {
+				canvas.SetRGBA(x, y, color.RGBA{40, 60, 200, 255})
+			}
+		}
+	}
+	return canvas
+}
+
+func TestIsSkinTone(t *testing.T) {
+	if !isSkinTone(224, 172, 138) || !isSkinTone(141, 85, 36) {
+		t.Error("Expected skin tones")
+	}
+	if isSkinTone(40, 60, 200) || isSkinTone(30, 200, 40) || isSkinTone(255, 255, 255) {
+		t.Error("Unexpected skin tones")
+	}
+}
+
+func TestDetectSkinRegions(t *testing.T) {
+	regions := detectSkinRegions(testSkinCanvas(image.Rect(60, 30, 100, 82)))
+	if len(regions) != 1 {
+		t.Fatalf("Invalid number of regions: %d", len(regions))
+	}
+	region := regions[0]
+	if region.Left != 60 || region.Top != 30 || region.Width != 40 || region.Height != 52 {
+		t.Errorf("Invalid region bounds: %+v", region)
+	}
+	if region.Score < 0.9 {
+		t.Errorf("Invalid region score: %g", region.Score)
+	}
+
+	// Wide skin tone regions are not face shaped
+	if regions := detectSkinRegions(testSkinCanvas(image.Rect(10, 60, 190, 80))); len(regions) != 0 {
+		t.Errorf("Unexpected regions: %+v", regions)
+	}
+}
+
+func TestDetectSkin(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+
+	image, err := DetectSkin(buf, ImageOptions{})
+	if err != nil {
+		t.Fatalf("Cannot detect the skin tone regions: %s", err)
+	}
+	if image.Mime != "application/json" {
+		t.Errorf("Invalid MIME type: %s", image.Mime)
+	}
+
+	var detection SkinDetection
+	if err := json.Unmarshal(image.Body, &detection); err != nil {
+		t.Fatalf("Invalid detection: %s", err)
+	}
+	if detection.Width != 550 || detection.Height != 740 || detection.Regions == nil {
+		t.Errorf("Invalid detection: %+v", detection)
+	}
+	for _, region := range detection.Regions {
+		if region.Left+region.Width > 550 || region.Top+region.Height > 740 {
+			t.Errorf("Invalid region bounds: %+v", region)
+		}
+	}
+}
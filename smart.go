@@ -0,0 +1,53 @@
+package main
+
+import (
+	"image"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// smartSamples is the maximum number of sampled pixels per axis inspected by the smart type selection
+const smartSamples = 256
+
+// smartType returns the best output image type for the given image content: GIF for animated
+// GIF images, PNG for flat graphics, such as logos, screenshots or diagrams, WebP for
+// photographic images with transparency, or JPEG for opaque photographic images.
+func smartType(buf []byte) (string, error) {
+	if bimg.DetermineImageType(buf) == bimg.GIF && countGIFFrames(buf) > 1 {
+		return "gif", nil
+	}
+
+	canvas, err := decodeCanvas(buf)
+	if err != nil {
+		return "", err
+	}
+	flat, alpha := inspectContent(canvas)
+	switch {
+	case flat:
+		return "png", nil
+	case alpha:
+		return "webp", nil
+	}
+	return "jpeg", nil
+}
+
+// inspectContent reports whether the given image is a flat graphic, by the distinct colors
+// of a grid of sampled pixels, and whether it has transparent pixels.
+func inspectContent(canvas *image.RGBA) (flat, alpha bool) {
+	size := canvas.Bounds().Size()
+	stepX, stepY := (size.X+smartSamples-1)/smartSamples, (size.Y+smartSamples-1)/smartSamples
+
+	colors := make(map[uint32]struct{})
+	samples := 0
+	for y := 0; y < size.Y; y += stepY {
+		for x := 0; x < size.X; x += stepX {
+			p := canvas.Pix[y*canvas.Stride+x*4:]
+			colors[uint32(p[0])<<24|uint32(p[1])<<16|uint32(p[2])<<8|uint32(p[3])] = struct{}{}
+			alpha = alpha || p[3] != 0xff
+			samples++
+		}
+	}
+
+	// Flat graphics use a few colors, or a small fraction of the samples due to anti-aliasing
+	return len(colors) <= 256 || len(colors)*20 < samples, alpha
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+func TestInspectContent(t *testing.T) {
+	flat := image.NewRGBA(image.Rect(0, 0, 300, 200))
+	photo := image.NewRGBA(image.Rect(0, 0, 300, 200))
+	random := rand.New(rand.NewSource(1))
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 300; x++ {
+			flat.Set(x, y, color.RGBA{uint8(x / 100 * 80), 0, 0, 0xff})
+			photo.Set(x, y, color.RGBA{uint8(random.Intn(256)), uint8(random.Intn(256)), uint8(y), 0xff})
+		}
+	}
+
+	if isFlat, alpha := inspectContent(flat); !isFlat || alpha {
+		t.Errorf("Invalid flat graphic content: flat %t, alpha %t", isFlat, alpha)
+	}
+	if isFlat, alpha := inspectContent(photo); isFlat || alpha {
+		t.Errorf("Invalid photographic content: flat %t, alpha %t", isFlat, alpha)
+	}
+
+	photo.Set(10, 10, color.Transparent)
+	if _, alpha := inspectContent(photo); !alpha {
+		t.Error("Expected transparent content")
+	}
+}
+
+func TestSmartType(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+	if imageType, err := smartType(buf); err != nil || imageType != "jpeg" {
+		t.Errorf("Invalid photographic image type: %s (%v)", imageType, err)
+	}
+	if imageType, err := smartType(testGIF(t)); err != nil || imageType != "gif" {
+		t.Errorf("Invalid animated image type: %s (%v)", imageType, err)
+	}
+}
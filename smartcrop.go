@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// GravityEntropy is the smart crop gravity favouring the highest entropy image areas,
+// which bimg does not support, unlike the attention based bimg.GravitySmart gravity.
+const GravityEntropy = bimg.GravitySmart + 1
+
+// CropBoxHeader is the response header of the source image area of the smart crop, if requested
+const CropBoxHeader = "X-Imaginary-Crop-Box"
+
+// CropBox represents the source image area of a smart crop
+type CropBox struct {
+	Left   int
+	Top    int
+	Width  int
+	Height int
+}
+
+// String returns the crop box as comma separated left, top, width and height values
+func (b CropBox) String() string {
+	return fmt.Sprintf("%d,%d,%d,%d", b.Left, b.Top, b.Width, b.Height)
+}
+
+// isSmartCropRequest reports whether the image must be cropped via the libvips smart crop
+// itself: always for the entropy gravity, or for the attention gravity if the crop box is requested.
+func isSmartCropRequest(o ImageOptions) bool {
+	if o.Width == 0 || o.Height == 0 {
+		return false
+	}
+	return o.Gravity == GravityEntropy || (o.Gravity == bimg.GravitySmart && o.CropBox)
+}
+
+// smartCrop resizes the image to cover the requested size, then crops it via the libvips smart
+// crop of the entropy or attention gravity, then processes the remaining params, exposing
+// the source image area of the crop if the cropbox param is defined.
+func smartCrop(buf []byte, o ImageOptions) (Image, error) {
+	interesting := vipsInterestingAttention
+	if o.Gravity == GravityEntropy {
+		interesting = vipsInterestingEntropy
+	}
+
+	cropped, box, err := vipsSmartCrop(buf, o.Width, o.Height, interesting, pageSaveSuffix)
+	if err != nil {
+		return Image{}, err
+	}
+
+	opts := BimgOptions(o)
+	opts.Width, opts.Height = 0, 0
+	opts.Gravity = bimg.GravityCentre
+	if opts.Type == bimg.UNKNOWN {
+		opts.Type = bimg.DetermineImageType(buf)
+	}
+
+	image, err := Process(cropped, opts)
+	if err != nil {
+		return Image{}, err
+	}
+	if o.CropBox {
+		image.CropBox = &box
+	}
+	return image, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+func TestIsSmartCropRequest(t *testing.T) {
+	cases := []struct {
+		opts     ImageOptions
+		expected bool
+	}{
+		{ImageOptions{Width: 300, Height: 200, Gravity: GravityEntropy}, true},
+		{ImageOptions{Width: 300, Height: 200, Gravity: bimg.GravitySmart, CropBox: true}, true},
+		{ImageOptions{Width: 300, Height: 200, Gravity: bimg.GravitySmart}, false},
+		{ImageOptions{Width: 300, Gravity: GravityEntropy}, false},
+		{ImageOptions{Width: 300, Height: 200, CropBox: true}, false},
+	}
+
+	for _, c := range cases {
+		if smart := isSmartCropRequest(c.opts); smart != c.expected {
+			t.Errorf("Invalid smart crop request %+v: %t", c.opts, smart)
+		}
+	}
+
+	if box := (CropBox{Left: 10, Top: 20, Width: 300, Height: 200}).String(); box != "10,20,300,200" {
+		t.Errorf("Invalid crop box: %s", box)
+	}
+	if parseGravity("entropy") != GravityEntropy || parseGravity("attention") != bimg.GravitySmart {
+		t.Error("Invalid smart crop gravities")
+	}
+}
+
+func TestEntropyCrop(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+
+	for _, operation := range []Operation{Crop, Thumbnail} {
+		image, err := operation(buf, ImageOptions{Width: 300, Height: 200, Gravity: GravityEntropy, CropBox: true})
+		if err != nil {
+			t.Fatalf("Cannot crop the image: %s", err)
+		}
+		if bimg.DetermineImageType(image.Body) != bimg.JPEG {
+			t.Error("Invalid image type")
+		}
+		if err := assertSize(image.Body, 300, 200); err != nil {
+			t.Error(err)
+		}
+
+		// The image covers the crop width, so only its top position is selected
+		box := image.CropBox
+		if box == nil {
+			t.Fatal("Missing crop box")
+		}
+		if box.Left != 0 || box.Width != 550 || box.Height < 366 || box.Height > 367 || box.Top+box.Height > 740 {
+			t.Errorf("Invalid crop box: %s", box)
+		}
+	}
+}
+
+func TestCropBoxHeader(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+	ts := testServer(func(w http.ResponseWriter, r *http.Request) {
+		imageHandler(w, r, buf, Crop, ServerOptions{}, nil)
+	})
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "?width=300&height=200&gravity=smart&cropbox=true")
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("Invalid response status: %d", res.StatusCode)
+	}
+	if res.Header.Get(CropBoxHeader) == "" {
+		t.Error("Missing crop box header")
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"io"
 	"net/http"
 	"net/url"
 )
@@ -10,11 +11,15 @@ type ImageSourceFactoryFunction func(*SourceConfig) ImageSource
 
 type SourceConfig struct {
 	AuthForwarding  bool
+	EnableURLSource bool
 	Authorization   string
 	MountPath       string
 	Type            ImageSourceType
 	AllowedOrigings []*url.URL
 	MaxAllowedSize  int
+	Secrets         *Secrets
+	CachePassthru   bool
+	ForwardHeaders  []string
 }
 
 var imageSourceMap = make(map[ImageSourceType]ImageSource)
@@ -29,6 +34,12 @@ type CacheableImageSource interface {
 	GetImageWithCacheHeaders(*http.Request) ([]byte, http.Header, error)
 }
 
+// StreamableImageSource represents the image sources able to stream the source image,
+// with its size in bytes, -1 if unknown, and its cache headers, instead of buffering it.
+type StreamableImageSource interface {
+	GetImageStream(*http.Request) (io.ReadCloser, int64, http.Header, error)
+}
+
 func RegisterSource(sourceType ImageSourceType, factory ImageSourceFactoryFunction) {
 	imageSourceFactoryMap[sourceType] = factory
 }
@@ -39,9 +50,13 @@ func LoadSources(o ServerOptions) {
 			Type:            name,
 			MountPath:       o.Mount,
 			AuthForwarding:  o.AuthForwarding,
+			EnableURLSource: o.EnableURLSource,
 			Authorization:   o.Authorization,
 			AllowedOrigings: o.AllowedOrigins,
 			MaxAllowedSize:  o.MaxAllowedSize,
+			Secrets:         o.Secrets,
+			CachePassthru:   o.HTTPCachePassthru,
+			ForwardHeaders:  o.ForwardHeaders,
 		})
 	}
 }
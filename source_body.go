@@ -1,7 +1,6 @@
 package main
 
 import (
-	"io/ioutil"
 	"net/http"
 	"strings"
 )
@@ -46,7 +45,7 @@ func readFormBody(r *http.Request) ([]byte, error) {
 	}
 	defer file.Close()
 
-	buf, err := ioutil.ReadAll(file)
+	buf, err := readImage(r, file, 0)
 	if len(buf) == 0 {
 		err = ErrEmptyBody
 	}
@@ -62,7 +61,7 @@ func formField(r *http.Request) string {
 }
 
 func readRawBody(r *http.Request) ([]byte, error) {
-	return ioutil.ReadAll(r.Body)
+	return readImage(r, r.Body, int(r.ContentLength))
 }
 
 func init() {
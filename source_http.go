@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -29,6 +31,35 @@ func isCacheHeader(headerName string) bool {
 	return false
 }
 
+// forwardedHeader reports whether the given origin response header is passed through to
+// the client: the cache headers, if the cache headers passthrough is enabled, and the
+// configured forwarded response headers.
+func (s *HttpImageSource) forwardedHeader(headerName string) bool {
+	if s.Config.CachePassthru && isCacheHeader(headerName) {
+		return true
+	}
+	for _, name := range s.Config.ForwardHeaders {
+		if http.CanonicalHeaderKey(name) == headerName {
+			return true
+		}
+	}
+	return false
+}
+
+// FetchError represents an error fetching the image from its origin
+type FetchError struct {
+	Message string
+}
+
+func (e FetchError) Error() string {
+	return e.Message
+}
+
+// NewFetchError creates a new origin fetch error of the given formatted message
+func NewFetchError(format string, args ...interface{}) FetchError {
+	return FetchError{fmt.Sprintf(format, args...)}
+}
+
 type HttpImageSource struct {
 	Config *SourceConfig
 }
@@ -37,6 +68,36 @@ func NewHttpImageSource(config *SourceConfig) ImageSource {
 	return &HttpImageSource{config}
 }
 
+// maxRedirects is the maximum redirects followed fetching an image, as the default HTTP client
+const maxRedirects = 10
+
+// client returns the HTTP client of the image source server requests
+func (s *HttpImageSource) client() *http.Client {
+	return &http.Client{CheckRedirect: s.checkRedirect}
+}
+
+// checkRedirect binds the origin credentials to their hosts on redirects: the credential headers
+// of the requested host are removed, as the forwarded authorization header if the host changes,
+// and the credential of the redirected host, if any, is applied instead.
+func (s *HttpImageSource) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return errors.New("stopped after 10 redirects")
+	}
+
+	credentials := s.Config.Secrets.OriginCredentials()
+	origin := via[0].URL.Host
+	if credential, ok := credentials.Lookup(origin); ok {
+		credential.strip(req)
+	}
+	if req.URL.Host != origin {
+		req.Header.Del("Authorization")
+	}
+	if credential, ok := credentials.Lookup(req.URL.Host); ok {
+		return credential.apply(req)
+	}
+	return nil
+}
+
 func (s *HttpImageSource) Matches(r *http.Request) bool {
 	return r.Method == "GET" && r.URL.Query().Get("url") != ""
 }
@@ -53,65 +114,121 @@ func (s *HttpImageSource) GetImageWithCacheHeaders(req *http.Request) ([]byte, h
 		return nil, nil, ErrInvalidImageURL
 	}
 	if shouldRestrictOrigin(url, s.Config.AllowedOrigings) {
-		return nil, nil, fmt.Errorf("Not allowed remote URL origin: %s", url.Host)
+		return nil, nil, NewAuditError(AuditOriginDenied, fmt.Sprintf("Not allowed remote URL origin: %s", url.Host))
 	}
 	return s.fetchImage(url, req)
 }
 
+// FetchURL fetches the image of the given URL other than the source image, such as overlay
+// images, bound to the given context, applying the same origin restrictions as the image source.
+func (s *HttpImageSource) FetchURL(ctx context.Context, rawurl string) ([]byte, error) {
+	if !s.Config.EnableURLSource {
+		return nil, ErrURLSourceDisabled
+	}
+	url, err := url.Parse(rawurl)
+	if err != nil || url.Host == "" {
+		return nil, ErrInvalidImageURL
+	}
+	if shouldRestrictOrigin(url, s.Config.AllowedOrigings) {
+		return nil, NewAuditError(AuditOriginDenied, fmt.Sprintf("Not allowed remote URL origin: %s", url.Host))
+	}
+	ireq := (&http.Request{Header: http.Header{}}).WithContext(ctx)
+	buf, _, err := s.fetchImage(url, ireq)
+	return buf, err
+}
+
+// GetImageStream opens the source image of the given request, returning its response body
+// unread, so the image can be processed as it is downloaded, instead of buffering it.
+func (s *HttpImageSource) GetImageStream(req *http.Request) (io.ReadCloser, int64, http.Header, error) {
+	url, err := parseURL(req)
+	if err != nil {
+		return nil, 0, nil, ErrInvalidImageURL
+	}
+	if shouldRestrictOrigin(url, s.Config.AllowedOrigings) {
+		return nil, 0, nil, NewAuditError(AuditOriginDenied, fmt.Sprintf("Not allowed remote URL origin: %s", url.Host))
+	}
+	res, headers, err := s.openImage(url, req)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	return res.Body, res.ContentLength, headers, nil
+}
+
 func (s *HttpImageSource) fetchImage(url *url.URL, ireq *http.Request) ([]byte, http.Header, error) {
+	res, resHeaders, err := s.openImage(url, ireq)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+
+	// Read the body
+	buf, err := readImage(ireq, res.Body, int(res.ContentLength))
+	if err != nil {
+		return nil, nil, NewFetchError("Unable to create image from response body: %s (url=%s)", res.Request.URL.String(), err)
+	}
+	return buf, resHeaders, nil
+}
+
+// openImage requests the given image URL, returning the response of the unread image body
+// and its cache and forwarded headers.
+func (s *HttpImageSource) openImage(url *url.URL, ireq *http.Request) (*http.Response, http.Header, error) {
 	// Check remote image size by fetching HTTP Headers
 	if s.Config.MaxAllowedSize > 0 {
-		req := newHTTPRequest(s, ireq, "HEAD", url)
-		res, err := http.DefaultClient.Do(req)
+		req, err := newHTTPRequest(s, ireq, "HEAD", url)
+		if err != nil {
+			return nil, nil, err
+		}
+		res, err := s.client().Do(req)
 		if err != nil {
-			return nil, nil, fmt.Errorf("Error fetching image http headers: %v", err)
+			return nil, nil, NewFetchError("Error fetching image http headers: %v", err)
 		}
 		res.Body.Close()
 		if res.StatusCode < 200 && res.StatusCode > 206 {
-			return nil, nil, fmt.Errorf("Error fetching image http headers: (status=%d) (url=%s)", res.StatusCode, req.URL.String())
+			return nil, nil, NewFetchError("Error fetching image http headers: (status=%d) (url=%s)", res.StatusCode, req.URL.String())
 		}
 
 		contentLength, _ := strconv.Atoi(res.Header.Get("Content-Length"))
 		if contentLength > s.Config.MaxAllowedSize {
-			return nil, nil, fmt.Errorf("Content-Length %d exceeds maximum allowed %d bytes", contentLength, s.Config.MaxAllowedSize)
+			return nil, nil, NewAuditError(AuditOversizedInput, fmt.Sprintf("Content-Length %d exceeds maximum allowed %d bytes", contentLength, s.Config.MaxAllowedSize))
 		}
 	}
 
-	// Perform the request using the default client
-	req := newHTTPRequest(s, ireq, "GET", url)
-	res, err := http.DefaultClient.Do(req)
+	// Perform the request
+	req, err := newHTTPRequest(s, ireq, "GET", url)
 	if err != nil {
-		return nil, nil, fmt.Errorf("Error downloading image: %v", err)
+		return nil, nil, err
+	}
+	res, err := s.client().Do(req)
+	if err != nil {
+		return nil, nil, NewFetchError("Error downloading image: %v", err)
 	}
-	defer res.Body.Close()
 	if res.StatusCode != 200 {
-		return nil, nil, fmt.Errorf("Error downloading image: (status=%d) (url=%s)", res.StatusCode, req.URL.String())
+		res.Body.Close()
+		return nil, nil, NewFetchError("Error downloading image: (status=%d) (url=%s)", res.StatusCode, req.URL.String())
 	}
 
-	// Gather the cache headers
+	// Gather the cache and forwarded headers
 	resHeaders := make(http.Header, len(res.Header))
 	for k, v := range res.Header {
-		if isCacheHeader(k) {
+		if s.forwardedHeader(k) {
 			for _, vv := range v {
 				resHeaders.Add(k, vv)
 			}
 		}
 	}
 
-	// Read the body
-	buf, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		return nil, nil, fmt.Errorf("Unable to create image from response body: %s (url=%s)", req.URL.String(), err)
-	}
-	return buf, resHeaders, nil
+	return res, resHeaders, nil
 }
 
 func (s *HttpImageSource) setAuthorizationHeader(req *http.Request, ireq *http.Request) {
 	auth := s.Config.Authorization
-	if auth == "" {
+	if secret := s.Config.Secrets.Authorization(); secret != "" {
+		auth = secret
+	}
+	if auth == "" && ireq != nil {
 		auth = ireq.Header.Get("X-Forward-Authorization")
 	}
-	if auth == "" {
+	if auth == "" && ireq != nil {
 		auth = ireq.Header.Get("Authorization")
 	}
 	if auth != "" {
@@ -124,17 +241,27 @@ func parseURL(request *http.Request) (*url.URL, error) {
 	return url.Parse(queryUrl)
 }
 
-func newHTTPRequest(s *HttpImageSource, ireq *http.Request, method string, url *url.URL) *http.Request {
+func newHTTPRequest(s *HttpImageSource, ireq *http.Request, method string, url *url.URL) (*http.Request, error) {
 	req, _ := http.NewRequest(method, url.String(), nil)
 	req.Header.Set("User-Agent", "imaginary/"+Version)
 	req.URL = url
 
-	// Forward auth header to the target server, if necessary
-	if s.Config.AuthForwarding || s.Config.Authorization != "" {
+	// Bind the origin request to the incoming request lifetime and deadline
+	if ireq != nil {
+		req = req.WithContext(ireq.Context())
+	}
+
+	// Set the origin credential, if defined, or forward auth header to the target server, if necessary.
+	// The authorization secret file is read on every request, since it may be defined after a reload.
+	if credential, ok := s.Config.Secrets.OriginCredentials().Lookup(url.Host); ok {
+		if err := credential.apply(req); err != nil {
+			return nil, err
+		}
+	} else if s.Config.AuthForwarding || s.Config.Authorization != "" || s.Config.Secrets.Authorization() != "" {
 		s.setAuthorizationHeader(req, ireq)
 	}
 
-	return req
+	return req, nil
 }
 
 func shouldRestrictOrigin(url *url.URL, origins []*url.URL) bool {
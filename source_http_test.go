@@ -5,6 +5,8 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -124,6 +126,31 @@ func TestHttpImageSourceForwardAuthHeader(t *testing.T) {
 	}
 }
 
+func TestHttpImageSourceAuthorizationFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imaginary-secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	authFile := filepath.Join(dir, "authorization")
+	ioutil.WriteFile(authFile, []byte("Bearer token1\n"), 0600)
+	secrets, err := NewSecrets(SecretsOptions{AuthorizationFile: authFile})
+	if err != nil {
+		t.Fatalf("Cannot read the secrets: %s", err)
+	}
+
+	source := &HttpImageSource{&SourceConfig{Secrets: secrets}}
+	target, _ := url.Parse("http://bar.com/image.jpg")
+	req, err := newHTTPRequest(source, nil, "GET", target)
+	if err != nil {
+		t.Fatalf("Cannot create the request: %s", err)
+	}
+	if req.Header.Get("Authorization") != "Bearer token1" {
+		t.Errorf("Invalid Authorization header: %s", req.Header.Get("Authorization"))
+	}
+}
+
 func TestHttpImageSourceError(t *testing.T) {
 	var err error
 
@@ -179,3 +206,42 @@ func TestHttpImageSourceExceedsMaximumAllowedLength(t *testing.T) {
 	w := httptest.NewRecorder()
 	fakeHandler(w, r)
 }
+
+func TestHttpImageSourceForwardedHeaders(t *testing.T) {
+	buf, _ := ioutil.ReadFile(fixtureImage)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("ETag", `"abc"`)
+		w.Header().Set("X-Origin-Id", "42")
+		w.Header().Set("Server", "origin")
+		w.Write(buf)
+	}))
+	defer ts.Close()
+
+	cases := []struct {
+		config   SourceConfig
+		expected []string
+	}{
+		{SourceConfig{}, []string{}},
+		{SourceConfig{CachePassthru: true}, []string{"Cache-Control"}},
+		{SourceConfig{ForwardHeaders: []string{"etag", "X-Origin-Id"}}, []string{"Etag", "X-Origin-Id"}},
+	}
+
+	for _, c := range cases {
+		config := c.config
+		source := &HttpImageSource{&config}
+		r, _ := http.NewRequest("GET", "http://foo/bar?url="+ts.URL, nil)
+		_, headers, err := source.GetImageWithCacheHeaders(r)
+		if err != nil {
+			t.Fatalf("Cannot fetch the image: %s", err)
+		}
+		if len(headers) != len(c.expected) {
+			t.Errorf("Invalid forwarded headers: %v", headers)
+		}
+		for _, name := range c.expected {
+			if headers.Get(name) == "" {
+				t.Errorf("Missing forwarded header %s: %v", name, headers)
+			}
+		}
+	}
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// errSourceStreamFallback rejects the streamed source images which must be buffered instead
+var errSourceStreamFallback = errors.New("the source image cannot be streamed")
+
+// sourceStream represents a source image read by libvips as it is downloaded. The read bytes
+// are recorded until the image is committed to the streamed processing, so the source image
+// can still be buffered and processed as usual if the image is rejected by its header.
+type sourceStream struct {
+	ctx       context.Context
+	r         *bufio.Reader
+	maxSize   int
+	read      int
+	recorded  bytes.Buffer
+	recording bool
+	err       error
+}
+
+func newSourceStream(ctx context.Context, r io.Reader, maxSize int) *sourceStream {
+	return &sourceStream{ctx: ctx, r: bufio.NewReader(r), maxSize: maxSize, recording: true}
+}
+
+// Read reads the next chunk of the source image, failing if the request context is done
+// or the source image exceeds the maximum allowed size, if any.
+func (s *sourceStream) Read(p []byte) (int, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	if err := s.ctx.Err(); err != nil {
+		s.err = err
+		return 0, err
+	}
+
+	n, err := s.r.Read(p)
+	s.read += n
+	if s.recording {
+		s.recorded.Write(p[:n])
+	}
+	if s.maxSize > 0 && s.read > s.maxSize {
+		err = NewAuditError(AuditOversizedInput, fmt.Sprintf("Image exceeds maximum allowed %d bytes", s.maxSize))
+	}
+	if err != nil && err != io.EOF {
+		s.err = err
+	}
+	return n, err
+}
+
+// imageType returns the source image type, peeking its magic bytes without consuming them
+func (s *sourceStream) imageType() bimg.ImageType {
+	header, _ := s.r.Peek(16)
+	return bimg.DetermineImageType(header)
+}
+
+// commit stops recording the read bytes, once the image is accepted for the streamed processing
+func (s *sourceStream) commit() {
+	s.recording = false
+	s.recorded = bytes.Buffer{}
+}
+
+// buffer reads the rest of the uncommitted source image, returning the full source image
+func (s *sourceStream) buffer() ([]byte, error) {
+	if _, err := io.Copy(ioutil.Discard, s); err != nil {
+		return nil, err
+	}
+	return s.recorded.Bytes(), nil
+}
+
+// readSourceChunk reads the next chunk of the streamed source image of the given handle into the
+// given buffer, reporting false on error, which is kept by the source stream to be replied.
+func readSourceChunk(handle uintptr, chunk []byte) (int, bool) {
+	s, ok := lookupStream(handle).(*sourceStream)
+	if !ok {
+		return 0, false
+	}
+	n, err := io.ReadFull(s, chunk)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		err = nil
+	}
+	return n, err == nil
+}
+
+// isSourceStreamEligible reports whether the source image of the given request can be streamed to
+// libvips, if enabled: the plain resize and thumbnail downscales eligible to the thumbnail fast path,
+// which shrinks the source image on load, without any other operation or source image inspection.
+func isSourceStreamEligible(r *http.Request, o ServerOptions) bool {
+	if !o.StreamSources || o.Moderation.Moderator != nil || explainRequested(r, o) || originalRequested(r, o) {
+		return false
+	}
+
+	opts := readParams(r.URL.Query())
+	endpoint := endpointName(r)
+	crop := endpoint == "resize" && resizeCrop(opts)
+	if endpoint != "resize" && endpoint != "thumbnail" {
+		return false
+	}
+	if crop && (opts.Width == 0 || opts.Height == 0) || !crop && (opts.Width > 0) == (opts.Height > 0) {
+		return false
+	}
+	if hasTransformParams(opts) || len(wrapperOperations(opts)) > 0 || len(opts.Relative) > 0 || opts.AspectRatio != "" ||
+		opts.Depth != 0 || opts.SkipLarger || opts.Threshold || opts.CropBox || opts.Page != nil {
+		return false
+	}
+
+	// The quality ladder default requires the output width before reading the source image header
+	if opts.Width == 0 && len(o.QualityLadder) > 0 && r.URL.Query().Get("quality") == "" {
+		return false
+	}
+
+	switch opts.Type {
+	case "", "auto", "jpeg", "png", "webp":
+		return true
+	}
+	return false
+}
+
+// isSourceOutputStreamEligible reports whether the source image of the given request can be streamed
+// to libvips while its output image is streamed to the response, if both are enabled: the requests
+// eligible to the output streaming, but the cached ones, since their output images are buffered.
+func isSourceOutputStreamEligible(r *http.Request, o ServerOptions) bool {
+	if !o.StreamSources || o.StreamMinSize == 0 || o.Moderation.Moderator != nil || explainRequested(r, o) ||
+		originalRequested(r, o) || isResultCached(r, o) {
+		return false
+	}
+	opts := readParams(r.URL.Query())
+	return isStreamRequest(endpointName(r), opts) && opts.Type != "ico" && opts.Page == nil
+}
+
+// streamSource processes the image of the given request while its source image is downloaded,
+// reporting whether the request was replied. Otherwise, it returns the buffered source image
+// and its cache headers, to be processed as usual, or the source image error.
+func streamSource(w http.ResponseWriter, r *http.Request, source StreamableImageSource, o ServerOptions) (bool, []byte, http.Header, error) {
+	timings, start := newTimings(o), time.Now()
+	body, length, cacheHeaders, err := source.GetImageStream(r)
+	if err != nil {
+		return false, nil, nil, err
+	}
+	defer body.Close()
+	timings.Since("fetch", start)
+
+	stream := newSourceStream(r.Context(), body, o.MaxAllowedSize)
+	if !isSourceStreamEligible(r, o) {
+		// Only the large source images are streamed, as their output images are
+		if length < int64(o.StreamMinSize) {
+			return bufferSource(stream, cacheHeaders, errSourceStreamFallback)
+		}
+		return streamSourceOutput(w, r, stream, cacheHeaders, timings, o)
+	}
+
+	opts := readParams(r.URL.Query())
+	crop := endpointName(r) == "resize" && resizeCrop(opts)
+
+	// The streamed source image type is inferred by its magic bytes, unlike the buffered ones
+	sourceType := stream.imageType()
+	vary := ""
+	if opts.Type == "auto" {
+		opts.Type = determineAcceptMimeType(r.Header.Get("Accept"))
+		vary = "Accept"
+	}
+	outputType := ImageType(opts.Type)
+	if outputType == bimg.UNKNOWN {
+		outputType = sourceType
+	}
+	switch {
+	case sourceType != bimg.JPEG && sourceType != bimg.PNG && sourceType != bimg.WEBP,
+		outputType != bimg.JPEG && outputType != bimg.PNG && outputType != bimg.WEBP:
+		return bufferSource(stream, cacheHeaders, errSourceStreamFallback)
+	}
+	// The output width is the requested one, since only downscales are streamed
+	if quality, ok := ladderQuality(r, opts.Width, o); ok {
+		opts.Quality = quality
+	}
+	if r.URL.Query().Get("interlace") == "" {
+		opts.Interlace = o.InterlacedByDefault(bimg.ImageTypeName(outputType))
+	}
+
+	var size bimg.ImageSize
+	acquired := false
+	defer func() {
+		if acquired {
+			o.ProcessingQueue.Release()
+		}
+	}()
+	accept := func(header bimg.ImageSize, orientation int) error {
+		size = header
+		if orientation >= 5 {
+			header.Width, header.Height = header.Height, header.Width
+		}
+		// Only downscales are handled, since bimg never enlarges by default
+		if header.Width < opts.Width || header.Height < opts.Height {
+			return errSourceStreamFallback
+		}
+		if err := checkCostLimit(w, sizeCost(size, opts), o); err != nil {
+			return err
+		}
+		// Wait for a processing slot once the header is accepted, so the slow source images
+		// do not hold a slot while their header is downloaded
+		if err := o.ProcessingQueue.Acquire(r.Context(), requestPriority(r, o)); err != nil {
+			return err
+		}
+		acquired = true
+		stream.commit()
+		return nil
+	}
+
+	start = time.Now()
+	handle := registerStream(stream)
+	defer unregisterStream(handle)
+	buf, committed, err := vipsThumbnailSource(handle, opts.Width, opts.Height, crop, thumbnailSaveSuffix(outputType, opts), accept)
+	if stream.err != nil {
+		err = stream.err
+	}
+	if !committed {
+		if replyContextError(r, w, o) {
+			return true, nil, nil, nil
+		}
+		// Only the processing cost is checked by the source image header
+		if e, ok := err.(Error); ok {
+			audit(o, r, AuditOversizedInput, e.Error())
+			ErrorReply(r, w, e, o)
+			return true, nil, nil, nil
+		}
+		return bufferSource(stream, cacheHeaders, err)
+	}
+	timings.Since(endpointName(r), start)
+
+	if replyContextError(r, w, o) {
+		return true, nil, nil, nil
+	}
+	if err != nil {
+		if _, ok := err.(AuditError); ok {
+			auditSourceError(o, r, err)
+			ErrorReply(r, w, NewSourceError("", err), o)
+			return true, nil, nil, nil
+		}
+		ErrorReply(r, w, NewError("Error while processing the image: "+err.Error(), BadRequest), o)
+		return true, nil, nil, nil
+	}
+
+	image := Image{Body: buf, Mime: GetImageMimeType(outputType)}
+	w.Header().Set(InputSizeHeader, strconv.Itoa(stream.read))
+	w.Header().Set(InputDimensionsHeader, formatDimensions(size))
+	w.Header().Set(OutputSizeHeader, strconv.Itoa(len(image.Body)))
+	if outputSize, err := bimg.Size(image.Body); err == nil {
+		w.Header().Set(OutputDimensionsHeader, formatDimensions(outputSize))
+	}
+	setDebugHeaders(w, timings)
+	replyProcessedImage(w, r, image, vary, cacheHeaders, false)
+	return true, nil, nil, nil
+}
+
+// streamSourceOutput processes the fit or convert image of the given request while its source image
+// is downloaded, streaming the output image to the response as it is encoded, as streamImage does,
+// so neither the source nor the output images are fully kept in memory. Both image sizes are unknown
+// until the response is written, so the response omits their headers, and the Content-Length header.
+func streamSourceOutput(w http.ResponseWriter, r *http.Request, stream *sourceStream, cacheHeaders http.Header, timings *Timings, o ServerOptions) (bool, []byte, http.Header, error) {
+	opts := readParams(r.URL.Query())
+
+	// The streamed source image type is inferred by its magic bytes, unlike the buffered ones
+	sourceType := stream.imageType()
+	vary := ""
+	if opts.Type == "auto" {
+		opts.Type = determineAcceptMimeType(r.Header.Get("Accept"))
+		vary = "Accept"
+	}
+	outputType := ImageType(opts.Type)
+	if outputType == bimg.UNKNOWN {
+		outputType = sourceType
+	}
+	switch {
+	case !isStreamType(sourceType), !isStreamType(outputType):
+		return bufferSource(stream, cacheHeaders, errSourceStreamFallback)
+	case sourceType == bimg.TIFF && o.InputLimits.MaxTIFFPages > 0:
+		// The TIFF directories are only counted within the whole source image
+		return bufferSource(stream, cacheHeaders, errSourceStreamFallback)
+	}
+	if r.URL.Query().Get("interlace") == "" {
+		opts.Interlace = o.InterlacedByDefault(bimg.ImageTypeName(outputType))
+	}
+
+	var size, output bimg.ImageSize
+	acquired := false
+	defer func() {
+		if acquired {
+			o.ProcessingQueue.Release()
+		}
+	}()
+	accept := func(header bimg.ImageSize, orientation int) (float64, float64, string, error) {
+		// Rotating the image by its EXIF orientation requires random access
+		if orientation > 1 {
+			return 0, 0, "", errSourceStreamFallback
+		}
+		size, output = header, header
+		if opts.Width > 0 && opts.Height > 0 {
+			output.Width, output.Height = fitDimensions(size.Width, size.Height, opts.Width, opts.Height, opts.Outside)
+		}
+		// Only downscales are streamed, since bimg never enlarges by default
+		if output.Width > size.Width || output.Height > size.Height || output.Width == 0 || output.Height == 0 {
+			return 0, 0, "", errSourceStreamFallback
+		}
+		if quality, ok := ladderQuality(r, output.Width, o); ok {
+			opts.Quality = quality
+		}
+		if err := checkCostLimit(w, sizeCost(size, opts), o); err != nil {
+			return 0, 0, "", err
+		}
+		// Wait for a processing slot once the header is accepted, so the slow source images
+		// do not hold a slot while their header is downloaded
+		if err := o.ProcessingQueue.Acquire(r.Context(), requestPriority(r, o)); err != nil {
+			return 0, 0, "", err
+		}
+		acquired = true
+		stream.commit()
+		hscale, vscale := float64(output.Width)/float64(size.Width), float64(output.Height)/float64(size.Height)
+		return hscale, vscale, streamSaveSuffix(outputType, opts), nil
+	}
+
+	s := &streamedImage{ctx: r.Context(), w: w, started: func() {
+		w.Header().Set(InputDimensionsHeader, formatDimensions(size))
+		w.Header().Set(OutputDimensionsHeader, formatDimensions(output))
+		setDebugHeaders(w, timings)
+		if vary != "" {
+			w.Header().Set("Vary", vary)
+		}
+		for k, v := range cacheHeaders {
+			for _, vv := range v {
+				w.Header().Add(k, vv)
+			}
+		}
+		w.Header().Set("Content-Type", GetImageMimeType(outputType))
+	}}
+	handle := registerStream(s)
+	defer unregisterStream(handle)
+	sourceHandle := registerStream(stream)
+	defer unregisterStream(sourceHandle)
+
+	committed, err := vipsStreamSource(sourceHandle, handle, accept)
+	if stream.err != nil {
+		err = stream.err
+	}
+	if !committed {
+		if replyContextError(r, w, o) {
+			return true, nil, nil, nil
+		}
+		// Only the processing cost is checked by the source image header
+		if e, ok := err.(Error); ok {
+			audit(o, r, AuditOversizedInput, e.Error())
+			ErrorReply(r, w, e, o)
+			return true, nil, nil, nil
+		}
+		return bufferSource(stream, cacheHeaders, err)
+	}
+
+	if s.written > 0 {
+		if err != nil {
+			// The response is partially written, so abort it to signal the failure to the client
+			debug("cannot stream the image: %s", err)
+			panic(http.ErrAbortHandler)
+		}
+		return true, nil, nil, nil
+	}
+	if replyContextError(r, w, o) {
+		return true, nil, nil, nil
+	}
+	if _, ok := err.(AuditError); ok {
+		auditSourceError(o, r, err)
+		ErrorReply(r, w, NewSourceError("", err), o)
+		return true, nil, nil, nil
+	}
+	if err == nil {
+		err = errors.New("empty output image")
+	}
+	ErrorReply(r, w, NewError("Error while processing the image: "+err.Error(), BadRequest), o)
+	return true, nil, nil, nil
+}
+
+// bufferSource buffers the uncommitted streamed source image, if it cannot be streamed
+func bufferSource(stream *sourceStream, cacheHeaders http.Header, err error) (bool, []byte, http.Header, error) {
+	if err != errSourceStreamFallback {
+		debug("source image streaming failed, falling back: %s", err)
+	}
+	buf, err := stream.buffer()
+	if err != nil {
+		if _, ok := err.(AuditError); !ok {
+			err = NewFetchError("Unable to create image from response body: %s", err)
+		}
+		return false, nil, nil, err
+	}
+	return false, buf, cacheHeaders, nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+func TestIsSourceStreamEligible(t *testing.T) {
+	o := ServerOptions{StreamSources: true}
+	cases := []struct {
+		url      string
+		options  ServerOptions
+		eligible bool
+	}{
+		{"/resize?width=300&height=200", o, true},
+		{"/resize?width=300&nocrop=true&type=webp", o, true},
+		{"/thumbnail?width=100&type=auto", o, true},
+		{"/resize?width=300&height=200", ServerOptions{}, false},
+		{"/resize?width=300", o, false},
+		{"/thumbnail?width=100&height=100", o, false},
+		{"/crop?width=300&height=200", o, false},
+		{"/resize?width=50%25&height=200", o, false},
+		{"/resize?width=300&height=200&flip=true", o, false},
+		{"/resize?width=300&height=200&border=10", o, false},
+		{"/resize?width=300&height=200&type=gif", o, false},
+		{"/thumbnail?height=100", o, true},
+		{"/thumbnail?height=100", ServerOptions{StreamSources: true, QualityLadder: QualityLadder{{200, 60}}}, false},
+		{"/thumbnail?width=100", ServerOptions{StreamSources: true, QualityLadder: QualityLadder{{200, 60}}}, true},
+		{"/resize?width=300&height=200&explain=true", ServerOptions{StreamSources: true, EnableExplain: true}, false},
+	}
+	for _, c := range cases {
+		if eligible := isSourceStreamEligible(httptest.NewRequest("GET", c.url, nil), c.options); eligible != c.eligible {
+			t.Errorf("Invalid source stream eligibility of %s: %t", c.url, eligible)
+		}
+	}
+}
+
+func TestIsSourceOutputStreamEligible(t *testing.T) {
+	o := ServerOptions{StreamSources: true, StreamMinSize: 1024}
+	cases := []struct {
+		url      string
+		options  ServerOptions
+		eligible bool
+	}{
+		{"/fit?width=300&height=200", o, true},
+		{"/convert?type=png", o, true},
+		{"/convert?type=auto", o, true},
+		{"/fit?width=300&height=200", ServerOptions{StreamSources: true}, false},
+		{"/fit?width=300&height=200", ServerOptions{StreamMinSize: 1024}, false},
+		{"/fit?width=300", o, false},
+		{"/fit?width=300&height=200&flip=true", o, false},
+		{"/convert?type=gif", o, false},
+		{"/convert?type=ico", o, false},
+		{"/convert?type=png&page=1", o, false},
+		{"/convert?type=png", ServerOptions{StreamSources: true, StreamMinSize: 1024, ResultCache: NewResultCache(1024)}, false},
+	}
+	for _, c := range cases {
+		if eligible := isSourceOutputStreamEligible(httptest.NewRequest("GET", c.url, nil), c.options); eligible != c.eligible {
+			t.Errorf("Invalid source output stream eligibility of %s: %t", c.url, eligible)
+		}
+	}
+}
+
+func TestSourceStream(t *testing.T) {
+	stream := newSourceStream(context.Background(), strings.NewReader("\xff\xd8\xff image"), 0)
+	if name := bimg.ImageTypeName(stream.imageType()); name != "jpeg" {
+		t.Errorf("Invalid source image type: %s", name)
+	}
+
+	chunk := make([]byte, 4)
+	stream.Read(chunk)
+	buf, err := stream.buffer()
+	if err != nil || string(buf) != "\xff\xd8\xff image" {
+		t.Errorf("The uncommitted source image should be fully buffered: %q %v", buf, err)
+	}
+
+	stream = newSourceStream(context.Background(), strings.NewReader("0123456789"), 4)
+	if _, err := ioutil.ReadAll(stream); err == nil || !strings.Contains(err.Error(), "exceeds maximum allowed 4 bytes") {
+		t.Errorf("The source image size should be limited: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	stream = newSourceStream(ctx, strings.NewReader("0123456789"), 0)
+	if _, err := stream.Read(chunk); err != context.Canceled {
+		t.Errorf("The source image read should be canceled: %v", err)
+	}
+}
+
+func TestStreamSource(t *testing.T) {
+	image, _ := ioutil.ReadAll(readFile("large.jpg"))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(image)
+	}))
+	defer ts.Close()
+
+	source := NewHttpImageSource(&SourceConfig{}).(StreamableImageSource)
+	r := httptest.NewRequest("GET", "/resize?width=300&height=200&url="+ts.URL, nil)
+	w := httptest.NewRecorder()
+	replied, buf, _, err := streamSource(w, r, source, ServerOptions{StreamSources: true})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// Falls back to the buffered source image if libvips cannot stream the source image
+	if !replied {
+		if !bytes.Equal(buf, image) {
+			t.Fatalf("Invalid buffered source image: %d bytes", len(buf))
+		}
+		return
+	}
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/jpeg" {
+		t.Fatalf("Invalid response: %d %s", w.Code, w.Body.String())
+	}
+	if err := assertSize(w.Body.Bytes(), 300, 200); err != nil {
+		t.Error(err)
+	}
+	if w.Header().Get(InputDimensionsHeader) != "1920x1080" {
+		t.Errorf("Invalid input dimensions header: %s", w.Header().Get(InputDimensionsHeader))
+	}
+}
+
+func TestStreamSourceOutput(t *testing.T) {
+	image, _ := ioutil.ReadAll(readFile("large.jpg"))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(image)))
+		w.Write(image)
+	}))
+	defer ts.Close()
+
+	source := NewHttpImageSource(&SourceConfig{}).(StreamableImageSource)
+	r := httptest.NewRequest("GET", "/fit?width=300&height=300&url="+ts.URL, nil)
+	w := httptest.NewRecorder()
+	replied, buf, _, err := streamSource(w, r, source, ServerOptions{StreamSources: true, StreamMinSize: 1024})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// Falls back to the buffered source image if libvips cannot stream the source image
+	if !replied {
+		if !bytes.Equal(buf, image) {
+			t.Fatalf("Invalid buffered source image: %d bytes", len(buf))
+		}
+		return
+	}
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/jpeg" {
+		t.Fatalf("Invalid response: %d %s", w.Code, w.Body.String())
+	}
+	if err := assertSize(w.Body.Bytes(), 300, 168); err != nil {
+		t.Error(err)
+	}
+	if w.Header().Get(InputDimensionsHeader) != "1920x1080" || w.Header().Get(InputSizeHeader) != "" || w.Header().Get(OutputSizeHeader) != "" {
+		t.Errorf("Invalid streamed response headers: %v", w.Header())
+	}
+}
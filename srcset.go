@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// maxSrcsetWidths limits the number of renditions processed by a single srcset request
+const maxSrcsetWidths = 16
+
+// DefaultSrcsetWidths is the default rendition widths ladder
+var DefaultSrcsetWidths = []int{320, 640, 960, 1280, 1920}
+
+// srcsetKeyTemplate is the default object key template of the stored srcset renditions
+const srcsetKeyTemplate = "srcset/{hash}/{width}.{ext}"
+
+// Rendition represents a processed image rendition of a srcset.
+type Rendition struct {
+	URL    string `json:"url"`
+	Key    string `json:"key,omitempty"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Type   string `json:"type"`
+	Size   int    `json:"size"`
+}
+
+// SrcsetDestination represents the S3 bucket storing the srcset renditions, whose object keys are
+// defined by the key template placeholders: {hash} (of the source image and the rendition params),
+// {width} and {ext}. The manifest URLs are the object keys relative to the base URL, if defined,
+// such as a CDN in front of the bucket, otherwise the resize endpoint URLs.
+type SrcsetDestination struct {
+	S3Endpoint   string         `json:"s3Endpoint"`
+	AWS          *AWSCredential `json:"aws"`
+	Bucket       string         `json:"bucket"`
+	Region       string         `json:"region"`
+	Key          string         `json:"key"`
+	BaseURL      string         `json:"baseURL"`
+	CacheControl string         `json:"cacheControl"`
+}
+
+// LoadSrcsetDestination loads the srcset renditions destination JSON file
+func LoadSrcsetDestination(path string) (*SrcsetDestination, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseSrcsetDestination(buf)
+}
+
+// parseSrcsetDestination parses and validates the srcset renditions destination, filling its defaults
+func parseSrcsetDestination(buf []byte) (*SrcsetDestination, error) {
+	d := &SrcsetDestination{}
+	if err := json.Unmarshal(buf, d); err != nil {
+		return nil, err
+	}
+
+	if d.Bucket == "" {
+		return nil, fmt.Errorf("missing destination bucket")
+	}
+	if d.AWS == nil {
+		d.AWS = &AWSCredential{}
+	}
+	if err := d.AWS.load(); err != nil {
+		return nil, fmt.Errorf("aws credentials: %s", err)
+	}
+	if d.Region == "" {
+		d.Region = d.AWS.Region
+	}
+	if d.Key == "" {
+		d.Key = srcsetKeyTemplate
+	}
+	if d.BaseURL != "" {
+		if u, err := url.Parse(d.BaseURL); err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid base URL: %s", d.BaseURL)
+		}
+	}
+	return d, nil
+}
+
+// store uploads the given rendition to the destination bucket as the given object key
+func (d *SrcsetDestination) store(key string, image Image) error {
+	credential := awsService(d.AWS, "s3", d.Region)
+	return putObject(s3URL(d.S3Endpoint, d.Bucket, d.Region, key).String(), &credential, image, d.CacheControl)
+}
+
+// srcsetKey returns the destination object key of the given rendition
+func srcsetKey(template, hash string, width int, ext string) string {
+	if ext == "jpeg" {
+		ext = "jpg"
+	}
+	replacer := strings.NewReplacer(
+		"{hash}", hash,
+		"{width}", strconv.Itoa(width),
+		"{ext}", ext,
+	)
+	return strings.TrimPrefix(path.Clean("/"+replacer.Replace(template)), "/")
+}
+
+// Srcset represents the srcset manifest JSON response.
+type Srcset struct {
+	Srcset     string      `json:"srcset"`
+	Renditions []Rendition `json:"renditions"`
+}
+
+// srcsetController processes all the image renditions of the requested widths,
+// or the configured widths ladder, replying with the srcset manifest.
+func srcsetController(o ServerOptions) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		widths, err := parseSrcsetWidths(r.URL.Query().Get("widths"), o.SrcsetWidths)
+		if err != nil {
+			ErrorReply(r, w, NewError(err.Error(), BadRequest), o)
+			return
+		}
+		imageController(o, SrcsetOperation(r, widths, o))(w, r)
+	}
+}
+
+// SrcsetOperation returns the operation which resizes the image into each one of the given widths.
+// Widths greater than the image width are skipped, since the image is never enlarged. Every
+// rendition is stored in the srcset destination, if defined, before replying with the manifest,
+// whatever its output format.
+func SrcsetOperation(r *http.Request, widths []int, o ServerOptions) Operation {
+	return func(buf []byte, opts ImageOptions) (Image, error) {
+		size, err := bimg.Size(buf)
+		if err != nil {
+			return Image{}, NewError("Cannot retrieve image metadata: "+err.Error(), BadRequest)
+		}
+		source := sha256.Sum256(buf)
+
+		manifest := Srcset{Renditions: []Rendition{}}
+		for i, width := range widths {
+			if width > size.Width {
+				if i > 0 {
+					break
+				}
+				width = size.Width
+			}
+
+			opts.Width = width
+			opts.Height = 0
+			image, err := Resize(buf, opts)
+			if err != nil {
+				return Image{}, err
+			}
+
+			rendition := Rendition{
+				URL:   srcsetRenditionURL(r, width, o),
+				Width: width,
+				Type:  bimg.DetermineImageTypeName(image.Body),
+				Size:  len(image.Body),
+			}
+			if size, err := bimg.Size(image.Body); err == nil {
+				rendition.Height = size.Height
+			}
+
+			if d := o.SrcsetDestination; d != nil {
+				hash := sha256.Sum256(append(source[:], srcsetRenditionQuery(r, width).Encode()...))
+				rendition.Key = srcsetKey(d.Key, hex.EncodeToString(hash[:16]), width, rendition.Type)
+				if err := d.store(rendition.Key, image); err != nil {
+					return Image{}, NewError("Cannot store the srcset rendition: "+err.Error(), BadGateway)
+				}
+				if d.BaseURL != "" {
+					rendition.URL = strings.TrimSuffix(d.BaseURL, "/") + "/" + rendition.Key
+				}
+			}
+			manifest.Renditions = append(manifest.Renditions, rendition)
+		}
+
+		candidates := make([]string, len(manifest.Renditions))
+		for i, rendition := range manifest.Renditions {
+			candidates[i] = fmt.Sprintf("%s %dw", rendition.URL, rendition.Width)
+		}
+		manifest.Srcset = strings.Join(candidates, ", ")
+
+		if r.URL.Query().Get("output") == "html" {
+			return Image{Body: []byte(srcsetHTML(manifest)), Mime: "text/html; charset=utf-8"}, nil
+		}
+
+		body, _ := json.Marshal(manifest)
+		return Image{Body: body, Mime: "application/json"}, nil
+	}
+}
+
+// srcsetRenditionQuery returns the resize endpoint params of the given rendition width,
+// preserving the original request params but the srcset ones and the URL signature.
+func srcsetRenditionQuery(r *http.Request, width int) url.Values {
+	query := url.Values{}
+	for key, values := range r.URL.Query() {
+		if key != "widths" && key != "output" && key != "sign" && key != "keyid" {
+			query[key] = values
+		}
+	}
+	query.Set("width", strconv.Itoa(width))
+	query.Del("height")
+	return query
+}
+
+// srcsetRenditionURL returns the resize endpoint URL of the given rendition width,
+// preserving the original request params and signing it, if required.
+func srcsetRenditionURL(r *http.Request, width int, o ServerOptions) string {
+	query := srcsetRenditionQuery(r, width)
+
+	path := apiRoute(r, o, "/resize")
+	if o.EnableURLSignature {
+		key := urlSignatureKeys(o).Primary()
+		query.Del("keyid")
+		if key.ID != "" {
+			query.Set("keyid", key.ID)
+		}
+		query = signURL(key.Secret, path, query)
+	}
+	return path + "?" + query.Encode()
+}
+
+func srcsetHTML(manifest Srcset) string {
+	if len(manifest.Renditions) == 0 {
+		return ""
+	}
+	largest := manifest.Renditions[len(manifest.Renditions)-1]
+	return fmt.Sprintf(`<img src="%s" srcset="%s" width="%d" height="%d" sizes="100vw">`,
+		html.EscapeString(largest.URL), html.EscapeString(manifest.Srcset), largest.Width, largest.Height)
+}
+
+// parseSrcsetWidths parses the comma separated widths, falling back to the given ladder.
+func parseSrcsetWidths(input string, ladder []int) ([]int, error) {
+	if input == "" {
+		if len(ladder) == 0 {
+			return DefaultSrcsetWidths, nil
+		}
+		return ladder, nil
+	}
+
+	widths := []int{}
+	for _, value := range strings.Split(input, ",") {
+		width, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || width <= 0 {
+			return nil, fmt.Errorf("Invalid srcset width: %s", value)
+		}
+		widths = append(widths, width)
+	}
+
+	if len(widths) > maxSrcsetWidths {
+		return nil, fmt.Errorf("Too many srcset widths, maximum is %d", maxSrcsetWidths)
+	}
+
+	sort.Ints(widths)
+	return widths, nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParseSrcsetWidths(t *testing.T) {
+	widths, err := parseSrcsetWidths("640, 320,1024", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(widths) != 3 || widths[0] != 320 || widths[2] != 1024 {
+		t.Errorf("Invalid widths: %v", widths)
+	}
+
+	if widths, _ := parseSrcsetWidths("", []int{100}); len(widths) != 1 || widths[0] != 100 {
+		t.Errorf("Invalid ladder widths: %v", widths)
+	}
+
+	for _, input := range []string{"foo", "-100", "100,,200", strings.Repeat("100,", maxSrcsetWidths) + "100"} {
+		if _, err := parseSrcsetWidths(input, nil); err == nil {
+			t.Errorf("Expected error for widths: %s", input)
+		}
+	}
+}
+
+func TestSrcset(t *testing.T) {
+	opts := ServerOptions{EnableURLSignature: true, URLSignatureKey: "4f46feebafc4b5e988f131c4ff8b5997"}
+	ts := testServer(srcsetController(opts))
+	defer ts.Close()
+
+	// large.jpg is 1920px wide
+	res, err := http.Post(ts.URL+"?widths=300,600,3000&type=webp", "image/jpeg", readFile("large.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("Invalid response status: %s", res.Status)
+	}
+
+	body, _ := ioutil.ReadAll(res.Body)
+	manifest := Srcset{}
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		t.Fatalf("Invalid srcset JSON response: %s", body)
+	}
+
+	if len(manifest.Renditions) != 2 {
+		t.Fatalf("Invalid number of renditions: %d", len(manifest.Renditions))
+	}
+	for i, width := range []int{300, 600} {
+		rendition := manifest.Renditions[i]
+		if rendition.Width != width || rendition.Height == 0 || rendition.Size == 0 || rendition.Type != "webp" {
+			t.Errorf("Invalid rendition: %#v", rendition)
+		}
+
+		u, _ := url.Parse(rendition.URL)
+		if u.Path != "/resize" || u.Query().Get("sign") == "" || u.Query().Get("widths") != "" {
+			t.Errorf("Invalid rendition URL: %s", rendition.URL)
+		}
+	}
+
+	if !strings.Contains(manifest.Srcset, " 300w, ") || !strings.HasSuffix(manifest.Srcset, " 600w") {
+		t.Errorf("Invalid srcset: %s", manifest.Srcset)
+	}
+}
+
+func TestSrcsetModeration(t *testing.T) {
+	moderator := moderatorFunc(func(buf []byte, mimeType string) (ModerationResult, error) {
+		return ModerationResult{Score: 0.9}, nil
+	})
+	ts := testServer(srcsetController(ServerOptions{Moderation: ModerationOptions{Moderator: moderator, Action: ModerationBlock}}))
+	defer ts.Close()
+
+	res, err := http.Post(ts.URL+"?widths=300", "image/jpeg", readFile("large.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden || res.Header.Get(ModerationHeader) != ModerationFlagged {
+		t.Errorf("The srcset of flagged images should be blocked: %s", res.Status)
+	}
+}
+
+func TestParseSrcsetDestination(t *testing.T) {
+	d, err := parseSrcsetDestination([]byte(`{"bucket": "renditions", "aws": {"accessKeyId": "AKID", "secretAccessKey": "secret", "region": "eu-west-1"}}`))
+	if err != nil {
+		t.Fatalf("Cannot parse the srcset destination: %s", err)
+	}
+	if d.Region != "eu-west-1" || d.Key != srcsetKeyTemplate {
+		t.Errorf("Invalid srcset destination defaults: %#v", d)
+	}
+
+	for _, input := range []string{`{}`, `{"bucket": "renditions", "baseURL": "cdn"}`, `[`} {
+		if _, err := parseSrcsetDestination([]byte(input)); err == nil {
+			t.Errorf("Expected invalid srcset destination error: %s", input)
+		}
+	}
+
+	if key := srcsetKey("/srcset/{hash}/{width}.{ext}", "abc", 320, "jpeg"); key != "srcset/abc/320.jpg" {
+		t.Errorf("Invalid srcset key: %s", key)
+	}
+}
+
+func TestSrcsetDestination(t *testing.T) {
+	stored := map[string]string{}
+	status := http.StatusOK
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" && r.Header.Get("Authorization") != "" {
+			stored[r.URL.Path] = r.Header.Get("Content-Type")
+		}
+		w.WriteHeader(status)
+	}))
+	defer storage.Close()
+
+	destination := &SrcsetDestination{
+		S3Endpoint: storage.URL,
+		AWS:        &AWSCredential{AccessKeyID: "AKID", SecretAccessKey: "secret"},
+		Bucket:     "renditions",
+		Region:     "eu-west-1",
+		Key:        srcsetKeyTemplate,
+		BaseURL:    "https://cdn.example.com/",
+	}
+	ts := testServer(srcsetController(ServerOptions{SrcsetDestination: destination}))
+	defer ts.Close()
+
+	// Both the JSON and HTML manifests store every rendition
+	for _, output := range []string{"json", "html"} {
+		stored = map[string]string{}
+		res, err := http.Post(ts.URL+"?widths=300,600&output="+output, "image/jpeg", readFile("large.jpg"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != 200 || len(stored) != 2 {
+			t.Fatalf("Invalid %s response: %s, %d renditions stored", output, res.Status, len(stored))
+		}
+		for path, mime := range stored {
+			if !strings.HasPrefix(path, "/renditions/srcset/") || mime != "image/jpeg" {
+				t.Errorf("Invalid stored rendition: %s %s", path, mime)
+			}
+			if !strings.Contains(string(body), "https://cdn.example.com"+strings.TrimPrefix(path, "/renditions")) {
+				t.Errorf("The %s manifest should point to the stored rendition: %s", output, body)
+			}
+		}
+	}
+
+	status = http.StatusForbidden
+	res, err := http.Post(ts.URL+"?widths=300", "image/jpeg", readFile("large.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadGateway {
+		t.Errorf("The storage failures should be replied with 502: %s", res.Status)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"image"
+	"math"
+)
+
+// ChannelStats represents the statistics of an image channel
+type ChannelStats struct {
+	Min       int     `json:"min"`
+	Max       int     `json:"max"`
+	Mean      float64 `json:"mean"`
+	StdDev    float64 `json:"stddev"`
+	Entropy   float64 `json:"entropy"`
+	Histogram []int   `json:"histogram"`
+}
+
+// ImageStats represents the statistics of an image: the per-channel statistics, the luma ones,
+// and the sharpness estimate, as the variance of the luma Laplacian.
+type ImageStats struct {
+	Width     int           `json:"width"`
+	Height    int           `json:"height"`
+	Red       ChannelStats  `json:"red"`
+	Green     ChannelStats  `json:"green"`
+	Blue      ChannelStats  `json:"blue"`
+	Alpha     *ChannelStats `json:"alpha,omitempty"`
+	Luma      ChannelStats  `json:"luma"`
+	Sharpness float64       `json:"sharpness"`
+}
+
+// Stats returns the image histograms and statistics as JSON, so upstream systems can flag
+// too dark or blurry uploads. The alpha channel statistics are only defined for non-opaque images.
+func Stats(buf []byte, o ImageOptions) (Image, error) {
+	image := Image{Mime: "application/json"}
+
+	canvas, err := decodeCanvas(buf)
+	if err != nil {
+		return image, NewError("Cannot decode the image: "+err.Error(), BadRequest)
+	}
+
+	body, _ := json.Marshal(imageStats(canvas))
+	image.Body = body
+	return image, nil
+}
+
+// imageStats returns the statistics of the given image
+func imageStats(canvas *image.RGBA) ImageStats {
+	size := canvas.Bounds().Size()
+	stats := ImageStats{Width: size.X, Height: size.Y}
+
+	var histograms [5][]int
+	for i := range histograms {
+		histograms[i] = make([]int, 256)
+	}
+	lumas := luma(canvas)
+	for y := 0; y < size.Y; y++ {
+		for x := 0; x < size.X; x++ {
+			p := canvas.Pix[y*canvas.Stride+x*4:]
+			for c := 0; c < 4; c++ {
+				histograms[c][p[c]]++
+			}
+			histograms[4][int(math.Min(255, lumas[y*size.X+x]+0.5))]++
+		}
+	}
+
+	stats.Red = channelStats(histograms[0])
+	stats.Green = channelStats(histograms[1])
+	stats.Blue = channelStats(histograms[2])
+	stats.Luma = channelStats(histograms[4])
+	if !canvas.Opaque() {
+		alpha := channelStats(histograms[3])
+		stats.Alpha = &alpha
+	}
+	stats.Sharpness = laplacianVariance(lumas, size.X, size.Y)
+	return stats
+}
+
+// channelStats returns the channel statistics of the given 256 values histogram, where
+// the entropy is the Shannon entropy, in bits, between 0 and 8.
+func channelStats(histogram []int) ChannelStats {
+	stats := ChannelStats{Min: -1, Histogram: histogram}
+
+	total, sum := 0, 0.0
+	for value, count := range histogram {
+		if count == 0 {
+			continue
+		}
+		if stats.Min < 0 {
+			stats.Min = value
+		}
+		stats.Max = value
+		total += count
+		sum += float64(value * count)
+	}
+	if total == 0 {
+		stats.Min = 0
+		return stats
+	}
+
+	stats.Mean = sum / float64(total)
+	variance := 0.0
+	for value, count := range histogram {
+		if count == 0 {
+			continue
+		}
+		d := float64(value) - stats.Mean
+		variance += d * d * float64(count)
+		p := float64(count) / float64(total)
+		stats.Entropy -= p * math.Log2(p)
+	}
+	stats.StdDev = math.Sqrt(variance / float64(total))
+	return stats
+}
+
+// laplacianVariance returns the variance of the 4-neighbours Laplacian of the given luma values,
+// which is low for blurry images, lacking edges, and high for sharp images.
+func laplacianVariance(lumas []float64, width, height int) float64 {
+	if width < 3 || height < 3 {
+		return 0
+	}
+
+	var sum, squares float64
+	for y := 1; y < height-1; y++ {
+		for x := 1; x < width-1; x++ {
+			i := y*width + x
+			l := lumas[i-width] + lumas[i+width] + lumas[i-1] + lumas[i+1] - 4*lumas[i]
+			sum += l
+			squares += l * l
+		}
+	}
+	n := float64((width - 2) * (height - 2))
+	mean := sum / n
+	return squares/n - mean*mean
+}
+
+// Image assessment defaults: the sharpness below which images are blurry, and the exposure
+// bounds and clipped pixels ratio beyond which images are under or overexposed.
+const (
+	assessBlurThreshold = 100
+	assessExposureLimit = 0.5
+	assessClippedRatio  = 0.5
+	assessShadowLuma    = 8
+	assessHighlightLuma = 247
+)
+
+// ImageAssessment represents the blurriness and exposure scores of an image, where the
+// exposure is the mean luma normalized between -1 (black) and 1 (white).
+type ImageAssessment struct {
+	Sharpness    float64 `json:"sharpness"`
+	Exposure     float64 `json:"exposure"`
+	Shadows      float64 `json:"shadows"`
+	Highlights   float64 `json:"highlights"`
+	Blurry       bool    `json:"blurry"`
+	Underexposed bool    `json:"underexposed"`
+	Overexposed  bool    `json:"overexposed"`
+	Usable       bool    `json:"usable"`
+}
+
+// assessImage scores the blurriness, via the luma Laplacian variance, and the exposure
+// of the given image, flagging it as blurry below the given sharpness threshold.
+func assessImage(canvas *image.RGBA, blurThreshold float64) ImageAssessment {
+	if blurThreshold == 0 {
+		blurThreshold = assessBlurThreshold
+	}
+
+	stats := imageStats(canvas)
+	assessment := ImageAssessment{
+		Sharpness: stats.Sharpness,
+		Exposure:  stats.Luma.Mean/127.5 - 1,
+	}
+
+	total := float64(stats.Width * stats.Height)
+	if total > 0 {
+		shadows, highlights := 0, 0
+		for value, count := range stats.Luma.Histogram {
+			if value <= assessShadowLuma {
+				shadows += count
+			} else if value >= assessHighlightLuma {
+				highlights += count
+			}
+		}
+		assessment.Shadows = float64(shadows) / total
+		assessment.Highlights = float64(highlights) / total
+	}
+
+	assessment.Blurry = assessment.Sharpness < blurThreshold
+	assessment.Underexposed = assessment.Exposure < -assessExposureLimit || assessment.Shadows > assessClippedRatio
+	assessment.Overexposed = assessment.Exposure > assessExposureLimit || assessment.Highlights > assessClippedRatio
+	assessment.Usable = !assessment.Blurry && !assessment.Underexposed && !assessment.Overexposed
+	return assessment
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"math"
+	"testing"
+)
+
+func TestChannelStats(t *testing.T) {
+	histogram := make([]int, 256)
+	histogram[10] = 2
+	histogram[30] = 2
+
+	stats := channelStats(histogram)
+	if stats.Min != 10 || stats.Max != 30 || stats.Mean != 20 || stats.StdDev != 10 || stats.Entropy != 1 {
+		t.Errorf("Invalid channel stats: %+v", stats)
+	}
+
+	if stats := channelStats(make([]int, 256)); stats.Min != 0 || stats.Max != 0 || stats.Entropy != 0 {
+		t.Errorf("Invalid empty channel stats: %+v", stats)
+	}
+}
+
+func TestLaplacianVariance(t *testing.T) {
+	flat := make([]float64, 16*16)
+	for i := range flat {
+		flat[i] = 100
+	}
+	if v := laplacianVariance(flat, 16, 16); v != 0 {
+		t.Errorf("Invalid flat image sharpness: %g", v)
+	}
+
+	checkers := make([]float64, 16*16)
+	for i := range checkers {
+		checkers[i] = float64(255 * ((i%16 + i/16) % 2))
+	}
+	if v := laplacianVariance(checkers, 16, 16); v <= 0 {
+		t.Errorf("Invalid sharp image sharpness: %g", v)
+	}
+}
+
+func TestImageStats(t *testing.T) {
+	canvas := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	for x := 0; x < 4; x++ {
+		canvas.SetRGBA(x, 0, color.RGBA{255, 0, 0, 255})
+		canvas.SetRGBA(x, 1, color.RGBA{0, 0, 255, 255})
+	}
+
+	stats := imageStats(canvas)
+	if stats.Red.Mean != 127.5 || stats.Green.Max != 0 || stats.Blue.Histogram[255] != 4 {
+		t.Errorf("Invalid channels stats: %+v", stats)
+	}
+	if stats.Alpha != nil {
+		t.Error("Unexpected alpha stats of an opaque image")
+	}
+	if math.Abs(stats.Luma.Mean-(0.299*255+0.114*255)/2) > 0.5 {
+		t.Errorf("Invalid luma mean: %g", stats.Luma.Mean)
+	}
+
+	canvas.SetRGBA(0, 0, color.RGBA{})
+	if stats := imageStats(canvas); stats.Alpha == nil || stats.Alpha.Min != 0 {
+		t.Errorf("Invalid alpha stats: %+v", stats.Alpha)
+	}
+}
+
+func TestStats(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+
+	image, err := Stats(buf, ImageOptions{})
+	if err != nil {
+		t.Fatalf("Cannot retrieve the image stats: %s", err)
+	}
+	if image.Mime != "application/json" {
+		t.Errorf("Invalid MIME type: %s", image.Mime)
+	}
+
+	var stats ImageStats
+	if err := json.Unmarshal(image.Body, &stats); err != nil {
+		t.Fatalf("Invalid stats: %s", err)
+	}
+	if stats.Width != 550 || stats.Height != 740 || len(stats.Luma.Histogram) != 256 || stats.Sharpness <= 0 {
+		t.Errorf("Invalid stats: %+v", stats)
+	}
+}
+
+func TestAssessImage(t *testing.T) {
+	dark := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	for i := 3; i < len(dark.Pix); i += 4 {
+		dark.Pix[i] = 255
+	}
+	assessment := assessImage(dark, 0)
+	if !assessment.Blurry || !assessment.Underexposed || assessment.Overexposed || assessment.Usable {
+		t.Errorf("Invalid dark image assessment: %+v", assessment)
+	}
+	if assessment.Exposure != -1 || assessment.Shadows != 1 {
+		t.Errorf("Invalid dark image exposure: %+v", assessment)
+	}
+
+	checkers := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x++ {
+			v := uint8(64 + 128*((x+y)%2))
+			checkers.SetRGBA(x, y, color.RGBA{v, v, v, 255})
+		}
+	}
+	assessment = assessImage(checkers, 0)
+	if assessment.Blurry || assessment.Underexposed || assessment.Overexposed || !assessment.Usable {
+		t.Errorf("Invalid sharp image assessment: %+v", assessment)
+	}
+	if assessment := assessImage(checkers, 1e9); !assessment.Blurry {
+		t.Errorf("Expected a blurry image with a high threshold: %+v", assessment)
+	}
+}
+
+func TestInfoAssessment(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+
+	image, err := Info(buf, ImageOptions{Assess: true})
+	if err != nil {
+		t.Fatalf("Cannot retrieve the image info: %s", err)
+	}
+	var info ImageInfo
+	if err := json.Unmarshal(image.Body, &info); err != nil {
+		t.Fatalf("Invalid info: %s", err)
+	}
+	if info.Assessment == nil || info.Assessment.Sharpness <= 0 {
+		t.Errorf("Invalid assessment: %+v", info.Assessment)
+	}
+
+	image, _ = Info(buf, ImageOptions{})
+	var plain ImageInfo
+	if err := json.Unmarshal(image.Body, &plain); err != nil || plain.Assessment != nil {
+		t.Error("Unexpected assessment without the assess param")
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StatsdClient implements a fire-and-forget statsd metrics emitter over UDP,
+// optionally using the DogStatsD tags extension.
+type StatsdClient struct {
+	conn      net.Conn
+	prefix    string
+	tags      []string
+	dogstatsd bool
+}
+
+// NewStatsdClient creates a new statsd client sending metrics to the given address.
+func NewStatsdClient(addr, prefix string, tags []string, dogstatsd bool) (*StatsdClient, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+	return &StatsdClient{conn: conn, prefix: prefix, tags: tags, dogstatsd: dogstatsd || len(tags) > 0}, nil
+}
+
+// Count increments the given counter metric.
+func (c *StatsdClient) Count(name string, value int64, tags ...string) {
+	c.send(name, strconv.FormatInt(value, 10), "c", tags)
+}
+
+// Timing records the given duration in milliseconds.
+func (c *StatsdClient) Timing(name string, d time.Duration, tags ...string) {
+	ms := float64(d) / float64(time.Millisecond)
+	c.send(name, strconv.FormatFloat(ms, 'f', 3, 64), "ms", tags)
+}
+
+func (c *StatsdClient) send(name, value, kind string, tags []string) {
+	var buf bytes.Buffer
+	buf.WriteString(c.prefix)
+	buf.WriteString(name)
+	buf.WriteByte(':')
+	buf.WriteString(value)
+	buf.WriteByte('|')
+	buf.WriteString(kind)
+
+	if c.dogstatsd {
+		tags = append(append([]string{}, c.tags...), tags...)
+		if len(tags) > 0 {
+			buf.WriteString("|#")
+			buf.WriteString(strings.Join(tags, ","))
+		}
+	}
+
+	// Metrics are best effort, errors are intentionally ignored
+	c.conn.Write(buf.Bytes())
+}
+
+// statusRecorder captures the response status code.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// NewStatsdHandler creates a new HTTP handler emitting the request count, latency and errors metrics.
+func NewStatsdHandler(handler http.Handler, client *StatsdClient) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		record := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		start := time.Now()
+		handler.ServeHTTP(record, r)
+		elapsed := time.Since(start)
+
+		endpoint := endpointName(r)
+		if endpoint == "" {
+			endpoint = "index"
+		}
+		tags := []string{"endpoint:" + endpoint, "status:" + strconv.Itoa(record.status)}
+
+		client.Count("requests", 1, tags...)
+		client.Timing("request.duration", elapsed, tags...)
+		if record.status >= 400 {
+			client.Count("errors", 1, tags...)
+		}
+		if !client.dogstatsd {
+			// Plain statsd has no tags support, so encode the endpoint in the metric name
+			client.Count(fmt.Sprintf("requests.%s.%d", endpoint, record.status), 1)
+			client.Timing(fmt.Sprintf("request.duration.%s", endpoint), elapsed)
+		}
+	})
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsdHandler(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	client, err := NewStatsdClient(conn.LocalAddr().String(), "imaginary", []string{"env:test"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := NewStatsdHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(400)
+	}), client)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/crop", nil))
+
+	metrics := []string{}
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for len(metrics) < 3 {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("Cannot read metrics: %s", err)
+		}
+		metrics = append(metrics, string(buf[:n]))
+	}
+
+	if metrics[0] != "imaginary.requests:1|c|#env:test,endpoint:crop,status:400" {
+		t.Errorf("Invalid request metric: %s", metrics[0])
+	}
+	if !strings.HasPrefix(metrics[1], "imaginary.request.duration:") || !strings.HasSuffix(metrics[1], "|ms|#env:test,endpoint:crop,status:400") {
+		t.Errorf("Invalid duration metric: %s", metrics[1])
+	}
+	if metrics[2] != "imaginary.errors:1|c|#env:test,endpoint:crop,status:400" {
+		t.Errorf("Invalid errors metric: %s", metrics[2])
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"sync"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// streamedImage represents an image response streamed chunk by chunk, as libvips encodes it
+type streamedImage struct {
+	ctx     context.Context
+	w       io.Writer
+	started func()
+	written int
+}
+
+var (
+	streamsMutex sync.Mutex
+	streams      = map[uintptr]interface{}{}
+	streamsSeq   uintptr
+)
+
+// registerStream registers the given streamed image or source, returning its handle passed
+// to libvips, since the Go memory cannot be referenced by C code.
+func registerStream(stream interface{}) uintptr {
+	streamsMutex.Lock()
+	defer streamsMutex.Unlock()
+	streamsSeq++
+	streams[streamsSeq] = stream
+	return streamsSeq
+}
+
+func unregisterStream(handle uintptr) {
+	streamsMutex.Lock()
+	defer streamsMutex.Unlock()
+	delete(streams, handle)
+}
+
+func lookupStream(handle uintptr) interface{} {
+	streamsMutex.Lock()
+	defer streamsMutex.Unlock()
+	return streams[handle]
+}
+
+// writeStreamChunk writes the given encoded chunk of the streamed image of the given handle,
+// writing the response headers first. It reports false to abort the encoding, if the request
+// context is done or the client went away.
+func writeStreamChunk(handle uintptr, chunk []byte) bool {
+	s, ok := lookupStream(handle).(*streamedImage)
+	if !ok || s.ctx.Err() != nil {
+		return false
+	}
+
+	if s.written == 0 {
+		s.started()
+	}
+	n, err := s.w.Write(chunk)
+	s.written += n
+	return err == nil
+}
+
+// isStreamEligible reports whether the output image of the given request can be streamed: the plain
+// fit downscales and convert requests, without any other operation, of large sources which libvips
+// can decode via sequential access, if enabled.
+func isStreamEligible(endpoint string, buf []byte, o ImageOptions, icoOutput bool, so ServerOptions) bool {
+	if so.StreamMinSize == 0 || len(buf) < so.StreamMinSize || icoOutput || !isStreamRequest(endpoint, o) {
+		return false
+	}
+	if !isStreamType(bimg.DetermineImageType(buf)) {
+		return false
+	}
+
+	// Rotating the image by its EXIF orientation requires random access
+	meta, err := bimg.Metadata(buf)
+	return err == nil && meta.Orientation <= 1
+}
+
+// isStreamRequest reports whether the given request params only define a plain fit downscale
+// or convert, whose output image can be streamed.
+func isStreamRequest(endpoint string, o ImageOptions) bool {
+	fit := endpoint == "fit" && o.Width > 0 && o.Height > 0
+	if !fit && !(endpoint == "convert" && o.Width == 0 && o.Height == 0) {
+		return false
+	}
+	if hasTransformParams(o) || len(wrapperOperations(o)) > 0 || o.Depth != 0 || o.SkipLarger || o.CropBox {
+		return false
+	}
+	return o.Type == "" || o.Type == "auto" || isStreamType(ImageType(o.Type))
+}
+
+// isStreamType reports whether libvips can decode and encode the given image type via sequential access
+func isStreamType(t bimg.ImageType) bool {
+	switch t {
+	case bimg.JPEG, bimg.PNG, bimg.WEBP, bimg.TIFF:
+		return true
+	}
+	return false
+}
+
+// streamImage streams the fit or convert output image of the given request to the response as it is
+// encoded, rather than buffering the full output image in memory. It reports whether the response was
+// started, in which case a failure can only be signaled by aborting the response.
+func streamImage(w http.ResponseWriter, r *http.Request, source, buf []byte, o ImageOptions, timings *Timings) (bool, error) {
+	size, output, outputType, ok, err := streamedOutput(buf, o)
+	if !ok {
+		return false, err
+	}
+
+	s := &streamedImage{ctx: r.Context(), w: w, started: func() {
+		// The output size is unknown until the image is fully encoded
+		setInputSavingsHeaders(w, source, buf)
+		w.Header().Set(OutputDimensionsHeader, formatDimensions(output))
+		setDebugHeaders(w, timings)
+		w.Header().Set("Content-Type", GetImageMimeType(outputType))
+	}}
+	err = encodeStreamedImage(s, buf, size, output, outputType, o)
+	return s.written > 0, err
+}
+
+// bufferStreamedImage encodes the fit or convert output image of the given request as streamImage
+// does, but into a pooled buffer, for the responses buffered anyway, such as the cached images.
+// The returned buffer, nil if the image cannot be streamed, is released once the response is written.
+func bufferStreamedImage(r *http.Request, buf []byte, o ImageOptions) (Image, *bytes.Buffer, error) {
+	size, output, outputType, ok, err := streamedOutput(buf, o)
+	if !ok {
+		return Image{}, nil, err
+	}
+
+	out := getBuffer()
+	s := &streamedImage{ctx: r.Context(), w: out, started: func() {}}
+	if err := encodeStreamedImage(s, buf, size, output, outputType, o); err != nil {
+		putBuffer(out)
+		return Image{}, nil, err
+	}
+	return Image{Body: out.Bytes(), Mime: GetImageMimeType(outputType)}, out, nil
+}
+
+// streamedOutput returns the source and output image dimensions and the output image type of the
+// given streamed image, reporting false if the image is not downscaled, since only downscales are
+// streamed, as bimg never enlarges by default.
+func streamedOutput(buf []byte, o ImageOptions) (bimg.ImageSize, bimg.ImageSize, bimg.ImageType, bool, error) {
+	size, err := bimg.Size(buf)
+	if err != nil {
+		return size, size, bimg.UNKNOWN, false, err
+	}
+
+	output := size
+	if o.Width > 0 && o.Height > 0 {
+		output.Width, output.Height = fitDimensions(size.Width, size.Height, o.Width, o.Height, o.Outside)
+	}
+	if output.Width > size.Width || output.Height > size.Height || output.Width == 0 || output.Height == 0 {
+		return size, output, bimg.UNKNOWN, false, nil
+	}
+
+	outputType := ImageType(o.Type)
+	if outputType == bimg.UNKNOWN {
+		outputType = bimg.DetermineImageType(buf)
+	}
+	return size, output, outputType, true, nil
+}
+
+// encodeStreamedImage encodes the given image, resized to the given output dimensions, to the given
+// streamed image, chunk by chunk.
+func encodeStreamedImage(s *streamedImage, buf []byte, size, output bimg.ImageSize, outputType bimg.ImageType, o ImageOptions) error {
+	handle := registerStream(s)
+	defer unregisterStream(handle)
+
+	hscale, vscale := float64(output.Width)/float64(size.Width), float64(output.Height)/float64(size.Height)
+	return vipsStream(buf, hscale, vscale, streamSaveSuffix(outputType, o), handle)
+}
+
+// streamSaveSuffix returns the libvips save suffix of the given streamed output image type
+func streamSaveSuffix(t bimg.ImageType, o ImageOptions) string {
+	if t != bimg.TIFF {
+		return thumbnailSaveSuffix(t, o)
+	}
+	if o.StripMetadata {
+		return ".tif[strip]"
+	}
+	return ".tif"
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+func TestIsStreamEligible(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("large.jpg"))
+	o := ServerOptions{StreamMinSize: 1024}
+
+	cases := []struct {
+		endpoint string
+		options  ImageOptions
+		ico      bool
+		server   ServerOptions
+		eligible bool
+	}{
+		{"fit", ImageOptions{Width: 300, Height: 300}, false, o, true},
+		{"convert", ImageOptions{Type: "png"}, false, o, true},
+		{"fit", ImageOptions{Width: 300, Height: 300}, false, ServerOptions{}, false},
+		{"fit", ImageOptions{Width: 300, Height: 300}, false, ServerOptions{StreamMinSize: len(buf) + 1}, false},
+		{"fit", ImageOptions{Width: 300}, false, o, false},
+		{"convert", ImageOptions{Type: "png", Width: 300}, false, o, false},
+		{"resize", ImageOptions{Width: 300, Height: 300}, false, o, false},
+		{"fit", ImageOptions{Width: 300, Height: 300, Flip: true}, false, o, false},
+		{"fit", ImageOptions{Width: 300, Height: 300, Border: "10"}, false, o, false},
+		{"convert", ImageOptions{Type: "gif"}, false, o, false},
+		{"convert", ImageOptions{Type: "png"}, true, o, false},
+	}
+	for _, c := range cases {
+		if eligible := isStreamEligible(c.endpoint, buf, c.options, c.ico, c.server); eligible != c.eligible {
+			t.Errorf("Invalid stream eligibility of %s %#v: %t", c.endpoint, c.options, eligible)
+		}
+	}
+}
+
+func TestStreamSaveSuffix(t *testing.T) {
+	if suffix := streamSaveSuffix(bimg.TIFF, ImageOptions{StripMetadata: true}); suffix != ".tif[strip]" {
+		t.Errorf("Invalid TIFF save suffix: %s", suffix)
+	}
+	if suffix := streamSaveSuffix(bimg.JPEG, ImageOptions{Quality: 70}); suffix != ".jpg[Q=70]" {
+		t.Errorf("Invalid JPEG save suffix: %s", suffix)
+	}
+}
+
+func TestStreamImage(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("large.jpg"))
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/fit?width=300&height=300&type=png", nil)
+
+	// Falls back to the buffered processing if libvips cannot stream the image
+	imageHandler(w, r, buf, Fit, ServerOptions{StreamMinSize: 1024}, nil)
+
+	if w.Code != 200 || w.Header().Get("Content-Type") != "image/png" {
+		t.Fatalf("Invalid response: %d %s", w.Code, w.Body.String())
+	}
+	if err := assertSize(w.Body.Bytes(), 300, 168); err != nil {
+		t.Error(err)
+	}
+	if w.Header().Get(InputSizeHeader) == "" || w.Header().Get(OutputDimensionsHeader) == "" {
+		t.Errorf("Missing savings headers: %v", w.Header())
+	}
+}
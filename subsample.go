@@ -0,0 +1,93 @@
+package main
+
+import (
+	"image"
+	"math"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// Chroma subsampling modes
+const (
+	Subsample444  = "444"
+	Subsample420  = "420"
+	SubsampleAuto = "auto"
+)
+
+// Fine chroma detail detection thresholds: the chroma deviation within 2x2 pixels blocks,
+// which 4:2:0 subsampling averages, and the fraction of blocks exceeding it.
+const (
+	chromaDeviation = 24
+	chromaBlocks    = 0.02
+)
+
+// Subsample wraps the given operation, encoding its JPEG output with the given chroma
+// subsampling mode: 4:4:4 preserves the colored text and line art that 4:2:0 degrades,
+// while auto selects 4:4:4 only if the image has fine colored details.
+func Subsample(operation Operation) Operation {
+	return func(buf []byte, o ImageOptions) (Image, error) {
+		switch o.Subsample {
+		case Subsample444, Subsample420, SubsampleAuto:
+		default:
+			return Image{}, NewError("Invalid subsample mode: "+o.Subsample, BadRequest)
+		}
+		if o.Subsample == Subsample420 || outputOptions(buf, o).Type != bimg.JPEG {
+			return operation(buf, o)
+		}
+
+		reference, err := losslessOutput(operation, buf, o)
+		if err != nil || reference.Mime != "image/png" {
+			return reference, err
+		}
+
+		if o.Subsample == SubsampleAuto {
+			canvas, err := decodeCanvas(reference.Body)
+			if err != nil {
+				return Image{}, err
+			}
+			o.Subsample = Subsample420
+			if hasFineChroma(canvas) {
+				o.Subsample = Subsample444
+			}
+		}
+
+		body, err := vipsEncode(reference.Body, thumbnailSaveSuffix(bimg.JPEG, o))
+		if err != nil {
+			return Image{}, err
+		}
+		return Image{Body: body, Mime: "image/jpeg"}, nil
+	}
+}
+
+// hasFineChroma reports whether the given image has fine colored details, such as colored
+// text or line art, by the chroma deviation within a grid of sampled 2x2 pixels blocks.
+func hasFineChroma(canvas *image.RGBA) bool {
+	size := canvas.Bounds().Size()
+	step := 2 * int(math.Max(1, math.Ceil(float64(size.X*size.Y)/(4*smartSamples*smartSamples))))
+
+	blocks, detailed := 0, 0
+	for y := 0; y+1 < size.Y; y += step {
+		for x := 0; x+1 < size.X; x += step {
+			var cb, cr [4]float64
+			var mb, mr float64
+			for i := 0; i < 4; i++ {
+				p := canvas.Pix[(y+i/2)*canvas.Stride+(x+i%2)*4:]
+				r, g, b := float64(p[0]), float64(p[1]), float64(p[2])
+				cb[i] = -0.168736*r - 0.331264*g + 0.5*b
+				cr[i] = 0.5*r - 0.418688*g - 0.081312*b
+				mb += cb[i] / 4
+				mr += cr[i] / 4
+			}
+
+			deviation := 0.0
+			for i := 0; i < 4; i++ {
+				deviation = math.Max(deviation, math.Max(math.Abs(cb[i]-mb), math.Abs(cr[i]-mr)))
+			}
+			if deviation > chromaDeviation {
+				detailed++
+			}
+			blocks++
+		}
+	}
+	return blocks > 0 && float64(detailed)/float64(blocks) > chromaBlocks
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io/ioutil"
+	"testing"
+)
+
+// jpegLumaSampling returns the sampling factors of the first JPEG frame component
+func jpegLumaSampling(buf []byte) byte {
+	for i := 2; i+11 < len(buf); i++ {
+		if buf[i] == 0xFF && (buf[i+1] == 0xC0 || buf[i+1] == 0xC2) {
+			return buf[i+11]
+		}
+	}
+	return 0
+}
+
+func TestHasFineChroma(t *testing.T) {
+	flat := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	draw.Draw(flat, flat.Bounds(), image.NewUniform(color.RGBA{200, 40, 40, 255}), image.ZP, draw.Src)
+	if hasFineChroma(flat) {
+		t.Error("Unexpected fine chroma details of a flat image")
+	}
+
+	lines := copyCanvas(flat)
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x += 2 {
+			lines.Set(x, y, color.RGBA{40, 40, 200, 255})
+		}
+	}
+	if !hasFineChroma(lines) {
+		t.Error("Expected fine chroma details of colored lines")
+	}
+}
+
+func TestSubsample(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+
+	image, err := Subsample(Resize)(buf, ImageOptions{Width: 300, Height: 200, Type: "jpeg", Subsample: "444"})
+	if err != nil {
+		t.Fatalf("Cannot encode the image: %s", err)
+	}
+	if sampling := jpegLumaSampling(image.Body); sampling != 0x11 {
+		t.Errorf("Invalid 4:4:4 sampling factors: %#x", sampling)
+	}
+	if err := assertSize(image.Body, 300, 200); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := Subsample(Resize)(buf, ImageOptions{Width: 300, Type: "jpeg", Subsample: "422"}); err == nil {
+		t.Error("Expected an error with an invalid subsample mode")
+	}
+}
+
+func TestSubsampleAuto(t *testing.T) {
+	lines := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			lines.Set(x, y, color.RGBA{uint8(200 - 160*(x%2)), 40, uint8(40 + 160*(x%2)), 255})
+		}
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, lines)
+
+	image, err := Subsample(Convert)(buf.Bytes(), ImageOptions{Type: "jpeg", Subsample: "auto"})
+	if err != nil {
+		t.Fatalf("Cannot encode the image: %s", err)
+	}
+	if sampling := jpegLumaSampling(image.Body); sampling != 0x11 {
+		t.Errorf("Invalid auto sampling factors: %#x", sampling)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// surrogateKeyHeaders are the CDN cache tag response headers: Fastly reads the
+// Surrogate-Key header, while Cloudflare reads the Cache-Tag one.
+var surrogateKeyHeaders = []string{"Surrogate-Key", "Cache-Tag"}
+
+// SurrogateKey returns the CDN cache tag shared by every image processed from the given
+// source image URL or mounted file path, so all of its derivatives can be purged at once
+// when the original image changes. The tag is the prefixed hex SHA-256 digest prefix
+// of the source image host and path, ignoring the URL scheme, query and fragment.
+func SurrogateKey(source, prefix string) string {
+	if u, err := url.Parse(source); err == nil && u.Host != "" {
+		source = strings.ToLower(u.Host) + u.EscapedPath()
+	} else {
+		source = "file:" + path.Clean("/"+source)
+	}
+	digest := sha256.Sum256([]byte(source))
+	return prefix + hex.EncodeToString(digest[:8])
+}
+
+// requestSurrogateKey returns the surrogate key of the given request source image, if any.
+// Images sent in the request body have no surrogate key.
+func requestSurrogateKey(r *http.Request, o ServerOptions) string {
+	query := r.URL.Query()
+	if source := query.Get("url"); source != "" {
+		return SurrogateKey(source, o.SurrogateKeyPrefix)
+	}
+	if source := query.Get("file"); source != "" {
+		return SurrogateKey(source, o.SurrogateKeyPrefix)
+	}
+	return ""
+}
+
+// setSurrogateKeyHeaders sets the CDN cache tag headers of the given request, if enabled
+func setSurrogateKeyHeaders(w http.ResponseWriter, r *http.Request, o ServerOptions) {
+	if !o.SurrogateKeys {
+		return
+	}
+	if key := requestSurrogateKey(r, o); key != "" {
+		for _, header := range surrogateKeyHeaders {
+			w.Header().Set(header, key)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSurrogateKey(t *testing.T) {
+	key := SurrogateKey("https://cdn.example.com/photos/cat.jpg", "")
+	if len(key) != 16 {
+		t.Fatalf("Invalid surrogate key length: %s", key)
+	}
+
+	same := []string{
+		"http://cdn.example.com/photos/cat.jpg",
+		"https://CDN.example.com/photos/cat.jpg?token=abc#top",
+	}
+	for _, source := range same {
+		if value := SurrogateKey(source, ""); value != key {
+			t.Errorf("Surrogate key of %s should match: %s != %s", source, value, key)
+		}
+	}
+
+	different := []string{
+		"https://cdn.example.com/photos/dog.jpg",
+		"https://example.com/photos/cat.jpg",
+		"photos/cat.jpg",
+	}
+	for _, source := range different {
+		if value := SurrogateKey(source, ""); value == key {
+			t.Errorf("Surrogate key of %s should not match: %s", source, value)
+		}
+	}
+
+	if SurrogateKey("photos/cat.jpg", "") != SurrogateKey("/photos/../photos/cat.jpg", "") {
+		t.Error("Surrogate key of mounted files should match the clean path")
+	}
+	if value := SurrogateKey("photos/cat.jpg", "shop-"); !strings.HasPrefix(value, "shop-") {
+		t.Errorf("Surrogate key should be prefixed: %s", value)
+	}
+}
+
+func TestSetSurrogateKeyHeaders(t *testing.T) {
+	o := ServerOptions{SurrogateKeys: true, SurrogateKeyPrefix: "img-"}
+	expected := SurrogateKey("http://cdn.example.com/cat.jpg", "img-")
+
+	w := httptest.NewRecorder()
+	setSurrogateKeyHeaders(w, httptest.NewRequest("GET", "/resize?width=100&url=http://cdn.example.com/cat.jpg", nil), o)
+	for _, header := range surrogateKeyHeaders {
+		if value := w.Header().Get(header); value != expected {
+			t.Errorf("Invalid %s header: %s", header, value)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	setSurrogateKeyHeaders(w, httptest.NewRequest("POST", "/resize?width=100", nil), o)
+	if value := w.Header().Get("Surrogate-Key"); value != "" {
+		t.Errorf("Unexpected surrogate key of body images: %s", value)
+	}
+
+	w = httptest.NewRecorder()
+	setSurrogateKeyHeaders(w, httptest.NewRequest("GET", "/resize?file=cat.jpg", nil), ServerOptions{})
+	if value := w.Header().Get("Surrogate-Key"); value != "" {
+		t.Errorf("Unexpected surrogate key if disabled: %s", value)
+	}
+}
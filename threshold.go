@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// BypassHeader is the response header of the source images replied unchanged instead of the
+// processed ones, whose value is the reason: "threshold" or "larger-output"
+const BypassHeader = "X-Imaginary-Bypass"
+
+// thresholdEndpoints are the image endpoints only shrinking the image to the requested dimensions,
+// which reply with the source image unchanged if the threshold param is defined and the source
+// image is already within the requested dimensions and bytes.
+var thresholdEndpoints = map[string]bool{
+	"resize":    true,
+	"fit":       true,
+	"thumbnail": true,
+	"crop":      true,
+	"smartcrop": true,
+}
+
+// thresholdJPEGMarkers are the JPEG metadata segments stripped from the source images replied
+// unchanged: the EXIF and XMP (APP1), the IPTC (APP13) and the comment ones. The ICC color
+// profile (APP2) is kept, so the colors are preserved.
+var thresholdJPEGMarkers = map[byte]bool{0xE1: true, 0xED: true, 0xFE: true}
+
+// thresholdPNGChunks are the PNG metadata chunks stripped from the source images replied unchanged
+var thresholdPNGChunks = map[string]bool{"tEXt": true, "zTXt": true, "iTXt": true, "eXIf": true, "tIME": true}
+
+var errMalformedImage = errors.New("malformed image")
+
+// thresholdImage returns the given source image, if the threshold param is defined and the source
+// image is already within the requested dimensions and bytes, preserving its type and orientation,
+// so it is not uselessly re-encoded. The metadata of the JPEG and PNG images is stripped without
+// re-encoding, if requested, while any other processing param requires processing the image.
+func thresholdImage(endpoint string, buf []byte, o ImageOptions) (Image, bool) {
+	if !o.Threshold || !thresholdEndpoints[endpoint] || o.Width == 0 && o.Height == 0 && o.MaxBytes == 0 {
+		return Image{}, false
+	}
+	if hasTransformParams(o) || len(o.Operations) > 0 || o.Depth != 0 || o.CropBox || o.Page != nil || o.Density != 0 {
+		return Image{}, false
+	}
+	// The encoding wrappers only apply to the processed images
+	for _, name := range wrapperOperations(o) {
+		switch name {
+		case "webp", "subsample", "autoquality", "maxbytes":
+		default:
+			return Image{}, false
+		}
+	}
+
+	imageType := bimg.DetermineImageType(buf)
+	if o.Type != "" && ImageType(o.Type) != imageType {
+		return Image{}, false
+	}
+	if o.MaxBytes > 0 && len(buf) > o.MaxBytes {
+		return Image{}, false
+	}
+	meta, err := bimg.Metadata(buf)
+	if err != nil || meta.Orientation > 1 {
+		return Image{}, false
+	}
+	if o.Width > 0 && meta.Size.Width > o.Width || o.Height > 0 && meta.Size.Height > o.Height {
+		return Image{}, false
+	}
+
+	if o.StripMetadata {
+		switch imageType {
+		case bimg.JPEG:
+			buf, err = stripJPEGMetadata(buf)
+		case bimg.PNG:
+			buf, err = stripPNGMetadata(buf)
+		default:
+			return Image{}, false
+		}
+		if err != nil {
+			return Image{}, false
+		}
+	}
+	return Image{Body: buf, Mime: GetImageMimeType(imageType)}, true
+}
+
+// stripJPEGMetadata removes the metadata segments of the given JPEG image, copying the rest of
+// the image, from the start of the compressed scan data, as is.
+func stripJPEGMetadata(buf []byte) ([]byte, error) {
+	if len(buf) < 4 || buf[0] != 0xFF || buf[1] != 0xD8 {
+		return nil, errMalformedImage
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(buf)))
+	out.Write(buf[:2])
+	for i := 2; i+4 <= len(buf); {
+		if buf[i] != 0xFF {
+			return nil, errMalformedImage
+		}
+		marker := buf[i+1]
+		if marker == 0xDA {
+			out.Write(buf[i:])
+			return out.Bytes(), nil
+		}
+		end := i + 2 + int(binary.BigEndian.Uint16(buf[i+2:]))
+		if end > len(buf) {
+			return nil, errMalformedImage
+		}
+		if !thresholdJPEGMarkers[marker] {
+			out.Write(buf[i:end])
+		}
+		i = end
+	}
+	return nil, errMalformedImage
+}
+
+// stripPNGMetadata removes the textual, EXIF and modification time chunks of the given PNG image
+func stripPNGMetadata(buf []byte) ([]byte, error) {
+	if len(buf) < 8 || !bytes.Equal(buf[:8], []byte("\x89PNG\r\n\x1a\n")) {
+		return nil, errMalformedImage
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(buf)))
+	out.Write(buf[:8])
+	for i := 8; i < len(buf); {
+		if i+12 > len(buf) {
+			return nil, errMalformedImage
+		}
+		end := i + 12 + int(binary.BigEndian.Uint32(buf[i:]))
+		if end > len(buf) || end < i {
+			return nil, errMalformedImage
+		}
+		if !thresholdPNGChunks[string(buf[i+4:i+8])] {
+			out.Write(buf[i:end])
+		}
+		i = end
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestThresholdImage(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("large.jpg"))
+	cases := []struct {
+		endpoint string
+		options  ImageOptions
+		bypassed bool
+	}{
+		{"resize", ImageOptions{Threshold: true, Width: 2000}, true},
+		{"fit", ImageOptions{Threshold: true, Width: 1920, Height: 1080}, true},
+		{"resize", ImageOptions{Threshold: true, Width: 2000, Type: "jpeg", Quality: 60}, true},
+		{"resize", ImageOptions{Threshold: true, Width: 2000, MaxBytes: len(buf)}, true},
+		{"resize", ImageOptions{Threshold: true, Width: 2000, StripMetadata: true}, true},
+		{"resize", ImageOptions{Width: 2000}, false},
+		{"resize", ImageOptions{Threshold: true}, false},
+		{"resize", ImageOptions{Threshold: true, Width: 1000}, false},
+		{"fit", ImageOptions{Threshold: true, Width: 2000, Height: 1000}, false},
+		{"resize", ImageOptions{Threshold: true, Width: 2000, Type: "webp"}, false},
+		{"resize", ImageOptions{Threshold: true, Width: 2000, MaxBytes: len(buf) - 1}, false},
+		{"resize", ImageOptions{Threshold: true, Width: 2000, Flip: true}, false},
+		{"resize", ImageOptions{Threshold: true, Width: 2000, Border: "10"}, false},
+		{"rotate", ImageOptions{Threshold: true, Width: 2000}, false},
+	}
+	for _, c := range cases {
+		image, bypassed := thresholdImage(c.endpoint, buf, c.options)
+		if bypassed != c.bypassed {
+			t.Errorf("Invalid threshold of %s %#v: %t", c.endpoint, c.options, bypassed)
+		}
+		if bypassed && image.Mime != "image/jpeg" {
+			t.Errorf("Invalid threshold image type: %s", image.Mime)
+		}
+	}
+}
+
+func TestStripJPEGMetadata(t *testing.T) {
+	jpeg := []byte("\xff\xd8" +
+		"\xff\xe0\x00\x06JFIF" +
+		"\xff\xe1\x00\x06Exif" +
+		"\xff\xe2\x00\x05ICC" +
+		"\xff\xfe\x00\x05com" +
+		"\xff\xda\x00\x02scan\xff\xd9")
+	stripped, err := stripJPEGMetadata(jpeg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := "\xff\xd8\xff\xe0\x00\x06JFIF\xff\xe2\x00\x05ICC\xff\xda\x00\x02scan\xff\xd9"
+	if string(stripped) != expected {
+		t.Errorf("Invalid stripped JPEG image: %q", stripped)
+	}
+
+	if _, err := stripJPEGMetadata(jpeg[:12]); err == nil {
+		t.Error("Expected an error with a truncated JPEG image")
+	}
+}
+
+func TestStripPNGMetadata(t *testing.T) {
+	chunk := func(name, data string) string {
+		return "\x00\x00\x00" + string(rune(len(data))) + name + data + "crc!"
+	}
+	png := "\x89PNG\r\n\x1a\n" + chunk("IHDR", "header") + chunk("tEXt", "comment") + chunk("IDAT", "data") + chunk("IEND", "")
+	stripped, err := stripPNGMetadata([]byte(png))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := "\x89PNG\r\n\x1a\n" + chunk("IHDR", "header") + chunk("IDAT", "data") + chunk("IEND", "")
+	if string(stripped) != expected {
+		t.Errorf("Invalid stripped PNG image: %q", stripped)
+	}
+
+	if _, err := stripPNGMetadata([]byte(png[:20])); err == nil {
+		t.Error("Expected an error with a truncated PNG image")
+	}
+}
+
+func TestThreshold(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("large.jpg"))
+	ts := testServer(controller(Resize))
+	defer ts.Close()
+
+	res, err := http.Post(ts.URL+"?width=2000&threshold=true", "image/jpeg", bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	if res.StatusCode != 200 {
+		t.Fatalf("Invalid response status: %s", res.Status)
+	}
+	if res.Header.Get(BypassHeader) != "threshold" {
+		t.Errorf("Invalid bypass header: %s", res.Header.Get(BypassHeader))
+	}
+	image, _ := ioutil.ReadAll(res.Body)
+	if !bytes.Equal(image, buf) {
+		t.Error("Expected the source image")
+	}
+
+	res, err = http.Post(ts.URL+"?width=300&threshold=true", "image/jpeg", bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal("Cannot perform the request")
+	}
+	if res.Header.Get(BypassHeader) != "" {
+		t.Errorf("The larger source images should be processed: %s", res.Header.Get(BypassHeader))
+	}
+	image, _ = ioutil.ReadAll(res.Body)
+	if res.StatusCode != 200 || bytes.Equal(image, buf) {
+		t.Errorf("Invalid processed image response: %s", res.Status)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// thumbnailFastPath tries to process plain downscale requests via vips_thumbnail,
+// which uses shrink-on-load for JPEG and WebP sources instead of decoding
+// the full image and resizing it afterwards.
+// It returns false if the request is not eligible, in which case the regular
+// processing must be used.
+func thumbnailFastPath(buf []byte, o ImageOptions, crop bool) (Image, bool) {
+	if !isThumbnailFastPathEligible(buf, o, crop) {
+		return Image{}, false
+	}
+
+	outputType := ImageType(o.Type)
+	if outputType == bimg.UNKNOWN {
+		outputType = bimg.DetermineImageType(buf)
+	}
+
+	body, err := vipsThumbnail(buf, o.Width, o.Height, crop, thumbnailSaveSuffix(outputType, o))
+	if err != nil {
+		debug("thumbnail fast path failed, falling back: %s", err)
+		return Image{}, false
+	}
+
+	return Image{Body: body, Mime: GetImageMimeType(outputType)}, true
+}
+
+// resizeCrop reports whether the resize request crops the image to the output size, which
+// requires both dimensions, since a single dimension only scales the image proportionally.
+func resizeCrop(o ImageOptions) bool {
+	return !o.NoCrop && o.Width > 0 && o.Height > 0
+}
+
+// hasTransformParams reports whether any param other than the output size, type and encoding is defined.
+// The params of the operations wrapping the endpoint operation, such as denoise or maxbytes, and the
+// params resolved before running it, such as page or ar, are not transform params. The unset colorspace
+// is sRGB, as bimg defaults it.
+func hasTransformParams(o ImageOptions) bool {
+	return o.AreaWidth != 0 || o.AreaHeight != 0 || o.Top != 0 || o.Left != 0 || o.Margin != 0 ||
+		o.Rotate != 0 || o.Factor != 0 || o.DPI != 0 || o.TextWidth != 0 ||
+		o.Flip || o.Flop || o.Force || o.Embed || o.Outside || o.NoReplicate || o.NoRotation || o.NoProfile ||
+		o.Opacity != 0 || o.Sigma != 0 || o.MinAmpl != 0 || o.Text != "" || o.Font != "" ||
+		len(o.Color) > 0 || len(o.Background) > 0 || o.Extend != bimg.ExtendBlack ||
+		o.Gravity != bimg.GravityCentre || o.Colorspace != 0 && o.Colorspace != bimg.InterpretationSRGB ||
+		o.Position != "" || o.QRLevel != "" || o.Grid != "" || o.Gap != 0 ||
+		o.Image != "" || o.Blend != "" || o.Scale != 0 || o.ScaleBy != "" || o.OverlayMin != 0 || o.OverlayMax != 0 ||
+		o.Tile || o.TileSpacing != 0 || o.TileAngle != 0 || o.Shape != "" || o.Direction != "" || o.Radius != 0 ||
+		o.ShadowX != 0 || o.ShadowY != 0 || o.Pixelate != 0 || o.Levels != 0 || o.Dither != "" ||
+		o.Channels != "" || o.Alpha != "" || o.Matrix != "" || o.Corners != "" || o.SkewX != 0 || o.SkewY != 0 ||
+		o.Format != "" || o.Diff || o.Assess || o.BlurThreshold != 0
+}
+
+func isThumbnailFastPathEligible(buf []byte, o ImageOptions, crop bool) bool {
+	// Any param other than the output size, type and quality requires the full pipeline
+	if hasTransformParams(o) {
+		return false
+	}
+
+	// Crop requires both dimensions, otherwise exactly one must be defined
+	if crop && (o.Width == 0 || o.Height == 0) {
+		return false
+	}
+	if !crop && (o.Width > 0) == (o.Height > 0) {
+		return false
+	}
+
+	switch bimg.DetermineImageType(buf) {
+	case bimg.JPEG, bimg.WEBP, bimg.PNG:
+	default:
+		return false
+	}
+
+	switch ImageType(o.Type) {
+	case bimg.UNKNOWN, bimg.JPEG, bimg.WEBP, bimg.PNG:
+	default:
+		return false
+	}
+
+	// Only downscales are handled, since bimg never enlarges by default
+	meta, err := bimg.Metadata(buf)
+	if err != nil {
+		return false
+	}
+	width, height := meta.Size.Width, meta.Size.Height
+	if meta.Orientation >= 5 {
+		width, height = height, width
+	}
+	return width >= o.Width && height >= o.Height
+}
+
+func thumbnailSaveSuffix(t bimg.ImageType, o ImageOptions) string {
+	strip := ""
+	if o.StripMetadata {
+		strip = ",strip"
+	}
+
+	quality := o.Quality
+	if quality == 0 {
+		quality = bimg.Quality
+	}
+
+	switch t {
+	case bimg.PNG:
+		compression := o.Compression
+		if compression == 0 {
+			compression = 6
+		}
+		if o.Interlace {
+			strip += ",interlace"
+		}
+		return fmt.Sprintf(".png[compression=%d%s]", compression, strip)
+	case bimg.WEBP:
+		if o.Lossless {
+			strip += ",lossless"
+		}
+		return fmt.Sprintf(".webp[Q=%d%s]", quality, strip)
+	}
+	if o.Interlace {
+		strip += ",interlace"
+	}
+	if o.Subsample == Subsample444 {
+		strip += ",no_subsample"
+	}
+	return fmt.Sprintf(".jpg[Q=%d%s]", quality, strip)
+}
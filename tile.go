@@ -0,0 +1,131 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// Tiled text watermark defaults, matching the bimg text watermark ones
+const (
+	tileFont    = "sans 10"
+	tileOpacity = 0.25
+)
+
+// checkTile validates the watermark tiling params
+func checkTile(o ImageOptions) error {
+	if o.TileSpacing < 0 {
+		return NewError("Invalid tilespacing param, must be a positive number", BadRequest)
+	}
+	if math.IsNaN(o.TileAngle) || math.IsInf(o.TileAngle, 0) {
+		return NewError("Invalid tileangle param", BadRequest)
+	}
+	return nil
+}
+
+// rotateTile rotates the given tile clockwise by the given angle in degrees,
+// fitting the output to the rotated tile bounds over a transparent background.
+func rotateTile(tile *image.RGBA, angle float64) (*image.RGBA, error) {
+	if math.Mod(angle, 360) == 0 {
+		return tile, nil
+	}
+	rad := angle * math.Pi / 180
+	sin, cos := math.Sin(rad), math.Cos(rad)
+	return affineImage(tile, []float64{cos, -sin, sin, cos, 0, 0}, true, color.RGBA{})
+}
+
+// tileImage repeats the overlay across the whole canvas, separated by the given spacing
+// in pixels and shifting every other row by half a tile, blending it with the given
+// blend mode and opacity.
+func tileImage(canvas *image.RGBA, overlay *image.RGBA, spacing int, blend blendFunc, opacity float64) {
+	size := overlay.Bounds().Size()
+	if size.X == 0 || size.Y == 0 {
+		return
+	}
+	stepX, stepY := size.X+spacing, size.Y+spacing
+	bounds := canvas.Bounds()
+
+	for row, y := 0, bounds.Min.Y+spacing/2; y < bounds.Max.Y; row, y = row+1, y+stepY {
+		x := bounds.Min.X + spacing/2
+		if row%2 == 1 {
+			x -= stepX / 2
+		}
+		for ; x < bounds.Max.X; x += stepX {
+			compositeImage(canvas, overlay, image.Pt(x, y), blend, opacity)
+		}
+	}
+}
+
+// tileOverlay rotates the overlay by the tileangle and repeats it across the whole canvas.
+func tileOverlay(canvas *image.RGBA, overlay image.Image, o ImageOptions, blend blendFunc, opacity float64) error {
+	tile := image.NewRGBA(overlay.Bounds().Sub(overlay.Bounds().Min))
+	draw.Draw(tile, tile.Bounds(), overlay, overlay.Bounds().Min, draw.Src)
+
+	tile, err := rotateTile(tile, o.TileAngle)
+	if err != nil {
+		return err
+	}
+	tileImage(canvas, tile, o.TileSpacing, blend, opacity)
+	return nil
+}
+
+// tileWatermark renders the text watermark rotated by the tileangle and repeated across
+// the whole image, instead of the bimg text watermark replication.
+func tileWatermark(buf []byte, o ImageOptions) (Image, error) {
+	if err := checkTile(o); err != nil {
+		return Image{}, err
+	}
+
+	opts := BimgOptions(o)
+	opts.Type = bimg.PNG
+	processed, err := Process(buf, opts)
+	if err != nil {
+		return Image{}, err
+	}
+	canvas, err := decodeCanvas(processed.Body)
+	if err != nil {
+		return Image{}, err
+	}
+
+	opacity := float64(o.Opacity)
+	if opacity == 0 {
+		opacity = tileOpacity
+	}
+	text, err := textTile(canvas.Bounds().Dx(), o)
+	if err != nil {
+		return Image{}, err
+	}
+	if err := tileOverlay(canvas, text, o, blendModes[BlendNormal], opacity); err != nil {
+		return Image{}, err
+	}
+
+	return encodeCanvas(canvas, outputOptions(buf, o))
+}
+
+// textTile renders the watermark text in the given color, wrapped within the textwidth,
+// or a sixth of the image width, as the bimg text watermark does.
+func textTile(width int, o ImageOptions) (*image.RGBA, error) {
+	font, textWidth := o.Font, o.TextWidth
+	if font == "" {
+		font = tileFont
+	}
+	if textWidth == 0 {
+		textWidth = width / 6
+	}
+
+	mask, err := vipsTextMask(o.Text, font, textWidth, textAlignCentre)
+	if err != nil {
+		return nil, err
+	}
+
+	fg := color.RGBA{A: 0xff}
+	if len(o.Color) > 2 {
+		fg = color.RGBA{o.Color[0], o.Color[1], o.Color[2], 0xff}
+	}
+	tile := image.NewRGBA(mask.Bounds().Sub(mask.Bounds().Min))
+	drawMask(tile, mask, fg, 0, 0)
+	return tile, nil
+}
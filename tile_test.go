@@ -0,0 +1,69 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"io/ioutil"
+	"testing"
+)
+
+func TestRotateTile(t *testing.T) {
+	tile := newCanvas(40, 20, color.RGBA{0xff, 0, 0, 0xff}, color.RGBA{0xff, 0, 0, 0xff})
+
+	rotated, err := rotateTile(tile, 90)
+	if err != nil {
+		t.Fatalf("Cannot rotate the tile: %s", err)
+	}
+	if size := rotated.Bounds().Size(); size.X != 20 || size.Y != 40 {
+		t.Errorf("Invalid rotated tile size: %v", size)
+	}
+
+	rotated, _ = rotateTile(tile, 45)
+	if size := rotated.Bounds().Size(); size.X <= 40 || size.Y <= 20 {
+		t.Errorf("Expected the rotated tile bounds to grow: %v", size)
+	}
+
+	if same, _ := rotateTile(tile, 0); same != tile {
+		t.Error("Expected the tile to be preserved without rotation")
+	}
+}
+
+func TestTileImage(t *testing.T) {
+	canvas := image.NewRGBA(image.Rect(0, 0, 100, 100))
+	tile := newCanvas(10, 10, color.RGBA{0xff, 0xff, 0xff, 0xff}, color.RGBA{0xff, 0xff, 0xff, 0xff})
+
+	tileImage(canvas, tile, 10, blendModes[BlendNormal], 1)
+
+	covered := 0
+	for i := 3; i < len(canvas.Pix); i += 4 {
+		if canvas.Pix[i] != 0 {
+			covered++
+		}
+	}
+	// Tiles of 10 pixels every 20 pixels cover about a quarter of the canvas
+	if covered < 2000 || covered > 3000 {
+		t.Errorf("Invalid tiled area: %d pixels", covered)
+	}
+	if canvas.RGBAAt(5, 5).A != 0xff || canvas.RGBAAt(15, 5).A != 0 {
+		t.Error("Invalid tile positions")
+	}
+}
+
+func TestTileWatermark(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+
+	img, err := Watermark(buf, ImageOptions{Text: "Copyright", Tile: true, TileSpacing: 20, TileAngle: -30, Opacity: 0.5})
+	if err != nil {
+		t.Fatalf("Cannot tile the watermark: %s", err)
+	}
+	if img.Mime != "image/jpeg" {
+		t.Errorf("Invalid image MIME type: %s", img.Mime)
+	}
+	if err := assertSize(img.Body, 550, 740); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := Watermark(buf, ImageOptions{Text: "Copyright", Tile: true, TileSpacing: -1}); err == nil {
+		t.Error("Expected invalid tile spacing error")
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// transformFunc maps the output image coordinates to the source image coordinates.
+type transformFunc func(x, y float64) (float64, float64)
+
+// parseFloats parses the comma separated numbers, which must match any of the given lengths.
+func parseFloats(val string, lengths ...int) ([]float64, error) {
+	nums := []float64{}
+	for _, part := range strings.Split(val, ",") {
+		n, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || math.IsNaN(n) || math.IsInf(n, 0) {
+			return nil, strconv.ErrSyntax
+		}
+		nums = append(nums, n)
+	}
+	for _, length := range lengths {
+		if len(nums) == length {
+			return nums, nil
+		}
+	}
+	return nil, strconv.ErrSyntax
+}
+
+// sampleBilinear interpolates the alpha premultiplied color at the given image
+// coordinates, treating the pixels out of the image bounds as transparent.
+func sampleBilinear(src *image.RGBA, x, y float64) color.RGBA {
+	x0, y0 := math.Floor(x), math.Floor(y)
+	fx, fy := x-x0, y-y0
+	ix, iy := int(x0), int(y0)
+
+	var r, g, b, a float64
+	for _, p := range [4]struct {
+		x, y int
+		w    float64
+	}{
+		{ix, iy, (1 - fx) * (1 - fy)},
+		{ix + 1, iy, fx * (1 - fy)},
+		{ix, iy + 1, (1 - fx) * fy},
+		{ix + 1, iy + 1, fx * fy},
+	} {
+		if p.w == 0 || !(image.Point{p.x, p.y}.In(src.Rect)) {
+			continue
+		}
+		c := src.RGBAAt(p.x, p.y)
+		r += float64(c.R) * p.w
+		g += float64(c.G) * p.w
+		b += float64(c.B) * p.w
+		a += float64(c.A) * p.w
+	}
+	return color.RGBA{uint8(r + 0.5), uint8(g + 0.5), uint8(b + 0.5), uint8(a + 0.5)}
+}
+
+// transformImage renders the output image of the given size, sampling each pixel centre
+// from the source image via the given mapping over the given background color.
+func transformImage(src *image.RGBA, width, height int, transform transformFunc, background color.RGBA) *image.RGBA {
+	out := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			sx, sy := transform(float64(x)+0.5, float64(y)+0.5)
+			out.SetRGBA(x, y, sampleBilinear(src, sx-0.5, sy-0.5))
+		}
+	}
+
+	if background.A == 0 {
+		return out
+	}
+	canvas := newCanvas(width, height, background, background)
+	draw.Draw(canvas, canvas.Bounds(), out, image.ZP, draw.Over)
+	return canvas
+}
+
+// affineImage transforms the image via the given affine matrix [a, b, c, d, e, f], mapping
+// x' = ax + by + e and y' = cx + dy + f. If fit is true, the output image is fitted to the
+// transformed image bounds, ignoring the translation, otherwise the image size is kept.
+func affineImage(src *image.RGBA, m []float64, fit bool, background color.RGBA) (*image.RGBA, error) {
+	det := m[0]*m[3] - m[1]*m[2]
+	if math.Abs(det) < 1e-9 {
+		return nil, NewError("Invalid affine matrix, must be invertible", BadRequest)
+	}
+
+	width, height := src.Rect.Dx(), src.Rect.Dy()
+	tx, ty := m[4], m[5]
+	if fit {
+		w, h := float64(width), float64(height)
+		minX, minY := math.Inf(1), math.Inf(1)
+		maxX, maxY := math.Inf(-1), math.Inf(-1)
+		for _, p := range [4][2]float64{{0, 0}, {w, 0}, {0, h}, {w, h}} {
+			x, y := m[0]*p[0]+m[1]*p[1], m[2]*p[0]+m[3]*p[1]
+			minX, minY = math.Min(minX, x), math.Min(minY, y)
+			maxX, maxY = math.Max(maxX, x), math.Max(maxY, y)
+		}
+		width, height = int(math.Ceil(maxX-minX-1e-6)), int(math.Ceil(maxY-minY-1e-6))
+		tx, ty = -minX, -minY
+	}
+	if err := checkCanvasSize(width, height); err != nil {
+		return nil, err
+	}
+
+	return transformImage(src, width, height, func(x, y float64) (float64, float64) {
+		x, y = x-tx, y-ty
+		return (m[3]*x - m[1]*y) / det, (m[0]*y - m[2]*x) / det
+	}, background), nil
+}
+
+// quadTransform returns the mapping of the unit square to the given quadrilateral
+// corners, in top left, top right, bottom right and bottom left order.
+func quadTransform(p []float64) func(s, t float64) (float64, float64) {
+	x0, y0, x1, y1, x2, y2, x3, y3 := p[0], p[1], p[2], p[3], p[4], p[5], p[6], p[7]
+	dx1, dx2, dx3 := x1-x2, x3-x2, x0-x1+x2-x3
+	dy1, dy2, dy3 := y1-y2, y3-y2, y0-y1+y2-y3
+
+	var g, h float64
+	if den := dx1*dy2 - dx2*dy1; den != 0 {
+		g = (dx3*dy2 - dx2*dy3) / den
+		h = (dx1*dy3 - dx3*dy1) / den
+	}
+	a, b, c := x1-x0+g*x1, x3-x0+h*x3, x0
+	d, e, f := y1-y0+g*y1, y3-y0+h*y3, y0
+
+	return func(s, t float64) (float64, float64) {
+		w := g*s + h*t + 1
+		return (a*s + b*t + c) / w, (d*s + e*t + f) / w
+	}
+}
+
+// Affine transforms the image via the 2x2 matrix, fitting the output image to the
+// transformed image, or the 2x3 matrix including the translation, keeping the image size.
+func Affine(buf []byte, o ImageOptions) (Image, error) {
+	if o.Matrix == "" {
+		return Image{}, NewError("Missing required param: matrix", BadRequest)
+	}
+	m, err := parseFloats(o.Matrix, 4, 6)
+	if err != nil {
+		return Image{}, NewError("Invalid matrix param, must define 4 or 6 numbers: "+o.Matrix, BadRequest)
+	}
+	fit := len(m) == 4
+	if fit {
+		m = append(m, 0, 0)
+	}
+
+	src, err := decodeCanvas(buf)
+	if err != nil {
+		return Image{}, err
+	}
+
+	output := outputOptions(buf, o)
+	out, err := affineImage(src, m, fit, canvasBackground(o, output.Type))
+	if err != nil {
+		return Image{}, err
+	}
+	return encodeCanvas(out, output)
+}
+
+// Perspective rectifies the image quadrilateral defined by the four corner points, in top
+// left, top right, bottom right and bottom left order, such as scanned documents and
+// whiteboard photos. The output size defaults to the quadrilateral average sides length.
+func Perspective(buf []byte, o ImageOptions) (Image, error) {
+	if o.Corners == "" {
+		return Image{}, NewError("Missing required param: corners", BadRequest)
+	}
+	p, err := parseFloats(o.Corners, 8)
+	if err != nil {
+		return Image{}, NewError("Invalid corners param, must define 4 points: "+o.Corners, BadRequest)
+	}
+
+	side := func(i, j int) float64 {
+		return math.Hypot(p[j*2]-p[i*2], p[j*2+1]-p[i*2+1])
+	}
+	width, height := o.Width, o.Height
+	if width == 0 {
+		width = int((side(0, 1)+side(3, 2))/2 + 0.5)
+	}
+	if height == 0 {
+		height = int((side(0, 3)+side(1, 2))/2 + 0.5)
+	}
+	if err := checkCanvasSize(width, height); err != nil {
+		return Image{}, err
+	}
+
+	src, err := decodeCanvas(buf)
+	if err != nil {
+		return Image{}, err
+	}
+
+	quad := quadTransform(p)
+	output := outputOptions(buf, o)
+	out := transformImage(src, width, height, func(x, y float64) (float64, float64) {
+		return quad(x/float64(width), y/float64(height))
+	}, canvasBackground(o, output.Type))
+	return encodeCanvas(out, output)
+}
+
+// maxSkewAngle is the maximum skew angle in degrees
+const maxSkewAngle = 80
+
+// Skew shears the image by the given horizontal and vertical angles in degrees, such as
+// slanted banners, fitting the output image and filling the uncovered area with the background.
+func Skew(buf []byte, o ImageOptions) (Image, error) {
+	if o.SkewX == 0 && o.SkewY == 0 {
+		return Image{}, NewError("Missing required param: skewx or skewy", BadRequest)
+	}
+	if math.Abs(o.SkewX) > maxSkewAngle || math.Abs(o.SkewY) > maxSkewAngle {
+		return Image{}, NewError("Invalid skew angle, must be between -80 and 80 degrees", BadRequest)
+	}
+
+	src, err := decodeCanvas(buf)
+	if err != nil {
+		return Image{}, err
+	}
+
+	m := []float64{1, math.Tan(o.SkewX * math.Pi / 180), math.Tan(o.SkewY * math.Pi / 180), 1, 0, 0}
+	output := outputOptions(buf, o)
+	out, err := affineImage(src, m, true, canvasBackground(o, output.Type))
+	if err != nil {
+		return Image{}, err
+	}
+	return encodeCanvas(out, output)
+}
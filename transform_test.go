@@ -0,0 +1,152 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"io/ioutil"
+	"math"
+	"testing"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+func gradientImage(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetRGBA(x, y, color.RGBA{uint8(x), uint8(y), 0, 0xff})
+		}
+	}
+	return img
+}
+
+func TestParseFloats(t *testing.T) {
+	if nums, err := parseFloats("1, 0.5,-2,3", 4, 6); err != nil || len(nums) != 4 || nums[2] != -2 {
+		t.Errorf("Invalid parsed numbers: %v (%v)", nums, err)
+	}
+	if _, err := parseFloats("1,2,3", 4, 6); err == nil {
+		t.Error("Expected invalid length error")
+	}
+	if _, err := parseFloats("1,foo,3,4", 4); err == nil {
+		t.Error("Expected invalid number error")
+	}
+}
+
+func TestAffineImage(t *testing.T) {
+	src := gradientImage(40, 20)
+
+	// Rotate 90 degrees clockwise, fitting the output image
+	out, err := affineImage(src, []float64{0, -1, 1, 0, 0, 0}, true, color.RGBA{})
+	if err != nil {
+		t.Fatalf("Cannot transform the image: %s", err)
+	}
+	if out.Bounds() != image.Rect(0, 0, 20, 40) {
+		t.Errorf("Invalid image bounds: %v", out.Bounds())
+	}
+	if c := out.RGBAAt(0, 0); c != src.RGBAAt(0, 19) {
+		t.Errorf("Invalid rotated pixel: %v", c)
+	}
+
+	// Translate keeping the image size
+	out, _ = affineImage(src, []float64{1, 0, 0, 1, 5, 3}, false, color.RGBA{})
+	if out.Bounds() != src.Bounds() {
+		t.Errorf("Invalid image bounds: %v", out.Bounds())
+	}
+	if c := out.RGBAAt(5, 3); c != src.RGBAAt(0, 0) {
+		t.Errorf("Invalid translated pixel: %v", c)
+	}
+	if c := out.RGBAAt(0, 0); c.A != 0 {
+		t.Errorf("Invalid background pixel: %v", c)
+	}
+
+	if _, err := affineImage(src, []float64{1, 2, 2, 4, 0, 0}, true, color.RGBA{}); err == nil {
+		t.Error("Expected non invertible matrix error")
+	}
+}
+
+func TestQuadTransform(t *testing.T) {
+	corners := []float64{10, 0, 30, 0, 40, 20, 0, 20}
+	quad := quadTransform(corners)
+
+	for i, p := range [4][2]float64{{0, 0}, {1, 0}, {1, 1}, {0, 1}} {
+		x, y := quad(p[0], p[1])
+		if math.Abs(x-corners[i*2]) > 1e-9 || math.Abs(y-corners[i*2+1]) > 1e-9 {
+			t.Errorf("Invalid corner %d mapping: %f,%f", i, x, y)
+		}
+	}
+
+	// The centre maps to the diagonals intersection
+	if x, y := quad(0.5, 0.5); math.Abs(x-20) > 1e-9 || math.Abs(y-20.0/3) > 1e-9 {
+		t.Errorf("Invalid centre mapping: %f,%f", x, y)
+	}
+}
+
+func TestAffine(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+	size, _ := bimg.Size(buf)
+
+	image, err := Affine(buf, ImageOptions{Matrix: "0,-1,1,0"})
+	if err != nil {
+		t.Fatalf("Cannot transform the image: %s", err)
+	}
+	if image.Mime != "image/jpeg" {
+		t.Errorf("Invalid image MIME type: %s", image.Mime)
+	}
+	if err := assertSize(image.Body, size.Height, size.Width); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := Affine(buf, ImageOptions{Matrix: "1,0"}); err == nil {
+		t.Error("Expected invalid matrix error")
+	}
+}
+
+func TestPerspective(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+
+	image, err := Perspective(buf, ImageOptions{Corners: "10,10,110,20,100,80,20,70", Type: "png"})
+	if err != nil {
+		t.Fatalf("Cannot rectify the image: %s", err)
+	}
+	if image.Mime != "image/png" {
+		t.Errorf("Invalid image MIME type: %s", image.Mime)
+	}
+	if err := assertSize(image.Body, 91, 61); err != nil {
+		t.Error(err)
+	}
+
+	image, _ = Perspective(buf, ImageOptions{Corners: "10,10,110,20,100,80,20,70", Width: 200, Height: 100})
+	if err := assertSize(image.Body, 200, 100); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := Perspective(buf, ImageOptions{Corners: "0,0,10,10"}); err == nil {
+		t.Error("Expected invalid corners error")
+	}
+}
+
+func TestSkew(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+	size, _ := bimg.Size(buf)
+
+	image, err := Skew(buf, ImageOptions{SkewX: 45, Background: []uint8{255, 0, 0}})
+	if err != nil {
+		t.Fatalf("Cannot skew the image: %s", err)
+	}
+	if err := assertSize(image.Body, size.Width+size.Height, size.Height); err != nil {
+		t.Error(err)
+	}
+
+	// The uncovered top right corner is filled with the background
+	canvas, _ := decodeCanvas(image.Body)
+	if c := canvas.RGBAAt(size.Width+size.Height-3, 2); c.R < 0xf0 || c.G > 0x10 || c.B > 0x10 {
+		t.Errorf("Invalid background color: %v", c)
+	}
+
+	if _, err := Skew(buf, ImageOptions{}); err == nil {
+		t.Error("Expected missing skew angle error")
+	}
+	if _, err := Skew(buf, ImageOptions{SkewY: 90}); err == nil {
+		t.Error("Expected invalid skew angle error")
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// upgradeEnv is the environment variable of the processes started by a binary upgrade,
+// which inherit the listening socket as file descriptor 3 and the ready pipe as 4.
+const upgradeEnv = "IMAGINARY_UPGRADE"
+
+// upgradeTimeout is the maximum time to wait for the upgraded process to serve
+const upgradeTimeout = time.Minute
+
+// upgradeListener returns the listening socket inherited from the upgraded process, if any,
+// or listens on the given address otherwise.
+func upgradeListener(addr string) (net.Listener, error) {
+	if os.Getenv(upgradeEnv) == "" {
+		return net.Listen("tcp", addr)
+	}
+	file := os.NewFile(3, "listener")
+	defer file.Close()
+	return net.FileListener(file)
+}
+
+// notifyUpgrade writes the process id to the PID file, if any, then notifies the upgraded
+// process, if any, that the current process serves the requests, so it can be drained.
+func notifyUpgrade(o ServerOptions) error {
+	if o.PIDFile != "" {
+		if err := ioutil.WriteFile(o.PIDFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+			return err
+		}
+	}
+	if os.Getenv(upgradeEnv) == "" {
+		return nil
+	}
+	os.Unsetenv(upgradeEnv)
+	ready := os.NewFile(4, "ready")
+	defer ready.Close()
+	_, err := ready.Write([]byte{1})
+	return err
+}
+
+// upgradeEnviron returns the environment of the upgraded process
+func upgradeEnviron() []string {
+	env := []string{upgradeEnv + "=1"}
+	for _, value := range os.Environ() {
+		if !strings.HasPrefix(value, upgradeEnv+"=") {
+			env = append(env, value)
+		}
+	}
+	return env
+}
+
+// upgrade starts a new process of the current binary, with the same arguments, handing over
+// the given listening socket, and waits until it serves the requests.
+func upgrade(listener net.Listener) error {
+	tcp, ok := listener.(*net.TCPListener)
+	if !ok {
+		return errors.New("unsupported listener")
+	}
+	file, err := tcp.File()
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyReader.Close()
+
+	executable, err := os.Executable()
+	if err != nil {
+		readyWriter.Close()
+		return err
+	}
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = upgradeEnviron()
+	cmd.ExtraFiles = []*os.File{file, readyWriter}
+	err = cmd.Start()
+	readyWriter.Close()
+	if err != nil {
+		return err
+	}
+
+	// The ready pipe is closed without data if the upgraded process exits before serving
+	ready := make(chan error, 1)
+	go func() {
+		_, err := readyReader.Read(make([]byte, 1))
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+	case <-time.After(upgradeTimeout):
+		err = errors.New("timeout waiting for the upgraded process")
+		cmd.Process.Kill()
+	}
+	if err != nil {
+		go cmd.Wait()
+		return fmt.Errorf("the upgraded process is not serving: %s", err)
+	}
+	return nil
+}
+
+// serveUpgradable serves the requests on the inherited listening socket, if any, handing it over
+// to a new process of the current binary on SIGUSR2 signal, then draining the current process
+// until the in flight requests are served, or the drain timeout is exceeded.
+func serveUpgradable(s *http.Server, o ServerOptions) error {
+	listener, err := upgradeListener(s.Addr)
+	if err != nil {
+		return err
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		if o.CertFile != "" && o.KeyFile != "" {
+			errs <- s.ServeTLS(listener, o.CertFile, o.KeyFile)
+			return
+		}
+		errs <- s.Serve(listener)
+	}()
+	if err := notifyUpgrade(o); err != nil {
+		return err
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR2)
+	defer signal.Stop(signals)
+	for {
+		select {
+		case err := <-errs:
+			return err
+		case <-signals:
+			if err := upgrade(listener); err != nil {
+				fmt.Fprintf(os.Stderr, "cannot upgrade the server: %s\n", err)
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(o.DrainTimeout)*time.Second)
+			defer cancel()
+			return s.Shutdown(ctx)
+		}
+	}
+}
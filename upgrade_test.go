@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestUpgradeEnviron(t *testing.T) {
+	os.Setenv(upgradeEnv, "stale")
+	defer os.Unsetenv(upgradeEnv)
+
+	count := 0
+	for _, value := range upgradeEnviron() {
+		if strings.HasPrefix(value, upgradeEnv+"=") {
+			count++
+			if value != upgradeEnv+"=1" {
+				t.Errorf("Invalid upgrade environment variable: %s", value)
+			}
+		}
+	}
+	if count != 1 {
+		t.Errorf("Invalid upgrade environment variables count: %d", count)
+	}
+}
+
+func TestNotifyUpgrade(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imaginary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	listener, err := upgradeListener("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %s", err)
+	}
+	defer listener.Close()
+
+	path := filepath.Join(dir, "imaginary.pid")
+	if err := notifyUpgrade(ServerOptions{PIDFile: path}); err != nil {
+		t.Fatalf("Cannot notify the upgrade: %s", err)
+	}
+	buf, _ := ioutil.ReadFile(path)
+	if string(buf) != strconv.Itoa(os.Getpid())+"\n" {
+		t.Errorf("Invalid PID file: %q", buf)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// Upscaling modes
+const (
+	UpscaleAI      = "ai"
+	UpscaleBicubic = "bicubic"
+)
+
+// maxUpscaleFactor is the maximum scale factor requested to the super-resolution service
+const maxUpscaleFactor = 4
+
+var upscaleClient = &http.Client{Timeout: 60 * time.Second}
+
+// Upscale wraps the given operation, upscaling the image via the external super-resolution
+// service of the given URL before processing it, if the output is larger than the image, so large
+// renditions of small legacy assets preserve their details. It falls back to the bicubic
+// interpolation of the operation itself if no service is configured or the service fails.
+func Upscale(service string, operation Operation) Operation {
+	return func(buf []byte, o ImageOptions) (Image, error) {
+		if o.Upscale != UpscaleAI && o.Upscale != UpscaleBicubic {
+			return Image{}, NewError("Invalid upscale mode: "+o.Upscale, BadRequest)
+		}
+		if o.Upscale == UpscaleBicubic || service == "" {
+			return operation(buf, o)
+		}
+
+		size, err := bimg.Size(buf)
+		if err != nil || size.Width == 0 || size.Height == 0 {
+			return operation(buf, o)
+		}
+		factor := upscaleFactor(size, o)
+		if factor < 2 {
+			return operation(buf, o)
+		}
+
+		upscaled, err := upscale(service, buf, factor)
+		if err != nil {
+			debug("super-resolution upscale failed, falling back to bicubic: %s", err)
+			return operation(buf, o)
+		}
+		return operation(upscaled, o)
+	}
+}
+
+// upscaleFactor returns the integer scale factor of the image size fitting the requested output size, up to 4
+func upscaleFactor(size bimg.ImageSize, o ImageOptions) int {
+	ratio := math.Max(float64(o.Width)/float64(size.Width), float64(o.Height)/float64(size.Height))
+	return int(math.Min(maxUpscaleFactor, math.Ceil(ratio)))
+}
+
+// upscale posts the image to the super-resolution service, defining the scale factor via
+// the scale query param, returning the upscaled image.
+func upscale(service string, buf []byte, factor int) ([]byte, error) {
+	u, err := url.Parse(service)
+	if err != nil {
+		return nil, err
+	}
+	query := u.Query()
+	query.Set("scale", strconv.Itoa(factor))
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequest("POST", u.String(), bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", GetImageMimeType(bimg.DetermineImageType(buf)))
+	req.Header.Set("User-Agent", "imaginary/"+Version)
+
+	res, err := upscaleClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		return nil, fmt.Errorf("invalid response status: %d", res.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if !bimg.IsTypeSupported(bimg.DetermineImageType(body)) {
+		return nil, fmt.Errorf("unsupported upscaled image type")
+	}
+	return body, nil
+}
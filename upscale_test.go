@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+func TestUpscaleFactor(t *testing.T) {
+	size := bimg.ImageSize{Width: 100, Height: 50}
+	cases := []struct {
+		opts     ImageOptions
+		expected int
+	}{
+		{ImageOptions{Width: 50}, 1},
+		{ImageOptions{Width: 100}, 1},
+		{ImageOptions{Width: 150}, 2},
+		{ImageOptions{Height: 200}, 4},
+		{ImageOptions{Width: 1000}, 4},
+	}
+
+	for _, c := range cases {
+		if factor := upscaleFactor(size, c.opts); factor != c.expected {
+			t.Errorf("Invalid upscale factor of %+v: %d != %d", c.opts, factor, c.expected)
+		}
+	}
+}
+
+func TestUpscale(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("test.png"))
+
+	scale := ""
+	ts := testServer(func(w http.ResponseWriter, r *http.Request) {
+		scale = r.URL.Query().Get("scale")
+		body, _ := ioutil.ReadAll(r.Body)
+		image, _ := Enlarge(body, ImageOptions{Width: 800, Height: 600})
+		w.Write(image.Body)
+	})
+	defer ts.Close()
+
+	image, err := Upscale(ts.URL, Enlarge)(buf, ImageOptions{Width: 700, Height: 525, Upscale: UpscaleAI})
+	if err != nil {
+		t.Fatalf("Cannot upscale the image: %s", err)
+	}
+	if scale != "2" {
+		t.Errorf("Invalid upscale factor: %s", scale)
+	}
+	if err := assertSize(image.Body, 700, 525); err != nil {
+		t.Error(err)
+	}
+
+	// Failed services fall back to the bicubic interpolation
+	failing := testServer(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	defer failing.Close()
+
+	image, err = Upscale(failing.URL, Enlarge)(buf, ImageOptions{Width: 700, Height: 525, Upscale: UpscaleAI})
+	if err != nil {
+		t.Fatalf("Cannot upscale the image: %s", err)
+	}
+	if err := assertSize(image.Body, 700, 525); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := Upscale("", Enlarge)(buf, ImageOptions{Width: 700, Height: 525, Upscale: "magic"}); err == nil {
+		t.Error("Expected an error with an invalid upscale mode")
+	}
+}
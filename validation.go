@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// requestParams are the query params of the image endpoints parsed besides the image params,
+// such as the image source, authorization and URL signature ones.
+var requestParams = map[string]bool{
+	"url":             true,
+	"file":            true,
+	"key":             true,
+	CacheVersionParam: true,
+	"sign":            true,
+	"keyid":           true,
+	"expires":         true,
+	"onerror":         true,
+	"field":           true,
+	"icosizes":        true,
+	"bg":              true,
+	"fg":              true,
+	"gradient":        true,
+	"template":        true,
+	"title":           true,
+	"subtitle":        true,
+	"widths":          true,
+	"output":          true,
+	"explain":         true,
+	"raw":             true,
+}
+
+// paramRanges are the allowed minimum and maximum values of the numeric image params
+var paramRanges = map[string][2]float64{
+	"width":        {0, bimg.MaxSize},
+	"height":       {0, bimg.MaxSize},
+	"areawidth":    {0, bimg.MaxSize},
+	"areaheight":   {0, bimg.MaxSize},
+	"top":          {0, bimg.MaxSize},
+	"left":         {0, bimg.MaxSize},
+	"quality":      {1, 100},
+	"minquality":   {1, 100},
+	"maxquality":   {1, 100},
+	"compression":  {0, 9},
+	"nearlossless": {0, 100},
+	"opacity":      {0, 1},
+	"rotate":       {0, 360},
+}
+
+// conflictingParams are the pairs of image params which cannot be both enabled
+var conflictingParams = [][2]string{
+	{"force", "nocrop"},
+	{"force", "embed"},
+}
+
+// validateParams validates the given query params, rejecting the unknown params, the invalid or
+// out of range values and the conflicting params, naming the offending param in the error.
+func validateParams(query url.Values) error {
+	names := []string{}
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		kind, ok := allowedParams[name]
+		if !ok && !requestParams[name] {
+			return NewError(unknownParamMessage(name), BadRequest)
+		}
+		value := query.Get(name)
+		if !ok || value == "" {
+			continue
+		}
+		if err := validateParam(name, kind, value); err != nil {
+			return NewError(fmt.Sprintf("Invalid %s param: %s", name, err), BadRequest)
+		}
+	}
+
+	for _, pair := range conflictingParams {
+		if parseBool(query.Get(pair[0])) && parseBool(query.Get(pair[1])) {
+			return NewError(fmt.Sprintf("Conflicting params: %s and %s cannot be combined", pair[0], pair[1]), BadRequest)
+		}
+	}
+	return nil
+}
+
+// validateParam validates the value of the given image param of the given kind
+func validateParam(name, kind, value string) error {
+	switch kind {
+	case "int", "float":
+		if _, ok := relativeParams[name]; ok && strings.HasSuffix(value, "%") {
+			if fraction, _ := parsePercent(value); fraction < 0 {
+				return fmt.Errorf("invalid percentage: %s", value)
+			}
+			return nil
+		}
+		if name == "quality" && value == "auto" {
+			return nil
+		}
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("must be a number: %s", value)
+		}
+		if bounds, ok := paramRanges[name]; ok && (number < bounds[0] || number > bounds[1]) {
+			return fmt.Errorf("must be between %v and %v: %s", bounds[0], bounds[1], value)
+		}
+	case "bool":
+		if _, err := strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("must be a boolean: %s", value)
+		}
+	case "color":
+		for _, num := range strings.Split(value, ",") {
+			if _, err := strconv.ParseUint(strings.TrimSpace(num), 10, 8); err != nil {
+				return fmt.Errorf("must be comma separated numbers between 0 and 255: %s", value)
+			}
+		}
+	case "colorspace":
+		if value != "srgb" && value != "bw" {
+			return fmt.Errorf("must be srgb or bw: %s", value)
+		}
+	case "gravity":
+		if _, ok := gravities[strings.TrimSpace(strings.ToLower(value))]; !ok {
+			return fmt.Errorf("must be one of %s: %s", strings.Join(sortedKeys(gravities), ", "), value)
+		}
+	case "extend":
+		if _, ok := extendModes[strings.TrimSpace(strings.ToLower(value))]; !ok {
+			return fmt.Errorf("must be one of %s: %s", strings.Join(sortedKeys(extendModes), ", "), value)
+		}
+	case "json":
+		if err := json.Unmarshal([]byte(value), &PipelineOperations{}); err != nil {
+			return fmt.Errorf("must be a JSON array of operations: %s", err)
+		}
+	}
+	return nil
+}
+
+// unknownParamMessage returns the error message of the given unknown param, suggesting
+// the closest known param, if any, since unknown params are usually typos.
+func unknownParamMessage(name string) string {
+	known := append(sortedKeys(allowedParams), sortedKeys(requestParams)...)
+	sort.Strings(known)
+
+	suggestion, distance := "", 3
+	for _, param := range known {
+		if d := editDistance(name, param); d < distance {
+			suggestion, distance = param, d
+		}
+	}
+	if suggestion == "" {
+		return "Unknown param: " + name
+	}
+	return fmt.Sprintf("Unknown param: %s, did you mean %s?", name, suggestion)
+}
+
+// editDistance returns the Damerau-Levenshtein distance of the given strings, counting the
+// adjacent transpositions as a single edit.
+func editDistance(a, b string) int {
+	d := make([][]int, len(a)+1)
+	for i := range d {
+		d[i] = make([]int, len(b)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d[i][j] = minInt(d[i-1][j]+1, minInt(d[i][j-1]+1, d[i-1][j-1]+cost))
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				d[i][j] = minInt(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+	return d[len(a)][len(b)]
+}
+
+// strictParams rejects the requests of invalid query params, if the strict params
+// validation is enabled, instead of silently ignoring them.
+func strictParams(fn func(http.ResponseWriter, *http.Request), o ServerOptions) func(http.ResponseWriter, *http.Request) {
+	if !o.StrictParams {
+		return fn
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := validateParams(r.URL.Query()); err != nil {
+			ErrorReply(r, w, err.(Error), o)
+			return
+		}
+		fn(w, r)
+	}
+}
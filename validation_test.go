@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestValidateParams(t *testing.T) {
+	cases := []struct {
+		query string
+		err   string
+	}{
+		{"width=300&height=200&type=webp&url=http://localhost/cat.jpg", ""},
+		{"width=50%25&quality=auto&sign=abc&keyid=k1&expires=1600000000&v=2", ""},
+		{"gravity=smart&extend=mirror&color=255,200,150&flip=true&operations=[]", ""},
+		{"width=", ""},
+		{"widht=300", "Unknown param: widht, did you mean width?"},
+		{"foobarbaz=1", "Unknown param: foobarbaz"},
+		{"width=abc", "Invalid width param: must be a number: abc"},
+		{"width=-300", "Invalid width param: must be between 0 and 16383: -300"},
+		{"quality=101", "Invalid quality param: must be between 1 and 100: 101"},
+		{"compression=10", "Invalid compression param: must be between 0 and 9: 10"},
+		{"width=10x%25", "Invalid width param: invalid percentage: 10x%"},
+		{"flip=yes", "Invalid flip param: must be a boolean: yes"},
+		{"color=300,0,0", "Invalid color param: must be comma separated numbers between 0 and 255: 300,0,0"},
+		{"gravity=up", "Invalid gravity param: must be one of attention, centre, east, entropy, north, smart, south, west: up"},
+		{"operations={", "Invalid operations param: must be a JSON array of operations: unexpected end of JSON input"},
+		{"force=true&nocrop=true", "Conflicting params: force and nocrop cannot be combined"},
+		{"force=true&nocrop=false", ""},
+	}
+
+	for _, c := range cases {
+		query, _ := url.ParseQuery(c.query)
+		err := validateParams(query)
+		if c.err == "" && err != nil {
+			t.Errorf("Unexpected error of %s: %s", c.query, err)
+		} else if c.err != "" && (err == nil || err.Error() != c.err) {
+			t.Errorf("Invalid error of %s: %v", c.query, err)
+		}
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	cases := []struct {
+		a, b     string
+		distance int
+	}{
+		{"width", "width", 0},
+		{"widht", "width", 1},
+		{"heigth", "height", 1},
+		{"qualty", "quality", 1},
+		{"", "top", 3},
+	}
+	for _, c := range cases {
+		if d := editDistance(c.a, c.b); d != c.distance {
+			t.Errorf("Invalid edit distance of %s and %s: %d", c.a, c.b, d)
+		}
+	}
+}
+
+func TestStrictParams(t *testing.T) {
+	called := false
+	fn := func(w http.ResponseWriter, r *http.Request) { called = true }
+
+	w := httptest.NewRecorder()
+	strictParams(fn, ServerOptions{})(w, httptest.NewRequest("GET", "/resize?widht=300", nil))
+	if !called {
+		t.Error("Unknown params should be ignored unless the strict params are enabled")
+	}
+
+	called = false
+	w = httptest.NewRecorder()
+	strictParams(fn, ServerOptions{StrictParams: true})(w, httptest.NewRequest("GET", "/resize?widht=300", nil))
+	if called || w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "did you mean width?") {
+		t.Errorf("Invalid strict params response: %d %s", w.Code, w.Body.String())
+	}
+}
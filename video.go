@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// Supported video formats
+const (
+	VideoFormatMP4  = "mp4"
+	VideoFormatWebM = "webm"
+)
+
+// videoDefaultTimeout is the maximum video encoding time, unless a processing timeout is defined
+const videoDefaultTimeout = 60 * time.Second
+
+// videoMimeTypes maps the video formats to their MIME type
+var videoMimeTypes = map[string]string{
+	VideoFormatMP4:  "video/mp4",
+	VideoFormatWebM: "video/webm",
+}
+
+// ErrVideoDisabled is returned if the ffmpeg integration is not enabled
+var ErrVideoDisabled = NewError("Video conversion is not enabled, see the -ffmpeg flag", NotImplemented)
+
+// videoCRF maps the quality param, from 1 to 100, to the encoder constant rate factor,
+// from 51 to 0 for H.264 and 63 to 0 for VP9, defaulting to the encoders recommended values.
+func videoCRF(format string, quality int) int {
+	max, crf := 51, 23
+	if format == VideoFormatWebM {
+		max, crf = 63, 32
+	}
+	if quality > 0 && quality <= 100 {
+		crf = (100 - quality) * max / 100
+	}
+	return crf
+}
+
+// ffmpegInputArgs returns the ffmpeg arguments reading the input file via the given demuxer
+// only, instead of probing it, and restricting the protocols to the local files, so crafted
+// inputs, such as HLS playlists, cannot make ffmpeg read other files or remote URLs.
+func ffmpegInputArgs(demuxer, input string) []string {
+	return []string{"-hide_banner", "-loglevel", "error", "-y", "-protocol_whitelist", "file", "-f", demuxer, "-i", input}
+}
+
+// ffmpegArgs returns the ffmpeg arguments converting the input GIF file into the output file of
+// the given format, scaled to the given width with even dimensions, as required by yuv420p.
+func ffmpegArgs(format string, width, quality int, input, output string) []string {
+	scale := "scale=trunc(iw/2)*2:trunc(ih/2)*2"
+	if width > 0 {
+		scale = fmt.Sprintf("scale=%d:-2", width-width%2)
+	}
+
+	args := append(ffmpegInputArgs("gif", input), "-vf", scale, "-an")
+	crf := strconv.Itoa(videoCRF(format, quality))
+	if format == VideoFormatWebM {
+		args = append(args, "-c:v", "libvpx-vp9", "-b:v", "0", "-crf", crf, "-pix_fmt", "yuv420p")
+	} else {
+		args = append(args, "-c:v", "libx264", "-crf", crf, "-pix_fmt", "yuv420p", "-movflags", "+faststart")
+	}
+	return append(args, output)
+}
+
+// Video returns the operation converting animated GIF images into MP4 or WebM videos via
+// the given ffmpeg binary, since videos are dramatically smaller than animated GIF images.
+// ffmpeg is killed if the request is canceled or the timeout is exceeded.
+func Video(ffmpeg string, timeout time.Duration) Operation {
+	return func(buf []byte, o ImageOptions) (Image, error) {
+		if ffmpeg == "" {
+			return Image{}, ErrVideoDisabled
+		}
+		if bimg.DetermineImageType(buf) != bimg.GIF {
+			return Image{}, NewError("Video conversion requires GIF images", BadRequest)
+		}
+
+		format := strings.ToLower(o.Format)
+		if format == "" {
+			format = VideoFormatMP4
+		}
+		mime, ok := videoMimeTypes[format]
+		if !ok {
+			return Image{}, NewError("Unsupported video format: "+o.Format, BadRequest)
+		}
+
+		body, err := runFFmpeg(o.Context, ffmpeg, buf, format, timeout, func(input, output string) []string {
+			return ffmpegArgs(format, o.Width, o.Quality, input, output)
+		})
+		if err != nil {
+			return Image{}, err
+		}
+		return Image{Body: body, Mime: mime}, nil
+	}
+}
+
+// isVideoMimeType reports whether the given MIME type is a video source
+func isVideoMimeType(mime string) bool {
+	return strings.HasPrefix(mime, "video/")
+}
+
+// videoDemuxer returns the ffmpeg demuxer of the given video container, by its signature:
+// the MP4 and MOV, the WebM and Matroska, and the AVI containers, or an empty string if the
+// container is not supported.
+func videoDemuxer(buf []byte) string {
+	switch {
+	case len(buf) >= 8 && string(buf[4:8]) == "ftyp":
+		return "mov"
+	case bytes.HasPrefix(buf, []byte{0x1A, 0x45, 0xDF, 0xA3}):
+		return "matroska"
+	case len(buf) >= 12 && string(buf[:4]) == "RIFF" && string(buf[8:12]) == "AVI ":
+		return "avi"
+	}
+	return ""
+}
+
+// frameArgs returns the ffmpeg arguments extracting the video frame at the given seconds as PNG
+// image, reading the input file via the given demuxer.
+func frameArgs(seconds float64, demuxer, input, output string) []string {
+	ss := strconv.FormatFloat(seconds, 'f', -1, 64)
+	args := append([]string{"-ss", ss}, ffmpegInputArgs(demuxer, input)...)
+	return append(args, "-frames:v", "1", "-an", "-c:v", "png", output)
+}
+
+// videoFrame extracts the still frame at the given seconds of the video via the given
+// ffmpeg binary, encoded as PNG image, to be processed as any other image source.
+// ffmpeg is killed if the given request context is done or the timeout is exceeded.
+func videoFrame(ctx context.Context, ffmpeg string, buf []byte, seconds float64, timeout time.Duration) ([]byte, error) {
+	if seconds < 0 {
+		return nil, NewError("Video frame seconds must be a positive number", BadRequest)
+	}
+	demuxer := videoDemuxer(buf)
+	if demuxer == "" {
+		return nil, NewError("Unsupported video container, only MP4, MOV, WebM, Matroska and AVI videos are supported", Unsupported)
+	}
+
+	frame, err := runFFmpeg(ctx, ffmpeg, buf, "png", timeout, func(input, output string) []string {
+		return frameArgs(seconds, demuxer, input, output)
+	})
+	if os.IsNotExist(err) || (err == nil && len(frame) == 0) {
+		return nil, NewError(fmt.Sprintf("No video frame at %g seconds", seconds), BadRequest)
+	}
+	return frame, err
+}
+
+// runFFmpeg runs the given ffmpeg binary with the arguments built from temporary input
+// and output file paths, returning the output file contents of the given extension.
+// ffmpeg is killed once the given context, if any, is done or the timeout is exceeded.
+func runFFmpeg(ctx context.Context, ffmpeg string, buf []byte, ext string, timeout time.Duration, args func(input, output string) []string) ([]byte, error) {
+	if timeout == 0 {
+		timeout = videoDefaultTimeout
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	dir, err := ioutil.TempDir("", "imaginary-video")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	input, output := filepath.Join(dir, "input"), filepath.Join(dir, "output."+ext)
+	if err := ioutil.WriteFile(input, buf, 0600); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, ffmpeg, args(input, output)...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, ErrProcessingTimeout
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("ffmpeg failed: %s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return ioutil.ReadFile(output)
+}
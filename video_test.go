@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func testGIF(t *testing.T) []byte {
+	anim := &gif.GIF{}
+	for i := 0; i < 4; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, 31, 21), palette.Plan9)
+		for x := 0; x < 31; x++ {
+			frame.Set(x, (x+i)%21, color.White)
+		}
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, 10)
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		t.Fatalf("Cannot encode the GIF image: %s", err)
+	}
+	return buf.Bytes()
+}
+
+func TestFFmpegArgs(t *testing.T) {
+	args := strings.Join(ffmpegArgs("mp4", 0, 0, "in.gif", "out.mp4"), " ")
+	for _, arg := range []string{"-protocol_whitelist file -f gif -i in.gif", "scale=trunc(iw/2)*2:trunc(ih/2)*2", "-c:v libx264", "-crf 23", "+faststart"} {
+		if !strings.Contains(args, arg) {
+			t.Errorf("Missing ffmpeg argument %q: %s", arg, args)
+		}
+	}
+	if !strings.HasSuffix(args, " out.mp4") {
+		t.Errorf("Invalid ffmpeg output: %s", args)
+	}
+
+	args = strings.Join(ffmpegArgs("webm", 301, 100, "in.gif", "out.webm"), " ")
+	for _, arg := range []string{"scale=300:-2", "-c:v libvpx-vp9", "-b:v 0", "-crf 0"} {
+		if !strings.Contains(args, arg) {
+			t.Errorf("Missing ffmpeg argument %q: %s", arg, args)
+		}
+	}
+}
+
+func TestVideoErrors(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+	if _, err := Video("", 0)(buf, ImageOptions{}); err != ErrVideoDisabled {
+		t.Errorf("Expected the disabled video error, got: %v", err)
+	}
+	if _, err := Video("ffmpeg", 0)(buf, ImageOptions{}); err == nil {
+		t.Error("Expected an error converting a JPEG image")
+	}
+	if _, err := Video("ffmpeg", 0)(testGIF(t), ImageOptions{Format: "avi"}); err == nil {
+		t.Error("Expected an error with an unsupported video format")
+	}
+}
+
+func TestVideo(t *testing.T) {
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		t.Skip("ffmpeg is not installed")
+	}
+
+	for format, mime := range videoMimeTypes {
+		video, err := Video(ffmpeg, 0)(testGIF(t), ImageOptions{Format: format})
+		if err != nil {
+			t.Fatalf("Cannot convert the GIF image to %s: %s", format, err)
+		}
+		if video.Mime != mime {
+			t.Errorf("Invalid video MIME type: %s", video.Mime)
+		}
+		if len(video.Body) == 0 {
+			t.Errorf("Empty %s video", format)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Video(ffmpeg, 0)(testGIF(t), ImageOptions{Context: ctx}); err != context.Canceled {
+		t.Errorf("Expected the canceled conversion error: %v", err)
+	}
+}
+
+func TestFrameArgs(t *testing.T) {
+	args := strings.Join(frameArgs(2.5, "mov", "in", "out.png"), " ")
+	if !strings.HasPrefix(args, "-ss 2.5 ") || !strings.Contains(args, "-protocol_whitelist file -f mov -i in -frames:v 1") || !strings.HasSuffix(args, " out.png") {
+		t.Errorf("Invalid ffmpeg arguments: %s", args)
+	}
+}
+
+func TestVideoDemuxer(t *testing.T) {
+	cases := map[string]string{
+		"\x00\x00\x00\x18ftypmp42":         "mov",
+		"\x00\x00\x00\x14ftypqt  ":         "mov",
+		"\x1a\x45\xdf\xa3\x9f\x42\x86\x81": "matroska",
+		"RIFF\x00\x00\x00\x00AVI LIST":     "avi",
+		"#EXTM3U\n#EXT-X-VERSION:3":        "",
+		"GIF89a":                           "",
+	}
+	for buf, demuxer := range cases {
+		if d := videoDemuxer([]byte(buf)); d != demuxer {
+			t.Errorf("Invalid demuxer of %q: %q", buf, d)
+		}
+	}
+}
+
+func TestVideoFrame(t *testing.T) {
+	if _, err := videoFrame(context.Background(), "ffmpeg", nil, -1, 0); err == nil {
+		t.Error("Expected an error with negative frame seconds")
+	}
+	if _, err := videoFrame(context.Background(), "ffmpeg", []byte("#EXTM3U\n"), 0, 0); err == nil {
+		t.Error("Expected an error with an unsupported video container")
+	}
+
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		t.Skip("ffmpeg is not installed")
+	}
+
+	video, err := Video(ffmpeg, 0)(testGIF(t), ImageOptions{})
+	if err != nil {
+		t.Fatalf("Cannot convert the GIF image: %s", err)
+	}
+	frame, err := videoFrame(context.Background(), ffmpeg, video.Body, 0.1, 0)
+	if err != nil {
+		t.Fatalf("Cannot extract the video frame: %s", err)
+	}
+	if err := assertSize(frame, 30, 20); err != nil {
+		t.Error(err)
+	}
+	if _, err := videoFrame(context.Background(), ffmpeg, video.Body, 60, 0); err == nil {
+		t.Error("Expected an error extracting a frame beyond the video duration")
+	}
+}
@@ -0,0 +1,847 @@
+package main
+
+/*
+#cgo pkg-config: vips
+#include <stdlib.h>
+#include <stdint.h>
+#include "vips/vips.h"
+
+#define IMAGINARY_HAS_THUMBNAIL (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 6))
+#define IMAGINARY_HAS_COMPOSITE (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 6))
+#define IMAGINARY_HAS_STREAMS (VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 9))
+
+// Writes the encoded chunk of the streamed image of the given handle, exported by vips_stream.go.
+extern long long imaginaryStreamWrite(void *data, long long length, uintptr_t handle);
+
+// Reads the next chunk of the streamed source image of the given handle, exported by vips_stream.go.
+extern long long imaginarySourceRead(void *data, long long length, uintptr_t handle);
+
+static int
+imaginary_thumbnail_buffer(void *buf, size_t len, VipsImage **out, int width, int height, int crop) {
+#if IMAGINARY_HAS_THUMBNAIL
+	return vips_thumbnail_buffer(buf, len, out, width,
+		"height", height,
+		"crop", crop ? VIPS_INTERESTING_CENTRE : VIPS_INTERESTING_NONE,
+		"size", VIPS_SIZE_DOWN,
+		NULL
+	);
+#else
+	vips_error("imaginary", "vips_thumbnail requires libvips 8.6+");
+	return -1;
+#endif
+}
+
+static int
+imaginary_image_write_to_buffer(VipsImage *in, const char *suffix, void **buf, size_t *len) {
+	return vips_image_write_to_buffer(in, suffix, buf, len, NULL);
+}
+
+// Pixelates the given image area, or the whole image if the area is empty, by averaging blocks
+// of pixels and upscaling them back via nearest neighbour, within the same libvips pipeline.
+static int
+imaginary_pixelate_buffer(void *buf, size_t len, VipsImage **out, int block, int left, int top, int width, int height) {
+	VipsImage *base = vips_image_new();
+	VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 6);
+
+	if (!(t[0] = vips_image_new_from_buffer(buf, len, "", NULL)) ||
+		vips_autorot(t[0], &t[1], NULL)) {
+		g_object_unref(base);
+		return -1;
+	}
+
+	if (width <= 0 || height <= 0) {
+		left = top = 0;
+		width = vips_image_get_width(t[1]);
+		height = vips_image_get_height(t[1]);
+	}
+
+	if (vips_extract_area(t[1], &t[2], left, top, width, height, NULL) ||
+		vips_shrink(t[2], &t[3], block, block, NULL) ||
+		vips_zoom(t[3], &t[4], block, block, NULL) ||
+		vips_embed(t[4], &t[5], 0, 0, width, height, "extend", VIPS_EXTEND_COPY, NULL) ||
+		vips_insert(t[1], t[5], out, left, top, NULL)) {
+		g_object_unref(base);
+		return -1;
+	}
+
+	g_object_unref(base);
+	return 0;
+}
+
+// Smooths the noise of the given image via a median filter of the given window size.
+static int
+imaginary_median_buffer(void *buf, size_t len, VipsImage **out, int size) {
+	VipsImage *base = vips_image_new();
+	VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 2);
+
+	if (!(t[0] = vips_image_new_from_buffer(buf, len, "", NULL)) ||
+		vips_autorot(t[0], &t[1], NULL) ||
+		vips_rank(t[1], out, size, size, (size * size) / 2, NULL)) {
+		g_object_unref(base);
+		return -1;
+	}
+
+	g_object_unref(base);
+	return 0;
+}
+
+static int
+imaginary_load_buffer(void *buf, size_t len, VipsImage **out) {
+	if (!(*out = vips_image_new_from_buffer(buf, len, "", NULL))) {
+		return -1;
+	}
+	return 0;
+}
+
+// Loads the given page (or frame) of multi-page images, such as animated GIF or multi-page TIFF images.
+static int
+imaginary_page_buffer(void *buf, size_t len, VipsImage **out, int page) {
+	if (!(*out = vips_image_new_from_buffer(buf, len, "", "page", page, NULL))) {
+		return -1;
+	}
+	return 0;
+}
+
+// Loads the given page of PDF images, or SVG images if the page is negative, at the given density.
+static int
+imaginary_rasterize_buffer(void *buf, size_t len, VipsImage **out, int page, int density) {
+	if (page < 0) {
+		*out = vips_image_new_from_buffer(buf, len, "", "dpi", (double) density, NULL);
+	} else {
+		*out = vips_image_new_from_buffer(buf, len, "", "page", page, "dpi", (double) density, NULL);
+	}
+	return *out ? 0 : -1;
+}
+
+// Sets the physical resolution of the given image, in pixels per millimetre.
+static int
+imaginary_resolution_buffer(void *buf, size_t len, VipsImage **out, double resolution) {
+	VipsImage *in;
+
+	if (!(in = vips_image_new_from_buffer(buf, len, "", NULL))) {
+		return -1;
+	}
+	if (vips_copy(in, out, "xres", resolution, "yres", resolution, NULL)) {
+		g_object_unref(in);
+		return -1;
+	}
+	g_object_unref(in);
+	return 0;
+}
+
+// Returns the bits per sample of the given image, reading its header only, or -1 on error.
+static int
+imaginary_bit_depth(void *buf, size_t len) {
+	VipsImage *in;
+	int depth;
+
+	if (!(in = vips_image_new_from_buffer(buf, len, "", NULL))) {
+		return -1;
+	}
+	depth = vips_format_sizeof(vips_image_get_format(in)) * 8;
+	g_object_unref(in);
+	return depth;
+}
+
+// Resizes the given image to cover the given size, without enlarging it, then crops it to the given size
+// via the given smart crop interest, returning the resize scale and the crop area position.
+static int
+imaginary_smartcrop_buffer(void *buf, size_t len, VipsImage **out, int width, int height, int interesting, double *scale, int *left, int *top) {
+	VipsImage *base = vips_image_new();
+	VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 3);
+
+	if (!(t[0] = vips_image_new_from_buffer(buf, len, "", NULL)) ||
+		vips_autorot(t[0], &t[1], NULL)) {
+		g_object_unref(base);
+		return -1;
+	}
+
+	*scale = VIPS_MIN(1.0, VIPS_MAX((double) width / vips_image_get_width(t[1]), (double) height / vips_image_get_height(t[1])));
+	if (vips_resize(t[1], &t[2], *scale, NULL) ||
+		vips_smartcrop(t[2], out,
+			VIPS_MIN(width, vips_image_get_width(t[2])),
+			VIPS_MIN(height, vips_image_get_height(t[2])),
+			"interesting", interesting,
+			NULL)) {
+		g_object_unref(base);
+		return -1;
+	}
+
+	// The extracted area offset is the negated crop area position
+	*left = -vips_image_get_xoffset(*out);
+	*top = -vips_image_get_yoffset(*out);
+
+	g_object_unref(base);
+	return 0;
+}
+
+// Composites the given overlay onto the given image at the given position via the given blend mode,
+// scaling the overlay alpha by the given opacity, and preserving the image alpha channel, if any.
+static int
+imaginary_composite_buffer(void *buf, size_t len, void *overlay_buf, size_t overlay_len, VipsImage **out, int mode, int left, int top, double opacity) {
+#if IMAGINARY_HAS_COMPOSITE
+	VipsImage *base = vips_image_new();
+	VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 10);
+	double scale[] = {1.0, 1.0, 1.0, opacity};
+	double offset[] = {0.0, 0.0, 0.0, 0.0};
+	int alpha;
+
+	if (!(t[0] = vips_image_new_from_buffer(buf, len, "", NULL)) ||
+		vips_autorot(t[0], &t[1], NULL) ||
+		vips_colourspace(t[1], &t[2], VIPS_INTERPRETATION_sRGB, NULL) ||
+		!(t[3] = vips_image_new_from_buffer(overlay_buf, overlay_len, "", NULL)) ||
+		vips_autorot(t[3], &t[4], NULL) ||
+		vips_colourspace(t[4], &t[5], VIPS_INTERPRETATION_sRGB, NULL)) {
+		g_object_unref(base);
+		return -1;
+	}
+
+	if ((vips_image_hasalpha(t[5]) ? vips_copy(t[5], &t[6], NULL) : vips_bandjoin_const1(t[5], &t[6], 255.0, NULL)) ||
+		(opacity < 1.0 ? vips_linear(t[6], &t[7], scale, offset, 4, "uchar", TRUE, NULL) : vips_copy(t[6], &t[7], NULL))) {
+		g_object_unref(base);
+		return -1;
+	}
+
+	// The composited image always has an alpha channel, which is dropped if the image had none
+	alpha = vips_image_hasalpha(t[2]);
+	if (vips_composite2(t[2], t[7], &t[8], mode, "x", left, "y", top, NULL) ||
+		(alpha ? vips_copy(t[8], &t[9], NULL) : vips_extract_band(t[8], &t[9], 0, "n", 3, NULL)) ||
+		vips_cast(t[9], out, VIPS_FORMAT_UCHAR, NULL)) {
+		g_object_unref(base);
+		return -1;
+	}
+
+	g_object_unref(base);
+	return 0;
+#else
+	vips_error("imaginary", "vips_composite2 requires libvips 8.6+");
+	return -1;
+#endif
+}
+
+static int
+imaginary_text(VipsImage **out, const char *text, const char *font, int width, int align) {
+	return vips_text(out, text, "font", font, "width", width, "align", align, NULL);
+}
+
+#if IMAGINARY_HAS_STREAMS
+static gint64
+imaginary_target_write(VipsTargetCustom *target, const void *data, gint64 length, void *handle) {
+	return imaginaryStreamWrite((void *) data, length, (uintptr_t) handle);
+}
+#endif
+
+#if IMAGINARY_HAS_STREAMS
+static gint64
+imaginary_source_read(VipsSourceCustom *source, void *data, gint64 length, void *handle) {
+	return imaginarySourceRead(data, length, (uintptr_t) handle);
+}
+#endif
+
+// Creates the libvips source reading the streamed source image of the given handle.
+// The source is untyped, since VipsSource is not defined before libvips 8.9.
+static void *
+imaginary_source_new(uintptr_t handle) {
+#if IMAGINARY_HAS_STREAMS
+	VipsSourceCustom *source = vips_source_custom_new();
+	g_signal_connect(source, "read", G_CALLBACK(imaginary_source_read), (void *) handle);
+	return source;
+#else
+	vips_error("imaginary", "streaming requires libvips 8.9+");
+	return NULL;
+#endif
+}
+
+// Reads the dimensions and the EXIF orientation of the given source image, reading its header only.
+// The header bytes are kept by the source, so the image can be loaded again afterwards.
+static int
+imaginary_source_header(void *source, int *width, int *height, int *orientation) {
+#if IMAGINARY_HAS_STREAMS
+	VipsImage *in;
+
+	if (!(in = vips_image_new_from_source((VipsSource *) source, "", "access", VIPS_ACCESS_SEQUENTIAL, NULL))) {
+		return -1;
+	}
+	*width = vips_image_get_width(in);
+	*height = vips_image_get_height(in);
+	*orientation = 1;
+	if (vips_image_get_typeof(in, VIPS_META_ORIENTATION)) {
+		vips_image_get_int(in, VIPS_META_ORIENTATION, orientation);
+	}
+	g_object_unref(in);
+	return 0;
+#else
+	vips_error("imaginary", "streaming requires libvips 8.9+");
+	return -1;
+#endif
+}
+
+// Shrinks the given source image via vips_thumbnail, taking advantage of the shrink-on-load support.
+static int
+imaginary_thumbnail_source(void *source, VipsImage **out, int width, int height, int crop) {
+#if IMAGINARY_HAS_STREAMS
+	return vips_thumbnail_source((VipsSource *) source, out, width,
+		"height", height,
+		"crop", crop ? VIPS_INTERESTING_CENTRE : VIPS_INTERESTING_NONE,
+		"size", VIPS_SIZE_DOWN,
+		NULL
+	);
+#else
+	vips_error("imaginary", "streaming requires libvips 8.9+");
+	return -1;
+#endif
+}
+
+// Converts the given sequentially loaded image to sRGB and resizes it by the given scales if any,
+// then encodes it with the given save suffix to the streamed image of the given handle, chunk by
+// chunk, so neither the decoded nor the encoded image are fully kept in memory. The given image
+// is unreferenced.
+static int
+imaginary_stream_image(VipsImage *image, double hscale, double vscale, const char *suffix, uintptr_t handle) {
+#if IMAGINARY_HAS_STREAMS
+	VipsImage *base = vips_image_new();
+	VipsImage **t = (VipsImage **) vips_object_local_array(VIPS_OBJECT(base), 3);
+	VipsImage *in;
+	VipsTargetCustom *target;
+	int result;
+
+	t[0] = image;
+	in = t[0];
+	if (in->Type != VIPS_INTERPRETATION_sRGB && in->Type != VIPS_INTERPRETATION_B_W) {
+		if (vips_colourspace(in, &t[1], VIPS_INTERPRETATION_sRGB, NULL)) {
+			g_object_unref(base);
+			return -1;
+		}
+		in = t[1];
+	}
+	if (hscale != 1.0 || vscale != 1.0) {
+		if (vips_resize(in, &t[2], hscale, "vscale", vscale, NULL)) {
+			g_object_unref(base);
+			return -1;
+		}
+		in = t[2];
+	}
+
+	target = vips_target_custom_new();
+	g_signal_connect(target, "write", G_CALLBACK(imaginary_target_write), (void *) handle);
+	result = vips_image_write_to_target(in, suffix, VIPS_TARGET(target), NULL);
+	g_object_unref(target);
+	g_object_unref(base);
+	return result;
+#else
+	vips_error("imaginary", "streaming requires libvips 8.9+");
+	return -1;
+#endif
+}
+
+// Loads the given image via sequential access, then streams it as imaginary_stream_image does.
+static int
+imaginary_stream_buffer(void *buf, size_t len, double hscale, double vscale, const char *suffix, uintptr_t handle) {
+#if IMAGINARY_HAS_STREAMS
+	VipsImage *in;
+
+	if (!(in = vips_image_new_from_buffer(buf, len, "", "access", VIPS_ACCESS_SEQUENTIAL, NULL))) {
+		return -1;
+	}
+	return imaginary_stream_image(in, hscale, vscale, suffix, handle);
+#else
+	vips_error("imaginary", "streaming requires libvips 8.9+");
+	return -1;
+#endif
+}
+
+// Loads the given source image via sequential access, then streams it as imaginary_stream_image does,
+// so the source image is not fully kept in memory either.
+static int
+imaginary_stream_source(void *source, double hscale, double vscale, const char *suffix, uintptr_t handle) {
+#if IMAGINARY_HAS_STREAMS
+	VipsImage *in;
+
+	if (!(in = vips_image_new_from_source((VipsSource *) source, "", "access", VIPS_ACCESS_SEQUENTIAL, NULL))) {
+		return -1;
+	}
+	return imaginary_stream_image(in, hscale, vscale, suffix, handle);
+#else
+	vips_error("imaginary", "streaming requires libvips 8.9+");
+	return -1;
+#endif
+}
+*/
+import "C"
+
+import (
+	"context"
+	"errors"
+	"image"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// VipsOptions represents the libvips runtime tuning params.
+// Negative values preserve the bimg defaults.
+type VipsOptions struct {
+	CacheMax    int
+	CacheMaxMem int
+	Concurrency int
+	LeakCheck   bool
+}
+
+// ConfigureVips applies the given tuning params to the already initialized libvips runtime.
+func ConfigureVips(o VipsOptions) {
+	if o.CacheMax >= 0 {
+		bimg.VipsCacheSetMax(o.CacheMax)
+	}
+	if o.CacheMaxMem >= 0 {
+		bimg.VipsCacheSetMaxMem(o.CacheMaxMem)
+	}
+	if o.Concurrency > 0 {
+		C.vips_concurrency_set(C.int(o.Concurrency))
+	}
+	if o.LeakCheck {
+		C.vips_leak_set(C.TRUE)
+	}
+}
+
+// serveUntilInterrupted serves the requests via the given serve function until the process is
+// interrupted, then drains the given server until the in flight requests are served, or the
+// drain timeout is exceeded, before shutting down libvips, which is when libvips reports the
+// leaked objects and memory. libvips is not shut down if the drain times out, since images are
+// still processed.
+func serveUntilInterrupted(s *http.Server, serve func() error, drainTimeout int) error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- serve()
+	}()
+	select {
+	case err := <-errs:
+		return err
+	case <-signals:
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(drainTimeout)*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		return err
+	}
+	bimg.Shutdown()
+	return nil
+}
+
+// getVipsOptions reads the libvips tuning params, honoring the equivalent environment variables if the flags are not defined.
+func getVipsOptions(cacheMax, cacheMaxMem, concurrency int, leakCheck bool) VipsOptions {
+	return VipsOptions{
+		CacheMax:    getEnvInt("VIPS_CACHE_MAX", cacheMax),
+		CacheMaxMem: getEnvInt("VIPS_CACHE_MAX_MEM", cacheMaxMem),
+		Concurrency: getEnvInt("VIPS_CONCURRENCY", concurrency),
+		LeakCheck:   leakCheck || os.Getenv("VIPS_LEAK") != "",
+	}
+}
+
+func getEnvInt(name string, value int) int {
+	if value >= 0 {
+		return value
+	}
+	if env := os.Getenv(name); env != "" {
+		if n, err := strconv.Atoi(env); err == nil {
+			return n
+		}
+	}
+	return value
+}
+
+// vipsMaxCoord is used as the unconstrained axis size for vips_thumbnail.
+const vipsMaxCoord = 10000000
+
+// vipsThumbnail shrinks the given image buffer via vips_thumbnail, which takes advantage
+// of the shrink-on-load support of the image loaders (JPEG, WebP...), and encodes the
+// output using the given libvips save suffix, such as ".jpg[Q=80]".
+func vipsThumbnail(buf []byte, width, height int, crop bool, suffix string) ([]byte, error) {
+	defer C.vips_thread_shutdown()
+
+	if len(buf) == 0 {
+		return nil, errors.New("Image buffer is empty")
+	}
+	if width == 0 {
+		width = vipsMaxCoord
+	}
+	if height == 0 {
+		height = vipsMaxCoord
+	}
+
+	var image *C.VipsImage
+	imageBuf := unsafe.Pointer(&buf[0])
+	err := C.imaginary_thumbnail_buffer(imageBuf, C.size_t(len(buf)), &image, C.int(width), C.int(height), C.int(boolToInt(crop)))
+	if err != 0 {
+		return nil, vipsError()
+	}
+	defer C.g_object_unref(C.gpointer(image))
+
+	return vipsSave(image, suffix)
+}
+
+// vipsPixelate pixelates the given image area, or the whole image if the area is empty,
+// with square blocks of the given size, encoding the output with the given save suffix.
+func vipsPixelate(buf []byte, block int, area image.Rectangle, suffix string) ([]byte, error) {
+	defer C.vips_thread_shutdown()
+
+	if len(buf) == 0 {
+		return nil, errors.New("Image buffer is empty")
+	}
+
+	var out *C.VipsImage
+	imageBuf := unsafe.Pointer(&buf[0])
+	err := C.imaginary_pixelate_buffer(imageBuf, C.size_t(len(buf)), &out, C.int(block),
+		C.int(area.Min.X), C.int(area.Min.Y), C.int(area.Dx()), C.int(area.Dy()))
+	if err != 0 {
+		return nil, vipsError()
+	}
+	defer C.g_object_unref(C.gpointer(out))
+
+	return vipsSave(out, suffix)
+}
+
+// vipsMedian applies a median filter of the given window size to the given image,
+// encoding the output with the given save suffix.
+func vipsMedian(buf []byte, size int, suffix string) ([]byte, error) {
+	defer C.vips_thread_shutdown()
+
+	if len(buf) == 0 {
+		return nil, errors.New("Image buffer is empty")
+	}
+
+	var out *C.VipsImage
+	imageBuf := unsafe.Pointer(&buf[0])
+	if C.imaginary_median_buffer(imageBuf, C.size_t(len(buf)), &out, C.int(size)) != 0 {
+		return nil, vipsError()
+	}
+	defer C.g_object_unref(C.gpointer(out))
+
+	return vipsSave(out, suffix)
+}
+
+// vipsEncode re-encodes the given image with the given save suffix, exposing the
+// libvips save options that bimg does not support, such as ".webp[near_lossless]".
+func vipsEncode(buf []byte, suffix string) ([]byte, error) {
+	defer C.vips_thread_shutdown()
+
+	if len(buf) == 0 {
+		return nil, errors.New("Image buffer is empty")
+	}
+
+	var out *C.VipsImage
+	imageBuf := unsafe.Pointer(&buf[0])
+	if C.imaginary_load_buffer(imageBuf, C.size_t(len(buf)), &out) != 0 {
+		return nil, vipsError()
+	}
+	defer C.g_object_unref(C.gpointer(out))
+
+	return vipsSave(out, suffix)
+}
+
+// vipsPage loads the given page of the multi-page image, encoding it with the given save suffix.
+func vipsPage(buf []byte, page int, suffix string) ([]byte, error) {
+	defer C.vips_thread_shutdown()
+
+	if len(buf) == 0 {
+		return nil, errors.New("Image buffer is empty")
+	}
+
+	var out *C.VipsImage
+	imageBuf := unsafe.Pointer(&buf[0])
+	if C.imaginary_page_buffer(imageBuf, C.size_t(len(buf)), &out, C.int(page)) != 0 {
+		return nil, vipsError()
+	}
+	defer C.g_object_unref(C.gpointer(out))
+
+	return vipsSave(out, suffix)
+}
+
+// vipsRasterize loads the given page of the PDF image, or the SVG image if the page is negative,
+// at the given density, encoding it with the given save suffix.
+func vipsRasterize(buf []byte, page, density int, suffix string) ([]byte, error) {
+	defer C.vips_thread_shutdown()
+
+	if len(buf) == 0 {
+		return nil, errors.New("Image buffer is empty")
+	}
+
+	var out *C.VipsImage
+	imageBuf := unsafe.Pointer(&buf[0])
+	if C.imaginary_rasterize_buffer(imageBuf, C.size_t(len(buf)), &out, C.int(page), C.int(density)) != 0 {
+		return nil, vipsError()
+	}
+	defer C.g_object_unref(C.gpointer(out))
+
+	return vipsSave(out, suffix)
+}
+
+// vipsResolution sets the physical resolution, in pixels per millimetre, of the given image,
+// encoding it with the given save suffix.
+func vipsResolution(buf []byte, resolution float64, suffix string) ([]byte, error) {
+	defer C.vips_thread_shutdown()
+
+	if len(buf) == 0 {
+		return nil, errors.New("Image buffer is empty")
+	}
+
+	var out *C.VipsImage
+	imageBuf := unsafe.Pointer(&buf[0])
+	if C.imaginary_resolution_buffer(imageBuf, C.size_t(len(buf)), &out, C.double(resolution)) != 0 {
+		return nil, vipsError()
+	}
+	defer C.g_object_unref(C.gpointer(out))
+
+	return vipsSave(out, suffix)
+}
+
+// vipsBitDepth returns the bits per sample of the given image, such as 16 for 16-bit PNG images.
+func vipsBitDepth(buf []byte) (int, error) {
+	defer C.vips_thread_shutdown()
+
+	if len(buf) == 0 {
+		return 0, errors.New("Image buffer is empty")
+	}
+
+	depth := C.imaginary_bit_depth(unsafe.Pointer(&buf[0]), C.size_t(len(buf)))
+	if depth < 0 {
+		return 0, vipsError()
+	}
+	return int(depth), nil
+}
+
+// Smart crop interests, matching the libvips VipsInteresting enum
+const (
+	vipsInterestingEntropy   = 2
+	vipsInterestingAttention = 3
+)
+
+// vipsSmartCrop resizes the given image to cover the given size, then crops it via the given smart
+// crop interest, encoding it with the given save suffix, and returning the source image crop area.
+func vipsSmartCrop(buf []byte, width, height, interesting int, suffix string) ([]byte, CropBox, error) {
+	defer C.vips_thread_shutdown()
+
+	if len(buf) == 0 {
+		return nil, CropBox{}, errors.New("Image buffer is empty")
+	}
+
+	var out *C.VipsImage
+	var scale C.double
+	var left, top C.int
+	imageBuf := unsafe.Pointer(&buf[0])
+	if C.imaginary_smartcrop_buffer(imageBuf, C.size_t(len(buf)), &out, C.int(width), C.int(height), C.int(interesting), &scale, &left, &top) != 0 {
+		return nil, CropBox{}, vipsError()
+	}
+	defer C.g_object_unref(C.gpointer(out))
+
+	s := float64(scale)
+	box := CropBox{
+		Left:   int(float64(left)/s + 0.5),
+		Top:    int(float64(top)/s + 0.5),
+		Width:  int(float64(C.vips_image_get_width(out))/s + 0.5),
+		Height: int(float64(C.vips_image_get_height(out))/s + 0.5),
+	}
+
+	body, err := vipsSave(out, suffix)
+	return body, box, err
+}
+
+// Composite blend modes, matching the libvips VipsBlendMode enum
+const (
+	vipsBlendModeOver     = 2
+	vipsBlendModeMultiply = 14
+	vipsBlendModeScreen   = 15
+	vipsBlendModeOverlay  = 16
+)
+
+// vipsComposite composites the overlay image onto the given image at the given position, via the
+// given blend mode and opacity, encoding the output with the given save suffix.
+func vipsComposite(buf, overlay []byte, mode int, at image.Point, opacity float64, suffix string) ([]byte, error) {
+	defer C.vips_thread_shutdown()
+
+	if len(buf) == 0 || len(overlay) == 0 {
+		return nil, errors.New("Image buffer is empty")
+	}
+
+	var out *C.VipsImage
+	imageBuf := unsafe.Pointer(&buf[0])
+	overlayBuf := unsafe.Pointer(&overlay[0])
+	if C.imaginary_composite_buffer(imageBuf, C.size_t(len(buf)), overlayBuf, C.size_t(len(overlay)), &out,
+		C.int(mode), C.int(at.X), C.int(at.Y), C.double(opacity)) != 0 {
+		return nil, vipsError()
+	}
+	defer C.g_object_unref(C.gpointer(out))
+
+	return vipsSave(out, suffix)
+}
+
+// vipsStream loads the given image via sequential access, resizing it by the given scales, if any,
+// and encodes it with the given save suffix to the streamed image of the given handle.
+func vipsStream(buf []byte, hscale, vscale float64, suffix string, handle uintptr) error {
+	defer C.vips_thread_shutdown()
+
+	if len(buf) == 0 {
+		return errors.New("Image buffer is empty")
+	}
+
+	csuffix := C.CString(suffix)
+	defer C.free(unsafe.Pointer(csuffix))
+
+	imageBuf := unsafe.Pointer(&buf[0])
+	if C.imaginary_stream_buffer(imageBuf, C.size_t(len(buf)), C.double(hscale), C.double(vscale), csuffix, C.uintptr_t(handle)) != 0 {
+		return vipsError()
+	}
+	return nil
+}
+
+// vipsStreamSource loads the streamed source image of the given source handle via sequential access,
+// and streams it as vipsStream does, without buffering the source image. The accept function is called
+// with the source image dimensions and EXIF orientation, read from its header, before the image is
+// decoded, returning the scales and the save suffix of the output image. It reports whether the source
+// image was accepted, since its header is consumed otherwise.
+func vipsStreamSource(sourceHandle, handle uintptr, accept func(bimg.ImageSize, int) (float64, float64, string, error)) (bool, error) {
+	defer C.vips_thread_shutdown()
+
+	source := C.imaginary_source_new(C.uintptr_t(sourceHandle))
+	if source == nil {
+		return false, vipsError()
+	}
+	defer C.g_object_unref(C.gpointer(source))
+
+	var sourceWidth, sourceHeight, orientation C.int
+	if C.imaginary_source_header(source, &sourceWidth, &sourceHeight, &orientation) != 0 {
+		return false, vipsError()
+	}
+	hscale, vscale, suffix, err := accept(bimg.ImageSize{Width: int(sourceWidth), Height: int(sourceHeight)}, int(orientation))
+	if err != nil {
+		return false, err
+	}
+
+	csuffix := C.CString(suffix)
+	defer C.free(unsafe.Pointer(csuffix))
+
+	if C.imaginary_stream_source(source, C.double(hscale), C.double(vscale), csuffix, C.uintptr_t(handle)) != 0 {
+		return true, vipsError()
+	}
+	return true, nil
+}
+
+// vipsThumbnailSource shrinks the streamed source image of the given handle via vips_thumbnail, as
+// vipsThumbnail does, without buffering the source image. The accept function is called with the
+// source image dimensions and EXIF orientation, read from its header, before the image is decoded.
+// It reports whether the source image was accepted, since its header is consumed otherwise.
+func vipsThumbnailSource(handle uintptr, width, height int, crop bool, suffix string, accept func(bimg.ImageSize, int) error) ([]byte, bool, error) {
+	defer C.vips_thread_shutdown()
+
+	source := C.imaginary_source_new(C.uintptr_t(handle))
+	if source == nil {
+		return nil, false, vipsError()
+	}
+	defer C.g_object_unref(C.gpointer(source))
+
+	var sourceWidth, sourceHeight, orientation C.int
+	if C.imaginary_source_header(source, &sourceWidth, &sourceHeight, &orientation) != 0 {
+		return nil, false, vipsError()
+	}
+	if err := accept(bimg.ImageSize{Width: int(sourceWidth), Height: int(sourceHeight)}, int(orientation)); err != nil {
+		return nil, false, err
+	}
+
+	if width == 0 {
+		width = vipsMaxCoord
+	}
+	if height == 0 {
+		height = vipsMaxCoord
+	}
+
+	var image *C.VipsImage
+	if C.imaginary_thumbnail_source(source, &image, C.int(width), C.int(height), C.int(boolToInt(crop))) != 0 {
+		return nil, true, vipsError()
+	}
+	defer C.g_object_unref(C.gpointer(image))
+
+	body, err := vipsSave(image, suffix)
+	return body, true, err
+}
+
+// vipsSave encodes the given image using the given libvips save suffix.
+func vipsSave(image *C.VipsImage, suffix string) ([]byte, error) {
+	var ptr unsafe.Pointer
+	length := C.size_t(0)
+	csuffix := C.CString(suffix)
+	defer C.free(unsafe.Pointer(csuffix))
+
+	if C.imaginary_image_write_to_buffer(image, csuffix, &ptr, &length) != 0 {
+		return nil, vipsError()
+	}
+	defer C.g_free(C.gpointer(ptr))
+
+	return C.GoBytes(ptr, C.int(length)), nil
+}
+
+// Text alignment modes, matching the libvips VipsAlign enum
+const (
+	textAlignLeft = iota
+	textAlignCentre
+	textAlignRight
+)
+
+// vipsTextMask renders the given text via libvips (Pango), returning the
+// anti-aliased text mask wrapped and aligned within the given width.
+func vipsTextMask(text, font string, width, align int) (*image.Alpha, error) {
+	defer C.vips_thread_shutdown()
+
+	ctext := C.CString(text)
+	defer C.free(unsafe.Pointer(ctext))
+	cfont := C.CString(font)
+	defer C.free(unsafe.Pointer(cfont))
+
+	var out *C.VipsImage
+	if C.imaginary_text(&out, ctext, cfont, C.int(width), C.int(align)) != 0 {
+		return nil, vipsError()
+	}
+	defer C.g_object_unref(C.gpointer(out))
+
+	length := C.size_t(0)
+	ptr := C.vips_image_write_to_memory(out, &length)
+	if ptr == nil {
+		return nil, vipsError()
+	}
+	defer C.g_free(C.gpointer(ptr))
+
+	mask := image.NewAlpha(image.Rect(0, 0, int(C.vips_image_get_width(out)), int(C.vips_image_get_height(out))))
+	copy(mask.Pix, C.GoBytes(ptr, C.int(length)))
+	return mask, nil
+}
+
+// vipsOperationExists reports whether the given libvips operation, such as heifload_buffer, is compiled in
+func vipsOperationExists(name string) bool {
+	cbase := C.CString("VipsOperation")
+	defer C.free(unsafe.Pointer(cbase))
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	return C.vips_type_find(cbase, cname) != 0
+}
+
+func vipsError() error {
+	s := C.GoString(C.vips_error_buffer())
+	C.vips_error_clear()
+	return errors.New(s)
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
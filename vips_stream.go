@@ -0,0 +1,33 @@
+package main
+
+/*
+#include <stdint.h>
+*/
+import "C"
+
+import "unsafe"
+
+// imaginaryStreamWrite writes the encoded chunk of the streamed image of the given handle,
+// called by libvips, returning the written length, or -1 to abort the encoding.
+//
+//export imaginaryStreamWrite
+func imaginaryStreamWrite(data unsafe.Pointer, length C.longlong, handle C.uintptr_t) C.longlong {
+	// The chunk is written without copying it, since the writers must not retain it
+	if !writeStreamChunk(uintptr(handle), (*[1 << 30]byte)(data)[:length:length]) {
+		return -1
+	}
+	return length
+}
+
+// imaginarySourceRead reads the next chunk of the streamed source image of the given handle into
+// the given libvips buffer, returning the read length, 0 at the end of the image, or -1 on error.
+//
+//export imaginarySourceRead
+func imaginarySourceRead(data unsafe.Pointer, length C.longlong, handle C.uintptr_t) C.longlong {
+	chunk := (*[1 << 30]byte)(data)[:length:length]
+	n, ok := readSourceChunk(uintptr(handle), chunk)
+	if !ok {
+		return -1
+	}
+	return C.longlong(n)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net"
+	"net/url"
+	"strings"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// warmupTypes are the output image types encoded by the warm-up, loading their libvips savers,
+// if supported by the libvips build
+var warmupTypes = []bimg.ImageType{bimg.JPEG, bimg.PNG, bimg.WEBP}
+
+// warmupImage returns a generated gradient PNG image processed by the warm-up
+func warmupImage() []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * 4), uint8(y * 4), 128, 255})
+		}
+	}
+	buf := &bytes.Buffer{}
+	png.Encode(buf, img)
+	return buf.Bytes()
+}
+
+// warmupFonts returns the fonts rendered by the placeholder, error and social media card images
+func warmupFonts(o ServerOptions) []string {
+	fonts := []string{"sans 12", "sans bold 12"}
+	for _, t := range o.OGTemplates {
+		for _, font := range []string{t.Title.Font, t.Subtitle.Font} {
+			if font != "" {
+				fonts = append(fonts, font)
+			}
+		}
+	}
+	return fonts
+}
+
+// warmupHosts returns the hosts of the allowed origins, the rewrite rules URL sources and
+// the moderation service, ignoring the wildcard and templated hosts.
+func warmupHosts(o ServerOptions) []string {
+	urls := []*url.URL{}
+	urls = append(urls, o.AllowedOrigins...)
+	if o.RewriteRules != nil {
+		for _, rule := range o.RewriteRules.Rules {
+			if u, err := url.Parse(rule.URL); err == nil && rule.URL != "" {
+				urls = append(urls, u)
+			}
+		}
+	}
+	if moderator, ok := o.Moderation.Moderator.(*HTTPModerator); ok {
+		if u, err := url.Parse(moderator.URL); err == nil {
+			urls = append(urls, u)
+		}
+	}
+
+	hosts := []string{}
+	seen := map[string]bool{}
+	for _, u := range urls {
+		host := u.Hostname()
+		if host == "" || seen[host] || strings.ContainsAny(host, "*{}") || net.ParseIP(host) != nil {
+			continue
+		}
+		seen[host] = true
+		hosts = append(hosts, host)
+	}
+	return hosts
+}
+
+// warmupWatermarks returns the absolute overlay image URLs of the rewrite rules and request
+// scripts params and presets, ignoring the templated URLs.
+func warmupWatermarks(o ServerOptions) []string {
+	params := []map[string]interface{}{}
+	if o.RewriteRules != nil {
+		for _, rule := range o.RewriteRules.Rules {
+			params = append(params, rule.Params)
+		}
+		for _, name := range sortedKeys(o.RewriteRules.Presets) {
+			params = append(params, o.RewriteRules.Presets[name])
+		}
+	}
+	if o.Scripts != nil {
+		for _, name := range sortedKeys(o.Scripts.Presets) {
+			params = append(params, o.Scripts.Presets[name])
+		}
+	}
+
+	urls := []string{}
+	seen := map[string]bool{}
+	for _, p := range params {
+		rawurl, _ := p["image"].(string)
+		if u, err := url.Parse(rawurl); err != nil || u.Host == "" || seen[rawurl] || strings.ContainsAny(rawurl, "{}") {
+			continue
+		}
+		seen[rawurl] = true
+		urls = append(urls, rawurl)
+	}
+	return urls
+}
+
+// Warmup pre-initializes the libvips operations and fonts, validates the placeholder image, which
+// is the fallback image of the errors, and the configured watermark images, and resolves the
+// configured origin hosts, so the first requests after a deploy are not slower. Unresolved hosts
+// and unavailable watermarks are not fatal, since the origins may be temporarily unavailable.
+func Warmup(o ServerOptions) error {
+	buf := warmupImage()
+	for _, imageType := range warmupTypes {
+		if !bimg.IsTypeSupportedSave(imageType) {
+			debug("skipping the unsupported %s warm-up image type", bimg.ImageTypeName(imageType))
+			continue
+		}
+		if _, err := Process(buf, bimg.Options{Width: 32, Height: 32, Crop: true, Type: imageType}); err != nil {
+			return fmt.Errorf("cannot encode the %s warm-up image: %s", bimg.ImageTypeName(imageType), err)
+		}
+	}
+
+	for _, font := range warmupFonts(o) {
+		if _, err := vipsTextMask("imaginary", font, 100, textAlignCentre); err != nil {
+			return fmt.Errorf("cannot render the %s font: %s", font, err)
+		}
+	}
+
+	if len(o.PlaceholderImage) > 0 {
+		if _, err := Process(o.PlaceholderImage, bimg.Options{Width: 32, Height: 32, Crop: true}); err != nil {
+			return fmt.Errorf("cannot process the placeholder image: %s", err)
+		}
+	}
+
+	for _, rawurl := range warmupWatermarks(o) {
+		image, err := fetchOverlayImage(context.Background(), rawurl)
+		if err != nil {
+			debug("cannot fetch the %s watermark image: %s", rawurl, err)
+			continue
+		}
+		if _, err := Process(image, bimg.Options{Width: 32, Height: 32, Crop: true}); err != nil {
+			return fmt.Errorf("cannot process the %s watermark image: %s", rawurl, err)
+		}
+	}
+
+	for _, host := range warmupHosts(o) {
+		if _, err := net.LookupHost(host); err != nil {
+			debug("cannot resolve the %s origin host: %s", host, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestWarmupHosts(t *testing.T) {
+	rules, err := parseRewriteRules([]byte(`{"rules": [
+		{"pattern": "/thumbs/{path}", "endpoint": "resize", "url": "https://cdn.example.com/{path}"},
+		{"pattern": "/tenants/{tenant}/{path}", "endpoint": "resize", "url": "https://{tenant}.example.com/{path}"},
+		{"pattern": "/avatars/{path}", "endpoint": "resize", "file": "avatars/{path}"}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := ServerOptions{
+		AllowedOrigins: parseOrigins("https://images.example.com,https://*.example.org,http://10.0.0.1:8080,https://cdn.example.com"),
+		RewriteRules:   rules,
+		Moderation:     ModerationOptions{Moderator: &HTTPModerator{URL: "http://moderation.internal:9000/classify"}},
+	}
+	hosts := warmupHosts(o)
+	if !reflect.DeepEqual(hosts, []string{"images.example.com", "cdn.example.com", "moderation.internal"}) {
+		t.Errorf("Invalid warm-up hosts: %#v", hosts)
+	}
+}
+
+func TestWarmupWatermarks(t *testing.T) {
+	rules, err := parseRewriteRules([]byte(`{"presets": {"brand": {"image": "https://cdn.example.com/logo.png"}}, "rules": [
+		{"pattern": "/thumbs/{path}", "endpoint": "composite", "params": {"image": "https://cdn.example.com/logo.png"}, "url": "https://cdn.example.com/{path}"},
+		{"pattern": "/tenants/{tenant}/{path}", "endpoint": "composite", "params": {"image": "https://{tenant}.example.com/logo.png"}, "url": "https://cdn.example.com/{path}"},
+		{"pattern": "/avatars/{path}", "endpoint": "composite", "params": {"image": "https://cdn.example.com/badge.png"}, "file": "avatars/{path}"}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := ServerOptions{RewriteRules: rules}
+	urls := warmupWatermarks(o)
+	if !reflect.DeepEqual(urls, []string{"https://cdn.example.com/logo.png", "https://cdn.example.com/badge.png"}) {
+		t.Errorf("Invalid warm-up watermarks: %#v", urls)
+	}
+}
+
+func TestWarmupFonts(t *testing.T) {
+	o := ServerOptions{OGTemplates: map[string]*OGTemplate{"blog": {Title: OGText{Font: "serif bold 48"}}}}
+	if fonts := warmupFonts(o); !reflect.DeepEqual(fonts, []string{"sans 12", "sans bold 12", "serif bold 48"}) {
+		t.Errorf("Invalid warm-up fonts: %#v", fonts)
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	if err := Warmup(ServerOptions{AllowedOrigins: []*url.URL{}}); err != nil {
+		t.Errorf("Cannot warm up: %s", err)
+	}
+	if err := Warmup(ServerOptions{PlaceholderImage: []byte("not an image")}); err == nil {
+		t.Error("Expected invalid placeholder image error")
+	}
+}
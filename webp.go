@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// Maximum WebP encoding params
+const (
+	maxNearLossless = 100
+	maxWebPEffort   = 6
+)
+
+// WebP wraps the given operation, encoding its WebP output with the near-lossless preprocessing
+// level and the compression effort params, which are not supported by bimg, directly via libvips.
+func WebP(operation Operation) Operation {
+	return func(buf []byte, o ImageOptions) (Image, error) {
+		if outputOptions(buf, o).Type != bimg.WEBP {
+			return operation(buf, o)
+		}
+		if o.NearLossless < 0 || o.NearLossless > maxNearLossless {
+			return Image{}, NewError(fmt.Sprintf("Near-lossless level must be between 0 and %d", maxNearLossless), BadRequest)
+		}
+		if o.Effort < 0 || o.Effort > maxWebPEffort {
+			return Image{}, NewError(fmt.Sprintf("WebP effort must be between 0 and %d", maxWebPEffort), BadRequest)
+		}
+
+		image, err := losslessOutput(operation, buf, o)
+		if err != nil || image.Mime != "image/png" {
+			return image, err
+		}
+
+		body, err := vipsEncode(image.Body, webpSaveSuffix(o))
+		if err != nil {
+			return Image{}, err
+		}
+		return Image{Body: body, Mime: "image/webp"}, nil
+	}
+}
+
+// webpSaveSuffix returns the libvips WebP save suffix of the given params, where the
+// near-lossless level, the lower the smaller the output, is defined via the Q option.
+func webpSaveSuffix(o ImageOptions) string {
+	quality := o.Quality
+	if quality == 0 {
+		quality = bimg.Quality
+	}
+
+	options := ""
+	switch {
+	case o.NearLossless > 0:
+		options = fmt.Sprintf("near_lossless,Q=%d", o.NearLossless)
+	case o.Lossless:
+		options = fmt.Sprintf("lossless,Q=%d", quality)
+	default:
+		options = fmt.Sprintf("Q=%d", quality)
+	}
+	if o.Effort > 0 {
+		options += fmt.Sprintf(",reduction_effort=%d", o.Effort)
+	}
+	if o.StripMetadata {
+		options += ",strip"
+	}
+	return ".webp[" + options + "]"
+}
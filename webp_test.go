@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+func TestWebPSaveSuffix(t *testing.T) {
+	cases := []struct {
+		options  ImageOptions
+		expected string
+	}{
+		{ImageOptions{}, ".webp[Q=80]"},
+		{ImageOptions{Lossless: true, Effort: 6}, ".webp[lossless,Q=80,reduction_effort=6]"},
+		{ImageOptions{NearLossless: 60, Lossless: true, StripMetadata: true}, ".webp[near_lossless,Q=60,strip]"},
+	}
+
+	for _, c := range cases {
+		if suffix := webpSaveSuffix(c.options); suffix != c.expected {
+			t.Errorf("Invalid WebP save suffix: %s != %s", suffix, c.expected)
+		}
+	}
+}
+
+func TestWebP(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+
+	lossy, err := Resize(buf, ImageOptions{Width: 300, Height: 200, Type: "webp"})
+	if err != nil {
+		t.Fatalf("Cannot resize the image: %s", err)
+	}
+	lossless, err := Resize(buf, ImageOptions{Width: 300, Height: 200, Type: "webp", Lossless: true})
+	if err != nil {
+		t.Fatalf("Cannot resize the image losslessly: %s", err)
+	}
+	if len(lossless.Body) <= len(lossy.Body) {
+		t.Errorf("Invalid lossless image size: %d <= %d", len(lossless.Body), len(lossy.Body))
+	}
+
+	image, err := WebP(Resize)(buf, ImageOptions{Width: 300, Height: 200, Type: "webp", NearLossless: 60, Effort: 6})
+	if err != nil {
+		t.Fatalf("Cannot encode the near-lossless image: %s", err)
+	}
+	if bimg.DetermineImageType(image.Body) != bimg.WEBP {
+		t.Error("Invalid image type")
+	}
+	if err := assertSize(image.Body, 300, 200); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := WebP(Resize)(buf, ImageOptions{Width: 300, Type: "webp", Effort: 10}); err == nil {
+		t.Error("Expected an error with an invalid effort")
+	}
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Worker defaults
+const (
+	workerWaitTime    = 20
+	workerMaxMessages = 10
+	workerKeyTemplate = "{rendition}/{name}.{ext}"
+)
+
+var workerClient = &http.Client{Timeout: 60 * time.Second}
+
+// WorkerOptions represents the pre-processing worker configuration file, defining the SQS
+// queue notified of the newly uploaded original images, the renditions generated of every
+// original image and the S3 bucket storing them. The image URLs of the messages are restricted
+// by the server allowed origins and maximum size, as the HTTP image source.
+type WorkerOptions struct {
+	Queue          string            `json:"queue"`
+	WaitTime       int               `json:"waitTime"`
+	Concurrency    int               `json:"concurrency"`
+	S3Endpoint     string            `json:"s3Endpoint"`
+	AWS            *AWSCredential    `json:"aws"`
+	Destination    WorkerDestination `json:"destination"`
+	Renditions     []WorkerRendition `json:"renditions"`
+	AllowedOrigins []*url.URL        `json:"-"`
+	MaxAllowedSize int               `json:"-"`
+}
+
+// WorkerDestination represents the S3 bucket storing the renditions, whose object keys are
+// defined by the key template placeholders: {rendition}, {key}, {name}, {dir} and {ext}.
+type WorkerDestination struct {
+	Bucket       string `json:"bucket"`
+	Region       string `json:"region"`
+	Key          string `json:"key"`
+	CacheControl string `json:"cacheControl"`
+}
+
+// WorkerRendition represents a named image rendition, generated by the given pipeline operations
+type WorkerRendition struct {
+	Name       string             `json:"name"`
+	Operations PipelineOperations `json:"operations"`
+}
+
+// workerObject represents an original image referenced by a queue message
+type workerObject struct {
+	Bucket string
+	Key    string
+	Region string
+	URL    string
+}
+
+// workerMessage represents a received queue message
+type workerMessage struct {
+	Body          string
+	ReceiptHandle string
+}
+
+// LoadWorkerOptions loads the pre-processing worker configuration JSON file
+func LoadWorkerOptions(path string) (WorkerOptions, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return WorkerOptions{}, err
+	}
+	return parseWorkerOptions(buf)
+}
+
+// parseWorkerOptions parses and validates the worker configuration, filling its defaults
+func parseWorkerOptions(buf []byte) (WorkerOptions, error) {
+	var o WorkerOptions
+	if err := json.Unmarshal(buf, &o); err != nil {
+		return o, err
+	}
+
+	if u, err := url.Parse(o.Queue); err != nil || u.Host == "" {
+		return o, fmt.Errorf("invalid SQS queue URL: %s", o.Queue)
+	}
+	if o.WaitTime <= 0 || o.WaitTime > workerWaitTime {
+		o.WaitTime = workerWaitTime
+	}
+	if o.Concurrency <= 0 {
+		o.Concurrency = 1
+	}
+	if o.AWS == nil {
+		o.AWS = &AWSCredential{}
+	}
+	if err := o.AWS.load(); err != nil {
+		return o, fmt.Errorf("aws credentials: %s", err)
+	}
+
+	if o.Destination.Bucket == "" {
+		return o, fmt.Errorf("missing destination bucket")
+	}
+	if o.Destination.Region == "" {
+		o.Destination.Region = o.AWS.Region
+	}
+	if o.Destination.Key == "" {
+		o.Destination.Key = workerKeyTemplate
+	}
+
+	if len(o.Renditions) == 0 {
+		return o, fmt.Errorf("missing renditions")
+	}
+	names := map[string]bool{}
+	for _, rendition := range o.Renditions {
+		if rendition.Name == "" || names[rendition.Name] {
+			return o, fmt.Errorf("missing or duplicated rendition name: %q", rendition.Name)
+		}
+		names[rendition.Name] = true
+		if len(rendition.Operations) == 0 {
+			return o, fmt.Errorf("rendition %s has no operations", rendition.Name)
+		}
+		for _, operation := range rendition.Operations {
+			if _, exists := OperationsMap[operation.Name]; !exists {
+				return o, fmt.Errorf("rendition %s has unsupported operation: %s", rendition.Name, operation.Name)
+			}
+		}
+	}
+	return o, nil
+}
+
+// RunWorker consumes the queue messages forever, generating the renditions of the original
+// images they reference. Messages are deleted once every rendition is stored, so failed
+// messages are received again after the queue visibility timeout.
+func RunWorker(o WorkerOptions) {
+	queue := &sqsQueue{URL: o.Queue, WaitTime: o.WaitTime, AWS: awsService(o.AWS, "sqs", o.AWS.Region)}
+	messages := make(chan workerMessage)
+
+	for i := 0; i < o.Concurrency; i++ {
+		go func() {
+			for message := range messages {
+				if err := handleWorkerMessage(o, message.Body); err != nil {
+					fmt.Fprintf(os.Stderr, "cannot process the queue message: %s\n", err)
+					continue
+				}
+				if err := queue.Delete(message); err != nil {
+					fmt.Fprintf(os.Stderr, "cannot delete the queue message: %s\n", err)
+				}
+			}
+		}()
+	}
+
+	debug("imaginary worker consuming %s", o.Queue)
+	for {
+		received, err := queue.Receive()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cannot receive the queue messages: %s\n", err)
+			time.Sleep(time.Duration(o.WaitTime) * time.Second)
+			continue
+		}
+		for _, message := range received {
+			messages <- message
+		}
+	}
+}
+
+// handleWorkerMessage generates and stores the renditions of every image of the given message
+func handleWorkerMessage(o WorkerOptions, body string) error {
+	objects, err := parseWorkerMessage(body)
+	if err != nil {
+		return err
+	}
+
+	for _, object := range objects {
+		// Prevent infinite loops of buckets notifying their own renditions
+		if object.Bucket == o.Destination.Bucket {
+			debug("skipping destination bucket object: %s", object.Key)
+			continue
+		}
+
+		buf, err := fetchObject(o.S3Endpoint, o.AWS, object, o.AllowedOrigins, o.MaxAllowedSize)
+		if err != nil {
+			return err
+		}
+
+		var wg sync.WaitGroup
+		errs := make([]error, len(o.Renditions))
+		for i, rendition := range o.Renditions {
+			wg.Add(1)
+			go func(i int, rendition WorkerRendition) {
+				defer wg.Done()
+				errs[i] = storeRendition(o, object, rendition, buf)
+			}(i, rendition)
+		}
+		wg.Wait()
+
+		for _, err := range errs {
+			if err != nil {
+				return err
+			}
+		}
+		debug("generated %d renditions of %s", len(o.Renditions), object.Key)
+	}
+	return nil
+}
+
+// storeRendition generates the given rendition of the given image, storing it in the destination bucket
+func storeRendition(o WorkerOptions, object workerObject, rendition WorkerRendition, buf []byte) (err error) {
+	// A malformed image must not crash the worker, only fail its message
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("cannot generate the %s rendition of %s: %v", rendition.Name, object.Key, rec)
+		}
+	}()
+
+	// Pipeline mutates its operations, so every run needs its own copy
+	operations := make(PipelineOperations, len(rendition.Operations))
+	copy(operations, rendition.Operations)
+
+	image, err := Pipeline(buf, ImageOptions{Operations: operations})
+	if err != nil {
+		return fmt.Errorf("cannot generate the %s rendition of %s: %s", rendition.Name, object.Key, err)
+	}
+
+	key := renditionKey(o.Destination.Key, rendition.Name, object.Key, ExtractImageTypeFromMime(image.Mime))
+	credential := awsService(o.AWS, "s3", o.Destination.Region)
+	return putObject(s3URL(o.S3Endpoint, o.Destination.Bucket, o.Destination.Region, key).String(), &credential, image, o.Destination.CacheControl)
+}
+
+// fetchObject downloads the given image URL or S3 object, signing the S3 object requests.
+// The image URLs are restricted to the given origins, if any, and every image to the given
+// maximum size, if defined.
+func fetchObject(s3Endpoint string, aws *AWSCredential, object workerObject, origins []*url.URL, maxSize int) ([]byte, error) {
+	rawurl := object.URL
+	if rawurl != "" {
+		u, err := url.Parse(rawurl)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid image URL: %s", rawurl)
+		}
+		if shouldRestrictOrigin(u, origins) {
+			return nil, fmt.Errorf("not allowed image URL origin: %s", u.Host)
+		}
+	} else {
+		if aws == nil {
+			return nil, fmt.Errorf("missing AWS credentials of the %s bucket", object.Bucket)
+		}
+		if object.Region == "" {
+			object.Region = aws.Region
+		}
+		rawurl = s3URL(s3Endpoint, object.Bucket, object.Region, object.Key).String()
+	}
+
+	req, err := http.NewRequest("GET", rawurl, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "imaginary/"+Version)
+	if object.URL == "" {
+		awsService(aws, "s3", object.Region).sign(req, time.Now())
+	}
+
+	res, err := workerClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Error downloading image: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Error downloading image: (status=%d) (url=%s)", res.StatusCode, rawurl)
+	}
+	if maxSize <= 0 {
+		return readAll(res.Body, int(res.ContentLength))
+	}
+
+	if res.ContentLength > int64(maxSize) {
+		return nil, fmt.Errorf("Content-Length %d exceeds maximum allowed %d bytes", res.ContentLength, maxSize)
+	}
+	buf, err := readAll(io.LimitReader(res.Body, int64(maxSize)+1), int(res.ContentLength))
+	if err == nil && len(buf) > maxSize {
+		return nil, fmt.Errorf("image size exceeds maximum allowed %d bytes", maxSize)
+	}
+	return buf, err
+}
+
+// putObject uploads the given image to the given URL, such as an S3 presigned URL, signing
+// the request with the given S3 credential, if any.
+func putObject(rawurl string, s3 *AWSCredential, image Image, cacheControl string) error {
+	req, err := http.NewRequest("PUT", rawurl, bytes.NewReader(image.Body))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = int64(len(image.Body))
+	req.Header.Set("Content-Type", image.Mime)
+	req.Header.Set("User-Agent", "imaginary/"+Version)
+	if cacheControl != "" {
+		req.Header.Set("Cache-Control", cacheControl)
+	}
+	if s3 != nil {
+		s3.signPayload(req, image.Body, time.Now())
+	}
+
+	res, err := workerClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("cannot store the image: %s", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("cannot store the image: (status=%d) (url=%s%s)", res.StatusCode, req.URL.Host, req.URL.Path)
+	}
+	return nil
+}
+
+// parseWorkerMessage parses the original images of the given message: an S3 event notification,
+// optionally wrapped in an SNS notification, or a generic {"bucket", "key"} or {"url"} object.
+func parseWorkerMessage(body string) ([]workerObject, error) {
+	var message struct {
+		Type    string `json:"Type"`
+		Message string `json:"Message"`
+		Event   string `json:"Event"`
+		Records []struct {
+			EventName string `json:"eventName"`
+			Region    string `json:"awsRegion"`
+			S3        struct {
+				Bucket struct {
+					Name string `json:"name"`
+				} `json:"bucket"`
+				Object struct {
+					Key string `json:"key"`
+				} `json:"object"`
+			} `json:"s3"`
+		} `json:"Records"`
+		Bucket string `json:"bucket"`
+		Key    string `json:"key"`
+		URL    string `json:"url"`
+	}
+	if err := json.Unmarshal([]byte(body), &message); err != nil {
+		return nil, fmt.Errorf("invalid message: %s", err)
+	}
+
+	switch {
+	case message.Type == "Notification":
+		return parseWorkerMessage(message.Message)
+	case message.Event == "s3:TestEvent":
+		return nil, nil
+	case message.URL != "":
+		return []workerObject{{URL: message.URL}}, nil
+	case message.Bucket != "" && message.Key != "":
+		return []workerObject{{Bucket: message.Bucket, Key: message.Key}}, nil
+	case len(message.Records) == 0:
+		return nil, fmt.Errorf("invalid message: missing image bucket and key or URL")
+	}
+
+	objects := []workerObject{}
+	for _, record := range message.Records {
+		if !strings.HasPrefix(record.EventName, "ObjectCreated:") {
+			continue
+		}
+		// S3 event notifications object keys are URL encoded
+		key, err := url.QueryUnescape(record.S3.Object.Key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid message object key: %s", record.S3.Object.Key)
+		}
+		objects = append(objects, workerObject{Bucket: record.S3.Bucket.Name, Key: key, Region: record.Region})
+	}
+	return objects, nil
+}
+
+// renditionKey returns the destination object key of the given rendition of the given object key
+func renditionKey(template, rendition, key, ext string) string {
+	dir, file := path.Split(key)
+	name := strings.TrimSuffix(file, path.Ext(file))
+	if ext == "jpeg" {
+		ext = "jpg"
+	}
+
+	replacer := strings.NewReplacer(
+		"{rendition}", rendition,
+		"{key}", key,
+		"{dir}", strings.TrimSuffix(dir, "/"),
+		"{name}", name,
+		"{ext}", ext,
+	)
+	return strings.TrimPrefix(path.Clean("/"+replacer.Replace(template)), "/")
+}
+
+// s3URL returns the URL of the given S3 object: virtual hosted style URL of the AWS S3 region
+// endpoint, or path style URL of the S3 compatible endpoint, if defined.
+func s3URL(endpoint, bucket, region, key string) *url.URL {
+	u := &url.URL{Scheme: "https", Host: bucket + ".s3." + region + ".amazonaws.com", Path: "/" + key}
+	if endpoint != "" {
+		if e, err := url.Parse(endpoint); err == nil {
+			u = &url.URL{Scheme: e.Scheme, Host: e.Host, Path: strings.TrimSuffix(e.Path, "/") + "/" + bucket + "/" + key}
+		}
+	}
+
+	segments := strings.Split(u.Path, "/")
+	for i, segment := range segments {
+		segments[i] = sigV4Escape(segment)
+	}
+	u.RawPath = strings.Join(segments, "/")
+	return u
+}
+
+// awsService returns a copy of the given credential signing the given AWS service region requests
+func awsService(c *AWSCredential, service, region string) AWSCredential {
+	credential := *c
+	credential.Service, credential.Region = service, region
+	return credential
+}
+
+// sqsQueue receives and deletes the messages of an SQS queue via the SQS JSON protocol
+type sqsQueue struct {
+	URL      string
+	WaitTime int
+	AWS      AWSCredential
+}
+
+// Receive long polls the queue messages
+func (q *sqsQueue) Receive() ([]workerMessage, error) {
+	var res struct {
+		Messages []workerMessage `json:"Messages"`
+	}
+	err := q.call("ReceiveMessage", map[string]interface{}{
+		"QueueUrl":            q.URL,
+		"MaxNumberOfMessages": workerMaxMessages,
+		"WaitTimeSeconds":     q.WaitTime,
+	}, &res)
+	return res.Messages, err
+}
+
+// Delete deletes the given processed message
+func (q *sqsQueue) Delete(message workerMessage) error {
+	return q.call("DeleteMessage", map[string]interface{}{
+		"QueueUrl":      q.URL,
+		"ReceiptHandle": message.ReceiptHandle,
+	}, nil)
+}
+
+// call sends the given SQS API action request, decoding its response
+func (q *sqsQueue) call(action string, params map[string]interface{}, response interface{}) error {
+	queueURL, err := url.Parse(q.URL)
+	if err != nil {
+		return err
+	}
+	body, _ := json.Marshal(params)
+
+	req, err := http.NewRequest("POST", queueURL.Scheme+"://"+queueURL.Host+"/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.0")
+	req.Header.Set("X-Amz-Target", "AmazonSQS."+action)
+	q.AWS.signPayload(req, body, time.Now())
+
+	res, err := workerClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		buf, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("SQS %s error: (status=%d) %s", action, res.StatusCode, bytes.TrimSpace(buf))
+	}
+	if response == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(response)
+}
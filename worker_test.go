@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const workerTestConfig = `{
+	"queue": "https://sqs.eu-west-1.amazonaws.com/123456789012/uploads",
+	"aws": {"accessKeyId": "AKID", "secretAccessKey": "secret", "region": "eu-west-1"},
+	"destination": {"bucket": "renditions"},
+	"renditions": [
+		{"name": "thumb", "operations": [{"operation": "thumbnail", "params": {"width": 100, "type": "webp"}}]},
+		{"name": "large", "operations": [{"operation": "resize", "params": {"width": 300}}]}
+	]
+}`
+
+func TestParseWorkerOptions(t *testing.T) {
+	o, err := parseWorkerOptions([]byte(workerTestConfig))
+	if err != nil {
+		t.Fatalf("Cannot parse the worker options: %s", err)
+	}
+	if o.WaitTime != workerWaitTime || o.Concurrency != 1 || o.Destination.Region != "eu-west-1" || o.Destination.Key != workerKeyTemplate {
+		t.Errorf("Invalid worker options defaults: %#v", o)
+	}
+
+	invalid := []string{
+		`{"queue": "uploads"}`,
+		strings.Replace(workerTestConfig, `"bucket": "renditions"`, `"bucket": ""`, 1),
+		strings.Replace(workerTestConfig, `"name": "large"`, `"name": "thumb"`, 1),
+		strings.Replace(workerTestConfig, `"operation": "resize"`, `"operation": "unknown"`, 1),
+		strings.Replace(workerTestConfig, `"region": "eu-west-1"`, `"region": ""`, 1),
+	}
+	for _, config := range invalid {
+		if _, err := parseWorkerOptions([]byte(config)); err == nil {
+			t.Errorf("Expected error of %s", config)
+		}
+	}
+}
+
+func TestParseWorkerMessage(t *testing.T) {
+	event := `{"Records": [
+		{"eventName": "ObjectCreated:Put", "awsRegion": "eu-west-1", "s3": {"bucket": {"name": "uploads"}, "object": {"key": "photos/my+cat%281%29.jpg"}}},
+		{"eventName": "ObjectRemoved:Delete", "s3": {"bucket": {"name": "uploads"}, "object": {"key": "photos/dog.jpg"}}}
+	]}`
+	sns, _ := json.Marshal(map[string]string{"Type": "Notification", "Message": event})
+
+	for _, body := range []string{event, string(sns)} {
+		objects, err := parseWorkerMessage(body)
+		if err != nil {
+			t.Fatalf("Cannot parse the message: %s", err)
+		}
+		if len(objects) != 1 || objects[0] != (workerObject{Bucket: "uploads", Key: "photos/my cat(1).jpg", Region: "eu-west-1"}) {
+			t.Errorf("Invalid message objects: %#v", objects)
+		}
+	}
+
+	cases := []struct {
+		body     string
+		expected []workerObject
+	}{
+		{`{"bucket": "uploads", "key": "cat.jpg"}`, []workerObject{{Bucket: "uploads", Key: "cat.jpg"}}},
+		{`{"url": "https://cdn.example.com/cat.jpg"}`, []workerObject{{URL: "https://cdn.example.com/cat.jpg"}}},
+		{`{"Service": "Amazon S3", "Event": "s3:TestEvent"}`, nil},
+	}
+	for _, c := range cases {
+		objects, err := parseWorkerMessage(c.body)
+		if err != nil || len(objects) != len(c.expected) || (len(objects) > 0 && objects[0] != c.expected[0]) {
+			t.Errorf("Invalid objects of %s: %#v (%v)", c.body, objects, err)
+		}
+	}
+
+	for _, body := range []string{`{}`, `not json`} {
+		if _, err := parseWorkerMessage(body); err == nil {
+			t.Errorf("Expected error of %s", body)
+		}
+	}
+}
+
+func TestRenditionKey(t *testing.T) {
+	cases := []struct {
+		template string
+		expected string
+	}{
+		{workerKeyTemplate, "thumb/cat.webp"},
+		{"{dir}/{name}-{rendition}.{ext}", "photos/2019/cat-thumb.webp"},
+		{"/{rendition}/{key}", "thumb/photos/2019/cat.jpeg"},
+	}
+	for _, c := range cases {
+		if key := renditionKey(c.template, "thumb", "photos/2019/cat.jpeg", "webp"); key != c.expected {
+			t.Errorf("Invalid rendition key of %s: %s", c.template, key)
+		}
+	}
+	if key := renditionKey("{name}.{ext}", "thumb", "cat.png", "jpeg"); key != "cat.jpg" {
+		t.Errorf("Invalid JPEG rendition key: %s", key)
+	}
+}
+
+func TestS3URL(t *testing.T) {
+	if u := s3URL("", "uploads", "eu-west-1", "photos/my cat+1.jpg").String(); u != "https://uploads.s3.eu-west-1.amazonaws.com/photos/my%20cat%2B1.jpg" {
+		t.Errorf("Invalid S3 URL: %s", u)
+	}
+	if u := s3URL("http://localhost:9000/", "uploads", "eu-west-1", "cat.jpg").String(); u != "http://localhost:9000/uploads/cat.jpg" {
+		t.Errorf("Invalid S3 compatible URL: %s", u)
+	}
+}
+
+func TestSQSQueue(t *testing.T) {
+	var deleted string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var params map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&params)
+		if !strings.Contains(r.Header.Get("Authorization"), "/eu-west-1/sqs/aws4_request") {
+			t.Errorf("Invalid Authorization header: %s", r.Header.Get("Authorization"))
+		}
+		switch r.Header.Get("X-Amz-Target") {
+		case "AmazonSQS.ReceiveMessage":
+			w.Write([]byte(`{"Messages": [{"MessageId": "1", "ReceiptHandle": "handle", "Body": "{}"}]}`))
+		case "AmazonSQS.DeleteMessage":
+			deleted = params["ReceiptHandle"].(string)
+			w.Write([]byte(`{}`))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer ts.Close()
+
+	queue := &sqsQueue{URL: ts.URL + "/123456789012/uploads", WaitTime: 1, AWS: AWSCredential{AccessKeyID: "AKID", SecretAccessKey: "secret", Region: "eu-west-1", Service: "sqs"}}
+	messages, err := queue.Receive()
+	if err != nil || len(messages) != 1 || messages[0].ReceiptHandle != "handle" || messages[0].Body != "{}" {
+		t.Fatalf("Invalid received messages: %#v (%v)", messages, err)
+	}
+	if err := queue.Delete(messages[0]); err != nil || deleted != "handle" {
+		t.Errorf("Cannot delete the message: %s", deleted)
+	}
+}
+
+func TestHandleWorkerMessage(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+
+	var mutex sync.Mutex
+	stored := map[string]string{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			if r.URL.Path != "/uploads/photos/cat.jpg" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(buf)
+		case "PUT":
+			mutex.Lock()
+			stored[r.URL.Path] = r.Header.Get("Content-Type")
+			mutex.Unlock()
+		}
+	}))
+	defer ts.Close()
+
+	o, _ := parseWorkerOptions([]byte(workerTestConfig))
+	o.S3Endpoint = ts.URL
+
+	if err := handleWorkerMessage(o, `{"bucket": "uploads", "key": "photos/cat.jpg"}`); err != nil {
+		t.Fatalf("Cannot handle the message: %s", err)
+	}
+	if stored["/renditions/thumb/cat.webp"] != "image/webp" || stored["/renditions/large/cat.jpg"] != "image/jpeg" {
+		t.Errorf("Invalid stored renditions: %v", stored)
+	}
+
+	if err := handleWorkerMessage(o, `{"bucket": "uploads", "key": "photos/missing.jpg"}`); err == nil {
+		t.Error("Expected missing image error")
+	}
+	if err := handleWorkerMessage(o, `{"bucket": "renditions", "key": "thumb/cat.webp"}`); err != nil {
+		t.Errorf("Destination bucket objects should be skipped: %s", err)
+	}
+}
+
+func TestFetchObjectLimits(t *testing.T) {
+	buf, _ := ioutil.ReadAll(readFile("imaginary.jpg"))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(buf)
+	}))
+	defer ts.Close()
+
+	object := workerObject{URL: ts.URL + "/cat.jpg"}
+	if _, err := fetchObject("", nil, object, parseOrigins(ts.URL), len(buf)); err != nil {
+		t.Errorf("Cannot fetch the allowed image: %s", err)
+	}
+	if _, err := fetchObject("", nil, object, parseOrigins("http://server.com"), 0); err == nil {
+		t.Error("Expected not allowed origin error")
+	}
+	if _, err := fetchObject("", nil, object, nil, len(buf)-1); err == nil {
+		t.Error("Expected maximum allowed size error")
+	}
+}